@@ -6,79 +6,72 @@ import (
 	"log"
 	"os"
 	"os/signal"
-	"time"
 
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/app"
 	"fyne.io/fyne/v2/canvas"
 	"github.com/kegsay/gorbslam/internal/orb"
+	"github.com/kegsay/gorbslam/internal/source"
+	"github.com/kegsay/gorbslam/internal/source/capture"
 	"gocv.io/x/gocv"
 )
 
 // Matches ORB keypoints between 2 images
 
 var (
-	flagImg1               = flag.String("img1", "", "First image")
-	flagImg2               = flag.String("img2", "", "Second image")
-	flagVideoCaptureDevice = flag.Int("cam", 0, "video capture device to read from")
+	flagImg1   = flag.String("img1", "", "First image")
+	flagImg2   = flag.String("img2", "", "Second image")
+	flagSource = flag.String("source", "cam:0", capture.Usage)
 )
 
-func matchWebcam(cap int) {
+// matchSource matches each frame of a source to the one before it
+func matchSource(uri string) {
+	src, err := capture.Open(uri)
+	if err != nil {
+		log.Printf("failed to open source: %s", err)
+		os.Exit(1)
+	}
 	a := app.New()
 	w := a.NewWindow("ORB Matches [video]")
 	windowCanvas := w.Canvas()
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	go func() {
+		<-c
+		w.Close()
+	}()
+	// the source is closed by the reader once it stops, which is waited for before returning
+	done := make(chan struct{})
+	stopped := make(chan struct{})
 	go func() {
+		defer close(stopped)
 		resized := false
-		vc, err := gocv.VideoCaptureDevice(cap)
-		if err != nil {
-			log.Printf("failed to load video capture device: %s", err)
-			os.Exit(1)
-		}
-		c := make(chan os.Signal, 1)
-		signal.Notify(c, os.Interrupt)
-		go func() {
-			for range c {
-				//vc.Close()
-				w.Close()
-				close(c)
-			}
-		}()
 		var prevFrame *gocv.Mat
 		var prevKPs []gocv.KeyPoint
 		var prevDescriptors gocv.Mat
-		for {
-			select {
-			case <-c:
+		// at the end of the source the last matches are left on screen
+		err := source.ForEach(src, done, func(f source.Frame) {
+			frame, err := capture.ToMat(f.Image)
+			if err != nil {
+				log.Printf("failed to convert frame: %s", err)
 				return
-			default:
-			}
-			if !vc.IsOpened() {
-				log.Println("waiting for video capture device...")
-				time.Sleep(100 * time.Millisecond)
-				continue
-			}
-			frame := gocv.NewMat()
-			if !vc.Read(&frame) {
-				log.Println("failed to read frame")
 			}
 			if !resized {
 				w.Resize(fyne.NewSize(float32(frame.Cols()*2), float32(frame.Rows())))
 				resized = true
 			}
-			if frame.Empty() {
-				log.Printf("cannot load image")
-				os.Exit(1)
-			}
 
 			kpFrame, dFrame := orb.Features(frame, false)
 			if len(kpFrame) == 0 {
-				continue
+				frame.Close()
+				dFrame.Close()
+				return
 			}
 			if prevFrame == nil {
 				prevFrame = &frame
 				prevDescriptors = dFrame
 				prevKPs = kpFrame
-				continue
+				return
 			}
 			// compare frame and prevFrame
 			matches := orb.MatchDescriptors(dFrame, prevDescriptors)
@@ -87,35 +80,39 @@ func matchWebcam(cap int) {
 				outputMat := gocv.NewMatWithSize(frame.Rows(), frame.Cols()*2, frame.Type())
 				gocv.DrawMatches(frame, kpFrame, *prevFrame, prevKPs, matches, &outputMat, color.RGBA{G: 255}, color.RGBA{B: 255}, nil, gocv.NotDrawSinglePoints)
 				outputImg, err := outputMat.ToImage()
+				outputMat.Close()
 				if err != nil {
 					log.Printf("cannot draw matches: %s", err)
-					continue
+				} else {
+					outputImage := canvas.NewImageFromImage(outputImg)
+					outputImage.ScaleMode = canvas.ImageScaleFastest
+					windowCanvas.SetContent(outputImage)
 				}
-				outputImage := canvas.NewImageFromImage(outputImg)
-				outputImage.ScaleMode = canvas.ImageScaleFastest
-				windowCanvas.SetContent(outputImage)
 			}
 
+			prevFrame.Close()
+			prevDescriptors.Close()
 			prevFrame = &frame
 			prevDescriptors = dFrame
 			prevKPs = kpFrame
+		})
+		if err != nil {
+			log.Printf("giving up reading frames: %s", err)
+			w.Close()
 		}
 	}()
 
 	w.Resize(fyne.NewSize(640, 480))
 	w.ShowAndRun()
+	close(done)
+	<-stopped
 }
 
 func main() {
 	flag.Parse()
-	if *flagImg1 == "" && *flagImg2 == "" && flagVideoCaptureDevice != nil {
-		matchWebcam(*flagVideoCaptureDevice)
-		return
-	}
-
 	if *flagImg1 == "" && *flagImg2 == "" {
-		flag.Usage()
-		os.Exit(1)
+		matchSource(*flagSource)
+		return
 	}
 	img1 := gocv.IMRead(*flagImg1, gocv.IMReadAnyColor)
 	if img1.Empty() {
@@ -2,6 +2,7 @@ package bow
 
 import (
 	"math"
+	"sort"
 )
 
 type WordID uint64
@@ -28,6 +29,16 @@ func (v *BowVector) AddWeightIfNotExist(id WordID, val WordValue) {
 	v.set(id, val)
 }
 
+// Len returns the number of words in the vector
+func (v *BowVector) Len() int {
+	return len(v.wordIDs)
+}
+
+// Entry returns the i-th word and its value, in ascending word ID order
+func (v *BowVector) Entry(i int) (WordID, WordValue) {
+	return v.wordIDs[i], v.wordVals[i]
+}
+
 // L1-Normalizes the values in the vector
 func (v *BowVector) Normalise() {
 	var norm float64
@@ -47,9 +58,6 @@ func (v *BowVector) set(id WordID, val WordValue) {
 		v.wordVals[i] = val
 		return
 	}
-	if i < len(v.wordIDs) && v.wordIDs[i] < id {
-		i++
-	}
 	// insert entry into word IDs and word vals
 	v.wordIDs = append(v.wordIDs, 0)
 	copy(v.wordIDs[i+1:], v.wordIDs[i:])
@@ -59,22 +67,11 @@ func (v *BowVector) set(id WordID, val WordValue) {
 	v.wordVals[i] = val
 }
 
-// Return the index of the next item that is >= than the provided word ID.
+// Return the index of the first item that is >= the provided word ID, which is len(wordIDs) if
+// every item is smaller.
 func (v *BowVector) lowerBound(w WordID) (i int, exists bool) {
-	low := 0
-	hi := len(v.wordIDs) - 1
-	var mid int
-	for low <= hi && hi < len(v.wordIDs) {
-		mid = int((low + hi) / 2)
-		if v.wordIDs[mid] < w { // value was smaller than the one we want, search higher
-			low = mid + 1
-		} else if v.wordIDs[mid] > w { // value was higher than the one we want, search lower
-			hi = mid - 1
-		} else { // we have the value
-			return mid, true
-		}
-	}
-	return mid, false
+	i = sort.Search(len(v.wordIDs), func(j int) bool { return v.wordIDs[j] >= w })
+	return i, i < len(v.wordIDs) && v.wordIDs[i] == w
 }
 
 func (v *BowVector) find(id WordID) (val WordValue, ok bool) {
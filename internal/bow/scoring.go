@@ -4,7 +4,7 @@ import "math"
 
 type Scorer interface {
 	// Computes the score between two vectors. Vectors must be sorted and normalised if needed.
-	Score(a, b []BowVector) float64
+	Score(a, b BowVector) float64
 }
 
 type L1Scorer struct{}
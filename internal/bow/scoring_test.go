@@ -25,3 +25,21 @@ func TestL1Scorer(t *testing.T) {
 		t.Fatalf("got score %v want 1.1", score)
 	}
 }
+
+var _ Scorer = (*L1Scorer)(nil)
+
+func TestL1ScorerDisjoint(t *testing.T) {
+	var s L1Scorer
+	// every word in A is smaller than every word in B, and vice versa
+	a := BowVector{wordIDs: []WordID{1, 2}, wordVals: []WordValue{0.5, 0.5}}
+	b := BowVector{wordIDs: []WordID{7, 9}, wordVals: []WordValue{0.5, 0.5}}
+	if score := s.Score(a, b); score != 0 {
+		t.Errorf("got score %v want 0", score)
+	}
+	if score := s.Score(b, a); score != 0 {
+		t.Errorf("got score %v want 0", score)
+	}
+	if score := s.Score(a, a); score != 1 {
+		t.Errorf("got self score %v want 1", score)
+	}
+}
@@ -0,0 +1,81 @@
+package bow
+
+import (
+	"sort"
+
+	"github.com/kegsay/gorbslam/internal/feature"
+)
+
+// FeatureVector groups the indexes of descriptors by the vocabulary node they passed through at a
+// fixed level of the tree. Only descriptors under the same node need to be compared when matching
+// two images, which is much faster than comparing every pair.
+type FeatureVector struct {
+	// Sorted node IDs
+	NodeIDs []int
+	// Features[i] are the descriptor indexes under NodeIDs[i]
+	Features [][]int
+}
+
+func (fv *FeatureVector) add(nodeID, feature int) {
+	i := sort.SearchInts(fv.NodeIDs, nodeID)
+	if i < len(fv.NodeIDs) && fv.NodeIDs[i] == nodeID {
+		fv.Features[i] = append(fv.Features[i], feature)
+		return
+	}
+	fv.NodeIDs = append(fv.NodeIDs, 0)
+	copy(fv.NodeIDs[i+1:], fv.NodeIDs[i:])
+	fv.NodeIDs[i] = nodeID
+	fv.Features = append(fv.Features, nil)
+	copy(fv.Features[i+1:], fv.Features[i:])
+	fv.Features[i] = []int{feature}
+}
+
+// Transform converts descriptors into a bag of words vector, weighted by TF-IDF and L1 normalised.
+// The feature vector groups the descriptors by their ancestor node levelsUp levels above the
+// words, ORB-SLAM2 uses 4.
+func (v *Vocabulary) Transform(descriptors []feature.Descriptor, levelsUp int) (BowVector, FeatureVector) {
+	var bv BowVector
+	var fv FeatureVector
+	if len(v.Nodes) == 0 {
+		return bv, fv
+	}
+	nodeLevel := v.DepthLevels - levelsUp
+	for i := range descriptors {
+		word, nodeID, ok := v.transformOne(&descriptors[i], nodeLevel)
+		if !ok || word.Weight <= 0 {
+			continue
+		}
+		bv.AddWeight(word.WordID, word.Weight)
+		fv.add(nodeID, i)
+	}
+	bv.Normalise()
+	return bv, fv
+}
+
+// Walk down the tree from the root, picking the closest child at each level, until a leaf. Returns
+// the leaf and the node passed through at nodeLevel (the root is level 0).
+func (v *Vocabulary) transformOne(d *feature.Descriptor, nodeLevel int) (*Node, int, bool) {
+	nodeID := 0
+	current := 0
+	level := 0
+	for len(v.Nodes[current].Children) > 0 {
+		level++
+		children := v.Nodes[current].Children
+		current = children[0]
+		best := d.Distance(&v.Nodes[current].Descriptor)
+		for _, c := range children[1:] {
+			if dist := d.Distance(&v.Nodes[c].Descriptor); dist < best {
+				best = dist
+				current = c
+			}
+		}
+		if level == nodeLevel {
+			nodeID = current
+		}
+	}
+	n := &v.Nodes[current]
+	if current == 0 || !n.IsWord {
+		return nil, 0, false
+	}
+	return n, nodeID, true
+}
@@ -0,0 +1,63 @@
+package bow
+
+import (
+	"math"
+	"testing"
+
+	"github.com/kegsay/gorbslam/internal/feature"
+)
+
+func descriptorWithBits(n int) feature.Descriptor {
+	var d feature.Descriptor
+	for i := 0; i < n; i++ {
+		d[i/8] |= 1 << uint(i%8)
+	}
+	return d
+}
+
+func TestTransform(t *testing.T) {
+	// two branches: descriptors with few bits set go left, with many bits set go right
+	v := NewVocabulary(2, 2)
+	left := v.AddNode(0, descriptorWithBits(0))
+	right := v.AddNode(0, descriptorWithBits(200))
+	w0 := v.AddWord(left, descriptorWithBits(0), 1)
+	w1 := v.AddWord(left, descriptorWithBits(40), 2)
+	w2 := v.AddWord(right, descriptorWithBits(160), 1)
+	// a word which is never useful for recognition
+	v.AddWord(right, descriptorWithBits(256), 0)
+
+	descriptors := []feature.Descriptor{
+		descriptorWithBits(2),   // w0
+		descriptorWithBits(38),  // w1
+		descriptorWithBits(44),  // w1
+		descriptorWithBits(170), // w2
+		descriptorWithBits(250), // zero weight
+	}
+	bv, fv := v.Transform(descriptors, 1)
+
+	want := map[WordID]float64{w0: 1.0 / 6, w1: 4.0 / 6, w2: 1.0 / 6}
+	if bv.Len() != len(want) {
+		t.Fatalf("got %d words want %d", bv.Len(), len(want))
+	}
+	for i := 0; i < bv.Len(); i++ {
+		id, val := bv.Entry(i)
+		if math.Abs(float64(val)-want[id]) > 1e-9 {
+			t.Errorf("word %d: got %v want %v", id, val, want[id])
+		}
+	}
+
+	// one level up from the words is the left and right nodes
+	if len(fv.NodeIDs) != 2 || fv.NodeIDs[0] != left || fv.NodeIDs[1] != right {
+		t.Fatalf("NodeIDs: got %v want [%d %d]", fv.NodeIDs, left, right)
+	}
+	if len(fv.Features[0]) != 3 || len(fv.Features[1]) != 1 || fv.Features[1][0] != 3 {
+		t.Errorf("Features: got %v want [[0 1 2] [3]]", fv.Features)
+	}
+
+	// the same descriptors always transform the same way
+	bv2, _ := v.Transform(descriptors, 1)
+	var s L1Scorer
+	if score := s.Score(bv, bv2); math.Abs(score-1) > 1e-9 {
+		t.Errorf("score with itself: got %v want 1", score)
+	}
+}
@@ -2,21 +2,26 @@ package bow
 
 import (
 	"bufio"
+	"encoding/binary"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"math"
 	"os"
 	"strconv"
 	"strings"
+
+	"github.com/kegsay/gorbslam/internal/feature"
 )
 
 type Node struct {
 	ID         int
 	Parent     int
 	Children   []int
-	Descriptor []uint8
+	Descriptor feature.Descriptor
 
 	// only if the node is a word
+	IsWord bool
 	WordID WordID
 	Weight WordValue
 }
@@ -30,6 +35,41 @@ type Vocabulary struct {
 	Nodes []Node
 }
 
+// NewVocabulary creates a vocabulary containing only the root node, for building a tree with
+// AddNode and AddWord.
+func NewVocabulary(branchingFactor, depthLevels int) *Vocabulary {
+	return &Vocabulary{
+		BranchingFactor: branchingFactor,
+		DepthLevels:     depthLevels,
+		Nodes:           []Node{{}},
+	}
+}
+
+// AddNode adds an internal node under parent, returning its ID
+func (v *Vocabulary) AddNode(parent int, descriptor feature.Descriptor) int {
+	id := len(v.Nodes)
+	v.Nodes[parent].Children = append(v.Nodes[parent].Children, id)
+	before := cap(v.Nodes)
+	v.Nodes = append(v.Nodes, Node{ID: id, Parent: parent, Descriptor: descriptor})
+	if cap(v.Nodes) != before {
+		// the nodes have moved, so the words need to point at the new copies
+		for i := range v.Words {
+			v.Words[i] = &v.Nodes[v.Words[i].ID]
+		}
+	}
+	return id
+}
+
+// AddWord adds a leaf node under parent, returning its word ID
+func (v *Vocabulary) AddWord(parent int, descriptor feature.Descriptor, weight WordValue) WordID {
+	n := &v.Nodes[v.AddNode(parent, descriptor)]
+	n.IsWord = true
+	n.WordID = WordID(len(v.Words))
+	n.Weight = weight
+	v.Words = append(v.Words, n)
+	return n.WordID
+}
+
 // Read a vocabulary file that is compatible with DBoW2 (only a subset of functionality is supported)
 func NewVocabularyFromFile(filename string) (*Vocabulary, error) {
 	file, err := os.Open(filename)
@@ -97,68 +137,79 @@ func NewVocabularyFromReader(reader io.Reader) (*Vocabulary, error) {
 	} else {
 		return nil, fmt.Errorf("no lines read")
 	}
-	v := &Vocabulary{
-		BranchingFactor: *branchingFactor,
-		DepthLevels:     *depthLevels,
-	}
+	v := NewVocabulary(*branchingFactor, *depthLevels)
 	// subsequent lines are nodes, and not all nodes are words for the BoW vectors.
 	expectedNodes := (math.Pow(float64(v.BranchingFactor), 1+float64(v.DepthLevels)) - 1) / (float64(v.BranchingFactor) - 1)
-	expectedWords := math.Pow(float64(v.BranchingFactor), 1+float64(v.DepthLevels)) - 1
-	nodes := make([]Node, 0, int(expectedNodes))
-	words := make([]*Node, 0, int(expectedWords))
-	// start with a root node
-	var root Node
-	nodes = append(nodes, root)
+	expectedWords := math.Pow(float64(v.BranchingFactor), float64(v.DepthLevels))
+	v.Nodes = make([]Node, 1, int(expectedNodes))
+	v.Words = make([]*Node, 0, int(expectedWords))
 
 	for scanner.Scan() {
 		line := scanner.Text()
 		fields := strings.Fields(line)
-		n := Node{
-			ID: len(nodes),
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("too few fields: line %v", line)
 		}
 		parentID, err := strconv.Atoi(fields[0])
-		isLeaf := fields[1] != "0"
 		if err != nil {
 			return nil, fmt.Errorf("parsing parent ID failed: line %v -> %s", line, err)
 		}
-		parent := nodes[parentID]
-		parent.Children = append(parent.Children, n.ID)
-		nodes[parentID] = parent
-		n.Parent = parentID
-
-		// fields [2]->[n-1] are depth levels
-		// TODO: is this right? We skip a bunch of fields here, 32 entries for ORB vectors, but depth is 6.
-		descriptor := make([]uint8, *depthLevels)
+		if parentID < 0 || parentID >= len(v.Nodes) {
+			return nil, fmt.Errorf("unknown parent ID %d: line %v", parentID, line)
+		}
+		isLeaf := fields[1] != "0"
+
+		// fields [2]->[n-2] are the descriptor bytes
+		var descriptor feature.Descriptor
+		if len(fields)-3 != len(descriptor) {
+			return nil, fmt.Errorf("expected %d descriptor bytes, got %d: line %v", len(descriptor), len(fields)-3, line)
+		}
 		for i := 0; i < len(descriptor); i++ {
 			desc, err := strconv.ParseUint(fields[2+i], 10, 8)
 			if err != nil {
-				return nil, fmt.Errorf("parsing depth %v at index %v failed: line %v -> %s", i, i+2, line, err)
+				return nil, fmt.Errorf("parsing descriptor byte %v at index %v failed: line %v -> %s", i, i+2, line, err)
 			}
 			descriptor[i] = uint8(desc)
 		}
-		n.Descriptor = descriptor
 
 		// [n] is the weight
 		weight, err := strconv.ParseFloat(fields[len(fields)-1], 64)
 		if err != nil {
 			return nil, fmt.Errorf("parsing weight failed: line %v -> %s", line, err)
 		}
-		n.Weight = WordValue(weight)
-
 		if isLeaf {
-			wordID := len(words)
-			n.WordID = WordID(wordID)
-			words = append(words, &n)
-		} else if len(n.Children) == 0 {
-			n.Children = make([]int, 0, *branchingFactor)
+			v.AddWord(parentID, descriptor, WordValue(weight))
+		} else {
+			v.AddNode(parentID, descriptor)
 		}
-		nodes = append(nodes, n)
 	}
-	v.Nodes = nodes
-	v.Words = words
 
 	if err := scanner.Err(); err != nil {
 		return nil, err
 	}
 	return v, nil
 }
+
+// Checksum identifies the vocabulary by hashing the tree, so that data computed with one
+// vocabulary (such as the bags of words of a saved map) is not used with another.
+func (v *Vocabulary) Checksum() uint64 {
+	h := fnv.New64a()
+	var buf [8]byte
+	put := func(x uint64) {
+		binary.LittleEndian.PutUint64(buf[:], x)
+		h.Write(buf[:])
+	}
+	put(uint64(v.BranchingFactor))
+	put(uint64(v.DepthLevels))
+	put(uint64(len(v.Nodes)))
+	for i := range v.Nodes {
+		n := &v.Nodes[i]
+		put(uint64(n.Parent))
+		h.Write(n.Descriptor[:])
+		if n.IsWord {
+			put(uint64(n.WordID))
+			put(math.Float64bits(float64(n.Weight)))
+		}
+	}
+	return h.Sum64()
+}
@@ -23,4 +23,34 @@ func TestVocabulary(t *testing.T) {
 	if len(voc.Nodes) != 303 {
 		t.Errorf("num Nodes wrong, got %v want 303", len(voc.Nodes))
 	}
+	if len(voc.Words) != 232 {
+		t.Errorf("num Words wrong, got %v want 232", len(voc.Words))
+	}
+	// every byte of the 256-bit descriptor is read
+	if d := voc.Nodes[1].Descriptor; d[0] != 252 || d[31] != 34 {
+		t.Errorf("descriptor wrong, got %v", d)
+	}
+	for i, w := range voc.Words {
+		if !w.IsWord || int(w.WordID) != i || w != &voc.Nodes[w.ID] {
+			t.Fatalf("word %d is not a leaf node: %+v", i, w)
+		}
+	}
+}
+
+func TestVocabularyChecksum(t *testing.T) {
+	voc, err := NewVocabularyFromReader(bytes.NewReader(VocabFile))
+	if err != nil {
+		t.Fatalf("NewVocabularyFromReader: %s", err)
+	}
+	again, err := NewVocabularyFromReader(bytes.NewReader(VocabFile))
+	if err != nil {
+		t.Fatalf("NewVocabularyFromReader: %s", err)
+	}
+	if voc.Checksum() != again.Checksum() {
+		t.Errorf("the same vocabulary has different checksums")
+	}
+	again.Words[0].Weight += 0.001
+	if voc.Checksum() == again.Checksum() {
+		t.Errorf("changing a weight did not change the checksum")
+	}
 }
@@ -0,0 +1,42 @@
+package camera
+
+import (
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"math"
+)
+
+// DepthImage is the image of an RGB-D camera's depth sensor, registered to the colour image so that
+// each pixel is the depth of the same pixel of the colour image. Like the colour image it is
+// distorted by the lens.
+type DepthImage struct {
+	*image.Gray16
+	// Raw depths are divided by Factor to give metres, e.g 5000 for the TUM RGB-D dataset. A raw
+	// depth of 0 means unknown.
+	Factor float64
+}
+
+// ReadDepthPNG reads a depth image from a 16-bit grayscale PNG, as saved by most RGB-D datasets.
+func ReadDepthPNG(r io.Reader, factor float64) (*DepthImage, error) {
+	img, err := png.Decode(r)
+	if err != nil {
+		return nil, err
+	}
+	gray, ok := img.(*image.Gray16)
+	if !ok {
+		return nil, fmt.Errorf("expected a 16-bit grayscale depth image, got %T", img)
+	}
+	return &DepthImage{Gray16: gray, Factor: factor}, nil
+}
+
+// Depth returns the depth in metres of the pixel containing (x, y), relative to the top left of the
+// image. Returns 0 if the depth is unknown or the pixel is outside the image.
+func (d *DepthImage) Depth(x, y float64) float64 {
+	p := image.Pt(int(math.Floor(x)), int(math.Floor(y))).Add(d.Rect.Min)
+	if !p.In(d.Rect) {
+		return 0
+	}
+	return float64(d.Gray16At(p.X, p.Y).Y) / d.Factor
+}
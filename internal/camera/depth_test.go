@@ -0,0 +1,46 @@
+package camera
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+func TestReadDepthPNG(t *testing.T) {
+	img := image.NewGray16(image.Rect(0, 0, 4, 3))
+	img.SetGray16(1, 2, color.Gray16{Y: 10000})
+	img.SetGray16(3, 0, color.Gray16{Y: 65535})
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("Encode: %s", err)
+	}
+	d, err := ReadDepthPNG(&buf, 5000)
+	if err != nil {
+		t.Fatalf("ReadDepthPNG: %s", err)
+	}
+	testCases := []struct {
+		x, y float64
+		want float64
+	}{
+		{x: 1.2, y: 2.9, want: 2},
+		{x: 3, y: 0.5, want: 13.107},
+		{x: 0, y: 0, want: 0},
+		{x: 4, y: 0, want: 0},
+		{x: -0.5, y: 1, want: 0},
+	}
+	for _, tc := range testCases {
+		if got := d.Depth(tc.x, tc.y); got != tc.want {
+			t.Errorf("(%v, %v): got depth %v want %v", tc.x, tc.y, got, tc.want)
+		}
+	}
+
+	buf.Reset()
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 4, 3))); err != nil {
+		t.Fatalf("Encode: %s", err)
+	}
+	if _, err := ReadDepthPNG(&buf, 5000); err == nil {
+		t.Errorf("read an 8-bit image as a depth image")
+	}
+}
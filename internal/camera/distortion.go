@@ -0,0 +1,74 @@
+package camera
+
+import "math"
+
+// Distortion holds the coefficients of the Brown-Conrady lens model used by OpenCV: radial (K1, K2,
+// K3) and tangential (P1, P2). Keypoints are detected in the distorted image and then undistorted
+// so that the rest of SLAM can use the ideal Pinhole model.
+// Learning: https://docs.opencv.org/4.x/dc/dbb/tutorial_py_calibration.html
+type Distortion struct {
+	K1 float64
+	K2 float64
+	P1 float64
+	P2 float64
+	K3 float64
+}
+
+// IsZero returns true if the lens has no distortion, so pixels need no correction
+func (d Distortion) IsZero() bool {
+	return d == Distortion{}
+}
+
+// distort applies the lens model to a point (x, y) on the normalised image plane (z == 1)
+func (d Distortion) distort(x, y float64) (float64, float64) {
+	r2 := x*x + y*y
+	radial := 1 + d.K1*r2 + d.K2*r2*r2 + d.K3*r2*r2*r2
+	xd := x*radial + 2*d.P1*x*y + d.P2*(r2+2*x*x)
+	yd := y*radial + d.P1*(r2+2*y*y) + 2*d.P2*x*y
+	return xd, yd
+}
+
+// Distort maps an ideal pixel to where the lens actually images it
+func (c Pinhole) Distort(d Distortion, u, v float64) (float64, float64) {
+	x, y := d.distort((u-c.Cx)/c.Fx, (v-c.Cy)/c.Fy)
+	return c.Fx*x + c.Cx, c.Fy*y + c.Cy
+}
+
+// Undistort maps a pixel of the distorted image to the ideal pinhole image. The lens model has no
+// closed-form inverse so this iterates as cv::undistortPoints does, which converges for the
+// moderate distortion of most lenses.
+func (c Pinhole) Undistort(d Distortion, u, v float64) (float64, float64) {
+	if d.IsZero() {
+		return u, v
+	}
+	xd, yd := (u-c.Cx)/c.Fx, (v-c.Cy)/c.Fy
+	x, y := xd, yd
+	for i := 0; i < 20; i++ {
+		r2 := x*x + y*y
+		radial := 1 + d.K1*r2 + d.K2*r2*r2 + d.K3*r2*r2*r2
+		dx := 2*d.P1*x*y + d.P2*(r2+2*x*x)
+		dy := d.P1*(r2+2*y*y) + 2*d.P2*x*y
+		x = (xd - dx) / radial
+		y = (yd - dy) / radial
+	}
+	return c.Fx*x + c.Cx, c.Fy*y + c.Cy
+}
+
+// UndistortedBounds returns the bounds of a width x height image once undistorted, which may be
+// larger or smaller than the image itself. As in ORB-SLAM2 only the corners are undistorted.
+func (c Pinhole) UndistortedBounds(d Distortion, width, height int) (minX, maxX, minY, maxY float64) {
+	w, h := float64(width), float64(height)
+	if d.IsZero() {
+		return 0, w, 0, h
+	}
+	var xs, ys [4]float64
+	xs[0], ys[0] = c.Undistort(d, 0, 0)
+	xs[1], ys[1] = c.Undistort(d, w, 0)
+	xs[2], ys[2] = c.Undistort(d, 0, h)
+	xs[3], ys[3] = c.Undistort(d, w, h)
+	minX = math.Min(xs[0], xs[2])
+	maxX = math.Max(xs[1], xs[3])
+	minY = math.Min(ys[0], ys[1])
+	maxY = math.Max(ys[2], ys[3])
+	return minX, maxX, minY, maxY
+}
@@ -0,0 +1,34 @@
+package camera
+
+import (
+	"math"
+	"testing"
+)
+
+func TestUndistort(t *testing.T) {
+	// a typical webcam: barrel distortion and a little tangential
+	cam := Pinhole{Fx: 517.3, Fy: 516.5, Cx: 318.6, Cy: 255.3}
+	d := Distortion{K1: 0.2624, K2: -0.9531, P1: -0.0054, P2: 0.0026, K3: 1.1633}
+	for _, p := range [][2]float64{{318.6, 255.3}, {10, 10}, {630, 20}, {100, 470}, {600, 400}, {320, 100}} {
+		u, v := cam.Undistort(d, p[0], p[1])
+		du, dv := cam.Distort(d, u, v)
+		if math.Abs(du-p[0]) > 1e-3 || math.Abs(dv-p[1]) > 1e-3 {
+			t.Errorf("%v: undistorted to (%v, %v) which distorts back to (%v, %v)", p, u, v, du, dv)
+		}
+	}
+	if u, v := cam.Undistort(Distortion{}, 12, 34); u != 12 || v != 34 {
+		t.Errorf("no distortion moved the pixel to (%v, %v)", u, v)
+	}
+}
+
+func TestUndistortedBounds(t *testing.T) {
+	cam := Pinhole{Fx: 500, Fy: 500, Cx: 320, Cy: 240}
+	if minX, maxX, minY, maxY := cam.UndistortedBounds(Distortion{}, 640, 480); minX != 0 || maxX != 640 || minY != 0 || maxY != 480 {
+		t.Errorf("no distortion: got bounds x [%v, %v] y [%v, %v]", minX, maxX, minY, maxY)
+	}
+	// barrel distortion squeezes the edges, so the undistorted image is larger
+	minX, maxX, minY, maxY := cam.UndistortedBounds(Distortion{K1: -0.2}, 640, 480)
+	if minX >= 0 || maxX <= 640 || minY >= 0 || maxY <= 480 {
+		t.Errorf("barrel distortion: got bounds x [%v, %v] y [%v, %v]", minX, maxX, minY, maxY)
+	}
+}
@@ -0,0 +1,46 @@
+package camera
+
+import "github.com/kegsay/gorbslam/internal/geom"
+
+// Pinhole is an ideal pinhole camera. Keypoints are expected to have been undistorted before
+// they are used with this model.
+// Learning: https://www.youtube.com/watch?v=26nV4oDLiqc
+type Pinhole struct {
+	// Focal lengths in pixels
+	Fx float64
+	Fy float64
+	// Principal point in pixels
+	Cx float64
+	Cy float64
+}
+
+// K returns the intrinsics matrix
+func (c Pinhole) K() geom.Mat3 {
+	return geom.Mat3{
+		{c.Fx, 0, c.Cx},
+		{0, c.Fy, c.Cy},
+		{0, 0, 1},
+	}
+}
+
+// Project a point in the camera frame onto the image plane. The point must be in front of the camera (z > 0).
+func (c Pinhole) Project(p geom.Vec3) (u, v float64) {
+	invZ := 1 / p[2]
+	return c.Fx*p[0]*invZ + c.Cx, c.Fy*p[1]*invZ + c.Cy
+}
+
+// Unproject a pixel into a ray in the camera frame with z == 1
+func (c Pinhole) Unproject(u, v float64) geom.Vec3 {
+	return geom.Vec3{(u - c.Cx) / c.Fx, (v - c.Cy) / c.Fy, 1}
+}
+
+// ProjectionJacobian returns the derivative of the projected pixel (u, v) with respect to the
+// point p in the camera frame.
+func (c Pinhole) ProjectionJacobian(p geom.Vec3) [2][3]float64 {
+	invZ := 1 / p[2]
+	invZ2 := invZ * invZ
+	return [2][3]float64{
+		{c.Fx * invZ, 0, -c.Fx * p[0] * invZ2},
+		{0, c.Fy * invZ, -c.Fy * p[1] * invZ2},
+	}
+}
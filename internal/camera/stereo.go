@@ -0,0 +1,178 @@
+package camera
+
+import (
+	"image"
+	"math"
+
+	"github.com/kegsay/gorbslam/internal/geom"
+)
+
+// StereoRectification turns the images of a calibrated stereo pair into those of two identical,
+// distortion-free cameras side by side with the same orientation, so that a point lies on the same
+// row of both images and stereo matching only searches along rows. Each camera is rotated about
+// its centre so that the new x axis lies along the baseline, and the new z axis is as close as
+// possible to the average of the two optical axes.
+// Learning: Fusiello et al: "A compact algorithm for rectification of stereo pairs" (2000)
+type StereoRectification struct {
+	// The camera of both rectified images
+	Camera Pinhole
+	// The distance between the camera centres, in the units of the extrinsics
+	Baseline float64
+	// The rotations from the coordinates of the left and right cameras to the rectified ones
+	R1 geom.Mat3
+	R2 geom.Mat3
+	// The size of the original and rectified images
+	Width  int
+	Height int
+
+	left, right rectifiedCamera
+}
+
+// the original camera on one side, and the remap tables from the rectified image to its own
+type rectifiedCamera struct {
+	cam   Pinhole
+	dist  Distortion
+	r     geom.Mat3
+	mapX  []float32
+	mapY  []float32
+	owner *StereoRectification
+}
+
+// NewStereoRectification computes the rectification of a stereo pair of width x height images.
+// tlr is the pose of the right camera relative to the left one: it transforms points from right
+// camera coordinates to left camera coordinates. The rectified focal length is the smaller of the
+// two cameras', so little of the images is lost, and the principal point keeps the centres of the
+// images near the centre. The remap tables are computed once, here.
+func NewStereoRectification(left, right Pinhole, leftDist, rightDist Distortion, tlr geom.SE3, width, height int) *StereoRectification {
+	// the new axes, in left camera coordinates
+	baseline := tlr.T.Norm()
+	e1 := tlr.T.Scale(1 / baseline)
+	z := geom.Vec3{0, 0, 1}.Add(tlr.R.Rotate(geom.Vec3{0, 0, 1}))
+	e2 := z.Cross(e1).Normalised()
+	e3 := e1.Cross(e2)
+	rect := geom.Mat3{e1, e2, e3}
+
+	s := &StereoRectification{
+		Baseline: baseline,
+		R1:       rect,
+		R2:       rect.Mul(tlr.R.Matrix()),
+		Width:    width,
+		Height:   height,
+	}
+	f := math.Min(left.Fy, right.Fy)
+	s.Camera = Pinhole{Fx: f, Fy: f}
+	// place the principal point so the middle of each image ends up, on average, in the middle
+	var sumX, sumY float64
+	for _, c := range []struct {
+		cam Pinhole
+		r   geom.Mat3
+	}{{left, s.R1}, {right, s.R2}} {
+		ray := c.r.MulVec(c.cam.Unproject(float64(width)/2, float64(height)/2))
+		sumX += f * ray[0] / ray[2]
+		sumY += f * ray[1] / ray[2]
+	}
+	s.Camera.Cx = float64(width)/2 - sumX/2
+	s.Camera.Cy = float64(height)/2 - sumY/2
+
+	s.left = rectifiedCamera{cam: left, dist: leftDist, r: s.R1, owner: s}
+	s.right = rectifiedCamera{cam: right, dist: rightDist, r: s.R2, owner: s}
+	s.left.buildMaps()
+	s.right.buildMaps()
+	return s
+}
+
+// Bf returns the baseline times the focal length, as Camera.bf in the settings
+func (s *StereoRectification) Bf() float64 {
+	return s.Camera.Fx * s.Baseline
+}
+
+// P1 and P2 return the projection matrices of the rectified left and right cameras, from left
+// rectified coordinates to homogeneous pixels
+func (s *StereoRectification) P1() [3][4]float64 {
+	k := s.Camera.K()
+	return [3][4]float64{
+		{k[0][0], k[0][1], k[0][2], 0},
+		{k[1][0], k[1][1], k[1][2], 0},
+		{k[2][0], k[2][1], k[2][2], 0},
+	}
+}
+
+// P2 is as P1 for the right camera, which is Baseline along the x axis
+func (s *StereoRectification) P2() [3][4]float64 {
+	p := s.P1()
+	p[0][3] = -s.Bf()
+	return p
+}
+
+// RectifyLeft maps a pixel of the original left image to the rectified image
+func (s *StereoRectification) RectifyLeft(u, v float64) (float64, float64) {
+	return s.left.rectifyPoint(u, v)
+}
+
+// RectifyRight maps a pixel of the original right image to the rectified image
+func (s *StereoRectification) RectifyRight(u, v float64) (float64, float64) {
+	return s.right.rectifyPoint(u, v)
+}
+
+// LeftMaps returns the remap tables of the left image: for each pixel of the rectified image, row
+// by row, the x and y coordinates of the original pixel it comes from. As used by cv::remap.
+func (s *StereoRectification) LeftMaps() (mapX, mapY []float32) {
+	return s.left.mapX, s.left.mapY
+}
+
+// RightMaps returns the remap tables of the right image, as LeftMaps
+func (s *StereoRectification) RightMaps() (mapX, mapY []float32) {
+	return s.right.mapX, s.right.mapY
+}
+
+// Rectify returns the rectified left and right images, interpolating bilinearly. Pixels which
+// come from outside the original images are black.
+func (s *StereoRectification) Rectify(left, right *image.Gray) (*image.Gray, *image.Gray) {
+	return s.left.remap(left), s.right.remap(right)
+}
+
+func (c *rectifiedCamera) rectifyPoint(u, v float64) (float64, float64) {
+	u, v = c.cam.Undistort(c.dist, u, v)
+	return c.owner.Camera.Project(c.r.MulVec(c.cam.Unproject(u, v)))
+}
+
+func (c *rectifiedCamera) buildMaps() {
+	w, h := c.owner.Width, c.owner.Height
+	c.mapX = make([]float32, w*h)
+	c.mapY = make([]float32, w*h)
+	rt := c.r.T()
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := y*w + x
+			ray := rt.MulVec(c.owner.Camera.Unproject(float64(x), float64(y)))
+			if ray[2] <= 0 {
+				c.mapX[i], c.mapY[i] = -1, -1
+				continue
+			}
+			u, v := c.cam.Project(ray)
+			u, v = c.cam.Distort(c.dist, u, v)
+			c.mapX[i], c.mapY[i] = float32(u), float32(v)
+		}
+	}
+}
+
+func (c *rectifiedCamera) remap(src *image.Gray) *image.Gray {
+	w, h := c.owner.Width, c.owner.Height
+	dst := image.NewGray(image.Rect(0, 0, w, h))
+	b := src.Bounds()
+	for i := range c.mapX {
+		x, y := float64(c.mapX[i]), float64(c.mapY[i])
+		x0, y0 := int(math.Floor(x)), int(math.Floor(y))
+		if x0 < 0 || y0 < 0 || x0+1 >= b.Dx() || y0+1 >= b.Dy() {
+			continue
+		}
+		fx, fy := x-float64(x0), y-float64(y0)
+		at := func(x, y int) float64 {
+			return float64(src.Pix[y*src.Stride+x])
+		}
+		top := at(x0, y0)*(1-fx) + at(x0+1, y0)*fx
+		bottom := at(x0, y0+1)*(1-fx) + at(x0+1, y0+1)*fx
+		dst.Pix[(i/w)*dst.Stride+i%w] = uint8(math.Round(top*(1-fy) + bottom*fy))
+	}
+	return dst
+}
@@ -0,0 +1,85 @@
+package camera
+
+import (
+	"image"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/kegsay/gorbslam/internal/geom"
+)
+
+// A rig like the EuRoC one: an 11cm baseline, slightly different lenses and a small misalignment
+func newTestRectification() (*StereoRectification, Pinhole, Pinhole, Distortion, Distortion, geom.SE3) {
+	left := Pinhole{Fx: 458.7, Fy: 457.3, Cx: 367.2, Cy: 248.4}
+	right := Pinhole{Fx: 457.6, Fy: 456.1, Cx: 379.9, Cy: 255.2}
+	leftDist := Distortion{K1: -0.2834, K2: 0.0739, P1: 0.0002, P2: 1.8e-05}
+	rightDist := Distortion{K1: -0.2837, K2: 0.0745, P1: -0.0001, P2: -3.6e-05}
+	tlr := geom.SE3{R: geom.ExpSO3(geom.Vec3{0.003, 0.02, -0.004}), T: geom.Vec3{0.11, -0.0004, 0.0009}}
+	return NewStereoRectification(left, right, leftDist, rightDist, tlr, 752, 480), left, right, leftDist, rightDist, tlr
+}
+
+func TestStereoRectificationPoints(t *testing.T) {
+	s, left, right, leftDist, rightDist, tlr := newTestRectification()
+	if math.Abs(s.Baseline-0.11) > 1e-3 || s.Camera.Fx != 456.1 || s.Bf() != s.Camera.Fx*s.Baseline {
+		t.Errorf("got camera %+v baseline %v", s.Camera, s.Baseline)
+	}
+	if p := s.P2(); p[0][3] != -s.Bf() || p[0][0] != s.Camera.Fx {
+		t.Errorf("got P2 %v", p)
+	}
+	trl := tlr.Inverse()
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		p := left.Unproject(100+rng.Float64()*550, 50+rng.Float64()*380).Scale(1 + rng.Float64()*10)
+		pr := trl.Transform(p)
+		ul, vl := left.Project(p)
+		ul, vl = left.Distort(leftDist, ul, vl)
+		ur, vr := right.Project(pr)
+		ur, vr = right.Distort(rightDist, ur, vr)
+
+		rul, rvl := s.RectifyLeft(ul, vl)
+		rur, rvr := s.RectifyRight(ur, vr)
+		if math.Abs(rvl-rvr) > 1e-3 {
+			t.Errorf("point %v: rectified to rows %v and %v", p, rvl, rvr)
+		}
+		// the disparity gives the depth along the rectified optical axis
+		z := s.R1.MulVec(p)[2]
+		if d := rul - rur; math.Abs(d-s.Bf()/z) > 1e-3 {
+			t.Errorf("point %v: got disparity %v want %v", p, d, s.Bf()/z)
+		}
+	}
+}
+
+func TestStereoRectificationMaps(t *testing.T) {
+	s, _, _, _, _, _ := newTestRectification()
+	mapX, mapY := s.LeftMaps()
+	for _, p := range [][2]int{{376, 240}, {50, 40}, {700, 450}} {
+		i := p[1]*s.Width + p[0]
+		u, v := s.RectifyLeft(float64(mapX[i]), float64(mapY[i]))
+		if math.Abs(u-float64(p[0])) > 1e-3 || math.Abs(v-float64(p[1])) > 1e-3 {
+			t.Errorf("rectified pixel %v comes from (%v, %v), which rectifies to (%v, %v)", p, mapX[i], mapY[i], u, v)
+		}
+	}
+
+	// an image whose brightness is a quarter of the x coordinate
+	src := image.NewGray(image.Rect(0, 0, s.Width, s.Height))
+	for y := 0; y < s.Height; y++ {
+		for x := 0; x < s.Width; x++ {
+			src.Pix[y*src.Stride+x] = uint8(x / 4)
+		}
+	}
+	_, rectified := s.Rectify(src, src)
+	mapX, mapY = s.RightMaps()
+	for y := 0; y < s.Height; y += 10 {
+		for x := 0; x < s.Width; x += 10 {
+			i := y*s.Width + x
+			want := 0.0
+			if mapX[i] >= 0 && mapY[i] >= 0 && mapX[i] < float32(s.Width-1) && mapY[i] < float32(s.Height-1) {
+				want = float64(mapX[i]) / 4
+			}
+			if got := float64(rectified.Pix[y*rectified.Stride+x]); math.Abs(got-want) > 1 {
+				t.Errorf("(%d, %d): got %v want %v", x, y, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,113 @@
+// Package dataset reads the sequences of public SLAM benchmarks, so that the system can be
+// evaluated against their ground truth. Each sequence gives its images as a source.FrameSource
+// and the true trajectory of the camera.
+package dataset
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/kegsay/gorbslam/internal/geom"
+	"github.com/kegsay/gorbslam/internal/imu"
+	"github.com/kegsay/gorbslam/internal/source"
+)
+
+// Pose is where the ground truth says the camera was at a time
+type Pose struct {
+	Timestamp time.Time
+	// Tcw: the transformation from world to camera coordinates, as the tracker estimates
+	Pose geom.SE3
+}
+
+// Trajectory is a ground truth trajectory, in time order
+type Trajectory []Pose
+
+// At returns the pose nearest in time to ts, false if there is none within maxDiff of it
+func (t Trajectory) At(ts time.Time, maxDiff time.Duration) (geom.SE3, bool) {
+	// the first pose at or after ts, and the one before it
+	i := sort.Search(len(t), func(i int) bool { return !t[i].Timestamp.Before(ts) })
+	best, bestDiff := -1, maxDiff
+	for _, j := range []int{i - 1, i} {
+		if j < 0 || j >= len(t) {
+			continue
+		}
+		if d := absDuration(t[j].Timestamp.Sub(ts)); d <= bestDiff {
+			best, bestDiff = j, d
+		}
+	}
+	if best < 0 {
+		return geom.SE3{}, false
+	}
+	return t[best].Pose, true
+}
+
+// stereoSequence reads pairs of left and right images, one pair at a time, with the IMU
+// measurements since the previous pair if there are any. As ORB-SLAM3, the first pair only has the
+// last measurement taken before it.
+type stereoSequence struct {
+	left, right []source.ImageFile
+	imu         []imu.Measurement
+	next        int
+	// the first IMU measurement not yet given to a frame
+	nextIMU int
+}
+
+func (s *stereoSequence) Next() (source.Frame, error) {
+	if s.next >= len(s.left) {
+		return source.Frame{}, io.EOF
+	}
+	left, right := s.left[s.next], s.right[s.next]
+	ms := s.imu
+	if s.next == 0 {
+		for s.nextIMU < len(ms)-1 && !ms[s.nextIMU+1].Timestamp.After(left.Timestamp) {
+			s.nextIMU++
+		}
+	}
+	s.next++
+	var frameIMU []imu.Measurement
+	for ; s.nextIMU < len(ms) && !ms[s.nextIMU].Timestamp.After(left.Timestamp); s.nextIMU++ {
+		frameIMU = append(frameIMU, ms[s.nextIMU])
+	}
+	leftImg, err := source.ReadImage(left.Path)
+	if err != nil {
+		return source.Frame{}, err
+	}
+	rightImg, err := source.ReadImage(right.Path)
+	if err != nil {
+		return source.Frame{}, err
+	}
+	return source.Frame{Image: leftImg, Right: rightImg, Timestamp: left.Timestamp, IMU: frameIMU}, nil
+}
+
+func (s *stereoSequence) Close() error {
+	return nil
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// parseFloats parses every field as a number
+func parseFloats(fields []string) ([]float64, error) {
+	values := make([]float64, len(fields))
+	for i, field := range fields {
+		v, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return nil, fmt.Errorf("expected a number, got '%s'", field)
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+// formatSeconds formats a timestamp as seconds since the Unix epoch with microseconds, as the TUM
+// RGB-D files do
+func formatSeconds(ts time.Time) string {
+	return fmt.Sprintf("%d.%06d", ts.Unix(), ts.Nanosecond()/1e3)
+}
@@ -0,0 +1,372 @@
+package dataset
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kegsay/gorbslam/internal/camera"
+	"github.com/kegsay/gorbslam/internal/geom"
+	"github.com/kegsay/gorbslam/internal/imu"
+	"github.com/kegsay/gorbslam/internal/settings"
+	"github.com/kegsay/gorbslam/internal/source"
+)
+
+// EuRoCMaxDifference is how far apart the images of the two cameras may be taken to be a stereo
+// pair. The cameras are triggered together, so their timestamps normally match exactly.
+const EuRoCMaxDifference = time.Millisecond
+
+// EuRoCCamera is a camera of the EuRoC MAV dataset, as described by its sensor.yaml
+type EuRoCCamera struct {
+	Camera     camera.Pinhole
+	Distortion camera.Distortion
+	// Tbc: the pose of the camera on the body, transforming points from camera to body (IMU)
+	// coordinates
+	Tbc    geom.SE3
+	Width  int
+	Height int
+	// Images per second
+	Rate float64
+}
+
+// EuRoC is a sequence of the EuRoC MAV dataset in the ASL folder layout:
+//
+//	mav0/cam0/data.csv, data/      the left images, listed as "timestamp [ns],filename"
+//	mav0/cam0/sensor.yaml          the left camera's intrinsics and pose on the body
+//	mav0/cam1/...                  likewise for the right camera
+//	mav0/imu0/data.csv             the IMU measurements
+//	mav0/imu0/sensor.yaml          the IMU's noise
+//	mav0/state_groundtruth_estimate0/data.csv  the pose of the body, with its velocity and biases
+//
+// Learning: Burri et al: "The EuRoC micro aerial vehicle datasets" (2016)
+type EuRoC struct {
+	// The mav0 directory
+	Dir string
+	// The images of both cameras, each left image with the right one taken at the same time
+	Left  []source.ImageFile
+	Right []source.ImageFile
+	// The cameras, cam0 on the left
+	LeftCamera  EuRoCCamera
+	RightCamera EuRoCCamera
+	// The IMU measurements, oldest first, and the calibration relating them to the left camera
+	IMU            []imu.Measurement
+	IMUCalibration *imu.Calibration
+	// The poses of the left camera, empty if the sequence has no ground truth
+	GroundTruth Trajectory
+}
+
+// OpenEuRoC reads a sequence of the EuRoC MAV dataset, given its directory or the mav0 directory
+// within it. The images and the IMU are required, the ground truth is not.
+func OpenEuRoC(dir string) (*EuRoC, error) {
+	if info, err := os.Stat(filepath.Join(dir, "mav0")); err == nil && info.IsDir() {
+		dir = filepath.Join(dir, "mav0")
+	}
+	e := &EuRoC{Dir: dir}
+	var err error
+	if e.LeftCamera, err = readEuRoCCamera(filepath.Join(dir, "cam0", "sensor.yaml")); err != nil {
+		return nil, err
+	}
+	if e.RightCamera, err = readEuRoCCamera(filepath.Join(dir, "cam1", "sensor.yaml")); err != nil {
+		return nil, err
+	}
+	left, err := readEuRoCImages(filepath.Join(dir, "cam0"))
+	if err != nil {
+		return nil, err
+	}
+	right, err := readEuRoCImages(filepath.Join(dir, "cam1"))
+	if err != nil {
+		return nil, err
+	}
+	e.Left, e.Right = synchronise(left, right, EuRoCMaxDifference)
+
+	f, err := os.Open(filepath.Join(dir, "imu0", "data.csv"))
+	if err != nil {
+		return nil, err
+	}
+	e.IMU, err = imu.ReadEuRoCCSV(f)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("imu0/data.csv: %s", err)
+	}
+	if e.IMUCalibration, err = readEuRoCIMU(filepath.Join(dir, "imu0", "sensor.yaml"), e.LeftCamera.Tbc); err != nil {
+		return nil, err
+	}
+
+	if f, err := os.Open(filepath.Join(dir, "state_groundtruth_estimate0", "data.csv")); err == nil {
+		e.GroundTruth, err = ReadEuRoCGroundTruth(f, e.LeftCamera.Tbc)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("state_groundtruth_estimate0/data.csv: %s", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Tlr returns the pose of the right camera relative to the left one: it transforms points from
+// right camera coordinates to left camera coordinates, as settings.RightCamera
+func (e *EuRoC) Tlr() geom.SE3 {
+	return e.LeftCamera.Tbc.Inverse().Mul(e.RightCamera.Tbc)
+}
+
+// Frames returns a source of the stereo pairs, each with the IMU measurements since the previous
+// pair. As ORB-SLAM3, the first pair only has the last measurement taken before it.
+func (e *EuRoC) Frames() source.FrameSource {
+	return &stereoSequence{left: e.Left, right: e.Right, imu: e.IMU}
+}
+
+// synchronise pairs the images of two cameras taken within maxDiff of each other, dropping those
+// of either camera without a partner
+func synchronise(left, right []source.ImageFile, maxDiff time.Duration) ([]source.ImageFile, []source.ImageFile) {
+	var l, r []source.ImageFile
+	for i, j := 0, 0; i < len(left) && j < len(right); {
+		d := right[j].Timestamp.Sub(left[i].Timestamp)
+		switch {
+		case absDuration(d) <= maxDiff:
+			l, r = append(l, left[i]), append(r, right[j])
+			i++
+			j++
+		case d < 0:
+			j++
+		default:
+			i++
+		}
+	}
+	return l, r
+}
+
+// readEuRoCImages reads the data.csv of a camera, listing its images in the data directory
+func readEuRoCImages(dir string) ([]source.ImageFile, error) {
+	f, err := os.Open(filepath.Join(dir, "data.csv"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var files []source.ImageFile
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, ",")
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s/data.csv: line %d: expected a timestamp and a file name, got '%s'", filepath.Base(dir), line, text)
+		}
+		ns, err := strconv.ParseInt(strings.TrimSpace(fields[0]), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s/data.csv: line %d: invalid timestamp '%s'", filepath.Base(dir), line, fields[0])
+		}
+		files = append(files, source.ImageFile{
+			Path:      filepath.Join(dir, "data", strings.TrimSpace(fields[1])),
+			Timestamp: time.Unix(0, ns),
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// readSensorYAML reads the key-value pairs of a sensor.yaml
+func readSensorYAML(filename string) (map[string]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	values, err := settings.Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	return values, nil
+}
+
+// readEuRoCCamera reads the sensor.yaml of a camera:
+//
+//	T_BS:
+//	  cols: 4
+//	  rows: 4
+//	  data: [0.0148655429818, -0.999880929698, 0.00414029679422, -0.0216401454975, ...]
+//	rate_hz: 20
+//	resolution: [752, 480]
+//	camera_model: pinhole
+//	intrinsics: [458.654, 457.296, 367.215, 248.375] #fu, fv, cu, cv
+//	distortion_model: radial-tangential
+//	distortion_coefficients: [-0.28340811, 0.07395907, 0.00019359, 1.76187114e-05]
+func readEuRoCCamera(filename string) (EuRoCCamera, error) {
+	values, err := readSensorYAML(filename)
+	if err != nil {
+		return EuRoCCamera{}, err
+	}
+	errorf := func(format string, args ...interface{}) (EuRoCCamera, error) {
+		return EuRoCCamera{}, fmt.Errorf("%s: %s", filename, fmt.Sprintf(format, args...))
+	}
+	if model := values["camera_model"]; model != "pinhole" {
+		return errorf("unsupported camera model '%s'", model)
+	}
+	if model := values["distortion_model"]; model != "radial-tangential" {
+		return errorf("unsupported distortion model '%s'", model)
+	}
+	var c EuRoCCamera
+	if c.Tbc, err = sensorTransform(values); err != nil {
+		return errorf("%s", err)
+	}
+	intrinsics, err := sensorList(values, "intrinsics", 4)
+	if err != nil {
+		return errorf("%s", err)
+	}
+	c.Camera = camera.Pinhole{Fx: intrinsics[0], Fy: intrinsics[1], Cx: intrinsics[2], Cy: intrinsics[3]}
+	dist, err := sensorList(values, "distortion_coefficients", 4)
+	if err != nil {
+		return errorf("%s", err)
+	}
+	c.Distortion = camera.Distortion{K1: dist[0], K2: dist[1], P1: dist[2], P2: dist[3]}
+	resolution, err := sensorList(values, "resolution", 2)
+	if err != nil {
+		return errorf("%s", err)
+	}
+	c.Width, c.Height = int(resolution[0]), int(resolution[1])
+	if c.Rate, err = sensorFloat(values, "rate_hz"); err != nil {
+		return errorf("%s", err)
+	}
+	if c.Camera.Fx <= 0 || c.Camera.Fy <= 0 || c.Width <= 0 || c.Height <= 0 || c.Rate <= 0 {
+		return errorf("focal lengths, resolution and rate must be positive")
+	}
+	return c, nil
+}
+
+// readEuRoCIMU reads the sensor.yaml of the IMU:
+//
+//	T_BS:
+//	  ...
+//	rate_hz: 200
+//	gyroscope_noise_density: 1.6968e-04     # [ rad / s / sqrt(Hz) ]   ( gyro "white noise" )
+//	gyroscope_random_walk: 1.9393e-05       # [ rad / s^2 / sqrt(Hz) ] ( gyro bias diffusion )
+//	accelerometer_noise_density: 2.0000e-3  # [ m / s^2 / sqrt(Hz) ]   ( accel "white noise" )
+//	accelerometer_random_walk: 3.0000e-3    # [ m / s^3 / sqrt(Hz) ].  ( accel bias diffusion )
+//
+// tbc is the pose of the camera on the body, which the IMU's T_BS is relative to as well.
+func readEuRoCIMU(filename string, tbc geom.SE3) (*imu.Calibration, error) {
+	values, err := readSensorYAML(filename)
+	if err != nil {
+		return nil, err
+	}
+	var v [5]float64
+	for i, key := range []string{"gyroscope_noise_density", "accelerometer_noise_density", "gyroscope_random_walk", "accelerometer_random_walk", "rate_hz"} {
+		if v[i], err = sensorFloat(values, key); err != nil {
+			return nil, fmt.Errorf("%s: %s", filename, err)
+		}
+		if v[i] <= 0 {
+			return nil, fmt.Errorf("%s: %s must be positive", filename, key)
+		}
+	}
+	// the body frame is the IMU's in the dataset, but be general: Tic = Tib * Tbc
+	tbi, err := sensorTransform(values)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	return imu.NewCalibration(tbi.Inverse().Mul(tbc), v[0], v[1], v[2], v[3], v[4]), nil
+}
+
+// ReadEuRoCGroundTruth reads the state_groundtruth_estimate0/data.csv of a sequence, giving the
+// poses of the camera whose pose on the body is tbc. Each line is a timestamp in nanoseconds, the
+// position and orientation (w, x, y, z) of the body in the world, then its velocity and biases:
+//
+//	#timestamp, p_RS_R_x [m], p_RS_R_y [m], p_RS_R_z [m], q_RS_w [], q_RS_x [], q_RS_y [], q_RS_z [], v_RS_R_x [m s^-1], ...
+//	1403636580838555648,4.688319,-1.786938,0.783338,0.534108,-0.153029,-0.827383,-0.082152,...
+func ReadEuRoCGroundTruth(r io.Reader, tbc geom.SE3) (Trajectory, error) {
+	var t Trajectory
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, ",")
+		if len(fields) < 8 {
+			return nil, fmt.Errorf("line %d: expected a timestamp, position and quaternion, got '%s'", line, text)
+		}
+		ns, err := strconv.ParseInt(strings.TrimSpace(fields[0]), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid timestamp '%s'", line, fields[0])
+		}
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+		v, err := parseFloats(fields[1:8])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+		q := geom.Quaternion{W: v[3], X: v[4], Y: v[5], Z: v[6]}
+		if q.Norm() == 0 {
+			return nil, fmt.Errorf("line %d: zero quaternion", line)
+		}
+		ts := time.Unix(0, ns)
+		if len(t) > 0 && ts.Before(t[len(t)-1].Timestamp) {
+			return nil, fmt.Errorf("line %d: timestamps are not in order", line)
+		}
+		twb := geom.SE3{R: geom.SO3FromQuaternion(q.Normalised()), T: geom.Vec3{v[0], v[1], v[2]}}
+		t = append(t, Pose{Timestamp: ts, Pose: twb.Mul(tbc).Inverse()})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// sensorFloat returns a number from a sensor.yaml
+func sensorFloat(values map[string]string, key string) (float64, error) {
+	v, ok := values[key]
+	if !ok {
+		return 0, fmt.Errorf("missing %s", key)
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s: expected a number, got '%s'", key, v)
+	}
+	return f, nil
+}
+
+// sensorList returns a list of n numbers such as "[752, 480]" from a sensor.yaml
+func sensorList(values map[string]string, key string, n int) ([]float64, error) {
+	v, ok := values[key]
+	if !ok {
+		return nil, fmt.Errorf("missing %s", key)
+	}
+	fields := strings.Split(strings.Trim(v, "[] "), ",")
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	list, err := parseFloats(fields)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", key, err)
+	}
+	if len(list) != n {
+		return nil, fmt.Errorf("%s: expected %d numbers, got %d", key, n, len(list))
+	}
+	return list, nil
+}
+
+// sensorTransform returns the T_BS of a sensor.yaml: the pose of the sensor on the body, as a 4x4
+// matrix row by row
+func sensorTransform(values map[string]string) (geom.SE3, error) {
+	if rows, cols := values["T_BS.rows"], values["T_BS.cols"]; rows != "4" || cols != "4" {
+		return geom.SE3{}, fmt.Errorf("T_BS: expected a 4x4 matrix, got %sx%s", rows, cols)
+	}
+	t, err := sensorList(values, "T_BS.data", 16)
+	if err != nil {
+		return geom.SE3{}, err
+	}
+	var r geom.Mat3
+	for i := range r {
+		copy(r[i][:], t[i*4:i*4+3])
+	}
+	return geom.SE3{R: geom.NewSO3(r).Normalised(), T: geom.Vec3{t[3], t[7], t[11]}}, nil
+}
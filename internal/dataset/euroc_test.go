@@ -0,0 +1,173 @@
+package dataset
+
+import (
+	"image/color"
+	"io"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kegsay/gorbslam/internal/camera"
+	"github.com/kegsay/gorbslam/internal/geom"
+)
+
+// eurocTime returns a timestamp in the fabricated EuRoC sequence from milliseconds after its first
+// image
+func eurocTime(ms int) time.Time {
+	return time.Unix(0, 1403636579763555584).Add(time.Duration(ms) * time.Millisecond)
+}
+
+func TestOpenEuRoC(t *testing.T) {
+	seq, err := OpenEuRoC("testdata/euroc")
+	if err != nil {
+		t.Fatalf("OpenEuRoC: %s", err)
+	}
+	if want := filepath.Join("testdata", "euroc", "mav0"); seq.Dir != want {
+		t.Errorf("got directory %s want %s", seq.Dir, want)
+	}
+	left := seq.LeftCamera
+	if want := (camera.Pinhole{Fx: 458.654, Fy: 457.296, Cx: 367.215, Cy: 248.375}); left.Camera != want {
+		t.Errorf("got camera %+v want %+v", left.Camera, want)
+	}
+	if want := (camera.Distortion{K1: -0.28340811, K2: 0.07395907, P1: 0.00019359, P2: 1.76187114e-05}); left.Distortion != want {
+		t.Errorf("got distortion %+v want %+v", left.Distortion, want)
+	}
+	if left.Width != 752 || left.Height != 480 || left.Rate != 20 {
+		t.Errorf("got %dx%d at %v Hz", left.Width, left.Height, left.Rate)
+	}
+	if d := left.Tbc.T.Sub(geom.Vec3{-0.0216401454975, -0.064676986768, 0.00981073058949}).Norm(); d > 1e-12 {
+		t.Errorf("got left camera at %v on the body", left.Tbc.T)
+	}
+	// the cameras are 11cm apart, the right one along the left's x axis and almost parallel to it
+	tlr := seq.Tlr()
+	if baseline := tlr.T.Norm(); math.Abs(baseline-0.110) > 1e-3 {
+		t.Errorf("got baseline %v", baseline)
+	}
+	if tlr.T[0] < 0.109 || tlr.R.Angle() > 0.02 {
+		t.Errorf("got Tlr %+v", tlr)
+	}
+
+	// the IMU is the body, so relates to the left camera as it does
+	calib := seq.IMUCalibration
+	if calib == nil || calib.Tbc.T.Sub(left.Tbc.T).Norm() > 1e-12 || calib.Tbc.R.Mul(left.Tbc.R.Inverse()).Angle() > 1e-9 {
+		t.Fatalf("got IMU calibration %+v", calib)
+	}
+	if want := 1.6968e-04 * math.Sqrt(200); math.Abs(calib.NoiseGyro-want) > 1e-12 {
+		t.Errorf("got gyro noise %v want %v", calib.NoiseGyro, want)
+	}
+	if len(seq.IMU) != 36 {
+		t.Errorf("got %d IMU measurements", len(seq.IMU))
+	}
+}
+
+func TestEuRoCFrames(t *testing.T) {
+	seq, err := OpenEuRoC("testdata/euroc/mav0")
+	if err != nil {
+		t.Fatalf("OpenEuRoC: %s", err)
+	}
+	// the right camera has no image 100ms in, so the left one is dropped too
+	want := []int{0, 50, 150}
+	if len(seq.Left) != len(want) || len(seq.Right) != len(want) {
+		t.Fatalf("got %d left and %d right images want %d pairs", len(seq.Left), len(seq.Right), len(want))
+	}
+	src := seq.Frames()
+	defer src.Close()
+	// the first frame has the measurement taken with it, the others those since the previous frame
+	wantIMU := []int{1, 10, 20}
+	for i := 0; ; i++ {
+		f, err := src.Next()
+		if err == io.EOF {
+			if i != len(want) {
+				t.Errorf("got %d frames want %d", i, len(want))
+			}
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next: %s", err)
+		}
+		if !f.Timestamp.Equal(eurocTime(want[i])) {
+			t.Errorf("frame %d: got timestamp %v", i, f.Timestamp)
+		}
+		// each image of a camera is a different shade, brighter on the right
+		shade := uint8(10 * (want[i]/50 + 1))
+		if f.Right == nil {
+			t.Fatalf("frame %d: no right image", i)
+		}
+		if l, r := color.GrayModel.Convert(f.Image.At(1, 1)).(color.Gray).Y, color.GrayModel.Convert(f.Right.At(1, 1)).(color.Gray).Y; l != shade || r != 100+shade {
+			t.Errorf("frame %d: got shades %d and %d want %d and %d", i, l, r, shade, 100+shade)
+		}
+		if len(f.IMU) != wantIMU[i] {
+			t.Errorf("frame %d: got %d IMU measurements want %d", i, len(f.IMU), wantIMU[i])
+			continue
+		}
+		if last := f.IMU[len(f.IMU)-1]; !last.Timestamp.Equal(f.Timestamp) {
+			t.Errorf("frame %d: last IMU measurement at %v", i, last.Timestamp)
+		}
+	}
+}
+
+func TestEuRoCGroundTruth(t *testing.T) {
+	seq, err := OpenEuRoC("testdata/euroc")
+	if err != nil {
+		t.Fatalf("OpenEuRoC: %s", err)
+	}
+	if len(seq.GroundTruth) != 2 {
+		t.Fatalf("got %d poses", len(seq.GroundTruth))
+	}
+	tbc := seq.LeftCamera.Tbc
+	// the file gives the body's pose, at (1.1, 2, 3) and turned 90 degrees about z, but poses are
+	// the left camera's Tcw
+	pose, ok := seq.GroundTruth.At(eurocTime(50), time.Millisecond)
+	if !ok {
+		t.Fatalf("no ground truth pose")
+	}
+	rwb := geom.ExpSO3(geom.Vec3{0, 0, math.Pi / 2})
+	if d := pose.Center().Sub(geom.Vec3{1.1, 2, 3}.Add(rwb.Rotate(tbc.T))).Norm(); d > 1e-6 {
+		t.Errorf("got camera centre %v", pose.Center())
+	}
+	if angle := pose.R.Mul(rwb.Mul(tbc.R)).Angle(); angle > 1e-6 {
+		t.Errorf("rotation is %v rad off", angle)
+	}
+
+	if _, err := ReadEuRoCGroundTruth(strings.NewReader("1403636579763555584,1,2,3\n"), tbc); err == nil {
+		t.Errorf("expected an error for a pose without a quaternion")
+	}
+	if _, err := ReadEuRoCGroundTruth(strings.NewReader("1403636579763555584,1,2,3,0,0,0,0\n"), tbc); err == nil {
+		t.Errorf("expected an error for a zero quaternion")
+	}
+}
+
+func TestReadEuRoCCamera(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "sensor.yaml")
+	sensor := `T_BS:
+  cols: 4
+  rows: 4
+  data: [1, 0, 0, 0, 0, 1, 0, 0, 0, 0, 1, 0, 0, 0, 0, 1]
+rate_hz: 20
+resolution: [752, 480]
+camera_model: pinhole
+intrinsics: [458.654, 457.296, 367.215, 248.375]
+distortion_model: radial-tangential
+distortion_coefficients: [-0.28340811, 0.07395907, 0.00019359, 1.76187114e-05]
+`
+	writeFile(t, filename, sensor)
+	if _, err := readEuRoCCamera(filename); err != nil {
+		t.Fatalf("readEuRoCCamera: %s", err)
+	}
+	testCases := map[string][2]string{
+		"another camera model":    {"camera_model: pinhole", "camera_model: omni"},
+		"too few intrinsics":      {"367.215, 248.375]", "367.215]"},
+		"a 3x3 T_BS":              {"rows: 4", "rows: 3"},
+		"no resolution":           {"resolution: [752, 480]", ""},
+		"a non-numeric rate":      {"rate_hz: 20", "rate_hz: fast"},
+		"a negative focal length": {"[458.654", "[-458.654"},
+	}
+	for name, replace := range testCases {
+		writeFile(t, filename, strings.Replace(sensor, replace[0], replace[1], 1))
+		if _, err := readEuRoCCamera(filename); err == nil {
+			t.Errorf("expected an error for %s", name)
+		}
+	}
+}
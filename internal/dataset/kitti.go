@@ -0,0 +1,227 @@
+package dataset
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kegsay/gorbslam/internal/camera"
+	"github.com/kegsay/gorbslam/internal/geom"
+	"github.com/kegsay/gorbslam/internal/source"
+)
+
+// KITTI is a sequence of the KITTI odometry benchmark, laid out as it is downloaded:
+//
+//	sequences/XX/image_0/NNNNNN.png  the left greyscale images, rectified
+//	sequences/XX/image_1/NNNNNN.png  the right ones
+//	sequences/XX/times.txt           the time of each image in seconds from the start
+//	sequences/XX/calib.txt           the projection matrices of the rectified cameras
+//	poses/XX.txt                     the poses of the left camera, Twc as 3x4 matrices
+//
+// Learning: Geiger et al: "Are we ready for Autonomous Driving? The KITTI Vision Benchmark Suite"
+// (2012)
+type KITTI struct {
+	// The sequence directory, sequences/XX
+	Dir   string
+	Left  []source.ImageFile
+	Right []source.ImageFile
+	// The cameras as rectified, so without distortion and with the same focal length
+	LeftCamera  camera.Pinhole
+	RightCamera camera.Pinhole
+	// The distance between the cameras in metres, the right one along the left's x axis
+	Baseline float64
+	// Empty if the sequence has no ground truth, as for sequences 11 to 21
+	GroundTruth Trajectory
+}
+
+// OpenKITTI reads a sequence of the KITTI odometry benchmark, given its directory sequences/XX.
+// Its ground truth is read from poses/XX.txt next to sequences, if there is one.
+func OpenKITTI(dir string) (*KITTI, error) {
+	dir = filepath.Clean(dir)
+	k := &KITTI{Dir: dir}
+	f, err := os.Open(filepath.Join(dir, "calib.txt"))
+	if err != nil {
+		return nil, err
+	}
+	calib, err := readKITTICalibration(f)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("calib.txt: %s", err)
+	}
+	p0, ok := calib["P0"]
+	if !ok {
+		return nil, fmt.Errorf("calib.txt: missing P0")
+	}
+	p1, ok := calib["P1"]
+	if !ok {
+		return nil, fmt.Errorf("calib.txt: missing P1")
+	}
+	k.LeftCamera = projectionCamera(p0)
+	k.RightCamera = projectionCamera(p1)
+	for _, c := range []camera.Pinhole{k.LeftCamera, k.RightCamera} {
+		if c.Fx <= 0 || c.Fy <= 0 {
+			return nil, fmt.Errorf("calib.txt: focal lengths must be positive, got %v and %v", c.Fx, c.Fy)
+		}
+	}
+	// P1 = K [I | -b], as the right camera is b along the x axis
+	k.Baseline = -p1[3] / k.RightCamera.Fx
+	if k.Baseline <= 0 {
+		return nil, fmt.Errorf("calib.txt: the right camera must be to the right of the left one, got baseline %v", k.Baseline)
+	}
+
+	if f, err = os.Open(filepath.Join(dir, "times.txt")); err != nil {
+		return nil, err
+	}
+	times, err := ReadKITTITimes(f)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("times.txt: %s", err)
+	}
+	for i, ts := range times {
+		name := fmt.Sprintf("%06d.png", i)
+		k.Left = append(k.Left, source.ImageFile{Path: filepath.Join(dir, "image_0", name), Timestamp: ts})
+		k.Right = append(k.Right, source.ImageFile{Path: filepath.Join(dir, "image_1", name), Timestamp: ts})
+	}
+
+	posesFile := filepath.Join(dir, "..", "..", "poses", filepath.Base(dir)+".txt")
+	if f, err := os.Open(posesFile); err == nil {
+		k.GroundTruth, err = ReadKITTIPoses(f, times)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", posesFile, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Tlr returns the pose of the right camera relative to the left one: it transforms points from
+// right camera coordinates to left camera coordinates, as settings.RightCamera
+func (k *KITTI) Tlr() geom.SE3 {
+	return geom.SE3{R: geom.IdentitySO3(), T: geom.Vec3{k.Baseline, 0, 0}}
+}
+
+// Bf returns the baseline times the focal length, the Camera.bf of the stereo settings
+func (k *KITTI) Bf() float64 {
+	return k.Baseline * k.LeftCamera.Fx
+}
+
+// Frames returns a source of the stereo pairs
+func (k *KITTI) Frames() source.FrameSource {
+	return &stereoSequence{left: k.Left, right: k.Right}
+}
+
+// projectionCamera returns the camera of a 3x4 projection matrix, row by row
+func projectionCamera(p [12]float64) camera.Pinhole {
+	return camera.Pinhole{Fx: p[0], Fy: p[5], Cx: p[2], Cy: p[6]}
+}
+
+// readKITTICalibration reads the 3x4 matrices of a calib.txt, one per line:
+//
+//	P0: 7.188560000000e+02 0.000000000000e+00 6.071928000000e+02 0.000000000000e+00 ...
+//	P1: 7.188560000000e+02 0.000000000000e+00 6.071928000000e+02 -3.861448000000e+02 ...
+func readKITTICalibration(r io.Reader) (map[string][12]float64, error) {
+	matrices := make(map[string][12]float64)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		colon := strings.Index(text, ":")
+		if colon < 0 {
+			return nil, fmt.Errorf("line %d: expected 'name: matrix', got '%s'", line, text)
+		}
+		m, err := parseMatrix34(strings.Fields(text[colon+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+		matrices[strings.TrimSpace(text[:colon])] = m
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return matrices, nil
+}
+
+// ReadKITTITimes reads a times.txt, the time of each image in seconds from the start of the
+// sequence, one per line. The start is taken to be the Unix epoch.
+func ReadKITTITimes(r io.Reader) ([]time.Time, error) {
+	var times []time.Time
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		// the times are in scientific notation, e.g 1.036400e-01, so are parsed as floats; they
+		// are small enough to keep far better than microseconds
+		secs, err := strconv.ParseFloat(text, 64)
+		if err != nil || secs < 0 {
+			return nil, fmt.Errorf("line %d: invalid timestamp '%s'", line, text)
+		}
+		ts := time.Unix(0, int64(math.Round(secs*1e9)))
+		if len(times) > 0 && ts.Before(times[len(times)-1]) {
+			return nil, fmt.Errorf("line %d: timestamps are not in order", line)
+		}
+		times = append(times, ts)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return times, nil
+}
+
+// ReadKITTIPoses reads the ground truth of a sequence, a line per image giving the pose of the left
+// camera in the world, Twc, as a 3x4 matrix row by row. times are those of the images.
+func ReadKITTIPoses(r io.Reader, times []time.Time) (Trajectory, error) {
+	var t Trajectory
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		m, err := parseMatrix34(strings.Fields(text))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+		if len(t) == len(times) {
+			return nil, fmt.Errorf("line %d: more poses than the %d images", line, len(times))
+		}
+		var rwc geom.Mat3
+		for i := range rwc {
+			copy(rwc[i][:], m[i*4:i*4+3])
+		}
+		twc := geom.SE3{R: geom.NewSO3(rwc).Normalised(), T: geom.Vec3{m[3], m[7], m[11]}}
+		t = append(t, Pose{Timestamp: times[len(t)], Pose: twc.Inverse()})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(t) != len(times) {
+		return nil, fmt.Errorf("got %d poses for %d images", len(t), len(times))
+	}
+	return t, nil
+}
+
+// parseMatrix34 parses the 12 numbers of a 3x4 matrix
+func parseMatrix34(fields []string) ([12]float64, error) {
+	var m [12]float64
+	if len(fields) != len(m) {
+		return m, fmt.Errorf("expected a 3x4 matrix, got %d numbers", len(fields))
+	}
+	v, err := parseFloats(fields)
+	if err != nil {
+		return m, err
+	}
+	copy(m[:], v)
+	return m, nil
+}
@@ -0,0 +1,139 @@
+package dataset
+
+import (
+	"image/color"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kegsay/gorbslam/internal/camera"
+	"github.com/kegsay/gorbslam/internal/geom"
+)
+
+func TestOpenKITTI(t *testing.T) {
+	seq, err := OpenKITTI("testdata/kitti/sequences/00/")
+	if err != nil {
+		t.Fatalf("OpenKITTI: %s", err)
+	}
+	want := camera.Pinhole{Fx: 718.856, Fy: 718.856, Cx: 607.1928, Cy: 185.2157}
+	if seq.LeftCamera != want || seq.RightCamera != want {
+		t.Errorf("got cameras %+v and %+v want %+v", seq.LeftCamera, seq.RightCamera, want)
+	}
+	if math.Abs(seq.Baseline-386.1448/718.856) > 1e-12 || math.Abs(seq.Bf()-386.1448) > 1e-9 {
+		t.Errorf("got baseline %v and bf %v", seq.Baseline, seq.Bf())
+	}
+	// a point on the right camera's axis is the baseline to the right of the left camera's
+	if got := seq.Tlr().Mul(geom.SE3{R: geom.IdentitySO3(), T: geom.Vec3{0, 0, 1}}).T; got.Sub(geom.Vec3{seq.Baseline, 0, 1}).Norm() > 1e-12 {
+		t.Errorf("got %v in left camera coordinates", got)
+	}
+
+	wantTimes := []time.Duration{0, 103640 * time.Microsecond, 207280 * time.Microsecond}
+	src := seq.Frames()
+	defer src.Close()
+	for i := 0; ; i++ {
+		f, err := src.Next()
+		if err == io.EOF {
+			if i != len(wantTimes) {
+				t.Errorf("got %d frames want %d", i, len(wantTimes))
+			}
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next: %s", err)
+		}
+		if !f.Timestamp.Equal(time.Unix(0, 0).Add(wantTimes[i])) {
+			t.Errorf("frame %d: got timestamp %v", i, f.Timestamp)
+		}
+		// each image of a camera is a different shade, brighter on the right
+		shade := uint8(10 * (i + 1))
+		if f.Right == nil {
+			t.Fatalf("frame %d: no right image", i)
+		}
+		if l, r := color.GrayModel.Convert(f.Image.At(1, 1)).(color.Gray).Y, color.GrayModel.Convert(f.Right.At(1, 1)).(color.Gray).Y; l != shade || r != 100+shade {
+			t.Errorf("frame %d: got shades %d and %d want %d and %d", i, l, r, shade, 100+shade)
+		}
+		if f.IMU != nil {
+			t.Errorf("frame %d: got IMU measurements %v", i, f.IMU)
+		}
+	}
+}
+
+func TestKITTIGroundTruth(t *testing.T) {
+	seq, err := OpenKITTI("testdata/kitti/sequences/00")
+	if err != nil {
+		t.Fatalf("OpenKITTI: %s", err)
+	}
+	if len(seq.GroundTruth) != 3 {
+		t.Fatalf("got %d poses", len(seq.GroundTruth))
+	}
+	// the file gives Twc, but poses are Tcw
+	pose, ok := seq.GroundTruth.At(seq.Left[2].Timestamp, time.Millisecond)
+	if !ok {
+		t.Fatalf("no ground truth pose")
+	}
+	if d := pose.Center().Sub(geom.Vec3{-9.374345e-02, -5.676064e-02, 1.716275}).Norm(); d > 1e-9 {
+		t.Errorf("got camera centre %v", pose.Center())
+	}
+	if angle := pose.R.Angle(); math.Abs(angle-0.0048) > 1e-4 {
+		t.Errorf("got rotation of %v rad", angle)
+	}
+
+	times := []time.Time{time.Unix(0, 0), time.Unix(1, 0)}
+	line := "1 0 0 0 0 1 0 0 0 0 1 0\n"
+	if _, err := ReadKITTIPoses(strings.NewReader(line), times); err == nil {
+		t.Errorf("expected an error for fewer poses than images")
+	}
+	if _, err := ReadKITTIPoses(strings.NewReader(line+line+line), times); err == nil {
+		t.Errorf("expected an error for more poses than images")
+	}
+	if _, err := ReadKITTIPoses(strings.NewReader("1 0 0 0 0 1 0 0 0 0 1\n"), times[:1]); err == nil {
+		t.Errorf("expected an error for a pose of 11 numbers")
+	}
+}
+
+func TestOpenKITTIWithoutGroundTruth(t *testing.T) {
+	// the test sequences have no poses
+	dir := filepath.Join(t.TempDir(), "sequences", "11")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("MkdirAll: %s", err)
+	}
+	calib, err := os.ReadFile("testdata/kitti/sequences/00/calib.txt")
+	if err != nil {
+		t.Fatalf("ReadFile: %s", err)
+	}
+	writeFile(t, filepath.Join(dir, "calib.txt"), string(calib))
+	writeFile(t, filepath.Join(dir, "times.txt"), "0.000000e+00\n1.036400e-01\n")
+	seq, err := OpenKITTI(dir)
+	if err != nil {
+		t.Fatalf("OpenKITTI: %s", err)
+	}
+	if len(seq.Left) != 2 || len(seq.GroundTruth) != 0 {
+		t.Errorf("got %d images and ground truth %v", len(seq.Left), seq.GroundTruth)
+	}
+	if want := filepath.Join(dir, "image_1", "000001.png"); seq.Right[1].Path != want {
+		t.Errorf("got right image %s want %s", seq.Right[1].Path, want)
+	}
+
+	writeFile(t, filepath.Join(dir, "times.txt"), "1.036400e-01\n0.000000e+00\n")
+	if _, err := OpenKITTI(dir); err == nil {
+		t.Errorf("expected an error for times out of order")
+	}
+	writeFile(t, filepath.Join(dir, "times.txt"), "0.000000e+00\n")
+	p0 := strings.SplitN(string(calib), "\n", 2)[0]
+	testCases := map[string]string{
+		"a calibration without P1": p0,
+		"a P1 of 11 numbers":       p0 + "\nP1: 718.856 0 607.1928 -386.1448 0 718.856 185.2157 0 0 0 1",
+		"a P1 without Fy":          p0 + "\nP1: 718.856 0 607.1928 -386.1448 0 0 185.2157 0 0 0 1 0",
+		"a P1 to the left":         p0 + "\nP1: 718.856 0 607.1928 386.1448 0 718.856 185.2157 0 0 0 1 0",
+	}
+	for name, contents := range testCases {
+		writeFile(t, filepath.Join(dir, "calib.txt"), contents+"\n")
+		if _, err := OpenKITTI(dir); err == nil {
+			t.Errorf("expected an error for %s", name)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package dataset
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kegsay/gorbslam/internal/camera"
+	"github.com/kegsay/gorbslam/internal/geom"
+	"github.com/kegsay/gorbslam/internal/source"
+)
+
+const (
+	// TUMDepthFactor scales the raw depths of the TUM RGB-D dataset to metres
+	TUMDepthFactor = 5000
+	// TUMMaxDifference is how far apart a colour and a depth image may be taken to be associated,
+	// the default of the dataset's associate.py
+	TUMMaxDifference = 20 * time.Millisecond
+	// TUMAssociationsFile is the file associations are read from if a sequence has one, as
+	// written by associate.py
+	TUMAssociationsFile = "associations.txt"
+)
+
+// Association pairs a colour image with the depth image taken closest to it
+type Association struct {
+	RGB   source.ImageFile
+	Depth source.ImageFile
+}
+
+// TUM is a sequence of the TUM RGB-D dataset, a directory holding:
+//
+//	rgb.txt          the colour images, as "timestamp filename" lines
+//	depth.txt        the depth images, likewise
+//	groundtruth.txt  the camera poses, as "timestamp tx ty tz qx qy qz qw" lines giving Twc
+//
+// Learning: Sturm et al: "A Benchmark for the Evaluation of RGB-D SLAM Systems" (2012)
+type TUM struct {
+	Dir   string
+	RGB   []source.ImageFile
+	Depth []source.ImageFile
+	// Each colour image with a depth image, from the sequence's associations file if it has one,
+	// otherwise by nearest timestamp. Nil if the sequence has no depth images.
+	Associations []Association
+	// Empty if the sequence has no ground truth, as for the validation sequences
+	GroundTruth Trajectory
+}
+
+// OpenTUM reads the lists of a TUM RGB-D sequence. Only rgb.txt is required.
+func OpenTUM(dir string) (*TUM, error) {
+	t := &TUM{Dir: dir}
+	var err error
+	if t.RGB, err = readTimestampsFile(filepath.Join(dir, "rgb.txt")); err != nil {
+		return nil, err
+	}
+	if t.Depth, err = readTimestampsFile(filepath.Join(dir, "depth.txt")); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if f, err := os.Open(filepath.Join(dir, "groundtruth.txt")); err == nil {
+		t.GroundTruth, err = ReadTUMTrajectory(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("groundtruth.txt: %s", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if f, err := os.Open(filepath.Join(dir, TUMAssociationsFile)); err == nil {
+		t.Associations, err = ReadAssociations(f, dir)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", TUMAssociationsFile, err)
+		}
+		if len(t.Associations) == 0 {
+			return nil, fmt.Errorf("%s: no associations", TUMAssociationsFile)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	} else if len(t.Depth) > 0 {
+		// otherwise Frames would end before the first frame
+		if t.Associations = Associate(t.RGB, t.Depth, TUMMaxDifference); len(t.Associations) == 0 {
+			return nil, fmt.Errorf("%s: no rgb/depth associations within %v", dir, TUMMaxDifference)
+		}
+	}
+	return t, nil
+}
+
+// readTimestampsFile reads a list of images, with paths relative to the list
+func readTimestampsFile(filename string) ([]source.ImageFile, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	files, err := source.ReadTimestamps(f, filepath.Dir(filename))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filepath.Base(filename), err)
+	}
+	return files, nil
+}
+
+// Frames returns a source of the sequence's images: the associated colour and depth images if
+// there are depth images, otherwise every colour image.
+func (t *TUM) Frames() source.FrameSource {
+	if t.Associations == nil {
+		return source.NewImageSequence(t.RGB)
+	}
+	return &rgbdSequence{associations: t.Associations}
+}
+
+// rgbdSequence reads the colour and depth images of associations, one pair at a time
+type rgbdSequence struct {
+	associations []Association
+	next         int
+}
+
+func (s *rgbdSequence) Next() (source.Frame, error) {
+	if s.next >= len(s.associations) {
+		return source.Frame{}, io.EOF
+	}
+	a := s.associations[s.next]
+	s.next++
+	img, err := source.ReadImage(a.RGB.Path)
+	if err != nil {
+		return source.Frame{}, err
+	}
+	f, err := os.Open(a.Depth.Path)
+	if err != nil {
+		return source.Frame{}, err
+	}
+	defer f.Close()
+	depth, err := camera.ReadDepthPNG(f, TUMDepthFactor)
+	if err != nil {
+		return source.Frame{}, fmt.Errorf("%s: %s", a.Depth.Path, err)
+	}
+	// the colour image's time, as ORB-SLAM2 uses
+	return source.Frame{Image: img, Depth: depth, Timestamp: a.RGB.Timestamp}, nil
+}
+
+func (s *rgbdSequence) Close() error {
+	return nil
+}
+
+// Associate pairs each colour image with the depth image nearest to it in time, if one is within
+// maxDiff. Like associate.py the closest pairs are matched first, so every image is used at most
+// once. The associations are in time order.
+func Associate(rgb, depth []source.ImageFile, maxDiff time.Duration) []Association {
+	type candidate struct {
+		i, j int
+		diff time.Duration
+	}
+	var candidates []candidate
+	// both lists are in time order, so the depth images within maxDiff of each colour one are a
+	// window which moves forwards
+	start := 0
+	for i := range rgb {
+		for start < len(depth) && depth[start].Timestamp.Before(rgb[i].Timestamp.Add(-maxDiff)) {
+			start++
+		}
+		for j := start; j < len(depth) && !depth[j].Timestamp.After(rgb[i].Timestamp.Add(maxDiff)); j++ {
+			candidates = append(candidates, candidate{i, j, absDuration(depth[j].Timestamp.Sub(rgb[i].Timestamp))})
+		}
+	}
+	sort.SliceStable(candidates, func(a, b int) bool { return candidates[a].diff < candidates[b].diff })
+	usedRGB := make([]bool, len(rgb))
+	usedDepth := make([]bool, len(depth))
+	var matches []candidate
+	for _, c := range candidates {
+		if usedRGB[c.i] || usedDepth[c.j] {
+			continue
+		}
+		usedRGB[c.i], usedDepth[c.j] = true, true
+		matches = append(matches, c)
+	}
+	sort.Slice(matches, func(a, b int) bool { return matches[a].i < matches[b].i })
+	associations := make([]Association, len(matches))
+	for k, m := range matches {
+		associations[k] = Association{RGB: rgb[m.i], Depth: depth[m.j]}
+	}
+	return associations
+}
+
+// ReadAssociations reads associations as written by associate.py, with file names relative to dir:
+//
+//	1305031102.175304 rgb/1305031102.175304.png 1305031102.160407 depth/1305031102.160407.png
+func ReadAssociations(r io.Reader, dir string) ([]Association, error) {
+	var associations []Association
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("line %d: expected 2 timestamps and file names, got '%s'", line, text)
+		}
+		var files [2]source.ImageFile
+		for k := range files {
+			ts, err := source.ParseSeconds(fields[2*k])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", line, err)
+			}
+			files[k] = source.ImageFile{Path: source.ResolvePath(dir, fields[2*k+1]), Timestamp: ts}
+		}
+		associations = append(associations, Association{RGB: files[0], Depth: files[1]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return associations, nil
+}
+
+// WriteAssociations writes associations as associate.py does, with file names relative to dir, so
+// that sequences without an associations file can be given one.
+func WriteAssociations(w io.Writer, associations []Association, dir string) error {
+	bw := bufio.NewWriter(w)
+	for _, a := range associations {
+		var fields []string
+		for _, f := range []source.ImageFile{a.RGB, a.Depth} {
+			rel, err := filepath.Rel(dir, f.Path)
+			if err != nil {
+				return err
+			}
+			fields = append(fields, formatSeconds(f.Timestamp), filepath.ToSlash(rel))
+		}
+		if _, err := fmt.Fprintln(bw, strings.Join(fields, " ")); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// ReadTUMTrajectory reads a trajectory of "timestamp tx ty tz qx qy qz qw" lines, each giving the
+// pose of the camera in the world, Twc. Lines starting with '#' are comments.
+func ReadTUMTrajectory(r io.Reader) (Trajectory, error) {
+	var t Trajectory
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 8 {
+			return nil, fmt.Errorf("line %d: expected a timestamp, translation and quaternion, got '%s'", line, text)
+		}
+		ts, err := source.ParseSeconds(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+		v, err := parseFloats(fields[1:])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+		q := geom.Quaternion{X: v[3], Y: v[4], Z: v[5], W: v[6]}
+		if q.Norm() == 0 {
+			return nil, fmt.Errorf("line %d: zero quaternion", line)
+		}
+		if len(t) > 0 && ts.Before(t[len(t)-1].Timestamp) {
+			return nil, fmt.Errorf("line %d: timestamps are not in order", line)
+		}
+		twc := geom.SE3{R: geom.SO3FromQuaternion(q.Normalised()), T: geom.Vec3{v[0], v[1], v[2]}}
+		t = append(t, Pose{Timestamp: ts, Pose: twc.Inverse()})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
@@ -0,0 +1,210 @@
+package dataset
+
+import (
+	"bytes"
+	"image/color"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kegsay/gorbslam/internal/geom"
+)
+
+// tumTime returns a timestamp in the fabricated TUM sequence from its fraction of a second
+func tumTime(usec int) time.Time {
+	return time.Unix(1305031102, int64(usec)*1000)
+}
+
+func TestOpenTUM(t *testing.T) {
+	seq, err := OpenTUM("testdata/tum")
+	if err != nil {
+		t.Fatalf("OpenTUM: %s", err)
+	}
+	if len(seq.RGB) != 4 || len(seq.Depth) != 4 || len(seq.GroundTruth) != 4 {
+		t.Fatalf("got %d colour images, %d depth images and %d poses", len(seq.RGB), len(seq.Depth), len(seq.GroundTruth))
+	}
+	// the third colour image's nearest depth image is closer still to the fourth, which takes it
+	want := [][2]int{{175304, 160407}, {211214, 226738}, {275326, 262886}}
+	if len(seq.Associations) != len(want) {
+		t.Fatalf("got %d associations want %d", len(seq.Associations), len(want))
+	}
+	for i, a := range seq.Associations {
+		if !a.RGB.Timestamp.Equal(tumTime(want[i][0])) || !a.Depth.Timestamp.Equal(tumTime(want[i][1])) {
+			t.Errorf("association %d: got %v and %v", i, a.RGB.Timestamp, a.Depth.Timestamp)
+		}
+	}
+
+	src := seq.Frames()
+	defer src.Close()
+	for i := 0; ; i++ {
+		f, err := src.Next()
+		if err == io.EOF {
+			if i != len(want) {
+				t.Errorf("got %d frames want %d", i, len(want))
+			}
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next: %s", err)
+		}
+		if !f.Timestamp.Equal(tumTime(want[i][0])) {
+			t.Errorf("frame %d: got timestamp %v", i, f.Timestamp)
+		}
+		// each image of the sequence is a different shade, and each depth image a different depth
+		wantGray := []uint8{10, 20, 40}[i]
+		if got := color.GrayModel.Convert(f.Image.At(1, 1)).(color.Gray).Y; got != wantGray {
+			t.Errorf("frame %d: got gray %d want %d", i, got, wantGray)
+		}
+		wantDepth := []float64{0.2, 0.4, 0.6}[i]
+		if f.Depth == nil || math.Abs(f.Depth.Depth(1, 1)-wantDepth) > 1e-9 {
+			t.Errorf("frame %d: got depth image %v want depth %v", i, f.Depth, wantDepth)
+		}
+	}
+}
+
+func TestTUMGroundTruth(t *testing.T) {
+	seq, err := OpenTUM("testdata/tum")
+	if err != nil {
+		t.Fatalf("OpenTUM: %s", err)
+	}
+	// the file gives Twc, but poses are Tcw
+	pose, ok := seq.GroundTruth.At(tumTime(212000), TUMMaxDifference)
+	if !ok {
+		t.Fatalf("no ground truth pose")
+	}
+	if d := pose.Center().Sub(geom.Vec3{1.3433, 0.6246, 1.6530}).Norm(); d > 1e-9 {
+		t.Errorf("got camera centre %v", pose.Center())
+	}
+	want := geom.SO3FromQuaternion(geom.Quaternion{X: 0.6577, Y: 0.6128, Z: -0.2941, W: -0.3247}.Normalised())
+	if angle := pose.R.Mul(want).Angle(); angle > 1e-9 {
+		t.Errorf("rotation is %v rad off", angle)
+	}
+	if _, ok := seq.GroundTruth.At(tumTime(400000), TUMMaxDifference); ok {
+		t.Errorf("got a pose long after the ground truth ends")
+	}
+}
+
+func TestAssociations(t *testing.T) {
+	seq, err := OpenTUM("testdata/tum")
+	if err != nil {
+		t.Fatalf("OpenTUM: %s", err)
+	}
+	var buf bytes.Buffer
+	if err := WriteAssociations(&buf, seq.Associations, seq.Dir); err != nil {
+		t.Fatalf("WriteAssociations: %s", err)
+	}
+	first := strings.SplitN(buf.String(), "\n", 2)[0]
+	if want := "1305031102.175304 rgb/1305031102.175304.png 1305031102.160407 depth/1305031102.160407.png"; first != want {
+		t.Errorf("got line '%s' want '%s'", first, want)
+	}
+	got, err := ReadAssociations(&buf, seq.Dir)
+	if err != nil {
+		t.Fatalf("ReadAssociations: %s", err)
+	}
+	if len(got) != len(seq.Associations) {
+		t.Fatalf("got %d associations back want %d", len(got), len(seq.Associations))
+	}
+	for i := range got {
+		if got[i] != seq.Associations[i] {
+			t.Errorf("association %d: got %+v want %+v", i, got[i], seq.Associations[i])
+		}
+	}
+
+	// with a tighter tolerance fewer images are associated
+	if a := Associate(seq.RGB, seq.Depth, 15*time.Millisecond); len(a) != 2 {
+		t.Errorf("got %d associations within 15ms", len(a))
+	}
+	if _, err := ReadAssociations(strings.NewReader("1305031102.175304 rgb/a.png\n"), ""); err == nil {
+		t.Errorf("expected an error for a line without a depth image")
+	}
+}
+
+func TestOpenTUMWithoutDepth(t *testing.T) {
+	dir := t.TempDir()
+	list := "1305031102.175304 " + filepath.ToSlash(mustAbs(t, "testdata/tum/rgb/1305031102.175304.png")) + "\n"
+	writeFile(t, filepath.Join(dir, "rgb.txt"), list)
+	seq, err := OpenTUM(dir)
+	if err != nil {
+		t.Fatalf("OpenTUM: %s", err)
+	}
+	if seq.Associations != nil || len(seq.GroundTruth) != 0 {
+		t.Errorf("got associations %v and ground truth %v", seq.Associations, seq.GroundTruth)
+	}
+	f, err := seq.Frames().Next()
+	if err != nil || f.Depth != nil || !f.Timestamp.Equal(tumTime(175304)) {
+		t.Errorf("got frame %+v, %v", f, err)
+	}
+
+	// an associations file is used as it is, even without depth.txt
+	writeFile(t, filepath.Join(dir, TUMAssociationsFile), "1305031102.175304 rgb/a.png 1305031102.160407 depth/b.png\n")
+	if seq, err = OpenTUM(dir); err != nil || len(seq.Associations) != 1 || seq.Associations[0].Depth.Path != filepath.Join(dir, "depth", "b.png") {
+		t.Errorf("got %+v, %v from the associations file", seq, err)
+	}
+
+	writeFile(t, filepath.Join(dir, "groundtruth.txt"), "1305031102.1758 1 2 3 0 0 0\n")
+	if _, err := OpenTUM(dir); err == nil {
+		t.Errorf("expected an error for a pose without a full quaternion")
+	}
+}
+
+func TestOpenTUMWithoutAssociations(t *testing.T) {
+	// the depth images are all a second after the colour ones
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "rgb.txt"), "1305031102.175304 rgb/a.png\n1305031102.211214 rgb/b.png\n")
+	writeFile(t, filepath.Join(dir, "depth.txt"), "1305031103.175304 depth/a.png\n1305031103.211214 depth/b.png\n")
+	if _, err := OpenTUM(dir); err == nil {
+		t.Errorf("expected an error for depth images without colour images near them")
+	}
+	writeFile(t, filepath.Join(dir, TUMAssociationsFile), "# no associations\n")
+	if _, err := OpenTUM(dir); err == nil {
+		t.Errorf("expected an error for an empty associations file")
+	}
+}
+
+func TestTrajectoryAt(t *testing.T) {
+	var traj Trajectory
+	for i := 0; i < 5; i++ {
+		traj = append(traj, Pose{Timestamp: time.Unix(int64(i), 0), Pose: geom.SE3{R: geom.IdentitySO3(), T: geom.Vec3{float64(i), 0, 0}}})
+	}
+	testCases := []struct {
+		ts   time.Time
+		want float64
+		ok   bool
+	}{
+		{time.Unix(2, 0), 2, true},
+		{time.Unix(2, 4e8), 2, true},
+		{time.Unix(2, 6e8), 3, true},
+		{time.Unix(-1, 0), 0, false},
+		{time.Unix(4, 3e8), 4, true},
+		{time.Unix(5, 0), 0, false},
+	}
+	for _, tc := range testCases {
+		got, ok := traj.At(tc.ts, 500*time.Millisecond)
+		if ok != tc.ok || (ok && got.T[0] != tc.want) {
+			t.Errorf("%v: got %v, %v want %v, %v", tc.ts, got.T, ok, tc.want, tc.ok)
+		}
+	}
+	if _, ok := Trajectory(nil).At(time.Unix(0, 0), time.Second); ok {
+		t.Errorf("got a pose from an empty trajectory")
+	}
+}
+
+func writeFile(t *testing.T, filename, contents string) {
+	t.Helper()
+	if err := os.WriteFile(filename, []byte(contents), 0644); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+}
+
+func mustAbs(t *testing.T, path string) string {
+	t.Helper()
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		t.Fatalf("Abs: %s", err)
+	}
+	return abs
+}
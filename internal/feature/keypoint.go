@@ -0,0 +1,81 @@
+package feature
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// KeyPoint is a detected feature, with its position undistorted onto an ideal pinhole image.
+type KeyPoint struct {
+	X float64
+	Y float64
+	// The pyramid level the keypoint was detected on
+	Octave int
+	// Orientation in degrees, used to check the rotation consistency of matches
+	Angle float64
+	// Detector response, higher is stronger
+	Response float64
+}
+
+// Descriptor is a 256-bit ORB (rotated BRIEF) descriptor. Each bit is the result of comparing the
+// brightness of a pair of pixels around the keypoint.
+type Descriptor [32]byte
+
+// Distance returns the Hamming distance between two descriptors: the number of differing bits.
+func (d *Descriptor) Distance(o *Descriptor) int {
+	var dist int
+	for i := 0; i < len(d); i += 8 {
+		dist += bits.OnesCount64(binary.LittleEndian.Uint64(d[i:]) ^ binary.LittleEndian.Uint64(o[i:]))
+	}
+	return dist
+}
+
+// Descriptor distance thresholds used by the ORB-SLAM2 matchers
+const (
+	// The maximum distance for a match to be considered good
+	DistanceLow = 50
+	// The maximum distance for a match to be considered at all
+	DistanceHigh = 100
+)
+
+// MedianDescriptor returns the index of the descriptor with the least median distance to all the
+// others. This is the most representative descriptor of a set of observations of the same point.
+func MedianDescriptor(descriptors []*Descriptor) int {
+	n := len(descriptors)
+	if n == 0 {
+		return -1
+	}
+	distances := make([][]int, n)
+	for i := range distances {
+		distances[i] = make([]int, n)
+	}
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			d := descriptors[i].Distance(descriptors[j])
+			distances[i][j] = d
+			distances[j][i] = d
+		}
+	}
+	best := 0
+	bestMedian := int(^uint(0) >> 1)
+	row := make([]int, n)
+	for i := 0; i < n; i++ {
+		copy(row, distances[i])
+		sortInts(row)
+		median := row[(n-1)/2]
+		if median < bestMedian {
+			bestMedian = median
+			best = i
+		}
+	}
+	return best
+}
+
+// insertion sort: the rows are small (one entry per observation of a point)
+func sortInts(a []int) {
+	for i := 1; i < len(a); i++ {
+		for j := i; j > 0 && a[j] < a[j-1]; j-- {
+			a[j], a[j-1] = a[j-1], a[j]
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package feature
+
+import "testing"
+
+func TestDescriptorDistance(t *testing.T) {
+	var a, b Descriptor
+	if d := a.Distance(&b); d != 0 {
+		t.Errorf("identical descriptors: got distance %d", d)
+	}
+	b[0] = 0xff
+	b[31] = 0x01
+	if d := a.Distance(&b); d != 9 {
+		t.Errorf("got distance %d want 9", d)
+	}
+	for i := range b {
+		b[i] = 0xff
+	}
+	if d := a.Distance(&b); d != 256 {
+		t.Errorf("got distance %d want 256", d)
+	}
+}
+
+func TestMedianDescriptor(t *testing.T) {
+	// four descriptors close together and one far away: the middle of the cluster wins
+	var base Descriptor
+	d1, d2, d3, d4, far := base, base, base, base, base
+	d1[0] = 0x01
+	d3[0] = 0x02
+	d4[0] = 0x04
+	for i := range far {
+		far[i] = 0xff
+	}
+	got := MedianDescriptor([]*Descriptor{&far, &d1, &d2, &d3, &d4})
+	if got != 2 {
+		t.Errorf("got index %d want 2", got)
+	}
+	if got := MedianDescriptor(nil); got != -1 {
+		t.Errorf("empty set: got %d want -1", got)
+	}
+}
@@ -0,0 +1,36 @@
+package feature
+
+// ScalePyramid describes the image pyramid used by the ORB extractor. Keypoints found on higher
+// levels (octaves) of the pyramid are detected on a downscaled image, so their positions are less
+// certain when mapped back onto the original image. Everything which measures reprojection error
+// needs to scale its expectations by the octave the keypoint came from.
+type ScalePyramid struct {
+	Levels      int
+	ScaleFactor float64
+	// ScaleFactors[i] = ScaleFactor^i
+	ScaleFactors    []float64
+	InvScaleFactors []float64
+	// Sigma2[i] = ScaleFactors[i]^2, the variance of a keypoint's position on level i
+	Sigma2    []float64
+	InvSigma2 []float64
+}
+
+func NewScalePyramid(levels int, scaleFactor float64) *ScalePyramid {
+	p := &ScalePyramid{
+		Levels:          levels,
+		ScaleFactor:     scaleFactor,
+		ScaleFactors:    make([]float64, levels),
+		InvScaleFactors: make([]float64, levels),
+		Sigma2:          make([]float64, levels),
+		InvSigma2:       make([]float64, levels),
+	}
+	scale := 1.0
+	for i := 0; i < levels; i++ {
+		p.ScaleFactors[i] = scale
+		p.InvScaleFactors[i] = 1 / scale
+		p.Sigma2[i] = scale * scale
+		p.InvSigma2[i] = 1 / (scale * scale)
+		scale *= scaleFactor
+	}
+	return p
+}
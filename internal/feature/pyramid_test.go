@@ -0,0 +1,28 @@
+package feature
+
+import (
+	"math"
+	"testing"
+)
+
+func TestScalePyramid(t *testing.T) {
+	p := NewScalePyramid(8, 1.2)
+	if len(p.ScaleFactors) != 8 || len(p.InvSigma2) != 8 {
+		t.Fatalf("wrong number of levels: %d", len(p.ScaleFactors))
+	}
+	if p.ScaleFactors[0] != 1 || p.Sigma2[0] != 1 {
+		t.Errorf("level 0 must be the original image: %v %v", p.ScaleFactors[0], p.Sigma2[0])
+	}
+	for i := 0; i < 8; i++ {
+		want := math.Pow(1.2, float64(i))
+		if math.Abs(p.ScaleFactors[i]-want) > 1e-12 {
+			t.Errorf("level %d: scale got %v want %v", i, p.ScaleFactors[i], want)
+		}
+		if math.Abs(p.Sigma2[i]*p.InvSigma2[i]-1) > 1e-12 {
+			t.Errorf("level %d: sigma2 * inv sigma2 != 1", i)
+		}
+		if math.Abs(p.ScaleFactors[i]*p.InvScaleFactors[i]-1) > 1e-12 {
+			t.Errorf("level %d: scale * inv scale != 1", i)
+		}
+	}
+}
@@ -0,0 +1,377 @@
+package geom
+
+import (
+	"math"
+	"sort"
+)
+
+// Dense is a row-major matrix of arbitrary size. It is intended for the small systems found in
+// geometric solvers (e.g 12x12 for EPnP, 9 columns for homographies) rather than large problems.
+type Dense struct {
+	Rows int
+	Cols int
+	Data []float64
+}
+
+func NewDense(rows, cols int) *Dense {
+	return &Dense{
+		Rows: rows,
+		Cols: cols,
+		Data: make([]float64, rows*cols),
+	}
+}
+
+// NewDenseFrom creates a matrix from the row-major data provided. The data is not copied.
+func NewDenseFrom(rows, cols int, data []float64) *Dense {
+	if len(data) != rows*cols {
+		panic("geom: data length does not match dimensions")
+	}
+	return &Dense{
+		Rows: rows,
+		Cols: cols,
+		Data: data,
+	}
+}
+
+func IdentityDense(n int) *Dense {
+	d := NewDense(n, n)
+	for i := 0; i < n; i++ {
+		d.Set(i, i, 1)
+	}
+	return d
+}
+
+func (d *Dense) At(i, j int) float64 {
+	return d.Data[i*d.Cols+j]
+}
+
+func (d *Dense) Set(i, j int, v float64) {
+	d.Data[i*d.Cols+j] = v
+}
+
+// Row returns a slice of row i. Modifying the slice modifies the matrix.
+func (d *Dense) Row(i int) []float64 {
+	return d.Data[i*d.Cols : (i+1)*d.Cols]
+}
+
+// Col returns a copy of column j
+func (d *Dense) Col(j int) []float64 {
+	out := make([]float64, d.Rows)
+	for i := 0; i < d.Rows; i++ {
+		out[i] = d.At(i, j)
+	}
+	return out
+}
+
+func (d *Dense) Clone() *Dense {
+	data := make([]float64, len(d.Data))
+	copy(data, d.Data)
+	return NewDenseFrom(d.Rows, d.Cols, data)
+}
+
+func (d *Dense) T() *Dense {
+	out := NewDense(d.Cols, d.Rows)
+	for i := 0; i < d.Rows; i++ {
+		for j := 0; j < d.Cols; j++ {
+			out.Set(j, i, d.At(i, j))
+		}
+	}
+	return out
+}
+
+func (d *Dense) Mul(o *Dense) *Dense {
+	if d.Cols != o.Rows {
+		panic("geom: dimension mismatch in Mul")
+	}
+	out := NewDense(d.Rows, o.Cols)
+	for i := 0; i < d.Rows; i++ {
+		for k := 0; k < d.Cols; k++ {
+			a := d.At(i, k)
+			if a == 0 {
+				continue
+			}
+			for j := 0; j < o.Cols; j++ {
+				out.Data[i*out.Cols+j] += a * o.Data[k*o.Cols+j]
+			}
+		}
+	}
+	return out
+}
+
+func (d *Dense) MulVec(v []float64) []float64 {
+	if d.Cols != len(v) {
+		panic("geom: dimension mismatch in MulVec")
+	}
+	out := make([]float64, d.Rows)
+	for i := 0; i < d.Rows; i++ {
+		row := d.Row(i)
+		var sum float64
+		for j := range row {
+			sum += row[j] * v[j]
+		}
+		out[i] = sum
+	}
+	return out
+}
+
+// AtA returns d^T * d, which is always symmetric.
+func (d *Dense) AtA() *Dense {
+	out := NewDense(d.Cols, d.Cols)
+	for r := 0; r < d.Rows; r++ {
+		row := d.Row(r)
+		for i := 0; i < d.Cols; i++ {
+			if row[i] == 0 {
+				continue
+			}
+			for j := i; j < d.Cols; j++ {
+				out.Data[i*d.Cols+j] += row[i] * row[j]
+			}
+		}
+	}
+	for i := 0; i < d.Cols; i++ {
+		for j := 0; j < i; j++ {
+			out.Set(i, j, out.At(j, i))
+		}
+	}
+	return out
+}
+
+const (
+	jacobiMaxSweeps = 60
+	jacobiEpsilon   = 1e-15
+)
+
+// SVD computes the singular value decomposition A = U * diag(S) * V^T using one-sided Jacobi
+// rotations. Singular values are sorted in descending order. U is Rows x n and V is n x n where
+// n = Cols. If the matrix has fewer rows than columns it is padded with zero rows so that V is
+// always a complete basis, which is what we want when looking for null spaces (e.g the 8-point
+// algorithm with exactly 8 points).
+// Learning: https://en.wikipedia.org/wiki/Jacobi_eigenvalue_algorithm#Singular_values
+func SVD(a *Dense) (u *Dense, s []float64, v *Dense) {
+	m, n := a.Rows, a.Cols
+	rows := m
+	if rows < n {
+		rows = n
+	}
+	w := NewDense(rows, n)
+	copy(w.Data, a.Data)
+	v = IdentityDense(n)
+
+	for sweep := 0; sweep < jacobiMaxSweeps; sweep++ {
+		rotated := false
+		for p := 0; p < n-1; p++ {
+			for q := p + 1; q < n; q++ {
+				var alpha, beta, gamma float64
+				for i := 0; i < rows; i++ {
+					wp := w.Data[i*n+p]
+					wq := w.Data[i*n+q]
+					alpha += wp * wp
+					beta += wq * wq
+					gamma += wp * wq
+				}
+				if gamma == 0 || math.Abs(gamma) <= jacobiEpsilon*math.Sqrt(alpha*beta) {
+					continue
+				}
+				rotated = true
+				zeta := (beta - alpha) / (2 * gamma)
+				t := math.Copysign(1, zeta) / (math.Abs(zeta) + math.Sqrt(1+zeta*zeta))
+				c := 1 / math.Sqrt(1+t*t)
+				sn := c * t
+				for i := 0; i < rows; i++ {
+					wp := w.Data[i*n+p]
+					wq := w.Data[i*n+q]
+					w.Data[i*n+p] = c*wp - sn*wq
+					w.Data[i*n+q] = sn*wp + c*wq
+				}
+				for i := 0; i < n; i++ {
+					vp := v.Data[i*n+p]
+					vq := v.Data[i*n+q]
+					v.Data[i*n+p] = c*vp - sn*vq
+					v.Data[i*n+q] = sn*vp + c*vq
+				}
+			}
+		}
+		if !rotated {
+			break
+		}
+	}
+
+	// singular values are the column norms of the rotated matrix
+	sv := make([]float64, n)
+	for j := 0; j < n; j++ {
+		var norm float64
+		for i := 0; i < rows; i++ {
+			norm += w.Data[i*n+j] * w.Data[i*n+j]
+		}
+		sv[j] = math.Sqrt(norm)
+	}
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return sv[order[i]] > sv[order[j]]
+	})
+
+	u = NewDense(m, n)
+	vSorted := NewDense(n, n)
+	s = make([]float64, n)
+	for k, j := range order {
+		s[k] = sv[j]
+		for i := 0; i < m; i++ {
+			if sv[j] > 0 {
+				u.Set(i, k, w.At(i, j)/sv[j])
+			}
+		}
+		for i := 0; i < n; i++ {
+			vSorted.Set(i, k, v.At(i, j))
+		}
+	}
+	return u, s, vSorted
+}
+
+// SymEigen computes the eigen decomposition of a symmetric matrix using cyclic Jacobi rotations.
+// Eigenvalues are sorted in ascending order, and the eigenvectors are the corresponding columns of vecs.
+func SymEigen(a *Dense) (vals []float64, vecs *Dense) {
+	if a.Rows != a.Cols {
+		panic("geom: SymEigen requires a square matrix")
+	}
+	n := a.Rows
+	w := a.Clone()
+	v := IdentityDense(n)
+
+	for sweep := 0; sweep < jacobiMaxSweeps; sweep++ {
+		var off float64
+		for p := 0; p < n; p++ {
+			for q := p + 1; q < n; q++ {
+				off += w.At(p, q) * w.At(p, q)
+			}
+		}
+		if off < 1e-30 {
+			break
+		}
+		for p := 0; p < n-1; p++ {
+			for q := p + 1; q < n; q++ {
+				apq := w.At(p, q)
+				if apq == 0 {
+					continue
+				}
+				app := w.At(p, p)
+				aqq := w.At(q, q)
+				theta := (aqq - app) / (2 * apq)
+				t := math.Copysign(1, theta) / (math.Abs(theta) + math.Sqrt(theta*theta+1))
+				c := 1 / math.Sqrt(t*t+1)
+				s := t * c
+				for k := 0; k < n; k++ {
+					akp := w.At(k, p)
+					akq := w.At(k, q)
+					w.Set(k, p, c*akp-s*akq)
+					w.Set(k, q, s*akp+c*akq)
+				}
+				for k := 0; k < n; k++ {
+					apk := w.At(p, k)
+					aqk := w.At(q, k)
+					w.Set(p, k, c*apk-s*aqk)
+					w.Set(q, k, s*apk+c*aqk)
+				}
+				for k := 0; k < n; k++ {
+					vkp := v.At(k, p)
+					vkq := v.At(k, q)
+					v.Set(k, p, c*vkp-s*vkq)
+					v.Set(k, q, s*vkp+c*vkq)
+				}
+			}
+		}
+	}
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return w.At(order[i], order[i]) < w.At(order[j], order[j])
+	})
+	vals = make([]float64, n)
+	vecs = NewDense(n, n)
+	for k, j := range order {
+		vals[k] = w.At(j, j)
+		for i := 0; i < n; i++ {
+			vecs.Set(i, k, v.At(i, j))
+		}
+	}
+	return vals, vecs
+}
+
+// LeastSquares solves min ||A x - b|| using the SVD pseudo-inverse. Singular values
+// smaller than a relative tolerance are treated as zero.
+func LeastSquares(a *Dense, b []float64) []float64 {
+	if a.Rows != len(b) {
+		panic("geom: dimension mismatch in LeastSquares")
+	}
+	u, s, v := SVD(a)
+	x := make([]float64, a.Cols)
+	if len(s) == 0 || s[0] == 0 {
+		return x
+	}
+	tol := s[0] * 1e-12 * float64(a.Rows+a.Cols)
+	for k := range s {
+		if s[k] <= tol {
+			continue
+		}
+		var utb float64
+		for i := 0; i < a.Rows; i++ {
+			utb += u.At(i, k) * b[i]
+		}
+		coeff := utb / s[k]
+		for j := 0; j < a.Cols; j++ {
+			x[j] += coeff * v.At(j, k)
+		}
+	}
+	return x
+}
+
+// SolveSPD solves A x = b for a symmetric positive definite A using a Cholesky decomposition.
+// Returns false if A is not positive definite.
+func SolveSPD(a *Dense, b []float64) ([]float64, bool) {
+	n := a.Rows
+	if a.Cols != n || len(b) != n {
+		panic("geom: dimension mismatch in SolveSPD")
+	}
+	l := NewDense(n, n)
+	for j := 0; j < n; j++ {
+		sum := a.At(j, j)
+		for k := 0; k < j; k++ {
+			sum -= l.At(j, k) * l.At(j, k)
+		}
+		if sum <= 0 || math.IsNaN(sum) {
+			return nil, false
+		}
+		ljj := math.Sqrt(sum)
+		l.Set(j, j, ljj)
+		for i := j + 1; i < n; i++ {
+			sum := a.At(i, j)
+			for k := 0; k < j; k++ {
+				sum -= l.At(i, k) * l.At(j, k)
+			}
+			l.Set(i, j, sum/ljj)
+		}
+	}
+	// forward substitution L y = b
+	y := make([]float64, n)
+	for i := 0; i < n; i++ {
+		sum := b[i]
+		for k := 0; k < i; k++ {
+			sum -= l.At(i, k) * y[k]
+		}
+		y[i] = sum / l.At(i, i)
+	}
+	// back substitution L^T x = y
+	x := make([]float64, n)
+	for i := n - 1; i >= 0; i-- {
+		sum := y[i]
+		for k := i + 1; k < n; k++ {
+			sum -= l.At(k, i) * x[k]
+		}
+		x[i] = sum / l.At(i, i)
+	}
+	return x, true
+}
@@ -0,0 +1,143 @@
+package geom
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func randomDense(rng *rand.Rand, rows, cols int) *Dense {
+	d := NewDense(rows, cols)
+	for i := range d.Data {
+		d.Data[i] = rng.NormFloat64()
+	}
+	return d
+}
+
+func TestSVD(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+	for _, size := range [][2]int{{3, 3}, {12, 12}, {20, 9}, {8, 9}, {6, 4}} {
+		a := randomDense(rng, size[0], size[1])
+		u, s, v := SVD(a)
+		for i := 1; i < len(s); i++ {
+			if s[i] > s[i-1] {
+				t.Fatalf("%v: singular values not sorted: %v", size, s)
+			}
+		}
+		// reconstruct A = U S V^T
+		for i := 0; i < a.Rows; i++ {
+			for j := 0; j < a.Cols; j++ {
+				var sum float64
+				for k := range s {
+					sum += u.At(i, k) * s[k] * v.At(j, k)
+				}
+				if math.Abs(sum-a.At(i, j)) > 1e-9 {
+					t.Fatalf("%v: reconstruction mismatch at (%d,%d): got %v want %v", size, i, j, sum, a.At(i, j))
+				}
+			}
+		}
+		// V must be orthonormal
+		vtv := v.T().Mul(v)
+		for i := 0; i < vtv.Rows; i++ {
+			for j := 0; j < vtv.Cols; j++ {
+				want := 0.0
+				if i == j {
+					want = 1
+				}
+				if math.Abs(vtv.At(i, j)-want) > 1e-9 {
+					t.Fatalf("%v: V not orthonormal: %v", size, vtv.Data)
+				}
+			}
+		}
+	}
+}
+
+func TestSVDNullSpace(t *testing.T) {
+	// 2 rows, 3 cols: the null space is spanned by the last column of V
+	a := NewDenseFrom(2, 3, []float64{
+		1, 0, 0,
+		0, 1, 0,
+	})
+	_, s, v := SVD(a)
+	if s[2] != 0 {
+		t.Fatalf("expected zero singular value, got %v", s)
+	}
+	null := v.Col(2)
+	if math.Abs(math.Abs(null[2])-1) > 1e-12 {
+		t.Fatalf("wrong null space: %v", null)
+	}
+}
+
+func TestSymEigen(t *testing.T) {
+	rng := rand.New(rand.NewSource(7))
+	a := randomDense(rng, 10, 6).AtA()
+	vals, vecs := SymEigen(a)
+	for i := 1; i < len(vals); i++ {
+		if vals[i] < vals[i-1] {
+			t.Fatalf("eigenvalues not sorted: %v", vals)
+		}
+	}
+	for k := range vals {
+		vec := vecs.Col(k)
+		av := a.MulVec(vec)
+		for i := range av {
+			if math.Abs(av[i]-vals[k]*vec[i]) > 1e-9 {
+				t.Fatalf("eigenpair %d wrong: Av=%v lambda*v=%v", k, av[i], vals[k]*vec[i])
+			}
+		}
+	}
+}
+
+func TestSolvers(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	a := randomDense(rng, 8, 4)
+	want := []float64{1, -2, 0.5, 3}
+	b := a.MulVec(want)
+	got := LeastSquares(a, b)
+	for i := range want {
+		if math.Abs(got[i]-want[i]) > 1e-9 {
+			t.Fatalf("LeastSquares: got %v want %v", got, want)
+		}
+	}
+	ata := a.AtA()
+	got, ok := SolveSPD(ata, ata.MulVec(want))
+	if !ok {
+		t.Fatalf("SolveSPD: matrix not positive definite")
+	}
+	for i := range want {
+		if math.Abs(got[i]-want[i]) > 1e-9 {
+			t.Fatalf("SolveSPD: got %v want %v", got, want)
+		}
+	}
+	if _, ok := SolveSPD(NewDense(2, 2), []float64{1, 1}); ok {
+		t.Fatalf("SolveSPD: expected failure on a singular matrix")
+	}
+}
+
+func TestMat3Inverse(t *testing.T) {
+	m := Mat3{{2, 1, 0}, {0, 3, 1}, {1, 0, 4}}
+	inv, ok := m.Inverse()
+	if !ok {
+		t.Fatalf("matrix should be invertible")
+	}
+	id := m.Mul(inv)
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			want := 0.0
+			if i == j {
+				want = 1
+			}
+			if math.Abs(id[i][j]-want) > 1e-12 {
+				t.Fatalf("m * inv(m) != I: %v", id)
+			}
+		}
+	}
+	if _, ok := (Mat3{}).Inverse(); ok {
+		t.Fatalf("zero matrix should not be invertible")
+	}
+	v := Vec3{1, 2, 3}
+	w := Vec3{-1, 0.5, 2}
+	if Skew(v).MulVec(w) != v.Cross(w) {
+		t.Fatalf("Skew(v)*w != v x w")
+	}
+}
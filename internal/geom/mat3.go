@@ -0,0 +1,112 @@
+package geom
+
+// Mat3 is a row-major 3x3 matrix, typically a rotation or camera intrinsics matrix.
+type Mat3 [3][3]float64
+
+func Identity3() Mat3 {
+	return Mat3{{1, 0, 0}, {0, 1, 0}, {0, 0, 1}}
+}
+
+// Skew returns the skew-symmetric matrix [v]x such that [v]x * w == v.Cross(w)
+func Skew(v Vec3) Mat3 {
+	return Mat3{
+		{0, -v[2], v[1]},
+		{v[2], 0, -v[0]},
+		{-v[1], v[0], 0},
+	}
+}
+
+func (m Mat3) Mul(n Mat3) Mat3 {
+	var out Mat3
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			out[i][j] = m[i][0]*n[0][j] + m[i][1]*n[1][j] + m[i][2]*n[2][j]
+		}
+	}
+	return out
+}
+
+func (m Mat3) MulVec(v Vec3) Vec3 {
+	return Vec3{
+		m[0][0]*v[0] + m[0][1]*v[1] + m[0][2]*v[2],
+		m[1][0]*v[0] + m[1][1]*v[1] + m[1][2]*v[2],
+		m[2][0]*v[0] + m[2][1]*v[1] + m[2][2]*v[2],
+	}
+}
+
+func (m Mat3) Add(n Mat3) Mat3 {
+	var out Mat3
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			out[i][j] = m[i][j] + n[i][j]
+		}
+	}
+	return out
+}
+
+func (m Mat3) Scale(s float64) Mat3 {
+	var out Mat3
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			out[i][j] = m[i][j] * s
+		}
+	}
+	return out
+}
+
+func (m Mat3) T() Mat3 {
+	var out Mat3
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			out[i][j] = m[j][i]
+		}
+	}
+	return out
+}
+
+func (m Mat3) Det() float64 {
+	return m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+		m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+}
+
+// Inverse returns the inverse of the matrix. Returns false if the matrix is singular.
+func (m Mat3) Inverse() (Mat3, bool) {
+	det := m.Det()
+	if det == 0 {
+		return Mat3{}, false
+	}
+	inv := Mat3{
+		{m[1][1]*m[2][2] - m[1][2]*m[2][1], m[0][2]*m[2][1] - m[0][1]*m[2][2], m[0][1]*m[1][2] - m[0][2]*m[1][1]},
+		{m[1][2]*m[2][0] - m[1][0]*m[2][2], m[0][0]*m[2][2] - m[0][2]*m[2][0], m[0][2]*m[1][0] - m[0][0]*m[1][2]},
+		{m[1][0]*m[2][1] - m[1][1]*m[2][0], m[0][1]*m[2][0] - m[0][0]*m[2][1], m[0][0]*m[1][1] - m[0][1]*m[1][0]},
+	}
+	return inv.Scale(1 / det), true
+}
+
+// Col returns column i of the matrix
+func (m Mat3) Col(i int) Vec3 {
+	return Vec3{m[0][i], m[1][i], m[2][i]}
+}
+
+// Dense converts the matrix into a 3x3 Dense matrix
+func (m Mat3) Dense() *Dense {
+	d := NewDense(3, 3)
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			d.Set(i, j, m[i][j])
+		}
+	}
+	return d
+}
+
+// Mat3FromDense converts the top-left 3x3 block of d into a Mat3
+func Mat3FromDense(d *Dense) Mat3 {
+	var m Mat3
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			m[i][j] = d.At(i, j)
+		}
+	}
+	return m
+}
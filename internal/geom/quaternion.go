@@ -0,0 +1,132 @@
+package geom
+
+import "math"
+
+// Quaternion is a rotation quaternion w + xi + yj + zk. Rotations should use unit quaternions.
+type Quaternion struct {
+	W, X, Y, Z float64
+}
+
+func IdentityQuaternion() Quaternion {
+	return Quaternion{W: 1}
+}
+
+func (q Quaternion) Norm() float64 {
+	return math.Sqrt(q.W*q.W + q.X*q.X + q.Y*q.Y + q.Z*q.Z)
+}
+
+// Normalised returns the unit quaternion in the direction of q. The scalar part is kept
+// non-negative so that each rotation has exactly one representation.
+func (q Quaternion) Normalised() Quaternion {
+	n := q.Norm()
+	if n == 0 {
+		return IdentityQuaternion()
+	}
+	if q.W < 0 {
+		n = -n
+	}
+	return Quaternion{q.W / n, q.X / n, q.Y / n, q.Z / n}
+}
+
+func (q Quaternion) Conj() Quaternion {
+	return Quaternion{q.W, -q.X, -q.Y, -q.Z}
+}
+
+// Mul returns the Hamilton product q * p, which is the rotation p followed by q.
+func (q Quaternion) Mul(p Quaternion) Quaternion {
+	return Quaternion{
+		W: q.W*p.W - q.X*p.X - q.Y*p.Y - q.Z*p.Z,
+		X: q.W*p.X + q.X*p.W + q.Y*p.Z - q.Z*p.Y,
+		Y: q.W*p.Y - q.X*p.Z + q.Y*p.W + q.Z*p.X,
+		Z: q.W*p.Z + q.X*p.Y - q.Y*p.X + q.Z*p.W,
+	}
+}
+
+// Rotate the vector v by the unit quaternion q
+func (q Quaternion) Rotate(v Vec3) Vec3 {
+	// v' = v + 2w(u x v) + 2u x (u x v) where u is the vector part
+	u := Vec3{q.X, q.Y, q.Z}
+	uv := u.Cross(v)
+	return v.Add(uv.Scale(2 * q.W)).Add(u.Cross(uv).Scale(2))
+}
+
+// Matrix returns the rotation matrix for the quaternion, normalising it first.
+func (q Quaternion) Matrix() Mat3 {
+	n := q.Norm()
+	w, x, y, z := q.W/n, q.X/n, q.Y/n, q.Z/n
+	return Mat3{
+		{1 - 2*(y*y+z*z), 2 * (x*y - w*z), 2 * (x*z + w*y)},
+		{2 * (x*y + w*z), 1 - 2*(x*x+z*z), 2 * (y*z - w*x)},
+		{2 * (x*z - w*y), 2 * (y*z + w*x), 1 - 2*(x*x+y*y)},
+	}
+}
+
+// QuaternionFromMatrix converts a rotation matrix into a unit quaternion. This uses Shepperd's
+// method which picks the largest of the 4 components to divide by, so it is stable for all
+// rotations including those close to pi.
+func QuaternionFromMatrix(m Mat3) Quaternion {
+	trace := m[0][0] + m[1][1] + m[2][2]
+	var q Quaternion
+	switch {
+	case trace > m[0][0] && trace > m[1][1] && trace > m[2][2]:
+		s := 2 * math.Sqrt(1+trace)
+		q = Quaternion{
+			W: 0.25 * s,
+			X: (m[2][1] - m[1][2]) / s,
+			Y: (m[0][2] - m[2][0]) / s,
+			Z: (m[1][0] - m[0][1]) / s,
+		}
+	case m[0][0] > m[1][1] && m[0][0] > m[2][2]:
+		s := 2 * math.Sqrt(1+m[0][0]-m[1][1]-m[2][2])
+		q = Quaternion{
+			W: (m[2][1] - m[1][2]) / s,
+			X: 0.25 * s,
+			Y: (m[0][1] + m[1][0]) / s,
+			Z: (m[0][2] + m[2][0]) / s,
+		}
+	case m[1][1] > m[2][2]:
+		s := 2 * math.Sqrt(1+m[1][1]-m[0][0]-m[2][2])
+		q = Quaternion{
+			W: (m[0][2] - m[2][0]) / s,
+			X: (m[0][1] + m[1][0]) / s,
+			Y: 0.25 * s,
+			Z: (m[1][2] + m[2][1]) / s,
+		}
+	default:
+		s := 2 * math.Sqrt(1+m[2][2]-m[0][0]-m[1][1])
+		q = Quaternion{
+			W: (m[1][0] - m[0][1]) / s,
+			X: (m[0][2] + m[2][0]) / s,
+			Y: (m[1][2] + m[2][1]) / s,
+			Z: 0.25 * s,
+		}
+	}
+	return q.Normalised()
+}
+
+// Slerp spherically interpolates between q (t=0) and p (t=1) along the shortest path.
+func (q Quaternion) Slerp(p Quaternion, t float64) Quaternion {
+	cos := q.W*p.W + q.X*p.X + q.Y*p.Y + q.Z*p.Z
+	if cos < 0 {
+		// take the short way round
+		p = Quaternion{-p.W, -p.X, -p.Y, -p.Z}
+		cos = -cos
+	}
+	var a, b float64
+	if cos > 1-1e-9 {
+		// nearly identical, fall back to linear interpolation to avoid dividing by sin(0)
+		a = 1 - t
+		b = t
+	} else {
+		theta := math.Acos(cos)
+		sin := math.Sin(theta)
+		a = math.Sin((1-t)*theta) / sin
+		b = math.Sin(t*theta) / sin
+	}
+	return Quaternion{
+		W: a*q.W + b*p.W,
+		X: a*q.X + b*p.X,
+		Y: a*q.Y + b*p.Y,
+		Z: a*q.Z + b*p.Z,
+	}.Normalised()
+}
@@ -0,0 +1,126 @@
+package geom
+
+// Mat4 is a row-major 4x4 homogeneous transformation matrix
+type Mat4 [4][4]float64
+
+// SE3 is a rigid body transform: a rotation followed by a translation. Camera poses are stored as
+// Tcw, which maps points in the world frame into the camera frame.
+// Use IdentitySE3 rather than the zero value, which is not a valid transform.
+type SE3 struct {
+	R SO3
+	T Vec3
+}
+
+func IdentitySE3() SE3 {
+	return SE3{R: IdentitySO3()}
+}
+
+func NewSE3(r Mat3, t Vec3) SE3 {
+	return SE3{R: NewSO3(r), T: t}
+}
+
+// ExpSE3 maps a twist to a transform. The twist is ordered (omega, upsilon): the first 3 elements
+// are the rotation and the last 3 are the translation, matching g2o.
+func ExpSE3(xi [6]float64) SE3 {
+	omega := Vec3{xi[0], xi[1], xi[2]}
+	upsilon := Vec3{xi[3], xi[4], xi[5]}
+	v := sim3W(omega, 0)
+	return SE3{
+		R: ExpSO3(omega),
+		T: v.MulVec(upsilon),
+	}
+}
+
+// Log maps the transform to a twist ordered (omega, upsilon)
+func (p SE3) Log() [6]float64 {
+	omega := p.R.Log()
+	v := sim3W(omega, 0)
+	vInv, _ := v.Inverse() // V is always invertible for rotations <= pi
+	upsilon := vInv.MulVec(p.T)
+	return [6]float64{omega[0], omega[1], omega[2], upsilon[0], upsilon[1], upsilon[2]}
+}
+
+// Mul returns p * o, which is the transform o followed by p.
+func (p SE3) Mul(o SE3) SE3 {
+	return SE3{
+		R: p.R.Mul(o.R),
+		T: p.R.Rotate(o.T).Add(p.T),
+	}
+}
+
+func (p SE3) Inverse() SE3 {
+	rInv := p.R.Inverse()
+	return SE3{
+		R: rInv,
+		T: rInv.Rotate(p.T).Scale(-1),
+	}
+}
+
+// Transform a point, e.g from the world frame into the camera frame if p is Tcw
+func (p SE3) Transform(v Vec3) Vec3 {
+	return p.R.Rotate(v).Add(p.T)
+}
+
+// Adjoint returns the 6x6 adjoint matrix for twists ordered (omega, upsilon), such that
+// p * exp(xi) * p^-1 == exp(Adjoint * xi)
+func (p SE3) Adjoint() [6][6]float64 {
+	var adj [6][6]float64
+	r := p.R.Matrix()
+	tr := Skew(p.T).Mul(r)
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			adj[i][j] = r[i][j]
+			adj[i+3][j+3] = r[i][j]
+			adj[i+3][j] = tr[i][j]
+		}
+	}
+	return adj
+}
+
+// Matrix returns the 4x4 homogeneous matrix [R t; 0 1]
+func (p SE3) Matrix() Mat4 {
+	var m Mat4
+	r := p.R.Matrix()
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			m[i][j] = r[i][j]
+		}
+		m[i][3] = p.T[i]
+	}
+	m[3][3] = 1
+	return m
+}
+
+// SE3FromMatrix creates a transform from a 4x4 homogeneous matrix. The rotation is re-orthogonalised.
+func SE3FromMatrix(m Mat4) SE3 {
+	var r Mat3
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			r[i][j] = m[i][j]
+		}
+	}
+	return SE3{
+		R: NewSO3(r).Normalised(),
+		T: Vec3{m[0][3], m[1][3], m[2][3]},
+	}
+}
+
+// Center returns the position of the origin of the transformed frame, e.g the camera centre in the
+// world frame if p is Tcw.
+func (p SE3) Center() Vec3 {
+	return p.Inverse().T
+}
+
+// Interpolate between p (t=0) and o (t=1) along the geodesic p * exp(t * log(p^-1 * o))
+func (p SE3) Interpolate(o SE3, t float64) SE3 {
+	xi := p.Inverse().Mul(o).Log()
+	for i := range xi {
+		xi[i] *= t
+	}
+	return p.Mul(ExpSE3(xi))
+}
+
+// Sim3 returns the transform as a similarity transform with unit scale
+func (p SE3) Sim3() Sim3 {
+	return Sim3{R: p.R, T: p.T, S: 1}
+}
@@ -0,0 +1,181 @@
+package geom
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// expm computes the exponential of a 4x4 matrix by scaling and squaring a Taylor series. It's slow
+// but obviously correct, so we use it to check the closed form exponential maps.
+func expm(a Mat4) Mat4 {
+	var norm float64
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 4; j++ {
+			norm += a[i][j] * a[i][j]
+		}
+	}
+	squarings := 0
+	for math.Sqrt(norm) > 0.01 {
+		norm /= 4
+		squarings++
+	}
+	scale := math.Pow(2, -float64(squarings))
+	var x, term, sum Mat4
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 4; j++ {
+			x[i][j] = a[i][j] * scale
+		}
+		term[i][i] = 1
+		sum[i][i] = 1
+	}
+	for k := 1; k < 20; k++ {
+		term = mat4Mul(term, x)
+		for i := 0; i < 4; i++ {
+			for j := 0; j < 4; j++ {
+				term[i][j] /= float64(k)
+				sum[i][j] += term[i][j]
+			}
+		}
+	}
+	for i := 0; i < squarings; i++ {
+		sum = mat4Mul(sum, sum)
+	}
+	return sum
+}
+
+func mat4Mul(a, b Mat4) Mat4 {
+	var out Mat4
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 4; j++ {
+			for k := 0; k < 4; k++ {
+				out[i][j] += a[i][k] * b[k][j]
+			}
+		}
+	}
+	return out
+}
+
+func mat4Close(a, b Mat4, tol float64) bool {
+	for i := 0; i < 4; i++ {
+		if !vecClose(a[i][:], b[i][:], tol) {
+			return false
+		}
+	}
+	return true
+}
+
+func randomSE3(rng *rand.Rand) SE3 {
+	return ExpSE3([6]float64{
+		rng.NormFloat64(), rng.NormFloat64(), rng.NormFloat64(),
+		rng.NormFloat64() * 3, rng.NormFloat64() * 3, rng.NormFloat64() * 3,
+	})
+}
+
+func TestSE3ExpMatchesMatrixExponential(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	twists := [][6]float64{}
+	for _, w := range awkwardRotations() {
+		twists = append(twists, [6]float64{w[0], w[1], w[2], 0.5, -1, 2})
+	}
+	for i := 0; i < 20; i++ {
+		twists = append(twists, [6]float64{
+			rng.NormFloat64(), rng.NormFloat64(), rng.NormFloat64(),
+			rng.NormFloat64(), rng.NormFloat64(), rng.NormFloat64(),
+		})
+	}
+	for _, xi := range twists {
+		// the generator is [w^ v; 0 0]
+		var gen Mat4
+		wHat := Skew(Vec3{xi[0], xi[1], xi[2]})
+		for i := 0; i < 3; i++ {
+			for j := 0; j < 3; j++ {
+				gen[i][j] = wHat[i][j]
+			}
+			gen[i][3] = xi[3+i]
+		}
+		if got, want := ExpSE3(xi).Matrix(), expm(gen); !mat4Close(got, want, 1e-9) {
+			t.Errorf("ExpSE3(%v) = %v want %v", xi, got, want)
+		}
+	}
+}
+
+func TestSE3ExpLog(t *testing.T) {
+	for _, w := range awkwardRotations() {
+		xi := [6]float64{w[0], w[1], w[2], 1, 2, -3}
+		p := ExpSE3(xi)
+		got := p.Log()
+		if !mat4Close(ExpSE3(got).Matrix(), p.Matrix(), 1e-9) {
+			t.Errorf("Exp(Log(T)) != T for %v", xi)
+		}
+		if w.Norm() < math.Pi-1e-6 && !vecClose(got[:], xi[:], 1e-8) {
+			t.Errorf("Log(Exp(%v)) = %v", xi, got)
+		}
+	}
+}
+
+func TestSE3Group(t *testing.T) {
+	rng := rand.New(rand.NewSource(4))
+	for i := 0; i < 50; i++ {
+		a := randomSE3(rng)
+		b := randomSE3(rng)
+		if !mat4Close(a.Mul(a.Inverse()).Matrix(), IdentitySE3().Matrix(), 1e-12) {
+			t.Fatalf("a * a^-1 != I")
+		}
+		if !mat4Close(a.Mul(b).Matrix(), mat4Mul(a.Matrix(), b.Matrix()), 1e-12) {
+			t.Fatalf("composition does not match matrix multiplication")
+		}
+		v := Vec3{rng.NormFloat64(), rng.NormFloat64(), rng.NormFloat64()}
+		if got, want := a.Inverse().Transform(a.Transform(v)), v; !vecClose(got[:], want[:], 1e-12) {
+			t.Fatalf("transform round trip: got %v want %v", got, want)
+		}
+		if !mat4Close(SE3FromMatrix(a.Matrix()).Matrix(), a.Matrix(), 1e-12) {
+			t.Fatalf("matrix round trip failed")
+		}
+		// camera centre is where the origin of the camera frame ends up in the world
+		if got, want := a.Center(), a.Inverse().Transform(Vec3{}); !vecClose(got[:], want[:], 1e-12) {
+			t.Fatalf("centre: got %v want %v", got, want)
+		}
+	}
+}
+
+func TestSE3Adjoint(t *testing.T) {
+	rng := rand.New(rand.NewSource(5))
+	for i := 0; i < 20; i++ {
+		p := randomSE3(rng)
+		xi := [6]float64{}
+		for j := range xi {
+			xi[j] = rng.NormFloat64() * 0.1
+		}
+		adj := p.Adjoint()
+		var adXi [6]float64
+		for r := 0; r < 6; r++ {
+			for c := 0; c < 6; c++ {
+				adXi[r] += adj[r][c] * xi[c]
+			}
+		}
+		got := p.Mul(ExpSE3(xi)).Mul(p.Inverse())
+		want := ExpSE3(adXi)
+		if !mat4Close(got.Matrix(), want.Matrix(), 1e-9) {
+			t.Fatalf("T exp(xi) T^-1 != exp(Ad xi)")
+		}
+	}
+}
+
+func TestSE3Interpolate(t *testing.T) {
+	rng := rand.New(rand.NewSource(6))
+	a := randomSE3(rng)
+	b := randomSE3(rng)
+	if !mat4Close(a.Interpolate(b, 0).Matrix(), a.Matrix(), 1e-9) {
+		t.Errorf("interpolate t=0 != a")
+	}
+	if !mat4Close(a.Interpolate(b, 1).Matrix(), b.Matrix(), 1e-9) {
+		t.Errorf("interpolate t=1 != b")
+	}
+	// going half way, then half way again from there, gets us to b
+	mid := a.Interpolate(b, 0.5)
+	step := a.Inverse().Mul(mid)
+	if !mat4Close(mid.Mul(step).Matrix(), b.Matrix(), 1e-9) {
+		t.Errorf("midpoint is not half way along the geodesic")
+	}
+}
@@ -0,0 +1,183 @@
+package geom
+
+import "math"
+
+// Sim3 is a similarity transform: rotation, translation and scale, p' = s*R*p + t. Monocular SLAM
+// cannot observe the scale of the world, which drifts over time, so loop closures are corrected
+// with similarity transforms rather than rigid ones.
+// Use IdentitySim3 rather than the zero value, which is not a valid transform.
+type Sim3 struct {
+	R SO3
+	T Vec3
+	S float64
+}
+
+func IdentitySim3() Sim3 {
+	return Sim3{R: IdentitySO3(), S: 1}
+}
+
+func NewSim3(r Mat3, t Vec3, s float64) Sim3 {
+	return Sim3{R: NewSO3(r), T: t, S: s}
+}
+
+// ExpSim3 maps a tangent vector to a similarity transform. The vector is ordered
+// (omega, upsilon, sigma) where sigma is the log of the scale, matching g2o.
+func ExpSim3(xi [7]float64) Sim3 {
+	omega := Vec3{xi[0], xi[1], xi[2]}
+	upsilon := Vec3{xi[3], xi[4], xi[5]}
+	sigma := xi[6]
+	w := sim3W(omega, sigma)
+	return Sim3{
+		R: ExpSO3(omega),
+		T: w.MulVec(upsilon),
+		S: math.Exp(sigma),
+	}
+}
+
+// Log maps the transform to a tangent vector ordered (omega, upsilon, sigma)
+func (p Sim3) Log() [7]float64 {
+	omega := p.R.Log()
+	sigma := math.Log(p.S)
+	w := sim3W(omega, sigma)
+	wInv, _ := w.Inverse()
+	upsilon := wInv.MulVec(p.T)
+	return [7]float64{omega[0], omega[1], omega[2], upsilon[0], upsilon[1], upsilon[2], sigma}
+}
+
+// Mul returns p * o, which is the transform o followed by p.
+func (p Sim3) Mul(o Sim3) Sim3 {
+	return Sim3{
+		R: p.R.Mul(o.R),
+		T: p.R.Rotate(o.T).Scale(p.S).Add(p.T),
+		S: p.S * o.S,
+	}
+}
+
+func (p Sim3) Inverse() Sim3 {
+	rInv := p.R.Inverse()
+	sInv := 1 / p.S
+	return Sim3{
+		R: rInv,
+		T: rInv.Rotate(p.T).Scale(-sInv),
+		S: sInv,
+	}
+}
+
+func (p Sim3) Transform(v Vec3) Vec3 {
+	return p.R.Rotate(v).Scale(p.S).Add(p.T)
+}
+
+// Adjoint returns the 7x7 adjoint matrix for tangent vectors ordered (omega, upsilon, sigma), such
+// that p * exp(xi) * p^-1 == exp(Adjoint * xi)
+func (p Sim3) Adjoint() [7][7]float64 {
+	var adj [7][7]float64
+	r := p.R.Matrix()
+	tr := Skew(p.T).Mul(r)
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			adj[i][j] = r[i][j]
+			adj[i+3][j+3] = p.S * r[i][j]
+			adj[i+3][j] = tr[i][j]
+		}
+		adj[i+3][6] = -p.T[i]
+	}
+	adj[6][6] = 1
+	return adj
+}
+
+// Matrix returns the 4x4 homogeneous matrix [sR t; 0 1]
+func (p Sim3) Matrix() Mat4 {
+	var m Mat4
+	r := p.R.Matrix()
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			m[i][j] = p.S * r[i][j]
+		}
+		m[i][3] = p.T[i]
+	}
+	m[3][3] = 1
+	return m
+}
+
+// Sim3FromMatrix creates a similarity transform from a 4x4 homogeneous matrix [sR t; 0 1].
+// The scale must be positive.
+func Sim3FromMatrix(m Mat4) Sim3 {
+	var sr Mat3
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			sr[i][j] = m[i][j]
+		}
+	}
+	s := math.Cbrt(sr.Det())
+	return Sim3{
+		R: NewSO3(sr.Scale(1 / s)).Normalised(),
+		T: Vec3{m[0][3], m[1][3], m[2][3]},
+		S: s,
+	}
+}
+
+// Interpolate between p (t=0) and o (t=1) along the geodesic p * exp(t * log(p^-1 * o))
+func (p Sim3) Interpolate(o Sim3, t float64) Sim3 {
+	xi := p.Inverse().Mul(o).Log()
+	for i := range xi {
+		xi[i] *= t
+	}
+	return p.Mul(ExpSim3(xi))
+}
+
+// SE3 drops the scale, which is how a corrected Sim3 pose is turned back into a camera pose:
+// [R t/s].
+func (p Sim3) SE3() SE3 {
+	return SE3{R: p.R, T: p.T.Scale(1 / p.S)}
+}
+
+// sim3W computes the matrix W which maps upsilon to the translation in the exponential map:
+// t = W * upsilon, W = A*Omega + B*Omega^2 + C*I. With sigma == 0 this is the SE3 "V" matrix.
+// Every coefficient has a well-defined limit as theta and sigma approach 0 so we switch to
+// Taylor expansions to avoid catastrophic cancellation.
+func sim3W(omega Vec3, sigma float64) Mat3 {
+	theta := omega.Norm()
+	omegaHat := Skew(omega)
+	omegaHat2 := omegaHat.Mul(omegaHat)
+	s := math.Exp(sigma)
+
+	// C = integral of e^(sigma*x) from 0 to 1
+	var c float64
+	if math.Abs(sigma) < 1e-8 {
+		c = 1 + sigma/2 + sigma*sigma/6
+	} else {
+		c = math.Expm1(sigma) / sigma
+	}
+
+	var a, b float64
+	const eps = 1e-5
+	switch {
+	case theta < eps:
+		if math.Abs(sigma) < 1 {
+			// The closed forms divide by sigma^3, so use the power series
+			// A = sum sigma^n / (n! (n+2)), B = sum sigma^n / (2 n! (n+3))
+			term := 1.0 // sigma^n / n!
+			for n := 0; n < 20; n++ {
+				a += term / float64(n+2)
+				b += term / float64(2*(n+3))
+				term *= sigma / float64(n+1)
+			}
+		} else {
+			sigma2 := sigma * sigma
+			a = ((sigma-1)*s + 1) / sigma2
+			b = ((0.5*sigma2-sigma+1)*s - 1) / (sigma2 * sigma)
+		}
+		a -= theta * theta / 24
+		b -= theta * theta / 120
+	default:
+		theta2 := theta * theta
+		sin := math.Sin(theta)
+		cos := math.Cos(theta)
+		sa := s * sin
+		sb := s * cos
+		denom := theta2 + sigma*sigma
+		a = (sa*sigma + (1-sb)*theta) / (theta * denom)
+		b = (c - ((sb-1)*sigma+sa*theta)/denom) / theta2
+	}
+	return omegaHat.Scale(a).Add(omegaHat2.Scale(b)).Add(Identity3().Scale(c))
+}
@@ -0,0 +1,136 @@
+package geom
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func randomSim3(rng *rand.Rand) Sim3 {
+	return ExpSim3([7]float64{
+		rng.NormFloat64(), rng.NormFloat64(), rng.NormFloat64(),
+		rng.NormFloat64() * 3, rng.NormFloat64() * 3, rng.NormFloat64() * 3,
+		rng.NormFloat64() * 0.5,
+	})
+}
+
+func TestSim3ExpMatchesMatrixExponential(t *testing.T) {
+	rng := rand.New(rand.NewSource(7))
+	var tangents [][7]float64
+	sigmas := []float64{0, 1e-12, 1e-9, 1e-6, 1e-4, -0.3, 0.7, 2, -2}
+	for _, w := range awkwardRotations() {
+		for _, sigma := range sigmas {
+			tangents = append(tangents, [7]float64{w[0], w[1], w[2], 0.5, -1, 2, sigma})
+		}
+	}
+	for i := 0; i < 20; i++ {
+		tangents = append(tangents, [7]float64{
+			rng.NormFloat64(), rng.NormFloat64(), rng.NormFloat64(),
+			rng.NormFloat64(), rng.NormFloat64(), rng.NormFloat64(),
+			rng.NormFloat64(),
+		})
+	}
+	for _, xi := range tangents {
+		// the generator is [w^ + sigma*I, v; 0 0]
+		var gen Mat4
+		wHat := Skew(Vec3{xi[0], xi[1], xi[2]})
+		for i := 0; i < 3; i++ {
+			for j := 0; j < 3; j++ {
+				gen[i][j] = wHat[i][j]
+			}
+			gen[i][i] += xi[6]
+			gen[i][3] = xi[3+i]
+		}
+		if got, want := ExpSim3(xi).Matrix(), expm(gen); !mat4Close(got, want, 1e-9) {
+			t.Errorf("ExpSim3(%v) = %v want %v", xi, got, want)
+		}
+	}
+}
+
+func TestSim3ExpLog(t *testing.T) {
+	for _, w := range awkwardRotations() {
+		for _, sigma := range []float64{0, 1e-10, 1e-5, -0.5, 1.5} {
+			xi := [7]float64{w[0], w[1], w[2], 1, 2, -3, sigma}
+			p := ExpSim3(xi)
+			got := p.Log()
+			if !mat4Close(ExpSim3(got).Matrix(), p.Matrix(), 1e-9) {
+				t.Errorf("Exp(Log(S)) != S for %v", xi)
+			}
+			if w.Norm() < math.Pi-1e-6 && !vecClose(got[:], xi[:], 1e-8) {
+				t.Errorf("Log(Exp(%v)) = %v", xi, got)
+			}
+		}
+	}
+}
+
+func TestSim3Group(t *testing.T) {
+	rng := rand.New(rand.NewSource(8))
+	for i := 0; i < 50; i++ {
+		a := randomSim3(rng)
+		b := randomSim3(rng)
+		if !mat4Close(a.Mul(a.Inverse()).Matrix(), IdentitySim3().Matrix(), 1e-12) {
+			t.Fatalf("a * a^-1 != I")
+		}
+		if !mat4Close(a.Mul(b).Matrix(), mat4Mul(a.Matrix(), b.Matrix()), 1e-12) {
+			t.Fatalf("composition does not match matrix multiplication")
+		}
+		v := Vec3{rng.NormFloat64(), rng.NormFloat64(), rng.NormFloat64()}
+		m := a.Matrix()
+		want := Vec3{
+			m[0][0]*v[0] + m[0][1]*v[1] + m[0][2]*v[2] + m[0][3],
+			m[1][0]*v[0] + m[1][1]*v[1] + m[1][2]*v[2] + m[1][3],
+			m[2][0]*v[0] + m[2][1]*v[1] + m[2][2]*v[2] + m[2][3],
+		}
+		if got := a.Transform(v); !vecClose(got[:], want[:], 1e-12) {
+			t.Fatalf("transform: got %v want %v", got, want)
+		}
+		back := Sim3FromMatrix(a.Matrix())
+		if !mat4Close(back.Matrix(), a.Matrix(), 1e-12) || math.Abs(back.S-a.S) > 1e-12 {
+			t.Fatalf("matrix round trip failed")
+		}
+		// SE3 conversions: a unit scale Sim3 is the same transform
+		se3 := randomSE3(rng)
+		if !mat4Close(se3.Sim3().Matrix(), se3.Matrix(), 1e-12) || !mat4Close(se3.Sim3().SE3().Matrix(), se3.Matrix(), 1e-12) {
+			t.Fatalf("SE3 <-> Sim3 conversion failed")
+		}
+	}
+}
+
+func TestSim3Adjoint(t *testing.T) {
+	rng := rand.New(rand.NewSource(9))
+	for i := 0; i < 20; i++ {
+		p := randomSim3(rng)
+		var xi [7]float64
+		for j := range xi {
+			xi[j] = rng.NormFloat64() * 0.1
+		}
+		adj := p.Adjoint()
+		var adXi [7]float64
+		for r := 0; r < 7; r++ {
+			for c := 0; c < 7; c++ {
+				adXi[r] += adj[r][c] * xi[c]
+			}
+		}
+		got := p.Mul(ExpSim3(xi)).Mul(p.Inverse())
+		want := ExpSim3(adXi)
+		if !mat4Close(got.Matrix(), want.Matrix(), 1e-9) {
+			t.Fatalf("S exp(xi) S^-1 != exp(Ad xi)")
+		}
+	}
+}
+
+func TestSim3Interpolate(t *testing.T) {
+	rng := rand.New(rand.NewSource(10))
+	a := randomSim3(rng)
+	b := randomSim3(rng)
+	if !mat4Close(a.Interpolate(b, 0).Matrix(), a.Matrix(), 1e-9) {
+		t.Errorf("interpolate t=0 != a")
+	}
+	if !mat4Close(a.Interpolate(b, 1).Matrix(), b.Matrix(), 1e-9) {
+		t.Errorf("interpolate t=1 != b")
+	}
+	mid := a.Interpolate(b, 0.5)
+	if math.Abs(mid.S-math.Sqrt(a.S*b.S)) > 1e-9 {
+		t.Errorf("scale should interpolate geometrically: got %v want %v", mid.S, math.Sqrt(a.S*b.S))
+	}
+}
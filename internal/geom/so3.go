@@ -0,0 +1,114 @@
+package geom
+
+import "math"
+
+// SO3 is a 3D rotation. Use IdentitySO3 rather than the zero value, which is not a valid rotation.
+// Learning: Sola, Deray, Atchuthan: "A micro Lie theory for state estimation in robotics" (2018)
+type SO3 struct {
+	mat Mat3
+}
+
+func IdentitySO3() SO3 {
+	return SO3{mat: Identity3()}
+}
+
+// NewSO3 creates a rotation from a rotation matrix. The matrix is not checked for orthogonality,
+// call Normalised if it may have drifted.
+func NewSO3(m Mat3) SO3 {
+	return SO3{mat: m}
+}
+
+func SO3FromQuaternion(q Quaternion) SO3 {
+	return SO3{mat: q.Matrix()}
+}
+
+// ExpSO3 maps an axis-angle vector (the Lie algebra so(3)) to a rotation.
+func ExpSO3(omega Vec3) SO3 {
+	theta := omega.Norm()
+	half := theta / 2
+	var k float64 // sin(theta/2)/theta
+	if theta < 1e-4 {
+		// Taylor expansion to avoid dividing by ~0
+		k = 0.5 - theta*theta/48
+	} else {
+		k = math.Sin(half) / theta
+	}
+	q := Quaternion{
+		W: math.Cos(half),
+		X: omega[0] * k,
+		Y: omega[1] * k,
+		Z: omega[2] * k,
+	}
+	return SO3{mat: q.Matrix()}
+}
+
+// Log maps the rotation back to an axis-angle vector with angle in [0, pi].
+// This goes via the quaternion, which is stable for both tiny rotations and those close to pi.
+func (r SO3) Log() Vec3 {
+	q := QuaternionFromMatrix(r.mat) // W >= 0
+	v := Vec3{q.X, q.Y, q.Z}
+	n := v.Norm()
+	var k float64 // theta / n
+	if n < 1e-8 {
+		// theta = 2 atan(n/w) ~= 2n/w - 2n^3/(3w^3)
+		k = 2/q.W - 2*n*n/(3*q.W*q.W*q.W)
+	} else {
+		k = 2 * math.Atan2(n, q.W) / n
+	}
+	return v.Scale(k)
+}
+
+func (r SO3) Matrix() Mat3 {
+	return r.mat
+}
+
+func (r SO3) Quaternion() Quaternion {
+	return QuaternionFromMatrix(r.mat)
+}
+
+// Mul returns r * o, which is the rotation o followed by r.
+func (r SO3) Mul(o SO3) SO3 {
+	return SO3{mat: r.mat.Mul(o.mat)}
+}
+
+func (r SO3) Inverse() SO3 {
+	return SO3{mat: r.mat.T()}
+}
+
+func (r SO3) Rotate(v Vec3) Vec3 {
+	return r.mat.MulVec(v)
+}
+
+// Adjoint of a rotation is the rotation matrix itself: R * exp(w) * R^-1 == exp(R * w)
+func (r SO3) Adjoint() Mat3 {
+	return r.mat
+}
+
+// Normalised re-orthogonalises the rotation, removing numerical drift from repeated composition.
+func (r SO3) Normalised() SO3 {
+	return SO3FromQuaternion(QuaternionFromMatrix(r.mat))
+}
+
+// Interpolate between r (t=0) and o (t=1) along the geodesic.
+func (r SO3) Interpolate(o SO3, t float64) SO3 {
+	return SO3FromQuaternion(r.Quaternion().Slerp(o.Quaternion(), t))
+}
+
+// Angle returns the rotation angle in radians
+func (r SO3) Angle() float64 {
+	return r.Log().Norm()
+}
+
+// RightJacobianSO3 returns the right Jacobian of the exponential map: for a small d,
+// Exp(omega + d) ~= Exp(omega) * Exp(Jr(omega) * d).
+func RightJacobianSO3(omega Vec3) Mat3 {
+	theta2 := omega.Dot(omega)
+	theta := math.Sqrt(theta2)
+	w := Skew(omega)
+	if theta < 1e-5 {
+		return Identity3().Add(w.Scale(-0.5))
+	}
+	a := (1 - math.Cos(theta)) / theta2
+	b := (theta - math.Sin(theta)) / (theta2 * theta)
+	return Identity3().Add(w.Scale(-a)).Add(w.Mul(w).Scale(b))
+}
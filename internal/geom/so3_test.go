@@ -0,0 +1,157 @@
+package geom
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func mat3Close(a, b Mat3, tol float64) bool {
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			if math.Abs(a[i][j]-b[i][j]) > tol {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func vecClose(a, b []float64, tol float64) bool {
+	for i := range a {
+		if math.Abs(a[i]-b[i]) > tol {
+			return false
+		}
+	}
+	return true
+}
+
+// Axis-angle vectors which are known to cause numerical problems
+func awkwardRotations() []Vec3 {
+	axis := Vec3{1, -2, 0.5}.Normalised()
+	return []Vec3{
+		{0, 0, 0},
+		axis.Scale(1e-12),
+		axis.Scale(1e-9),
+		axis.Scale(1e-6),
+		axis.Scale(1e-4),
+		axis.Scale(1),
+		axis.Scale(math.Pi - 1e-3),
+		axis.Scale(math.Pi - 1e-6),
+		axis.Scale(math.Pi - 1e-10),
+		{math.Pi, 0, 0},
+		{0, math.Pi, 0},
+		{0, 0, math.Pi},
+	}
+}
+
+func TestSO3ExpLog(t *testing.T) {
+	for _, w := range awkwardRotations() {
+		r := ExpSO3(w)
+		// must be a rotation matrix
+		m := r.Matrix()
+		if !mat3Close(m.Mul(m.T()), Identity3(), 1e-12) || math.Abs(m.Det()-1) > 1e-12 {
+			t.Fatalf("ExpSO3(%v) is not a rotation: %v", w, m)
+		}
+		got := r.Log()
+		neg := w.Scale(-1)
+		// rotations of exactly pi have 2 valid logs: w and -w
+		if !vecClose(got[:], w[:], 1e-9) && !(math.Abs(w.Norm()-math.Pi) < 1e-9 && vecClose(got[:], neg[:], 1e-9)) {
+			t.Errorf("Log(Exp(%v)) = %v", w, got)
+		}
+		// Exp(Log(R)) == R always
+		if !mat3Close(ExpSO3(got).Matrix(), m, 1e-12) {
+			t.Errorf("Exp(Log(R)) != R for %v", w)
+		}
+	}
+}
+
+func TestSO3RodriguesAgreement(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		w := Vec3{rng.NormFloat64(), rng.NormFloat64(), rng.NormFloat64()}
+		theta := w.Norm()
+		k := Skew(w.Scale(1 / theta))
+		want := Identity3().Add(k.Scale(math.Sin(theta))).Add(k.Mul(k).Scale(1 - math.Cos(theta)))
+		if !mat3Close(ExpSO3(w).Matrix(), want, 1e-12) {
+			t.Fatalf("ExpSO3 disagrees with Rodrigues' formula for %v", w)
+		}
+	}
+}
+
+func TestQuaternion(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	rots := awkwardRotations()
+	for i := 0; i < 50; i++ {
+		rots = append(rots, Vec3{rng.NormFloat64(), rng.NormFloat64(), rng.NormFloat64()})
+	}
+	for _, w := range rots {
+		r := ExpSO3(w)
+		q := r.Quaternion()
+		if math.Abs(q.Norm()-1) > 1e-12 {
+			t.Fatalf("quaternion not normalised: %v", q)
+		}
+		if !mat3Close(q.Matrix(), r.Matrix(), 1e-12) {
+			t.Fatalf("quaternion round trip failed for %v", w)
+		}
+		v := Vec3{0.3, -1, 2}
+		if got, want := q.Rotate(v), r.Rotate(v); !vecClose(got[:], want[:], 1e-12) {
+			t.Fatalf("quaternion rotate: got %v want %v", got, want)
+		}
+	}
+	a := ExpSO3(Vec3{0.1, 0.2, 0.3})
+	b := ExpSO3(Vec3{-0.5, 0.4, 0.1})
+	if !mat3Close(a.Quaternion().Mul(b.Quaternion()).Matrix(), a.Mul(b).Matrix(), 1e-12) {
+		t.Fatalf("quaternion product does not match matrix product")
+	}
+}
+
+func TestSO3Interpolate(t *testing.T) {
+	a := ExpSO3(Vec3{0.1, 0.2, 0.3})
+	b := ExpSO3(Vec3{-0.5, 0.4, 0.1})
+	if !mat3Close(a.Interpolate(b, 0).Matrix(), a.Matrix(), 1e-12) {
+		t.Errorf("interpolate t=0 != a")
+	}
+	if !mat3Close(a.Interpolate(b, 1).Matrix(), b.Matrix(), 1e-12) {
+		t.Errorf("interpolate t=1 != b")
+	}
+	// the midpoint should be half the relative rotation away from both ends
+	mid := a.Interpolate(b, 0.5)
+	d1 := a.Inverse().Mul(mid).Angle()
+	d2 := mid.Inverse().Mul(b).Angle()
+	if math.Abs(d1-d2) > 1e-12 || math.Abs(d1*2-a.Inverse().Mul(b).Angle()) > 1e-12 {
+		t.Errorf("midpoint not equidistant: %v %v", d1, d2)
+	}
+	// interpolating between nearly identical rotations must not produce NaNs
+	c := ExpSO3(Vec3{0.1, 0.2, 0.3 + 1e-12})
+	if m := a.Interpolate(c, 0.5).Matrix(); math.IsNaN(m[0][0]) {
+		t.Errorf("interpolating nearly identical rotations produced NaN")
+	}
+}
+
+func TestSO3Normalised(t *testing.T) {
+	r := ExpSO3(Vec3{0.3, 0.2, -0.1})
+	// repeated composition drifts away from orthogonality, simulate it by perturbing the matrix
+	m := r.Matrix()
+	m[0][1] += 1e-6
+	fixed := NewSO3(m).Normalised().Matrix()
+	if !mat3Close(fixed.Mul(fixed.T()), Identity3(), 1e-12) {
+		t.Fatalf("Normalised did not re-orthogonalise")
+	}
+	if !mat3Close(fixed, r.Matrix(), 1e-5) {
+		t.Fatalf("Normalised moved the rotation too far")
+	}
+}
+
+func TestRightJacobianSO3(t *testing.T) {
+	for _, w := range []Vec3{{0, 0, 0}, {1e-7, 0, 2e-7}, {0.3, -0.2, 0.5}, {1, 2, -0.5}} {
+		jr := RightJacobianSO3(w)
+		for _, d := range []Vec3{{1e-6, 0, 0}, {0, -1e-6, 0}, {0, 0, 1e-6}} {
+			want := ExpSO3(w.Add(d)).Matrix()
+			got := ExpSO3(w).Mul(ExpSO3(jr.MulVec(d))).Matrix()
+			if !mat3Close(got, want, 1e-11) {
+				t.Errorf("Jr(%v): Exp(w+d) = %v, Exp(w)Exp(Jr d) = %v", w, want, got)
+			}
+		}
+	}
+}
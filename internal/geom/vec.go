@@ -0,0 +1,54 @@
+package geom
+
+import "math"
+
+// Vec3 is a 3D vector, used for points in the world and camera frames.
+type Vec3 [3]float64
+
+func (a Vec3) Add(b Vec3) Vec3 {
+	return Vec3{a[0] + b[0], a[1] + b[1], a[2] + b[2]}
+}
+
+func (a Vec3) Sub(b Vec3) Vec3 {
+	return Vec3{a[0] - b[0], a[1] - b[1], a[2] - b[2]}
+}
+
+func (a Vec3) Scale(s float64) Vec3 {
+	return Vec3{a[0] * s, a[1] * s, a[2] * s}
+}
+
+func (a Vec3) Dot(b Vec3) float64 {
+	return a[0]*b[0] + a[1]*b[1] + a[2]*b[2]
+}
+
+func (a Vec3) Cross(b Vec3) Vec3 {
+	return Vec3{
+		a[1]*b[2] - a[2]*b[1],
+		a[2]*b[0] - a[0]*b[2],
+		a[0]*b[1] - a[1]*b[0],
+	}
+}
+
+func (a Vec3) Norm() float64 {
+	return math.Sqrt(a.Dot(a))
+}
+
+// Normalised returns a unit vector in the direction of a. The zero vector is returned unchanged.
+func (a Vec3) Normalised() Vec3 {
+	n := a.Norm()
+	if n == 0 {
+		return a
+	}
+	return a.Scale(1 / n)
+}
+
+// Outer returns the outer product a * b^T
+func (a Vec3) Outer(b Vec3) Mat3 {
+	var m Mat3
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			m[i][j] = a[i] * b[j]
+		}
+	}
+	return m
+}
@@ -0,0 +1,225 @@
+package graph
+
+import (
+	"github.com/kegsay/gorbslam/internal/camera"
+	"github.com/kegsay/gorbslam/internal/geom"
+)
+
+// EdgeProjection is a monocular observation of a map point by a keyframe: the residual is the
+// observed keypoint minus the projection of the point. Vertices are the point then the pose.
+type EdgeProjection struct {
+	EdgeBase
+	Camera camera.Pinhole
+	U      float64
+	V      float64
+}
+
+// NewEdgeProjection creates an edge for the keypoint (u, v) observing point from pose. invSigma2
+// is the inverse variance for the octave the keypoint was extracted from.
+func NewEdgeProjection(point *VertexPoint, pose *VertexSE3, cam camera.Pinhole, u, v, invSigma2 float64) *EdgeProjection {
+	return &EdgeProjection{
+		EdgeBase: EdgeBase{
+			Vertices:    []Vertex{point, pose},
+			Information: []float64{invSigma2, 0, 0, invSigma2},
+		},
+		Camera: cam,
+		U:      u,
+		V:      v,
+	}
+}
+
+func (e *EdgeProjection) Dim() int { return 2 }
+
+// PointInCamera returns the observed point in the camera frame
+func (e *EdgeProjection) PointInCamera() geom.Vec3 {
+	point := e.Vertices[0].(*VertexPoint)
+	pose := e.Vertices[1].(*VertexSE3)
+	return pose.Estimate.Transform(point.Estimate)
+}
+
+// DepthPositive returns true if the point is in front of the camera
+func (e *EdgeProjection) DepthPositive() bool {
+	return e.PointInCamera()[2] > 0
+}
+
+func (e *EdgeProjection) Residual() []float64 {
+	u, v := e.Camera.Project(e.PointInCamera())
+	return []float64{e.U - u, e.V - v}
+}
+
+func (e *EdgeProjection) Jacobians() [][]float64 {
+	pose := e.Vertices[1].(*VertexSE3)
+	pc := e.PointInCamera()
+	dp := e.Camera.ProjectionJacobian(pc)
+	r := pose.Estimate.R.Matrix()
+	jPoint := make([]float64, 2*3)
+	jPose := make([]float64, 2*6)
+	// d(pc)/d(pose) = [ -[pc]x | I ], d(pc)/d(point) = R
+	dpc := [3][6]float64{
+		{0, pc[2], -pc[1], 1, 0, 0},
+		{-pc[2], 0, pc[0], 0, 1, 0},
+		{pc[1], -pc[0], 0, 0, 0, 1},
+	}
+	for row := 0; row < 2; row++ {
+		for c := 0; c < 3; c++ {
+			jPoint[row*3+c] = -(dp[row][0]*r[0][c] + dp[row][1]*r[1][c] + dp[row][2]*r[2][c])
+		}
+		for c := 0; c < 6; c++ {
+			jPose[row*6+c] = -(dp[row][0]*dpc[0][c] + dp[row][1]*dpc[1][c] + dp[row][2]*dpc[2][c])
+		}
+	}
+	return [][]float64{jPoint, jPose}
+}
+
+// EdgePoseProjection is an observation of a fixed map point, used for motion-only bundle
+// adjustment where only the pose is optimised.
+type EdgePoseProjection struct {
+	EdgeBase
+	Camera camera.Pinhole
+	Point  geom.Vec3
+	U      float64
+	V      float64
+}
+
+// NewEdgePoseProjection creates an edge for the keypoint (u, v) observing the world point from pose.
+func NewEdgePoseProjection(pose *VertexSE3, cam camera.Pinhole, point geom.Vec3, u, v, invSigma2 float64) *EdgePoseProjection {
+	return &EdgePoseProjection{
+		EdgeBase: EdgeBase{
+			Vertices:    []Vertex{pose},
+			Information: []float64{invSigma2, 0, 0, invSigma2},
+		},
+		Camera: cam,
+		Point:  point,
+		U:      u,
+		V:      v,
+	}
+}
+
+func (e *EdgePoseProjection) Dim() int { return 2 }
+
+// PointInCamera returns the observed point in the camera frame
+func (e *EdgePoseProjection) PointInCamera() geom.Vec3 {
+	return e.Vertices[0].(*VertexSE3).Estimate.Transform(e.Point)
+}
+
+func (e *EdgePoseProjection) Residual() []float64 {
+	u, v := e.Camera.Project(e.PointInCamera())
+	return []float64{e.U - u, e.V - v}
+}
+
+func (e *EdgePoseProjection) Jacobians() [][]float64 {
+	pc := e.PointInCamera()
+	dp := e.Camera.ProjectionJacobian(pc)
+	dpc := [3][6]float64{
+		{0, pc[2], -pc[1], 1, 0, 0},
+		{-pc[2], 0, pc[0], 0, 1, 0},
+		{pc[1], -pc[0], 0, 0, 0, 1},
+	}
+	j := make([]float64, 2*6)
+	for row := 0; row < 2; row++ {
+		for c := 0; c < 6; c++ {
+			j[row*6+c] = -(dp[row][0]*dpc[0][c] + dp[row][1]*dpc[1][c] + dp[row][2]*dpc[2][c])
+		}
+	}
+	return [][]float64{j}
+}
+
+// EdgeSim3 is a relative similarity constraint between two Sim3 vertices i and j, as used by the
+// essential graph. The measurement is Sji = Sjw * Swi, and the residual is
+// log(Sji * Siw * Swj), which is zero when the vertices agree with the measurement. The Jacobians
+// are computed numerically, as in ORB-SLAM2.
+type EdgeSim3 struct {
+	EdgeBase
+	Measurement geom.Sim3
+}
+
+// NewEdgeSim3 creates a relative constraint with the measurement sji between vi and vj.
+func NewEdgeSim3(vi, vj *VertexSim3, sji geom.Sim3) *EdgeSim3 {
+	return &EdgeSim3{
+		EdgeBase:    EdgeBase{Vertices: []Vertex{vi, vj}},
+		Measurement: sji,
+	}
+}
+
+func (e *EdgeSim3) Dim() int { return 7 }
+
+func (e *EdgeSim3) Residual() []float64 {
+	siw := e.Vertices[0].(*VertexSim3).Estimate
+	sjw := e.Vertices[1].(*VertexSim3).Estimate
+	r := e.Measurement.Mul(siw).Mul(sjw.Inverse()).Log()
+	return r[:]
+}
+
+// EdgeSim3Projection is an observation by keyframe 1 of a fixed point from keyframe 2, used to
+// refine the similarity S12 between two keyframes when closing a loop. The point P2 is in the
+// camera frame of keyframe 2 and is projected into keyframe 1 by S12. The Jacobians are computed
+// numerically.
+type EdgeSim3Projection struct {
+	EdgeBase
+	Camera camera.Pinhole
+	Point  geom.Vec3
+	U      float64
+	V      float64
+}
+
+// NewEdgeSim3Projection creates an edge for the keypoint (u, v) in keyframe 1 observing p2.
+func NewEdgeSim3Projection(s12 *VertexSim3, cam camera.Pinhole, p2 geom.Vec3, u, v, invSigma2 float64) *EdgeSim3Projection {
+	return &EdgeSim3Projection{
+		EdgeBase: EdgeBase{
+			Vertices:    []Vertex{s12},
+			Information: []float64{invSigma2, 0, 0, invSigma2},
+		},
+		Camera: cam,
+		Point:  p2,
+		U:      u,
+		V:      v,
+	}
+}
+
+func (e *EdgeSim3Projection) Dim() int { return 2 }
+
+// PointInCamera returns the point in the camera frame of keyframe 1
+func (e *EdgeSim3Projection) PointInCamera() geom.Vec3 {
+	return e.Vertices[0].(*VertexSim3).Estimate.Transform(e.Point)
+}
+
+func (e *EdgeSim3Projection) Residual() []float64 {
+	u, v := e.Camera.Project(e.PointInCamera())
+	return []float64{e.U - u, e.V - v}
+}
+
+// EdgeInverseSim3Projection is the reverse of EdgeSim3Projection: an observation by keyframe 2 of
+// the point P1 from keyframe 1, projected by the inverse of S12.
+type EdgeInverseSim3Projection struct {
+	EdgeBase
+	Camera camera.Pinhole
+	Point  geom.Vec3
+	U      float64
+	V      float64
+}
+
+// NewEdgeInverseSim3Projection creates an edge for the keypoint (u, v) in keyframe 2 observing p1.
+func NewEdgeInverseSim3Projection(s12 *VertexSim3, cam camera.Pinhole, p1 geom.Vec3, u, v, invSigma2 float64) *EdgeInverseSim3Projection {
+	return &EdgeInverseSim3Projection{
+		EdgeBase: EdgeBase{
+			Vertices:    []Vertex{s12},
+			Information: []float64{invSigma2, 0, 0, invSigma2},
+		},
+		Camera: cam,
+		Point:  p1,
+		U:      u,
+		V:      v,
+	}
+}
+
+func (e *EdgeInverseSim3Projection) Dim() int { return 2 }
+
+// PointInCamera returns the point in the camera frame of keyframe 2
+func (e *EdgeInverseSim3Projection) PointInCamera() geom.Vec3 {
+	return e.Vertices[0].(*VertexSim3).Estimate.Inverse().Transform(e.Point)
+}
+
+func (e *EdgeInverseSim3Projection) Residual() []float64 {
+	u, v := e.Camera.Project(e.PointInCamera())
+	return []float64{e.U - u, e.V - v}
+}
@@ -0,0 +1,396 @@
+// Package graph is a small g2o-like framework for non-linear least squares problems expressed as
+// graphs: vertices are the parameters being optimised (poses, points) and edges are the
+// measurements between them. Each edge contributes a residual, and the optimiser minimises the
+// sum of the (robustified) squared residuals weighted by their information matrices.
+// Learning: Kümmerle et al: "g2o: A General Framework for Graph Optimization" (2011)
+package graph
+
+import (
+	"context"
+	"errors"
+	"math"
+)
+
+// Vertex is a parameter block being optimised. Updates are applied with Plus, which lets vertices
+// live on a manifold (e.g SE3) while the optimiser works with a minimal vector of Dim elements.
+// Implementations must embed VertexBase.
+type Vertex interface {
+	// The number of degrees of freedom
+	Dim() int
+	// Apply an update of Dim elements to the estimate
+	Plus(delta []float64)
+	// Push saves the current estimate, Pop restores the last saved estimate and Discard drops it.
+	Push()
+	Pop()
+	Discard()
+	base() *VertexBase
+}
+
+// VertexBase holds the properties common to all vertices.
+type VertexBase struct {
+	// Fixed vertices are not optimised but still constrain the vertices they are linked to.
+	Fixed bool
+	// Marginalized vertices are eliminated with the Schur complement before solving for the rest.
+	// This is much faster when there are many small vertices (e.g map points) which are only linked
+	// to the other vertices. Marginalized vertices must not be linked to each other.
+	Marginalized bool
+
+	graph *Graph
+	kind  vertexKind
+	// the index of the vertex in the reduced system (free) or in the marginalized list
+	index int
+}
+
+func (b *VertexBase) base() *VertexBase {
+	return b
+}
+
+type vertexKind int
+
+const (
+	kindFree vertexKind = iota
+	kindMarginalized
+	kindFixed
+)
+
+// Edge is a measurement linking one or more vertices. Implementations must embed EdgeBase. Edges
+// which also implement JacobianEdge supply analytic Jacobians, otherwise they are computed by
+// numeric differentiation of Residual.
+type Edge interface {
+	// The number of elements in the residual
+	Dim() int
+	// The residual for the current estimates of the vertices
+	Residual() []float64
+	base() *EdgeBase
+}
+
+// JacobianEdge is an Edge which can compute its own Jacobians.
+type JacobianEdge interface {
+	Edge
+	// Jacobians returns the derivative of the residual with respect to each vertex, in the same
+	// order as the vertices. Each is row-major with Dim rows and vertex.Dim() columns. Jacobians
+	// for fixed vertices may be nil.
+	Jacobians() [][]float64
+}
+
+// EdgeBase holds the properties common to all edges.
+type EdgeBase struct {
+	// The vertices this edge links
+	Vertices []Vertex
+	// Row-major Dim x Dim information matrix (inverse covariance). nil means the identity.
+	Information []float64
+	// Optional robust kernel, to reduce the influence of outliers
+	Kernel Kernel
+	// Disabled edges are ignored by the optimiser. ORB-SLAM2 uses g2o levels for this, e.g to
+	// exclude outliers from the second phase of an optimisation.
+	Disabled bool
+}
+
+func (b *EdgeBase) base() *EdgeBase {
+	return b
+}
+
+// Chi2 returns the information-weighted squared residual e^T * Information * e of an edge.
+func Chi2(e Edge) float64 {
+	return chi2(e.Residual(), e.base().Information)
+}
+
+func chi2(r, info []float64) float64 {
+	if info == nil {
+		return dot(r, r)
+	}
+	d := len(r)
+	var sum float64
+	for i := 0; i < d; i++ {
+		for j := 0; j < d; j++ {
+			sum += r[i] * info[i*d+j] * r[j]
+		}
+	}
+	return sum
+}
+
+// Algorithm is the non-linear least squares method used to optimise the graph.
+type Algorithm int
+
+const (
+	// Levenberg-Marquardt: Gauss-Newton with adaptive damping. The default, as it copes well
+	// with poor initial estimates.
+	LevenbergMarquardt Algorithm = iota
+	// Gauss-Newton: every step is accepted. Fast when the initial estimate is good.
+	GaussNewton
+	// Powell's dogleg: a trust region method mixing the Gauss-Newton and steepest descent steps.
+	Dogleg
+)
+
+var (
+	// ErrMarginalizedLink is returned if an edge links two different marginalized vertices, which
+	// would break the block diagonal structure the Schur complement relies on.
+	ErrMarginalizedLink = errors.New("graph: edge links two marginalized vertices")
+	// ErrUnknownVertex is returned if an edge refers to a vertex which was not added to the graph.
+	ErrUnknownVertex = errors.New("graph: edge refers to a vertex not in the graph")
+)
+
+// Stats describes an optimisation run
+type Stats struct {
+	Iterations int
+	// The robust cost before and after optimising
+	InitialCost float64
+	FinalCost   float64
+	// True if the context was cancelled before the optimisation completed
+	Aborted bool
+}
+
+// Graph is a set of vertices and edges to optimise.
+type Graph struct {
+	Algorithm Algorithm
+	vertices  []Vertex
+	edges     []Edge
+}
+
+// AddVertex adds a vertex to the graph.
+func (g *Graph) AddVertex(v Vertex) {
+	v.base().graph = g
+	g.vertices = append(g.vertices, v)
+}
+
+// AddEdge adds an edge to the graph. Its vertices must be added to the graph before optimising.
+func (g *Graph) AddEdge(e Edge) {
+	g.edges = append(g.edges, e)
+}
+
+// Vertices returns the vertices in the order they were added
+func (g *Graph) Vertices() []Vertex {
+	return g.vertices
+}
+
+// Edges returns the edges in the order they were added
+func (g *Graph) Edges() []Edge {
+	return g.edges
+}
+
+// Cost returns the robust cost of all enabled edges at the current estimate.
+func (g *Graph) Cost() float64 {
+	var cost float64
+	for _, e := range g.edges {
+		if e.base().Disabled {
+			continue
+		}
+		c := Chi2(e)
+		if k := e.base().Kernel; k != nil {
+			c, _ = k.Robustify(c)
+		}
+		cost += c
+	}
+	return cost
+}
+
+// Optimize runs up to the given number of iterations of the graph's Algorithm. It stops early if
+// the cost converges or the context is cancelled, keeping whatever progress has been made.
+func (g *Graph) Optimize(ctx context.Context, iterations int) (Stats, error) {
+	if err := g.prepare(); err != nil {
+		return Stats{}, err
+	}
+	sys := g.newSystem()
+	cost, err := sys.build(g.edges)
+	if err != nil {
+		return Stats{}, err
+	}
+	stats := Stats{InitialCost: cost, FinalCost: cost}
+	if cost == 0 {
+		return stats, nil
+	}
+	var step func(sys *system, cost float64) (float64, bool)
+	switch g.Algorithm {
+	case GaussNewton:
+		step = g.gaussNewtonStep
+	case Dogleg:
+		d := &dogleg{radius: 1e4}
+		step = d.step(g)
+	default:
+		var maxDiag float64
+		for _, d := range sys.diagonal() {
+			maxDiag = math.Max(maxDiag, d)
+		}
+		lm := &levenbergMarquardt{lambda: 1e-5 * maxDiag, nu: 2}
+		step = lm.step(g)
+	}
+
+	for iter := 0; iter < iterations; iter++ {
+		if ctx.Err() != nil {
+			stats.Aborted = true
+			break
+		}
+		stats.Iterations++
+		newCost, accepted := step(sys, cost)
+		if !accepted {
+			continue
+		}
+		converged := math.Abs(cost-newCost) <= 1e-10*cost
+		if cost, err = sys.build(g.edges); err != nil {
+			return stats, err
+		}
+		if converged || cost == 0 {
+			break
+		}
+	}
+	stats.FinalCost = cost
+	return stats, nil
+}
+
+// Assign every vertex to the free, marginalized or fixed part of the system.
+func (g *Graph) prepare() error {
+	var numFree, numMarginalized int
+	for _, v := range g.vertices {
+		b := v.base()
+		switch {
+		case b.Fixed:
+			b.kind = kindFixed
+		case b.Marginalized:
+			b.kind = kindMarginalized
+			b.index = numMarginalized
+			numMarginalized++
+		default:
+			b.kind = kindFree
+			b.index = numFree
+			numFree++
+		}
+	}
+	for _, e := range g.edges {
+		for _, v := range e.base().Vertices {
+			if v.base().graph != g {
+				return ErrUnknownVertex
+			}
+		}
+	}
+	return nil
+}
+
+func (g *Graph) push() {
+	for _, v := range g.vertices {
+		v.Push()
+	}
+}
+
+func (g *Graph) pop() {
+	for _, v := range g.vertices {
+		v.Pop()
+	}
+}
+
+func (g *Graph) discard() {
+	for _, v := range g.vertices {
+		v.Discard()
+	}
+}
+
+// Apply an update to every free and marginalized vertex.
+func (g *Graph) apply(dx *update) {
+	for _, v := range g.vertices {
+		b := v.base()
+		switch b.kind {
+		case kindFree:
+			o := dx.offsets[b.index]
+			v.Plus(dx.free[o : o+v.Dim()])
+		case kindMarginalized:
+			v.Plus(dx.marginalized[b.index])
+		}
+	}
+}
+
+func (g *Graph) gaussNewtonStep(sys *system, cost float64) (float64, bool) {
+	dx, ok := sys.solve(0)
+	if !ok {
+		return cost, false
+	}
+	g.apply(dx)
+	return g.Cost(), true
+}
+
+type levenbergMarquardt struct {
+	lambda float64
+	nu     float64
+}
+
+func (lm *levenbergMarquardt) step(g *Graph) func(sys *system, cost float64) (float64, bool) {
+	return func(sys *system, cost float64) (float64, bool) {
+		dx, ok := sys.solve(lm.lambda)
+		if !ok {
+			lm.lambda *= lm.nu
+			lm.nu *= 2
+			return cost, false
+		}
+		// gain ratio: actual reduction vs the reduction predicted by the linear model
+		predicted := dx.dot(sys.gradient()) + lm.lambda*dx.dot(dx)
+		g.push()
+		g.apply(dx)
+		newCost := g.Cost()
+		if newCost < cost && predicted > 0 {
+			g.discard()
+			rho := (cost - newCost) / predicted
+			lm.lambda *= math.Max(1.0/3, 1-math.Pow(2*rho-1, 3))
+			lm.nu = 2
+			return newCost, true
+		}
+		g.pop()
+		lm.lambda *= lm.nu
+		lm.nu *= 2
+		return cost, false
+	}
+}
+
+// Learning: Madsen et al: "Methods for Non-Linear Least Squares Problems" (2004), section 3.3
+type dogleg struct {
+	radius float64
+}
+
+func (d *dogleg) step(g *Graph) func(sys *system, cost float64) (float64, bool) {
+	return func(sys *system, cost float64) (float64, bool) {
+		grad := sys.gradient()
+		gradNorm := math.Sqrt(grad.dot(grad))
+		if gradNorm == 0 {
+			return cost, false
+		}
+		// the Cauchy point: the minimum along the steepest descent direction
+		alpha := grad.dot(grad) / grad.dot(sys.mulVec(grad))
+		// the Gauss-Newton step, with a little damping if the system is singular
+		gn, ok := sys.solve(0)
+		for damping := 1e-9; !ok && damping < 1e9; damping *= 100 {
+			gn, ok = sys.solve(damping)
+		}
+
+		var dx *update
+		switch {
+		case ok && math.Sqrt(gn.dot(gn)) <= d.radius:
+			dx = gn
+		case !ok || alpha*gradNorm >= d.radius:
+			dx = grad.scale(d.radius / gradNorm)
+		default:
+			// move from the Cauchy point towards the Gauss-Newton step until we hit the radius
+			a := grad.scale(alpha)
+			diff := gn.sub(a)
+			aa, ad, dd := a.dot(a), a.dot(diff), diff.dot(diff)
+			r2 := d.radius * d.radius
+			beta := (-ad + math.Sqrt(ad*ad+dd*(r2-aa))) / dd
+			dx = a.add(diff.scale(beta))
+		}
+
+		// predicted reduction of the quadratic model: 2 b.dx - dx^T H dx
+		predicted := 2*dx.dot(grad) - dx.dot(sys.mulVec(dx))
+		stepNorm := math.Sqrt(dx.dot(dx))
+		g.push()
+		g.apply(dx)
+		newCost := g.Cost()
+		rho := (cost - newCost) / predicted
+		if rho > 0.75 {
+			d.radius = math.Max(d.radius, 3*stepNorm)
+		} else if rho < 0.25 {
+			d.radius = stepNorm / 2
+		}
+		if newCost < cost && predicted > 0 {
+			g.discard()
+			return newCost, true
+		}
+		g.pop()
+		return cost, false
+	}
+}
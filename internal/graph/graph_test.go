@@ -0,0 +1,259 @@
+package graph
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/kegsay/gorbslam/internal/camera"
+	"github.com/kegsay/gorbslam/internal/geom"
+)
+
+var testCam = camera.Pinhole{Fx: 500, Fy: 500, Cx: 320, Cy: 240}
+
+type baScene struct {
+	g          *Graph
+	poses      []*VertexSE3
+	points     []*VertexPoint
+	truePoses  []geom.SE3
+	truePoints []geom.Vec3
+}
+
+// A camera moving sideways along x looking at points in front of it. The first two poses are
+// fixed to remove the gauge freedom. Poses and points are perturbed from the truth.
+func newBAScene(rng *rand.Rand, numPoses, numPoints int, marginalize bool) *baScene {
+	s := &baScene{g: &Graph{}}
+	for i := 0; i < numPoses; i++ {
+		twc := geom.NewSE3(geom.ExpSO3(geom.Vec3{0, rng.NormFloat64() * 0.05, 0}).Matrix(), geom.Vec3{float64(i) * 0.3, 0, 0})
+		tcw := twc.Inverse()
+		v := &VertexSE3{Estimate: tcw}
+		if i < 2 {
+			v.Fixed = true
+		} else {
+			v.Estimate = geom.ExpSE3([6]float64{
+				rng.NormFloat64() * 0.01, rng.NormFloat64() * 0.01, rng.NormFloat64() * 0.01,
+				rng.NormFloat64() * 0.03, rng.NormFloat64() * 0.03, rng.NormFloat64() * 0.03,
+			}).Mul(tcw)
+		}
+		s.g.AddVertex(v)
+		s.poses = append(s.poses, v)
+		s.truePoses = append(s.truePoses, tcw)
+	}
+	for i := 0; i < numPoints; i++ {
+		pw := geom.Vec3{rng.Float64()*float64(numPoses)*0.3 - 1, rng.Float64()*4 - 2, 4 + rng.Float64()*4}
+		v := &VertexPoint{Estimate: pw.Add(geom.Vec3{rng.NormFloat64(), rng.NormFloat64(), rng.NormFloat64()}.Scale(0.05))}
+		v.Marginalized = marginalize
+		s.g.AddVertex(v)
+		s.points = append(s.points, v)
+		s.truePoints = append(s.truePoints, pw)
+		for k, pose := range s.truePoses {
+			pc := pose.Transform(pw)
+			u, vv := testCam.Project(pc)
+			if pc[2] <= 0 || u < 0 || u >= 640 || vv < 0 || vv >= 480 {
+				continue
+			}
+			s.g.AddEdge(NewEdgeProjection(v, s.poses[k], testCam, u, vv, 1))
+		}
+	}
+	return s
+}
+
+func (s *baScene) check(t *testing.T, tol float64) {
+	t.Helper()
+	for i, p := range s.poses {
+		if d := p.Estimate.Center().Sub(s.truePoses[i].Center()).Norm(); d > tol {
+			t.Errorf("pose %d: translation error %v", i, d)
+		}
+	}
+	for i, p := range s.points {
+		if d := p.Estimate.Sub(s.truePoints[i]).Norm(); d > tol {
+			t.Fatalf("point %d: error %v", i, d)
+		}
+	}
+}
+
+func TestOptimizeAlgorithms(t *testing.T) {
+	testCases := []struct {
+		name        string
+		algorithm   Algorithm
+		marginalize bool
+	}{
+		{name: "levenberg-marquardt", algorithm: LevenbergMarquardt, marginalize: true},
+		{name: "levenberg-marquardt without marginalization", algorithm: LevenbergMarquardt},
+		{name: "gauss-newton", algorithm: GaussNewton, marginalize: true},
+		{name: "dogleg", algorithm: Dogleg, marginalize: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newBAScene(rand.New(rand.NewSource(1)), 8, 150, tc.marginalize)
+			s.g.Algorithm = tc.algorithm
+			stats, err := s.g.Optimize(context.Background(), 30)
+			if err != nil {
+				t.Fatalf("Optimize: %s", err)
+			}
+			if stats.FinalCost > 1e-8 {
+				t.Errorf("did not converge: cost %v -> %v in %d iterations", stats.InitialCost, stats.FinalCost, stats.Iterations)
+			}
+			s.check(t, 1e-4)
+		})
+	}
+}
+
+func TestMarginalizationMatchesFullSystem(t *testing.T) {
+	// a single Gauss-Newton step must be the same whether or not the points are eliminated
+	full := newBAScene(rand.New(rand.NewSource(2)), 5, 60, false)
+	schur := newBAScene(rand.New(rand.NewSource(2)), 5, 60, true)
+	for _, s := range []*baScene{full, schur} {
+		s.g.Algorithm = GaussNewton
+		if _, err := s.g.Optimize(context.Background(), 1); err != nil {
+			t.Fatalf("Optimize: %s", err)
+		}
+	}
+	for i := range full.poses {
+		a, b := full.poses[i].Estimate, schur.poses[i].Estimate
+		if a.T.Sub(b.T).Norm() > 1e-9 || a.R.Mul(b.R.Inverse()).Angle() > 1e-9 {
+			t.Errorf("pose %d differs: %v vs %v", i, a, b)
+		}
+	}
+	for i := range full.points {
+		if d := full.points[i].Estimate.Sub(schur.points[i].Estimate).Norm(); d > 1e-9 {
+			t.Errorf("point %d differs by %v", i, d)
+		}
+	}
+}
+
+func TestRobustKernelRejectsOutliers(t *testing.T) {
+	s := newBAScene(rand.New(rand.NewSource(3)), 8, 150, true)
+	rng := rand.New(rand.NewSource(4))
+	for _, e := range s.g.Edges() {
+		ep := e.(*EdgeProjection)
+		ep.Kernel = Huber{Delta: math.Sqrt(5.991)}
+		if rng.Float64() < 0.05 {
+			ep.U += 40
+			ep.V -= 40
+		}
+	}
+	if _, err := s.g.Optimize(context.Background(), 30); err != nil {
+		t.Fatalf("Optimize: %s", err)
+	}
+	for i, p := range s.poses {
+		if d := p.Estimate.Center().Sub(s.truePoses[i].Center()).Norm(); d > 0.01 {
+			t.Errorf("pose %d: translation error %v", i, d)
+		}
+	}
+	// points seen by only a couple of nearby poses, one of them an outlier, have poorly
+	// constrained depth so only check the typical error
+	errs := make([]float64, len(s.points))
+	for i, p := range s.points {
+		errs[i] = p.Estimate.Sub(s.truePoints[i]).Norm()
+	}
+	sort.Float64s(errs)
+	if median := errs[len(errs)/2]; median > 0.01 {
+		t.Errorf("median point error %v", median)
+	}
+}
+
+func TestPoseGraphSim3(t *testing.T) {
+	// a loop of poses with relative Sim3 constraints, including a loop closure from the last pose
+	// back to the first. Only the first vertex is fixed.
+	rng := rand.New(rand.NewSource(5))
+	const n = 12
+	truth := make([]geom.Sim3, n)
+	vertices := make([]*VertexSim3, n)
+	g := &Graph{}
+	for i := range truth {
+		angle := 2 * math.Pi * float64(i) / n
+		twc := geom.NewSE3(geom.ExpSO3(geom.Vec3{0, -angle, 0}).Matrix(), geom.Vec3{5 * math.Cos(angle), 0, 5 * math.Sin(angle)})
+		truth[i] = twc.Inverse().Sim3()
+		vertices[i] = &VertexSim3{Estimate: truth[i]}
+		if i == 0 {
+			vertices[i].Fixed = true
+		} else {
+			// drift grows along the trajectory
+			drift := float64(i) / n
+			vertices[i].Estimate = geom.ExpSim3([7]float64{
+				rng.NormFloat64() * 0.02 * drift, rng.NormFloat64() * 0.02 * drift, rng.NormFloat64() * 0.02 * drift,
+				rng.NormFloat64() * 0.2 * drift, rng.NormFloat64() * 0.2 * drift, rng.NormFloat64() * 0.2 * drift,
+				0.1 * drift,
+			}).Mul(truth[i])
+		}
+		g.AddVertex(vertices[i])
+	}
+	link := func(i, j int) {
+		sji := truth[j].Mul(truth[i].Inverse())
+		g.AddEdge(NewEdgeSim3(vertices[i], vertices[j], sji))
+	}
+	for i := 0; i+1 < n; i++ {
+		link(i, i+1)
+	}
+	link(n-1, 0)
+
+	if _, err := g.Optimize(context.Background(), 20); err != nil {
+		t.Fatalf("Optimize: %s", err)
+	}
+	for i, v := range vertices {
+		got := v.Estimate.Mul(truth[i].Inverse()).Log()
+		for k, x := range got {
+			if math.Abs(x) > 1e-5 {
+				t.Errorf("vertex %d: error %v in element %d", i, x, k)
+			}
+		}
+	}
+}
+
+func TestNumericJacobianMatchesAnalytic(t *testing.T) {
+	point := &VertexPoint{Estimate: geom.Vec3{0.3, -0.2, 4}}
+	pose := &VertexSE3{Estimate: geom.ExpSE3([6]float64{0.1, -0.2, 0.05, 0.3, 0.1, -0.2})}
+	u, v := testCam.Project(pose.Estimate.Transform(point.Estimate))
+	edges := []JacobianEdge{
+		NewEdgeProjection(point, pose, testCam, u+2, v-1, 1),
+		NewEdgePoseProjection(pose, testCam, point.Estimate, u+2, v-1, 1),
+	}
+	for _, e := range edges {
+		analytic := e.Jacobians()
+		numeric := numericJacobians(e)
+		for i := range analytic {
+			for k := range analytic[i] {
+				if math.Abs(analytic[i][k]-numeric[i][k]) > 1e-4 {
+					t.Errorf("%T vertex %d element %d: analytic %v numeric %v", e, i, k, analytic[i][k], numeric[i][k])
+				}
+			}
+		}
+	}
+}
+
+func TestOptimizeErrors(t *testing.T) {
+	g := &Graph{}
+	a := &VertexSim3{Estimate: geom.IdentitySim3()}
+	b := &VertexSim3{Estimate: geom.IdentitySim3()}
+	a.Marginalized = true
+	b.Marginalized = true
+	g.AddVertex(a)
+	g.AddVertex(b)
+	g.AddEdge(NewEdgeSim3(a, b, geom.NewSim3(geom.Identity3(), geom.Vec3{1, 0, 0}, 1)))
+	if _, err := g.Optimize(context.Background(), 1); err != ErrMarginalizedLink {
+		t.Errorf("got %v want ErrMarginalizedLink", err)
+	}
+
+	g = &Graph{}
+	g.AddVertex(a)
+	g.AddEdge(NewEdgeSim3(a, &VertexSim3{Estimate: geom.IdentitySim3()}, geom.IdentitySim3()))
+	if _, err := g.Optimize(context.Background(), 1); err != ErrUnknownVertex {
+		t.Errorf("got %v want ErrUnknownVertex", err)
+	}
+}
+
+func TestOptimizeCancelled(t *testing.T) {
+	s := newBAScene(rand.New(rand.NewSource(6)), 4, 30, true)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	stats, err := s.g.Optimize(ctx, 10)
+	if err != nil {
+		t.Fatalf("Optimize: %s", err)
+	}
+	if !stats.Aborted || stats.Iterations != 0 {
+		t.Errorf("expected an aborted run with no iterations, got %+v", stats)
+	}
+}
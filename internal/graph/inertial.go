@@ -0,0 +1,251 @@
+package graph
+
+import (
+	"math"
+
+	"github.com/kegsay/gorbslam/internal/geom"
+	"github.com/kegsay/gorbslam/internal/imu"
+)
+
+// VertexVelocity is the velocity of the IMU in world coordinates.
+type VertexVelocity struct {
+	VertexBase
+	Estimate geom.Vec3
+	stack    []geom.Vec3
+}
+
+func (v *VertexVelocity) Dim() int { return 3 }
+
+func (v *VertexVelocity) Plus(delta []float64) {
+	v.Estimate = v.Estimate.Add(geom.Vec3{delta[0], delta[1], delta[2]})
+}
+
+func (v *VertexVelocity) Push() { v.stack = append(v.stack, v.Estimate) }
+
+func (v *VertexVelocity) Pop() {
+	v.Estimate = v.stack[len(v.stack)-1]
+	v.Discard()
+}
+
+func (v *VertexVelocity) Discard() { v.stack = v.stack[:len(v.stack)-1] }
+
+// VertexBias is the bias of either the gyroscope or the accelerometer.
+type VertexBias struct {
+	VertexBase
+	Estimate geom.Vec3
+	stack    []geom.Vec3
+}
+
+func (v *VertexBias) Dim() int { return 3 }
+
+func (v *VertexBias) Plus(delta []float64) {
+	v.Estimate = v.Estimate.Add(geom.Vec3{delta[0], delta[1], delta[2]})
+}
+
+func (v *VertexBias) Push() { v.stack = append(v.stack, v.Estimate) }
+
+func (v *VertexBias) Pop() {
+	v.Estimate = v.stack[len(v.stack)-1]
+	v.Discard()
+}
+
+func (v *VertexBias) Discard() { v.stack = v.stack[:len(v.stack)-1] }
+
+// VertexGravityDir is the rotation Rwg from the inertial frame, whose z axis points up, to the
+// world. Only the direction of gravity matters, so rotations about the inertial z axis are not
+// observable and updates only rotate about x and y: Rwg <- Rwg * exp(delta0, delta1, 0).
+type VertexGravityDir struct {
+	VertexBase
+	Estimate geom.SO3
+	stack    []geom.SO3
+}
+
+func (v *VertexGravityDir) Dim() int { return 2 }
+
+func (v *VertexGravityDir) Plus(delta []float64) {
+	v.Estimate = v.Estimate.Mul(geom.ExpSO3(geom.Vec3{delta[0], delta[1], 0})).Normalised()
+}
+
+func (v *VertexGravityDir) Push() { v.stack = append(v.stack, v.Estimate) }
+
+func (v *VertexGravityDir) Pop() {
+	v.Estimate = v.stack[len(v.stack)-1]
+	v.Discard()
+}
+
+func (v *VertexGravityDir) Discard() { v.stack = v.stack[:len(v.stack)-1] }
+
+// Gravity returns the gravity vector in world coordinates
+func (v *VertexGravityDir) Gravity() geom.Vec3 {
+	return v.Estimate.Rotate(imu.Gravity())
+}
+
+// VertexScale is the scale of a monocular map. Updates are multiplicative, so the scale stays
+// positive: s <- s * exp(delta).
+type VertexScale struct {
+	VertexBase
+	Estimate float64
+	stack    []float64
+}
+
+func (v *VertexScale) Dim() int { return 1 }
+
+func (v *VertexScale) Plus(delta []float64) {
+	v.Estimate *= math.Exp(delta[0])
+}
+
+func (v *VertexScale) Push() { v.stack = append(v.stack, v.Estimate) }
+
+func (v *VertexScale) Pop() {
+	v.Estimate = v.stack[len(v.stack)-1]
+	v.Discard()
+}
+
+func (v *VertexScale) Discard() { v.stack = v.stack[:len(v.stack)-1] }
+
+// EdgeInertial is the preintegrated IMU motion between keyframes i and j. Vertices are the pose
+// Tcw and velocity of i, the gyroscope and accelerometer biases of i, then the pose and velocity
+// of j. The residual is the difference in rotation, velocity and position between the motion of
+// the vertices and the preintegrated motion, corrected to the biases. The Jacobians are computed
+// numerically.
+type EdgeInertial struct {
+	EdgeBase
+	Preintegrated *imu.Preintegrated
+	// Gravity in world coordinates
+	Gravity geom.Vec3
+}
+
+// NewEdgeInertial creates an edge for the preintegration p between keyframes i and j, in a world
+// where gravity is g.
+func NewEdgeInertial(pose1 *VertexSE3, vel1 *VertexVelocity, gyroBias, accBias *VertexBias, pose2 *VertexSE3, vel2 *VertexVelocity, p *imu.Preintegrated, g geom.Vec3) *EdgeInertial {
+	return &EdgeInertial{
+		EdgeBase: EdgeBase{
+			Vertices:    []Vertex{pose1, vel1, gyroBias, accBias, pose2, vel2},
+			Information: p.Information(),
+		},
+		Preintegrated: p,
+		Gravity:       g,
+	}
+}
+
+func (e *EdgeInertial) Dim() int { return 9 }
+
+func (e *EdgeInertial) Residual() []float64 {
+	v := e.Vertices
+	tcb := e.Preintegrated.Calibration.Tcb
+	twb1 := v[0].(*VertexSE3).Estimate.Inverse().Mul(tcb)
+	twb2 := v[4].(*VertexSE3).Estimate.Inverse().Mul(tcb)
+	b := imu.Bias{Gyro: v[2].(*VertexBias).Estimate, Acc: v[3].(*VertexBias).Estimate}
+	return inertialResidual(e.Preintegrated, b, twb1, twb2, v[1].(*VertexVelocity).Estimate, v[5].(*VertexVelocity).Estimate, e.Gravity)
+}
+
+// EdgeInertialGS is EdgeInertial for a monocular map whose scale and orientation relative to
+// gravity are unknown, as used by the inertial initialisation. Vertices are as EdgeInertial then
+// the gravity direction and the scale. The camera positions are multiplied by the scale to give
+// metres, whereas the velocities are already in metres per second.
+type EdgeInertialGS struct {
+	EdgeBase
+	Preintegrated *imu.Preintegrated
+}
+
+// NewEdgeInertialGS creates an edge for the preintegration p between keyframes i and j.
+func NewEdgeInertialGS(pose1 *VertexSE3, vel1 *VertexVelocity, gyroBias, accBias *VertexBias, pose2 *VertexSE3, vel2 *VertexVelocity, gravity *VertexGravityDir, scale *VertexScale, p *imu.Preintegrated) *EdgeInertialGS {
+	return &EdgeInertialGS{
+		EdgeBase: EdgeBase{
+			Vertices:    []Vertex{pose1, vel1, gyroBias, accBias, pose2, vel2, gravity, scale},
+			Information: p.Information(),
+		},
+		Preintegrated: p,
+	}
+}
+
+func (e *EdgeInertialGS) Dim() int { return 9 }
+
+func (e *EdgeInertialGS) Residual() []float64 {
+	v := e.Vertices
+	s := v[7].(*VertexScale).Estimate
+	tcb := e.Preintegrated.Calibration.Tcb
+	// Twb = Twc * Tcb with the camera position scaled to metres
+	scaled := func(tcw geom.SE3) geom.SE3 {
+		twc := tcw.Inverse()
+		twc.T = twc.T.Scale(s)
+		return twc.Mul(tcb)
+	}
+	twb1 := scaled(v[0].(*VertexSE3).Estimate)
+	twb2 := scaled(v[4].(*VertexSE3).Estimate)
+	b := imu.Bias{Gyro: v[2].(*VertexBias).Estimate, Acc: v[3].(*VertexBias).Estimate}
+	g := v[6].(*VertexGravityDir).Gravity()
+	return inertialResidual(e.Preintegrated, b, twb1, twb2, v[1].(*VertexVelocity).Estimate, v[5].(*VertexVelocity).Estimate, g)
+}
+
+// inertialResidual compares the motion of the body from (twb1, v1) to (twb2, v2) under gravity g
+// with the preintegrated motion corrected to the bias b
+func inertialResidual(p *imu.Preintegrated, b imu.Bias, twb1, twb2 geom.SE3, v1, v2, g geom.Vec3) []float64 {
+	dt := p.DeltaT
+	rbw1 := twb1.R.Inverse()
+	er := p.DeltaRotation(b).Inverse().Mul(rbw1).Mul(twb2.R).Log()
+	ev := rbw1.Rotate(v2.Sub(v1).Sub(g.Scale(dt))).Sub(p.DeltaVelocity(b))
+	ep := rbw1.Rotate(twb2.T.Sub(twb1.T).Sub(v1.Scale(dt)).Sub(g.Scale(dt * dt / 2))).Sub(p.DeltaPosition(b))
+	return []float64{er[0], er[1], er[2], ev[0], ev[1], ev[2], ep[0], ep[1], ep[2]}
+}
+
+// EdgeBiasRandomWalk links the gyroscope or accelerometer biases of consecutive keyframes, which
+// should differ by no more than the random walk of the sensor. The residual is the difference of
+// the two biases.
+type EdgeBiasRandomWalk struct {
+	EdgeBase
+}
+
+// NewEdgeBiasRandomWalk creates an edge between the biases of keyframes i and j. info is the
+// inverse variance of each component of the random walk between them.
+func NewEdgeBiasRandomWalk(b1, b2 *VertexBias, info float64) *EdgeBiasRandomWalk {
+	return &EdgeBiasRandomWalk{
+		EdgeBase: EdgeBase{
+			Vertices:    []Vertex{b1, b2},
+			Information: diagonal3(info),
+		},
+	}
+}
+
+func (e *EdgeBiasRandomWalk) Dim() int { return 3 }
+
+func (e *EdgeBiasRandomWalk) Residual() []float64 {
+	d := e.Vertices[1].(*VertexBias).Estimate.Sub(e.Vertices[0].(*VertexBias).Estimate)
+	return d[:]
+}
+
+func (e *EdgeBiasRandomWalk) Jacobians() [][]float64 {
+	return [][]float64{diagonal3(-1), diagonal3(1)}
+}
+
+// EdgeBiasPrior pulls a bias towards a prior value, e.g zero when the biases are first estimated.
+type EdgeBiasPrior struct {
+	EdgeBase
+	Prior geom.Vec3
+}
+
+// NewEdgeBiasPrior creates a prior of prior for b, with info the inverse variance of each component.
+func NewEdgeBiasPrior(b *VertexBias, prior geom.Vec3, info float64) *EdgeBiasPrior {
+	return &EdgeBiasPrior{
+		EdgeBase: EdgeBase{
+			Vertices:    []Vertex{b},
+			Information: diagonal3(info),
+		},
+		Prior: prior,
+	}
+}
+
+func (e *EdgeBiasPrior) Dim() int { return 3 }
+
+func (e *EdgeBiasPrior) Residual() []float64 {
+	d := e.Prior.Sub(e.Vertices[0].(*VertexBias).Estimate)
+	return d[:]
+}
+
+func (e *EdgeBiasPrior) Jacobians() [][]float64 {
+	return [][]float64{diagonal3(-1)}
+}
+
+func diagonal3(v float64) []float64 {
+	return []float64{v, 0, 0, 0, v, 0, 0, 0, v}
+}
@@ -0,0 +1,52 @@
+package graph
+
+import "math"
+
+// Kernel is a robust cost function which reduces the influence of large residuals, so a few bad
+// measurements can't drag the solution too far.
+// Learning: Zhang: "Parameter Estimation Techniques: A Tutorial with Application to Conic Fitting" (1997)
+type Kernel interface {
+	// Robustify returns the robust cost for the squared error chi2, and its derivative with
+	// respect to chi2 which is used to weight the edge (iteratively reweighted least squares).
+	Robustify(chi2 float64) (cost, weight float64)
+}
+
+// Huber is quadratic for errors under Delta and linear above it.
+type Huber struct {
+	Delta float64
+}
+
+func (k Huber) Robustify(chi2 float64) (float64, float64) {
+	d2 := k.Delta * k.Delta
+	if chi2 <= d2 {
+		return chi2, 1
+	}
+	e := math.Sqrt(chi2)
+	return 2*k.Delta*e - d2, k.Delta / e
+}
+
+// Cauchy grows logarithmically, so large errors have even less influence than with Huber.
+type Cauchy struct {
+	Delta float64
+}
+
+func (k Cauchy) Robustify(chi2 float64) (float64, float64) {
+	d2 := k.Delta * k.Delta
+	x := chi2 / d2
+	return d2 * math.Log1p(x), 1 / (1 + x)
+}
+
+// Tukey (biweight) ignores errors over Delta entirely. It should only be used once the estimate is
+// close, as measurements which start out far away never get a chance to pull the solution.
+type Tukey struct {
+	Delta float64
+}
+
+func (k Tukey) Robustify(chi2 float64) (float64, float64) {
+	d2 := k.Delta * k.Delta
+	if chi2 > d2 {
+		return d2 / 3, 0
+	}
+	x := 1 - chi2/d2
+	return d2 / 3 * (1 - x*x*x), x * x
+}
@@ -0,0 +1,30 @@
+package graph
+
+import (
+	"math"
+	"testing"
+)
+
+func TestKernels(t *testing.T) {
+	kernels := []Kernel{Huber{Delta: 2}, Cauchy{Delta: 2}, Tukey{Delta: 2}}
+	for _, k := range kernels {
+		// quadratic near zero
+		if cost, w := k.Robustify(1e-8); math.Abs(cost-1e-8) > 1e-12 || math.Abs(w-1) > 1e-6 {
+			t.Errorf("%T: not quadratic near zero: cost %v weight %v", k, cost, w)
+		}
+		// the weight is the derivative of the cost, and the cost is continuous
+		for _, chi2 := range []float64{0.5, 3.9, 4.1, 10, 100} {
+			const h = 1e-6
+			plus, _ := k.Robustify(chi2 + h)
+			minus, _ := k.Robustify(chi2 - h)
+			_, w := k.Robustify(chi2)
+			if numeric := (plus - minus) / (2 * h); math.Abs(numeric-w) > 1e-5 {
+				t.Errorf("%T chi2=%v: weight %v but derivative %v", k, chi2, w, numeric)
+			}
+		}
+		// large errors cost less than least squares
+		if cost, _ := k.Robustify(100); cost >= 100 {
+			t.Errorf("%T: large error not down-weighted: %v", k, cost)
+		}
+	}
+}
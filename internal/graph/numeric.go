@@ -0,0 +1,39 @@
+package graph
+
+// The step used for central differences. The estimates are O(1)-ish (metres, radians) so this
+// balances truncation error against floating point cancellation.
+const numericStep = 1e-6
+
+// numericJacobians differentiates the residual of an edge with respect to each of its non-fixed
+// vertices using central differences. Used for edges which don't implement JacobianEdge.
+func numericJacobians(e Edge) [][]float64 {
+	vertices := e.base().Vertices
+	d := e.Dim()
+	js := make([][]float64, len(vertices))
+	for i, v := range vertices {
+		if v.base().Fixed {
+			continue
+		}
+		n := v.Dim()
+		j := make([]float64, d*n)
+		delta := make([]float64, n)
+		for k := 0; k < n; k++ {
+			delta[k] = numericStep
+			v.Push()
+			v.Plus(delta)
+			plus := e.Residual()
+			v.Pop()
+			delta[k] = -numericStep
+			v.Push()
+			v.Plus(delta)
+			minus := e.Residual()
+			v.Pop()
+			delta[k] = 0
+			for r := 0; r < d; r++ {
+				j[r*n+k] = (plus[r] - minus[r]) / (2 * numericStep)
+			}
+		}
+		js[i] = j
+	}
+	return js
+}
@@ -0,0 +1,450 @@
+package graph
+
+import (
+	"sort"
+
+	"github.com/kegsay/gorbslam/internal/sparse"
+)
+
+// The linearised system H dx = b at the current estimate, with H = sum(J^T W J) and
+// b = -sum(J^T W e). The free vertices form a block-sparse matrix, and each marginalized vertex
+// has its own diagonal block plus the blocks linking it to free vertices.
+type system struct {
+	dims    []int
+	offsets []int
+	hcc     *sparse.BlockSym
+	bc      []float64
+	marg    []*marginalized
+}
+
+type marginalized struct {
+	dim int
+	hmm []float64
+	bm  []float64
+	// free vertex index -> the (free dim x dim) block of H linking them
+	cross map[int][]float64
+}
+
+// update is a vector with one element per degree of freedom of the free and marginalized vertices
+type update struct {
+	offsets      []int
+	free         []float64
+	marginalized [][]float64
+}
+
+func (g *Graph) newSystem() *system {
+	s := &system{}
+	for _, v := range g.vertices {
+		b := v.base()
+		switch b.kind {
+		case kindFree:
+			s.dims = append(s.dims, v.Dim())
+		case kindMarginalized:
+			s.marg = append(s.marg, &marginalized{dim: v.Dim()})
+		}
+	}
+	var offset int
+	s.offsets = make([]int, len(s.dims))
+	for i, d := range s.dims {
+		s.offsets[i] = offset
+		offset += d
+	}
+	s.bc = make([]float64, offset)
+	return s
+}
+
+// Linearise every enabled edge at the current estimate. Returns the robust cost.
+func (s *system) build(edges []Edge) (float64, error) {
+	s.hcc = sparse.NewBlockSym(s.dims)
+	for i := range s.bc {
+		s.bc[i] = 0
+	}
+	for _, m := range s.marg {
+		m.hmm = make([]float64, m.dim*m.dim)
+		m.bm = make([]float64, m.dim)
+		m.cross = make(map[int][]float64)
+	}
+	var cost float64
+	for _, e := range edges {
+		eb := e.base()
+		if eb.Disabled {
+			continue
+		}
+		r := e.Residual()
+		d := len(r)
+		info := eb.Information
+		if info == nil {
+			info = identity(d)
+		}
+		c := chi2(r, info)
+		w := 1.0
+		if eb.Kernel != nil {
+			c, w = eb.Kernel.Robustify(c)
+		}
+		cost += c
+
+		var js [][]float64
+		if je, ok := e.(JacobianEdge); ok {
+			js = je.Jacobians()
+		} else {
+			js = numericJacobians(e)
+		}
+		// W * e
+		we := make([]float64, d)
+		for i := 0; i < d; i++ {
+			for k := 0; k < d; k++ {
+				we[i] += w * info[i*d+k] * r[k]
+			}
+		}
+		for a, va := range eb.Vertices {
+			ba := va.base()
+			if ba.kind == kindFixed {
+				continue
+			}
+			ja := js[a]
+			na := va.Dim()
+			// W * Ja
+			wja := make([]float64, d*na)
+			for i := 0; i < d; i++ {
+				for k := 0; k < d; k++ {
+					wik := w * info[i*d+k]
+					if wik == 0 {
+						continue
+					}
+					for c := 0; c < na; c++ {
+						wja[i*na+c] += wik * ja[k*na+c]
+					}
+				}
+			}
+			// b_a -= Ja^T W e
+			var bv []float64
+			if ba.kind == kindFree {
+				o := s.offsets[ba.index]
+				bv = s.bc[o : o+na]
+			} else {
+				bv = s.marg[ba.index].bm
+			}
+			for c := 0; c < na; c++ {
+				var sum float64
+				for i := 0; i < d; i++ {
+					sum += ja[i*na+c] * we[i]
+				}
+				bv[c] -= sum
+			}
+			// H_ab += Ja^T W Jb, for each later vertex b (including a itself)
+			for bIdx := a; bIdx < len(eb.Vertices); bIdx++ {
+				vb := eb.Vertices[bIdx]
+				if vb.base().kind == kindFixed {
+					continue
+				}
+				jb := js[bIdx]
+				nb := vb.Dim()
+				// block is na x nb: Ja^T W Jb = (W Ja)^T Jb
+				block := make([]float64, na*nb)
+				for i := 0; i < d; i++ {
+					for r := 0; r < na; r++ {
+						x := wja[i*na+r]
+						if x == 0 {
+							continue
+						}
+						for c := 0; c < nb; c++ {
+							block[r*nb+c] += x * jb[i*nb+c]
+						}
+					}
+				}
+				if err := s.add(va, vb, block, a == bIdx); err != nil {
+					return 0, err
+				}
+			}
+		}
+	}
+	return cost, nil
+}
+
+// Add the na x nb block Ja^T W Jb to H. If diagonal is false and both are the same vertex, the
+// transpose is also added since the pair only appears once.
+func (s *system) add(va, vb Vertex, block []float64, diagonal bool) error {
+	ba, bb := va.base(), vb.base()
+	na, nb := va.Dim(), vb.Dim()
+	switch {
+	case ba.kind == kindFree && bb.kind == kindFree:
+		switch {
+		case ba.index < bb.index:
+			addTo(s.hcc.Block(ba.index, bb.index), block, na, nb, false)
+		case ba.index > bb.index:
+			addTo(s.hcc.Block(bb.index, ba.index), block, na, nb, true)
+		default:
+			h := s.hcc.Block(ba.index, ba.index)
+			addTo(h, block, na, nb, false)
+			if !diagonal {
+				addTo(h, block, na, nb, true)
+			}
+		}
+	case ba.kind == kindFree:
+		m := s.marg[bb.index]
+		addTo(m.crossBlock(ba.index, na), block, na, nb, false)
+	case bb.kind == kindFree:
+		m := s.marg[ba.index]
+		addTo(m.crossBlock(bb.index, nb), block, na, nb, true)
+	case ba.index == bb.index:
+		m := s.marg[ba.index]
+		addTo(m.hmm, block, na, nb, false)
+		if !diagonal {
+			addTo(m.hmm, block, na, nb, true)
+		}
+	default:
+		return ErrMarginalizedLink
+	}
+	return nil
+}
+
+func (m *marginalized) crossBlock(free, freeDim int) []float64 {
+	b, ok := m.cross[free]
+	if !ok {
+		b = make([]float64, freeDim*m.dim)
+		m.cross[free] = b
+	}
+	return b
+}
+
+// Add the rows x cols block src to dst, or its transpose.
+func addTo(dst, src []float64, rows, cols int, transpose bool) {
+	if !transpose {
+		for i := range src {
+			dst[i] += src[i]
+		}
+		return
+	}
+	for r := 0; r < rows; r++ {
+		for c := 0; c < cols; c++ {
+			dst[c*rows+r] += src[r*cols+c]
+		}
+	}
+}
+
+// The scalar diagonal of H, free vertices then marginalized
+func (s *system) diagonal() []float64 {
+	diag := s.hcc.Diagonal()
+	for _, m := range s.marg {
+		for k := 0; k < m.dim; k++ {
+			diag = append(diag, m.hmm[k*m.dim+k])
+		}
+	}
+	return diag
+}
+
+// Solve (H + lambda * I) dx = b, eliminating the marginalized vertices with the Schur complement.
+func (s *system) solve(lambda float64) (*update, bool) {
+	reduced := s.hcc.Clone()
+	reduced.AddToDiagonal(lambda)
+	rhs := append([]float64(nil), s.bc...)
+
+	inverses := make([][]float64, len(s.marg))
+	for mi, m := range s.marg {
+		if len(m.cross) == 0 && isZero(m.hmm) {
+			// not constrained by any enabled edge, leave it alone
+			continue
+		}
+		inv := append([]float64(nil), m.hmm...)
+		for k := 0; k < m.dim; k++ {
+			inv[k*m.dim+k] += lambda
+		}
+		if !sparse.InvertSPD(inv, m.dim) {
+			return nil, false
+		}
+		inverses[mi] = inv
+
+		frees := make([]int, 0, len(m.cross))
+		for c := range m.cross {
+			frees = append(frees, c)
+		}
+		sort.Ints(frees)
+		// W_c = H_cm * H_mm^-1
+		ws := make([][]float64, len(frees))
+		for i, c := range frees {
+			ws[i] = mulBlocks(m.cross[c], inv, s.dims[c], m.dim, m.dim)
+		}
+		for i, c := range frees {
+			dc := s.dims[c]
+			o := s.offsets[c]
+			// rhs_c -= W_c * b_m
+			for r := 0; r < dc; r++ {
+				var sum float64
+				for k := 0; k < m.dim; k++ {
+					sum += ws[i][r*m.dim+k] * m.bm[k]
+				}
+				rhs[o+r] -= sum
+			}
+			// S_cc' -= W_c * H_c'm^T
+			for j := i; j < len(frees); j++ {
+				c2 := frees[j]
+				cross2 := m.cross[c2]
+				dc2 := s.dims[c2]
+				block := reduced.Block(c, c2)
+				for r := 0; r < dc; r++ {
+					for col := 0; col < dc2; col++ {
+						var sum float64
+						for k := 0; k < m.dim; k++ {
+							sum += ws[i][r*m.dim+k] * cross2[col*m.dim+k]
+						}
+						block[r*dc2+col] -= sum
+					}
+				}
+			}
+		}
+	}
+
+	free, ok := sparse.Solve(reduced, rhs)
+	if !ok {
+		return nil, false
+	}
+	if free == nil {
+		free = []float64{}
+	}
+	dx := &update{offsets: s.offsets, free: free, marginalized: make([][]float64, len(s.marg))}
+	for mi, m := range s.marg {
+		dx.marginalized[mi] = make([]float64, m.dim)
+		inv := inverses[mi]
+		if inv == nil {
+			continue
+		}
+		// dx_m = H_mm^-1 (b_m - sum(H_cm^T dx_c))
+		rhsM := append([]float64(nil), m.bm...)
+		for c, cross := range m.cross {
+			o := s.offsets[c]
+			for k := 0; k < m.dim; k++ {
+				var sum float64
+				for r := 0; r < s.dims[c]; r++ {
+					sum += cross[r*m.dim+k] * free[o+r]
+				}
+				rhsM[k] -= sum
+			}
+		}
+		for r := 0; r < m.dim; r++ {
+			var sum float64
+			for k := 0; k < m.dim; k++ {
+				sum += inv[r*m.dim+k] * rhsM[k]
+			}
+			dx.marginalized[mi][r] = sum
+		}
+	}
+	return dx, true
+}
+
+// The gradient direction b = -J^T W e
+func (s *system) gradient() *update {
+	g := &update{offsets: s.offsets, free: s.bc, marginalized: make([][]float64, len(s.marg))}
+	for i, m := range s.marg {
+		g.marginalized[i] = m.bm
+	}
+	return g
+}
+
+// Compute H * x
+func (s *system) mulVec(x *update) *update {
+	y := &update{offsets: s.offsets, free: s.hcc.MulVec(x.free), marginalized: make([][]float64, len(s.marg))}
+	for mi, m := range s.marg {
+		xm := x.marginalized[mi]
+		ym := make([]float64, m.dim)
+		for r := 0; r < m.dim; r++ {
+			for c := 0; c < m.dim; c++ {
+				ym[r] += m.hmm[r*m.dim+c] * xm[c]
+			}
+		}
+		for c, cross := range m.cross {
+			o := s.offsets[c]
+			for r := 0; r < s.dims[c]; r++ {
+				for k := 0; k < m.dim; k++ {
+					y.free[o+r] += cross[r*m.dim+k] * xm[k]
+					ym[k] += cross[r*m.dim+k] * x.free[o+r]
+				}
+			}
+		}
+		y.marginalized[mi] = ym
+	}
+	return y
+}
+
+func (u *update) dot(o *update) float64 {
+	sum := dot(u.free, o.free)
+	for i := range u.marginalized {
+		sum += dot(u.marginalized[i], o.marginalized[i])
+	}
+	return sum
+}
+
+func (u *update) combine(o *update, f func(a, b float64) float64) *update {
+	out := &update{offsets: u.offsets, free: make([]float64, len(u.free)), marginalized: make([][]float64, len(u.marginalized))}
+	for i := range u.free {
+		var b float64
+		if o != nil {
+			b = o.free[i]
+		}
+		out.free[i] = f(u.free[i], b)
+	}
+	for i, m := range u.marginalized {
+		out.marginalized[i] = make([]float64, len(m))
+		for k := range m {
+			var b float64
+			if o != nil {
+				b = o.marginalized[i][k]
+			}
+			out.marginalized[i][k] = f(m[k], b)
+		}
+	}
+	return out
+}
+
+func (u *update) scale(s float64) *update {
+	return u.combine(nil, func(a, _ float64) float64 { return a * s })
+}
+
+func (u *update) add(o *update) *update {
+	return u.combine(o, func(a, b float64) float64 { return a + b })
+}
+
+func (u *update) sub(o *update) *update {
+	return u.combine(o, func(a, b float64) float64 { return a - b })
+}
+
+// Multiply the rows x inner matrix a by the inner x cols matrix b
+func mulBlocks(a, b []float64, rows, inner, cols int) []float64 {
+	out := make([]float64, rows*cols)
+	for r := 0; r < rows; r++ {
+		for k := 0; k < inner; k++ {
+			x := a[r*inner+k]
+			if x == 0 {
+				continue
+			}
+			for c := 0; c < cols; c++ {
+				out[r*cols+c] += x * b[k*cols+c]
+			}
+		}
+	}
+	return out
+}
+
+func identity(d int) []float64 {
+	m := make([]float64, d*d)
+	for i := 0; i < d; i++ {
+		m[i*d+i] = 1
+	}
+	return m
+}
+
+func isZero(a []float64) bool {
+	for _, v := range a {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func dot(a, b []float64) float64 {
+	var sum float64
+	for i := range a {
+		sum += a[i] * b[i]
+	}
+	return sum
+}
@@ -0,0 +1,83 @@
+package graph
+
+import "github.com/kegsay/gorbslam/internal/geom"
+
+// VertexSE3 is a camera pose Tcw. Updates are left-multiplied: Tcw <- exp(delta) * Tcw with
+// delta = (omega, upsilon).
+type VertexSE3 struct {
+	VertexBase
+	Estimate geom.SE3
+	stack    []geom.SE3
+}
+
+func (v *VertexSE3) Dim() int { return 6 }
+
+func (v *VertexSE3) Plus(delta []float64) {
+	var d [6]float64
+	copy(d[:], delta)
+	v.Estimate = geom.ExpSE3(d).Mul(v.Estimate)
+}
+
+func (v *VertexSE3) Push() { v.stack = append(v.stack, v.Estimate) }
+
+func (v *VertexSE3) Pop() {
+	v.Estimate = v.stack[len(v.stack)-1]
+	v.Discard()
+}
+
+func (v *VertexSE3) Discard() { v.stack = v.stack[:len(v.stack)-1] }
+
+// VertexSim3 is a similarity transform Siw, used for pose graph optimisation where monocular scale
+// drift must be corrected. Updates are left-multiplied: Siw <- exp(delta) * Siw with
+// delta = (omega, upsilon, sigma). If FixScale is set (stereo/RGB-D, where scale is observable)
+// the scale is not optimised and the vertex has 6 degrees of freedom.
+type VertexSim3 struct {
+	VertexBase
+	Estimate geom.Sim3
+	FixScale bool
+	stack    []geom.Sim3
+}
+
+func (v *VertexSim3) Dim() int {
+	if v.FixScale {
+		return 6
+	}
+	return 7
+}
+
+func (v *VertexSim3) Plus(delta []float64) {
+	var d [7]float64
+	copy(d[:], delta)
+	v.Estimate = geom.ExpSim3(d).Mul(v.Estimate)
+}
+
+func (v *VertexSim3) Push() { v.stack = append(v.stack, v.Estimate) }
+
+func (v *VertexSim3) Pop() {
+	v.Estimate = v.stack[len(v.stack)-1]
+	v.Discard()
+}
+
+func (v *VertexSim3) Discard() { v.stack = v.stack[:len(v.stack)-1] }
+
+// VertexPoint is a 3D point in world coordinates.
+type VertexPoint struct {
+	VertexBase
+	Estimate geom.Vec3
+	stack    []geom.Vec3
+}
+
+func (v *VertexPoint) Dim() int { return 3 }
+
+func (v *VertexPoint) Plus(delta []float64) {
+	v.Estimate = v.Estimate.Add(geom.Vec3{delta[0], delta[1], delta[2]})
+}
+
+func (v *VertexPoint) Push() { v.stack = append(v.stack, v.Estimate) }
+
+func (v *VertexPoint) Pop() {
+	v.Estimate = v.stack[len(v.stack)-1]
+	v.Discard()
+}
+
+func (v *VertexPoint) Discard() { v.stack = v.stack[:len(v.stack)-1] }
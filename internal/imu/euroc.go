@@ -0,0 +1,57 @@
+package imu
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kegsay/gorbslam/internal/geom"
+)
+
+// ReadEuRoCCSV reads IMU measurements in the format of the EuRoC MAV dataset's imu0/data.csv:
+// a timestamp in nanoseconds, the angular velocity then the linear acceleration, one measurement
+// per line. Lines starting with '#' are comments. Example contents:
+//
+//	#timestamp [ns],w_RS_S_x [rad s^-1],w_RS_S_y [rad s^-1],w_RS_S_z [rad s^-1],a_RS_S_x [m s^-2],a_RS_S_y [m s^-2],a_RS_S_z [m s^-2]
+//	1403636579758555392,-0.0991347,0.1403244,0.0293215,8.1476917,-0.3759215,-2.4026292
+//
+// The measurements are returned in the order they were read.
+func ReadEuRoCCSV(r io.Reader) ([]Measurement, error) {
+	var ms []Measurement
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ",")
+		if len(fields) != 7 {
+			return nil, fmt.Errorf("line %d: expected 7 fields, got %d", lineNum, len(fields))
+		}
+		ns, err := strconv.ParseInt(strings.TrimSpace(fields[0]), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid timestamp '%s'", lineNum, fields[0])
+		}
+		var values [6]float64
+		for i := range values {
+			values[i], err = strconv.ParseFloat(strings.TrimSpace(fields[i+1]), 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: expected a number, got '%s'", lineNum, fields[i+1])
+			}
+		}
+		ms = append(ms, Measurement{
+			Timestamp: time.Unix(0, ns),
+			Gyro:      geom.Vec3{values[0], values[1], values[2]},
+			Acc:       geom.Vec3{values[3], values[4], values[5]},
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ms, nil
+}
@@ -0,0 +1,45 @@
+package imu
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kegsay/gorbslam/internal/geom"
+)
+
+func TestReadEuRoCCSV(t *testing.T) {
+	const csv = `#timestamp [ns],w_RS_S_x [rad s^-1],w_RS_S_y [rad s^-1],w_RS_S_z [rad s^-1],a_RS_S_x [m s^-2],a_RS_S_y [m s^-2],a_RS_S_z [m s^-2]
+1403636579758555392,-0.099134701513277898,0.14032447186034408,0.029321531433504733,8.1476917083333333,-0.37592158333333331,-2.4026292499999999
+1403636579763555584,-0.099134701513277898,0.14032447186034408,0.029321531433504733,8.033280791666666,-0.40861041666666664,-2.4026292499999999
+
+`
+	ms, err := ReadEuRoCCSV(strings.NewReader(csv))
+	if err != nil {
+		t.Fatalf("ReadEuRoCCSV: %s", err)
+	}
+	if len(ms) != 2 {
+		t.Fatalf("got %d measurements, want 2", len(ms))
+	}
+	want := Measurement{
+		Timestamp: time.Unix(0, 1403636579758555392),
+		Gyro:      geom.Vec3{-0.099134701513277898, 0.14032447186034408, 0.029321531433504733},
+		Acc:       geom.Vec3{8.1476917083333333, -0.37592158333333331, -2.4026292499999999},
+	}
+	if ms[0] != want {
+		t.Errorf("got %+v want %+v", ms[0], want)
+	}
+	if d := ms[1].Timestamp.Sub(ms[0].Timestamp); d != 5000192*time.Nanosecond {
+		t.Errorf("measurements are %v apart", d)
+	}
+
+	for _, bad := range []string{
+		"1403636579758555392,1,2,3,4,5\n",
+		"14036365797585x5392,1,2,3,4,5,6\n",
+		"1403636579758555392,1,2,3,4,five,6\n",
+	} {
+		if _, err := ReadEuRoCCSV(strings.NewReader(bad)); err == nil {
+			t.Errorf("no error reading %q", bad)
+		}
+	}
+}
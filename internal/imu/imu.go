@@ -0,0 +1,86 @@
+// Package imu handles the measurements of an inertial measurement unit: the angular velocity from a
+// gyroscope and the linear acceleration from an accelerometer, sampled much faster than the camera.
+// Between two keyframes the measurements are preintegrated into a single relative motion, which
+// constrains the poses, velocities and sensor biases of the keyframes in the optimiser.
+// Learning: Forster et al: "On-Manifold Preintegration for Real-Time Visual-Inertial Odometry" (2017)
+package imu
+
+import (
+	"math"
+	"time"
+
+	"github.com/kegsay/gorbslam/internal/geom"
+)
+
+// GravityValue is the magnitude of gravity in m/s^2. Gravity points along -z in the inertial frame.
+const GravityValue = 9.81
+
+// Gravity returns the gravity vector in the inertial frame
+func Gravity() geom.Vec3 {
+	return geom.Vec3{0, 0, -GravityValue}
+}
+
+// Measurement is a single IMU sample, in the body frame of the IMU
+type Measurement struct {
+	Timestamp time.Time
+	// Linear acceleration in m/s^2, including the reaction to gravity: an IMU at rest measures +g
+	// upwards
+	Acc geom.Vec3
+	// Angular velocity in rad/s
+	Gyro geom.Vec3
+}
+
+// Bias is the slowly varying offset of the accelerometer and gyroscope, which is subtracted from
+// every measurement
+type Bias struct {
+	Acc  geom.Vec3
+	Gyro geom.Vec3
+}
+
+// Calibration describes the IMU and where it is mounted relative to the camera. The noise is given
+// as the discrete standard deviations of a single sample, see NewCalibration.
+type Calibration struct {
+	// Tcb transforms points from the body (IMU) frame to the camera frame, and Tbc is its inverse
+	Tcb geom.SE3
+	Tbc geom.SE3
+	// The standard deviation of a gyroscope (rad/s) and accelerometer (m/s^2) sample
+	NoiseGyro float64
+	NoiseAcc  float64
+	// The standard deviation of the change in the gyroscope and accelerometer biases, per sqrt(s)
+	WalkGyro float64
+	WalkAcc  float64
+}
+
+// NewCalibration creates the calibration of an IMU sampled at frequency Hz from its datasheet
+// values, which are continuous-time noise densities as in the Kalibr and ORB-SLAM3 settings:
+// noiseGyro in rad/s/sqrt(Hz), noiseAcc in m/s^2/sqrt(Hz), and the random walks gyroWalk in
+// rad/s^2/sqrt(Hz) and accWalk in m/s^3/sqrt(Hz). tbc transforms points from the camera frame to
+// the body frame.
+func NewCalibration(tbc geom.SE3, noiseGyro, noiseAcc, gyroWalk, accWalk, frequency float64) *Calibration {
+	sf := math.Sqrt(frequency)
+	return &Calibration{
+		Tcb:       tbc.Inverse(),
+		Tbc:       tbc,
+		NoiseGyro: noiseGyro * sf,
+		NoiseAcc:  noiseAcc * sf,
+		WalkGyro:  gyroWalk / sf,
+		WalkAcc:   accWalk / sf,
+	}
+}
+
+// Between returns the measurements needed to integrate from t0 to t1: those in the interval, plus
+// the last one before it and the first one after it if there are any. ms must be in time order.
+func Between(ms []Measurement, t0, t1 time.Time) []Measurement {
+	start := 0
+	for start < len(ms)-1 && !ms[start+1].Timestamp.After(t0) {
+		start++
+	}
+	end := start
+	for end < len(ms) && ms[end].Timestamp.Before(t1) {
+		end++
+	}
+	if end < len(ms) {
+		end++
+	}
+	return ms[start:end]
+}
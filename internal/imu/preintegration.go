@@ -0,0 +1,359 @@
+package imu
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/kegsay/gorbslam/internal/geom"
+)
+
+// Preintegrated is the motion measured by the IMU between two keyframes i and j: the rotation,
+// velocity and position deltas, expressed in the body frame of keyframe i and independent of its
+// pose, velocity and of gravity. With the body poses (Rwb, pwb) and velocities v of the keyframes:
+//
+//	Rj = Ri * dR
+//	vj = vi + g*dt + Ri * dV
+//	pj = pi + vi*dt + g*dt^2/2 + Ri * dP
+//
+// The deltas depend on the bias the measurements were corrected with. Rather than integrating the
+// measurements again whenever the estimate of the bias changes, the deltas are corrected to first
+// order with their Jacobians with respect to the bias.
+//
+// A Preintegrated is not safe for concurrent use.
+type Preintegrated struct {
+	Calibration *Calibration
+	// The bias the measurements were integrated with
+	Bias Bias
+	// The time in seconds covered by the measurements
+	DeltaT float64
+	// The covariance of (rotation, velocity, position, gyroscope bias, accelerometer bias), in that
+	// order. The bias blocks are the random walk over DeltaT.
+	Covariance [15][15]float64
+
+	dR     geom.Mat3
+	dV, dP geom.Vec3
+	// the Jacobians of the deltas with respect to the gyroscope (g) and accelerometer (a) biases
+	jRg, jVg, jVa, jPg, jPa geom.Mat3
+	// the measurements, kept for Reintegrate and MergePrevious
+	steps []step
+}
+
+// step is a measurement held for dt seconds
+type step struct {
+	acc, gyro geom.Vec3
+	dt        float64
+}
+
+// NewPreintegrated creates an empty preintegration with the bias estimated at keyframe i.
+func NewPreintegrated(bias Bias, calib *Calibration) *Preintegrated {
+	p := &Preintegrated{Calibration: calib}
+	p.initialise(bias)
+	return p
+}
+
+func (p *Preintegrated) initialise(bias Bias) {
+	p.Bias = bias
+	p.DeltaT = 0
+	p.Covariance = [15][15]float64{}
+	p.dR = geom.Identity3()
+	p.dV, p.dP = geom.Vec3{}, geom.Vec3{}
+	p.jRg, p.jVg, p.jVa, p.jPg, p.jPa = geom.Mat3{}, geom.Mat3{}, geom.Mat3{}, geom.Mat3{}, geom.Mat3{}
+	p.steps = nil
+}
+
+// Integrate adds the measurements from t0 to t1. The IMU is assumed to change linearly between
+// samples, so each interval between consecutive samples is integrated with the average of the
+// values at its ends. Before the first and after the last sample the nearest one is used.
+// ms must be in time order, and can come from Between.
+func (p *Preintegrated) Integrate(ms []Measurement, t0, t1 time.Time) {
+	if len(ms) == 0 || !t1.After(t0) {
+		return
+	}
+	// at returns the measurement interpolated at t
+	at := func(a, b *Measurement, t time.Time) (geom.Vec3, geom.Vec3) {
+		span := b.Timestamp.Sub(a.Timestamp).Seconds()
+		if span <= 0 {
+			return a.Acc, a.Gyro
+		}
+		f := t.Sub(a.Timestamp).Seconds() / span
+		return a.Acc.Scale(1 - f).Add(b.Acc.Scale(f)), a.Gyro.Scale(1 - f).Add(b.Gyro.Scale(f))
+	}
+	first, last := &ms[0], &ms[len(ms)-1]
+	if t0.Before(first.Timestamp) {
+		end := first.Timestamp
+		if t1.Before(end) {
+			end = t1
+		}
+		p.IntegrateNewMeasurement(first.Acc, first.Gyro, end.Sub(t0).Seconds())
+	}
+	for i := 0; i+1 < len(ms); i++ {
+		a, b := &ms[i], &ms[i+1]
+		start, end := a.Timestamp, b.Timestamp
+		if start.Before(t0) {
+			start = t0
+		}
+		if end.After(t1) {
+			end = t1
+		}
+		if !end.After(start) {
+			continue
+		}
+		acc0, gyro0 := at(a, b, start)
+		acc1, gyro1 := at(a, b, end)
+		p.IntegrateNewMeasurement(acc0.Add(acc1).Scale(0.5), gyro0.Add(gyro1).Scale(0.5), end.Sub(start).Seconds())
+	}
+	if t1.After(last.Timestamp) {
+		start := last.Timestamp
+		if t0.After(start) {
+			start = t0
+		}
+		p.IntegrateNewMeasurement(last.Acc, last.Gyro, t1.Sub(start).Seconds())
+	}
+}
+
+// IntegrateNewMeasurement adds a measurement held for dt seconds, updating the deltas, their bias
+// Jacobians and their covariance.
+func (p *Preintegrated) IntegrateNewMeasurement(acc, gyro geom.Vec3, dt float64) {
+	p.steps = append(p.steps, step{acc: acc, gyro: gyro, dt: dt})
+	acc = acc.Sub(p.Bias.Acc)
+	gyro = gyro.Sub(p.Bias.Gyro)
+
+	// Position and velocity first, as they use the rotation before it is updated. The acceleration
+	// is the average over the step, so it is rotated by the rotation half way through, which makes
+	// the integration second order in dt rather than first order as in ORB-SLAM3.
+	dt2 := dt * dt
+	half := geom.ExpSO3(gyro.Scale(dt / 2)).Matrix()
+	rMid := p.dR.Mul(half)
+	// the derivative of the rotation half way through with respect to the gyroscope bias
+	jRgMid := half.T().Mul(p.jRg).Add(geom.RightJacobianSO3(gyro.Scale(dt / 2)).Scale(-dt / 2))
+	p.dP = p.dP.Add(p.dV.Scale(dt)).Add(rMid.MulVec(acc).Scale(0.5 * dt2))
+	p.dV = p.dV.Add(rMid.MulVec(acc).Scale(dt))
+
+	// the noise propagates as x' = A x + B n, with x = (rotation, velocity, position) and n the
+	// gyroscope and accelerometer noise
+	rMidwAcc := rMid.Mul(geom.Skew(acc))
+	var a [9][9]float64
+	var b [9][6]float64
+	for i := 0; i < 9; i++ {
+		a[i][i] = 1
+	}
+	setBlock9(&a, 3, 0, rMidwAcc.Mul(half.T()).Scale(-dt))
+	setBlock9(&a, 6, 0, rMidwAcc.Mul(half.T()).Scale(-0.5*dt2))
+	setBlock9(&a, 6, 3, geom.Identity3().Scale(dt))
+	setBlock6(&b, 3, 3, rMid.Scale(dt))
+	setBlock6(&b, 6, 3, rMid.Scale(0.5*dt2))
+
+	p.jPa = p.jPa.Add(p.jVa.Scale(dt)).Add(rMid.Scale(-0.5 * dt2))
+	p.jPg = p.jPg.Add(p.jVg.Scale(dt)).Add(rMidwAcc.Mul(jRgMid).Scale(-0.5 * dt2))
+	p.jVa = p.jVa.Add(rMid.Scale(-dt))
+	p.jVg = p.jVg.Add(rMidwAcc.Mul(jRgMid).Scale(-dt))
+
+	omega := gyro.Scale(dt)
+	dRi := geom.ExpSO3(omega).Matrix()
+	jr := geom.RightJacobianSO3(omega)
+	p.dR = geom.NewSO3(p.dR.Mul(dRi)).Normalised().Matrix()
+	setBlock9(&a, 0, 0, dRi.T())
+	setBlock6(&b, 0, 0, jr.Scale(dt))
+
+	// C = A C A^T + B N B^T
+	var ac, c [9][9]float64
+	for i := 0; i < 9; i++ {
+		for j := 0; j < 9; j++ {
+			for k := 0; k < 9; k++ {
+				ac[i][j] += a[i][k] * p.Covariance[k][j]
+			}
+		}
+	}
+	noise := [6]float64{}
+	for i := 0; i < 3; i++ {
+		noise[i] = p.Calibration.NoiseGyro * p.Calibration.NoiseGyro
+		noise[3+i] = p.Calibration.NoiseAcc * p.Calibration.NoiseAcc
+	}
+	for i := 0; i < 9; i++ {
+		for j := 0; j < 9; j++ {
+			for k := 0; k < 9; k++ {
+				c[i][j] += ac[i][k] * a[j][k]
+			}
+			for k := 0; k < 6; k++ {
+				c[i][j] += b[i][k] * noise[k] * b[j][k]
+			}
+		}
+	}
+	for i := 0; i < 9; i++ {
+		copy(p.Covariance[i][:9], c[i][:])
+	}
+	for i := 0; i < 3; i++ {
+		p.Covariance[9+i][9+i] += p.Calibration.WalkGyro * p.Calibration.WalkGyro * dt
+		p.Covariance[12+i][12+i] += p.Calibration.WalkAcc * p.Calibration.WalkAcc * dt
+	}
+
+	p.jRg = dRi.T().Mul(p.jRg).Add(jr.Scale(-dt))
+	p.DeltaT += dt
+}
+
+// Reintegrate integrates the measurements again with a new bias, which is needed when the bias
+// has changed too much for the first order correction to hold.
+func (p *Preintegrated) Reintegrate(bias Bias) {
+	steps := p.steps
+	p.initialise(bias)
+	for _, s := range steps {
+		p.IntegrateNewMeasurement(s.acc, s.gyro, s.dt)
+	}
+}
+
+// MergePrevious prepends the measurements of prev, which must end where p starts, so that p
+// covers both. This is used when the keyframe between them is removed. The bias of p is kept.
+func (p *Preintegrated) MergePrevious(prev *Preintegrated) {
+	steps := append(append([]step(nil), prev.steps...), p.steps...)
+	p.initialise(p.Bias)
+	for _, s := range steps {
+		p.IntegrateNewMeasurement(s.acc, s.gyro, s.dt)
+	}
+}
+
+// Clone returns an independent copy
+func (p *Preintegrated) Clone() *Preintegrated {
+	c := *p
+	c.steps = append([]step(nil), p.steps...)
+	return &c
+}
+
+// The number of float64s in an encoded Preintegrated: the calibration and bias, then each step
+const (
+	headerFloats = 2*12 + 4 + 6
+	stepFloats   = 7
+)
+
+// MarshalBinary encodes the calibration, the bias and the measurements, little-endian. The deltas
+// are not encoded: UnmarshalBinary integrates the measurements again, which gives the same deltas.
+func (p *Preintegrated) MarshalBinary() ([]byte, error) {
+	floats := make([]float64, 0, headerFloats+stepFloats*len(p.steps))
+	c := p.Calibration
+	for _, t := range []geom.SE3{c.Tcb, c.Tbc} {
+		for _, row := range t.R.Matrix() {
+			floats = append(floats, row[:]...)
+		}
+		floats = append(floats, t.T[:]...)
+	}
+	floats = append(floats, c.NoiseGyro, c.NoiseAcc, c.WalkGyro, c.WalkAcc)
+	floats = append(floats, p.Bias.Acc[:]...)
+	floats = append(floats, p.Bias.Gyro[:]...)
+	for _, s := range p.steps {
+		floats = append(floats, s.acc[:]...)
+		floats = append(floats, s.gyro[:]...)
+		floats = append(floats, s.dt)
+	}
+	b := make([]byte, 8*len(floats))
+	for i, f := range floats {
+		binary.LittleEndian.PutUint64(b[8*i:], math.Float64bits(f))
+	}
+	return b, nil
+}
+
+// UnmarshalBinary decodes what MarshalBinary encodes, with a calibration of its own
+func (p *Preintegrated) UnmarshalBinary(b []byte) error {
+	if len(b)%8 != 0 || len(b)/8 < headerFloats || (len(b)/8-headerFloats)%stepFloats != 0 {
+		return fmt.Errorf("invalid preintegration of %d bytes", len(b))
+	}
+	floats := make([]float64, len(b)/8)
+	for i := range floats {
+		floats[i] = math.Float64frombits(binary.LittleEndian.Uint64(b[8*i:]))
+	}
+	next := func(n int) []float64 {
+		v := floats[:n]
+		floats = floats[n:]
+		return v
+	}
+	vec3 := func() geom.Vec3 {
+		v := next(3)
+		return geom.Vec3{v[0], v[1], v[2]}
+	}
+	se3 := func() geom.SE3 {
+		var r geom.Mat3
+		for i := range r {
+			r[i] = vec3()
+		}
+		return geom.SE3{R: geom.NewSO3(r), T: vec3()}
+	}
+	calib := &Calibration{Tcb: se3(), Tbc: se3()}
+	noise := next(4)
+	calib.NoiseGyro, calib.NoiseAcc, calib.WalkGyro, calib.WalkAcc = noise[0], noise[1], noise[2], noise[3]
+	p.Calibration = calib
+	p.initialise(Bias{Acc: vec3(), Gyro: vec3()})
+	for len(floats) > 0 {
+		acc, gyro := vec3(), vec3()
+		p.IntegrateNewMeasurement(acc, gyro, next(1)[0])
+	}
+	return nil
+}
+
+// DeltaRotation returns the rotation delta corrected to the bias b
+func (p *Preintegrated) DeltaRotation(b Bias) geom.SO3 {
+	dbg := b.Gyro.Sub(p.Bias.Gyro)
+	return geom.NewSO3(p.dR.Mul(geom.ExpSO3(p.jRg.MulVec(dbg)).Matrix())).Normalised()
+}
+
+// DeltaVelocity returns the velocity delta corrected to the bias b
+func (p *Preintegrated) DeltaVelocity(b Bias) geom.Vec3 {
+	dbg, dba := b.Gyro.Sub(p.Bias.Gyro), b.Acc.Sub(p.Bias.Acc)
+	return p.dV.Add(p.jVg.MulVec(dbg)).Add(p.jVa.MulVec(dba))
+}
+
+// DeltaPosition returns the position delta corrected to the bias b
+func (p *Preintegrated) DeltaPosition(b Bias) geom.Vec3 {
+	dbg, dba := b.Gyro.Sub(p.Bias.Gyro), b.Acc.Sub(p.Bias.Acc)
+	return p.dP.Add(p.jPg.MulVec(dbg)).Add(p.jPa.MulVec(dba))
+}
+
+// Information returns the inverse of the covariance of the rotation, velocity and position
+// deltas as a row-major 9x9 matrix, or nil if there are no measurements.
+func (p *Preintegrated) Information() []float64 {
+	if p.DeltaT == 0 {
+		return nil
+	}
+	c := geom.NewDense(9, 9)
+	for i := 0; i < 9; i++ {
+		for j := 0; j < 9; j++ {
+			// symmetrise away the rounding errors of the propagation
+			c.Set(i, j, (p.Covariance[i][j]+p.Covariance[j][i])/2)
+		}
+	}
+	info := make([]float64, 81)
+	for j := 0; j < 9; j++ {
+		e := make([]float64, 9)
+		e[j] = 1
+		col, ok := geom.SolveSPD(c, e)
+		if !ok {
+			return nil
+		}
+		for i := 0; i < 9; i++ {
+			info[i*9+j] = col[i]
+		}
+	}
+	return info
+}
+
+// GyroWalkInformation and AccWalkInformation return the inverse variance of the change of each
+// component of the gyroscope and accelerometer biases over DeltaT.
+func (p *Preintegrated) GyroWalkInformation() float64 {
+	return 1 / p.Covariance[9][9]
+}
+
+// AccWalkInformation is as GyroWalkInformation for the accelerometer
+func (p *Preintegrated) AccWalkInformation() float64 {
+	return 1 / p.Covariance[12][12]
+}
+
+func setBlock9(m *[9][9]float64, row, col int, b geom.Mat3) {
+	for i := 0; i < 3; i++ {
+		copy(m[row+i][col:col+3], b[i][:])
+	}
+}
+
+func setBlock6(m *[9][6]float64, row, col int, b geom.Mat3) {
+	for i := 0; i < 3; i++ {
+		copy(m[row+i][col:col+3], b[i][:])
+	}
+}
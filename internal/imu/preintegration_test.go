@@ -0,0 +1,191 @@
+package imu
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/kegsay/gorbslam/internal/geom"
+)
+
+// trajectory is a smooth body motion whose derivatives are known exactly: the body turns about a
+// fixed axis at a varying rate while moving along a Lissajous curve
+type trajectory struct {
+	r0   geom.SO3
+	axis geom.Vec3
+}
+
+var testTrajectory = trajectory{
+	r0:   geom.ExpSO3(geom.Vec3{0.1, -0.3, 0.2}),
+	axis: geom.Vec3{0.2, 0.5, 1}.Normalised(),
+}
+
+var epoch = time.Unix(1000, 0)
+
+func (tr trajectory) angle(t float64) float64     { return 0.8*t + 0.3*math.Sin(2*t) }
+func (tr trajectory) angleRate(t float64) float64 { return 0.8 + 0.6*math.Cos(2*t) }
+
+// pose returns Rwb and the position, velocity and acceleration of the body at t seconds
+func (tr trajectory) pose(t float64) (geom.SO3, geom.Vec3, geom.Vec3, geom.Vec3) {
+	r := tr.r0.Mul(geom.ExpSO3(tr.axis.Scale(tr.angle(t))))
+	p := geom.Vec3{2 * math.Sin(t), math.Cos(1.5 * t), 0.5 * math.Sin(0.7*t)}
+	v := geom.Vec3{2 * math.Cos(t), -1.5 * math.Sin(1.5*t), 0.35 * math.Cos(0.7*t)}
+	a := geom.Vec3{-2 * math.Sin(t), -2.25 * math.Cos(1.5*t), -0.245 * math.Sin(0.7*t)}
+	return r, p, v, a
+}
+
+// measurements samples the trajectory at hz from 0 to duration seconds, as seen by an IMU with
+// the given bias
+func (tr trajectory) measurements(hz, duration float64, bias Bias) []Measurement {
+	var ms []Measurement
+	for i := 0; float64(i) <= duration*hz; i++ {
+		t := float64(i) / hz
+		r, _, _, a := tr.pose(t)
+		ms = append(ms, Measurement{
+			Timestamp: epoch.Add(time.Duration(t * float64(time.Second))),
+			Acc:       r.Inverse().Rotate(a.Sub(Gravity())).Add(bias.Acc),
+			Gyro:      tr.axis.Scale(tr.angleRate(t)).Add(bias.Gyro),
+		})
+	}
+	return ms
+}
+
+func seconds(t float64) time.Time {
+	return epoch.Add(time.Duration(t * float64(time.Second)))
+}
+
+var testCalibration = NewCalibration(geom.IdentitySE3(), 1.7e-4, 2e-3, 1.9e-5, 3e-3, 200)
+
+func TestPreintegrationTrajectory(t *testing.T) {
+	bias := Bias{Acc: geom.Vec3{0.05, -0.1, 0.08}, Gyro: geom.Vec3{0.01, 0.02, -0.015}}
+	ms := testTrajectory.measurements(200, 3, bias)
+	// keyframes aren't aligned with the IMU samples
+	const t0, t1 = 0.5012, 1.7033
+	p := NewPreintegrated(bias, testCalibration)
+	p.Integrate(Between(ms, seconds(t0), seconds(t1)), seconds(t0), seconds(t1))
+	if math.Abs(p.DeltaT-(t1-t0)) > 1e-9 {
+		t.Errorf("integrated %v seconds, want %v", p.DeltaT, t1-t0)
+	}
+
+	ri, pi, vi, _ := testTrajectory.pose(t0)
+	rj, pj, vj, _ := testTrajectory.pose(t1)
+	dt := t1 - t0
+	g := Gravity()
+	wantR := ri.Inverse().Mul(rj)
+	wantV := ri.Inverse().Rotate(vj.Sub(vi).Sub(g.Scale(dt)))
+	wantP := ri.Inverse().Rotate(pj.Sub(pi).Sub(vi.Scale(dt)).Sub(g.Scale(dt * dt / 2)))
+	if d := p.DeltaRotation(bias).Inverse().Mul(wantR).Angle(); d > 1e-5 {
+		t.Errorf("rotation delta is %v rad off", d)
+	}
+	if d := p.DeltaVelocity(bias).Sub(wantV).Norm(); d > 1e-4 {
+		t.Errorf("velocity delta is %v m/s off", d)
+	}
+	if d := p.DeltaPosition(bias).Sub(wantP).Norm(); d > 1e-4 {
+		t.Errorf("position delta is %v m off", d)
+	}
+
+	// the covariance grows with time, and its inverse is usable as an information matrix
+	info := p.Information()
+	if info == nil {
+		t.Fatalf("covariance is not positive definite")
+	}
+	for i := 0; i < 9; i++ {
+		if info[i*9+i] <= 0 {
+			t.Errorf("information %d is %v", i, info[i*9+i])
+		}
+	}
+	if want := 1 / (testCalibration.WalkGyro * testCalibration.WalkGyro * dt); math.Abs(p.GyroWalkInformation()-want) > 1e-6*want {
+		t.Errorf("gyroscope random walk information is %v, want %v", p.GyroWalkInformation(), want)
+	}
+}
+
+// A small change of bias is corrected to first order by the Jacobians, as well as integrating again
+func TestPreintegrationBiasCorrection(t *testing.T) {
+	ms := testTrajectory.measurements(200, 2, Bias{})
+	p := NewPreintegrated(Bias{}, testCalibration)
+	p.Integrate(ms, seconds(0), seconds(2))
+	db := Bias{Acc: geom.Vec3{0.02, -0.03, 0.01}, Gyro: geom.Vec3{-0.002, 0.003, 0.001}}
+
+	re := p.Clone()
+	re.Reintegrate(db)
+	if re.Bias != db || p.Bias != (Bias{}) {
+		t.Fatalf("bias is %v after reintegrating, and the original's %v", re.Bias, p.Bias)
+	}
+	errR := p.DeltaRotation(db).Inverse().Mul(re.DeltaRotation(db)).Angle()
+	errV := p.DeltaVelocity(db).Sub(re.DeltaVelocity(db)).Norm()
+	errP := p.DeltaPosition(db).Sub(re.DeltaPosition(db)).Norm()
+	// without the correction
+	rawR := p.DeltaRotation(Bias{}).Inverse().Mul(re.DeltaRotation(db)).Angle()
+	rawV := p.DeltaVelocity(Bias{}).Sub(re.DeltaVelocity(db)).Norm()
+	rawP := p.DeltaPosition(Bias{}).Sub(re.DeltaPosition(db)).Norm()
+	if errR > rawR/50 || errV > rawV/50 || errP > rawP/50 {
+		t.Errorf("first order correction is off by (%v, %v, %v), uncorrected (%v, %v, %v)", errR, errV, errP, rawR, rawV, rawP)
+	}
+}
+
+func TestPreintegrationMergePrevious(t *testing.T) {
+	ms := testTrajectory.measurements(200, 2, Bias{})
+	whole := NewPreintegrated(Bias{}, testCalibration)
+	whole.Integrate(ms, seconds(0.2), seconds(1.8))
+	first := NewPreintegrated(Bias{}, testCalibration)
+	first.Integrate(Between(ms, seconds(0.2), seconds(0.9)), seconds(0.2), seconds(0.9))
+	second := NewPreintegrated(Bias{}, testCalibration)
+	second.Integrate(Between(ms, seconds(0.9), seconds(1.8)), seconds(0.9), seconds(1.8))
+	second.MergePrevious(first)
+
+	if math.Abs(second.DeltaT-whole.DeltaT) > 1e-9 {
+		t.Errorf("merged %v seconds, want %v", second.DeltaT, whole.DeltaT)
+	}
+	if d := second.DeltaPosition(Bias{}).Sub(whole.DeltaPosition(Bias{})).Norm(); d > 1e-9 {
+		t.Errorf("merged position delta is %v off", d)
+	}
+	if d := second.DeltaRotation(Bias{}).Inverse().Mul(whole.DeltaRotation(Bias{})).Angle(); d > 1e-9 {
+		t.Errorf("merged rotation delta is %v off", d)
+	}
+	if d := second.Covariance[6][6] - whole.Covariance[6][6]; math.Abs(d) > 1e-9*whole.Covariance[6][6] {
+		t.Errorf("merged position covariance is %v off", d)
+	}
+}
+
+func TestBetween(t *testing.T) {
+	ms := testTrajectory.measurements(10, 1, Bias{})
+	for _, tc := range []struct {
+		t0, t1      float64
+		first, last int
+	}{
+		{0.25, 0.55, 2, 6},
+		{0.3, 0.5, 3, 5},
+		{-1, 0.05, 0, 1},
+		{0.95, 2, 9, 10},
+	} {
+		got := Between(ms, seconds(tc.t0), seconds(tc.t1))
+		if got[0] != ms[tc.first] || got[len(got)-1] != ms[tc.last] || len(got) != tc.last-tc.first+1 {
+			t.Errorf("Between(%v, %v): got %d measurements from %v", tc.t0, tc.t1, len(got), got[0].Timestamp.Sub(epoch))
+		}
+	}
+}
+
+func TestPreintegrationMarshalBinary(t *testing.T) {
+	bias := Bias{Acc: geom.Vec3{0.05, -0.1, 0.08}, Gyro: geom.Vec3{0.01, 0.02, -0.015}}
+	calib := NewCalibration(geom.SE3{R: geom.ExpSO3(geom.Vec3{0.1, 0.2, -0.3}), T: geom.Vec3{0.05, -0.02, 0.01}}, 1.7e-4, 2e-3, 1.9e-5, 3e-3, 200)
+	p := NewPreintegrated(bias, calib)
+	p.Integrate(testTrajectory.measurements(200, 1, bias), seconds(0.1), seconds(0.9))
+	b, err := p.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary: %s", err)
+	}
+	var got Preintegrated
+	if err := got.UnmarshalBinary(b); err != nil {
+		t.Fatalf("UnmarshalBinary: %s", err)
+	}
+	if *got.Calibration != *calib || got.Bias != bias || got.DeltaT != p.DeltaT || got.Covariance != p.Covariance {
+		t.Errorf("got calibration %+v, bias %+v and %v seconds", *got.Calibration, got.Bias, got.DeltaT)
+	}
+	other := Bias{Gyro: geom.Vec3{0.02, 0, 0}}
+	if got.DeltaRotation(other) != p.DeltaRotation(other) || got.DeltaVelocity(other) != p.DeltaVelocity(other) || got.DeltaPosition(other) != p.DeltaPosition(other) {
+		t.Errorf("got different deltas")
+	}
+	if err := got.UnmarshalBinary(b[:len(b)-8]); err == nil {
+		t.Errorf("expected an error for a truncated preintegration")
+	}
+}
@@ -0,0 +1,286 @@
+package loopclosing
+
+import (
+	"context"
+
+	"github.com/kegsay/gorbslam/internal/geom"
+	"github.com/kegsay/gorbslam/internal/matching"
+	"github.com/kegsay/gorbslam/internal/optim"
+	"github.com/kegsay/gorbslam/internal/world"
+)
+
+// correctLoop closes the loop found by computeSim3. The current keyframe and its neighbours are
+// moved to agree with the other end of the loop, taking their map points with them, and the
+// points seen at both ends are fused. Then the rest of the map is corrected by optimising the
+// essential graph, and finally global bundle adjustment is started in the background.
+func (l *LoopClosing) correctLoop(ctx context.Context) {
+	// Abort global BA first: applying its result stops local mapping, which would deadlock if we
+	// had already stopped it.
+	l.globalBA.Stop()
+	l.stopLocalMapping()
+
+	current := l.current
+	// the fused points may have changed the covisibility since the keyframe was created
+	current.UpdateConnections()
+	connected := append(current.CovisibleKeyFrames(), current)
+	corrected := map[*world.KeyFrame]geom.Sim3{current: l.scw}
+	nonCorrected := make(map[*world.KeyFrame]geom.Sim3, len(connected))
+	// the keyframe whose correction moved each point
+	correctedBy := make(map[*world.MapPoint]*world.KeyFrame)
+
+	l.m.Update.Lock()
+	twc := current.Pose().Inverse()
+	for _, kf := range connected {
+		tiw := kf.Pose()
+		if kf != current {
+			// keep the pose relative to the current keyframe: Siw = Tic * Scw
+			corrected[kf] = tiw.Mul(twc).Sim3().Mul(l.scw)
+		}
+		nonCorrected[kf] = tiw.Sim3()
+	}
+	for _, kf := range connected {
+		siw := corrected[kf]
+		swi := siw.Inverse()
+		siwNonCorrected := nonCorrected[kf]
+		for _, mp := range kf.MapPointMatches() {
+			if mp == nil || mp.IsBad() || correctedBy[mp] != nil {
+				continue
+			}
+			// into the keyframe with its old pose, then back out with the corrected one
+			mp.SetPosition(swi.Transform(siwNonCorrected.Transform(mp.Position())))
+			correctedBy[mp] = kf
+			mp.UpdateNormalAndDepth()
+		}
+		// the scale is absorbed into the translation: [R t/s]
+		kf.SetPose(siw.SE3())
+		kf.UpdateConnections()
+	}
+	l.fuseMatchedPoints()
+	l.m.Update.Unlock()
+
+	l.searchAndFuse(connected, corrected)
+
+	// the new links between the two ends of the loop, made by fusing their points
+	isConnected := make(map[*world.KeyFrame]bool, len(connected))
+	for _, kf := range connected {
+		isConnected[kf] = true
+	}
+	loopConnections := make(map[*world.KeyFrame][]*world.KeyFrame)
+	for _, kf := range connected {
+		previous := make(map[*world.KeyFrame]bool)
+		for _, n := range kf.CovisibleKeyFrames() {
+			previous[n] = true
+		}
+		kf.UpdateConnections()
+		for _, n := range kf.ConnectedKeyFrames() {
+			if !previous[n] && !isConnected[n] {
+				loopConnections[kf] = append(loopConnections[kf], n)
+			}
+		}
+	}
+
+	l.optimizeEssentialGraph(ctx, nonCorrected, corrected, correctedBy, loopConnections)
+
+	l.matched.AddLoopEdge(current)
+	current.AddLoopEdge(l.matched)
+	l.m.InformNewBigChange()
+	l.globalBA.Start(ctx, current.ID)
+	l.releaseLocalMapping()
+
+	l.lastLoopKFID = current.ID
+	l.mu.Lock()
+	l.numLoops++
+	l.mu.Unlock()
+}
+
+// fuseMatchedPoints makes the loop points matched to the current keyframe replace its own. Must
+// be called with the map update lock held.
+func (l *LoopClosing) fuseMatchedPoints() {
+	current := l.current
+	for i, loopMP := range l.currentMatchedPoints {
+		if loopMP == nil {
+			continue
+		}
+		if mp := current.MapPoint(i); mp != nil {
+			mp.Replace(loopMP)
+		} else {
+			current.AddMapPoint(loopMP, i)
+			loopMP.AddObservation(current, i)
+			loopMP.ComputeDistinctiveDescriptors()
+		}
+	}
+}
+
+// searchAndFuse projects the map points around the loop into the current keyframe and its
+// neighbours with their corrected poses. Points seen from both ends of the loop are fused.
+func (l *LoopClosing) searchAndFuse(connected []*world.KeyFrame, corrected map[*world.KeyFrame]geom.Sim3) {
+	matcher := matching.NewMatcher(0.8, true)
+	for _, kf := range connected {
+		replace, _ := matcher.FuseSim3(kf, corrected[kf], l.loopMapPoints, 4)
+		l.m.Update.Lock()
+		for i, mp := range replace {
+			if mp != nil {
+				mp.Replace(l.loopMapPoints[i])
+			}
+		}
+		l.m.Update.Unlock()
+	}
+}
+
+// optimizeEssentialGraph spreads the correction made around the current keyframe over the whole
+// map. nonCorrected and corrected are the poses of the keyframes around the current keyframe
+// before and after correction, and correctedBy is the keyframe each corrected point moved with.
+func (l *LoopClosing) optimizeEssentialGraph(ctx context.Context, nonCorrected, corrected map[*world.KeyFrame]geom.Sim3, correctedBy map[*world.MapPoint]*world.KeyFrame, loopConnections map[*world.KeyFrame][]*world.KeyFrame) {
+	l.m.Update.Lock()
+	keyFrames := l.m.KeyFrames()
+	index := make(map[*world.KeyFrame]int, len(keyFrames))
+	for i, kf := range keyFrames {
+		index[kf] = i
+	}
+	eg := &optim.EssentialGraph{
+		KeyFrames:       make([]optim.EssentialKeyFrame, len(keyFrames)),
+		CurrentKeyFrame: index[l.current],
+		LoopKeyFrame:    index[l.matched],
+		FixScale:        l.fixScale,
+	}
+	for i, kf := range keyFrames {
+		ekf := &eg.KeyFrames[i]
+		ekf.Pose = kf.Pose()
+		if siw, ok := nonCorrected[kf]; ok {
+			ekf.Pose = siw.SE3()
+			c := corrected[kf]
+			ekf.Corrected = &c
+		}
+		ekf.Parent = -1
+		if parent, ok := index[kf.Parent()]; ok {
+			ekf.Parent = parent
+		}
+		for _, n := range kf.CovisiblesByWeight(optim.EssentialMinWeight) {
+			if j, ok := index[n]; ok && n.ID < kf.ID {
+				eg.Covisibility = append(eg.Covisibility, optim.EssentialEdge{I: i, J: j, Weight: kf.Weight(n)})
+			}
+		}
+		for _, n := range kf.LoopEdges() {
+			if j, ok := index[n]; ok && n.ID < kf.ID {
+				eg.Loops = append(eg.Loops, optim.EssentialEdge{I: i, J: j})
+			}
+		}
+		for _, n := range loopConnections[kf] {
+			if j, ok := index[n]; ok {
+				eg.LoopConnections = append(eg.LoopConnections, optim.EssentialEdge{I: i, J: j, Weight: kf.Weight(n)})
+			}
+		}
+	}
+	var points []*world.MapPoint
+	for _, mp := range l.m.MapPoints() {
+		if mp.IsBad() {
+			continue
+		}
+		ref := correctedBy[mp]
+		if ref == nil {
+			ref = mp.ReferenceKeyFrame()
+		}
+		r, ok := index[ref]
+		if !ok {
+			continue
+		}
+		eg.Points = append(eg.Points, optim.EssentialPoint{Position: mp.Position(), Reference: r})
+		points = append(points, mp)
+	}
+	l.m.Update.Unlock()
+
+	if _, err := optim.OptimizeEssentialGraph(ctx, eg); err != nil {
+		return
+	}
+
+	l.m.Update.Lock()
+	defer l.m.Update.Unlock()
+	for i, kf := range keyFrames {
+		kf.SetPose(eg.KeyFrames[i].Pose)
+	}
+	for i, mp := range points {
+		mp.SetPosition(eg.Points[i].Position)
+		mp.UpdateNormalAndDepth()
+	}
+}
+
+// GlobalBASnapshot copies every keyframe, map point and observation for global bundle adjustment
+func (l *LoopClosing) GlobalBASnapshot() *optim.GlobalBAProblem {
+	l.m.Update.Lock()
+	defer l.m.Update.Unlock()
+	p := &optim.GlobalBAProblem{}
+	p.KeyFrames, p.Points = l.snapshot()
+	for _, kf := range l.m.KeyFrames() {
+		if p.InvSigma2 == nil {
+			p.Camera, p.InvSigma2 = kf.Camera, kf.Pyramid.InvSigma2
+		}
+		for i, mp := range kf.MapPointMatches() {
+			if mp == nil || mp.IsBad() {
+				continue
+			}
+			kp := &kf.KeyPoints[i]
+			p.Observations = append(p.Observations, optim.GlobalBAObservation{
+				KeyFrame: kf.ID, Point: mp.ID, U: kp.X, V: kp.Y, Octave: kp.Octave,
+			})
+		}
+	}
+	return p
+}
+
+// snapshot copies the poses of the keyframes and the positions of the points. Must be called with
+// the map update lock held.
+func (l *LoopClosing) snapshot() ([]optim.GlobalBAKeyFrame, []optim.GlobalBAPoint) {
+	var keyFrames []optim.GlobalBAKeyFrame
+	for _, kf := range l.m.KeyFrames() {
+		parent := int64(-1)
+		if p := kf.Parent(); p != nil {
+			parent = p.ID
+		}
+		keyFrames = append(keyFrames, optim.GlobalBAKeyFrame{ID: kf.ID, Pose: kf.Pose(), Parent: parent})
+	}
+	var points []optim.GlobalBAPoint
+	for _, mp := range l.m.MapPoints() {
+		if mp.IsBad() {
+			continue
+		}
+		ref := int64(-1)
+		if r := mp.ReferenceKeyFrame(); r != nil {
+			ref = r.ID
+		}
+		points = append(points, optim.GlobalBAPoint{ID: mp.ID, Position: mp.Position(), Reference: ref})
+	}
+	return keyFrames, points
+}
+
+// ApplyGlobalBA merges the result of global bundle adjustment into the map. Local mapping is
+// stopped meanwhile, as it may have added keyframes and points since the snapshot which must be
+// corrected too.
+func (l *LoopClosing) ApplyGlobalBA(result *optim.GlobalBAResult) {
+	l.stopLocalMapping()
+	defer l.releaseLocalMapping()
+	l.m.Update.Lock()
+	defer l.m.Update.Unlock()
+
+	keyFrames, points := l.snapshot()
+	result.Propagate(keyFrames, points)
+	byID := make(map[int64]geom.SE3, len(keyFrames))
+	for _, kf := range keyFrames {
+		byID[kf.ID] = kf.Pose
+	}
+	for _, kf := range l.m.KeyFrames() {
+		if pose, ok := byID[kf.ID]; ok {
+			kf.SetPose(pose)
+		}
+	}
+	positions := make(map[int64]geom.Vec3, len(points))
+	for _, p := range points {
+		positions[p.ID] = p.Position
+	}
+	for _, mp := range l.m.MapPoints() {
+		if pos, ok := positions[mp.ID]; ok {
+			mp.SetPosition(pos)
+			mp.UpdateNormalAndDepth()
+		}
+	}
+	l.m.InformNewBigChange()
+}
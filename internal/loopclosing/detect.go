@@ -0,0 +1,305 @@
+package loopclosing
+
+import (
+	"github.com/kegsay/gorbslam/internal/bow"
+	"github.com/kegsay/gorbslam/internal/geom"
+	"github.com/kegsay/gorbslam/internal/matching"
+	"github.com/kegsay/gorbslam/internal/optim"
+	"github.com/kegsay/gorbslam/internal/solver"
+	"github.com/kegsay/gorbslam/internal/world"
+)
+
+const (
+	// a loop candidate must be detected for this many consecutive keyframes
+	covisibilityConsistencyTh = 3
+	// no loop is looked for until this many keyframes after the last one closed
+	minKeyFramesBetweenLoops = 10
+	// the minimum matches to compute a Sim3 with a candidate, and inliers to accept it
+	minSim3Matches = 20
+	// the minimum matches, after searching the map points around the loop, to accept a loop
+	minLoopMatches = 40
+)
+
+// consistentGroup is a loop candidate and its connected keyframes, with the number of consecutive
+// keyframes a candidate in the group has been detected for.
+type consistentGroup struct {
+	keyFrames   map[*world.KeyFrame]bool
+	consistency int
+}
+
+// detectLoop looks for loop candidates for kf in the keyframe database, then keeps those which
+// are consistent: a candidate (or a keyframe connected to it) was also detected for the previous
+// keyframes. Returns true if any candidate has been detected often enough to be trusted, in which
+// case they are in enoughConsistent. The keyframe is added to the database.
+func (l *LoopClosing) detectLoop(kf *world.KeyFrame) bool {
+	l.current = kf
+	// don't let local mapping remove the keyframe while we use it
+	kf.SetNotErase()
+	if kf.IsBad() || kf.ID < l.lastLoopKFID+minKeyFramesBetweenLoops {
+		l.db.Add(kf)
+		kf.SetErase()
+		return false
+	}
+
+	candidates := l.db.DetectLoopCandidates(kf, minCandidateScore(kf))
+	if len(candidates) == 0 {
+		l.db.Add(kf)
+		l.consistentGroups = nil
+		kf.SetErase()
+		return false
+	}
+	l.consistentGroups, l.enoughConsistent = checkConsistency(candidates, l.consistentGroups)
+
+	l.db.Add(kf)
+	if len(l.enoughConsistent) == 0 {
+		kf.SetErase()
+		return false
+	}
+	return true
+}
+
+// minCandidateScore returns the similarity a loop candidate of kf must reach: at least that of the
+// least similar of its neighbours
+func minCandidateScore(kf *world.KeyFrame) float64 {
+	var scorer bow.L1Scorer
+	bv := kf.BowVector()
+	minScore := 1.0
+	for _, n := range kf.CovisibleKeyFrames() {
+		if n.IsBad() {
+			continue
+		}
+		if s := scorer.Score(bv, n.BowVector()); s < minScore {
+			minScore = s
+		}
+	}
+	return minScore
+}
+
+// checkConsistency checks, for each candidate, whether its group is consistent with a group of the
+// previous keyframe. Each previous group can only continue into one new group. Returns the groups
+// of the candidates, and the candidates which have been detected often enough to be trusted.
+func checkConsistency(candidates []*world.KeyFrame, previous []consistentGroup) ([]consistentGroup, []*world.KeyFrame) {
+	var groups []consistentGroup
+	var enoughConsistent []*world.KeyFrame
+	continued := make([]bool, len(previous))
+	for _, candidate := range candidates {
+		group := map[*world.KeyFrame]bool{candidate: true}
+		for _, c := range candidate.ConnectedKeyFrames() {
+			group[c] = true
+		}
+		var enough, consistentForSome bool
+		for i, prev := range previous {
+			if !intersects(group, prev.keyFrames) {
+				continue
+			}
+			consistentForSome = true
+			consistency := prev.consistency + 1
+			if !continued[i] {
+				groups = append(groups, consistentGroup{keyFrames: group, consistency: consistency})
+				continued[i] = true
+			}
+			if consistency >= covisibilityConsistencyTh && !enough {
+				enoughConsistent = append(enoughConsistent, candidate)
+				enough = true
+			}
+		}
+		if !consistentForSome {
+			groups = append(groups, consistentGroup{keyFrames: group})
+		}
+	}
+	return groups, enoughConsistent
+}
+
+func intersects(a, b map[*world.KeyFrame]bool) bool {
+	for kf := range a {
+		if b[kf] {
+			return true
+		}
+	}
+	return false
+}
+
+// sim3Candidate is a loop candidate with the map points matched to the current keyframe and a
+// solver for the similarity between them
+type sim3Candidate struct {
+	kf *world.KeyFrame
+	// the map point of the candidate matched to each keypoint of the current keyframe
+	matches []*world.MapPoint
+	// the keypoint of the current keyframe for each of the solver's matches
+	indexes   []int
+	solver    *solver.Sim3Solver
+	discarded bool
+}
+
+// computeSim3 looks for a consistent candidate whose map points agree with the current keyframe
+// under a similarity transform. The candidates are matched with the bag of words, then RANSAC is
+// run over all of them in turn until one produces a transform with enough inliers. This is
+// refined with more matches found with the transform, and finally the map points around the
+// candidate are projected into the current keyframe: if enough match, the loop is accepted.
+func (l *LoopClosing) computeSim3() bool {
+	current := l.current
+	matcher := matching.NewMatcher(0.75, true)
+	var candidates []*sim3Candidate
+	numCandidates := 0
+	for _, kf := range l.enoughConsistent {
+		// don't let local mapping remove the candidate while we use it
+		kf.SetNotErase()
+		c := &sim3Candidate{kf: kf, discarded: true}
+		candidates = append(candidates, c)
+		if kf.IsBad() {
+			continue
+		}
+		matches, n := matcher.SearchByBoWKeyFrames(current, kf)
+		if n < minSim3Matches {
+			continue
+		}
+		c.matches = matches
+		c.solver, c.indexes = l.newSim3Solver(kf, matches)
+		c.discarded = false
+		numCandidates++
+	}
+
+	var found *sim3Candidate
+	for numCandidates > 0 && found == nil {
+		for _, c := range candidates {
+			if c.discarded {
+				continue
+			}
+			res, noMore := c.solver.Iterate(5)
+			if noMore {
+				c.discarded = true
+				numCandidates--
+			}
+			if res == nil {
+				continue
+			}
+			matches12 := make([]*world.MapPoint, len(current.KeyPoints))
+			for j, inlier := range res.Inliers {
+				if inlier {
+					idx := c.indexes[j]
+					matches12[idx] = c.matches[idx]
+				}
+			}
+			matcher.SearchBySim3(current, c.kf, matches12, res.S12, 7.5)
+			s12, ok := l.optimizeSim3(c.kf, matches12, res.S12)
+			if !ok {
+				continue
+			}
+			found = c
+			l.matched = c.kf
+			// Scw = S12 * S2w, the current keyframe's pose as seen from the other end of the loop
+			l.scw = s12.Mul(c.kf.Pose().Sim3())
+			l.currentMatchedPoints = matches12
+			break
+		}
+	}
+	if found == nil {
+		for _, kf := range l.enoughConsistent {
+			kf.SetErase()
+		}
+		current.SetErase()
+		return false
+	}
+
+	// the points seen by the matched keyframe and its neighbours
+	seen := make(map[*world.MapPoint]bool)
+	l.loopMapPoints = nil
+	for _, kf := range append(l.matched.CovisibleKeyFrames(), l.matched) {
+		for _, mp := range kf.MapPointMatches() {
+			if mp == nil || mp.IsBad() || seen[mp] {
+				continue
+			}
+			seen[mp] = true
+			l.loopMapPoints = append(l.loopMapPoints, mp)
+		}
+	}
+	matcher.SearchByProjectionSim3(current, l.scw, l.loopMapPoints, l.currentMatchedPoints, 10)
+
+	var numMatches int
+	for _, mp := range l.currentMatchedPoints {
+		if mp != nil {
+			numMatches++
+		}
+	}
+	if numMatches < minLoopMatches {
+		for _, kf := range l.enoughConsistent {
+			kf.SetErase()
+		}
+		current.SetErase()
+		return false
+	}
+	for _, kf := range l.enoughConsistent {
+		if kf != l.matched {
+			kf.SetErase()
+		}
+	}
+	return true
+}
+
+// newSim3Solver creates a RANSAC solver for the similarity from kf to the current keyframe, using
+// the map points of kf matched to each keypoint of the current keyframe. Returns the solver and
+// the keypoint of the current keyframe for each of its matches.
+func (l *LoopClosing) newSim3Solver(kf *world.KeyFrame, matches []*world.MapPoint) (*solver.Sim3Solver, []int) {
+	current := l.current
+	corrs, indexes := l.correspondences(kf, matches)
+	sm := make([]solver.Sim3Match, len(corrs))
+	for i, c := range corrs {
+		sm[i] = solver.Sim3Match{
+			P1: c.P1, P2: c.P2, U1: c.U1, V1: c.V1, U2: c.U2, V2: c.V2,
+			Octave1: c.Octave1, Octave2: c.Octave2,
+		}
+	}
+	s := solver.NewSim3Solver(current.Camera, kf.Camera, sm, current.Pyramid.Sigma2, l.fixScale)
+	s.SetRansacParameters(0.99, minSim3Matches, 300)
+	return s, indexes
+}
+
+// optimizeSim3 refines s12, the similarity from kf to the current keyframe, with the matched map
+// points. Matches which disagree are removed. Returns false if too few agree.
+func (l *LoopClosing) optimizeSim3(kf *world.KeyFrame, matches12 []*world.MapPoint, s12 geom.Sim3) (geom.Sim3, bool) {
+	current := l.current
+	corrs, indexes := l.correspondences(kf, matches12)
+	s12, numInliers := optim.OptimizeSim3(current.Camera, kf.Camera, s12, corrs, current.Pyramid.InvSigma2, 10, l.fixScale)
+	for i, c := range corrs {
+		if c.Outlier {
+			matches12[indexes[i]] = nil
+		}
+	}
+	return s12, numInliers >= minSim3Matches
+}
+
+// correspondences pairs the map point of each keypoint of the current keyframe with the map point
+// of kf matched to it, in the camera frame of each keyframe. Returns the pairs and the keypoint of
+// the current keyframe for each.
+func (l *LoopClosing) correspondences(kf *world.KeyFrame, matches []*world.MapPoint) ([]optim.Sim3Correspondence, []int) {
+	current := l.current
+	pose1, pose2 := current.Pose(), kf.Pose()
+	var corrs []optim.Sim3Correspondence
+	var indexes []int
+	for i, mp2 := range matches {
+		if mp2 == nil || mp2.IsBad() {
+			continue
+		}
+		mp1 := current.MapPoint(i)
+		if mp1 == nil || mp1.IsBad() {
+			continue
+		}
+		idx2, ok := mp2.Index(kf)
+		if !ok {
+			continue
+		}
+		kp1, kp2 := &current.KeyPoints[i], &kf.KeyPoints[idx2]
+		corrs = append(corrs, optim.Sim3Correspondence{
+			P1:      pose1.Transform(mp1.Position()),
+			P2:      pose2.Transform(mp2.Position()),
+			U1:      kp1.X,
+			V1:      kp1.Y,
+			U2:      kp2.X,
+			V2:      kp2.Y,
+			Octave1: kp1.Octave,
+			Octave2: kp2.Octave,
+		})
+		indexes = append(indexes, i)
+	}
+	return corrs, indexes
+}
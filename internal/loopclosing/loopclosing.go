@@ -0,0 +1,264 @@
+// Package loopclosing corrects the drift accumulated by tracking when the camera returns to a
+// place it has already mapped. This is the third of the three ORB-SLAM2 goroutines: it takes
+// keyframes from local mapping, looks for earlier keyframes which look the same, computes the
+// similarity between the two ends of the loop, then fuses the duplicated map points and spreads
+// the correction over the whole map with an essential graph optimisation and global bundle
+// adjustment.
+// Learning: Mur-Artal and Tardós: "Fast Relocalisation and Loop Closing in Keyframe-Based SLAM" (2014)
+package loopclosing
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/kegsay/gorbslam/internal/geom"
+	"github.com/kegsay/gorbslam/internal/optim"
+	"github.com/kegsay/gorbslam/internal/world"
+)
+
+// LocalMapper is the part of local mapping loop closing talks to: it must be stopped while the map
+// is corrected.
+type LocalMapper interface {
+	RequestStop()
+	IsStopped() bool
+	Release()
+}
+
+// LoopClosing processes keyframes once local mapping is done with them. Other goroutines control
+// it through its methods, which are safe for concurrent use.
+type LoopClosing struct {
+	m        *world.Map
+	db       *world.KeyFrameDatabase
+	mapper   LocalMapper
+	fixScale bool
+	globalBA *optim.GlobalBA
+	atlas    *world.Atlas
+
+	mu    sync.Mutex
+	queue []*world.KeyFrame
+	// closed (and replaced) whenever something changes which the goroutine may be waiting for
+	wake      chan struct{}
+	finished  bool
+	resetDone chan struct{}
+	numLoops  int
+	numMerges int
+	paused    bool
+	// held by the goroutine while it processes a keyframe, so Pause can wait for it
+	busy sync.Mutex
+
+	// only used by the goroutine
+	lastLoopKFID int64
+	current      *world.KeyFrame
+	// the groups of keyframes around the loop candidates of the previous keyframe
+	consistentGroups []consistentGroup
+	// the same for merge candidates
+	mergeGroups []consistentGroup
+	// candidates which have been detected for enough consecutive keyframes
+	enoughConsistent []*world.KeyFrame
+	// the keyframe closing the loop with the current one, and the current pose corrected by it
+	matched *world.KeyFrame
+	scw     geom.Sim3
+	// the map point of the loop matched to each keypoint of the current keyframe
+	currentMatchedPoints []*world.MapPoint
+	// the map points seen by the matched keyframe and its neighbours
+	loopMapPoints []*world.MapPoint
+}
+
+// NewLoopClosing creates loop closing for the map m, finding loops with the keyframe database db.
+// fixScale should be set for stereo and RGB-D, where the scale of the map does not drift.
+func NewLoopClosing(m *world.Map, db *world.KeyFrameDatabase, fixScale bool) *LoopClosing {
+	l := &LoopClosing{
+		m:        m,
+		db:       db,
+		fixScale: fixScale,
+		wake:     make(chan struct{}),
+	}
+	l.globalBA = optim.NewGlobalBA(l)
+	return l
+}
+
+// SetLocalMapper sets the local mapping to stop while correcting the map. Must be called before
+// Run.
+func (l *LoopClosing) SetLocalMapper(mapper LocalMapper) {
+	l.mapper = mapper
+}
+
+// SetAtlas sets the atlas holding the maps stored when tracking was lost for too long. Keyframes
+// are then also checked against those maps, and a map seen again is merged into the active one.
+// Must be called before Run.
+func (l *LoopClosing) SetAtlas(a *world.Atlas) {
+	l.atlas = a
+}
+
+// notify wakes up the goroutine. Must be called with the lock held.
+func (l *LoopClosing) notify() {
+	close(l.wake)
+	l.wake = make(chan struct{})
+}
+
+// Run processes keyframes until the context is cancelled. Any global bundle adjustment in
+// progress is aborted before returning.
+func (l *LoopClosing) Run(ctx context.Context) {
+	defer func() {
+		l.globalBA.Stop()
+		l.mu.Lock()
+		l.finished = true
+		if l.resetDone != nil {
+			l.resetLocked()
+		}
+		l.mu.Unlock()
+	}()
+	for {
+		l.busy.Lock()
+		if kf := l.nextKeyFrame(); kf != nil {
+			if l.detectLoop(kf) && l.computeSim3() {
+				l.correctLoop(ctx)
+			} else if l.detectMerge(kf) && l.computeSim3() {
+				l.mergeMaps(ctx)
+			}
+		}
+		l.busy.Unlock()
+		l.resetIfRequested()
+
+		l.mu.Lock()
+		wake := l.wake
+		idle := (len(l.queue) == 0 || l.paused) && l.resetDone == nil
+		l.mu.Unlock()
+		if idle {
+			select {
+			case <-ctx.Done():
+				return
+			case <-wake:
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// InsertKeyFrame queues a keyframe to be checked for a loop. The first keyframe of the map is
+// never checked.
+func (l *LoopClosing) InsertKeyFrame(kf *world.KeyFrame) {
+	if l.m.IsOrigin(kf) {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.queue = append(l.queue, kf)
+	l.notify()
+}
+
+// KeyFramesInQueue returns the number of keyframes waiting to be checked
+func (l *LoopClosing) KeyFramesInQueue() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.queue)
+}
+
+func (l *LoopClosing) nextKeyFrame() *world.KeyFrame {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.queue) == 0 || l.paused {
+		return nil
+	}
+	kf := l.queue[0]
+	l.queue = l.queue[1:]
+	return kf
+}
+
+// Pause stops loop closing from changing the map or the keyframe database, e.g for localisation
+// mode. It blocks until any loop correction in progress is done, and aborts the global bundle
+// adjustment if one is running. Keyframes are still queued while paused, and checked once resumed.
+func (l *LoopClosing) Pause() {
+	l.mu.Lock()
+	l.paused = true
+	l.mu.Unlock()
+	l.busy.Lock()
+	l.busy.Unlock()
+	l.globalBA.Stop()
+}
+
+// Resume undoes Pause
+func (l *LoopClosing) Resume() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.paused = false
+	l.notify()
+}
+
+// NumLoops returns the number of loops which have been closed
+func (l *LoopClosing) NumLoops() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.numLoops
+}
+
+// NumMerges returns the number of maps which have been merged into the active map
+func (l *LoopClosing) NumMerges() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.numMerges
+}
+
+// GlobalBA returns the runner for the global bundle adjustment started after each loop closure
+func (l *LoopClosing) GlobalBA() *optim.GlobalBA {
+	return l.globalBA
+}
+
+// RequestReset discards the queued keyframes and the loop detection state, blocking until done.
+// The keyframe database is cleared too, as it belongs to the map which is being thrown away.
+func (l *LoopClosing) RequestReset() {
+	l.mu.Lock()
+	if l.finished {
+		l.resetLocked()
+		l.mu.Unlock()
+		return
+	}
+	if l.resetDone == nil {
+		l.resetDone = make(chan struct{})
+	}
+	done := l.resetDone
+	l.notify()
+	l.mu.Unlock()
+	<-done
+}
+
+func (l *LoopClosing) resetIfRequested() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.resetDone != nil {
+		l.resetLocked()
+	}
+}
+
+func (l *LoopClosing) resetLocked() {
+	l.queue = nil
+	l.lastLoopKFID = 0
+	l.consistentGroups = nil
+	l.mergeGroups = nil
+	l.enoughConsistent = nil
+	l.db.Clear()
+	if l.resetDone != nil {
+		close(l.resetDone)
+		l.resetDone = nil
+	}
+}
+
+// stopLocalMapping blocks until local mapping has stopped, so the map can be corrected
+func (l *LoopClosing) stopLocalMapping() {
+	if l.mapper == nil {
+		return
+	}
+	l.mapper.RequestStop()
+	for !l.mapper.IsStopped() {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (l *LoopClosing) releaseLocalMapping() {
+	if l.mapper != nil {
+		l.mapper.Release()
+	}
+}
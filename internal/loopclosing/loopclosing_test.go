@@ -0,0 +1,369 @@
+package loopclosing
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/kegsay/gorbslam/internal/bow"
+	"github.com/kegsay/gorbslam/internal/geom"
+	"github.com/kegsay/gorbslam/internal/mapping"
+	"github.com/kegsay/gorbslam/internal/optim"
+	"github.com/kegsay/gorbslam/internal/solver"
+	"github.com/kegsay/gorbslam/internal/tracking"
+	"github.com/kegsay/gorbslam/internal/world"
+	"github.com/kegsay/gorbslam/internal/worldtest"
+)
+
+var (
+	_ LocalMapper              = (*mapping.LocalMapping)(nil)
+	_ mapping.KeyFrameInserter = (*LoopClosing)(nil)
+	_ tracking.LoopCloser      = (*LoopClosing)(nil)
+	_ optim.GlobalBAMap        = (*LoopClosing)(nil)
+)
+
+// A vocabulary tree of random nodes. Random descriptors are all roughly the same distance from
+// every node, so each ends up in an arbitrary but fixed word: images of the same points share
+// words, images of different points mostly don't.
+func newTestVocabulary(rng *rand.Rand, branching, depth int) *bow.Vocabulary {
+	v := bow.NewVocabulary(branching, depth)
+	var grow func(parent, level int)
+	grow = func(parent, level int) {
+		for i := 0; i < branching; i++ {
+			if level == depth {
+				v.AddWord(parent, worldtest.RandomDescriptor(rng), 1)
+				continue
+			}
+			grow(v.AddNode(parent, worldtest.RandomDescriptor(rng)), level+1)
+		}
+	}
+	grow(0, 1)
+	return v
+}
+
+// newTestScene creates a ring of n points around the origin
+func newTestScene(rng *rand.Rand, n int) *worldtest.Scene {
+	s := worldtest.NewScene(rng)
+	for i := 0; i < n; i++ {
+		phi := rng.Float64() * 2 * math.Pi
+		r := 5 + rng.Float64()*2
+		s.Add(geom.Vec3{r * math.Sin(phi), (rng.Float64() - 0.5) * r * 0.6, r * math.Cos(phi)})
+	}
+	return s
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestResetAndStop(t *testing.T) {
+	db := world.NewKeyFrameDatabase()
+	l := NewLoopClosing(world.NewMap(), db, false)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		l.Run(ctx)
+		close(done)
+	}()
+	l.RequestReset()
+	l.RequestReset()
+	cancel()
+	<-done
+	// resetting once finished doesn't deadlock
+	l.RequestReset()
+	if l.NumLoops() != 0 {
+		t.Errorf("closed %d loops", l.NumLoops())
+	}
+}
+
+func TestPause(t *testing.T) {
+	m := world.NewMap()
+	l := NewLoopClosing(m, world.NewKeyFrameDatabase(), false)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		l.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	newKeyFrame := func() *world.KeyFrame {
+		kf := world.NewKeyFrame(world.NewFrame(world.NewFeatures(worldtest.Camera, worldtest.Pyramid, nil, nil, worldtest.Width, worldtest.Height), time.Time{}), m)
+		m.AddKeyFrame(kf)
+		return kf
+	}
+	// the origin is never queued
+	newKeyFrame()
+
+	l.Pause()
+	l.InsertKeyFrame(newKeyFrame())
+	l.InsertKeyFrame(newKeyFrame())
+	time.Sleep(10 * time.Millisecond)
+	if n := l.KeyFramesInQueue(); n != 2 {
+		t.Fatalf("got %d keyframes in the queue while paused, want 2", n)
+	}
+	l.Resume()
+	waitFor(t, "the queue to be processed", func() bool { return l.KeyFramesInQueue() == 0 })
+}
+
+// The camera moves around a circle of radius 3 inside the ring of points, looking outwards, one
+// degree per frame
+const framesPerLoop = 360
+
+func truePose(i int) geom.SE3 {
+	theta := 2 * math.Pi * float64(i) / framesPerLoop
+	twc := geom.SE3{
+		R: geom.ExpSO3(geom.Vec3{0, theta, 0}),
+		T: geom.Vec3{3 * math.Sin(theta), 0, 3 * math.Cos(theta)},
+	}
+	return twc.Inverse()
+}
+
+// trajectoryError is the mean distance between the keyframe centres and the true camera centres,
+// once the keyframes are aligned to the truth with a similarity transform (monocular SLAM can't
+// know the scale, or where the world is).
+func trajectoryError(t *testing.T, centres map[*world.KeyFrame]geom.Vec3, frameIndex map[int64]int) float64 {
+	t.Helper()
+	var est, truth []geom.Vec3
+	for kf, c := range centres {
+		est = append(est, c)
+		truth = append(truth, truePose(frameIndex[kf.FrameID]).Center())
+	}
+	s, ok := solver.HornSim3(truth, est, false)
+	if !ok {
+		t.Fatalf("could not align the trajectory")
+	}
+	var sum float64
+	for i := range est {
+		sum += s.Transform(est[i]).Sub(truth[i]).Norm()
+	}
+	return sum / float64(len(est))
+}
+
+func keyFrameCentres(m *world.Map) map[*world.KeyFrame]geom.Vec3 {
+	centres := make(map[*world.KeyFrame]geom.Vec3)
+	for _, kf := range m.KeyFrames() {
+		centres[kf] = kf.CameraCenter()
+	}
+	return centres
+}
+
+// Tracking, local mapping and loop closing run on a camera going round in a circle. When the
+// camera comes back to the start the loop is closed, which reduces the error accumulated on the
+// way round.
+func TestLoopClosure(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping in short mode")
+	}
+	rng := rand.New(rand.NewSource(3))
+	scene := newTestScene(rng, 4000)
+	voc := newTestVocabulary(rng, 6, 5)
+	m := world.NewMap()
+	db := world.NewKeyFrameDatabase()
+	mapper := mapping.NewLocalMapping(m, voc)
+	closer := NewLoopClosing(m, db, false)
+	mapper.SetLoopCloser(closer)
+	closer.SetLocalMapper(mapper)
+	tracker := tracking.NewTracker(voc, m, mapper, 30)
+	tracker.SetLoopCloser(closer)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	mapperDone, closerDone := make(chan struct{}), make(chan struct{})
+	go func() {
+		mapper.Run(ctx)
+		close(mapperDone)
+	}()
+	go func() {
+		closer.Run(ctx)
+		close(closerDone)
+	}()
+	defer func() {
+		cancel()
+		<-mapperDone
+		<-closerDone
+	}()
+
+	numFrames := framesPerLoop * 5 / 4
+	frameIndex := make(map[int64]int)
+	var before map[*world.KeyFrame]geom.Vec3
+	var results []tracking.Result
+	for i := 0; i < numFrames; i++ {
+		f := scene.Frame(truePose(i), 0.5)
+		frameIndex[f.ID] = i
+		results = append(results, tracker.Track(f))
+		// wait for the other goroutines to finish with each keyframe, so the run is repeatable
+		waitFor(t, "local mapping", func() bool { return mapper.KeyFramesInQueue() == 0 && mapper.AcceptKeyFrames() })
+		waitFor(t, "loop closing", func() bool { return closer.KeyFramesInQueue() == 0 })
+		if closer.NumLoops() == 0 {
+			before = keyFrameCentres(m)
+		}
+	}
+	closer.GlobalBA().Wait()
+
+	if closer.NumLoops() == 0 {
+		t.Fatalf("no loop was closed")
+	}
+	if last := results[len(results)-1]; last.State != tracking.OK {
+		t.Errorf("tracking lost after closing the loop: %v", last.State)
+	}
+	if closer.GlobalBA().Applied() == 0 {
+		t.Errorf("global bundle adjustment was not applied")
+	}
+
+	// compare the same keyframes before and after
+	after := keyFrameCentres(m)
+	for kf := range before {
+		if _, ok := after[kf]; !ok {
+			delete(before, kf)
+		}
+	}
+	for kf := range after {
+		if _, ok := before[kf]; !ok {
+			delete(after, kf)
+		}
+	}
+	errBefore := trajectoryError(t, before, frameIndex)
+	errAfter := trajectoryError(t, after, frameIndex)
+	t.Logf("trajectory error %v before closing the loop, %v after, over %d keyframes", errBefore, errAfter, len(after))
+	if errAfter > errBefore/2 {
+		t.Errorf("closing the loop did not reduce the trajectory error enough: %v -> %v", errBefore, errAfter)
+	}
+}
+
+// The camera maps part of the ring, is covered for long enough that a new map is started, then
+// starts again further round and comes back the other way. When it reaches the first map the two
+// are merged into one.
+func TestMergeMaps(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping in short mode")
+	}
+	rng := rand.New(rand.NewSource(4))
+	scene := newTestScene(rng, 4000)
+	voc := newTestVocabulary(rng, 6, 5)
+	m := world.NewMap()
+	db := world.NewKeyFrameDatabase()
+	atlas := world.NewAtlas(m, db)
+	mapper := mapping.NewLocalMapping(m, voc)
+	closer := NewLoopClosing(m, db, false)
+	closer.SetAtlas(atlas)
+	mapper.SetLoopCloser(closer)
+	closer.SetLocalMapper(mapper)
+	tracker := tracking.NewTracker(voc, m, mapper, 30)
+	tracker.SetLoopCloser(closer)
+	tracker.SetKeyFrameDatabase(db)
+	tracker.SetAtlas(atlas)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	mapperDone, closerDone := make(chan struct{}), make(chan struct{})
+	go func() {
+		mapper.Run(ctx)
+		close(mapperDone)
+	}()
+	go func() {
+		closer.Run(ctx)
+		close(closerDone)
+	}()
+	defer func() {
+		cancel()
+		<-mapperDone
+		<-closerDone
+	}()
+
+	start := time.Unix(0, 0)
+	n := 0
+	frameIndex := make(map[int64]int)
+	track := func(f *world.Frame, i int) tracking.Result {
+		f.Timestamp = start.Add(time.Duration(n) * time.Second / 30)
+		n++
+		frameIndex[f.ID] = i
+		res := tracker.Track(f)
+		waitFor(t, "local mapping", func() bool { return mapper.KeyFramesInQueue() == 0 && mapper.AcceptKeyFrames() })
+		waitFor(t, "loop closing", func() bool { return closer.KeyFramesInQueue() == 0 })
+		return res
+	}
+	for i := 0; i < 60; i++ {
+		track(scene.Frame(truePose(i), 0.5), i)
+	}
+	first := m.KeyFrames()
+
+	// nothing to see for 6 seconds
+	for j := 0; j < 180 && atlas.NumMaps() == 1; j++ {
+		track(world.NewFrame(world.NewFeatures(worldtest.Camera, worldtest.Pyramid, nil, nil, worldtest.Width, worldtest.Height), time.Time{}), -1)
+	}
+	if atlas.NumMaps() != 2 {
+		t.Fatalf("no new map was started")
+	}
+
+	var last tracking.Result
+	for i := 150; i > 20 && closer.NumMerges() == 0; i-- {
+		last = track(scene.Frame(truePose(i), 0.5), i)
+	}
+	closer.GlobalBA().Wait()
+	if closer.NumMerges() != 1 || atlas.NumMaps() != 1 {
+		t.Fatalf("got %d merges and %d maps", closer.NumMerges(), atlas.NumMaps())
+	}
+	if last.State != tracking.OK {
+		t.Errorf("tracking lost after merging: %v", last.State)
+	}
+	kept := 0
+	for _, kf := range first {
+		if !kf.IsBad() {
+			kept++
+		}
+	}
+	if kept == 0 {
+		t.Errorf("no keyframes of the first map were merged")
+	}
+	// both maps now agree on where the camera was
+	errMerged := trajectoryError(t, keyFrameCentres(m), frameIndex)
+	t.Logf("trajectory error %v over %d keyframes, %d of them from the first map", errMerged, m.NumKeyFrames(), kept)
+	if errMerged > 0.1 {
+		t.Errorf("merged trajectory error %v is too high", errMerged)
+	}
+}
+
+func TestMergeMapsWithoutInactiveMap(t *testing.T) {
+	scene := worldtest.NewScene(rand.New(rand.NewSource(5)))
+	m := world.NewMap()
+	db := world.NewKeyFrameDatabase()
+	atlas := world.NewAtlas(m, db)
+	l := NewLoopClosing(m, db, false)
+	l.SetAtlas(atlas)
+	newKeyFrame := func(m *world.Map) *world.KeyFrame {
+		kf := world.NewKeyFrame(scene.Frame(geom.IdentitySE3(), 0), m)
+		m.AddKeyFrame(kf)
+		return kf
+	}
+	// neither keyframe is the first of its map, which is never removed
+	newKeyFrame(m)
+	current := newKeyFrame(m)
+	// the matched keyframe's map is no longer in the atlas
+	other := world.NewMap()
+	newKeyFrame(other)
+	matched := newKeyFrame(other)
+	for _, kf := range []*world.KeyFrame{current, matched} {
+		kf.SetNotErase()
+		// deferred until loop closing is done with the keyframe
+		kf.SetBad()
+	}
+
+	l.current, l.matched = current, matched
+	l.mergeMaps(context.Background())
+	if l.NumMerges() != 0 || atlas.NumMaps() != 1 {
+		t.Errorf("got %d merges and %d maps", l.NumMerges(), atlas.NumMaps())
+	}
+	if !current.IsBad() || !matched.IsBad() {
+		t.Errorf("keyframes are still protected from removal")
+	}
+}
@@ -0,0 +1,87 @@
+package loopclosing
+
+import (
+	"context"
+
+	"github.com/kegsay/gorbslam/internal/geom"
+	"github.com/kegsay/gorbslam/internal/world"
+)
+
+// detectMerge looks for merge candidates for kf in the inactive maps of the atlas. As for loops, a
+// candidate must be consistently detected for several keyframes before it is trusted, in which
+// case it is in enoughConsistent.
+func (l *LoopClosing) detectMerge(kf *world.KeyFrame) bool {
+	if l.atlas == nil {
+		return false
+	}
+	l.current = kf
+	kf.SetNotErase()
+	if kf.IsBad() {
+		kf.SetErase()
+		return false
+	}
+	candidates := l.atlas.DetectMergeCandidates(kf, minCandidateScore(kf))
+	if len(candidates) == 0 {
+		l.mergeGroups = nil
+		kf.SetErase()
+		return false
+	}
+	l.mergeGroups, l.enoughConsistent = checkConsistency(candidates, l.mergeGroups)
+	if len(l.enoughConsistent) == 0 {
+		kf.SetErase()
+		return false
+	}
+	return true
+}
+
+// mergeMaps welds the inactive map of the keyframe found by computeSim3 into the active map. The
+// whole inactive map is moved by the similarity between the two, so that the matched keyframe
+// lines up with the current one, then the map points seen from both are fused and global bundle
+// adjustment is started to settle the seam.
+func (l *LoopClosing) mergeMaps(ctx context.Context) {
+	// as in correctLoop, abort global BA before stopping local mapping
+	l.globalBA.Stop()
+	l.stopLocalMapping()
+
+	current, matched := l.current, l.matched
+	l.m.Update.Lock()
+	inactive := l.atlas.MapOf(matched)
+	if inactive == nil {
+		// the matched keyframe's map was merged or cleared since it was detected
+		l.m.Update.Unlock()
+		l.releaseLocalMapping()
+		matched.SetErase()
+		current.SetErase()
+		return
+	}
+	// Scw is the current pose in the coordinates of the inactive map, so x = Twc * Scw * x_inactive
+	s := current.Pose().Inverse().Sim3().Mul(l.scw)
+	l.atlas.Merge(inactive, s, matched, current)
+	l.fuseMatchedPoints()
+	l.m.Update.Unlock()
+
+	// nothing moved in the active map, so the poses are already correct
+	connected := append(current.CovisibleKeyFrames(), current)
+	poses := make(map[*world.KeyFrame]geom.Sim3, len(connected))
+	for _, kf := range connected {
+		poses[kf] = kf.Pose().Sim3()
+	}
+	l.searchAndFuse(connected, poses)
+	// the fused points connect the keyframes on either side of the seam
+	for _, kf := range append(connected, append(matched.CovisibleKeyFrames(), matched)...) {
+		kf.UpdateConnections()
+	}
+
+	matched.AddLoopEdge(current)
+	current.AddLoopEdge(matched)
+	l.m.InformNewBigChange()
+	l.globalBA.Start(ctx, current.ID)
+	l.releaseLocalMapping()
+
+	l.lastLoopKFID = current.ID
+	l.consistentGroups = nil
+	l.mergeGroups = nil
+	l.mu.Lock()
+	l.numMerges++
+	l.mu.Unlock()
+}
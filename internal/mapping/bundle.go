@@ -0,0 +1,100 @@
+package mapping
+
+import (
+	"context"
+
+	"github.com/kegsay/gorbslam/internal/optim"
+	"github.com/kegsay/gorbslam/internal/world"
+)
+
+// localBundleAdjustment optimises the current keyframe, the keyframes connected to it in the
+// covisibility graph and every point they observe. Keyframes which observe those points but aren't
+// connected are included but held fixed. Observations found to be outliers are removed from the
+// map.
+func (l *LocalMapping) localBundleAdjustment(ctx context.Context) {
+	kf := l.current
+	local := []*world.KeyFrame{kf}
+	index := map[*world.KeyFrame]int{kf: 0}
+	for _, n := range kf.CovisibleKeyFrames() {
+		if n.IsBad() {
+			continue
+		}
+		index[n] = len(local)
+		local = append(local, n)
+	}
+	numLocal := len(local)
+
+	var points []*world.MapPoint
+	pointIndex := make(map[*world.MapPoint]int)
+	for _, k := range local {
+		for _, mp := range k.MapPoints() {
+			if _, ok := pointIndex[mp]; ok {
+				continue
+			}
+			pointIndex[mp] = len(points)
+			points = append(points, mp)
+		}
+	}
+
+	p := &optim.BundleProblem{
+		Camera:    kf.Camera,
+		Bf:        kf.Bf,
+		InvSigma2: kf.Pyramid.InvSigma2,
+	}
+	for _, k := range local {
+		// the origin anchors the map
+		p.KeyFrames = append(p.KeyFrames, optim.BAKeyFrame{Pose: k.Pose(), Fixed: l.m.IsOrigin(k)})
+	}
+	type observer struct {
+		kf  *world.KeyFrame
+		idx int
+	}
+	var observers []observer
+	for pi, mp := range points {
+		p.Points = append(p.Points, optim.BAPoint{Position: mp.Position()})
+		for k, idx := range mp.Observations() {
+			if k.IsBad() {
+				continue
+			}
+			ki, ok := index[k]
+			if !ok {
+				// fixed keyframes observe the points but are not optimised
+				ki = len(local)
+				index[k] = ki
+				local = append(local, k)
+				p.KeyFrames = append(p.KeyFrames, optim.BAKeyFrame{Pose: k.Pose(), Fixed: true})
+			}
+			kp := &k.KeyPoints[idx]
+			p.Observations = append(p.Observations, optim.BAObservation{
+				KeyFrame: ki, Point: pi, U: kp.X, V: kp.Y, URight: k.RightX(idx), Octave: kp.Octave,
+			})
+			observers = append(observers, observer{k, idx})
+		}
+	}
+	if len(p.Observations) == 0 {
+		return
+	}
+
+	optim.LocalBundleAdjustment(ctx, p)
+
+	l.m.Update.Lock()
+	defer l.m.Update.Unlock()
+	for i, o := range p.Observations {
+		if !o.Outlier {
+			continue
+		}
+		mp := points[o.Point]
+		observers[i].kf.EraseMapPoint(mp)
+		mp.EraseObservation(observers[i].kf)
+	}
+	for i := 0; i < numLocal; i++ {
+		local[i].SetPose(p.KeyFrames[i].Pose)
+	}
+	for i, mp := range points {
+		if mp.IsBad() {
+			continue
+		}
+		mp.SetPosition(p.Points[i].Position)
+		mp.UpdateNormalAndDepth()
+	}
+}
@@ -0,0 +1,70 @@
+package mapping
+
+// mapPointCulling removes recently created points which are not being found as often as predicted
+// or are not seen by enough keyframes soon after creation. Points which survive 3 keyframes are no
+// longer checked.
+func (l *LocalMapping) mapPointCulling() {
+	const minObs = 2
+	currentID := l.current.ID
+	kept := l.recentPoints[:0]
+	for _, mp := range l.recentPoints {
+		switch {
+		case mp.IsBad():
+		case mp.FoundRatio() < 0.25:
+			mp.SetBad()
+		case currentID-mp.FirstKeyFrameID >= 2 && mp.NumObservations() <= minObs:
+			mp.SetBad()
+		case currentID-mp.FirstKeyFrameID >= 3:
+		default:
+			kept = append(kept, mp)
+		}
+	}
+	l.recentPoints = kept
+}
+
+// keyFrameCulling removes the covisible keyframes of the current keyframe which are redundant: 90%
+// of their map points are seen by at least 3 other keyframes at the same or a finer scale. Only
+// close points count for a stereo keyframe, as the far ones don't fix the scale.
+func (l *LocalMapping) keyFrameCulling() {
+	const thObs = 3
+	for _, kf := range l.current.CovisibleKeyFrames() {
+		if l.m.IsOrigin(kf) || kf.IsBad() {
+			continue
+		}
+		if kf.Preintegrated() != nil && !inertialCullable(kf) {
+			continue
+		}
+		numPoints, numRedundant := 0, 0
+		for i, mp := range kf.MapPointMatches() {
+			if mp == nil || mp.IsBad() {
+				continue
+			}
+			if kf.IsStereo() && (kf.Depth[i] > kf.ThDepth || kf.Depth[i] < 0) {
+				continue
+			}
+			numPoints++
+			if mp.NumObservations() <= thObs {
+				continue
+			}
+			level := kf.KeyPoints[i].Octave
+			numObs := 0
+			for other, idx := range mp.Observations() {
+				if other == kf {
+					continue
+				}
+				if other.KeyPoints[idx].Octave <= level+1 {
+					numObs++
+					if numObs >= thObs {
+						break
+					}
+				}
+			}
+			if numObs >= thObs {
+				numRedundant++
+			}
+		}
+		if float64(numRedundant) > 0.9*float64(numPoints) {
+			kf.SetBad()
+		}
+	}
+}
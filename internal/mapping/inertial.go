@@ -0,0 +1,110 @@
+package mapping
+
+import (
+	"context"
+	"time"
+
+	"github.com/kegsay/gorbslam/internal/geom"
+	"github.com/kegsay/gorbslam/internal/optim"
+	"github.com/kegsay/gorbslam/internal/world"
+)
+
+const (
+	// the IMU is initialised once the keyframes span this long, and there are this many of them
+	minInertialTime      = 2 * time.Second
+	minInertialKeyFrames = 10
+	// the IMU motion between keyframes is only accurate over short times, so a keyframe is only
+	// removed if its neighbours in time are less than this apart
+	maxInertialCullGap = 500 * time.Millisecond
+	// an estimated scale this small means the initialisation failed
+	minInertialScale = 0.1
+)
+
+// The IMU estimates are refined when the keyframes span these times, as the longer the trajectory
+// the better the accelerometer bias can be told apart from gravity
+var inertialRefinementTimes = []time.Duration{
+	5 * time.Second, 15 * time.Second, 25 * time.Second, 35 * time.Second,
+	45 * time.Second, 55 * time.Second, 65 * time.Second, 75 * time.Second,
+}
+
+// inertialInitialization estimates the direction of gravity, the scale of the map and the IMU
+// biases once the keyframes span long enough, then refines them at inertialRefinementTimes. The
+// map is rotated so that gravity points along -z and scaled to metres, and every keyframe is
+// given the estimated bias and velocity. This follows ORB-SLAM3, including the strong prior on
+// the accelerometer bias in the first monocular initialisation.
+func (l *LocalMapping) inertialInitialization(ctx context.Context) {
+	kfs := inertialKeyFrames(l.current)
+	if len(kfs) < minInertialKeyFrames {
+		return
+	}
+	span := kfs[len(kfs)-1].Timestamp.Sub(kfs[0].Timestamp)
+	initialized := l.m.IsIMUInitialized()
+	if !initialized && span < minInertialTime {
+		return
+	}
+	if initialized && (l.inertialRefinements >= len(inertialRefinementTimes) || span < inertialRefinementTimes[l.inertialRefinements]) {
+		return
+	}
+
+	stereo := kfs[0].IsStereo()
+	problem := &optim.InertialProblem{
+		Scale:     1,
+		FixScale:  stereo,
+		PriorGyro: 1e2,
+		PriorAcc:  1e5,
+	}
+	if !initialized && !stereo {
+		problem.PriorAcc = 1e10
+	}
+	if initialized {
+		problem.PriorGyro, problem.PriorAcc = 1, 1e5
+	}
+	for _, kf := range kfs {
+		problem.KeyFrames = append(problem.KeyFrames, optim.InertialKeyFrame{Pose: kf.Pose(), Preintegrated: kf.Preintegrated()})
+	}
+	res, err := optim.InertialInitialization(ctx, problem)
+	if err != nil || res.Stats.Aborted || res.Scale < minInertialScale {
+		return
+	}
+
+	l.m.Update.Lock()
+	// the tracker may have queued keyframes while we optimised, which it tracks against so they
+	// must move with the map
+	l.mu.Lock()
+	pending := append([]*world.KeyFrame(nil), l.queue...)
+	l.mu.Unlock()
+	// the world becomes the inertial frame, in metres
+	rgw := res.Rwg.Inverse()
+	l.m.Transform(geom.Sim3{R: rgw, S: res.Scale}, pending...)
+	for i, kf := range kfs {
+		kf.SetVelocity(rgw.Rotate(res.Velocities[i]))
+	}
+	for _, kf := range append(l.m.KeyFrames(), pending...) {
+		kf.SetBias(res.Bias)
+	}
+	l.m.SetIMUInitialized()
+	l.m.Update.Unlock()
+	l.m.InformNewBigChange()
+	if initialized {
+		l.inertialRefinements++
+	}
+}
+
+// inertialKeyFrames returns the keyframes linked in time up to kf, oldest first
+func inertialKeyFrames(kf *world.KeyFrame) []*world.KeyFrame {
+	var kfs []*world.KeyFrame
+	for ; kf != nil; kf = kf.PrevKeyFrame() {
+		kfs = append(kfs, kf)
+	}
+	for i, j := 0, len(kfs)-1; i < j; i, j = i+1, j-1 {
+		kfs[i], kfs[j] = kfs[j], kfs[i]
+	}
+	return kfs
+}
+
+// inertialCullable returns true if kf can be removed without leaving too long a gap in time
+// between its neighbours
+func inertialCullable(kf *world.KeyFrame) bool {
+	prev, next := kf.PrevKeyFrame(), kf.NextKeyFrame()
+	return prev != nil && next != nil && next.Timestamp.Sub(prev.Timestamp) < maxInertialCullGap
+}
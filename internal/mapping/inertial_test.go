@@ -0,0 +1,142 @@
+package mapping
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/kegsay/gorbslam/internal/geom"
+	"github.com/kegsay/gorbslam/internal/imu"
+	"github.com/kegsay/gorbslam/internal/tracking"
+	"github.com/kegsay/gorbslam/internal/world"
+	"github.com/kegsay/gorbslam/internal/worldtest"
+)
+
+// inertialTrajectory is a camera rigidly mounted with an IMU, swaying in front of the test scene.
+// The scene is in front of the camera's starting pose, and gravity is along -z of the inertial frame.
+type inertialTrajectory struct {
+	// Rgs rotates the scene's coordinates into the inertial frame
+	rgs geom.SO3
+	tbc geom.SE3
+	// the IMU's starting orientation, so that the camera starts aligned with the scene
+	r0   geom.SO3
+	axis geom.Vec3
+}
+
+func newInertialTrajectory() *inertialTrajectory {
+	tr := &inertialTrajectory{
+		// the scene's z axis, where the camera looks, is horizontal
+		rgs:  geom.ExpSO3(geom.Vec3{-math.Pi / 2, 0, 0}).Mul(geom.ExpSO3(geom.Vec3{0, 0.3, 0})),
+		tbc:  geom.SE3{R: geom.ExpSO3(geom.Vec3{0, 0, math.Pi / 2}), T: geom.Vec3{0.03, -0.01, 0.02}},
+		axis: geom.Vec3{0.2, 1, 0.1}.Normalised(),
+	}
+	tr.r0 = tr.rgs.Mul(tr.tbc.R.Inverse())
+	return tr
+}
+
+// body returns Rgb and the position, velocity and acceleration of the IMU in the inertial frame at
+// t seconds, and its angular velocity in the body frame
+func (tr *inertialTrajectory) body(t float64) (geom.SO3, geom.Vec3, geom.Vec3, geom.Vec3, geom.Vec3) {
+	r := tr.r0.Mul(geom.ExpSO3(tr.axis.Scale(0.08 * math.Sin(1.3*t))))
+	omega := tr.axis.Scale(0.104 * math.Cos(1.3*t))
+	p := geom.Vec3{0.3 * math.Sin(1.7*t), 0.15 * math.Sin(2.3*t), 0.1 * math.Sin(1.1*t)}
+	v := geom.Vec3{0.51 * math.Cos(1.7*t), 0.345 * math.Cos(2.3*t), 0.11 * math.Cos(1.1*t)}
+	a := geom.Vec3{-0.867 * math.Sin(1.7*t), -0.7935 * math.Sin(2.3*t), -0.121 * math.Sin(1.1*t)}
+	return r, p, v, a, omega
+}
+
+// cameraPose returns Tcs, the pose of the camera in the scene's coordinates at t seconds
+func (tr *inertialTrajectory) cameraPose(t float64) geom.SE3 {
+	r, p, _, _, _ := tr.body(t)
+	tgc := geom.SE3{R: r, T: p}.Mul(tr.tbc)
+	tsg := geom.SE3{R: tr.rgs.Inverse()}
+	return tsg.Mul(tgc).Inverse()
+}
+
+func (tr *inertialTrajectory) measurement(t float64, epoch time.Time, bias imu.Bias) imu.Measurement {
+	r, _, _, a, omega := tr.body(t)
+	return imu.Measurement{
+		Timestamp: epoch.Add(time.Duration(t * float64(time.Second))),
+		Acc:       r.Inverse().Rotate(a.Sub(imu.Gravity())).Add(bias.Acc),
+		Gyro:      omega.Add(bias.Gyro),
+	}
+}
+
+// A monocular camera with an IMU: once the keyframes span long enough the map is rotated to align
+// with gravity and scaled to metres, and tracking carries on in the new map.
+func TestVisualInertialTracking(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping in short mode")
+	}
+	rng := rand.New(rand.NewSource(3))
+	scene := newTestScene(rng, 2000, 8, 6)
+	voc := worldtest.FlatVocabulary(rng, 16)
+	m := world.NewMap()
+	mapper := NewLocalMapping(m, voc)
+	tracker := tracking.NewTracker(voc, m, mapper, 20)
+	tr := newInertialTrajectory()
+	calib := imu.NewCalibration(tr.tbc, 1.7e-4, 2e-3, 1.9e-5, 3e-3, 200)
+	tracker.SetIMU(calib)
+	bias := imu.Bias{Gyro: geom.Vec3{0.004, -0.003, 0.002}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		mapper.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	epoch := time.Unix(1000, 0)
+	const fps, imuRate, numFrames = 20, 200, 80
+	var results []tracking.Result
+	// the first frame tracked in the metric map
+	first := -1
+	sample := 0
+	for i := 0; i < numFrames; i++ {
+		ts := float64(i) / fps
+		f := scene.Frame(tr.cameraPose(ts), 0.3)
+		f.Timestamp = epoch.Add(time.Duration(ts * float64(time.Second)))
+		for ; float64(sample)/imuRate <= ts; sample++ {
+			f.IMU = append(f.IMU, tr.measurement(float64(sample)/imuRate, epoch, bias))
+		}
+		initialized := m.IsIMUInitialized()
+		results = append(results, tracker.Track(f))
+		if initialized && first < 0 {
+			first = i
+		}
+		waitFor(t, "local mapping", func() bool { return mapper.KeyFramesInQueue() == 0 })
+	}
+
+	if first < 0 || first > numFrames-10 {
+		t.Fatalf("IMU was not initialised in time: first metric frame %d, %d keyframes", first, m.NumKeyFrames())
+	}
+	last := results[numFrames-1]
+	if last.State != tracking.OK {
+		t.Fatalf("last frame: got state %v want OK", last.State)
+	}
+	// the map is in metres, so the camera moved as far as it did in truth
+	got := last.Pose.Center().Sub(results[first].Pose.Center()).Norm()
+	want := tr.cameraPose(float64(numFrames-1) / fps).Center().Sub(tr.cameraPose(float64(first) / fps).Center()).Norm()
+	if math.Abs(got-want) > 0.05*want {
+		t.Errorf("camera moved %vm in the map, %vm in truth", got, want)
+	}
+	// and gravity is along -z: compare its direction in the camera
+	down := geom.Vec3{0, 0, -1}
+	rcg := tr.cameraPose(float64(numFrames-1) / fps).R.Mul(tr.rgs.Inverse())
+	cos := last.Pose.R.Rotate(down).Dot(rcg.Rotate(down))
+	if angle := math.Acos(math.Min(cos, 1)); angle > 0.02 {
+		t.Errorf("gravity is %v rad off", angle)
+	}
+	for _, kf := range m.KeyFrames() {
+		if d := kf.Bias().Gyro.Sub(bias.Gyro).Norm(); d > 1e-3 {
+			t.Errorf("keyframe %d: gyroscope bias %v want %v", kf.ID, kf.Bias().Gyro, bias.Gyro)
+			break
+		}
+	}
+}
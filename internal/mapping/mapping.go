@@ -0,0 +1,398 @@
+// Package mapping grows and refines the map around each new keyframe. This is the second of the
+// three ORB-SLAM2 goroutines: it takes keyframes from tracking, triangulates new map points with
+// their neighbours, merges duplicated points, runs local bundle adjustment and removes redundant
+// keyframes, before passing them on to loop closing.
+// Learning: https://youtu.be/0I30M6yTklo?t=281
+package mapping
+
+import (
+	"context"
+	"sync"
+
+	"github.com/kegsay/gorbslam/internal/bow"
+	"github.com/kegsay/gorbslam/internal/matching"
+	"github.com/kegsay/gorbslam/internal/world"
+)
+
+// the current keyframe is fused with this many of its best covisible keyframes, plus this many of
+// each of theirs
+const (
+	fuseNeighbours       = 20
+	fuseSecondNeighbours = 5
+)
+
+// KeyFrameInserter receives keyframes once they have been processed, i.e loop closing
+type KeyFrameInserter interface {
+	InsertKeyFrame(kf *world.KeyFrame)
+}
+
+// LocalMapping processes keyframes inserted by the tracker. Other goroutines control it through
+// its methods, which are safe for concurrent use.
+//
+// Loop closing stops local mapping while it corrects the map: RequestStop asks it to stop after
+// the keyframe in progress, IsStopped reports when it has, and Release resumes it. The tracker
+// holds off stopping with SetNotStop while it creates a keyframe.
+type LocalMapping struct {
+	m          *world.Map
+	voc        *bow.Vocabulary
+	loopCloser KeyFrameInserter
+
+	mu    sync.Mutex
+	queue []*world.KeyFrame
+	// closed (and replaced) whenever something changes which the goroutine may be waiting for
+	wake          chan struct{}
+	acceptKFs     bool
+	abortBA       context.CancelFunc
+	stopRequested bool
+	stopped       bool
+	notStop       bool
+	finished      bool
+	resetDone     chan struct{}
+
+	// only used by the goroutine
+	current      *world.KeyFrame
+	recentPoints []*world.MapPoint
+	// the number of times the IMU estimates have been refined since they were initialised
+	inertialRefinements int
+}
+
+// NewLocalMapping creates local mapping for the map m.
+func NewLocalMapping(m *world.Map, voc *bow.Vocabulary) *LocalMapping {
+	return &LocalMapping{
+		m:         m,
+		voc:       voc,
+		wake:      make(chan struct{}),
+		acceptKFs: true,
+	}
+}
+
+// SetLoopCloser sets where keyframes go once they have been processed. Must be called before Run.
+func (l *LocalMapping) SetLoopCloser(lc KeyFrameInserter) {
+	l.loopCloser = lc
+}
+
+// notify wakes up the goroutine. Must be called with the lock held.
+func (l *LocalMapping) notify() {
+	close(l.wake)
+	l.wake = make(chan struct{})
+}
+
+// Run processes keyframes until the context is cancelled.
+func (l *LocalMapping) Run(ctx context.Context) {
+	defer func() {
+		l.mu.Lock()
+		l.finished = true
+		l.stopped = true
+		l.resetLocked()
+		l.mu.Unlock()
+	}()
+	for {
+		l.setAcceptKeyFrames(false)
+		if kf := l.nextKeyFrame(); kf != nil {
+			l.processKeyFrame(ctx, kf)
+		} else if l.stop() {
+			if !l.waitWhileStopped(ctx) {
+				return
+			}
+		}
+		l.resetIfRequested()
+		l.setAcceptKeyFrames(true)
+
+		l.mu.Lock()
+		wake := l.wake
+		idle := len(l.queue) == 0 && l.resetDone == nil && (!l.stopRequested || l.notStop)
+		l.mu.Unlock()
+		if idle {
+			select {
+			case <-ctx.Done():
+				return
+			case <-wake:
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// waitWhileStopped blocks until loop closing releases us, handling reset requests meanwhile.
+// Returns false if the context is cancelled.
+func (l *LocalMapping) waitWhileStopped(ctx context.Context) bool {
+	for {
+		l.mu.Lock()
+		if l.resetDone != nil {
+			l.resetLocked()
+		}
+		stopped := l.stopped
+		wake := l.wake
+		l.mu.Unlock()
+		if !stopped {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-wake:
+		}
+	}
+}
+
+func (l *LocalMapping) processKeyFrame(ctx context.Context, kf *world.KeyFrame) {
+	l.current = kf
+	l.processNewKeyFrame()
+	l.mapPointCulling()
+	l.createNewMapPoints()
+	if !l.hasNewKeyFrames() {
+		l.searchInNeighbors()
+	}
+	if !l.hasNewKeyFrames() && !l.StopRequested() {
+		if l.m.NumKeyFrames() > 2 {
+			baCtx, cancel := context.WithCancel(ctx)
+			l.mu.Lock()
+			l.abortBA = cancel
+			l.mu.Unlock()
+			l.localBundleAdjustment(baCtx)
+			l.mu.Lock()
+			l.abortBA = nil
+			l.mu.Unlock()
+			cancel()
+		}
+		l.keyFrameCulling()
+		if kf.Preintegrated() != nil {
+			l.inertialInitialization(ctx)
+		}
+	}
+	if l.loopCloser != nil {
+		l.loopCloser.InsertKeyFrame(kf)
+	}
+}
+
+// InsertKeyFrame queues a keyframe for processing, interrupting any bundle adjustment in progress
+// so that it is processed sooner.
+func (l *LocalMapping) InsertKeyFrame(kf *world.KeyFrame) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.queue = append(l.queue, kf)
+	l.interruptBALocked()
+	l.notify()
+}
+
+// KeyFramesInQueue returns the number of keyframes waiting to be processed
+func (l *LocalMapping) KeyFramesInQueue() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.queue)
+}
+
+func (l *LocalMapping) hasNewKeyFrames() bool {
+	return l.KeyFramesInQueue() > 0
+}
+
+func (l *LocalMapping) nextKeyFrame() *world.KeyFrame {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.queue) == 0 {
+		return nil
+	}
+	kf := l.queue[0]
+	l.queue = l.queue[1:]
+	return kf
+}
+
+// AcceptKeyFrames returns false while a keyframe is being processed
+func (l *LocalMapping) AcceptKeyFrames() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.acceptKFs
+}
+
+func (l *LocalMapping) setAcceptKeyFrames(flag bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.acceptKFs = flag
+}
+
+// InterruptBA aborts the local bundle adjustment in progress, if any
+func (l *LocalMapping) InterruptBA() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.interruptBALocked()
+}
+
+func (l *LocalMapping) interruptBALocked() {
+	if l.abortBA != nil {
+		l.abortBA()
+	}
+}
+
+// RequestStop asks local mapping to stop once the keyframe in progress has been processed
+func (l *LocalMapping) RequestStop() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stopRequested = true
+	l.interruptBALocked()
+	l.notify()
+}
+
+// stop stops if requested and allowed, returning true if stopped
+func (l *LocalMapping) stop() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stopRequested && !l.notStop {
+		l.stopped = true
+		return true
+	}
+	return false
+}
+
+// IsStopped returns true once local mapping has stopped after RequestStop
+func (l *LocalMapping) IsStopped() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.stopped
+}
+
+// StopRequested returns true if RequestStop has been called and Release has not
+func (l *LocalMapping) StopRequested() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.stopRequested
+}
+
+// SetNotStop prevents local mapping from stopping while flag is set. Returns false if it has
+// already stopped, in which case the flag is not set.
+func (l *LocalMapping) SetNotStop(flag bool) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if flag && l.stopped {
+		return false
+	}
+	l.notStop = flag
+	if !flag {
+		l.notify()
+	}
+	return true
+}
+
+// Release resumes local mapping after a stop. Keyframes inserted while stopped are discarded,
+// since the map they were tracked against has since been corrected.
+func (l *LocalMapping) Release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.finished {
+		return
+	}
+	l.stopped = false
+	l.stopRequested = false
+	l.queue = nil
+	l.notify()
+}
+
+// RequestReset discards the queued keyframes and recently created points, blocking until done.
+func (l *LocalMapping) RequestReset() {
+	l.mu.Lock()
+	if l.finished {
+		l.resetLocked()
+		l.mu.Unlock()
+		return
+	}
+	if l.resetDone == nil {
+		l.resetDone = make(chan struct{})
+	}
+	done := l.resetDone
+	l.notify()
+	l.mu.Unlock()
+	<-done
+}
+
+func (l *LocalMapping) resetIfRequested() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.resetDone != nil {
+		l.resetLocked()
+	}
+}
+
+func (l *LocalMapping) resetLocked() {
+	l.queue = nil
+	l.recentPoints = nil
+	l.inertialRefinements = 0
+	if l.resetDone != nil {
+		close(l.resetDone)
+		l.resetDone = nil
+	}
+}
+
+// processNewKeyFrame adds the keyframe to the map: the map points matched by the tracker gain an
+// observation, and the keyframe is connected into the covisibility graph.
+func (l *LocalMapping) processNewKeyFrame() {
+	kf := l.current
+	kf.ComputeBoW(l.voc)
+	for i, mp := range kf.MapPointMatches() {
+		if mp == nil || mp.IsBad() {
+			continue
+		}
+		if !mp.IsInKeyFrame(kf) {
+			mp.AddObservation(kf, i)
+			mp.UpdateNormalAndDepth()
+			mp.ComputeDistinctiveDescriptors()
+		} else {
+			// created with the keyframe (i.e by initialisation), so check it like a new point
+			l.recentPoints = append(l.recentPoints, mp)
+		}
+	}
+	kf.UpdateConnections()
+	l.m.AddKeyFrame(kf)
+}
+
+// searchInNeighbors fuses the points of the current keyframe with those of its neighbours (and
+// their neighbours), so the same point seen by several keyframes only exists once.
+func (l *LocalMapping) searchInNeighbors() {
+	kf := l.current
+	targets := make(map[*world.KeyFrame]bool)
+	var targetList []*world.KeyFrame
+	addTarget := func(t *world.KeyFrame) {
+		if t.IsBad() || t == kf || targets[t] {
+			return
+		}
+		targets[t] = true
+		targetList = append(targetList, t)
+	}
+	for _, n := range kf.BestCovisibilityKeyFrames(fuseNeighbours) {
+		addTarget(n)
+	}
+	for _, n := range append([]*world.KeyFrame(nil), targetList...) {
+		for _, n2 := range n.BestCovisibilityKeyFrames(fuseSecondNeighbours) {
+			addTarget(n2)
+		}
+	}
+
+	matcher := matching.NewMatcher(0.6, true)
+	// our points into the neighbours
+	points := kf.MapPointMatches()
+	for _, t := range targetList {
+		matcher.Fuse(t, points, 3)
+	}
+	// and the neighbours' points into us
+	seen := make(map[*world.MapPoint]bool)
+	var candidates []*world.MapPoint
+	for _, t := range targetList {
+		for _, mp := range t.MapPointMatches() {
+			if mp == nil || mp.IsBad() || seen[mp] {
+				continue
+			}
+			seen[mp] = true
+			candidates = append(candidates, mp)
+		}
+	}
+	matcher.Fuse(kf, candidates, 3)
+
+	for _, mp := range kf.MapPointMatches() {
+		if mp == nil || mp.IsBad() {
+			continue
+		}
+		mp.ComputeDistinctiveDescriptors()
+		mp.UpdateNormalAndDepth()
+	}
+	kf.UpdateConnections()
+}
@@ -0,0 +1,195 @@
+package mapping
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kegsay/gorbslam/internal/geom"
+	"github.com/kegsay/gorbslam/internal/tracking"
+	"github.com/kegsay/gorbslam/internal/world"
+	"github.com/kegsay/gorbslam/internal/worldtest"
+)
+
+var _ tracking.LocalMapper = (*LocalMapping)(nil)
+
+// newTestScene creates n points between 3 and 6 units in front of the origin, spread across a
+// width x height area of the image plane at that depth.
+func newTestScene(rng *rand.Rand, n int, width, height float64) *worldtest.Scene {
+	s := worldtest.NewScene(rng)
+	for i := 0; i < n; i++ {
+		x, y, z := (rng.Float64()-0.5)*width, (rng.Float64()-0.5)*height, 3+rng.Float64()*3
+		s.Add(geom.Vec3{x * z / 4, y * z / 4, z})
+	}
+	return s
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestStopAndRelease(t *testing.T) {
+	l := NewLocalMapping(world.NewMap(), nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		l.Run(ctx)
+		close(done)
+	}()
+
+	// the tracker can hold off a stop while it creates a keyframe
+	if !l.SetNotStop(true) {
+		t.Fatalf("SetNotStop failed before stopping")
+	}
+	l.RequestStop()
+	time.Sleep(10 * time.Millisecond)
+	if l.IsStopped() {
+		t.Fatalf("stopped while SetNotStop was set")
+	}
+	l.SetNotStop(false)
+	waitFor(t, "stop", l.IsStopped)
+	if l.SetNotStop(true) {
+		t.Errorf("SetNotStop succeeded after stopping")
+	}
+	if !l.StopRequested() {
+		t.Errorf("StopRequested returned false while stopped")
+	}
+
+	// resetting while stopped doesn't deadlock
+	l.RequestReset()
+
+	l.Release()
+	waitFor(t, "release", func() bool { return !l.IsStopped() })
+	if l.StopRequested() {
+		t.Errorf("StopRequested returned true after Release")
+	}
+	l.RequestReset()
+
+	cancel()
+	<-done
+	// and neither does resetting once finished
+	l.RequestReset()
+}
+
+// Loop closing stopping and releasing local mapping while the tracker uses it doesn't deadlock
+func TestConcurrentControl(t *testing.T) {
+	l := NewLocalMapping(world.NewMap(), nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		l.Run(ctx)
+		close(done)
+	}()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			l.RequestStop()
+			for !l.IsStopped() {
+				time.Sleep(10 * time.Microsecond)
+			}
+			l.Release()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			if l.SetNotStop(true) {
+				l.AcceptKeyFrames()
+				l.SetNotStop(false)
+			}
+			l.InterruptBA()
+			l.RequestReset()
+		}
+	}()
+	wg.Wait()
+	cancel()
+	<-done
+}
+
+// The true camera pose Tcw of frame i: moving sideways while turning back and forth
+func truePose(i int) geom.SE3 {
+	x := float64(i)
+	twc := geom.SE3{
+		R: geom.ExpSO3(geom.Vec3{0, 0.1 * math.Sin(x/15), 0}),
+		T: geom.Vec3{0.03 * x, 0.1 * math.Sin(x/10), 0},
+	}
+	return twc.Inverse()
+}
+
+// Tracking with local mapping running alongside follows the camera well beyond the initial map,
+// which tracking alone could not.
+func TestTrackingWithLocalMapping(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping in short mode")
+	}
+	rng := rand.New(rand.NewSource(1))
+	// wide enough for the camera to keep seeing points as it moves
+	scene := newTestScene(rng, 2000, 8, 3)
+	voc := worldtest.FlatVocabulary(rng, 16)
+	m := world.NewMap()
+	mapper := NewLocalMapping(m, voc)
+	tracker := tracking.NewTracker(voc, m, mapper, 30)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		mapper.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	const numFrames = 60
+	var results []tracking.Result
+	for i := 0; i < numFrames; i++ {
+		f := scene.Frame(truePose(i), 0.3)
+		results = append(results, tracker.Track(f))
+		// give local mapping time to keep up, as a real camera would
+		waitFor(t, "local mapping", func() bool { return mapper.KeyFramesInQueue() == 0 })
+	}
+
+	initialised := -1
+	for i, res := range results {
+		if res.State == tracking.OK {
+			initialised = i
+			break
+		}
+	}
+	if initialised < 0 {
+		t.Fatalf("never initialised")
+	}
+	for i := initialised; i < numFrames; i++ {
+		if results[i].State != tracking.OK {
+			t.Fatalf("frame %d: got state %v want OK", i, results[i].State)
+		}
+	}
+	if m.NumKeyFrames() < 5 {
+		t.Errorf("only %d keyframes", m.NumKeyFrames())
+	}
+
+	// compare up to scale, which drifts slowly with monocular SLAM
+	last := numFrames - 1
+	scale := truePose(last).Center().Sub(truePose(initialised).Center()).Norm() /
+		results[last].Pose.Center().Sub(results[initialised].Pose.Center()).Norm()
+	for i := initialised; i < numFrames; i++ {
+		got := results[i].Pose.Center().Scale(scale)
+		want := truePose(i).Center()
+		if d := got.Sub(want).Norm(); d > 0.1*want.Norm()+0.02 {
+			t.Errorf("frame %d: camera centre %v want %v", i, got, want)
+		}
+	}
+}
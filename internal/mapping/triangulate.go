@@ -0,0 +1,55 @@
+package mapping
+
+import (
+	"github.com/kegsay/gorbslam/internal/matching"
+	"github.com/kegsay/gorbslam/internal/world"
+)
+
+const (
+	// new points are triangulated with this many of the best covisible keyframes
+	triangulationNeighbours = 20
+	// the minimum baseline between two keyframes, relative to the scene depth
+	minBaselineRatio = 0.01
+)
+
+// createNewMapPoints triangulates new map points from matches between the unmatched keypoints of
+// the current keyframe and its neighbours.
+func (l *LocalMapping) createNewMapPoints() {
+	kf1 := l.current
+	neighbours := kf1.BestCovisibilityKeyFrames(triangulationNeighbours)
+	matcher := matching.NewMatcher(0.6, false)
+
+	pose1 := kf1.Pose()
+	c1 := pose1.Center()
+
+	for i, kf2 := range neighbours {
+		// give up and let the next keyframe be processed
+		if i > 0 && l.hasNewKeyFrames() {
+			return
+		}
+		pose2 := kf2.Pose()
+		baseline := pose2.Center().Sub(c1).Norm()
+		medianDepth := kf2.ComputeSceneMedianDepth(2)
+		if medianDepth <= 0 || baseline/medianDepth < minBaselineRatio {
+			continue
+		}
+		pairs := matcher.SearchForTriangulation(kf1, kf2, world.Fundamental12(kf1.Features, kf2.Features, pose1, pose2))
+
+		for _, pair := range pairs {
+			idx1, idx2 := pair[0], pair[1]
+			x, ok := world.TriangulateMatch(kf1.Features, pose1, idx1, kf2.Features, pose2, idx2)
+			if !ok {
+				continue
+			}
+			mp := world.NewMapPoint(x, kf1, l.m)
+			mp.AddObservation(kf1, idx1)
+			mp.AddObservation(kf2, idx2)
+			kf1.AddMapPoint(mp, idx1)
+			kf2.AddMapPoint(mp, idx2)
+			mp.ComputeDistinctiveDescriptors()
+			mp.UpdateNormalAndDepth()
+			l.m.AddMapPoint(mp)
+			l.recentPoints = append(l.recentPoints, mp)
+		}
+	}
+}
@@ -0,0 +1,633 @@
+// Package matching finds correspondences between the ORB descriptors of frames, keyframes and map
+// points. It mirrors the ORB-SLAM2 ORBmatcher: every search restricts the candidates (by predicted
+// position, vocabulary node or epipolar line) before comparing descriptors, which is both faster
+// and more robust than matching everything against everything.
+package matching
+
+import (
+	"math"
+
+	"github.com/kegsay/gorbslam/internal/bow"
+	"github.com/kegsay/gorbslam/internal/feature"
+	"github.com/kegsay/gorbslam/internal/geom"
+	"github.com/kegsay/gorbslam/internal/world"
+)
+
+const (
+	thHigh = feature.DistanceHigh
+	thLow  = feature.DistanceLow
+	// the number of bins in the rotation consistency histogram
+	histoLength = 30
+)
+
+// Matcher finds descriptor matches.
+type Matcher struct {
+	// A match is only accepted if its distance is less than NNRatio times the distance of the
+	// second best candidate. 1 disables the test.
+	NNRatio float64
+	// Discard matches whose change in keypoint orientation disagrees with the majority
+	CheckOrientation bool
+}
+
+// NewMatcher creates a matcher with the nearest neighbour ratio and orientation check
+func NewMatcher(nnRatio float64, checkOrientation bool) *Matcher {
+	return &Matcher{NNRatio: nnRatio, CheckOrientation: checkOrientation}
+}
+
+// rotationHistogram groups matches by the change in keypoint orientation between the two images.
+// All correct matches should rotate by roughly the same amount, so matches outside the three most
+// common bins are probably wrong.
+type rotationHistogram struct {
+	bins [histoLength][]int
+}
+
+func (h *rotationHistogram) add(angle1, angle2 float64, idx int) {
+	rot := angle1 - angle2
+	if rot < 0 {
+		rot += 360
+	}
+	bin := int(math.Round(rot*histoLength/360)) % histoLength
+	h.bins[bin] = append(h.bins[bin], idx)
+}
+
+// outliers returns the indexes of the matches outside the three largest bins. The second and third
+// bins are only kept if they have at least a tenth of the matches of the largest.
+func (h *rotationHistogram) outliers() []int {
+	max1, max2, max3 := -1, -1, -1
+	for i := range h.bins {
+		n := len(h.bins[i])
+		switch {
+		case max1 < 0 || n > len(h.bins[max1]):
+			max1, max2, max3 = i, max1, max2
+		case max2 < 0 || n > len(h.bins[max2]):
+			max2, max3 = i, max2
+		case max3 < 0 || n > len(h.bins[max3]):
+			max3 = i
+		}
+	}
+	n1 := float64(len(h.bins[max1]))
+	if float64(len(h.bins[max2])) < 0.1*n1 {
+		max2, max3 = -1, -1
+	} else if float64(len(h.bins[max3])) < 0.1*n1 {
+		max3 = -1
+	}
+	var out []int
+	for i := range h.bins {
+		if i == max1 || i == max2 || i == max3 {
+			continue
+		}
+		out = append(out, h.bins[i]...)
+	}
+	return out
+}
+
+// radiusByViewingCos returns the search window for a map point: points seen from close to their
+// mean viewing direction are predicted more accurately.
+func radiusByViewingCos(viewCos float64) float64 {
+	if viewCos > 0.998 {
+		return 2.5
+	}
+	return 4.0
+}
+
+// SearchByProjection matches the local map points to the frame by projecting each point into the
+// frame and searching around the projection. projections[i] is where points[i] is expected to
+// appear, from Frame.IsInFrustum. A larger th widens the search, e.g after relocalisation. Keypoints
+// already matched to a map point with observations are skipped. Returns the number of new matches.
+func (m *Matcher) SearchByProjection(f *world.Frame, points []*world.MapPoint, projections []world.Projection, th float64) int {
+	n := 0
+	for i, mp := range points {
+		if mp.IsBad() {
+			continue
+		}
+		proj := projections[i]
+		r := radiusByViewingCos(proj.ViewCos) * th * f.Pyramid.ScaleFactors[proj.Level]
+		indices := f.FeaturesInArea(proj.U, proj.V, r, proj.Level-1, proj.Level)
+		if len(indices) == 0 {
+			continue
+		}
+		d := mp.Descriptor()
+		bestDist, bestDist2 := 256, 256
+		bestLevel, bestLevel2 := -1, -1
+		bestIdx := -1
+		for _, idx := range indices {
+			if existing := f.MapPoints[idx]; existing != nil && existing.NumObservations() > 0 {
+				continue
+			}
+			dist := d.Distance(&f.Descriptors[idx])
+			level := f.KeyPoints[idx].Octave
+			if dist < bestDist {
+				bestDist2, bestLevel2 = bestDist, bestLevel
+				bestDist, bestLevel, bestIdx = dist, level, idx
+			} else if dist < bestDist2 {
+				bestDist2, bestLevel2 = dist, level
+			}
+		}
+		if bestDist > thHigh {
+			continue
+		}
+		// if the two best are on the same level the ratio test applies
+		if bestLevel == bestLevel2 && float64(bestDist) > m.NNRatio*float64(bestDist2) {
+			continue
+		}
+		f.MapPoints[bestIdx] = mp
+		n++
+	}
+	return n
+}
+
+// SearchByProjectionLastFrame matches the map points tracked in the last frame to the current
+// frame, by projecting them with the current (predicted) pose and searching within th pixels
+// (scaled by the keypoint octave). Returns the number of matches.
+func (m *Matcher) SearchByProjectionLastFrame(current, last *world.Frame, th float64) int {
+	n := 0
+	var hist rotationHistogram
+	for i, mp := range last.MapPoints {
+		if mp == nil || last.Outliers[i] {
+			continue
+		}
+		pc := current.Pose.Transform(mp.Position())
+		if pc[2] <= 0 {
+			continue
+		}
+		u, v := current.Camera.Project(pc)
+		if !current.IsInImage(u, v) {
+			continue
+		}
+		lastOctave := last.KeyPoints[i].Octave
+		r := th * current.Pyramid.ScaleFactors[lastOctave]
+		indices := current.FeaturesInArea(u, v, r, lastOctave-1, lastOctave+1)
+		if len(indices) == 0 {
+			continue
+		}
+		d := mp.Descriptor()
+		bestDist, bestIdx := 256, -1
+		for _, idx := range indices {
+			if existing := current.MapPoints[idx]; existing != nil && existing.NumObservations() > 0 {
+				continue
+			}
+			if dist := d.Distance(&current.Descriptors[idx]); dist < bestDist {
+				bestDist, bestIdx = dist, idx
+			}
+		}
+		if bestDist > thHigh {
+			continue
+		}
+		current.MapPoints[bestIdx] = mp
+		n++
+		if m.CheckOrientation {
+			hist.add(last.KeyPoints[i].Angle, current.KeyPoints[bestIdx].Angle, bestIdx)
+		}
+	}
+	if m.CheckOrientation {
+		for _, idx := range hist.outliers() {
+			current.MapPoints[idx] = nil
+			n--
+		}
+	}
+	return n
+}
+
+// SearchByProjectionKeyFrame matches the map points of the keyframe to the frame by projecting
+// them with the frame's pose, searching within th pixels (scaled by the predicted octave). Used by
+// relocalisation to find more matches once a pose is known. Points in found are skipped, as are
+// keypoints already matched, and a match must be at most maxDist from the point's descriptor.
+// Returns the number of new matches.
+func (m *Matcher) SearchByProjectionKeyFrame(f *world.Frame, kf *world.KeyFrame, found map[*world.MapPoint]bool, th float64, maxDist int) int {
+	n := 0
+	var hist rotationHistogram
+	center := f.CameraCenter()
+	for i, mp := range kf.MapPointMatches() {
+		if mp == nil || mp.IsBad() || found[mp] {
+			continue
+		}
+		pos := mp.Position()
+		pc := f.Pose.Transform(pos)
+		if pc[2] <= 0 {
+			continue
+		}
+		u, v := f.Camera.Project(pc)
+		if !f.IsInImage(u, v) {
+			continue
+		}
+		dist := pos.Sub(center).Norm()
+		if dist < mp.MinDistanceInvariance() || dist > mp.MaxDistanceInvariance() {
+			continue
+		}
+		level := mp.PredictScale(dist, f.Pyramid)
+		r := th * f.Pyramid.ScaleFactors[level]
+		indices := f.FeaturesInArea(u, v, r, level-1, level+1)
+		if len(indices) == 0 {
+			continue
+		}
+		d := mp.Descriptor()
+		bestDist, bestIdx := 256, -1
+		for _, idx := range indices {
+			if f.MapPoints[idx] != nil {
+				continue
+			}
+			if dist := d.Distance(&f.Descriptors[idx]); dist < bestDist {
+				bestDist, bestIdx = dist, idx
+			}
+		}
+		if bestDist > maxDist {
+			continue
+		}
+		f.MapPoints[bestIdx] = mp
+		n++
+		if m.CheckOrientation {
+			hist.add(kf.KeyPoints[i].Angle, f.KeyPoints[bestIdx].Angle, bestIdx)
+		}
+	}
+	if m.CheckOrientation {
+		for _, idx := range hist.outliers() {
+			f.MapPoints[idx] = nil
+			n--
+		}
+	}
+	return n
+}
+
+// SearchByBoW matches the map points of the keyframe to the keypoints of the frame, only comparing
+// descriptors under the same vocabulary node. Both must have had their BoW computed. Returns the
+// map point matched to each keypoint of the frame (nil if none) and the number of matches.
+func (m *Matcher) SearchByBoW(kf *world.KeyFrame, f *world.Frame) ([]*world.MapPoint, int) {
+	matches := make([]*world.MapPoint, len(f.KeyPoints))
+	kfPoints := kf.MapPointMatches()
+	kfFV := kf.FeatureVector()
+	fFV := f.FeatureVector
+	n := 0
+	var hist rotationHistogram
+
+	i, j := 0, 0
+	for i < len(kfFV.NodeIDs) && j < len(fFV.NodeIDs) {
+		if kfFV.NodeIDs[i] < fFV.NodeIDs[j] {
+			i++
+			continue
+		}
+		if kfFV.NodeIDs[i] > fFV.NodeIDs[j] {
+			j++
+			continue
+		}
+		for _, idxKF := range kfFV.Features[i] {
+			mp := kfPoints[idxKF]
+			if mp == nil || mp.IsBad() {
+				continue
+			}
+			d := &kf.Descriptors[idxKF]
+			bestDist1, bestDist2 := 256, 256
+			bestIdxF := -1
+			for _, idxF := range fFV.Features[j] {
+				if matches[idxF] != nil {
+					continue
+				}
+				dist := d.Distance(&f.Descriptors[idxF])
+				if dist < bestDist1 {
+					bestDist2 = bestDist1
+					bestDist1, bestIdxF = dist, idxF
+				} else if dist < bestDist2 {
+					bestDist2 = dist
+				}
+			}
+			if bestDist1 > thLow || float64(bestDist1) >= m.NNRatio*float64(bestDist2) {
+				continue
+			}
+			matches[bestIdxF] = mp
+			n++
+			if m.CheckOrientation {
+				hist.add(kf.KeyPoints[idxKF].Angle, f.KeyPoints[bestIdxF].Angle, bestIdxF)
+			}
+		}
+		i++
+		j++
+	}
+	if m.CheckOrientation {
+		for _, idx := range hist.outliers() {
+			matches[idx] = nil
+			n--
+		}
+	}
+	return matches, n
+}
+
+// SearchByBoWKeyFrames matches the map points of kf1 to the map points of kf2, only comparing
+// descriptors under the same vocabulary node. Used to find the map points two keyframes closing a
+// loop have in common. Returns the map point of kf2 matched to each keypoint of kf1 (nil if none)
+// and the number of matches.
+func (m *Matcher) SearchByBoWKeyFrames(kf1, kf2 *world.KeyFrame) ([]*world.MapPoint, int) {
+	matches12 := make([]*world.MapPoint, len(kf1.KeyPoints))
+	points1, points2 := kf1.MapPointMatches(), kf2.MapPointMatches()
+	fv1, fv2 := kf1.FeatureVector(), kf2.FeatureVector()
+	matched2 := make([]bool, len(kf2.KeyPoints))
+	n := 0
+	var hist rotationHistogram
+
+	i, j := 0, 0
+	for i < len(fv1.NodeIDs) && j < len(fv2.NodeIDs) {
+		if fv1.NodeIDs[i] < fv2.NodeIDs[j] {
+			i++
+			continue
+		}
+		if fv1.NodeIDs[i] > fv2.NodeIDs[j] {
+			j++
+			continue
+		}
+		for _, idx1 := range fv1.Features[i] {
+			mp1 := points1[idx1]
+			if mp1 == nil || mp1.IsBad() {
+				continue
+			}
+			d1 := &kf1.Descriptors[idx1]
+			bestDist1, bestDist2 := 256, 256
+			bestIdx2 := -1
+			for _, idx2 := range fv2.Features[j] {
+				mp2 := points2[idx2]
+				if matched2[idx2] || mp2 == nil || mp2.IsBad() {
+					continue
+				}
+				dist := d1.Distance(&kf2.Descriptors[idx2])
+				if dist < bestDist1 {
+					bestDist2 = bestDist1
+					bestDist1, bestIdx2 = dist, idx2
+				} else if dist < bestDist2 {
+					bestDist2 = dist
+				}
+			}
+			if bestDist1 >= thLow || float64(bestDist1) >= m.NNRatio*float64(bestDist2) {
+				continue
+			}
+			matches12[idx1] = points2[bestIdx2]
+			matched2[bestIdx2] = true
+			n++
+			if m.CheckOrientation {
+				hist.add(kf1.KeyPoints[idx1].Angle, kf2.KeyPoints[bestIdx2].Angle, idx1)
+			}
+		}
+		i++
+		j++
+	}
+	if m.CheckOrientation {
+		for _, idx1 := range hist.outliers() {
+			matches12[idx1] = nil
+			n--
+		}
+	}
+	return matches12, n
+}
+
+// SearchForInitialization matches the finest level keypoints of f1 to f2, searching within
+// windowSize pixels of prevMatched[i], the position keypoint i was last matched at (initially its
+// own position). Used to initialise a monocular map before there are any map points. Returns the
+// index of the keypoint in f2 matched to each keypoint in f1 (-1 if none) and the number of
+// matches, and updates prevMatched with the new positions.
+func (m *Matcher) SearchForInitialization(f1, f2 *world.Frame, prevMatched [][2]float64, windowSize float64) ([]int, int) {
+	matches12 := make([]int, len(f1.KeyPoints))
+	for i := range matches12 {
+		matches12[i] = -1
+	}
+	matches21 := make([]int, len(f2.KeyPoints))
+	matchedDistance := make([]int, len(f2.KeyPoints))
+	for i := range matches21 {
+		matches21[i] = -1
+		matchedDistance[i] = math.MaxInt32
+	}
+	n := 0
+	var hist rotationHistogram
+
+	for i1 := range f1.KeyPoints {
+		kp1 := &f1.KeyPoints[i1]
+		if kp1.Octave > 0 {
+			continue
+		}
+		indices := f2.FeaturesInArea(prevMatched[i1][0], prevMatched[i1][1], windowSize, kp1.Octave, kp1.Octave)
+		if len(indices) == 0 {
+			continue
+		}
+		d1 := &f1.Descriptors[i1]
+		bestDist, bestDist2 := math.MaxInt32, math.MaxInt32
+		bestIdx2 := -1
+		for _, i2 := range indices {
+			dist := d1.Distance(&f2.Descriptors[i2])
+			// keypoints already matched more closely are taken
+			if matchedDistance[i2] <= dist {
+				continue
+			}
+			if dist < bestDist {
+				bestDist2 = bestDist
+				bestDist, bestIdx2 = dist, i2
+			} else if dist < bestDist2 {
+				bestDist2 = dist
+			}
+		}
+		if bestDist > thLow || float64(bestDist) >= m.NNRatio*float64(bestDist2) {
+			continue
+		}
+		// steal the keypoint from a worse match
+		if prev := matches21[bestIdx2]; prev >= 0 {
+			matches12[prev] = -1
+			n--
+		}
+		matches12[i1] = bestIdx2
+		matches21[bestIdx2] = i1
+		matchedDistance[bestIdx2] = bestDist
+		n++
+		if m.CheckOrientation {
+			hist.add(kp1.Angle, f2.KeyPoints[bestIdx2].Angle, i1)
+		}
+	}
+	if m.CheckOrientation {
+		for _, i1 := range hist.outliers() {
+			if matches12[i1] >= 0 {
+				matches12[i1] = -1
+				n--
+			}
+		}
+	}
+	for i1, i2 := range matches12 {
+		if i2 >= 0 {
+			prevMatched[i1] = [2]float64{f2.KeyPoints[i2].X, f2.KeyPoints[i2].Y}
+		}
+	}
+	return matches12, n
+}
+
+// SearchForTriangulation matches the keypoints of kf1 and kf2 which don't observe map points yet,
+// so that new points can be triangulated from them. f12 is the fundamental matrix from kf2 to kf1
+// (x1' F12 x2 = 0): a match must lie close to the epipolar line of its partner, and away from the
+// epipole where the line gives no constraint. Only descriptors under the same vocabulary node are
+// compared. Returns the pairs of keypoint indexes (in kf1, in kf2).
+func (m *Matcher) SearchForTriangulation(kf1, kf2 *world.KeyFrame, f12 geom.Mat3) [][2]int {
+	// the first camera centre projected into the second image
+	c1 := kf2.Pose().Transform(kf1.CameraCenter())
+	ex, ey := kf2.Camera.Project(c1)
+	return m.searchForTriangulation(kf1.Features, kf2.Features, kf1.FeatureVector(), kf2.FeatureVector(),
+		kf1.MapPointMatches(), kf2.MapPointMatches(), ex, ey, f12)
+}
+
+// SearchForTriangulationFrame is SearchForTriangulation between a keyframe and a frame with a
+// pose. Keypoints of the frame matched to any point are skipped.
+func (m *Matcher) SearchForTriangulationFrame(kf *world.KeyFrame, f *world.Frame, f12 geom.Mat3) [][2]int {
+	c1 := f.Pose.Transform(kf.CameraCenter())
+	ex, ey := f.Camera.Project(c1)
+	return m.searchForTriangulation(kf.Features, f.Features, kf.FeatureVector(), f.FeatureVector,
+		kf.MapPointMatches(), f.MapPoints, ex, ey, f12)
+}
+
+// searchForTriangulation matches the keypoints of f1 and f2 which have no point, given the
+// epipole (ex, ey) in the second image.
+func (m *Matcher) searchForTriangulation(f1, f2 *world.Features, fv1, fv2 bow.FeatureVector, points1, points2 []*world.MapPoint, ex, ey float64, f12 geom.Mat3) [][2]int {
+	matched2 := make([]bool, len(f2.KeyPoints))
+	matches12 := make([]int, len(f1.KeyPoints))
+	for i := range matches12 {
+		matches12[i] = -1
+	}
+	var hist rotationHistogram
+
+	i, j := 0, 0
+	for i < len(fv1.NodeIDs) && j < len(fv2.NodeIDs) {
+		if fv1.NodeIDs[i] < fv2.NodeIDs[j] {
+			i++
+			continue
+		}
+		if fv1.NodeIDs[i] > fv2.NodeIDs[j] {
+			j++
+			continue
+		}
+		for _, idx1 := range fv1.Features[i] {
+			if points1[idx1] != nil {
+				continue
+			}
+			kp1 := &f1.KeyPoints[idx1]
+			d1 := &f1.Descriptors[idx1]
+			bestDist, bestIdx2 := thLow, -1
+			for _, idx2 := range fv2.Features[j] {
+				if matched2[idx2] || points2[idx2] != nil {
+					continue
+				}
+				dist := d1.Distance(&f2.Descriptors[idx2])
+				if dist > thLow || dist > bestDist {
+					continue
+				}
+				kp2 := &f2.KeyPoints[idx2]
+				// too close to the epipole: the point could be anywhere along the line
+				dx, dy := ex-kp2.X, ey-kp2.Y
+				if dx*dx+dy*dy < 100*f2.Pyramid.ScaleFactors[kp2.Octave] {
+					continue
+				}
+				if checkDistEpipolarLine(kp1, kp2, f12, f2.Pyramid.Sigma2[kp2.Octave]) {
+					bestDist, bestIdx2 = dist, idx2
+				}
+			}
+			if bestIdx2 < 0 {
+				continue
+			}
+			matched2[bestIdx2] = true
+			matches12[idx1] = bestIdx2
+			if m.CheckOrientation {
+				hist.add(kp1.Angle, f2.KeyPoints[bestIdx2].Angle, idx1)
+			}
+		}
+		i++
+		j++
+	}
+	if m.CheckOrientation {
+		for _, idx1 := range hist.outliers() {
+			matches12[idx1] = -1
+		}
+	}
+	var pairs [][2]int
+	for idx1, idx2 := range matches12 {
+		if idx2 >= 0 {
+			pairs = append(pairs, [2]int{idx1, idx2})
+		}
+	}
+	return pairs
+}
+
+// checkDistEpipolarLine returns true if kp2 is within the 1 DoF chi-squared threshold of the
+// epipolar line of kp1 in the second image.
+func checkDistEpipolarLine(kp1, kp2 *feature.KeyPoint, f12 geom.Mat3, sigma2 float64) bool {
+	// l2 = x1' F12
+	a := kp1.X*f12[0][0] + kp1.Y*f12[1][0] + f12[2][0]
+	b := kp1.X*f12[0][1] + kp1.Y*f12[1][1] + f12[2][1]
+	c := kp1.X*f12[0][2] + kp1.Y*f12[1][2] + f12[2][2]
+	num := a*kp2.X + b*kp2.Y + c
+	den := a*a + b*b
+	if den == 0 {
+		return false
+	}
+	return num*num/den < 3.84*sigma2
+}
+
+// Fuse projects the map points into the keyframe and searches for a keypoint matching each within
+// th pixels (scaled by the predicted octave). If the keypoint already observes a map point the
+// two are duplicates and the one with fewer observations is replaced by the other, otherwise the
+// keypoint becomes an observation of the point. Returns the number of points fused or added.
+func (m *Matcher) Fuse(kf *world.KeyFrame, points []*world.MapPoint, th float64) int {
+	pose := kf.Pose()
+	center := pose.Center()
+	n := 0
+	for _, mp := range points {
+		if mp == nil || mp.IsBad() || mp.IsInKeyFrame(kf) {
+			continue
+		}
+		pw := mp.Position()
+		pc := pose.Transform(pw)
+		if pc[2] <= 0 {
+			continue
+		}
+		u, v := kf.Camera.Project(pc)
+		if !kf.IsInImage(u, v) {
+			continue
+		}
+		po := pw.Sub(center)
+		dist := po.Norm()
+		if dist < mp.MinDistanceInvariance() || dist > mp.MaxDistanceInvariance() {
+			continue
+		}
+		// seen from too different an angle to the other observations
+		if po.Dot(mp.Normal()) < 0.5*dist {
+			continue
+		}
+		level := mp.PredictScale(dist, kf.Pyramid)
+		r := th * kf.Pyramid.ScaleFactors[level]
+		indices := kf.FeaturesInArea(u, v, r, -1, -1)
+		if len(indices) == 0 {
+			continue
+		}
+
+		d := mp.Descriptor()
+		bestDist, bestIdx := 256, -1
+		for _, idx := range indices {
+			kp := &kf.KeyPoints[idx]
+			if kp.Octave < level-1 || kp.Octave > level {
+				continue
+			}
+			// the keypoint must agree with the projection
+			ex, ey := u-kp.X, v-kp.Y
+			if (ex*ex+ey*ey)*kf.Pyramid.InvSigma2[kp.Octave] > 5.99 {
+				continue
+			}
+			if dist := d.Distance(&kf.Descriptors[idx]); dist < bestDist {
+				bestDist, bestIdx = dist, idx
+			}
+		}
+		if bestDist > thLow {
+			continue
+		}
+		if existing := kf.MapPoint(bestIdx); existing != nil {
+			if !existing.IsBad() {
+				if existing.NumObservations() > mp.NumObservations() {
+					mp.Replace(existing)
+				} else {
+					existing.Replace(mp)
+				}
+			}
+		} else {
+			mp.AddObservation(kf, bestIdx)
+			kf.AddMapPoint(mp, bestIdx)
+		}
+		n++
+	}
+	return n
+}
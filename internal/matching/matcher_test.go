@@ -0,0 +1,326 @@
+package matching
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/kegsay/gorbslam/internal/feature"
+	"github.com/kegsay/gorbslam/internal/geom"
+	"github.com/kegsay/gorbslam/internal/world"
+	"github.com/kegsay/gorbslam/internal/worldtest"
+)
+
+// A scene of random points in front of the origin, each with a random descriptor
+type testScene struct {
+	points      []geom.Vec3
+	descriptors []feature.Descriptor
+}
+
+func newTestScene(rng *rand.Rand, n int) *testScene {
+	s := &testScene{}
+	for i := 0; i < n; i++ {
+		u, v := 20+rng.Float64()*600, 20+rng.Float64()*440
+		s.points = append(s.points, worldtest.Camera.Unproject(u, v).Scale(2+rng.Float64()*3))
+		s.descriptors = append(s.descriptors, worldtest.RandomDescriptor(rng))
+	}
+	return s
+}
+
+// frame projects the scene into a camera at tcw, keeping the keypoint order of the scene.
+func (s *testScene) frame(tcw geom.SE3, angle float64) *world.Frame {
+	var kps []feature.KeyPoint
+	var descs []feature.Descriptor
+	for i, p := range s.points {
+		u, v := worldtest.Camera.Project(tcw.Transform(p))
+		kps = append(kps, feature.KeyPoint{X: u, Y: v, Angle: angle})
+		descs = append(descs, s.descriptors[i])
+	}
+	f := world.NewFrame(world.NewFeatures(worldtest.Camera, worldtest.Pyramid, kps, descs, 640, 480), time.Time{})
+	f.SetPose(tcw)
+	return f
+}
+
+// mapPoints creates a keyframe from f observing every point of the scene
+func (s *testScene) mapPoints(f *world.Frame) []*world.MapPoint {
+	m := world.NewMap()
+	kf := world.NewKeyFrame(f, m)
+	m.AddKeyFrame(kf)
+	var mps []*world.MapPoint
+	for i, p := range s.points {
+		mp := world.NewMapPoint(p, kf, m)
+		mp.AddObservation(kf, i)
+		kf.AddMapPoint(mp, i)
+		mp.ComputeDistinctiveDescriptors()
+		mp.UpdateNormalAndDepth()
+		m.AddMapPoint(mp)
+		f.MapPoints[i] = mp
+		mps = append(mps, mp)
+	}
+	return mps
+}
+
+func TestRotationHistogram(t *testing.T) {
+	var h rotationHistogram
+	// 20 matches rotated by 10 degrees, 5 by 45 and 3 by 180
+	for i := 0; i < 20; i++ {
+		h.add(15, 5, i)
+	}
+	for i := 20; i < 25; i++ {
+		h.add(0, 315, i)
+	}
+	for i := 25; i < 28; i++ {
+		h.add(190, 10, i)
+	}
+	got := h.outliers()
+	if len(got) != 0 {
+		// the three largest bins are kept
+		t.Fatalf("expected no outliers, got %v", got)
+	}
+	for i := 28; i < 48; i++ {
+		h.add(100, 0, i)
+	}
+	got = h.outliers()
+	if len(got) != 3 || got[0] != 25 {
+		t.Fatalf("expected the 180 degree matches to be outliers, got %v", got)
+	}
+}
+
+func TestRotationHistogramSmallBins(t *testing.T) {
+	var h rotationHistogram
+	for i := 0; i < 100; i++ {
+		h.add(0, 0, i)
+	}
+	// bins with less than a tenth of the largest are dropped even if they're in the top 3
+	h.add(90, 0, 100)
+	got := h.outliers()
+	if len(got) != 1 || got[0] != 100 {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func TestSearchByProjectionLastFrame(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	s := newTestScene(rng, 200)
+	last := s.frame(geom.IdentitySE3(), 0)
+	mps := s.mapPoints(last)
+	current := s.frame(geom.SE3{R: geom.ExpSO3(geom.Vec3{0, 0.02, 0}), T: geom.Vec3{-0.05, 0, 0}}, 0)
+
+	n := NewMatcher(0.9, true).SearchByProjectionLastFrame(current, last, 7)
+	if n < 190 {
+		t.Fatalf("matched %d of 200", n)
+	}
+	for i, mp := range current.MapPoints {
+		if mp != nil && mp != mps[i] {
+			t.Errorf("keypoint %d matched to point %d", i, mp.ID)
+		}
+	}
+}
+
+func TestSearchByProjection(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	s := newTestScene(rng, 200)
+	mps := s.mapPoints(s.frame(geom.IdentitySE3(), 0))
+	current := s.frame(geom.SE3{R: geom.ExpSO3(geom.Vec3{0.01, 0, 0}), T: geom.Vec3{0, 0.05, 0}}, 0)
+
+	var points []*world.MapPoint
+	var projections []world.Projection
+	for _, mp := range mps {
+		if proj, ok := current.IsInFrustum(mp, 0.5); ok {
+			points = append(points, mp)
+			projections = append(projections, proj)
+		}
+	}
+	n := NewMatcher(0.8, true).SearchByProjection(current, points, projections, 1)
+	if n < len(points)*9/10 {
+		t.Fatalf("matched %d of %d", n, len(points))
+	}
+	for i, mp := range current.MapPoints {
+		if mp != nil && mp != mps[i] {
+			t.Errorf("keypoint %d matched to point %d", i, mp.ID)
+		}
+	}
+}
+
+func TestSearchByProjectionKeyFrame(t *testing.T) {
+	rng := rand.New(rand.NewSource(10))
+	s := newTestScene(rng, 200)
+	mps := s.mapPoints(s.frame(geom.IdentitySE3(), 0))
+	kf := mps[0].ReferenceKeyFrame()
+	current := s.frame(geom.SE3{R: geom.ExpSO3(geom.Vec3{0, 0.01, 0}), T: geom.Vec3{0.05, 0, 0}}, 0)
+	// keypoint 0 is already matched and point 1 was already found
+	current.MapPoints[0] = mps[0]
+	found := map[*world.MapPoint]bool{mps[0]: true, mps[1]: true}
+
+	n := NewMatcher(0.9, true).SearchByProjectionKeyFrame(current, kf, found, 10, 100)
+	if n < 180 {
+		t.Fatalf("matched %d of 198", n)
+	}
+	if current.MapPoints[1] != nil {
+		t.Errorf("found point was matched again")
+	}
+	for i, mp := range current.MapPoints {
+		if mp != nil && mp != mps[i] {
+			t.Errorf("keypoint %d matched to point %d", i, mp.ID)
+		}
+	}
+}
+
+func TestSearchForInitialization(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	s := newTestScene(rng, 200)
+	f1 := s.frame(geom.IdentitySE3(), 30)
+	// every keypoint rotates by 10 degrees, apart from one which rotates by 90
+	f2 := s.frame(geom.SE3{R: geom.ExpSO3(geom.Vec3{}), T: geom.Vec3{-0.1, 0, 0}}, 20)
+	f2.KeyPoints[7].Angle = 300
+
+	prevMatched := make([][2]float64, len(f1.KeyPoints))
+	for i, kp := range f1.KeyPoints {
+		prevMatched[i] = [2]float64{kp.X, kp.Y}
+	}
+	matches, n := NewMatcher(0.9, true).SearchForInitialization(f1, f2, prevMatched, 100)
+	if n != len(f1.KeyPoints)-1 {
+		t.Errorf("matched %d of %d", n, len(f1.KeyPoints))
+	}
+	for i, j := range matches {
+		switch {
+		case i == 7 && j != -1:
+			t.Errorf("rotation outlier matched to %d", j)
+		case i != 7 && j != i:
+			t.Errorf("keypoint %d matched to %d", i, j)
+		}
+	}
+	if prevMatched[0][0] != f2.KeyPoints[0].X {
+		t.Errorf("prevMatched not updated")
+	}
+}
+
+func TestSearchForTriangulation(t *testing.T) {
+	rng := rand.New(rand.NewSource(4))
+	s := newTestScene(rng, 200)
+	voc := worldtest.FlatVocabulary(rng, 8)
+	m := world.NewMap()
+	pose2 := geom.SE3{R: geom.ExpSO3(geom.Vec3{0, 0.05, 0}), T: geom.Vec3{-0.3, 0, 0}}
+	kf1 := world.NewKeyFrame(s.frame(geom.IdentitySE3(), 0), m)
+	kf2 := world.NewKeyFrame(s.frame(pose2, 0), m)
+	kf1.ComputeBoW(voc)
+	kf2.ComputeBoW(voc)
+	// the first 50 keypoints of kf2 are shuffled, so the descriptors match but the positions don't
+	// agree with the epipolar geometry
+	perm := rng.Perm(50)
+	for i := 0; i < 50; i++ {
+		kf2.Descriptors[i] = s.descriptors[perm[i]]
+	}
+	// keypoints which already observe a map point are skipped
+	kf1.AddMapPoint(world.NewMapPoint(s.points[199], kf1, m), 199)
+
+	t12 := pose2.Inverse()
+	e12 := geom.Skew(t12.T).Mul(t12.R.Matrix())
+	kinv, _ := worldtest.Camera.K().Inverse()
+	f12 := kinv.T().Mul(e12).Mul(kinv)
+
+	pairs := NewMatcher(0.6, false).SearchForTriangulation(kf1, kf2, f12)
+	for _, p := range pairs {
+		if p[0] != p[1] {
+			t.Errorf("keypoint %d matched to %d", p[0], p[1])
+		}
+		if p[0] == 199 {
+			t.Errorf("matched a keypoint which already has a map point")
+		}
+	}
+	// a handful of the shuffled keypoints may be close enough to the epipolar line to be matched
+	if len(pairs) < 140 {
+		t.Errorf("got %d pairs", len(pairs))
+	}
+}
+
+func TestFuse(t *testing.T) {
+	rng := rand.New(rand.NewSource(5))
+	s := newTestScene(rng, 100)
+	f1 := s.frame(geom.IdentitySE3(), 0)
+	mps := s.mapPoints(f1)
+	m := world.NewMap()
+	kf := world.NewKeyFrame(s.frame(geom.SE3{R: geom.ExpSO3(geom.Vec3{}), T: geom.Vec3{-0.1, 0, 0}}, 0), m)
+	// keypoint 0 already observes a duplicate of point 0, with more observations
+	dup := world.NewMapPoint(s.points[0], kf, m)
+	dup.AddObservation(kf, 0)
+	kf.AddMapPoint(dup, 0)
+	other := world.NewKeyFrame(s.frame(geom.IdentitySE3(), 0), m)
+	dup.AddObservation(other, 0)
+	other.AddMapPoint(dup, 0)
+
+	n := NewMatcher(0.6, true).Fuse(kf, mps, 3)
+	if n != len(mps) {
+		t.Errorf("fused %d of %d", n, len(mps))
+	}
+	for i := 1; i < len(mps); i++ {
+		if kf.MapPoint(i) != mps[i] || !mps[i].IsInKeyFrame(kf) {
+			t.Errorf("point %d not added to the keyframe", i)
+		}
+	}
+	// the point with fewer observations is replaced
+	if !mps[0].IsBad() || mps[0].Replaced() != dup || kf.MapPoint(0) != dup {
+		t.Errorf("duplicate was not fused: bad=%v replaced=%v", mps[0].IsBad(), mps[0].Replaced())
+	}
+}
+
+func TestSearchByBoWKeyFrames(t *testing.T) {
+	rng := rand.New(rand.NewSource(9))
+	s := newTestScene(rng, 150)
+	voc := worldtest.FlatVocabulary(rng, 8)
+	mps1 := s.mapPoints(s.frame(geom.IdentitySE3(), 0))
+	// a second map of the same scene, as when closing a loop
+	mps2 := s.mapPoints(s.frame(geom.SE3{R: geom.ExpSO3(geom.Vec3{}), T: geom.Vec3{0.2, 0, 0}}, 10))
+	kf1, kf2 := mps1[0].ReferenceKeyFrame(), mps2[0].ReferenceKeyFrame()
+	kf1.ComputeBoW(voc)
+	kf2.ComputeBoW(voc)
+	// keypoint 5 of kf2 has no map point, and keypoint 6 of kf2 is rotated differently
+	kf2.EraseMapPointMatch(5)
+	kf2.KeyPoints[6].Angle = 200
+
+	matches12, n := NewMatcher(0.75, true).SearchByBoWKeyFrames(kf1, kf2)
+	if n != len(mps1)-2 {
+		t.Errorf("matched %d of %d", n, len(mps1))
+	}
+	for i, mp := range matches12 {
+		switch {
+		case (i == 5 || i == 6) && mp != nil:
+			t.Errorf("keypoint %d should not be matched", i)
+		case i != 5 && i != 6 && mp != mps2[i]:
+			t.Errorf("keypoint %d matched to the wrong point", i)
+		}
+	}
+}
+
+func TestSearchForTriangulationFrame(t *testing.T) {
+	rng := rand.New(rand.NewSource(6))
+	s := newTestScene(rng, 200)
+	voc := worldtest.FlatVocabulary(rng, 8)
+	m := world.NewMap()
+	pose2 := geom.SE3{R: geom.ExpSO3(geom.Vec3{0, 0.05, 0}), T: geom.Vec3{-0.3, 0, 0}}
+	kf := world.NewKeyFrame(s.frame(geom.IdentitySE3(), 0), m)
+	kf.ComputeBoW(voc)
+	f := s.frame(pose2, 0)
+	f.SetPose(pose2)
+	f.ComputeBoW(voc)
+	// keypoints of the frame which are already matched are skipped
+	f.MapPoints[10] = world.NewMapPoint(s.points[10], kf, m)
+
+	t12 := pose2.Inverse()
+	e12 := geom.Skew(t12.T).Mul(t12.R.Matrix())
+	kinv, _ := worldtest.Camera.K().Inverse()
+	f12 := kinv.T().Mul(e12).Mul(kinv)
+
+	pairs := NewMatcher(0.6, false).SearchForTriangulationFrame(kf, f, f12)
+	for _, p := range pairs {
+		if p[0] != p[1] {
+			t.Errorf("keypoint %d matched to %d", p[0], p[1])
+		}
+		if p[1] == 10 {
+			t.Errorf("matched a keypoint which already has a map point")
+		}
+	}
+	if len(pairs) < 190 {
+		t.Errorf("got %d pairs", len(pairs))
+	}
+}
@@ -0,0 +1,188 @@
+package matching
+
+import (
+	"github.com/kegsay/gorbslam/internal/geom"
+	"github.com/kegsay/gorbslam/internal/world"
+)
+
+// sim3Projection is where a map point transformed by a similarity is expected to be seen by a
+// keyframe.
+type sim3Projection struct {
+	u, v  float64
+	level int
+}
+
+// Project the point pc, in the camera frame of kf, and check it lies in the image at a distance
+// the point can be seen from. As in ORB-SLAM2 the distance is compared with the point's own scale
+// invariance, which assumes the scale between the maps is not far from 1.
+func projectSim3(kf *world.KeyFrame, mp *world.MapPoint, pc geom.Vec3) (sim3Projection, bool) {
+	if pc[2] <= 0 {
+		return sim3Projection{}, false
+	}
+	u, v := kf.Camera.Project(pc)
+	if !kf.IsInImage(u, v) {
+		return sim3Projection{}, false
+	}
+	dist := pc.Norm()
+	if dist < mp.MinDistanceInvariance() || dist > mp.MaxDistanceInvariance() {
+		return sim3Projection{}, false
+	}
+	return sim3Projection{u: u, v: v, level: mp.PredictScale(dist, kf.Pyramid)}, true
+}
+
+// The keypoint of kf in the predicted octave (or the one below) with the closest descriptor to mp,
+// skipping those for which skip returns true. Returns -1 if there are no candidates.
+func bestInArea(kf *world.KeyFrame, mp *world.MapPoint, proj sim3Projection, th float64, skip func(idx int) bool) (int, int) {
+	r := th * kf.Pyramid.ScaleFactors[proj.level]
+	d := mp.Descriptor()
+	bestDist, bestIdx := 256, -1
+	for _, idx := range kf.FeaturesInArea(proj.u, proj.v, r, proj.level-1, proj.level) {
+		if skip != nil && skip(idx) {
+			continue
+		}
+		if dist := d.Distance(&kf.Descriptors[idx]); dist < bestDist {
+			bestDist, bestIdx = dist, idx
+		}
+	}
+	return bestIdx, bestDist
+}
+
+// SearchBySim3 finds more matches between the map points of kf1 and kf2 once the similarity s12
+// from kf2 to kf1 is known, typically from the Sim3 solver. The points of each keyframe are
+// projected into the other and searched for within th pixels (scaled by the predicted octave),
+// and a match is only accepted if both searches agree. matches12 holds the map point of kf2
+// matched to each keypoint of kf1 (nil if none), and is updated with the new matches. Returns the
+// number of new matches.
+func (m *Matcher) SearchBySim3(kf1, kf2 *world.KeyFrame, matches12 []*world.MapPoint, s12 geom.Sim3, th float64) int {
+	pose1, pose2 := kf1.Pose(), kf2.Pose()
+	s21 := s12.Inverse()
+	points1, points2 := kf1.MapPointMatches(), kf2.MapPointMatches()
+
+	alreadyMatched1 := make([]bool, len(points1))
+	alreadyMatched2 := make([]bool, len(points2))
+	for i, mp := range matches12 {
+		if mp == nil {
+			continue
+		}
+		alreadyMatched1[i] = true
+		if idx2, ok := mp.Index(kf2); ok {
+			alreadyMatched2[idx2] = true
+		}
+	}
+
+	// search for the points of one keyframe in the other, returning the keypoint matched to each
+	// point (-1 if none)
+	search := func(from, to *world.KeyFrame, fromPose geom.SE3, s geom.Sim3, points []*world.MapPoint, alreadyMatched []bool) []int {
+		match := make([]int, len(points))
+		for i, mp := range points {
+			match[i] = -1
+			if mp == nil || mp.IsBad() || alreadyMatched[i] {
+				continue
+			}
+			pc := s.Transform(fromPose.Transform(mp.Position()))
+			proj, ok := projectSim3(to, mp, pc)
+			if !ok {
+				continue
+			}
+			if idx, dist := bestInArea(to, mp, proj, th, nil); idx >= 0 && dist <= thHigh {
+				match[i] = idx
+			}
+		}
+		return match
+	}
+	match1 := search(kf1, kf2, pose1, s21, points1, alreadyMatched1)
+	match2 := search(kf2, kf1, pose2, s12, points2, alreadyMatched2)
+
+	n := 0
+	for i1, idx2 := range match1 {
+		if idx2 >= 0 && match2[idx2] == i1 {
+			matches12[i1] = points2[idx2]
+			n++
+		}
+	}
+	return n
+}
+
+// SearchByProjectionSim3 projects the map points into the keyframe with the similarity Scw, and
+// searches for an unmatched keypoint within th pixels (scaled by the predicted octave) of each
+// projection. Used when closing a loop to match the map points around the loop keyframe to the
+// current keyframe. matched holds the map point matched to each keypoint of kf, and is updated
+// with the new matches. Returns the number of new matches.
+func (m *Matcher) SearchByProjectionSim3(kf *world.KeyFrame, scw geom.Sim3, points, matched []*world.MapPoint, th float64) int {
+	tcw := scw.SE3()
+	center := tcw.Center()
+	found := make(map[*world.MapPoint]bool)
+	for _, mp := range matched {
+		if mp != nil {
+			found[mp] = true
+		}
+	}
+	n := 0
+	for _, mp := range points {
+		if mp == nil || mp.IsBad() || found[mp] {
+			continue
+		}
+		pw := mp.Position()
+		proj, ok := projectSim3(kf, mp, tcw.Transform(pw))
+		if !ok {
+			continue
+		}
+		// seen from too different an angle to the other observations
+		po := pw.Sub(center)
+		if po.Dot(mp.Normal()) < 0.5*po.Norm() {
+			continue
+		}
+		idx, dist := bestInArea(kf, mp, proj, th, func(idx int) bool { return matched[idx] != nil })
+		if idx < 0 || dist > thLow {
+			continue
+		}
+		matched[idx] = mp
+		n++
+	}
+	return n
+}
+
+// FuseSim3 projects the map points into the keyframe with the similarity Scw and searches for a
+// keypoint matching each within th pixels (scaled by the predicted octave). If the keypoint has
+// no map point it becomes an observation of the point. Otherwise the keypoint's point is a
+// duplicate, which is returned for the caller to replace with points[i], as loop closing must do
+// the replacement while holding the map update lock. Returns the point to be replaced for each of
+// points (nil if none) and the number of points fused or added.
+func (m *Matcher) FuseSim3(kf *world.KeyFrame, scw geom.Sim3, points []*world.MapPoint, th float64) ([]*world.MapPoint, int) {
+	tcw := scw.SE3()
+	center := tcw.Center()
+	found := make(map[*world.MapPoint]bool)
+	for _, mp := range kf.MapPoints() {
+		found[mp] = true
+	}
+	replace := make([]*world.MapPoint, len(points))
+	n := 0
+	for i, mp := range points {
+		if mp == nil || mp.IsBad() || found[mp] {
+			continue
+		}
+		pw := mp.Position()
+		proj, ok := projectSim3(kf, mp, tcw.Transform(pw))
+		if !ok {
+			continue
+		}
+		po := pw.Sub(center)
+		if po.Dot(mp.Normal()) < 0.5*po.Norm() {
+			continue
+		}
+		idx, dist := bestInArea(kf, mp, proj, th, nil)
+		if idx < 0 || dist > thLow {
+			continue
+		}
+		if existing := kf.MapPoint(idx); existing != nil {
+			if !existing.IsBad() {
+				replace[i] = existing
+			}
+		} else {
+			mp.AddObservation(kf, idx)
+			kf.AddMapPoint(mp, idx)
+		}
+		n++
+	}
+	return replace, n
+}
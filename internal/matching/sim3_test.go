@@ -0,0 +1,122 @@
+package matching
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/kegsay/gorbslam/internal/geom"
+	"github.com/kegsay/gorbslam/internal/world"
+)
+
+// Two maps of the same scene as seen when closing a loop: the first keyframe is at the origin of
+// the scene, the second at pose2 in a copy of the scene scaled by scale, as happens when the
+// monocular scale drifts. Every point is mapped twice, once by each keyframe. s12 is the
+// similarity from the second keyframe to the first.
+type loopScene struct {
+	*testScene
+	kf1, kf2 *world.KeyFrame
+	mps1     []*world.MapPoint
+	mps2     []*world.MapPoint
+	s12      geom.Sim3
+	scale    float64
+}
+
+func newLoopScene(rng *rand.Rand, n int, pose2 geom.SE3, scale float64) *loopScene {
+	s := newTestScene(rng, n)
+	scaled := &testScene{descriptors: s.descriptors}
+	for _, p := range s.points {
+		scaled.points = append(scaled.points, p.Scale(scale))
+	}
+	scaledPose2 := geom.SE3{R: pose2.R, T: pose2.T.Scale(scale)}
+	ls := &loopScene{testScene: s, scale: scale}
+	ls.mps1 = s.mapPoints(s.frame(geom.IdentitySE3(), 0))
+	ls.mps2 = scaled.mapPoints(scaled.frame(scaledPose2, 0))
+	ls.kf1 = ls.mps1[0].ReferenceKeyFrame()
+	ls.kf2 = ls.mps2[0].ReferenceKeyFrame()
+	t12 := pose2.Inverse().Sim3()
+	ls.s12 = geom.Sim3{R: t12.R, T: t12.T, S: 1 / scale}
+	return ls
+}
+
+func TestSearchBySim3(t *testing.T) {
+	rng := rand.New(rand.NewSource(6))
+	pose2 := geom.SE3{R: geom.ExpSO3(geom.Vec3{0, 0.03, 0}), T: geom.Vec3{-0.1, 0.05, 0}}
+	s := newLoopScene(rng, 200, pose2, 1.15)
+	// the first 20 are already matched, e.g by the BoW search
+	matches12 := make([]*world.MapPoint, len(s.mps1))
+	for i := 0; i < 20; i++ {
+		matches12[i] = s.mps2[i]
+	}
+	// a mismatch which should be left alone, and stop point 31 of kf2 being matched again
+	matches12[30] = s.mps2[31]
+
+	n := NewMatcher(0.75, true).SearchBySim3(s.kf1, s.kf2, matches12, s.s12, 7.5)
+	if n < 160 {
+		t.Errorf("found %d new matches", n)
+	}
+	for i, mp := range matches12 {
+		switch {
+		case i == 30 && mp != s.mps2[31]:
+			t.Errorf("existing match was changed")
+		case i == 31 && mp != nil:
+			t.Errorf("point already matched by another keypoint was matched again")
+		case i != 30 && mp != nil && mp != s.mps2[i]:
+			t.Errorf("keypoint %d matched to point %d", i, mp.ID)
+		}
+	}
+}
+
+func TestSearchByProjectionSim3(t *testing.T) {
+	rng := rand.New(rand.NewSource(7))
+	pose2 := geom.SE3{R: geom.ExpSO3(geom.Vec3{0.02, 0, 0}), T: geom.Vec3{0.1, 0, 0}}
+	s := newLoopScene(rng, 200, pose2, 0.8)
+	// the first keyframe is at the origin of the unscaled scene
+	scw := geom.Sim3{R: geom.IdentitySO3(), S: 1 / s.scale}
+	matched := make([]*world.MapPoint, len(s.mps1))
+	matched[0] = s.mps2[0]
+	// keypoint 1 is already taken, so point 1 can't be matched
+	matched[1] = s.mps2[2]
+
+	n := NewMatcher(0.75, true).SearchByProjectionSim3(s.kf1, scw, s.mps2, matched, 10)
+	if n < 180 {
+		t.Errorf("found %d new matches", n)
+	}
+	for i, mp := range matched {
+		switch {
+		case i == 1 && mp != s.mps2[2]:
+			t.Errorf("existing match was changed")
+		case i != 1 && mp != nil && mp != s.mps2[i]:
+			t.Errorf("keypoint %d matched to point %d", i, mp.ID)
+		}
+	}
+}
+
+func TestFuseSim3(t *testing.T) {
+	rng := rand.New(rand.NewSource(8))
+	pose2 := geom.SE3{R: geom.ExpSO3(geom.Vec3{0, -0.02, 0}), T: geom.Vec3{0, 0.1, 0}}
+	s := newLoopScene(rng, 100, pose2, 1.2)
+	// the second half of the keypoints of the first keyframe don't observe a point yet
+	for i := 50; i < len(s.mps1); i++ {
+		s.mps1[i].SetBad()
+	}
+	scw := geom.Sim3{R: geom.IdentitySO3(), S: 1 / s.scale}
+
+	replace, n := NewMatcher(0.8, true).FuseSim3(s.kf1, scw, s.mps2, 4)
+	if n < 95 {
+		t.Errorf("fused %d of %d", n, len(s.mps2))
+	}
+	for i := range s.mps2 {
+		if i < 50 {
+			if replace[i] != nil && replace[i] != s.mps1[i] {
+				t.Errorf("point %d would replace the wrong point %d", i, replace[i].ID)
+			}
+			continue
+		}
+		if replace[i] != nil {
+			t.Errorf("point %d has a replacement but the keypoint had no point", i)
+		}
+		if mp := s.kf1.MapPoint(i); mp != nil && (mp != s.mps2[i] || !mp.IsInKeyFrame(s.kf1)) {
+			t.Errorf("keypoint %d observes the wrong point", i)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package matching
+
+import (
+	"image"
+	"math"
+	"sort"
+
+	"github.com/kegsay/gorbslam/internal/world"
+)
+
+const (
+	// the patch compared between the left and right images is (2*stereoPatchRadius+1)^2 pixels
+	stereoPatchRadius = 5
+	// the patch is slid this many pixels either side of the descriptor match
+	stereoSearchRadius = 5
+)
+
+// ComputeStereoMatches finds the right image x coordinate and depth of each keypoint of the left
+// image of a rectified stereo pair, -1 for keypoints without a match. bf is the baseline times fx.
+// leftImages and rightImages are the images of each level of the scale pyramid. Each left keypoint
+// is matched by descriptor to the right keypoints near its row, within the possible disparities.
+// The match is refined by sliding a patch along the row to minimise the sum of absolute
+// differences, and interpolated to a fraction of a pixel by fitting a parabola to the best three
+// positions. Finally matches whose patch differs by much more than the median are discarded.
+func ComputeStereoMatches(left, right *world.Features, leftImages, rightImages []*image.Gray, bf float64) ([]float64, []float64) {
+	uRight := make([]float64, len(left.KeyPoints))
+	depth := make([]float64, len(left.KeyPoints))
+	for i := range uRight {
+		uRight[i], depth[i] = -1, -1
+	}
+	if len(leftImages) == 0 || bf <= 0 {
+		return uRight, depth
+	}
+	pyramid := left.Pyramid
+
+	// the right keypoints which may match a left keypoint on each row, allowing for the uncertainty
+	// of the keypoint's octave
+	numRows := leftImages[0].Bounds().Dy()
+	rows := make([][]int, numRows)
+	for iR := range right.KeyPoints {
+		kp := &right.KeyPoints[iR]
+		r := 2 * pyramid.ScaleFactors[kp.Octave]
+		minRow := int(math.Max(0, math.Floor(kp.Y-r)))
+		maxRow := int(math.Min(float64(numRows-1), math.Ceil(kp.Y+r)))
+		for row := minRow; row <= maxRow; row++ {
+			rows[row] = append(rows[row], iR)
+		}
+	}
+
+	// points can't be closer than the baseline
+	minZ := bf / left.Camera.Fx
+	minD, maxD := 0.0, bf/minZ
+	thOrbDist := (thHigh + thLow) / 2
+
+	type patchDist struct {
+		dist int
+		idx  int
+	}
+	var dists []patchDist
+	for iL := range left.KeyPoints {
+		kpL := &left.KeyPoints[iL]
+		levelL := kpL.Octave
+		row := int(kpL.Y)
+		if row < 0 || row >= numRows || levelL >= len(leftImages) {
+			continue
+		}
+		uL := kpL.X
+		minU, maxU := uL-maxD, uL-minD
+		if maxU < 0 {
+			continue
+		}
+
+		bestDist, bestIdxR := thHigh, -1
+		for _, iR := range rows[row] {
+			kpR := &right.KeyPoints[iR]
+			if kpR.Octave < levelL-1 || kpR.Octave > levelL+1 {
+				continue
+			}
+			if kpR.X < minU || kpR.X > maxU {
+				continue
+			}
+			if d := left.Descriptors[iL].Distance(&right.Descriptors[iR]); d < bestDist {
+				bestDist, bestIdxR = d, iR
+			}
+		}
+		if bestIdxR < 0 || bestDist >= thOrbDist {
+			continue
+		}
+
+		// slide the patch along the row on the octave's image
+		scale := pyramid.InvScaleFactors[levelL]
+		scaleduL := int(math.Round(uL * scale))
+		scaledvL := int(math.Round(kpL.Y * scale))
+		scaleduR0 := int(math.Round(right.KeyPoints[bestIdxR].X * scale))
+		imL, imR := leftImages[levelL], rightImages[levelL]
+		w, l := stereoPatchRadius, stereoSearchRadius
+		if !patchInImage(imL, scaleduL, scaledvL, w) ||
+			!patchInImage(imR, scaleduR0-l, scaledvL, w) || !patchInImage(imR, scaleduR0+l, scaledvL, w) {
+			continue
+		}
+		bestPatchDist, bestIncR := math.MaxInt32, 0
+		var patchDists [2*stereoSearchRadius + 1]int
+		for incR := -l; incR <= l; incR++ {
+			d := patchSAD(imL, imR, scaleduL, scaleduR0+incR, scaledvL, w)
+			if d < bestPatchDist {
+				bestPatchDist, bestIncR = d, incR
+			}
+			patchDists[l+incR] = d
+		}
+		if bestIncR == -l || bestIncR == l {
+			continue
+		}
+
+		// sub-pixel match, from the parabola through the best position and its neighbours
+		dist1 := float64(patchDists[l+bestIncR-1])
+		dist2 := float64(patchDists[l+bestIncR])
+		dist3 := float64(patchDists[l+bestIncR+1])
+		denom := 2 * (dist1 + dist3 - 2*dist2)
+		if denom == 0 {
+			continue
+		}
+		deltaR := (dist1 - dist3) / denom
+		if deltaR < -1 || deltaR > 1 {
+			continue
+		}
+		bestuR := pyramid.ScaleFactors[levelL] * (float64(scaleduR0+bestIncR) + deltaR)
+
+		disparity := uL - bestuR
+		if disparity < minD || disparity >= maxD {
+			continue
+		}
+		if disparity <= 0 {
+			disparity = 0.01
+			bestuR = uL - 0.01
+		}
+		depth[iL] = bf / disparity
+		uRight[iL] = bestuR
+		dists = append(dists, patchDist{dist: bestPatchDist, idx: iL})
+	}
+
+	if len(dists) == 0 {
+		return uRight, depth
+	}
+	sort.Slice(dists, func(i, j int) bool { return dists[i].dist < dists[j].dist })
+	median := float64(dists[len(dists)/2].dist)
+	thDist := 1.5 * 1.4 * median
+	for i := len(dists) - 1; i >= 0 && float64(dists[i].dist) >= thDist; i-- {
+		uRight[dists[i].idx], depth[dists[i].idx] = -1, -1
+	}
+	return uRight, depth
+}
+
+// patchInImage returns true if the patch of radius w centred on (x, y) lies within the image
+func patchInImage(img *image.Gray, x, y, w int) bool {
+	b := img.Bounds()
+	return x-w >= 0 && y-w >= 0 && x+w < b.Dx() && y+w < b.Dy()
+}
+
+// patchSAD returns the sum of absolute differences between the patches of radius w centred on
+// (xL, y) and (xR, y), each relative to its centre pixel so that a change of brightness between
+// the cameras doesn't matter.
+func patchSAD(imL, imR *image.Gray, xL, xR, y, w int) int {
+	centreL, centreR := grayAt(imL, xL, y), grayAt(imR, xR, y)
+	sum := 0
+	for dy := -w; dy <= w; dy++ {
+		for dx := -w; dx <= w; dx++ {
+			d := (grayAt(imL, xL+dx, y+dy) - centreL) - (grayAt(imR, xR+dx, y+dy) - centreR)
+			if d < 0 {
+				d = -d
+			}
+			sum += d
+		}
+	}
+	return sum
+}
+
+// grayAt returns the pixel at (x, y) relative to the image's origin
+func grayAt(img *image.Gray, x, y int) int {
+	return int(img.Pix[y*img.Stride+x])
+}
@@ -0,0 +1,114 @@
+package matching
+
+import (
+	"image"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/kegsay/gorbslam/internal/feature"
+	"github.com/kegsay/gorbslam/internal/world"
+	"github.com/kegsay/gorbslam/internal/worldtest"
+)
+
+// texture is a smooth random pattern, so that patches can be located to a fraction of a pixel
+type texture struct {
+	fx, fy, phase, amp []float64
+}
+
+func newTexture(rng *rand.Rand) *texture {
+	t := &texture{}
+	for i := 0; i < 8; i++ {
+		t.fx = append(t.fx, 0.15+rng.Float64()*0.35)
+		t.fy = append(t.fy, (rng.Float64()-0.5)*0.6)
+		t.phase = append(t.phase, rng.Float64()*2*math.Pi)
+		t.amp = append(t.amp, 10+rng.Float64()*5)
+	}
+	return t
+}
+
+func (t *texture) at(x, y float64) float64 {
+	v := 128.0
+	for i := range t.fx {
+		v += t.amp[i] * math.Sin(t.fx[i]*x+t.fy[i]*y+t.phase[i])
+	}
+	return v
+}
+
+// pyramidImages renders the texture shifted left by disparity pixels on each level of the pyramid
+func (t *texture) pyramidImages(pyramid *feature.ScalePyramid, levels int, disparity float64) []*image.Gray {
+	var images []*image.Gray
+	for level := 0; level < levels; level++ {
+		s := pyramid.ScaleFactors[level]
+		w, h := int(math.Round(640/s)), int(math.Round(480/s))
+		img := image.NewGray(image.Rect(0, 0, w, h))
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				img.Pix[y*img.Stride+x] = uint8(math.Round(t.at(float64(x)*s+disparity, float64(y)*s)))
+			}
+		}
+		images = append(images, img)
+	}
+	return images
+}
+
+// A fronto-parallel plane seen by a rectified stereo pair
+func TestComputeStereoMatches(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	tex := newTexture(rng)
+	const bf, disparity = 40.0, 12.37
+	leftImages := tex.pyramidImages(worldtest.Pyramid, 2, 0)
+	rightImages := tex.pyramidImages(worldtest.Pyramid, 2, disparity)
+
+	var left, right []feature.KeyPoint
+	var leftDescs, rightDescs []feature.Descriptor
+	add := func(uL, uR, v float64, octave int, matched bool) {
+		d := worldtest.RandomDescriptor(rng)
+		left = append(left, feature.KeyPoint{X: uL, Y: v, Octave: octave})
+		leftDescs = append(leftDescs, d)
+		if !matched {
+			d = worldtest.RandomDescriptor(rng)
+		}
+		right = append(right, feature.KeyPoint{X: uR, Y: v + rng.Float64() - 0.5, Octave: octave})
+		rightDescs = append(rightDescs, d)
+	}
+	const numGood = 60
+	for i := 0; i < numGood; i++ {
+		// keypoints are detected on whole pixels of their octave's image, and to the nearest pixel
+		// or so in the other image
+		octave := i % 2
+		s := worldtest.Pyramid.ScaleFactors[octave]
+		u, v := math.Round((60+rng.Float64()*520)/s)*s, math.Round((40+rng.Float64()*400)/s)*s
+		add(u, u-disparity+rng.Float64()*2-1, v, octave, true)
+	}
+	// no match, a match with a negative disparity, and one at the wrong disparity
+	add(300, 290, 200, 0, false)
+	add(300, 310, 210, 0, true)
+	add(300, 270, 220, 0, true)
+
+	lf := world.NewFeatures(worldtest.Camera, worldtest.Pyramid, left, leftDescs, 640, 480)
+	rf := world.NewFeatures(worldtest.Camera, worldtest.Pyramid, right, rightDescs, 640, 480)
+	uRight, depth := ComputeStereoMatches(lf, rf, leftImages, rightImages, bf)
+
+	matched := 0
+	for i := 0; i < numGood; i++ {
+		if depth[i] < 0 {
+			continue
+		}
+		matched++
+		if d := math.Abs(uRight[i] - (left[i].X - disparity)); d > 0.3*worldtest.Pyramid.ScaleFactors[left[i].Octave] {
+			t.Errorf("keypoint %d on octave %d: right x is %v off", i, left[i].Octave, d)
+		}
+		if want := bf / disparity; math.Abs(depth[i]-want) > 0.03*want {
+			t.Errorf("keypoint %d: got depth %v want %v", i, depth[i], want)
+		}
+	}
+	if matched < numGood*3/4 {
+		t.Errorf("only matched %d of %d keypoints", matched, numGood)
+	}
+	for i := numGood; i < len(left); i++ {
+		if uRight[i] != -1 || depth[i] != -1 {
+			t.Errorf("bad keypoint %d was matched: right x %v depth %v", i-numGood, uRight[i], depth[i])
+		}
+	}
+}
@@ -0,0 +1,449 @@
+package optim
+
+import (
+	"context"
+	"math"
+
+	"github.com/kegsay/gorbslam/internal/camera"
+	"github.com/kegsay/gorbslam/internal/geom"
+	"github.com/kegsay/gorbslam/internal/sparse"
+)
+
+// BAKeyFrame is a keyframe pose taking part in bundle adjustment.
+type BAKeyFrame struct {
+	// The camera pose Tcw
+	Pose geom.SE3
+	// Fixed keyframes observe the points being optimised but are not moved themselves. They anchor
+	// the solution: without them the whole map could drift/rotate/scale freely.
+	Fixed bool
+}
+
+// BAPoint is a map point taking part in bundle adjustment.
+type BAPoint struct {
+	// World position
+	Position geom.Vec3
+}
+
+// BAObservation is a keypoint in a keyframe which observes a map point.
+type BAObservation struct {
+	// Indexes into BundleProblem.KeyFrames and BundleProblem.Points
+	KeyFrame int
+	Point    int
+	// Undistorted keypoint position in pixels
+	U float64
+	V float64
+	// The keypoint's x coordinate in the right image of a stereo or RGB-D camera, negative if it
+	// has none
+	URight float64
+	// The pyramid level the keypoint was extracted from
+	Octave int
+	// Outliers are excluded from the optimisation. Set by LocalBundleAdjustment when the
+	// observation does not agree with the optimised map.
+	Outlier bool
+}
+
+// BundleProblem is a set of keyframes and map points to jointly optimise. The optimised poses and
+// positions are written back into the slices.
+type BundleProblem struct {
+	Camera camera.Pinhole
+	// The stereo baseline times fx, for observations with a URight. 0 for a monocular camera.
+	Bf           float64
+	InvSigma2    []float64
+	KeyFrames    []BAKeyFrame
+	Points       []BAPoint
+	Observations []BAObservation
+}
+
+// BAStats describes a bundle adjustment run
+type BAStats struct {
+	Iterations  int
+	InitialCost float64
+	FinalCost   float64
+	// The number of observations marked as outliers
+	NumOutliers int
+	// True if the context was cancelled before the optimisation completed
+	Aborted bool
+}
+
+// LocalBundleAdjustment refines the keyframes and map points in the local window around a new
+// keyframe. This follows ORB-SLAM2: 5 iterations with a Huber kernel, then observations failing
+// the chi-squared test (or behind the camera) are marked as outliers and 10 more iterations are
+// run without the kernel. Finally the outliers are checked again, the caller should then remove
+// the Outlier observations from the map.
+//
+// Cancelling the context stops the optimisation early (e.g when a new keyframe arrives and we'd
+// rather process it), in which case whatever progress has been made is kept.
+// Learning: https://youtu.be/0I30M6yTklo?t=281
+func LocalBundleAdjustment(ctx context.Context, p *BundleProblem) BAStats {
+	stats := p.Optimize(ctx, 5, true)
+	if stats.Aborted {
+		return stats
+	}
+	p.markOutliers()
+	second := p.Optimize(ctx, 10, false)
+	stats.Iterations += second.Iterations
+	stats.FinalCost = second.FinalCost
+	stats.Aborted = second.Aborted
+	stats.NumOutliers = p.markOutliers()
+	return stats
+}
+
+// Mark observations with a high reprojection error or negative depth as outliers. Returns the
+// number of outliers.
+func (p *BundleProblem) markOutliers() int {
+	var numOutliers int
+	for i := range p.Observations {
+		o := &p.Observations[i]
+		r, ok := p.reprojection(o)
+		o.Outlier = !ok || r.chi2(p.InvSigma2[o.Octave]) > r.threshold()
+		if o.Outlier {
+			numOutliers++
+		}
+	}
+	return numOutliers
+}
+
+// reprojection returns the reprojection of an observation, false if its point is behind the camera
+func (p *BundleProblem) reprojection(o *BAObservation) (reprojection, bool) {
+	kf := &p.KeyFrames[o.KeyFrame]
+	pc := kf.Pose.Transform(p.Points[o.Point].Position)
+	if pc[2] <= 0 {
+		return reprojection{}, false
+	}
+	return newReprojection(p.Camera, p.Bf, pc, o.U, o.V, o.URight), true
+}
+
+func (p *BundleProblem) cost(robust bool) float64 {
+	var cost float64
+	for i := range p.Observations {
+		o := &p.Observations[i]
+		if o.Outlier {
+			continue
+		}
+		chi2 := 1e6
+		r, ok := p.reprojection(o)
+		if ok {
+			chi2 = r.chi2(p.InvSigma2[o.Octave])
+		}
+		if kernel := r.kernel(robust); kernel != nil {
+			chi2, _ = kernel.Robustify(chi2)
+		}
+		cost += chi2
+	}
+	return cost
+}
+
+// The linear system for one LM iteration, split into camera and point parts so that the points
+// can be eliminated with the Schur complement.
+type baSystem struct {
+	// camera index -> index in the reduced system, -1 if fixed
+	freeIndex []int
+	numFree   int
+	hcc       *sparse.BlockSym
+	bc        []float64
+	hpp       [][9]float64
+	bp        [][3]float64
+	// per observation: Hcp (6x3), only valid for free keyframes
+	hcp [][18]float64
+	// observations which contributed to the system, grouped by point
+	obsByPoint [][]int
+}
+
+func (p *BundleProblem) newSystem() *baSystem {
+	s := &baSystem{
+		freeIndex:  make([]int, len(p.KeyFrames)),
+		hpp:        make([][9]float64, len(p.Points)),
+		bp:         make([][3]float64, len(p.Points)),
+		hcp:        make([][18]float64, len(p.Observations)),
+		obsByPoint: make([][]int, len(p.Points)),
+	}
+	for i, kf := range p.KeyFrames {
+		if kf.Fixed {
+			s.freeIndex[i] = -1
+			continue
+		}
+		s.freeIndex[i] = s.numFree
+		s.numFree++
+	}
+	s.bc = make([]float64, 6*s.numFree)
+	return s
+}
+
+// Build the normal equations at the current estimate. Returns the current cost.
+func (p *BundleProblem) buildSystem(s *baSystem, robust bool) float64 {
+	s.hcc = sparse.NewBlockSym(poseDims(s.numFree))
+	for i := range s.bc {
+		s.bc[i] = 0
+	}
+	for i := range s.hpp {
+		s.hpp[i] = [9]float64{}
+		s.bp[i] = [3]float64{}
+		s.obsByPoint[i] = s.obsByPoint[i][:0]
+	}
+	var cost float64
+	for idx := range p.Observations {
+		o := &p.Observations[idx]
+		if o.Outlier {
+			continue
+		}
+		r, ok := p.reprojection(o)
+		if !ok {
+			cost += 1e6
+			continue
+		}
+		e := r.e
+		info := p.InvSigma2[o.Octave]
+		chi2 := r.chi2(info)
+		w := info
+		if kernel := r.kernel(robust); kernel != nil {
+			c, kw := kernel.Robustify(chi2)
+			cost += c
+			w *= kw
+		} else {
+			cost += chi2
+		}
+
+		// Jacobian wrt the point: -d(proj)/d(pc) * R
+		jp := projectionJacobianPoint(&r, p.KeyFrames[o.KeyFrame].Pose.R.Matrix())
+		hpp := &s.hpp[o.Point]
+		bp := &s.bp[o.Point]
+		for i := 0; i < 3; i++ {
+			bp[i] -= w * (jp[0][i]*e[0] + jp[1][i]*e[1] + jp[2][i]*e[2])
+			for c := 0; c < 3; c++ {
+				hpp[i*3+c] += w * (jp[0][i]*jp[0][c] + jp[1][i]*jp[1][c] + jp[2][i]*jp[2][c])
+			}
+		}
+		s.obsByPoint[o.Point] = append(s.obsByPoint[o.Point], idx)
+
+		ci := s.freeIndex[o.KeyFrame]
+		if ci < 0 {
+			continue
+		}
+		jc := projectionJacobianPose(&r)
+		hcc := s.hcc.Block(ci, ci)
+		bc := s.bc[6*ci : 6*ci+6]
+		for i := 0; i < 6; i++ {
+			bc[i] -= w * (jc[0][i]*e[0] + jc[1][i]*e[1] + jc[2][i]*e[2])
+			for c := 0; c < 6; c++ {
+				hcc[i*6+c] += w * (jc[0][i]*jc[0][c] + jc[1][i]*jc[1][c] + jc[2][i]*jc[2][c])
+			}
+		}
+		hcp := &s.hcp[idx]
+		for i := 0; i < 6; i++ {
+			for c := 0; c < 3; c++ {
+				hcp[i*3+c] = w * (jc[0][i]*jp[0][c] + jc[1][i]*jp[1][c] + jc[2][i]*jp[2][c])
+			}
+		}
+	}
+	return cost
+}
+
+// The block sizes for n 6 DoF poses
+func poseDims(n int) []int {
+	dims := make([]int, n)
+	for i := range dims {
+		dims[i] = 6
+	}
+	return dims
+}
+
+// Solve the damped system with the Schur complement: eliminate the points (whose Hessian is block
+// diagonal so trivially invertible), solve the reduced camera system, then back-substitute to find
+// the point updates.
+func (p *BundleProblem) solveSchur(s *baSystem, lambda float64) (dc []float64, dp [][3]float64, ok bool) {
+	reduced := s.hcc.Clone()
+	reduced.AddToDiagonal(lambda)
+	rhs := append([]float64(nil), s.bc...)
+
+	hppInv := make([][9]float64, len(p.Points))
+	valid := make([]bool, len(p.Points))
+	for pi := range p.Points {
+		obs := s.obsByPoint[pi]
+		if len(obs) == 0 {
+			continue
+		}
+		inv := s.hpp[pi]
+		for k := 0; k < 3; k++ {
+			inv[k*3+k] += lambda
+		}
+		if !sparse.InvertSPD(inv[:], 3) {
+			continue
+		}
+		hppInv[pi] = inv
+		valid[pi] = true
+		bp := s.bp[pi]
+
+		// W_i = Hcp_i * Hpp^-1 for each free keyframe observing the point
+		for a, ia := range obs {
+			ca := s.freeIndex[p.Observations[ia].KeyFrame]
+			if ca < 0 {
+				continue
+			}
+			var w [18]float64
+			hcpA := &s.hcp[ia]
+			for r := 0; r < 6; r++ {
+				for c := 0; c < 3; c++ {
+					w[r*3+c] = hcpA[r*3]*inv[c] + hcpA[r*3+1]*inv[3+c] + hcpA[r*3+2]*inv[6+c]
+				}
+			}
+			// rhs_a -= W_a * bp
+			for r := 0; r < 6; r++ {
+				rhs[6*ca+r] -= w[r*3]*bp[0] + w[r*3+1]*bp[1] + w[r*3+2]*bp[2]
+			}
+			// S_ab -= W_a * Hcp_b^T
+			for _, ib := range obs[a:] {
+				cb := s.freeIndex[p.Observations[ib].KeyFrame]
+				if cb < 0 {
+					continue
+				}
+				hcpB := &s.hcp[ib]
+				if ca <= cb {
+					block := reduced.Block(ca, cb)
+					for r := 0; r < 6; r++ {
+						for c := 0; c < 6; c++ {
+							block[r*6+c] -= w[r*3]*hcpB[c*3] + w[r*3+1]*hcpB[c*3+1] + w[r*3+2]*hcpB[c*3+2]
+						}
+					}
+				} else {
+					// store the transpose in the upper triangle
+					block := reduced.Block(cb, ca)
+					for r := 0; r < 6; r++ {
+						for c := 0; c < 6; c++ {
+							block[c*6+r] -= w[r*3]*hcpB[c*3] + w[r*3+1]*hcpB[c*3+1] + w[r*3+2]*hcpB[c*3+2]
+						}
+					}
+				}
+			}
+		}
+	}
+	dc, ok = sparse.Solve(reduced, rhs)
+	if !ok {
+		return nil, nil, false
+	}
+	dp = make([][3]float64, len(p.Points))
+	for pi := range p.Points {
+		if !valid[pi] {
+			continue
+		}
+		// dp = Hpp^-1 (bp - sum Hcp_i^T dc_i)
+		rhsP := s.bp[pi]
+		for _, io := range s.obsByPoint[pi] {
+			ci := s.freeIndex[p.Observations[io].KeyFrame]
+			if ci < 0 {
+				continue
+			}
+			hcp := &s.hcp[io]
+			for c := 0; c < 3; c++ {
+				var sum float64
+				for r := 0; r < 6; r++ {
+					sum += hcp[r*3+c] * dc[6*ci+r]
+				}
+				rhsP[c] -= sum
+			}
+		}
+		inv := &hppInv[pi]
+		for r := 0; r < 3; r++ {
+			dp[pi][r] = inv[r*3]*rhsP[0] + inv[r*3+1]*rhsP[1] + inv[r*3+2]*rhsP[2]
+		}
+	}
+	return dc, dp, true
+}
+
+// Optimize runs up to the given number of Levenberg-Marquardt iterations on all free keyframes and
+// points, using the observations which are not marked as outliers. If robust, errors are weighted
+// by a Huber kernel.
+func (p *BundleProblem) Optimize(ctx context.Context, iterations int, robust bool) BAStats {
+	s := p.newSystem()
+	cost := p.buildSystem(s, robust)
+	stats := BAStats{InitialCost: cost, FinalCost: cost}
+	if cost == 0 {
+		return stats
+	}
+
+	// initial damping relative to the largest diagonal element, as in g2o
+	var maxDiag float64
+	for _, d := range s.hcc.Diagonal() {
+		maxDiag = math.Max(maxDiag, d)
+	}
+	for _, h := range s.hpp {
+		maxDiag = math.Max(maxDiag, math.Max(h[0], math.Max(h[4], h[8])))
+	}
+	lambda := 1e-5 * maxDiag
+	nu := 2.0
+
+	oldPoses := make([]geom.SE3, len(p.KeyFrames))
+	oldPoints := make([]geom.Vec3, len(p.Points))
+	for iter := 0; iter < iterations; iter++ {
+		if ctx.Err() != nil {
+			stats.Aborted = true
+			break
+		}
+		stats.Iterations++
+		dc, dp, ok := p.solveSchur(s, lambda)
+		if !ok {
+			lambda *= nu
+			nu *= 2
+			continue
+		}
+		// predicted reduction: dx . (lambda * dx + b)
+		var predicted float64
+		for i := range dc {
+			predicted += dc[i] * (lambda*dc[i] + s.bc[i])
+		}
+		for pi := range dp {
+			for k := 0; k < 3; k++ {
+				predicted += dp[pi][k] * (lambda*dp[pi][k] + s.bp[pi][k])
+			}
+		}
+
+		for i := range p.KeyFrames {
+			oldPoses[i] = p.KeyFrames[i].Pose
+			ci := s.freeIndex[i]
+			if ci < 0 {
+				continue
+			}
+			d := dc[6*ci : 6*ci+6]
+			p.KeyFrames[i].Pose = geom.ExpSE3([6]float64{d[0], d[1], d[2], d[3], d[4], d[5]}).Mul(p.KeyFrames[i].Pose)
+		}
+		for i := range p.Points {
+			oldPoints[i] = p.Points[i].Position
+			p.Points[i].Position = p.Points[i].Position.Add(geom.Vec3(dp[i]))
+		}
+		newCost := p.cost(robust)
+		if newCost < cost && predicted > 0 {
+			rho := (cost - newCost) / predicted
+			lambda *= math.Max(1.0/3, 1-math.Pow(2*rho-1, 3))
+			nu = 2
+			converged := (cost-newCost)/cost < 1e-10
+			cost = p.buildSystem(s, robust)
+			if converged {
+				break
+			}
+		} else {
+			// reject the step
+			for i := range p.KeyFrames {
+				p.KeyFrames[i].Pose = oldPoses[i]
+			}
+			for i := range p.Points {
+				p.Points[i].Position = oldPoints[i]
+			}
+			lambda *= nu
+			nu *= 2
+		}
+	}
+	stats.FinalCost = cost
+	return stats
+}
+
+// projectionJacobianPoint returns the Jacobian of the reprojection error (observed - projected)
+// with respect to the world position of the point, given the camera rotation Rcw.
+func projectionJacobianPoint(r *reprojection, rcw geom.Mat3) [3][3]float64 {
+	dp := &r.dp
+	var j [3][3]float64
+	for row := 0; row < 3; row++ {
+		for c := 0; c < 3; c++ {
+			j[row][c] = -(dp[row][0]*rcw[0][c] + dp[row][1]*rcw[1][c] + dp[row][2]*rcw[2][c])
+		}
+	}
+	return j
+}
@@ -0,0 +1,227 @@
+package optim
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/kegsay/gorbslam/internal/geom"
+)
+
+// The pose Tcw of the i'th of n cameras evenly spaced around a circle, looking at the centre
+func circlePose(i, n int, radius float64) geom.SE3 {
+	angle := 2 * math.Pi * float64(i) / float64(n)
+	center := geom.Vec3{radius * math.Cos(angle), 0, radius * math.Sin(angle)}
+	// look towards the origin: the camera z axis points at -center
+	z := center.Scale(-1).Normalised()
+	y := geom.Vec3{0, 1, 0}
+	x := y.Cross(z).Normalised()
+	y = z.Cross(x)
+	rcw := geom.Mat3{x, y, z}
+	return geom.NewSE3(rcw.T(), center).Inverse()
+}
+
+// Generate keyframes moving along a circle looking inwards at a cloud of points. Each point is
+// observed by every keyframe it projects into, up to maxObs of them.
+func syntheticBundleScene(rng *rand.Rand, numKFs, numPoints, maxObs int, noise float64) *BundleProblem {
+	p := &BundleProblem{
+		Camera:    testCam,
+		InvSigma2: testPyramid.InvSigma2,
+	}
+	for i := 0; i < numKFs; i++ {
+		p.KeyFrames = append(p.KeyFrames, BAKeyFrame{Pose: circlePose(i, numKFs, 10)})
+	}
+	for len(p.Points) < numPoints {
+		pw := geom.Vec3{rng.NormFloat64() * 2, rng.NormFloat64() * 2, rng.NormFloat64() * 2}
+		var obs []BAObservation
+		// start at a random keyframe so observations are spread around the circle
+		start := rng.Intn(numKFs)
+		for k := 0; k < numKFs && len(obs) < maxObs; k++ {
+			kfIdx := (start + k) % numKFs
+			pc := p.KeyFrames[kfIdx].Pose.Transform(pw)
+			if pc[2] <= 0 {
+				continue
+			}
+			u, v := testCam.Project(pc)
+			if u < 0 || u >= 640 || v < 0 || v >= 480 {
+				continue
+			}
+			octave := rng.Intn(4)
+			scale := testPyramid.ScaleFactors[octave]
+			obs = append(obs, BAObservation{
+				KeyFrame: kfIdx,
+				Point:    len(p.Points),
+				U:        u + rng.NormFloat64()*noise*scale,
+				V:        v + rng.NormFloat64()*noise*scale,
+				Octave:   octave,
+			})
+		}
+		if len(obs) < 2 {
+			continue
+		}
+		p.Points = append(p.Points, BAPoint{Position: pw})
+		p.Observations = append(p.Observations, obs...)
+	}
+	return p
+}
+
+// Perturb the free keyframes and all points, returning the true values
+func perturbBundle(rng *rand.Rand, p *BundleProblem, rot, trans, point float64) ([]geom.SE3, []geom.Vec3) {
+	poses := make([]geom.SE3, len(p.KeyFrames))
+	points := make([]geom.Vec3, len(p.Points))
+	for i := range p.KeyFrames {
+		poses[i] = p.KeyFrames[i].Pose
+		if !p.KeyFrames[i].Fixed {
+			p.KeyFrames[i].Pose = perturb(rng, poses[i], rot, trans)
+		}
+	}
+	for i := range p.Points {
+		points[i] = p.Points[i].Position
+		p.Points[i].Position = points[i].Add(geom.Vec3{rng.NormFloat64(), rng.NormFloat64(), rng.NormFloat64()}.Scale(point))
+	}
+	return poses, points
+}
+
+func TestLocalBundleAdjustmentConverges(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	p := syntheticBundleScene(rng, 12, 500, 6, 0)
+	// fix 2 keyframes to remove the gauge freedom (including scale)
+	p.KeyFrames[0].Fixed = true
+	p.KeyFrames[1].Fixed = true
+	poses, points := perturbBundle(rng, p, 0.01, 0.05, 0.05)
+
+	stats := LocalBundleAdjustment(context.Background(), p)
+	if stats.FinalCost >= stats.InitialCost {
+		t.Fatalf("cost did not decrease: %v -> %v", stats.InitialCost, stats.FinalCost)
+	}
+	if stats.NumOutliers != 0 {
+		t.Errorf("got %d outliers without noise", stats.NumOutliers)
+	}
+	for i, kf := range p.KeyFrames {
+		rotErr := kf.Pose.R.Mul(poses[i].R.Inverse()).Angle()
+		transErr := kf.Pose.Center().Sub(poses[i].Center()).Norm()
+		if rotErr > 1e-4 || transErr > 1e-3 {
+			t.Errorf("keyframe %d: rotation error %v, translation error %v", i, rotErr, transErr)
+		}
+	}
+	for i, pt := range p.Points {
+		if d := pt.Position.Sub(points[i]).Norm(); d > 1e-3 {
+			t.Fatalf("point %d: error %v", i, d)
+		}
+	}
+}
+
+func TestLocalBundleAdjustmentOutliers(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	p := syntheticBundleScene(rng, 10, 400, 5, 1)
+	p.KeyFrames[0].Fixed = true
+	p.KeyFrames[1].Fixed = true
+	isOutlier := make([]bool, len(p.Observations))
+	for i := range p.Observations {
+		if rng.Float64() < 0.05 {
+			isOutlier[i] = true
+			p.Observations[i].U += 30 + rng.Float64()*50
+			p.Observations[i].V -= 30 + rng.Float64()*50
+		}
+	}
+	poses, _ := perturbBundle(rng, p, 0.005, 0.02, 0.02)
+
+	LocalBundleAdjustment(context.Background(), p)
+	var missed int
+	for i, o := range p.Observations {
+		if isOutlier[i] && !o.Outlier {
+			missed++
+		}
+	}
+	if missed > 0 {
+		t.Errorf("%d gross outliers were not detected", missed)
+	}
+	// with pixel noise the keyframes can't be recovered exactly, but they should be within 1% of
+	// the radius of the circle
+	for i, kf := range p.KeyFrames {
+		transErr := kf.Pose.Center().Sub(poses[i].Center()).Norm()
+		if transErr > 0.1 {
+			t.Errorf("keyframe %d: translation error %v", i, transErr)
+		}
+	}
+}
+
+func TestLocalBundleAdjustmentCancelled(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	p := syntheticBundleScene(rng, 6, 100, 4, 0)
+	p.KeyFrames[0].Fixed = true
+	perturbBundle(rng, p, 0.01, 0.05, 0.05)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	stats := LocalBundleAdjustment(ctx, p)
+	if !stats.Aborted || stats.Iterations != 0 {
+		t.Errorf("expected an aborted run with no iterations, got %+v", stats)
+	}
+}
+
+// A point seen by a single stereo keyframe has its depth measured, which a monocular keyframe can't
+func TestBundleAdjustmentStereoDepth(t *testing.T) {
+	rng := rand.New(rand.NewSource(4))
+	p := &BundleProblem{
+		Camera:    testCam,
+		Bf:        testBf,
+		InvSigma2: testPyramid.InvSigma2,
+		KeyFrames: []BAKeyFrame{{Pose: circlePose(0, 1, 10), Fixed: true}},
+	}
+	var truth []geom.Vec3
+	for i := 0; i < 50; i++ {
+		pw := geom.Vec3{rng.NormFloat64(), rng.NormFloat64(), rng.NormFloat64()}
+		s := stereoProject(p.KeyFrames[0].Pose.Transform(pw))
+		truth = append(truth, pw)
+		// the point starts 20% too far away along its viewing ray
+		center := p.KeyFrames[0].Pose.Center()
+		p.Points = append(p.Points, BAPoint{Position: center.Add(pw.Sub(center).Scale(1.2))})
+		p.Observations = append(p.Observations, BAObservation{Point: i, U: s[0], V: s[1], URight: s[2]})
+	}
+	LocalBundleAdjustment(context.Background(), p)
+	for i, pt := range p.Points {
+		if d := pt.Position.Sub(truth[i]).Norm(); d > 1e-3 {
+			t.Fatalf("point %d: error %v", i, d)
+		}
+	}
+}
+
+func TestProjectionJacobianPoint(t *testing.T) {
+	pose := geom.ExpSE3([6]float64{0.1, 0.2, -0.1, 0.5, -0.2, 0.3})
+	pw := geom.Vec3{0.4, -0.3, 4}
+	r := newReprojection(testCam, testBf, pose.Transform(pw), 0, 0, 0)
+	j := projectionJacobianPoint(&r, pose.R.Matrix())
+	const h = 1e-6
+	for c := 0; c < 3; c++ {
+		var d geom.Vec3
+		d[c] = h
+		plus := stereoProject(pose.Transform(pw.Add(d)))
+		minus := stereoProject(pose.Transform(pw.Sub(d)))
+		for row := 0; row < 3; row++ {
+			numeric := -(plus[row] - minus[row]) / (2 * h)
+			if math.Abs(numeric-j[row][c]) > 1e-4 {
+				t.Errorf("row %d column %d: analytic %v numeric %v", row, c, j[row][c], numeric)
+			}
+		}
+	}
+}
+
+func BenchmarkLocalBundleAdjustment(b *testing.B) {
+	rng := rand.New(rand.NewSource(1))
+	scene := syntheticBundleScene(rng, 300, 20000, 8, 1)
+	for i := 0; i < 20; i++ {
+		scene.KeyFrames[i].Fixed = true
+	}
+	perturbBundle(rng, scene, 0.002, 0.01, 0.02)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		p := *scene
+		p.KeyFrames = append([]BAKeyFrame(nil), scene.KeyFrames...)
+		p.Points = append([]BAPoint(nil), scene.Points...)
+		p.Observations = append([]BAObservation(nil), scene.Observations...)
+		b.StartTimer()
+		LocalBundleAdjustment(context.Background(), &p)
+	}
+}
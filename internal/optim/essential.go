@@ -0,0 +1,142 @@
+package optim
+
+import (
+	"context"
+
+	"github.com/kegsay/gorbslam/internal/geom"
+	"github.com/kegsay/gorbslam/internal/graph"
+)
+
+// The minimum number of shared map points for a covisibility edge or new loop connection to be
+// part of the essential graph.
+const EssentialMinWeight = 100
+
+const essentialIterations = 20
+
+// EssentialKeyFrame is a keyframe in the essential graph.
+type EssentialKeyFrame struct {
+	// The pose Tcw before the loop correction. Updated in place with the optimised pose.
+	Pose geom.SE3
+	// The corrected pose Scw for the keyframes around the current keyframe, which the loop closer
+	// corrected by propagating the loop Sim3. nil for every other keyframe.
+	Corrected *geom.Sim3
+	// The parent in the spanning tree, or -1 for the root
+	Parent int
+}
+
+// EssentialEdge links two keyframes which share Weight map points.
+type EssentialEdge struct {
+	I      int
+	J      int
+	Weight int
+}
+
+// EssentialPoint is a map point to correct after optimising the keyframes.
+type EssentialPoint struct {
+	// World position, updated in place
+	Position geom.Vec3
+	// The keyframe whose correction is applied to the point. ORB-SLAM2 uses the keyframe which
+	// corrected the point during loop fusion if there is one, otherwise the point's reference
+	// keyframe.
+	Reference int
+}
+
+// EssentialGraph is the sparse subset of the covisibility graph optimised when closing a loop:
+// the spanning tree, covisibility edges with a high weight and loop edges.
+type EssentialGraph struct {
+	KeyFrames []EssentialKeyFrame
+	// Covisibility edges. Only those with at least EssentialMinWeight shared points are used.
+	Covisibility []EssentialEdge
+	// Loop edges from previous loop closures
+	Loops []EssentialEdge
+	// Connections made by fusing map points around the current loop. Unlike the other edges
+	// they are measured from the corrected poses.
+	LoopConnections []EssentialEdge
+	Points          []EssentialPoint
+	// The keyframes closing the loop. The loop keyframe is held fixed.
+	CurrentKeyFrame int
+	LoopKeyFrame    int
+	// Fix the scale for stereo/RGB-D, where it is observable
+	FixScale bool
+}
+
+// OptimizeEssentialGraph corrects the drift accumulated around a loop by optimising the Sim3 poses
+// of every keyframe over the essential graph. Each edge is a relative Sim3 measurement, so the loop
+// error is spread over the whole loop rather than concentrated at the closing keyframes. Map
+// points are then moved with their reference keyframe: P <- Scw_optimised^-1 * Scw_initial * P.
+// Points which were already corrected during loop fusion should reference a keyframe with a
+// Corrected pose, so they are only moved by the change the optimisation made.
+// Learning: Strasdat et al: "Scale Drift-Aware Large Scale Monocular SLAM" (2010)
+//
+// Returns the optimised Scw of each keyframe. The Pose of each keyframe is updated to the SE3
+// [R t/s] and points are updated in place.
+func OptimizeEssentialGraph(ctx context.Context, eg *EssentialGraph) ([]geom.Sim3, error) {
+	g := &graph.Graph{}
+	n := len(eg.KeyFrames)
+	vertices := make([]*graph.VertexSim3, n)
+	// the uncorrected and initial (possibly corrected) poses
+	uncorrected := make([]geom.Sim3, n)
+	initial := make([]geom.Sim3, n)
+	for i, kf := range eg.KeyFrames {
+		uncorrected[i] = kf.Pose.Sim3()
+		initial[i] = uncorrected[i]
+		if kf.Corrected != nil {
+			initial[i] = *kf.Corrected
+		}
+		v := &graph.VertexSim3{Estimate: initial[i], FixScale: eg.FixScale}
+		v.Fixed = i == eg.LoopKeyFrame
+		g.AddVertex(v)
+		vertices[i] = v
+	}
+
+	inserted := make(map[[2]int]bool)
+	insert := func(i, j int, poses []geom.Sim3) {
+		key := [2]int{i, j}
+		if i > j {
+			key = [2]int{j, i}
+		}
+		if i == j || inserted[key] {
+			return
+		}
+		inserted[key] = true
+		sji := poses[j].Mul(poses[i].Inverse())
+		g.AddEdge(graph.NewEdgeSim3(vertices[i], vertices[j], sji))
+	}
+
+	for _, e := range eg.LoopConnections {
+		isLoop := (e.I == eg.CurrentKeyFrame && e.J == eg.LoopKeyFrame) || (e.J == eg.CurrentKeyFrame && e.I == eg.LoopKeyFrame)
+		if e.Weight < EssentialMinWeight && !isLoop {
+			continue
+		}
+		insert(e.I, e.J, initial)
+	}
+	for i, kf := range eg.KeyFrames {
+		if kf.Parent >= 0 {
+			insert(i, kf.Parent, uncorrected)
+		}
+	}
+	for _, e := range eg.Loops {
+		insert(e.I, e.J, uncorrected)
+	}
+	for _, e := range eg.Covisibility {
+		if e.Weight >= EssentialMinWeight {
+			insert(e.I, e.J, uncorrected)
+		}
+	}
+
+	if _, err := g.Optimize(ctx, essentialIterations); err != nil {
+		return nil, err
+	}
+
+	corrected := make([]geom.Sim3, n)
+	for i, v := range vertices {
+		corrected[i] = v.Estimate
+		eg.KeyFrames[i].Pose = v.Estimate.SE3()
+	}
+	for i := range eg.Points {
+		p := &eg.Points[i]
+		r := p.Reference
+		p.Position = corrected[r].Inverse().Transform(initial[r].Transform(p.Position))
+	}
+	return corrected, nil
+}
@@ -0,0 +1,147 @@
+package optim
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+
+	"github.com/kegsay/gorbslam/internal/geom"
+)
+
+type driftScene struct {
+	eg         *EssentialGraph
+	truth      []geom.SE3
+	truePoints []geom.Vec3
+}
+
+// A loop of n keyframes around a circle, where each relative motion picks up a little rotation
+// drift and the scale of the map slowly grows, as it does with monocular SLAM. The last keyframe
+// has detected a loop with the first, and the loop closer has corrected the last few keyframes
+// (and the points they reference) using the loop Sim3.
+func newDriftScene(rng *rand.Rand, n int, scaleDrift, rotDrift float64) *driftScene {
+	s := &driftScene{eg: &EssentialGraph{CurrentKeyFrame: n - 1, LoopKeyFrame: 0}}
+	scales := make([]float64, n)
+	drifted := make([]geom.SE3, n)
+	for i := 0; i < n; i++ {
+		s.truth = append(s.truth, circlePose(i, n, 10))
+		scales[i] = 1
+		drifted[i] = s.truth[i]
+		if i > 0 {
+			scales[i] = scales[i-1] * (1 + scaleDrift)
+			rel := s.truth[i].Mul(s.truth[i-1].Inverse())
+			rel.R = geom.ExpSO3(geom.Vec3{rotDrift, rotDrift / 2, -rotDrift}).Mul(rel.R)
+			rel.T = rel.T.Scale(scales[i])
+			drifted[i] = rel.Mul(drifted[i-1])
+		}
+		s.eg.KeyFrames = append(s.eg.KeyFrames, EssentialKeyFrame{Pose: drifted[i], Parent: i - 1})
+	}
+
+	// the loop Sim3 maps the world into the (scaled) frame of the current keyframe, and is
+	// propagated to its neighbours
+	const neighbours = 3
+	cur := n - 1
+	scw := geom.NewSim3(s.truth[cur].R.Matrix(), s.truth[cur].T.Scale(scales[cur]), scales[cur])
+	for i := n - neighbours; i < n; i++ {
+		sic := drifted[i].Sim3().Mul(drifted[cur].Sim3().Inverse())
+		corrected := sic.Mul(scw)
+		s.eg.KeyFrames[i].Corrected = &corrected
+	}
+
+	for i := 0; i < n; i++ {
+		for _, d := range []int{1, 2, 3} {
+			if i+d < n {
+				// only adjacent keyframes share enough points to be in the essential graph
+				s.eg.Covisibility = append(s.eg.Covisibility, EssentialEdge{I: i, J: i + d, Weight: 300 / (d * d)})
+			}
+		}
+		// points seen by this keyframe, in the drifted map
+		for k := 0; k < 5; k++ {
+			pc := geom.Vec3{rng.Float64() - 0.5, rng.Float64() - 0.5, 5 + rng.Float64()}
+			x := s.truth[i].Inverse().Transform(pc)
+			position := drifted[i].Inverse().Transform(pc.Scale(scales[i]))
+			if c := s.eg.KeyFrames[i].Corrected; c != nil {
+				// already moved when fusing the loop
+				position = c.Inverse().Transform(drifted[i].Transform(position))
+			}
+			s.truePoints = append(s.truePoints, x)
+			s.eg.Points = append(s.eg.Points, EssentialPoint{Position: position, Reference: i})
+		}
+	}
+	for a := n - neighbours; a < n; a++ {
+		for b := 0; b < neighbours; b++ {
+			weight := 150
+			if a == cur && b == 0 {
+				// the loop edge itself is always included
+				weight = 20
+			}
+			s.eg.LoopConnections = append(s.eg.LoopConnections, EssentialEdge{I: a, J: b, Weight: weight})
+		}
+	}
+	return s
+}
+
+func (s *driftScene) errors() (maxKeyFrame, maxPoint float64) {
+	for i, kf := range s.eg.KeyFrames {
+		if d := kf.Pose.Center().Sub(s.truth[i].Center()).Norm(); d > maxKeyFrame {
+			maxKeyFrame = d
+		}
+	}
+	for i, p := range s.eg.Points {
+		if d := p.Position.Sub(s.truePoints[i]).Norm(); d > maxPoint {
+			maxPoint = d
+		}
+	}
+	return maxKeyFrame, maxPoint
+}
+
+func TestOptimizeEssentialGraphCorrectsDrift(t *testing.T) {
+	testCases := []struct {
+		name       string
+		scaleDrift float64
+		rotDrift   float64
+	}{
+		{name: "rotation drift", rotDrift: 0.002},
+		{name: "scale drift", scaleDrift: 0.01},
+		{name: "rotation and scale drift", scaleDrift: 0.01, rotDrift: 0.002},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newDriftScene(rand.New(rand.NewSource(1)), 40, tc.scaleDrift, tc.rotDrift)
+			kfBefore, pointBefore := s.errors()
+			loopPose := s.eg.KeyFrames[0].Pose
+
+			corrected, err := OptimizeEssentialGraph(context.Background(), s.eg)
+			if err != nil {
+				t.Fatalf("OptimizeEssentialGraph: %s", err)
+			}
+			if len(corrected) != len(s.eg.KeyFrames) {
+				t.Fatalf("got %d corrected poses want %d", len(corrected), len(s.eg.KeyFrames))
+			}
+			if s.eg.KeyFrames[0].Pose != loopPose {
+				t.Errorf("the loop keyframe moved")
+			}
+			kfAfter, pointAfter := s.errors()
+			t.Logf("keyframe error %v -> %v, point error %v -> %v", kfBefore, kfAfter, pointBefore, pointAfter)
+			// the drift can't be removed entirely since the relative measurements themselves have
+			// drifted, but it is spread around the loop
+			if kfAfter > kfBefore/4 || kfAfter > 0.3 {
+				t.Errorf("keyframe drift not corrected: %v -> %v", kfBefore, kfAfter)
+			}
+			if pointAfter > pointBefore/4 || pointAfter > 0.3 {
+				t.Errorf("point drift not corrected: %v -> %v", pointBefore, pointAfter)
+			}
+		})
+	}
+}
+
+func TestOptimizeEssentialGraphNoDrift(t *testing.T) {
+	// with a consistent map the optimisation must not move anything
+	s := newDriftScene(rand.New(rand.NewSource(2)), 20, 0, 0)
+	if _, err := OptimizeEssentialGraph(context.Background(), s.eg); err != nil {
+		t.Fatalf("OptimizeEssentialGraph: %s", err)
+	}
+	kf, point := s.errors()
+	if kf > 1e-6 || point > 1e-6 {
+		t.Errorf("consistent map was changed: keyframe error %v point error %v", kf, point)
+	}
+}
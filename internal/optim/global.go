@@ -0,0 +1,269 @@
+package optim
+
+import (
+	"context"
+	"sync"
+
+	"github.com/kegsay/gorbslam/internal/camera"
+	"github.com/kegsay/gorbslam/internal/geom"
+)
+
+const globalBAIterations = 10
+
+// GlobalBAKeyFrame is a keyframe in a global bundle adjustment snapshot.
+type GlobalBAKeyFrame struct {
+	ID   int64
+	Pose geom.SE3
+	// The parent in the spanning tree, or -1 for the root. The root is held fixed.
+	Parent int64
+}
+
+// GlobalBAPoint is a map point in a global bundle adjustment snapshot.
+type GlobalBAPoint struct {
+	ID       int64
+	Position geom.Vec3
+	// The reference keyframe, used to correct points created while the optimisation was running
+	Reference int64
+}
+
+// GlobalBAObservation is a keypoint in a keyframe which observes a map point.
+type GlobalBAObservation struct {
+	KeyFrame int64
+	Point    int64
+	U        float64
+	V        float64
+	Octave   int
+}
+
+// GlobalBAProblem is a snapshot of the whole map.
+type GlobalBAProblem struct {
+	Camera       camera.Pinhole
+	InvSigma2    []float64
+	KeyFrames    []GlobalBAKeyFrame
+	Points       []GlobalBAPoint
+	Observations []GlobalBAObservation
+}
+
+// GlobalBAResult is the optimised state of the keyframes and points in a snapshot.
+type GlobalBAResult struct {
+	// The loop keyframe which triggered the optimisation
+	LoopKeyFrame int64
+	Poses        map[int64]geom.SE3
+	Points       map[int64]geom.Vec3
+	Stats        BAStats
+}
+
+// GlobalBAMap is implemented by the map so that global bundle adjustment can run without holding
+// the map lock for the (long) duration of the optimisation.
+type GlobalBAMap interface {
+	// GlobalBASnapshot returns a consistent copy of every keyframe, point and observation.
+	GlobalBASnapshot() *GlobalBAProblem
+	// ApplyGlobalBA merges a completed optimisation into the map. Implementations should hold
+	// the map lock, and use GlobalBAResult.Propagate to correct the keyframes and points which
+	// were created since the snapshot was taken.
+	ApplyGlobalBA(result *GlobalBAResult)
+}
+
+// GlobalBundleAdjustment optimises every keyframe and point in the problem, with a Huber kernel
+// and no outlier rejection, as ORB-SLAM2 does after closing a loop.
+func GlobalBundleAdjustment(ctx context.Context, problem *GlobalBAProblem, loopKeyFrame int64) *GlobalBAResult {
+	p := &BundleProblem{
+		Camera:    problem.Camera,
+		InvSigma2: problem.InvSigma2,
+	}
+	kfIndex := make(map[int64]int, len(problem.KeyFrames))
+	for i, kf := range problem.KeyFrames {
+		kfIndex[kf.ID] = i
+		p.KeyFrames = append(p.KeyFrames, BAKeyFrame{Pose: kf.Pose, Fixed: kf.Parent < 0})
+	}
+	pointIndex := make(map[int64]int, len(problem.Points))
+	for i, pt := range problem.Points {
+		pointIndex[pt.ID] = i
+		p.Points = append(p.Points, BAPoint{Position: pt.Position})
+	}
+	for _, o := range problem.Observations {
+		kf, ok := kfIndex[o.KeyFrame]
+		if !ok {
+			continue
+		}
+		pt, ok := pointIndex[o.Point]
+		if !ok {
+			continue
+		}
+		p.Observations = append(p.Observations, BAObservation{KeyFrame: kf, Point: pt, U: o.U, V: o.V, Octave: o.Octave})
+	}
+
+	stats := p.Optimize(ctx, globalBAIterations, true)
+	result := &GlobalBAResult{
+		LoopKeyFrame: loopKeyFrame,
+		Poses:        make(map[int64]geom.SE3, len(p.KeyFrames)),
+		Points:       make(map[int64]geom.Vec3, len(p.Points)),
+		Stats:        stats,
+	}
+	for i, kf := range problem.KeyFrames {
+		result.Poses[kf.ID] = p.KeyFrames[i].Pose
+	}
+	for i, pt := range problem.Points {
+		result.Points[pt.ID] = p.Points[i].Position
+	}
+	return result
+}
+
+// Propagate applies the result to the current state of the map, updating the keyframes and
+// points in place. Keyframes which were not optimised (because they were created during the
+// optimisation) are corrected by keeping their pose relative to their parent in the spanning
+// tree, and points which were not optimised move with their reference keyframe.
+func (r *GlobalBAResult) Propagate(keyFrames []GlobalBAKeyFrame, points []GlobalBAPoint) {
+	children := make(map[int64][]int)
+	var queue []int
+	for i, kf := range keyFrames {
+		if kf.Parent < 0 {
+			queue = append(queue, i)
+		} else {
+			children[kf.Parent] = append(children[kf.Parent], i)
+		}
+	}
+	corrected := make(map[int64]geom.SE3, len(keyFrames))
+	before := make(map[int64]geom.SE3, len(keyFrames))
+	for _, i := range queue {
+		if pose, ok := r.Poses[keyFrames[i].ID]; ok {
+			corrected[keyFrames[i].ID] = pose
+		} else {
+			corrected[keyFrames[i].ID] = keyFrames[i].Pose
+		}
+	}
+	// breadth first through the spanning tree so parents are corrected before their children
+	for len(queue) > 0 {
+		i := queue[0]
+		queue = queue[1:]
+		kf := &keyFrames[i]
+		for _, c := range children[kf.ID] {
+			child := &keyFrames[c]
+			if pose, ok := r.Poses[child.ID]; ok {
+				corrected[child.ID] = pose
+			} else {
+				// keep the pose relative to the parent: Tchild_parent * Tparent_w(corrected)
+				tcp := child.Pose.Mul(kf.Pose.Inverse())
+				corrected[child.ID] = tcp.Mul(corrected[kf.ID])
+			}
+			queue = append(queue, c)
+		}
+		before[kf.ID] = kf.Pose
+		kf.Pose = corrected[kf.ID]
+	}
+
+	for i := range points {
+		p := &points[i]
+		if pos, ok := r.Points[p.ID]; ok {
+			p.Position = pos
+			continue
+		}
+		old, ok := before[p.Reference]
+		if !ok {
+			continue
+		}
+		// into the reference keyframe's frame with its old pose, then back out with the new one
+		p.Position = corrected[p.Reference].Inverse().Transform(old.Transform(p.Position))
+	}
+}
+
+// GlobalBA runs global bundle adjustment in a background goroutine. Only one optimisation runs at
+// a time: starting a new one (e.g because another loop was closed) aborts the one in progress.
+// Learning: https://youtu.be/0I30M6yTklo?t=281
+type GlobalBA struct {
+	m GlobalBAMap
+	// serialises Start and Stop
+	control sync.Mutex
+	// protects the fields below, and is held while a result is applied so that a run can't be
+	// applied after Stop returns
+	mu      sync.Mutex
+	cancel  context.CancelFunc
+	done    chan struct{}
+	applied int
+}
+
+// NewGlobalBA creates a runner which optimises the map m.
+func NewGlobalBA(m GlobalBAMap) *GlobalBA {
+	return &GlobalBA{m: m}
+}
+
+// Start aborts any optimisation in progress, then snapshots the map and optimises it in the
+// background. The result is applied to the map unless the run is aborted first.
+func (g *GlobalBA) Start(ctx context.Context, loopKeyFrame int64) {
+	g.control.Lock()
+	defer g.control.Unlock()
+	g.stop()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	g.cancel = cancel
+	g.done = done
+	go g.run(ctx, loopKeyFrame, done)
+}
+
+func (g *GlobalBA) run(ctx context.Context, loopKeyFrame int64, done chan struct{}) {
+	defer close(done)
+	result := GlobalBundleAdjustment(ctx, g.m.GlobalBASnapshot(), loopKeyFrame)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	// Stop cancels with the lock held, so once we've checked here we can't be aborted
+	if ctx.Err() != nil {
+		return
+	}
+	g.m.ApplyGlobalBA(result)
+	g.applied++
+}
+
+// Stop aborts the optimisation in progress, if any, and waits for it to finish. The result of an
+// aborted optimisation is discarded.
+func (g *GlobalBA) Stop() {
+	g.control.Lock()
+	defer g.control.Unlock()
+	g.stop()
+}
+
+func (g *GlobalBA) stop() {
+	g.mu.Lock()
+	if g.cancel != nil {
+		g.cancel()
+	}
+	done := g.done
+	g.mu.Unlock()
+	if done != nil {
+		<-done
+	}
+}
+
+// Running returns true if an optimisation is in progress
+func (g *GlobalBA) Running() bool {
+	g.mu.Lock()
+	done := g.done
+	g.mu.Unlock()
+	if done == nil {
+		return false
+	}
+	select {
+	case <-done:
+		return false
+	default:
+		return true
+	}
+}
+
+// Wait blocks until the optimisation in progress, if any, completes.
+func (g *GlobalBA) Wait() {
+	g.mu.Lock()
+	done := g.done
+	g.mu.Unlock()
+	if done != nil {
+		<-done
+	}
+}
+
+// Applied returns the number of optimisations which have been applied to the map
+func (g *GlobalBA) Applied() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.applied
+}
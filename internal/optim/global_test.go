@@ -0,0 +1,232 @@
+package optim
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/kegsay/gorbslam/internal/geom"
+)
+
+func TestGlobalBAResultPropagate(t *testing.T) {
+	// the optimisation moved the whole map by the rigid transform c. Keyframes 3 and 4 and point 2
+	// were created during the optimisation so aren't in the result, but must move the same way.
+	c := geom.ExpSE3([6]float64{0.1, -0.05, 0.2, 0.5, 0.1, -0.3})
+	keyFrames := []GlobalBAKeyFrame{
+		{ID: 0, Parent: -1, Pose: geom.IdentitySE3()},
+		{ID: 1, Parent: 0, Pose: geom.ExpSE3([6]float64{0, 0.1, 0, 1, 0, 0})},
+		{ID: 2, Parent: 1, Pose: geom.ExpSE3([6]float64{0, 0.2, 0, 2, 0, 0})},
+		{ID: 3, Parent: 2, Pose: geom.ExpSE3([6]float64{0, 0.3, 0, 3, 0.1, 0})},
+		{ID: 4, Parent: 3, Pose: geom.ExpSE3([6]float64{0, 0.4, 0, 4, 0.2, 0})},
+	}
+	points := []GlobalBAPoint{
+		{ID: 0, Reference: 0, Position: geom.Vec3{0, 0, 5}},
+		{ID: 1, Reference: 2, Position: geom.Vec3{1, 0, 5}},
+		{ID: 2, Reference: 4, Position: geom.Vec3{3, 1, 5}},
+	}
+	result := &GlobalBAResult{
+		Poses:  make(map[int64]geom.SE3),
+		Points: make(map[int64]geom.Vec3),
+	}
+	for _, kf := range keyFrames[:3] {
+		result.Poses[kf.ID] = kf.Pose.Mul(c)
+	}
+	for _, p := range points[:2] {
+		result.Points[p.ID] = c.Inverse().Transform(p.Position)
+	}
+	wantPoses := make([]geom.SE3, len(keyFrames))
+	for i, kf := range keyFrames {
+		wantPoses[i] = kf.Pose.Mul(c)
+	}
+	wantPoints := make([]geom.Vec3, len(points))
+	for i, p := range points {
+		wantPoints[i] = c.Inverse().Transform(p.Position)
+	}
+
+	result.Propagate(keyFrames, points)
+	for i, kf := range keyFrames {
+		rotErr := kf.Pose.R.Mul(wantPoses[i].R.Inverse()).Angle()
+		transErr := kf.Pose.Center().Sub(wantPoses[i].Center()).Norm()
+		if rotErr > 1e-9 || transErr > 1e-9 {
+			t.Errorf("keyframe %d: rotation error %v translation error %v", i, rotErr, transErr)
+		}
+	}
+	for i, p := range points {
+		if d := p.Position.Sub(wantPoints[i]).Norm(); d > 1e-9 {
+			t.Errorf("point %d: error %v", i, d)
+		}
+	}
+}
+
+// Convert a bundle scene into a global BA snapshot, where keyframe 0 is the root of a chain.
+func globalBAProblem(p *BundleProblem) *GlobalBAProblem {
+	problem := &GlobalBAProblem{Camera: p.Camera, InvSigma2: p.InvSigma2}
+	for i, kf := range p.KeyFrames {
+		problem.KeyFrames = append(problem.KeyFrames, GlobalBAKeyFrame{ID: int64(i), Pose: kf.Pose, Parent: int64(i) - 1})
+	}
+	for i, pt := range p.Points {
+		problem.Points = append(problem.Points, GlobalBAPoint{ID: int64(i), Position: pt.Position})
+	}
+	for _, o := range p.Observations {
+		problem.Observations = append(problem.Observations, GlobalBAObservation{
+			KeyFrame: int64(o.KeyFrame), Point: int64(o.Point), U: o.U, V: o.V, Octave: o.Octave,
+		})
+	}
+	for i := range problem.Points {
+		problem.Points[i].Reference = problem.Observations[0].KeyFrame
+	}
+	return problem
+}
+
+func TestGlobalBundleAdjustment(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	scene := syntheticBundleScene(rng, 10, 300, 5, 0)
+	// leave the first two keyframes at their true poses so the perturbed map has the right scale,
+	// but global BA only holds the root fixed
+	scene.KeyFrames[0].Fixed = true
+	scene.KeyFrames[1].Fixed = true
+	perturbBundle(rng, scene, 0.005, 0.02, 0.02)
+	problem := globalBAProblem(scene)
+	result := GlobalBundleAdjustment(context.Background(), problem, 7)
+	if result.LoopKeyFrame != 7 {
+		t.Errorf("LoopKeyFrame: got %d want 7", result.LoopKeyFrame)
+	}
+	if len(result.Poses) != len(problem.KeyFrames) || len(result.Points) != len(problem.Points) {
+		t.Fatalf("result is missing keyframes or points")
+	}
+	if result.Stats.FinalCost > result.Stats.InitialCost/100 {
+		t.Errorf("cost did not drop: %v -> %v", result.Stats.InitialCost, result.Stats.FinalCost)
+	}
+	if result.Poses[0] != problem.KeyFrames[0].Pose {
+		t.Errorf("root keyframe moved")
+	}
+}
+
+// fakeMap is a map which tracking keeps adding keyframes to while global BA runs.
+type fakeMap struct {
+	mu        sync.Mutex
+	problem   *GlobalBAProblem
+	snapshots chan struct{}
+	release   chan struct{}
+	applied   []*GlobalBAResult
+}
+
+func (m *fakeMap) GlobalBASnapshot() *GlobalBAProblem {
+	m.mu.Lock()
+	snapshot := &GlobalBAProblem{
+		Camera:       m.problem.Camera,
+		InvSigma2:    m.problem.InvSigma2,
+		KeyFrames:    append([]GlobalBAKeyFrame(nil), m.problem.KeyFrames...),
+		Points:       append([]GlobalBAPoint(nil), m.problem.Points...),
+		Observations: append([]GlobalBAObservation(nil), m.problem.Observations...),
+	}
+	m.mu.Unlock()
+	if m.snapshots != nil {
+		m.snapshots <- struct{}{}
+		<-m.release
+	}
+	return snapshot
+}
+
+func (m *fakeMap) ApplyGlobalBA(result *GlobalBAResult) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	result.Propagate(m.problem.KeyFrames, m.problem.Points)
+	m.applied = append(m.applied, result)
+}
+
+// Add a keyframe as a child of the last keyframe, as tracking does
+func (m *fakeMap) addKeyFrame(pose geom.SE3) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	last := m.problem.KeyFrames[len(m.problem.KeyFrames)-1]
+	m.problem.KeyFrames = append(m.problem.KeyFrames, GlobalBAKeyFrame{ID: last.ID + 1, Pose: pose, Parent: last.ID})
+}
+
+func TestGlobalBARunner(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	scene := syntheticBundleScene(rng, 8, 200, 4, 0)
+	perturbBundle(rng, scene, 0.002, 0.01, 0.01)
+	m := &fakeMap{
+		problem:   globalBAProblem(scene),
+		snapshots: make(chan struct{}),
+		release:   make(chan struct{}),
+	}
+	numSnapshot := len(m.problem.KeyFrames)
+	g := NewGlobalBA(m)
+	g.Start(context.Background(), 3)
+	<-m.snapshots
+	if !g.Running() {
+		t.Errorf("expected the optimisation to be running")
+	}
+	close(m.release)
+	// tracking carries on while the optimisation runs
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 5; i++ {
+			m.addKeyFrame(circlePose(i, 5, 12))
+		}
+	}()
+	wg.Wait()
+	m.mu.Lock()
+	relBefore := m.problem.KeyFrames[numSnapshot].Pose.Mul(m.problem.KeyFrames[numSnapshot-1].Pose.Inverse())
+	m.mu.Unlock()
+
+	g.Wait()
+	if g.Running() {
+		t.Errorf("expected the optimisation to have finished")
+	}
+	if g.Applied() != 1 {
+		t.Fatalf("Applied: got %d want 1", g.Applied())
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.applied) != 1 || m.applied[0].LoopKeyFrame != 3 {
+		t.Fatalf("result was not applied to the map")
+	}
+	// the first keyframe created during the run keeps its pose relative to its parent
+	relAfter := m.problem.KeyFrames[numSnapshot].Pose.Mul(m.problem.KeyFrames[numSnapshot-1].Pose.Inverse())
+	for i, d := range relAfter.Mul(relBefore.Inverse()).Log() {
+		if math.Abs(d) > 1e-9 {
+			t.Errorf("relative pose of new keyframe changed: element %d is %v", i, d)
+		}
+	}
+	if m.problem.KeyFrames[numSnapshot-1].Pose != m.applied[0].Poses[int64(numSnapshot-1)] {
+		t.Errorf("optimised keyframe pose was not applied")
+	}
+}
+
+func TestGlobalBAAborted(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	scene := syntheticBundleScene(rng, 6, 100, 4, 0)
+	m := &fakeMap{
+		problem:   globalBAProblem(scene),
+		snapshots: make(chan struct{}),
+		release:   make(chan struct{}),
+	}
+	g := NewGlobalBA(m)
+	ctx, cancel := context.WithCancel(context.Background())
+	g.Start(ctx, 1)
+	<-m.snapshots
+	// a new loop is detected while the optimisation is running
+	cancel()
+	close(m.release)
+	g.Wait()
+	if g.Applied() != 0 {
+		t.Errorf("aborted optimisation was applied")
+	}
+	// stopping when nothing is running is fine
+	g.Stop()
+
+	// and a new run can be started afterwards
+	m.snapshots = nil
+	g.Start(context.Background(), 2)
+	g.Wait()
+	if g.Applied() != 1 {
+		t.Errorf("Applied: got %d want 1", g.Applied())
+	}
+}
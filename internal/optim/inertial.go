@@ -0,0 +1,171 @@
+package optim
+
+import (
+	"context"
+	"errors"
+	"math"
+
+	"github.com/kegsay/gorbslam/internal/geom"
+	"github.com/kegsay/gorbslam/internal/graph"
+	"github.com/kegsay/gorbslam/internal/imu"
+)
+
+const inertialIterations = 200
+
+// ErrTooFewInertialKeyFrames is returned if an inertial initialisation has fewer than two keyframes
+// with IMU measurements between them.
+var ErrTooFewInertialKeyFrames = errors.New("optim: too few keyframes with IMU measurements")
+
+// InertialKeyFrame is a keyframe in an inertial initialisation.
+type InertialKeyFrame struct {
+	// The pose Tcw, in the units of the map
+	Pose geom.SE3
+	// The IMU motion from the previous keyframe, nil for the first keyframe
+	Preintegrated *imu.Preintegrated
+}
+
+// InertialProblem is the trajectory of the keyframes, in time order, with the IMU measurements
+// between them.
+type InertialProblem struct {
+	KeyFrames []InertialKeyFrame
+	// The initial estimate of the metres per map unit
+	Scale float64
+	// Fix the scale for stereo/RGB-D, where it is already metric
+	FixScale bool
+	// The inverse variances of the priors pulling the gyroscope and accelerometer biases to zero.
+	// ORB-SLAM3 uses 1e2 and 1e10 for the first monocular initialisation, keeping the
+	// accelerometer bias at zero until the trajectory is long enough to tell it from gravity.
+	PriorGyro float64
+	PriorAcc  float64
+}
+
+// InertialResult is the estimated state of the IMU
+type InertialResult struct {
+	// The rotation from the inertial frame, in which gravity points along -z, to the world
+	Rwg geom.SO3
+	// The metres per map unit
+	Scale float64
+	// The bias, common to all the keyframes
+	Bias imu.Bias
+	// The velocity of each keyframe in world coordinates, in metres per second
+	Velocities []geom.Vec3
+	Stats      graph.Stats
+}
+
+// InertialInitialization estimates the direction of gravity, the scale of the map, the IMU
+// biases and the velocity of each keyframe from the trajectory of the keyframes and the IMU
+// measurements between them. The keyframe poses are held fixed, so this is a small problem which
+// converges from a rough estimate: gravity is first guessed by assuming the accelerations average
+// out, and the velocities from the keyframe positions.
+// Learning: Campos et al: "Inertial-Only Optimization for Visual-Inertial Initialization" (2020)
+func InertialInitialization(ctx context.Context, p *InertialProblem) (*InertialResult, error) {
+	n := len(p.KeyFrames)
+	numEdges := 0
+	for i := 1; i < n; i++ {
+		if p.KeyFrames[i].Preintegrated != nil && p.KeyFrames[i].Preintegrated.DeltaT > 0 {
+			numEdges++
+		}
+	}
+	if numEdges == 0 {
+		return nil, ErrTooFewInertialKeyFrames
+	}
+	scale := p.Scale
+	if scale <= 0 {
+		scale = 1
+	}
+
+	// twb and Rwb of each keyframe, with positions scaled by the initial guess
+	twb := make([]geom.SE3, n)
+	for i, kf := range p.KeyFrames {
+		var tcb geom.SE3
+		if i > 0 && kf.Preintegrated != nil {
+			tcb = kf.Preintegrated.Calibration.Tcb
+		} else if i+1 < n && p.KeyFrames[i+1].Preintegrated != nil {
+			tcb = p.KeyFrames[i+1].Preintegrated.Calibration.Tcb
+		} else {
+			tcb = geom.IdentitySE3()
+		}
+		twc := kf.Pose.Inverse()
+		twc.T = twc.T.Scale(scale)
+		twb[i] = twc.Mul(tcb)
+	}
+
+	// Without acceleration the velocity deltas only measure gravity, so their sum points against it
+	var dirG geom.Vec3
+	velocities := make([]geom.Vec3, n)
+	for i := 1; i < n; i++ {
+		pi := p.KeyFrames[i].Preintegrated
+		if pi == nil || pi.DeltaT == 0 {
+			continue
+		}
+		dirG = dirG.Sub(twb[i-1].R.Rotate(pi.DeltaVelocity(pi.Bias)))
+		velocities[i] = twb[i].T.Sub(twb[i-1].T).Scale(1 / pi.DeltaT)
+	}
+	if n > 1 {
+		velocities[0] = velocities[1]
+	}
+	rwg := rotationBetween(geom.Vec3{0, 0, -1}, dirG.Normalised())
+
+	g := &graph.Graph{}
+	poses := make([]*graph.VertexSE3, n)
+	vels := make([]*graph.VertexVelocity, n)
+	for i, kf := range p.KeyFrames {
+		poses[i] = &graph.VertexSE3{Estimate: kf.Pose}
+		poses[i].Fixed = true
+		vels[i] = &graph.VertexVelocity{Estimate: velocities[i]}
+		g.AddVertex(poses[i])
+		g.AddVertex(vels[i])
+	}
+	gyroBias := &graph.VertexBias{}
+	accBias := &graph.VertexBias{}
+	gravity := &graph.VertexGravityDir{Estimate: rwg}
+	scaleVertex := &graph.VertexScale{Estimate: scale}
+	scaleVertex.Fixed = p.FixScale
+	g.AddVertex(gyroBias)
+	g.AddVertex(accBias)
+	g.AddVertex(gravity)
+	g.AddVertex(scaleVertex)
+	g.AddEdge(graph.NewEdgeBiasPrior(gyroBias, geom.Vec3{}, p.PriorGyro))
+	g.AddEdge(graph.NewEdgeBiasPrior(accBias, geom.Vec3{}, p.PriorAcc))
+	for i := 1; i < n; i++ {
+		pi := p.KeyFrames[i].Preintegrated
+		if pi == nil || pi.DeltaT == 0 {
+			continue
+		}
+		g.AddEdge(graph.NewEdgeInertialGS(poses[i-1], vels[i-1], gyroBias, accBias, poses[i], vels[i], gravity, scaleVertex, pi))
+	}
+	stats, err := g.Optimize(ctx, inertialIterations)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &InertialResult{
+		Rwg:        gravity.Estimate,
+		Scale:      scaleVertex.Estimate,
+		Bias:       imu.Bias{Gyro: gyroBias.Estimate, Acc: accBias.Estimate},
+		Velocities: make([]geom.Vec3, n),
+		Stats:      stats,
+	}
+	for i, v := range vels {
+		res.Velocities[i] = v.Estimate
+	}
+	return res, nil
+}
+
+// rotationBetween returns the smallest rotation taking the unit vector a to the unit vector b
+func rotationBetween(a, b geom.Vec3) geom.SO3 {
+	axis := a.Cross(b)
+	n := axis.Norm()
+	if n < 1e-12 {
+		if a.Dot(b) > 0 {
+			return geom.IdentitySO3()
+		}
+		// any perpendicular axis will do
+		axis = a.Cross(geom.Vec3{1, 0, 0})
+		if axis.Norm() < 1e-6 {
+			axis = a.Cross(geom.Vec3{0, 1, 0})
+		}
+		return geom.ExpSO3(axis.Normalised().Scale(math.Pi))
+	}
+	return geom.ExpSO3(axis.Scale(math.Atan2(n, a.Dot(b)) / n))
+}
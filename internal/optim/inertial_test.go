@@ -0,0 +1,92 @@
+package optim
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/kegsay/gorbslam/internal/geom"
+	"github.com/kegsay/gorbslam/internal/imu"
+)
+
+// imuBodyPose returns Rgb and the position, velocity and acceleration of a body moving smoothly in
+// the inertial frame at t seconds, and its angular velocity in the body frame
+func imuBodyPose(t float64) (geom.SO3, geom.Vec3, geom.Vec3, geom.Vec3, geom.Vec3) {
+	axis := geom.Vec3{0.3, -0.4, 1}.Normalised()
+	r := geom.ExpSO3(geom.Vec3{1.2, 0.1, -0.3}).Mul(geom.ExpSO3(axis.Scale(0.6*t + 0.4*math.Sin(1.3*t))))
+	omega := axis.Scale(0.6 + 0.52*math.Cos(1.3*t))
+	p := geom.Vec3{1.5 * math.Sin(0.9*t), 0.8 * math.Cos(1.4*t), 0.3 * math.Sin(1.1*t)}
+	v := geom.Vec3{1.35 * math.Cos(0.9*t), -1.12 * math.Sin(1.4*t), 0.33 * math.Cos(1.1*t)}
+	a := geom.Vec3{-1.215 * math.Sin(0.9*t), -1.568 * math.Cos(1.4*t), -0.363 * math.Sin(1.1*t)}
+	return r, p, v, a, omega
+}
+
+func TestInertialInitialization(t *testing.T) {
+	epoch := time.Unix(100, 0)
+	at := func(s float64) time.Time { return epoch.Add(time.Duration(s * float64(time.Second))) }
+	bias := imu.Bias{Gyro: geom.Vec3{0.012, -0.02, 0.008}, Acc: geom.Vec3{0.04, -0.03, 0.05}}
+	var ms []imu.Measurement
+	for i := 0; i <= 800; i++ {
+		s := float64(i) / 200
+		r, _, _, a, omega := imuBodyPose(s)
+		ms = append(ms, imu.Measurement{
+			Timestamp: at(s),
+			Acc:       r.Inverse().Rotate(a.Sub(imu.Gravity())).Add(bias.Acc),
+			Gyro:      omega.Add(bias.Gyro),
+		})
+	}
+
+	// the camera is looking forwards from a little in front of the IMU
+	tbc := geom.SE3{R: geom.ExpSO3(geom.Vec3{-math.Pi / 2, 0, 0}), T: geom.Vec3{0.05, -0.02, 0.01}}
+	calib := imu.NewCalibration(tbc, 1.7e-4, 2e-3, 1.9e-5, 3e-3, 200)
+	// the map's world is rotated relative to gravity and in units of 2.5m
+	rwg := geom.ExpSO3(geom.Vec3{0.4, -0.25, 0.7})
+	const scale = 2.5
+
+	problem := &InertialProblem{PriorGyro: 1e2, PriorAcc: 1e2}
+	var velocities []geom.Vec3
+	const numKFs = 13
+	for i := 0; i < numKFs; i++ {
+		s := float64(i) * 0.3
+		r, p, v, _, _ := imuBodyPose(s)
+		// Twc in metres, then in the units of the map
+		twc := geom.SE3{R: rwg.Mul(r), T: rwg.Rotate(p)}.Mul(tbc)
+		twc.T = twc.T.Scale(1 / scale)
+		kf := InertialKeyFrame{Pose: twc.Inverse()}
+		if i > 0 {
+			t0, t1 := at(s-0.3), at(s)
+			kf.Preintegrated = imu.NewPreintegrated(imu.Bias{}, calib)
+			kf.Preintegrated.Integrate(imu.Between(ms, t0, t1), t0, t1)
+		}
+		problem.KeyFrames = append(problem.KeyFrames, kf)
+		velocities = append(velocities, rwg.Rotate(v))
+	}
+
+	res, err := InertialInitialization(context.Background(), problem)
+	if err != nil {
+		t.Fatalf("InertialInitialization: %s", err)
+	}
+	down := geom.Vec3{0, 0, -1}
+	if cos := res.Rwg.Rotate(down).Dot(rwg.Rotate(down)); math.Acos(math.Min(cos, 1)) > 0.01 {
+		t.Errorf("gravity direction is %v rad off", math.Acos(cos))
+	}
+	if math.Abs(res.Scale-scale) > 0.005*scale {
+		t.Errorf("got scale %v want %v", res.Scale, scale)
+	}
+	if d := res.Bias.Gyro.Sub(bias.Gyro).Norm(); d > 1e-3 {
+		t.Errorf("gyroscope bias is %v off: got %v want %v", d, res.Bias.Gyro, bias.Gyro)
+	}
+	if d := res.Bias.Acc.Sub(bias.Acc).Norm(); d > 0.02 {
+		t.Errorf("accelerometer bias is %v off: got %v want %v", d, res.Bias.Acc, bias.Acc)
+	}
+	for i, v := range res.Velocities {
+		if d := v.Sub(velocities[i]).Norm(); d > 0.05 {
+			t.Errorf("keyframe %d velocity is %v m/s off", i, d)
+		}
+	}
+
+	if _, err := InertialInitialization(context.Background(), &InertialProblem{KeyFrames: problem.KeyFrames[:1]}); err != ErrTooFewInertialKeyFrames {
+		t.Errorf("got error %v with one keyframe", err)
+	}
+}
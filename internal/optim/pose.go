@@ -0,0 +1,289 @@
+package optim
+
+import (
+	"math"
+
+	"github.com/kegsay/gorbslam/internal/camera"
+	"github.com/kegsay/gorbslam/internal/geom"
+	"github.com/kegsay/gorbslam/internal/graph"
+)
+
+// PoseObservation is a match between a keypoint in the frame being tracked and a map point.
+type PoseObservation struct {
+	// The map point in world coordinates. This is held fixed during the optimisation.
+	Point geom.Vec3
+	// Undistorted keypoint position in pixels
+	U float64
+	V float64
+	// The keypoint's x coordinate in the right image of a stereo or RGB-D camera, negative if it
+	// has none
+	URight float64
+	// The pyramid level the keypoint was extracted from
+	Octave int
+	// Set by PoseOptimization if the observation does not agree with the optimised pose
+	Outlier bool
+}
+
+// Chi-squared values at 95% used to decide whether an observation is an outlier
+const (
+	// 2 degrees of freedom: (u, v) for monocular observations
+	Chi2Mono = 5.991
+	// 3 degrees of freedom: (u, v, uRight) for stereo observations
+	Chi2Stereo = 7.815
+)
+
+const (
+	poseRounds          = 4
+	poseIterations      = 10
+	poseMinObservations = 3
+)
+
+// PoseOptimization refines the camera pose Tcw by minimising the reprojection error of the
+// observed map points, keeping the map points fixed ("motion-only bundle adjustment"). This is
+// what the tracker runs on every frame.
+// Learning: https://www.youtube.com/watch?v=0I30M6yTklo&t=191s
+//
+// Like ORB-SLAM2 we run 4 rounds of 10 Levenberg-Marquardt iterations. After each round every
+// observation is classified as an inlier or outlier using a chi-squared test, and outliers are
+// excluded from the next round (but re-checked, so they can come back). The Huber kernel is only
+// used for the first 2 rounds: by then the gross outliers are gone and we want the least squares
+// solution. Errors are weighted by invSigma2 for the octave of each keypoint.
+//
+// For a stereo or RGB-D camera bf is the baseline times fx, and observations with a URight also
+// constrain the depth of their point, so the scale can't drift. bf is 0 for a monocular camera.
+//
+// Returns the optimised pose and the number of inliers. The Outlier field of each observation is
+// updated in place.
+func PoseOptimization(cam camera.Pinhole, bf float64, tcw geom.SE3, obs []PoseObservation, invSigma2 []float64) (geom.SE3, int) {
+	if len(obs) < poseMinObservations {
+		return tcw, 0
+	}
+	for i := range obs {
+		obs[i].Outlier = false
+	}
+	var numBad int
+	for round := 0; round < poseRounds; round++ {
+		tcw = optimisePose(cam, bf, tcw, obs, invSigma2, round < 2)
+
+		numBad = 0
+		for i := range obs {
+			o := &obs[i]
+			r, ok := poseReprojection(cam, bf, tcw, o)
+			if !ok || r.chi2(invSigma2[o.Octave]) > r.threshold() {
+				obs[i].Outlier = true
+				numBad++
+			} else {
+				obs[i].Outlier = false
+			}
+		}
+		if len(obs)-numBad < 10 {
+			break
+		}
+	}
+	// the tracker composes poses frame after frame (i.e the motion model), so drift in the rotation
+	// would compound. g2o avoids this by storing the rotation as a unit quaternion.
+	tcw.R = tcw.R.Normalised()
+	return tcw, len(obs) - numBad
+}
+
+// reprojection is the error (observed - projected) of a keypoint observing a point, with the
+// Jacobian of the projection with respect to the point in camera coordinates. A stereo observation
+// has the error of its right image coordinate, u - bf/z, in the third row, which is zero otherwise.
+type reprojection struct {
+	pc     geom.Vec3
+	e      [3]float64
+	dp     [3][3]float64
+	stereo bool
+}
+
+// newReprojection projects pc, a point in front of the camera, for a keypoint at (u, v) and uRight
+// in the right image, which is negative for a monocular observation
+func newReprojection(cam camera.Pinhole, bf float64, pc geom.Vec3, u, v, uRight float64) reprojection {
+	r := reprojection{pc: pc, stereo: bf > 0 && uRight >= 0}
+	pu, pv := cam.Project(pc)
+	r.e[0], r.e[1] = u-pu, v-pv
+	dp := cam.ProjectionJacobian(pc)
+	r.dp[0], r.dp[1] = dp[0], dp[1]
+	if r.stereo {
+		invZ := 1 / pc[2]
+		r.e[2] = uRight - (pu - bf*invZ)
+		r.dp[2] = dp[0]
+		r.dp[2][2] += bf * invZ * invZ
+	}
+	return r
+}
+
+// chi2 returns the information-weighted squared error
+func (r *reprojection) chi2(info float64) float64 {
+	return (r.e[0]*r.e[0] + r.e[1]*r.e[1] + r.e[2]*r.e[2]) * info
+}
+
+// threshold returns the chi-squared value above which the observation is an outlier
+func (r *reprojection) threshold() float64 {
+	if r.stereo {
+		return Chi2Stereo
+	}
+	return Chi2Mono
+}
+
+// kernel returns the Huber kernel for the error, or nil for plain least squares
+func (r *reprojection) kernel(robust bool) graph.Kernel {
+	if !robust {
+		return nil
+	}
+	return graph.Huber{Delta: math.Sqrt(r.threshold())}
+}
+
+// poseReprojection returns the reprojection of an observation, false if its point is behind the
+// camera
+func poseReprojection(cam camera.Pinhole, bf float64, tcw geom.SE3, o *PoseObservation) (reprojection, bool) {
+	pc := tcw.Transform(o.Point)
+	if pc[2] <= 0 {
+		return reprojection{}, false
+	}
+	return newReprojection(cam, bf, pc, o.U, o.V, o.URight), true
+}
+
+// Run Levenberg-Marquardt on the pose using the observations which are not marked as outliers.
+// If robust, errors are weighted by a Huber kernel.
+func optimisePose(cam camera.Pinhole, bf float64, tcw geom.SE3, obs []PoseObservation, invSigma2 []float64, robust bool) geom.SE3 {
+	h := geom.NewDense(6, 6)
+	b := make([]float64, 6)
+	cost := poseNormalEquations(cam, bf, tcw, obs, invSigma2, robust, h, b)
+	if cost == 0 {
+		return tcw
+	}
+	// initial damping is relative to the size of the Hessian diagonal, as in g2o
+	var maxDiag float64
+	for i := 0; i < 6; i++ {
+		maxDiag = math.Max(maxDiag, h.At(i, i))
+	}
+	lambda := 1e-5 * maxDiag
+	nu := 2.0
+	damped := geom.NewDense(6, 6)
+	for iter := 0; iter < poseIterations; iter++ {
+		copy(damped.Data, h.Data)
+		for i := 0; i < 6; i++ {
+			damped.Set(i, i, h.At(i, i)+lambda)
+		}
+		dx, ok := geom.SolveSPD(damped, b)
+		if !ok {
+			lambda *= nu
+			nu *= 2
+			continue
+		}
+		candidate := geom.ExpSE3([6]float64{dx[0], dx[1], dx[2], dx[3], dx[4], dx[5]}).Mul(tcw)
+		newCost := poseCost(cam, bf, candidate, obs, invSigma2, robust)
+		// gain ratio: actual reduction vs the reduction predicted by the linear model
+		var predicted float64
+		for i := 0; i < 6; i++ {
+			predicted += dx[i] * (lambda*dx[i] + b[i])
+		}
+		rho := (cost - newCost) / predicted
+		if newCost < cost && predicted > 0 {
+			tcw = candidate
+			lambda *= math.Max(1.0/3, 1-math.Pow(2*rho-1, 3))
+			nu = 2
+			cost = poseNormalEquations(cam, bf, tcw, obs, invSigma2, robust, h, b)
+			if cost < 1e-12 {
+				break
+			}
+		} else {
+			lambda *= nu
+			nu *= 2
+		}
+	}
+	return tcw
+}
+
+func poseCost(cam camera.Pinhole, bf float64, tcw geom.SE3, obs []PoseObservation, invSigma2 []float64, robust bool) float64 {
+	var cost float64
+	for i := range obs {
+		o := &obs[i]
+		if o.Outlier {
+			continue
+		}
+		// a point which moved behind the camera counts as a large error, but doesn't dominate
+		// when robust
+		chi2 := 1e6
+		r, ok := poseReprojection(cam, bf, tcw, o)
+		if ok {
+			chi2 = r.chi2(invSigma2[o.Octave])
+		}
+		if kernel := r.kernel(robust); kernel != nil {
+			chi2, _ = kernel.Robustify(chi2)
+		}
+		cost += chi2
+	}
+	return cost
+}
+
+// Build the Gauss-Newton normal equations H dx = b for a left-multiplied update
+// Tcw <- exp(dx) * Tcw with dx = (omega, upsilon). Returns the current cost.
+func poseNormalEquations(cam camera.Pinhole, bf float64, tcw geom.SE3, obs []PoseObservation, invSigma2 []float64, robust bool, h *geom.Dense, b []float64) float64 {
+	for i := range h.Data {
+		h.Data[i] = 0
+	}
+	for i := range b {
+		b[i] = 0
+	}
+	var cost float64
+	for i := range obs {
+		o := &obs[i]
+		if o.Outlier {
+			continue
+		}
+		r, ok := poseReprojection(cam, bf, tcw, o)
+		if !ok {
+			cost += 1e6
+			continue
+		}
+		info := invSigma2[o.Octave]
+		chi2 := r.chi2(info)
+		w := info
+		if kernel := r.kernel(robust); kernel != nil {
+			c, kw := kernel.Robustify(chi2)
+			cost += c
+			w *= kw
+		} else {
+			cost += chi2
+		}
+		accumulate6(h, b, projectionJacobianPose(&r), r.e, w)
+	}
+	return cost
+}
+
+// projectionJacobianPose returns the Jacobian of the reprojection error (observed - projected)
+// with respect to a left-multiplied pose update (omega, upsilon)
+func projectionJacobianPose(r *reprojection) [3][6]float64 {
+	x, y, z := r.pc[0], r.pc[1], r.pc[2]
+	dp := &r.dp
+	// d(pc)/d(dx) = [ -[pc]x | I ]
+	dpc := [3][6]float64{
+		{0, z, -y, 1, 0, 0},
+		{-z, 0, x, 0, 1, 0},
+		{y, -x, 0, 0, 0, 1},
+	}
+	var j [3][6]float64
+	for row := 0; row < 3; row++ {
+		for c := 0; c < 6; c++ {
+			// error = observed - projected, hence the minus sign
+			j[row][c] = -(dp[row][0]*dpc[0][c] + dp[row][1]*dpc[1][c] + dp[row][2]*dpc[2][c])
+		}
+	}
+	return j
+}
+
+// Add w * J^T J to h and -w * J^T e to b
+func accumulate6(h *geom.Dense, b []float64, j [3][6]float64, e [3]float64, w float64) {
+	for r := 0; r < 6; r++ {
+		b[r] -= w * (j[0][r]*e[0] + j[1][r]*e[1] + j[2][r]*e[2])
+		for c := r; c < 6; c++ {
+			v := w * (j[0][r]*j[0][c] + j[1][r]*j[1][c] + j[2][r]*j[2][c])
+			h.Data[r*6+c] += v
+			if c != r {
+				h.Data[c*6+r] += v
+			}
+		}
+	}
+}
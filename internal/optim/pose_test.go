@@ -0,0 +1,198 @@
+package optim
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/kegsay/gorbslam/internal/camera"
+	"github.com/kegsay/gorbslam/internal/feature"
+	"github.com/kegsay/gorbslam/internal/geom"
+)
+
+var (
+	testCam     = camera.Pinhole{Fx: 500, Fy: 500, Cx: 320, Cy: 240}
+	testPyramid = feature.NewScalePyramid(8, 1.2)
+)
+
+// Generate observations of random map points seen by the camera at tcw
+func syntheticPoseScene(rng *rand.Rand, tcw geom.SE3, n int, noise, outlierRatio float64) ([]PoseObservation, []bool) {
+	twc := tcw.Inverse()
+	obs := make([]PoseObservation, n)
+	isOutlier := make([]bool, n)
+	for i := range obs {
+		u := 20 + rng.Float64()*600
+		v := 20 + rng.Float64()*440
+		octave := rng.Intn(4)
+		pc := testCam.Unproject(u, v).Scale(1 + rng.Float64()*10)
+		scale := testPyramid.ScaleFactors[octave]
+		obs[i] = PoseObservation{
+			Point:  twc.Transform(pc),
+			U:      u + rng.NormFloat64()*noise*scale,
+			V:      v + rng.NormFloat64()*noise*scale,
+			Octave: octave,
+		}
+		if rng.Float64() < outlierRatio {
+			isOutlier[i] = true
+			obs[i].U = rng.Float64() * 640
+			obs[i].V = rng.Float64() * 480
+		}
+	}
+	return obs, isOutlier
+}
+
+func perturb(rng *rand.Rand, p geom.SE3, rot, trans float64) geom.SE3 {
+	return geom.ExpSE3([6]float64{
+		rng.NormFloat64() * rot, rng.NormFloat64() * rot, rng.NormFloat64() * rot,
+		rng.NormFloat64() * trans, rng.NormFloat64() * trans, rng.NormFloat64() * trans,
+	}).Mul(p)
+}
+
+func TestPoseOptimizationConverges(t *testing.T) {
+	testCases := []struct {
+		name         string
+		noise        float64
+		outlierRatio float64
+		rot          float64
+		trans        float64
+	}{
+		{name: "no noise", noise: 0, rot: 0.02, trans: 0.05},
+		{name: "noise", noise: 1, rot: 0.02, trans: 0.05},
+		{name: "noise and outliers", noise: 1, outlierRatio: 0.3, rot: 0.02, trans: 0.05},
+		{name: "large perturbation", noise: 0.5, outlierRatio: 0.1, rot: 0.05, trans: 0.2},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rng := rand.New(rand.NewSource(1))
+			truth := geom.ExpSE3([6]float64{0.1, -0.2, 0.05, 0.3, 0.1, -0.5})
+			obs, isOutlier := syntheticPoseScene(rng, truth, 300, tc.noise, tc.outlierRatio)
+			start := perturb(rng, truth, tc.rot, tc.trans)
+
+			got, numInliers := PoseOptimization(testCam, 0, start, obs, testPyramid.InvSigma2)
+			rotErr := got.R.Mul(truth.R.Inverse()).Angle()
+			transErr := got.Center().Sub(truth.Center()).Norm()
+			if rotErr > 0.002 || transErr > 0.01 {
+				t.Errorf("did not converge: rotation error %v, translation error %v", rotErr, transErr)
+			}
+			var wantInliers, misclassified int
+			for i := range obs {
+				if !isOutlier[i] {
+					wantInliers++
+				}
+				if obs[i].Outlier != isOutlier[i] {
+					misclassified++
+				}
+			}
+			// a few noisy inliers fall outside the 95% chi-squared bound, and a few random
+			// outliers land near their true projection
+			if misclassified > len(obs)/15 {
+				t.Errorf("too many misclassified observations: %d", misclassified)
+			}
+			if math.Abs(float64(numInliers-wantInliers)) > float64(len(obs)/15) {
+				t.Errorf("inliers: got %d want ~%d", numInliers, wantInliers)
+			}
+		})
+	}
+}
+
+func TestPoseOptimizationTooFewObservations(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	truth := geom.IdentitySE3()
+	obs, _ := syntheticPoseScene(rng, truth, 2, 0, 0)
+	got, numInliers := PoseOptimization(testCam, 0, truth, obs, testPyramid.InvSigma2)
+	if numInliers != 0 {
+		t.Errorf("expected no inliers with too few observations, got %d", numInliers)
+	}
+	if got != truth {
+		t.Errorf("pose should not change with too few observations")
+	}
+}
+
+// A rotation which has drifted from orthogonality (e.g by composing poses with the motion model)
+// comes back as a proper rotation.
+func TestPoseOptimizationNormalisesRotation(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	truth := geom.ExpSE3([6]float64{0.1, -0.2, 0.05, 0.3, 0.1, -0.5})
+	obs, _ := syntheticPoseScene(rng, truth, 300, 0.5, 0)
+	m := truth.R.Matrix()
+	m[0][0] *= 1.001
+	m[1][1] *= 0.999
+	start := geom.SE3{R: geom.NewSO3(m), T: truth.T}
+
+	got, _ := PoseOptimization(testCam, 0, start, obs, testPyramid.InvSigma2)
+	r := got.R.Matrix()
+	rtr := r.T().Mul(r)
+	id := geom.Identity3()
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			if d := math.Abs(rtr[i][j] - id[i][j]); d > 1e-9 {
+				t.Fatalf("rotation is not orthogonal: R^T R = %v", rtr)
+			}
+		}
+	}
+	if d := got.R.Mul(truth.R.Inverse()).Angle(); d > 0.002 {
+		t.Errorf("rotation error %v", d)
+	}
+}
+
+// testBf is the baseline times fx of a stereo testCam
+const testBf = 40
+
+// stereoProject returns the pixel at which testCam sees pc, and its x coordinate in the right image
+func stereoProject(pc geom.Vec3) [3]float64 {
+	u, v := testCam.Project(pc)
+	return [3]float64{u, v, u - testBf/pc[2]}
+}
+
+// Observations whose right image coordinate disagrees with their depth are outliers for a stereo
+// camera, but not for a monocular one which can't measure it.
+func TestPoseOptimizationStereo(t *testing.T) {
+	rng := rand.New(rand.NewSource(4))
+	truth := geom.ExpSE3([6]float64{0.1, -0.2, 0.05, 0.3, 0.1, -0.5})
+	obs, _ := syntheticPoseScene(rng, truth, 200, 0, 0)
+	for i := range obs {
+		obs[i].URight = stereoProject(truth.Transform(obs[i].Point))[2]
+		if i%10 == 0 {
+			obs[i].URight -= 20
+		}
+	}
+	got, numInliers := PoseOptimization(testCam, testBf, perturb(rng, truth, 0.02, 0.05), obs, testPyramid.InvSigma2)
+	if d := got.Center().Sub(truth.Center()).Norm(); d > 1e-3 {
+		t.Errorf("translation error %v", d)
+	}
+	if numInliers != 180 {
+		t.Errorf("got %d inliers want 180", numInliers)
+	}
+	for i := range obs {
+		if obs[i].Outlier != (i%10 == 0) {
+			t.Errorf("observation %d: outlier %v", i, obs[i].Outlier)
+		}
+	}
+	if _, numInliers = PoseOptimization(testCam, 0, truth, obs, testPyramid.InvSigma2); numInliers != len(obs) {
+		t.Errorf("got %d inliers for a monocular camera want %d", numInliers, len(obs))
+	}
+}
+
+func TestProjectionJacobianPose(t *testing.T) {
+	// compare against numeric differentiation
+	pose := geom.ExpSE3([6]float64{0.1, 0.2, -0.1, 0.5, -0.2, 0.3})
+	pw := geom.Vec3{0.4, -0.3, 4}
+	pc := pose.Transform(pw)
+	r := newReprojection(testCam, testBf, pc, 0, 0, 0)
+	j := projectionJacobianPose(&r)
+	const h = 1e-6
+	for c := 0; c < 6; c++ {
+		var dx [6]float64
+		dx[c] = h
+		plus := stereoProject(geom.ExpSE3(dx).Mul(pose).Transform(pw))
+		dx[c] = -h
+		minus := stereoProject(geom.ExpSE3(dx).Mul(pose).Transform(pw))
+		for row := 0; row < 3; row++ {
+			// error = observed - projected
+			numeric := -(plus[row] - minus[row]) / (2 * h)
+			if math.Abs(numeric-j[row][c]) > 1e-4 {
+				t.Errorf("row %d column %d: analytic %v numeric %v", row, c, j[row][c], numeric)
+			}
+		}
+	}
+}
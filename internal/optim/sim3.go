@@ -0,0 +1,89 @@
+package optim
+
+import (
+	"context"
+	"math"
+
+	"github.com/kegsay/gorbslam/internal/camera"
+	"github.com/kegsay/gorbslam/internal/geom"
+	"github.com/kegsay/gorbslam/internal/graph"
+)
+
+// Sim3Correspondence is a map point of keyframe 1 matched with a map point of keyframe 2. The
+// points are in the camera frames of their keyframes and (U1, V1), (U2, V2) are their keypoints.
+type Sim3Correspondence struct {
+	P1      geom.Vec3
+	P2      geom.Vec3
+	U1      float64
+	V1      float64
+	U2      float64
+	V2      float64
+	Octave1 int
+	Octave2 int
+	// Set for correspondences rejected by the optimisation
+	Outlier bool
+}
+
+// OptimizeSim3 refines the similarity S12 from keyframe 2 to keyframe 1 by minimising the
+// reprojection error of each correspondence in both keyframes: P2 is projected into keyframe 1 by
+// S12 and P1 into keyframe 2 by S21. This follows ORB-SLAM2: 5 iterations with a Huber kernel,
+// then correspondences whose error in either keyframe exceeds th2 are rejected and the
+// optimisation continues for 10 more iterations (5 if nothing was rejected). ORB-SLAM2 uses
+// th2 = 10 when closing loops.
+//
+// Returns the refined S12 and the number of inliers. If fewer than 10 correspondences survive the
+// first round s12 is returned unchanged with no inliers.
+func OptimizeSim3(cam1, cam2 camera.Pinhole, s12 geom.Sim3, corrs []Sim3Correspondence, invSigma2 []float64, th2 float64, fixScale bool) (geom.Sim3, int) {
+	g := &graph.Graph{}
+	v := &graph.VertexSim3{Estimate: s12, FixScale: fixScale}
+	g.AddVertex(v)
+	kernel := graph.Huber{Delta: math.Sqrt(th2)}
+	edges12 := make([]*graph.EdgeSim3Projection, len(corrs))
+	edges21 := make([]*graph.EdgeInverseSim3Projection, len(corrs))
+	for i := range corrs {
+		c := &corrs[i]
+		c.Outlier = false
+		e12 := graph.NewEdgeSim3Projection(v, cam1, c.P2, c.U1, c.V1, invSigma2[c.Octave1])
+		e12.Kernel = kernel
+		e21 := graph.NewEdgeInverseSim3Projection(v, cam2, c.P1, c.U2, c.V2, invSigma2[c.Octave2])
+		e21.Kernel = kernel
+		g.AddEdge(e12)
+		g.AddEdge(e21)
+		edges12[i], edges21[i] = e12, e21
+	}
+
+	// reject the correspondences which don't agree with the refined transform in both directions
+	reject := func() int {
+		var numBad int
+		for i := range corrs {
+			if corrs[i].Outlier {
+				continue
+			}
+			if graph.Chi2(edges12[i]) > th2 || graph.Chi2(edges21[i]) > th2 {
+				corrs[i].Outlier = true
+				edges12[i].Disabled = true
+				edges21[i].Disabled = true
+				numBad++
+			}
+		}
+		return numBad
+	}
+
+	ctx := context.Background()
+	if _, err := g.Optimize(ctx, 5); err != nil {
+		return s12, 0
+	}
+	numBad := reject()
+	if len(corrs)-numBad < 10 {
+		return s12, 0
+	}
+	moreIterations := 5
+	if numBad > 0 {
+		moreIterations = 10
+	}
+	if _, err := g.Optimize(ctx, moreIterations); err != nil {
+		return s12, 0
+	}
+	numBad += reject()
+	return v.Estimate, len(corrs) - numBad
+}
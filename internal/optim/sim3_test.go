@@ -0,0 +1,98 @@
+package optim
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/kegsay/gorbslam/internal/geom"
+)
+
+// Points seen by two keyframes related by s12, with a fraction of mismatched keypoints
+func syntheticSim3Scene(rng *rand.Rand, s12 geom.Sim3, n int, noise, outlierRatio float64) ([]Sim3Correspondence, []bool) {
+	s21 := s12.Inverse()
+	corrs := make([]Sim3Correspondence, n)
+	isOutlier := make([]bool, n)
+	for i := range corrs {
+		c := &corrs[i]
+		c.U1 = 20 + rng.Float64()*600
+		c.V1 = 20 + rng.Float64()*440
+		c.Octave1, c.Octave2 = rng.Intn(4), rng.Intn(4)
+		c.P1 = testCam.Unproject(c.U1, c.V1).Scale(2 + rng.Float64()*6)
+		c.P2 = s21.Transform(c.P1)
+		c.U2, c.V2 = testCam.Project(c.P2)
+		s1, s2 := testPyramid.ScaleFactors[c.Octave1], testPyramid.ScaleFactors[c.Octave2]
+		c.U1 += rng.NormFloat64() * noise * s1
+		c.V1 += rng.NormFloat64() * noise * s1
+		c.U2 += rng.NormFloat64() * noise * s2
+		c.V2 += rng.NormFloat64() * noise * s2
+		if rng.Float64() < outlierRatio {
+			isOutlier[i] = true
+			c.U2 = rng.Float64() * 640
+			c.V2 = rng.Float64() * 480
+		}
+	}
+	return corrs, isOutlier
+}
+
+func TestOptimizeSim3(t *testing.T) {
+	testCases := []struct {
+		name         string
+		fixScale     bool
+		scale        float64
+		outlierRatio float64
+	}{
+		{name: "scale", scale: 1.4},
+		{name: "scale with outliers", scale: 0.7, outlierRatio: 0.3},
+		{name: "fixed scale", fixScale: true, scale: 1, outlierRatio: 0.2},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rng := rand.New(rand.NewSource(1))
+			truth := geom.NewSim3(geom.ExpSO3(geom.Vec3{0.05, -0.1, 0.02}).Matrix(), geom.Vec3{0.3, -0.1, 0.2}, tc.scale)
+			corrs, isOutlier := syntheticSim3Scene(rng, truth, 200, 0.5, tc.outlierRatio)
+			// perturb the rotation and translation, and the scale by 5% unless it's fixed
+			delta := [7]float64{0.01, -0.01, 0.02, 0.05, 0.05, -0.05, 0.05}
+			if tc.fixScale {
+				delta[6] = 0
+			}
+			start := geom.ExpSim3(delta).Mul(truth)
+
+			got, numInliers := OptimizeSim3(testCam, testCam, start, corrs, testPyramid.InvSigma2, 10, tc.fixScale)
+			d := got.Mul(truth.Inverse()).Log()
+			for i, x := range d {
+				if math.Abs(x) > 0.005 {
+					t.Fatalf("did not converge: error %v in component %d", d, i)
+				}
+			}
+			var wantInliers, misclassified int
+			for i := range corrs {
+				if !isOutlier[i] {
+					wantInliers++
+				}
+				if corrs[i].Outlier != isOutlier[i] {
+					misclassified++
+				}
+			}
+			if misclassified > len(corrs)/20 {
+				t.Errorf("too many misclassified correspondences: %d", misclassified)
+			}
+			if math.Abs(float64(numInliers-wantInliers)) > float64(len(corrs)/20) {
+				t.Errorf("inliers: got %d want ~%d", numInliers, wantInliers)
+			}
+		})
+	}
+}
+
+func TestOptimizeSim3TooFewInliers(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	truth := geom.IdentitySim3()
+	corrs, _ := syntheticSim3Scene(rng, truth, 30, 0, 0.9)
+	got, numInliers := OptimizeSim3(testCam, testCam, truth, corrs, testPyramid.InvSigma2, 10, false)
+	if numInliers != 0 {
+		t.Errorf("expected no inliers, got %d", numInliers)
+	}
+	if got != truth {
+		t.Errorf("transform should not change when the correspondences are rejected")
+	}
+}
@@ -0,0 +1,99 @@
+package orb
+
+import (
+	"fmt"
+	"image"
+	"math"
+
+	"github.com/kegsay/gorbslam/internal/feature"
+	"gocv.io/x/gocv"
+)
+
+// Extractor extracts ORB features from a stream of grayscale images. Unlike Features the detectors
+// are created once and reused, so the extractor must be closed when done with.
+type Extractor struct {
+	// The scale of each pyramid level the keypoints were detected on
+	Pyramid *feature.ScalePyramid
+
+	orb        gocv.ORB
+	initialORB gocv.ORB
+}
+
+// NewExtractor creates an extractor which retains up to numFeatures features per image, or more
+// while initialising as with nInitialFeatures.
+func NewExtractor(numFeatures int, scaleFactor float64, numLevels, fastThreshold int) *Extractor {
+	initialFeatures := numFeatures * nInitialFeatures / nFeatures
+	return &Extractor{
+		Pyramid: feature.NewScalePyramid(numLevels, scaleFactor),
+		orb: gocv.NewORBWithParams(
+			numFeatures, float32(scaleFactor), numLevels, edgeThreshold, firstLevel, WTAK, scoreType, patchSize, fastThreshold,
+		),
+		initialORB: gocv.NewORBWithParams(
+			initialFeatures, float32(scaleFactor), numLevels, edgeThreshold, firstLevel, WTAK, scoreType, patchSize, fastThreshold,
+		),
+	}
+}
+
+// Extract detects keypoints in a grayscale image and computes their descriptors. Set initial while
+// the map is being initialised, to extract more features.
+func (e *Extractor) Extract(img gocv.Mat, initial bool) ([]feature.KeyPoint, []feature.Descriptor, error) {
+	orb := e.orb
+	if initial {
+		orb = e.initialORB
+	}
+	mask := gocv.NewMat()
+	defer mask.Close()
+	kps, descMat := orb.DetectAndCompute(img, mask)
+	defer descMat.Close()
+	if len(kps) == 0 {
+		return nil, nil, nil
+	}
+	if descMat.Rows() != len(kps) || descMat.Cols() != len(feature.Descriptor{}) {
+		return nil, nil, fmt.Errorf("unexpected descriptors: %d keypoints, %dx%d descriptors", len(kps), descMat.Rows(), descMat.Cols())
+	}
+	data := descMat.ToBytes()
+	keyPoints := make([]feature.KeyPoint, len(kps))
+	descriptors := make([]feature.Descriptor, len(kps))
+	for i, kp := range kps {
+		keyPoints[i] = feature.KeyPoint{
+			X:        kp.X,
+			Y:        kp.Y,
+			Octave:   kp.Octave,
+			Angle:    kp.Angle,
+			Response: kp.Response,
+		}
+		copy(descriptors[i][:], data[i*len(descriptors[i]):])
+	}
+	return keyPoints, descriptors, nil
+}
+
+// PyramidImages returns a grayscale image scaled to each level of the pyramid, as the keypoints
+// were detected on. The first is a copy of img.
+func (e *Extractor) PyramidImages(img gocv.Mat) ([]*image.Gray, error) {
+	images := make([]*image.Gray, e.Pyramid.Levels)
+	level := gocv.NewMat()
+	defer level.Close()
+	for i := range images {
+		scale := e.Pyramid.InvScaleFactors[i]
+		size := image.Pt(int(math.Round(float64(img.Cols())*scale)), int(math.Round(float64(img.Rows())*scale)))
+		gocv.Resize(img, &level, size, 0, 0, gocv.InterpolationLinear)
+		converted, err := level.ToImage()
+		if err != nil {
+			return nil, err
+		}
+		gray, ok := converted.(*image.Gray)
+		if !ok {
+			return nil, fmt.Errorf("expected a grayscale image, got %T", converted)
+		}
+		images[i] = gray
+	}
+	return images, nil
+}
+
+// Close releases the detectors
+func (e *Extractor) Close() error {
+	if err := e.orb.Close(); err != nil {
+		return err
+	}
+	return e.initialORB.Close()
+}
@@ -1,6 +1,7 @@
 package orb
 
 import (
+	"github.com/kegsay/gorbslam/internal/feature"
 	"gocv.io/x/gocv"
 )
 
@@ -33,6 +34,10 @@ const (
 	scoreType = gocv.ORBScoreTypeHarris // opencv default
 )
 
+// Pyramid describes the scale of each level of the image pyramid the extractor uses. Use this to
+// weight reprojection errors by the octave of the keypoint.
+var Pyramid = feature.NewScalePyramid(nLevels, scaleFactor)
+
 // Compute the feature vectors for the input image.
 // Learning: https://www.youtube.com/watch?v=4AvTMVD9ig0 for more information (it describes SIFT but works similarly for ORB too)
 // - Detect keypoints in the image
@@ -45,10 +50,10 @@ func Features(img gocv.Mat, initial bool) ([]gocv.KeyPoint, gocv.Mat) {
 	orb := gocv.NewORBWithParams(
 		features, scaleFactor, nLevels, edgeThreshold, firstLevel, WTAK, scoreType, patchSize, fastThreshold,
 	)
+	defer orb.Close()
 	// Masks specifying where to look for keypoints
 	mask := gocv.NewMatWithSizeFromScalar(gocv.NewScalar(1, 1, 1, 1), img.Rows(), img.Cols(), gocv.MatTypeCV8U)
+	defer mask.Close()
 	keypoints, descriptors := orb.DetectAndCompute(img, mask)
-	// TODO: undistort
-	// TODO: assign features to grid?
 	return keypoints, descriptors
 }
@@ -0,0 +1,328 @@
+// Package settings reads the camera and feature extractor settings files used by ORB-SLAM2. These
+// are OpenCV FileStorage YAML files, of which only the subset the ORB-SLAM2 examples use is
+// supported: "key: value" pairs, comments, and indented blocks such as opencv-matrix nodes.
+package settings
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/kegsay/gorbslam/internal/camera"
+	"github.com/kegsay/gorbslam/internal/geom"
+	"github.com/kegsay/gorbslam/internal/imu"
+)
+
+// Settings configures a SLAM system for a camera.
+type Settings struct {
+	Camera     camera.Pinhole
+	Distortion camera.Distortion
+	// Frames per second, which bounds how often keyframes are inserted
+	FPS int
+	// True if colour images are RGB rather than OpenCV's BGR, the default
+	RGB bool
+	// The stereo baseline times fx, zero for a monocular camera
+	Bf float64
+	// Points closer than ThDepth baselines are close points, whose depth from a stereo or RGB-D
+	// camera is reliable
+	ThDepth float64
+	// Raw depths from an RGB-D camera are divided by DepthMapFactor to give metres
+	DepthMapFactor float64
+	// The size of the images, zero if not given
+	Width  int
+	Height int
+	// The right camera of a stereo pair whose images are not rectified, nil if they are
+	Right *RightCamera
+	// The IMU rigidly attached to the camera, nil if there is none
+	IMU *imu.Calibration
+	ORB ORBSettings
+
+	values map[string]string
+}
+
+// RightCamera describes the right camera of a stereo pair, as the Camera2 settings and the
+// Stereo.T_c1_c2 matrix of ORB-SLAM3.
+type RightCamera struct {
+	Camera     camera.Pinhole
+	Distortion camera.Distortion
+	// The pose of the right camera relative to the left one: it transforms points from right
+	// camera coordinates to left camera coordinates
+	Tlr geom.SE3
+}
+
+// ORBSettings configures the ORB extractor
+type ORBSettings struct {
+	// The number of features to extract from each image
+	NumFeatures int
+	// The scale between pyramid levels, and the number of levels
+	ScaleFactor float64
+	NumLevels   int
+	// FAST corner thresholds: the initial one, and a lower one tried in cells where the initial
+	// one finds no corners
+	IniThFAST int
+	MinThFAST int
+}
+
+// NewSettingsFromFile reads a settings file
+func NewSettingsFromFile(filename string) (*Settings, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return NewSettingsFromReader(file)
+}
+
+// NewSettingsFromReader reads settings. Example contents:
+//
+//	%YAML:1.0
+//	Camera.fx: 517.306408
+//	Camera.fy: 516.469215
+//	...
+//	ORBextractor.nFeatures: 1000
+//
+// The camera intrinsics are required, everything else has a default.
+func NewSettingsFromReader(reader io.Reader) (*Settings, error) {
+	values, err := Parse(reader)
+	if err != nil {
+		return nil, err
+	}
+	s := &Settings{values: values}
+	p := parser{values: values}
+	s.Camera = camera.Pinhole{
+		Fx: p.float("Camera.fx", nil),
+		Fy: p.float("Camera.fy", nil),
+		Cx: p.float("Camera.cx", nil),
+		Cy: p.float("Camera.cy", nil),
+	}
+	s.Distortion = camera.Distortion{
+		K1: p.float("Camera.k1", zero),
+		K2: p.float("Camera.k2", zero),
+		P1: p.float("Camera.p1", zero),
+		P2: p.float("Camera.p2", zero),
+		K3: p.float("Camera.k3", zero),
+	}
+	s.FPS = int(p.float("Camera.fps", def(30)))
+	if s.FPS <= 0 {
+		s.FPS = 30
+	}
+	s.RGB = p.float("Camera.RGB", zero) != 0
+	s.Bf = p.float("Camera.bf", zero)
+	s.ThDepth = p.float("ThDepth", def(35))
+	s.DepthMapFactor = p.float("DepthMapFactor", def(1))
+	s.Width = int(p.float("Camera.width", zero))
+	s.Height = int(p.float("Camera.height", zero))
+	if _, ok := values["Camera2.fx"]; ok {
+		s.Right = &RightCamera{
+			Camera: camera.Pinhole{
+				Fx: p.float("Camera2.fx", nil),
+				Fy: p.float("Camera2.fy", nil),
+				Cx: p.float("Camera2.cx", nil),
+				Cy: p.float("Camera2.cy", nil),
+			},
+			Distortion: camera.Distortion{
+				K1: p.float("Camera2.k1", zero),
+				K2: p.float("Camera2.k2", zero),
+				P1: p.float("Camera2.p1", zero),
+				P2: p.float("Camera2.p2", zero),
+				K3: p.float("Camera2.k3", zero),
+			},
+		}
+		s.Right.Tlr = p.transform("Stereo.T_c1_c2")
+	}
+	if _, ok := values["IMU.NoiseGyro"]; ok {
+		noiseGyro, noiseAcc := p.float("IMU.NoiseGyro", nil), p.float("IMU.NoiseAcc", nil)
+		walkGyro, walkAcc := p.float("IMU.GyroWalk", nil), p.float("IMU.AccWalk", nil)
+		freq := p.float("IMU.Frequency", nil)
+		tbc := p.transform("IMU.T_b_c1")
+		if p.err == nil && (noiseGyro <= 0 || noiseAcc <= 0 || walkGyro <= 0 || walkAcc <= 0 || freq <= 0) {
+			return nil, fmt.Errorf("IMU noise, random walk and frequency must be positive")
+		}
+		s.IMU = imu.NewCalibration(tbc, noiseGyro, noiseAcc, walkGyro, walkAcc, freq)
+	}
+	s.ORB = ORBSettings{
+		NumFeatures: int(p.float("ORBextractor.nFeatures", def(1000))),
+		ScaleFactor: p.float("ORBextractor.scaleFactor", def(1.2)),
+		NumLevels:   int(p.float("ORBextractor.nLevels", def(8))),
+		IniThFAST:   int(p.float("ORBextractor.iniThFAST", def(20))),
+		MinThFAST:   int(p.float("ORBextractor.minThFAST", def(7))),
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	if s.Camera.Fx <= 0 || s.Camera.Fy <= 0 {
+		return nil, fmt.Errorf("focal lengths must be positive, got fx=%v fy=%v", s.Camera.Fx, s.Camera.Fy)
+	}
+	if s.Bf < 0 || s.ThDepth <= 0 || s.DepthMapFactor <= 0 {
+		return nil, fmt.Errorf("invalid stereo settings: bf=%v ThDepth=%v DepthMapFactor=%v", s.Bf, s.ThDepth, s.DepthMapFactor)
+	}
+	if s.Right != nil && (s.Width <= 0 || s.Height <= 0 || s.Right.Tlr.T.Norm() == 0) {
+		return nil, fmt.Errorf("an unrectified stereo pair needs Camera.width, Camera.height and the baseline in Stereo.T_c1_c2")
+	}
+	if s.ORB.ScaleFactor <= 1 || s.ORB.NumLevels < 1 || s.ORB.NumFeatures < 1 {
+		return nil, fmt.Errorf("invalid ORB extractor settings: %+v", s.ORB)
+	}
+	return s, nil
+}
+
+// DepthThreshold returns the depth below which points are close points, in the units of the
+// baseline
+func (s *Settings) DepthThreshold() float64 {
+	return s.Bf * s.ThDepth / s.Camera.Fx
+}
+
+// Value returns the raw value of a key, for settings not parsed into fields. Keys nested under a
+// block are joined with a dot, e.g "LEFT.K.rows".
+func (s *Settings) Value(key string) (string, bool) {
+	v, ok := s.values[key]
+	return v, ok
+}
+
+var zero = def(0)
+
+// def returns a pointer to a default value
+func def(v float64) *float64 {
+	return &v
+}
+
+// parser reads typed values, remembering the first error
+type parser struct {
+	values map[string]string
+	err    error
+}
+
+// float returns the value of key as a number, or the default if it is missing. A nil default
+// means the key is required.
+func (p *parser) float(key string, dflt *float64) float64 {
+	if p.err != nil {
+		return 0
+	}
+	v, ok := p.values[key]
+	if !ok {
+		if dflt == nil {
+			p.err = fmt.Errorf("missing required setting %s", key)
+			return 0
+		}
+		return *dflt
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		p.err = fmt.Errorf("setting %s: expected a number, got '%s'", key, v)
+		return 0
+	}
+	return f
+}
+
+// matrix returns the data of a rows x cols opencv-matrix, row by row. Every matrix is required.
+func (p *parser) matrix(key string, rows, cols int) []float64 {
+	if p.err != nil {
+		return make([]float64, rows*cols)
+	}
+	if r, c := p.float(key+".rows", nil), p.float(key+".cols", nil); p.err == nil && (int(r) != rows || int(c) != cols) {
+		p.err = fmt.Errorf("setting %s: expected a %dx%d matrix, got %vx%v", key, rows, cols, r, c)
+	}
+	data, ok := p.values[key+".data"]
+	if p.err == nil && !ok {
+		p.err = fmt.Errorf("missing required setting %s.data", key)
+	}
+	var values []float64
+	for _, field := range strings.Split(strings.Trim(data, "[] "), ",") {
+		if p.err != nil {
+			break
+		}
+		f, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			p.err = fmt.Errorf("setting %s: expected numbers, got '%s'", key, field)
+		}
+		values = append(values, f)
+	}
+	if p.err == nil && len(values) != rows*cols {
+		p.err = fmt.Errorf("setting %s: expected %d values, got %d", key, rows*cols, len(values))
+	}
+	if p.err != nil {
+		return make([]float64, rows*cols)
+	}
+	return values
+}
+
+// transform returns a rigid transform given as a 4x4 opencv-matrix, which is required
+func (p *parser) transform(key string) geom.SE3 {
+	t := p.matrix(key, 4, 4)
+	var r geom.Mat3
+	for i := range r {
+		copy(r[i][:], t[i*4:i*4+3])
+	}
+	return geom.SE3{R: geom.NewSO3(r).Normalised(), T: geom.Vec3{t[3], t[7], t[11]}}
+}
+
+// Parse reads the key-value pairs of a settings file, or any other YAML file using the same
+// subset. Indented lines belong to the last key with a deeper indentation, whose keys they are
+// joined to with a dot, and brackets may span several lines.
+func Parse(reader io.Reader) (map[string]string, error) {
+	values := make(map[string]string)
+	type block struct {
+		key    string
+		indent int
+	}
+	var parents []block
+	scanner := bufio.NewScanner(reader)
+	lineNum := 0
+	var pendingKey, pendingValue string
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if pendingKey != "" {
+			// continuing a bracketed value
+			pendingValue += " " + strings.TrimSpace(line)
+			if strings.Contains(line, "]") {
+				values[pendingKey] = pendingValue
+				pendingKey, pendingValue = "", ""
+			}
+			continue
+		}
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "%") || trimmed == "---" {
+			continue
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " \t"))
+		colon := strings.Index(trimmed, ":")
+		if colon < 0 {
+			return nil, fmt.Errorf("line %d: expected 'key: value', got '%s'", lineNum, trimmed)
+		}
+		key := strings.TrimSpace(trimmed[:colon])
+		value := strings.Trim(strings.TrimSpace(trimmed[colon+1:]), `"'`)
+
+		for len(parents) > 0 && parents[len(parents)-1].indent >= indent {
+			parents = parents[:len(parents)-1]
+		}
+		if len(parents) > 0 {
+			key = parents[len(parents)-1].key + "." + key
+		}
+		// an empty value, or a type tag like "!!opencv-matrix", opens a block
+		if value == "" || strings.HasPrefix(value, "!!") {
+			parents = append(parents, block{key: key, indent: indent})
+			if value != "" {
+				values[key] = value
+			}
+			continue
+		}
+		if strings.HasPrefix(value, "[") && !strings.Contains(value, "]") {
+			pendingKey, pendingValue = key, value
+			continue
+		}
+		values[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if pendingKey != "" {
+		return nil, fmt.Errorf("unterminated '[' in %s", pendingKey)
+	}
+	return values, nil
+}
@@ -0,0 +1,254 @@
+package settings
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/kegsay/gorbslam/internal/camera"
+)
+
+// Based on the TUM1.yaml settings shipped with ORB-SLAM2, with a matrix added
+const tum1 = `%YAML:1.0
+
+#--------------------------------------------------------------------------------------------
+# Camera Parameters. Adjust them!
+#--------------------------------------------------------------------------------------------
+
+# Camera calibration and distortion parameters (OpenCV) 
+Camera.fx: 517.306408
+Camera.fy: 516.469215
+Camera.cx: 318.643040
+Camera.cy: 255.313989
+
+Camera.k1: 0.262383
+Camera.k2: -0.953104
+Camera.p1: -0.005358
+Camera.p2: 0.002628
+Camera.k3: 1.163314
+
+# Camera frames per second 
+Camera.fps: 30.0
+
+# Color order of the images (0: BGR, 1: RGB. It is ignored if images are grayscale)
+Camera.RGB: 1
+
+ORBextractor.nFeatures: 1000
+ORBextractor.scaleFactor: 1.2
+ORBextractor.nLevels: 8
+ORBextractor.iniThFAST: 20
+ORBextractor.minThFAST: 7
+
+LEFT.K: !!opencv-matrix
+   rows: 3
+   cols: 3
+   dt: d
+   data: [458.654, 0.0, 367.215,
+          0.0, 457.296, 248.375,
+          0.0, 0.0, 1.0]
+
+Viewer.KeyFrameSize: 0.05
+`
+
+func TestNewSettingsFromReader(t *testing.T) {
+	s, err := NewSettingsFromReader(strings.NewReader(tum1))
+	if err != nil {
+		t.Fatalf("NewSettingsFromReader: %s", err)
+	}
+	if want := (camera.Pinhole{Fx: 517.306408, Fy: 516.469215, Cx: 318.643040, Cy: 255.313989}); s.Camera != want {
+		t.Errorf("got camera %+v want %+v", s.Camera, want)
+	}
+	if want := (camera.Distortion{K1: 0.262383, K2: -0.953104, P1: -0.005358, P2: 0.002628, K3: 1.163314}); s.Distortion != want {
+		t.Errorf("got distortion %+v want %+v", s.Distortion, want)
+	}
+	if s.FPS != 30 || !s.RGB {
+		t.Errorf("got fps %d rgb %v", s.FPS, s.RGB)
+	}
+	if want := (ORBSettings{NumFeatures: 1000, ScaleFactor: 1.2, NumLevels: 8, IniThFAST: 20, MinThFAST: 7}); s.ORB != want {
+		t.Errorf("got ORB settings %+v want %+v", s.ORB, want)
+	}
+	for key, want := range map[string]string{
+		"LEFT.K":              "!!opencv-matrix",
+		"LEFT.K.rows":         "3",
+		"LEFT.K.data":         "[458.654, 0.0, 367.215, 0.0, 457.296, 248.375, 0.0, 0.0, 1.0]",
+		"Viewer.KeyFrameSize": "0.05",
+	} {
+		if got, ok := s.Value(key); !ok || got != want {
+			t.Errorf("%s: got '%s' want '%s'", key, got, want)
+		}
+	}
+}
+
+func TestNewSettingsFromReaderDefaults(t *testing.T) {
+	s, err := NewSettingsFromReader(strings.NewReader("Camera.fx: 500\nCamera.fy: 500\nCamera.cx: 320\nCamera.cy: 240\n"))
+	if err != nil {
+		t.Fatalf("NewSettingsFromReader: %s", err)
+	}
+	if !s.Distortion.IsZero() || s.FPS != 30 || s.RGB || s.ORB.NumFeatures != 1000 || s.ORB.NumLevels != 8 {
+		t.Errorf("got defaults %+v", s)
+	}
+	if s.Bf != 0 || s.ThDepth != 35 || s.DepthMapFactor != 1 {
+		t.Errorf("got stereo defaults bf=%v ThDepth=%v DepthMapFactor=%v", s.Bf, s.ThDepth, s.DepthMapFactor)
+	}
+}
+
+// Based on the TUM1.yaml RGB-D settings shipped with ORB-SLAM2
+func TestNewSettingsFromReaderRGBD(t *testing.T) {
+	s, err := NewSettingsFromReader(strings.NewReader(`Camera.fx: 517.306408
+Camera.fy: 516.469215
+Camera.cx: 318.643040
+Camera.cy: 255.313989
+Camera.bf: 40.0
+ThDepth: 40.0
+DepthMapFactor: 5000.0
+`))
+	if err != nil {
+		t.Fatalf("NewSettingsFromReader: %s", err)
+	}
+	if s.Bf != 40 || s.ThDepth != 40 || s.DepthMapFactor != 5000 {
+		t.Errorf("got bf=%v ThDepth=%v DepthMapFactor=%v", s.Bf, s.ThDepth, s.DepthMapFactor)
+	}
+}
+
+// The camera settings of the EuRoC.yaml settings shipped with ORB-SLAM3, without the extrinsics
+const euroc = `Camera.fx: 458.654
+Camera.fy: 457.296
+Camera.cx: 367.215
+Camera.cy: 248.375
+Camera.k1: -0.28340811
+Camera.k2: 0.07395907
+Camera.p1: 0.00019359
+Camera.p2: 1.76187114e-05
+Camera2.fx: 457.587
+Camera2.fy: 456.134
+Camera2.cx: 379.999
+Camera2.cy: 255.238
+Camera2.k1: -0.28368365
+Camera2.k2: 0.07451284
+Camera2.p1: -0.00010473
+Camera2.p2: -3.55590700e-05
+Camera.width: 752
+Camera.height: 480
+`
+
+func TestNewSettingsFromReaderUnrectifiedStereo(t *testing.T) {
+	s, err := NewSettingsFromReader(strings.NewReader(euroc + `Stereo.T_c1_c2: !!opencv-matrix
+  rows: 4
+  cols: 4
+  dt: f
+  data: [0.999997256477797,-0.002317135723275,-0.000343393120620,0.110074137800478,
+         0.002312067192432,0.999898048507103,-0.014090668452683,-0.000156612054392,
+         0.000376008102320,0.014089835846691,0.999900662638082,0.000889382785432,
+         0,0,0,1.000000000000000]
+`))
+	if err != nil {
+		t.Fatalf("NewSettingsFromReader: %s", err)
+	}
+	if s.Width != 752 || s.Height != 480 || s.Right == nil {
+		t.Fatalf("got size %dx%d and right camera %+v", s.Width, s.Height, s.Right)
+	}
+	if want := (camera.Pinhole{Fx: 457.587, Fy: 456.134, Cx: 379.999, Cy: 255.238}); s.Right.Camera != want {
+		t.Errorf("got right camera %+v want %+v", s.Right.Camera, want)
+	}
+	if s.Right.Distortion.K1 != -0.28368365 || s.Right.Distortion.P2 != -3.55590700e-05 {
+		t.Errorf("got right distortion %+v", s.Right.Distortion)
+	}
+	if tr := s.Right.Tlr.T; tr[0] != 0.110074137800478 || tr[2] != 0.000889382785432 {
+		t.Errorf("got translation %v", tr)
+	}
+	if r := s.Right.Tlr.R.Matrix(); math.Abs(r[1][2]+0.014090668452683) > 1e-6 {
+		t.Errorf("got rotation %v", r)
+	}
+}
+
+// Based on the EuRoC.yaml stereo settings shipped with ORB-SLAM2
+func TestNewSettingsFromReaderStereo(t *testing.T) {
+	s, err := NewSettingsFromReader(strings.NewReader(`Camera.fx: 435.2046959714599
+Camera.fy: 435.2046959714599
+Camera.cx: 367.4517211914062
+Camera.cy: 252.2008514404297
+Camera.bf: 47.90639384423901
+ThDepth: 35
+`))
+	if err != nil {
+		t.Fatalf("NewSettingsFromReader: %s", err)
+	}
+	if s.Bf != 47.90639384423901 || s.ThDepth != 35 {
+		t.Errorf("got bf=%v ThDepth=%v", s.Bf, s.ThDepth)
+	}
+	// the EuRoC baseline is 11cm
+	if got := s.DepthThreshold(); got < 3.85 || got > 3.86 {
+		t.Errorf("got depth threshold %v", got)
+	}
+}
+
+// The IMU settings of the EuRoC monocular-inertial settings shipped with ORB-SLAM3
+const eurocIMU = `Camera.fx: 458.654
+Camera.fy: 457.296
+Camera.cx: 367.215
+Camera.cy: 248.375
+
+IMU.T_b_c1: !!opencv-matrix
+   rows: 4
+   cols: 4
+   dt: f
+   data: [0.0148655429818, -0.999880929698, 0.00414029679422, -0.0216401454975,
+         0.999557249008, 0.0149672133247, 0.025715529948, -0.064676986768,
+        -0.0257744366974, 0.00375618835797, 0.999660727178, 0.00981073058949,
+         0.0, 0.0, 0.0, 1.0]
+
+# IMU noise
+IMU.NoiseGyro: 1.7e-4
+IMU.NoiseAcc: 2.0000e-3
+IMU.GyroWalk: 1.9393e-05
+IMU.AccWalk: 3.0000e-03
+IMU.Frequency: 200.0
+`
+
+func TestNewSettingsFromReaderIMU(t *testing.T) {
+	s, err := NewSettingsFromReader(strings.NewReader(eurocIMU))
+	if err != nil {
+		t.Fatalf("NewSettingsFromReader: %s", err)
+	}
+	if s.IMU == nil {
+		t.Fatalf("no IMU calibration")
+	}
+	if tr := s.IMU.Tbc.T; tr[0] != -0.0216401454975 || tr[2] != 0.00981073058949 {
+		t.Errorf("got translation %v", tr)
+	}
+	if d := s.IMU.Tcb.Mul(s.IMU.Tbc).T.Norm(); d > 1e-12 {
+		t.Errorf("Tcb is not the inverse of Tbc")
+	}
+	// the noise densities are converted to the discrete time noise at 200Hz
+	if got, want := s.IMU.NoiseGyro, 1.7e-4*math.Sqrt(200); math.Abs(got-want) > 1e-12 {
+		t.Errorf("got gyroscope noise %v want %v", got, want)
+	}
+	if got, want := s.IMU.WalkAcc, 3e-3/math.Sqrt(200); math.Abs(got-want) > 1e-12 {
+		t.Errorf("got accelerometer random walk %v want %v", got, want)
+	}
+	if s, err := NewSettingsFromReader(strings.NewReader(tum1)); err != nil || s.IMU != nil {
+		t.Errorf("got IMU %+v for a camera without one, err %v", s.IMU, err)
+	}
+}
+
+func TestNewSettingsFromReaderErrors(t *testing.T) {
+	testCases := map[string]string{
+		"missing":      "Camera.fx: 500\nCamera.fy: 500\nCamera.cx: 320\n",
+		"not a number": "Camera.fx: abc\nCamera.fy: 500\nCamera.cx: 320\nCamera.cy: 240\n",
+		"no colon":     "Camera.fx 500\n",
+		"bad focal":    "Camera.fx: 0\nCamera.fy: 500\nCamera.cx: 320\nCamera.cy: 240\n",
+		"bad bf":       "Camera.fx: 500\nCamera.fy: 500\nCamera.cx: 320\nCamera.cy: 240\nCamera.bf: -40\n",
+		"bad depth":    "Camera.fx: 500\nCamera.fy: 500\nCamera.cx: 320\nCamera.cy: 240\nDepthMapFactor: 0\n",
+		"bad matrix":   euroc + "Stereo.T_c1_c2: !!opencv-matrix\n  rows: 3\n  cols: 4\n  dt: f\n  data: [1, 0, 0, 0.11, 0, 1, 0, 0, 0, 0, 1, 0]\n",
+		"no matrix":    euroc,
+		"bad scale":    "Camera.fx: 500\nCamera.fy: 500\nCamera.cx: 320\nCamera.cy: 240\nORBextractor.scaleFactor: 1\n",
+		"unterminated": "Camera.fx: 500\nM: [1, 2,\n3\n",
+		"no IMU walk":  strings.Replace(eurocIMU, "IMU.AccWalk", "IMU.AccelerometerWalk", 1),
+		"bad IMU":      strings.Replace(eurocIMU, "IMU.Frequency: 200.0", "IMU.Frequency: 0", 1),
+	}
+	for name, contents := range testCases {
+		if _, err := NewSettingsFromReader(strings.NewReader(contents)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,377 @@
+package solver
+
+import (
+	"math"
+
+	"github.com/kegsay/gorbslam/internal/camera"
+	"github.com/kegsay/gorbslam/internal/geom"
+)
+
+// EPnP solves the Perspective-n-Point problem in O(n) by expressing every 3D point as a weighted
+// sum of 4 virtual control points, then solving for the control points in the camera frame.
+// Learning: Lepetit, Moreno-Noguer, Fua: "EPnP: An Accurate O(n) Solution to the PnP Problem" (IJCV 2009)
+//
+// The world points and pixels must have the same length, which must be at least 4.
+// Returns the camera pose Tcw which maps world points into the camera frame, along with the mean
+// reprojection error in pixels.
+func EPnP(cam camera.Pinhole, worldPoints []geom.Vec3, pixels [][2]float64) (pose geom.SE3, reprojErr float64, ok bool) {
+	n := len(worldPoints)
+	if n < 4 || len(pixels) != n {
+		return pose, 0, false
+	}
+	e := epnp{
+		cam:    cam,
+		pws:    worldPoints,
+		us:     pixels,
+		alphas: make([][4]float64, n),
+		pcs:    make([]geom.Vec3, n),
+	}
+	if !e.chooseControlPoints() {
+		return pose, 0, false
+	}
+	if !e.computeBarycentricCoordinates() {
+		return pose, 0, false
+	}
+	m := e.fillM()
+	_, vecs := geom.SymEigen(m.AtA())
+	// the 4 eigenvectors with the smallest eigenvalues span the solution space
+	var ut [4][12]float64
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 12; j++ {
+			ut[i][j] = vecs.At(j, i)
+		}
+	}
+	l := computeL6x10(ut)
+	rho := e.computeRho()
+
+	// Try the 3 approximations of beta, refining each with Gauss-Newton and pick the one which
+	// reprojects the best.
+	approximations := []func(l *geom.Dense, rho []float64) [4]float64{
+		findBetasApprox1, findBetasApprox2, findBetasApprox3,
+	}
+	bestErr := math.Inf(1)
+	for _, approx := range approximations {
+		betas := approx(l, rho)
+		betas = gaussNewton(l, rho, betas)
+		candidate := e.computePose(ut, betas)
+		reproj := e.reprojectionError(candidate)
+		if reproj < bestErr {
+			bestErr = reproj
+			pose = candidate
+		}
+	}
+	if math.IsInf(bestErr, 1) || math.IsNaN(bestErr) {
+		return pose, 0, false
+	}
+	return pose, bestErr, true
+}
+
+type epnp struct {
+	cam    camera.Pinhole
+	pws    []geom.Vec3
+	us     [][2]float64
+	alphas [][4]float64
+	pcs    []geom.Vec3
+	// control points in world and camera frames
+	cws [4]geom.Vec3
+	ccs [4]geom.Vec3
+}
+
+// The first control point is the centroid of the points, the rest lie along the principal axes.
+func (e *epnp) chooseControlPoints() bool {
+	var c0 geom.Vec3
+	for _, p := range e.pws {
+		c0 = c0.Add(p)
+	}
+	n := float64(len(e.pws))
+	c0 = c0.Scale(1 / n)
+	e.cws[0] = c0
+
+	cov := geom.NewDense(3, 3)
+	for _, p := range e.pws {
+		d := p.Sub(c0)
+		for i := 0; i < 3; i++ {
+			for j := 0; j < 3; j++ {
+				cov.Data[i*3+j] += d[i] * d[j]
+			}
+		}
+	}
+	vals, vecs := geom.SymEigen(cov)
+	for i := 1; i < 4; i++ {
+		// largest eigenvalue first, to match the paper
+		k := 3 - i
+		if vals[k] < 0 {
+			vals[k] = 0
+		}
+		k2 := math.Sqrt(vals[k] / n)
+		axis := geom.Vec3{vecs.At(0, k), vecs.At(1, k), vecs.At(2, k)}
+		e.cws[i] = c0.Add(axis.Scale(k2))
+	}
+	return true
+}
+
+func (e *epnp) computeBarycentricCoordinates() bool {
+	var cc geom.Mat3
+	for i := 0; i < 3; i++ {
+		for j := 1; j < 4; j++ {
+			cc[i][j-1] = e.cws[j][i] - e.cws[0][i]
+		}
+	}
+	ccInv, ok := cc.Inverse()
+	if !ok {
+		// all points are coplanar or collinear along some axis which makes the control points
+		// degenerate. Planar scenes are handled because the PCA axis has a tiny but non-zero
+		// variance in practice, truly degenerate configurations are rejected.
+		return false
+	}
+	for i, p := range e.pws {
+		a := ccInv.MulVec(p.Sub(e.cws[0]))
+		e.alphas[i] = [4]float64{1 - a[0] - a[1] - a[2], a[0], a[1], a[2]}
+	}
+	return true
+}
+
+func (e *epnp) fillM() *geom.Dense {
+	m := geom.NewDense(2*len(e.pws), 12)
+	for i := range e.pws {
+		u, v := e.us[i][0], e.us[i][1]
+		m1 := m.Row(2 * i)
+		m2 := m.Row(2*i + 1)
+		for j := 0; j < 4; j++ {
+			a := e.alphas[i][j]
+			m1[3*j] = a * e.cam.Fx
+			m1[3*j+1] = 0
+			m1[3*j+2] = a * (e.cam.Cx - u)
+
+			m2[3*j] = 0
+			m2[3*j+1] = a * e.cam.Fy
+			m2[3*j+2] = a * (e.cam.Cy - v)
+		}
+	}
+	return m
+}
+
+// pairs of control points whose distances must be preserved
+var controlPointPairs = [6][2]int{{0, 1}, {0, 2}, {0, 3}, {1, 2}, {1, 3}, {2, 3}}
+
+// The 6x10 matrix L relates the (quadratic) betas to the squared distances between control points.
+// The columns correspond to betas [B11 B12 B22 B13 B23 B33 B14 B24 B34 B44].
+func computeL6x10(ut [4][12]float64) *geom.Dense {
+	var dv [4][6]geom.Vec3
+	for i := 0; i < 4; i++ {
+		for j, pair := range controlPointPairs {
+			a, b := pair[0], pair[1]
+			for k := 0; k < 3; k++ {
+				dv[i][j][k] = ut[i][3*a+k] - ut[i][3*b+k]
+			}
+		}
+	}
+	l := geom.NewDense(6, 10)
+	for i := 0; i < 6; i++ {
+		row := l.Row(i)
+		row[0] = dv[0][i].Dot(dv[0][i])
+		row[1] = 2 * dv[0][i].Dot(dv[1][i])
+		row[2] = dv[1][i].Dot(dv[1][i])
+		row[3] = 2 * dv[0][i].Dot(dv[2][i])
+		row[4] = 2 * dv[1][i].Dot(dv[2][i])
+		row[5] = dv[2][i].Dot(dv[2][i])
+		row[6] = 2 * dv[0][i].Dot(dv[3][i])
+		row[7] = 2 * dv[1][i].Dot(dv[3][i])
+		row[8] = 2 * dv[2][i].Dot(dv[3][i])
+		row[9] = dv[3][i].Dot(dv[3][i])
+	}
+	return l
+}
+
+func (e *epnp) computeRho() []float64 {
+	rho := make([]float64, 6)
+	for i, pair := range controlPointPairs {
+		d := e.cws[pair[0]].Sub(e.cws[pair[1]])
+		rho[i] = d.Dot(d)
+	}
+	return rho
+}
+
+func selectColumns(l *geom.Dense, cols ...int) *geom.Dense {
+	out := geom.NewDense(l.Rows, len(cols))
+	for i := 0; i < l.Rows; i++ {
+		for j, c := range cols {
+			out.Set(i, j, l.At(i, c))
+		}
+	}
+	return out
+}
+
+// betas10 = [B11 B12 B22 B13 B23 B33 B14 B24 B34 B44]
+// approx1: [B11 B12 B13 B14]
+func findBetasApprox1(l *geom.Dense, rho []float64) [4]float64 {
+	b4 := geom.LeastSquares(selectColumns(l, 0, 1, 3, 6), rho)
+	var betas [4]float64
+	if b4[0] < 0 {
+		betas[0] = math.Sqrt(-b4[0])
+		betas[1] = -b4[1] / betas[0]
+		betas[2] = -b4[2] / betas[0]
+		betas[3] = -b4[3] / betas[0]
+	} else if b4[0] > 0 {
+		betas[0] = math.Sqrt(b4[0])
+		betas[1] = b4[1] / betas[0]
+		betas[2] = b4[2] / betas[0]
+		betas[3] = b4[3] / betas[0]
+	}
+	return betas
+}
+
+// approx2: [B11 B12 B22]
+func findBetasApprox2(l *geom.Dense, rho []float64) [4]float64 {
+	b3 := geom.LeastSquares(selectColumns(l, 0, 1, 2), rho)
+	var betas [4]float64
+	if b3[0] < 0 {
+		betas[0] = math.Sqrt(-b3[0])
+		if b3[2] < 0 {
+			betas[1] = math.Sqrt(-b3[2])
+		}
+	} else {
+		betas[0] = math.Sqrt(b3[0])
+		if b3[2] > 0 {
+			betas[1] = math.Sqrt(b3[2])
+		}
+	}
+	if b3[1] < 0 {
+		betas[0] = -betas[0]
+	}
+	return betas
+}
+
+// approx3: [B11 B12 B22 B13 B23]
+func findBetasApprox3(l *geom.Dense, rho []float64) [4]float64 {
+	b5 := geom.LeastSquares(selectColumns(l, 0, 1, 2, 3, 4), rho)
+	var betas [4]float64
+	if b5[0] < 0 {
+		betas[0] = math.Sqrt(-b5[0])
+		if b5[2] < 0 {
+			betas[1] = math.Sqrt(-b5[2])
+		}
+	} else {
+		betas[0] = math.Sqrt(b5[0])
+		if b5[2] > 0 {
+			betas[1] = math.Sqrt(b5[2])
+		}
+	}
+	if b5[1] < 0 {
+		betas[0] = -betas[0]
+	}
+	if betas[0] != 0 {
+		betas[2] = b5[3] / betas[0]
+	}
+	return betas
+}
+
+// Refine the betas by minimising the difference between the control point distances in the
+// world and camera frames.
+func gaussNewton(l *geom.Dense, rho []float64, betas [4]float64) [4]float64 {
+	const iterations = 5
+	a := geom.NewDense(6, 4)
+	b := make([]float64, 6)
+	for iter := 0; iter < iterations; iter++ {
+		for i := 0; i < 6; i++ {
+			lr := l.Row(i)
+			ar := a.Row(i)
+			ar[0] = 2*lr[0]*betas[0] + lr[1]*betas[1] + lr[3]*betas[2] + lr[6]*betas[3]
+			ar[1] = lr[1]*betas[0] + 2*lr[2]*betas[1] + lr[4]*betas[2] + lr[7]*betas[3]
+			ar[2] = lr[3]*betas[0] + lr[4]*betas[1] + 2*lr[5]*betas[2] + lr[8]*betas[3]
+			ar[3] = lr[6]*betas[0] + lr[7]*betas[1] + lr[8]*betas[2] + 2*lr[9]*betas[3]
+
+			b[i] = rho[i] - (lr[0]*betas[0]*betas[0] +
+				lr[1]*betas[0]*betas[1] +
+				lr[2]*betas[1]*betas[1] +
+				lr[3]*betas[0]*betas[2] +
+				lr[4]*betas[1]*betas[2] +
+				lr[5]*betas[2]*betas[2] +
+				lr[6]*betas[0]*betas[3] +
+				lr[7]*betas[1]*betas[3] +
+				lr[8]*betas[2]*betas[3] +
+				lr[9]*betas[3]*betas[3])
+		}
+		x := geom.LeastSquares(a, b)
+		for i := 0; i < 4; i++ {
+			betas[i] += x[i]
+		}
+	}
+	return betas
+}
+
+func (e *epnp) computePose(ut [4][12]float64, betas [4]float64) geom.SE3 {
+	// control points in the camera frame
+	for j := 0; j < 4; j++ {
+		e.ccs[j] = geom.Vec3{}
+		for i := 0; i < 4; i++ {
+			for k := 0; k < 3; k++ {
+				e.ccs[j][k] += betas[i] * ut[i][3*j+k]
+			}
+		}
+	}
+	for i := range e.pws {
+		var pc geom.Vec3
+		for j := 0; j < 4; j++ {
+			pc = pc.Add(e.ccs[j].Scale(e.alphas[i][j]))
+		}
+		e.pcs[i] = pc
+	}
+	// points must be in front of the camera
+	if e.pcs[0][2] < 0 {
+		for j := 0; j < 4; j++ {
+			e.ccs[j] = e.ccs[j].Scale(-1)
+		}
+		for i := range e.pcs {
+			e.pcs[i] = e.pcs[i].Scale(-1)
+		}
+	}
+	return AbsoluteOrientation(e.pws, e.pcs)
+}
+
+func (e *epnp) reprojectionError(pose geom.SE3) float64 {
+	var sum float64
+	for i, pw := range e.pws {
+		pc := pose.Transform(pw)
+		if pc[2] <= 0 {
+			return math.Inf(1)
+		}
+		u, v := e.cam.Project(pc)
+		du := e.us[i][0] - u
+		dv := e.us[i][1] - v
+		sum += math.Sqrt(du*du + dv*dv)
+	}
+	return sum / float64(len(e.pws))
+}
+
+// AbsoluteOrientation finds the rigid transform T which best maps points a onto points b in a
+// least squares sense, i.e b = T*a. The slices must be the same length.
+// Learning: Arun, Huang, Blostein: "Least-Squares Fitting of Two 3-D Point Sets" (1987)
+func AbsoluteOrientation(a, b []geom.Vec3) geom.SE3 {
+	var ca, cb geom.Vec3
+	for i := range a {
+		ca = ca.Add(a[i])
+		cb = cb.Add(b[i])
+	}
+	n := float64(len(a))
+	ca = ca.Scale(1 / n)
+	cb = cb.Scale(1 / n)
+
+	var h geom.Mat3
+	for i := range a {
+		h = h.Add(b[i].Sub(cb).Outer(a[i].Sub(ca)))
+	}
+	u, _, v := geom.SVD(h.Dense())
+	um := geom.Mat3FromDense(u)
+	vm := geom.Mat3FromDense(v)
+	r := um.Mul(vm.T())
+	if r.Det() < 0 {
+		// reflection, flip the axis with the smallest singular value
+		for i := 0; i < 3; i++ {
+			um[i][2] = -um[i][2]
+		}
+		r = um.Mul(vm.T())
+	}
+	t := cb.Sub(r.MulVec(ca))
+	return geom.NewSE3(r, t)
+}
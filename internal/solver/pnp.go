@@ -0,0 +1,238 @@
+package solver
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+
+	"github.com/kegsay/gorbslam/internal/camera"
+	"github.com/kegsay/gorbslam/internal/geom"
+)
+
+// PnPCorrespondence is a match between a 2D keypoint in the current frame and a 3D map point.
+type PnPCorrespondence struct {
+	// The map point in world coordinates
+	Point geom.Vec3
+	// Undistorted keypoint position in pixels
+	U float64
+	V float64
+	// The pyramid level the keypoint was extracted from, used to scale the error threshold
+	Octave int
+}
+
+// PnPResult is the outcome of a successful PnP RANSAC run.
+type PnPResult struct {
+	// The camera pose Tcw, which maps world points into the camera frame
+	Pose geom.SE3
+	// Inliers[i] is true if correspondence i agrees with the pose
+	Inliers    []bool
+	NumInliers int
+}
+
+// PnPSolver estimates the camera pose from 2D-3D correspondences using EPnP inside a RANSAC loop.
+// This is used for relocalisation, where the correspondences come from BoW matching and so have
+// a lot of outliers. Semantics match the ORB-SLAM2 PnPsolver: call SetRansacParameters then
+// Iterate repeatedly until a pose is found or there are no more iterations to run.
+type PnPSolver struct {
+	cam   camera.Pinhole
+	corrs []PnPCorrespondence
+	// sigma^2 of the octave for each correspondence
+	sigma2 []float64
+	// squared error thresholds per correspondence: sigma^2 * th2
+	maxError []float64
+	rng      *rand.Rand
+
+	// RANSAC parameters
+	minInliers    int
+	maxIterations int
+	minSet        int
+	epsilon       float64
+
+	// RANSAC state, carried over between calls to Iterate
+	iterations      int
+	bestInliers     []bool
+	bestNumInliers  int
+	bestPose        geom.SE3
+	refinedInliers  []bool
+	refinedPose     geom.SE3
+	refinedNInliers int
+}
+
+// NewPnPSolver creates a solver for the given correspondences. sigma2 contains the squared scale
+// factor for each pyramid level, as the error tolerated in higher octaves is larger. Returns an
+// error if a correspondence's octave is not one of the levels.
+func NewPnPSolver(cam camera.Pinhole, corrs []PnPCorrespondence, sigma2 []float64) (*PnPSolver, error) {
+	s := &PnPSolver{
+		cam:      cam,
+		corrs:    corrs,
+		sigma2:   make([]float64, len(corrs)),
+		maxError: make([]float64, len(corrs)),
+		rng:      rand.New(rand.NewSource(0)),
+	}
+	for i, c := range corrs {
+		if c.Octave < 0 || c.Octave >= len(sigma2) {
+			return nil, fmt.Errorf("correspondence %d is on octave %d of a %d level pyramid", i, c.Octave, len(sigma2))
+		}
+		s.sigma2[i] = sigma2[c.Octave]
+	}
+	s.SetRansacParameters(0.99, 8, 300, 4, 0.4, 5.991)
+	return s, nil
+}
+
+// SetSeed sets the seed for the random sampling, making runs reproducible.
+func (s *PnPSolver) SetSeed(seed int64) {
+	s.rng = rand.New(rand.NewSource(seed))
+}
+
+// SetRansacParameters configures the RANSAC loop.
+//   - probability: the desired probability of picking an outlier-free sample at least once
+//   - minInliers: the minimum number of inliers for a pose to be accepted
+//   - maxIterations: the maximum number of RANSAC iterations across all calls to Iterate
+//   - minSet: the number of correspondences used to compute each hypothesis (>= 4)
+//   - epsilon: the expected inlier ratio
+//   - th2: the chi-squared threshold (2 DoF) which is scaled by sigma^2 per octave. 5.991 is 95%.
+func (s *PnPSolver) SetRansacParameters(probability float64, minInliers, maxIterations, minSet int, epsilon, th2 float64) {
+	s.maxIterations = maxIterations
+	s.minSet = minSet
+	n := len(s.corrs)
+
+	// adjust parameters according to the number of correspondences
+	s.minInliers = minInliers
+	if eps := int(epsilon * float64(n)); eps > s.minInliers {
+		s.minInliers = eps
+	}
+	if s.minInliers < minSet {
+		s.minInliers = minSet
+	}
+	if n > 0 {
+		s.epsilon = math.Max(epsilon, float64(s.minInliers)/float64(n))
+	} else {
+		s.epsilon = epsilon
+	}
+
+	// number of iterations needed to pick an outlier-free set with the desired probability
+	var iterations int
+	if s.minInliers == n || s.epsilon >= 1 {
+		iterations = 1
+	} else {
+		iterations = int(math.Ceil(math.Log(1-probability) / math.Log(1-math.Pow(s.epsilon, float64(minSet)))))
+	}
+	if iterations < 1 {
+		iterations = 1
+	}
+	if iterations < s.maxIterations {
+		s.maxIterations = iterations
+	}
+	for i := range s.corrs {
+		s.maxError[i] = s.sigma2[i] * th2
+	}
+}
+
+// Iterate runs up to n RANSAC iterations. Returns the pose if one has been found with enough inliers
+// after refinement. noMore is true if the solver has exhausted its iterations or cannot possibly
+// succeed, in which case the caller should stop calling Iterate. If noMore is true and a result is
+// returned, it is the best unrefined hypothesis.
+func (s *PnPSolver) Iterate(n int) (result *PnPResult, noMore bool) {
+	numCorrs := len(s.corrs)
+	if numCorrs < s.minInliers {
+		return nil, true
+	}
+	indices := make([]int, numCorrs)
+	points := make([]geom.Vec3, s.minSet)
+	pixels := make([][2]float64, s.minSet)
+	inliers := make([]bool, numCorrs)
+
+	for i := 0; i < n && s.iterations < s.maxIterations; i++ {
+		s.iterations++
+
+		// pick a random minimal set without replacement
+		for j := range indices {
+			indices[j] = j
+		}
+		for j := 0; j < s.minSet; j++ {
+			k := j + s.rng.Intn(numCorrs-j)
+			indices[j], indices[k] = indices[k], indices[j]
+			c := s.corrs[indices[j]]
+			points[j] = c.Point
+			pixels[j] = [2]float64{c.U, c.V}
+		}
+		pose, _, ok := EPnP(s.cam, points, pixels)
+		if !ok {
+			continue
+		}
+		numInliers := s.checkInliers(pose, inliers)
+		if numInliers < s.minInliers {
+			continue
+		}
+		if numInliers > s.bestNumInliers {
+			s.bestNumInliers = numInliers
+			s.bestInliers = append(s.bestInliers[:0], inliers...)
+			s.bestPose = pose
+		}
+		if s.refine() {
+			return &PnPResult{
+				Pose:       s.refinedPose,
+				Inliers:    append([]bool(nil), s.refinedInliers...),
+				NumInliers: s.refinedNInliers,
+			}, false
+		}
+	}
+
+	if s.iterations >= s.maxIterations {
+		if s.bestNumInliers >= s.minInliers {
+			return &PnPResult{
+				Pose:       s.bestPose,
+				Inliers:    append([]bool(nil), s.bestInliers...),
+				NumInliers: s.bestNumInliers,
+			}, true
+		}
+		return nil, true
+	}
+	return nil, false
+}
+
+// Recompute the pose using all the inliers of the best hypothesis, then check the inliers again.
+func (s *PnPSolver) refine() bool {
+	points := make([]geom.Vec3, 0, s.bestNumInliers)
+	pixels := make([][2]float64, 0, s.bestNumInliers)
+	for i, inlier := range s.bestInliers {
+		if !inlier {
+			continue
+		}
+		c := s.corrs[i]
+		points = append(points, c.Point)
+		pixels = append(pixels, [2]float64{c.U, c.V})
+	}
+	pose, _, ok := EPnP(s.cam, points, pixels)
+	if !ok {
+		return false
+	}
+	inliers := make([]bool, len(s.corrs))
+	numInliers := s.checkInliers(pose, inliers)
+	if numInliers <= s.minInliers {
+		return false
+	}
+	s.refinedPose = pose
+	s.refinedInliers = inliers
+	s.refinedNInliers = numInliers
+	return true
+}
+
+func (s *PnPSolver) checkInliers(pose geom.SE3, inliers []bool) int {
+	var numInliers int
+	for i, c := range s.corrs {
+		inliers[i] = false
+		pc := pose.Transform(c.Point)
+		if pc[2] <= 0 {
+			continue
+		}
+		u, v := s.cam.Project(pc)
+		du := c.U - u
+		dv := c.V - v
+		if du*du+dv*dv < s.maxError[i] {
+			inliers[i] = true
+			numInliers++
+		}
+	}
+	return numInliers
+}
@@ -0,0 +1,200 @@
+package solver
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/kegsay/gorbslam/internal/camera"
+	"github.com/kegsay/gorbslam/internal/geom"
+)
+
+var testCam = camera.Pinhole{Fx: 500, Fy: 500, Cx: 320, Cy: 240}
+
+// 8 pyramid levels with a 1.2 scale factor, like the ORB extractor
+func testSigma2() []float64 {
+	sigma2 := make([]float64, 8)
+	scale := 1.0
+	for i := range sigma2 {
+		sigma2[i] = scale * scale
+		scale *= 1.2
+	}
+	return sigma2
+}
+
+func randomPose(rng *rand.Rand) geom.SE3 {
+	return geom.SE3{
+		R: geom.ExpSO3(geom.Vec3{rng.NormFloat64() * 0.3, rng.NormFloat64() * 0.3, rng.NormFloat64() * 0.3}),
+		T: geom.Vec3{rng.NormFloat64(), rng.NormFloat64(), rng.NormFloat64()},
+	}
+}
+
+// Generate world points which are visible from the camera pose Tcw.
+func visiblePoints(rng *rand.Rand, tcw geom.SE3, n int) ([]geom.Vec3, [][2]float64) {
+	twc := tcw.Inverse()
+	world := make([]geom.Vec3, 0, n)
+	pixels := make([][2]float64, 0, n)
+	for len(world) < n {
+		u := rng.Float64() * 640
+		v := rng.Float64() * 480
+		depth := 2 + rng.Float64()*8
+		pc := testCam.Unproject(u, v).Scale(depth)
+		world = append(world, twc.Transform(pc))
+		pixels = append(pixels, [2]float64{u, v})
+	}
+	return world, pixels
+}
+
+func rotationError(a, b geom.SO3) float64 {
+	return a.Mul(b.Inverse()).Angle()
+}
+
+func TestEPnP(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 50; i++ {
+		want := randomPose(rng)
+		// with 4 or 5 points the solution space has 4 dimensions, which the beta approximations
+		// only solve approximately, so don't expect exact results from minimal sets here.
+		world, pixels := visiblePoints(rng, want, 6+rng.Intn(50))
+		got, reprojErr, ok := EPnP(testCam, world, pixels)
+		if !ok {
+			t.Fatalf("EPnP failed")
+		}
+		if reprojErr > 1e-6 {
+			t.Errorf("reprojection error too high: %v", reprojErr)
+		}
+		if rotErr := rotationError(got.R, want.R); rotErr > 1e-6 {
+			t.Errorf("rotation error too high: %v", rotErr)
+		}
+		if tErr := got.T.Sub(want.T).Norm(); tErr > 1e-5 {
+			t.Errorf("translation error too high: %v", tErr)
+		}
+	}
+}
+
+func TestEPnPNoise(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	want := randomPose(rng)
+	world, pixels := visiblePoints(rng, want, 200)
+	for i := range pixels {
+		pixels[i][0] += rng.NormFloat64()
+		pixels[i][1] += rng.NormFloat64()
+	}
+	got, reprojErr, ok := EPnP(testCam, world, pixels)
+	if !ok {
+		t.Fatalf("EPnP failed")
+	}
+	if reprojErr > 2 {
+		t.Errorf("reprojection error too high: %v", reprojErr)
+	}
+	if rotErr := rotationError(got.R, want.R); rotErr > 0.01 {
+		t.Errorf("rotation error too high: %v", rotErr)
+	}
+	if tErr := got.T.Sub(want.T).Norm(); tErr > 0.05 {
+		t.Errorf("translation error too high: %v", tErr)
+	}
+}
+
+func TestPnPSolverRANSAC(t *testing.T) {
+	testCases := []struct {
+		name         string
+		numPoints    int
+		outlierRatio float64
+		noise        float64
+	}{
+		{name: "no outliers", numPoints: 50, outlierRatio: 0, noise: 0.5},
+		{name: "30% outliers", numPoints: 100, outlierRatio: 0.3, noise: 1},
+		{name: "50% outliers", numPoints: 200, outlierRatio: 0.5, noise: 1},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rng := rand.New(rand.NewSource(int64(tc.numPoints)))
+			want := randomPose(rng)
+			world, pixels := visiblePoints(rng, want, tc.numPoints)
+			isOutlier := make([]bool, tc.numPoints)
+			corrs := make([]PnPCorrespondence, tc.numPoints)
+			for i := range corrs {
+				octave := rng.Intn(3)
+				scale := math.Pow(1.2, float64(octave))
+				u := pixels[i][0] + rng.NormFloat64()*tc.noise*scale
+				v := pixels[i][1] + rng.NormFloat64()*tc.noise*scale
+				if rng.Float64() < tc.outlierRatio {
+					isOutlier[i] = true
+					u = rng.Float64() * 640
+					v = rng.Float64() * 480
+				}
+				corrs[i] = PnPCorrespondence{
+					Point: world[i], U: u, V: v, Octave: octave,
+				}
+			}
+			s, err := NewPnPSolver(testCam, corrs, testSigma2())
+			if err != nil {
+				t.Fatalf("NewPnPSolver: %s", err)
+			}
+			s.SetRansacParameters(0.99, 10, 300, 4, 0.3, 5.991)
+			var res *PnPResult
+			for {
+				var noMore bool
+				res, noMore = s.Iterate(5)
+				if res != nil || noMore {
+					break
+				}
+			}
+			if res == nil {
+				t.Fatalf("failed to find a pose")
+			}
+			if rotErr := rotationError(res.Pose.R, want.R); rotErr > 0.01 {
+				t.Errorf("rotation error too high: %v", rotErr)
+			}
+			if tErr := res.Pose.T.Sub(want.T).Norm(); tErr > 0.1 {
+				t.Errorf("translation error too high: %v", tErr)
+			}
+			var wrongInliers int
+			for i := range isOutlier {
+				if isOutlier[i] && res.Inliers[i] {
+					wrongInliers++
+				}
+			}
+			// random outliers may happen to land close to their true projection
+			if wrongInliers > 2 {
+				t.Errorf("%d outliers were marked as inliers", wrongInliers)
+			}
+			if res.NumInliers < int(float64(tc.numPoints)*(1-tc.outlierRatio)*0.8) {
+				t.Errorf("too few inliers: %d", res.NumInliers)
+			}
+		})
+	}
+}
+
+func TestPnPSolverNotEnoughCorrespondences(t *testing.T) {
+	rng := rand.New(rand.NewSource(5))
+	world, pixels := visiblePoints(rng, randomPose(rng), 6)
+	corrs := make([]PnPCorrespondence, len(world))
+	for i := range corrs {
+		corrs[i] = PnPCorrespondence{Point: world[i], U: pixels[i][0], V: pixels[i][1]}
+	}
+	s, err := NewPnPSolver(testCam, corrs, testSigma2())
+	if err != nil {
+		t.Fatalf("NewPnPSolver: %s", err)
+	}
+	s.SetRansacParameters(0.99, 10, 300, 4, 0.5, 5.991)
+	res, noMore := s.Iterate(5)
+	if res != nil || !noMore {
+		t.Fatalf("expected no result and noMore, got %v %v", res, noMore)
+	}
+}
+
+func TestPnPSolverOctaveOutOfRange(t *testing.T) {
+	rng := rand.New(rand.NewSource(6))
+	world, pixels := visiblePoints(rng, randomPose(rng), 6)
+	for _, octave := range []int{len(testSigma2()), -1} {
+		corrs := make([]PnPCorrespondence, len(world))
+		for i := range corrs {
+			corrs[i] = PnPCorrespondence{Point: world[i], U: pixels[i][0], V: pixels[i][1]}
+		}
+		corrs[3].Octave = octave
+		if _, err := NewPnPSolver(testCam, corrs, testSigma2()); err == nil {
+			t.Errorf("octave %d: expected an error", octave)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package solver
+
+import (
+	"math"
+	"math/rand"
+
+	"github.com/kegsay/gorbslam/internal/camera"
+	"github.com/kegsay/gorbslam/internal/geom"
+)
+
+// Sim3Match is a pair of matched map points seen by two keyframes, expressed in each keyframe's camera frame.
+type Sim3Match struct {
+	// The map point in the camera frame of keyframe 1 and keyframe 2 respectively
+	P1 geom.Vec3
+	P2 geom.Vec3
+	// Undistorted keypoint positions in keyframe 1 and keyframe 2
+	U1, V1 float64
+	U2, V2 float64
+	// The pyramid levels the keypoints were extracted from
+	Octave1 int
+	Octave2 int
+}
+
+// Sim3Result is the outcome of a successful Sim3 RANSAC run.
+type Sim3Result struct {
+	// S12 maps points in the camera frame of keyframe 2 into the camera frame of keyframe 1
+	S12 geom.Sim3
+	// Inliers[i] is true if match i agrees with the transform in both keyframes
+	Inliers    []bool
+	NumInliers int
+}
+
+// Sim3Solver estimates the similarity transform between two keyframes which see the same map
+// points, using Horn's closed-form solution inside a RANSAC loop. Monocular maps drift in scale
+// over time, so when we close a loop the two ends of the loop disagree on rotation, translation
+// AND scale. For stereo/RGB-D the scale is observable, so it can be fixed to 1.
+// Learning: Horn: "Closed-form solution of absolute orientation using unit quaternions" (1987)
+type Sim3Solver struct {
+	cam1     camera.Pinhole
+	cam2     camera.Pinhole
+	matches  []Sim3Match
+	fixScale bool
+	// squared error thresholds per match in each keyframe
+	maxError1 []float64
+	maxError2 []float64
+	rng       *rand.Rand
+
+	// RANSAC parameters
+	minInliers    int
+	maxIterations int
+
+	// RANSAC state, carried over between calls to Iterate
+	iterations     int
+	bestNumInliers int
+	best           *Sim3Result
+}
+
+// The chi-squared threshold for 2 degrees of freedom at 99%
+const sim3Th2 = 9.21
+
+// The number of matches needed to compute a similarity transform
+const sim3MinSet = 3
+
+// NewSim3Solver creates a solver for the given matches. sigma2 contains the squared scale factor
+// for each pyramid level. If fixScale is true the scale is forced to 1 (stereo and RGB-D).
+func NewSim3Solver(cam1, cam2 camera.Pinhole, matches []Sim3Match, sigma2 []float64, fixScale bool) *Sim3Solver {
+	s := &Sim3Solver{
+		cam1:      cam1,
+		cam2:      cam2,
+		matches:   matches,
+		fixScale:  fixScale,
+		maxError1: make([]float64, len(matches)),
+		maxError2: make([]float64, len(matches)),
+		rng:       rand.New(rand.NewSource(0)),
+	}
+	for i, m := range matches {
+		s.maxError1[i] = sigma2[m.Octave1] * sim3Th2
+		s.maxError2[i] = sigma2[m.Octave2] * sim3Th2
+	}
+	s.SetRansacParameters(0.99, 6, 300)
+	return s
+}
+
+// SetSeed sets the seed for the random sampling, making runs reproducible.
+func (s *Sim3Solver) SetSeed(seed int64) {
+	s.rng = rand.New(rand.NewSource(seed))
+}
+
+// SetRansacParameters configures the RANSAC loop.
+//   - probability: the desired probability of picking an outlier-free sample at least once
+//   - minInliers: the minimum number of inliers for a transform to be accepted
+//   - maxIterations: the maximum number of RANSAC iterations across all calls to Iterate
+func (s *Sim3Solver) SetRansacParameters(probability float64, minInliers, maxIterations int) {
+	s.minInliers = minInliers
+	s.maxIterations = maxIterations
+	n := len(s.matches)
+	if n == 0 {
+		return
+	}
+	epsilon := float64(minInliers) / float64(n)
+	var iterations int
+	if minInliers >= n || epsilon >= 1 {
+		iterations = 1
+	} else {
+		iterations = int(math.Ceil(math.Log(1-probability) / math.Log(1-math.Pow(epsilon, sim3MinSet))))
+	}
+	if iterations < 1 {
+		iterations = 1
+	}
+	if iterations < s.maxIterations {
+		s.maxIterations = iterations
+	}
+}
+
+// Iterate runs up to n RANSAC iterations. Returns the refined transform as soon as a hypothesis
+// with enough inliers is found. noMore is true if the solver has exhausted its iterations or cannot
+// possibly succeed, in which case the caller should stop calling Iterate.
+func (s *Sim3Solver) Iterate(n int) (result *Sim3Result, noMore bool) {
+	numMatches := len(s.matches)
+	if numMatches < s.minInliers || numMatches < sim3MinSet {
+		return nil, true
+	}
+	indices := make([]int, numMatches)
+	var p1, p2 [sim3MinSet]geom.Vec3
+	inliers := make([]bool, numMatches)
+
+	for i := 0; i < n && s.iterations < s.maxIterations; i++ {
+		s.iterations++
+		for j := range indices {
+			indices[j] = j
+		}
+		for j := 0; j < sim3MinSet; j++ {
+			k := j + s.rng.Intn(numMatches-j)
+			indices[j], indices[k] = indices[k], indices[j]
+			p1[j] = s.matches[indices[j]].P1
+			p2[j] = s.matches[indices[j]].P2
+		}
+		s12, ok := HornSim3(p1[:], p2[:], s.fixScale)
+		if !ok {
+			continue
+		}
+		numInliers := s.checkInliers(s12, inliers)
+		if numInliers < s.minInliers || numInliers <= s.bestNumInliers {
+			continue
+		}
+		s.bestNumInliers = numInliers
+		s.best = s.refine(s12, inliers)
+		return s.best, false
+	}
+	if s.iterations >= s.maxIterations {
+		return nil, true
+	}
+	return nil, false
+}
+
+// Recompute the transform using all inliers, repeating until the inlier set stops changing.
+func (s *Sim3Solver) refine(s12 geom.Sim3, inliers []bool) *Sim3Result {
+	const maxRefinements = 5
+	res := &Sim3Result{
+		S12:     s12,
+		Inliers: append([]bool(nil), inliers...),
+	}
+	for _, in := range inliers {
+		if in {
+			res.NumInliers++
+		}
+	}
+	candidateInliers := make([]bool, len(s.matches))
+	for i := 0; i < maxRefinements; i++ {
+		p1 := make([]geom.Vec3, 0, res.NumInliers)
+		p2 := make([]geom.Vec3, 0, res.NumInliers)
+		for j, in := range res.Inliers {
+			if in {
+				p1 = append(p1, s.matches[j].P1)
+				p2 = append(p2, s.matches[j].P2)
+			}
+		}
+		candidate, ok := HornSim3(p1, p2, s.fixScale)
+		if !ok {
+			break
+		}
+		numInliers := s.checkInliers(candidate, candidateInliers)
+		if numInliers < res.NumInliers {
+			break
+		}
+		changed := false
+		for j := range candidateInliers {
+			if candidateInliers[j] != res.Inliers[j] {
+				changed = true
+				break
+			}
+		}
+		res.S12 = candidate
+		copy(res.Inliers, candidateInliers)
+		res.NumInliers = numInliers
+		if !changed {
+			break
+		}
+	}
+	return res
+}
+
+// Check inliers by reprojecting the points of each keyframe into the other keyframe.
+func (s *Sim3Solver) checkInliers(s12 geom.Sim3, inliers []bool) int {
+	s21 := s12.Inverse()
+	var numInliers int
+	for i, m := range s.matches {
+		inliers[i] = false
+		p2in1 := s12.Transform(m.P2)
+		p1in2 := s21.Transform(m.P1)
+		if p2in1[2] <= 0 || p1in2[2] <= 0 {
+			continue
+		}
+		u1, v1 := s.cam1.Project(p2in1)
+		u2, v2 := s.cam2.Project(p1in2)
+		err1 := (u1-m.U1)*(u1-m.U1) + (v1-m.V1)*(v1-m.V1)
+		err2 := (u2-m.U2)*(u2-m.U2) + (v2-m.V2)*(v2-m.V2)
+		if err1 < s.maxError1[i] && err2 < s.maxError2[i] {
+			inliers[i] = true
+			numInliers++
+		}
+	}
+	return numInliers
+}
+
+// HornSim3 computes the similarity transform S12 such that p1 = S12 * p2 in the least squares
+// sense using Horn's closed-form quaternion method. If fixScale is true, the scale is 1.
+// The slices must be the same length, and at least 3 non-collinear points are needed.
+func HornSim3(p1, p2 []geom.Vec3, fixScale bool) (s12 geom.Sim3, ok bool) {
+	n := len(p1)
+	if n < 3 || len(p2) != n {
+		return s12, false
+	}
+	// centroids
+	var o1, o2 geom.Vec3
+	for i := 0; i < n; i++ {
+		o1 = o1.Add(p1[i])
+		o2 = o2.Add(p2[i])
+	}
+	o1 = o1.Scale(1 / float64(n))
+	o2 = o2.Scale(1 / float64(n))
+
+	// M = sum (p2 - o2) * (p1 - o1)^T
+	var m geom.Mat3
+	for i := 0; i < n; i++ {
+		m = m.Add(p2[i].Sub(o2).Outer(p1[i].Sub(o1)))
+	}
+	// Horn's symmetric 4x4 matrix, whose eigenvector with the largest eigenvalue is the
+	// quaternion (w, x, y, z) of the rotation from 2 to 1
+	nm := geom.NewDenseFrom(4, 4, []float64{
+		m[0][0] + m[1][1] + m[2][2], m[1][2] - m[2][1], m[2][0] - m[0][2], m[0][1] - m[1][0],
+		m[1][2] - m[2][1], m[0][0] - m[1][1] - m[2][2], m[0][1] + m[1][0], m[2][0] + m[0][2],
+		m[2][0] - m[0][2], m[0][1] + m[1][0], -m[0][0] + m[1][1] - m[2][2], m[1][2] + m[2][1],
+		m[0][1] - m[1][0], m[2][0] + m[0][2], m[1][2] + m[2][1], -m[0][0] - m[1][1] + m[2][2],
+	})
+	vals, vecs := geom.SymEigen(nm)
+	if math.IsNaN(vals[3]) {
+		return s12, false
+	}
+	q := geom.Quaternion{W: vecs.At(0, 3), X: vecs.At(1, 3), Y: vecs.At(2, 3), Z: vecs.At(3, 3)}
+	r := q.Matrix()
+
+	s := 1.0
+	if !fixScale {
+		var nom, den float64
+		for i := 0; i < n; i++ {
+			a := p1[i].Sub(o1)
+			b := p2[i].Sub(o2)
+			nom += a.Dot(r.MulVec(b))
+			den += b.Dot(b)
+		}
+		if den == 0 || nom <= 0 {
+			return s12, false
+		}
+		s = nom / den
+	}
+	t := o1.Sub(r.MulVec(o2).Scale(s))
+	return geom.NewSim3(r, t, s), true
+}
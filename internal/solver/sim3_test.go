@@ -0,0 +1,141 @@
+package solver
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/kegsay/gorbslam/internal/geom"
+)
+
+// Generate matches between two keyframes related by p1 = S12 * p2
+func sim3Matches(rng *rand.Rand, s12 geom.Sim3, n int, noise, outlierRatio float64) ([]Sim3Match, []bool) {
+	matches := make([]Sim3Match, 0, n)
+	isOutlier := make([]bool, 0, n)
+	s21 := s12.Inverse()
+	for len(matches) < n {
+		p1 := testCam.Unproject(rng.Float64()*640, rng.Float64()*480).Scale(2 + rng.Float64()*6)
+		p2 := s21.Transform(p1)
+		if p2[2] <= 0.1 {
+			continue
+		}
+		u1, v1 := testCam.Project(p1)
+		u2, v2 := testCam.Project(p2)
+		if u2 < 0 || u2 > 640 || v2 < 0 || v2 > 480 {
+			continue
+		}
+		m := Sim3Match{
+			P1: p1,
+			P2: p2,
+			U1: u1 + rng.NormFloat64()*noise,
+			V1: v1 + rng.NormFloat64()*noise,
+			U2: u2 + rng.NormFloat64()*noise,
+			V2: v2 + rng.NormFloat64()*noise,
+		}
+		outlier := rng.Float64() < outlierRatio
+		if outlier {
+			// the point in keyframe 2 is a completely different point
+			m.P2 = testCam.Unproject(rng.Float64()*640, rng.Float64()*480).Scale(2 + rng.Float64()*6)
+			m.U2, m.V2 = testCam.Project(m.P2)
+		}
+		matches = append(matches, m)
+		isOutlier = append(isOutlier, outlier)
+	}
+	return matches, isOutlier
+}
+
+func TestHornSim3(t *testing.T) {
+	rng := rand.New(rand.NewSource(11))
+	for i := 0; i < 20; i++ {
+		pose := randomPose(rng)
+		want := geom.Sim3{R: pose.R, T: pose.T, S: 0.5 + rng.Float64()*2}
+		p2 := make([]geom.Vec3, 10)
+		p1 := make([]geom.Vec3, 10)
+		for j := range p2 {
+			p2[j] = geom.Vec3{rng.NormFloat64(), rng.NormFloat64(), rng.NormFloat64()}
+			p1[j] = want.Transform(p2[j])
+		}
+		got, ok := HornSim3(p1, p2, false)
+		if !ok {
+			t.Fatalf("HornSim3 failed")
+		}
+		if rotErr := rotationError(got.R, want.R); rotErr > 1e-6 {
+			t.Errorf("rotation error too high: %v", rotErr)
+		}
+		if tErr := got.T.Sub(want.T).Norm(); tErr > 1e-6 {
+			t.Errorf("translation error too high: %v", tErr)
+		}
+		if math.Abs(got.S-want.S) > 1e-6 {
+			t.Errorf("scale: got %v want %v", got.S, want.S)
+		}
+		// with a fixed scale the scale must be 1, and the rotation is still recovered
+		got, ok = HornSim3(p1, p2, true)
+		if !ok || got.S != 1 {
+			t.Fatalf("HornSim3 with fixed scale: ok=%v s=%v", ok, got.S)
+		}
+		if rotErr := rotationError(got.R, want.R); rotErr > 1e-6 {
+			t.Errorf("fixed scale rotation error too high: %v", rotErr)
+		}
+	}
+}
+
+func TestSim3SolverRANSAC(t *testing.T) {
+	testCases := []struct {
+		name         string
+		scale        float64
+		fixScale     bool
+		outlierRatio float64
+	}{
+		{name: "scale drift", scale: 1.7, outlierRatio: 0.3},
+		{name: "scale shrink", scale: 0.6, outlierRatio: 0.5},
+		{name: "fixed scale", scale: 1, fixScale: true, outlierRatio: 0.3},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rng := rand.New(rand.NewSource(99))
+			want := geom.Sim3{
+				R: geom.ExpSO3(geom.Vec3{0.05, -0.2, 0.1}),
+				T: geom.Vec3{0.5, -0.1, 0.3},
+				S: tc.scale,
+			}
+			matches, isOutlier := sim3Matches(rng, want, 80, 0.5, tc.outlierRatio)
+			s := NewSim3Solver(testCam, testCam, matches, testSigma2(), tc.fixScale)
+			s.SetRansacParameters(0.99, 20, 300)
+			var res *Sim3Result
+			for {
+				var noMore bool
+				res, noMore = s.Iterate(5)
+				if res != nil || noMore {
+					break
+				}
+			}
+			if res == nil {
+				t.Fatalf("failed to find a transform")
+			}
+			if rotErr := rotationError(res.S12.R, want.R); rotErr > 0.01 {
+				t.Errorf("rotation error too high: %v", rotErr)
+			}
+			if tErr := res.S12.T.Sub(want.T).Norm(); tErr > 0.05 {
+				t.Errorf("translation error too high: %v", tErr)
+			}
+			if math.Abs(res.S12.S-tc.scale)/tc.scale > 0.02 {
+				t.Errorf("scale: got %v want %v", res.S12.S, tc.scale)
+			}
+			var wrongInliers, numInliers int
+			for i := range isOutlier {
+				if res.Inliers[i] {
+					numInliers++
+					if isOutlier[i] {
+						wrongInliers++
+					}
+				}
+			}
+			if numInliers != res.NumInliers {
+				t.Errorf("NumInliers %d does not match inlier mask %d", res.NumInliers, numInliers)
+			}
+			if wrongInliers > 0 {
+				t.Errorf("%d outliers were marked as inliers", wrongInliers)
+			}
+		})
+	}
+}
@@ -0,0 +1,548 @@
+package solver
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+
+	"github.com/kegsay/gorbslam/internal/camera"
+	"github.com/kegsay/gorbslam/internal/geom"
+)
+
+const (
+	// chi-squared thresholds at 95%: 1 DoF for the distance to an epipolar line, 2 DoF for the
+	// distance to a point
+	chi2OneDoF = 3.841
+	chi2TwoDoF = 5.991
+	// the homography is chosen over the fundamental matrix above this score ratio
+	homographyRatio = 0.40
+	// parallax (cosine) below which a point is too far away to triangulate reliably
+	maxCosParallax = 0.99998
+)
+
+// TwoViewResult is the relative pose and structure recovered from two views.
+type TwoViewResult struct {
+	// The pose of the second camera relative to the first, T21
+	Pose geom.SE3
+	// Points[i] is match i triangulated in the first camera's frame, valid if Triangulated[i]
+	Points          []geom.Vec3
+	Triangulated    []bool
+	NumTriangulated int
+	// True if the scene was explained by a homography (planar or low parallax) rather than the
+	// fundamental matrix
+	Homography bool
+}
+
+// TwoViewSolver recovers the motion between two views of an unknown scene, used to initialise a
+// monocular map. Semantics match the ORB-SLAM2 Initializer: a homography and a fundamental matrix
+// are estimated in parallel with RANSAC, the model which better explains the matches is chosen
+// and decomposed into candidate motions, and a motion is only accepted if triangulating with it
+// puts most points in front of both cameras with enough parallax and no other candidate comes
+// close.
+// Learning: https://www.youtube.com/watch?v=izpYAwJ0Hlw
+type TwoViewSolver struct {
+	cam        camera.Pinhole
+	sigma2     float64
+	iterations int
+	rng        *rand.Rand
+	// MinParallax is the minimum parallax in degrees for the reconstruction to be accepted
+	MinParallax float64
+	// MinTriangulated is the minimum number of points which must be triangulated
+	MinTriangulated int
+}
+
+// NewTwoViewSolver creates a solver for keypoints with a position error of sigma pixels, running
+// the given number of RANSAC iterations for each model.
+func NewTwoViewSolver(cam camera.Pinhole, sigma float64, iterations int) *TwoViewSolver {
+	return &TwoViewSolver{
+		cam:             cam,
+		sigma2:          sigma * sigma,
+		iterations:      iterations,
+		rng:             rand.New(rand.NewSource(0)),
+		MinParallax:     1.0,
+		MinTriangulated: 50,
+	}
+}
+
+// SetSeed sets the seed for the random sampling, making runs reproducible.
+func (s *TwoViewSolver) SetSeed(seed int64) {
+	s.rng = rand.New(rand.NewSource(seed))
+}
+
+// Reconstruct recovers the motion from the matched undistorted keypoints, where pts1[i] in the
+// first image matches pts2[i] in the second. Returns false if there is too little parallax or the
+// motion is ambiguous, in which case the caller should try again with a later frame.
+func (s *TwoViewSolver) Reconstruct(pts1, pts2 [][2]float64) (*TwoViewResult, bool) {
+	n := len(pts1)
+	if n < 8 || len(pts2) != n {
+		return nil, false
+	}
+	// the same minimal sets are used for both models
+	sets := make([][8]int, s.iterations)
+	for it := range sets {
+		available := make([]int, n)
+		for i := range available {
+			available[i] = i
+		}
+		for j := 0; j < 8; j++ {
+			k := s.rng.Intn(len(available))
+			sets[it][j] = available[k]
+			available[k] = available[len(available)-1]
+			available = available[:len(available)-1]
+		}
+	}
+
+	h21, inliersH, scoreH := s.findHomography(pts1, pts2, sets)
+	f21, inliersF, scoreF := s.findFundamental(pts1, pts2, sets)
+	if scoreH+scoreF == 0 {
+		return nil, false
+	}
+	if scoreH/(scoreH+scoreF) > homographyRatio {
+		return s.reconstructH(pts1, pts2, inliersH, h21)
+	}
+	return s.reconstructF(pts1, pts2, inliersF, f21)
+}
+
+// Translate the points so their centroid is the origin and scale them to a mean absolute deviation
+// of 1, which makes the DLT well conditioned. Returns the points and the transform applied.
+func normalisePoints(pts [][2]float64) ([][2]float64, geom.Mat3) {
+	var meanX, meanY float64
+	for _, p := range pts {
+		meanX += p[0]
+		meanY += p[1]
+	}
+	meanX /= float64(len(pts))
+	meanY /= float64(len(pts))
+	var devX, devY float64
+	out := make([][2]float64, len(pts))
+	for i, p := range pts {
+		out[i] = [2]float64{p[0] - meanX, p[1] - meanY}
+		devX += math.Abs(out[i][0])
+		devY += math.Abs(out[i][1])
+	}
+	sX := float64(len(pts)) / devX
+	sY := float64(len(pts)) / devY
+	for i := range out {
+		out[i][0] *= sX
+		out[i][1] *= sY
+	}
+	return out, geom.Mat3{
+		{sX, 0, -meanX * sX},
+		{0, sY, -meanY * sY},
+		{0, 0, 1},
+	}
+}
+
+// The right singular vector of a with the smallest singular value, as a 3x3 matrix
+func nullSpace3(a *geom.Dense) geom.Mat3 {
+	_, _, v := geom.SVD(a)
+	var m geom.Mat3
+	for i := 0; i < 9; i++ {
+		m[i/3][i%3] = v.At(i, 8)
+	}
+	return m
+}
+
+func computeH21(p1, p2 [][2]float64) geom.Mat3 {
+	a := geom.NewDense(2*len(p1), 9)
+	for i := range p1 {
+		u1, v1 := p1[i][0], p1[i][1]
+		u2, v2 := p2[i][0], p2[i][1]
+		copy(a.Row(2*i), []float64{0, 0, 0, -u1, -v1, -1, v2 * u1, v2 * v1, v2})
+		copy(a.Row(2*i+1), []float64{u1, v1, 1, 0, 0, 0, -u2 * u1, -u2 * v1, -u2})
+	}
+	return nullSpace3(a)
+}
+
+func computeF21(p1, p2 [][2]float64) geom.Mat3 {
+	a := geom.NewDense(len(p1), 9)
+	for i := range p1 {
+		u1, v1 := p1[i][0], p1[i][1]
+		u2, v2 := p2[i][0], p2[i][1]
+		copy(a.Row(i), []float64{u2 * u1, u2 * v1, u2, v2 * u1, v2 * v1, v2, u1, v1, 1})
+	}
+	f := nullSpace3(a)
+	// enforce rank 2
+	u, w, v := geom.SVD(f.Dense())
+	w[2] = 0
+	return geom.Mat3FromDense(u.Mul(diag(w)).Mul(v.T()))
+}
+
+func diag(d []float64) *geom.Dense {
+	m := geom.NewDense(len(d), len(d))
+	for i, x := range d {
+		m.Set(i, i, x)
+	}
+	return m
+}
+
+func (s *TwoViewSolver) findHomography(pts1, pts2 [][2]float64, sets [][8]int) (geom.Mat3, []bool, float64) {
+	pn1, t1 := normalisePoints(pts1)
+	pn2, t2 := normalisePoints(pts2)
+	t2inv, _ := t2.Inverse()
+
+	var best geom.Mat3
+	var bestInliers []bool
+	var bestScore float64
+	inliers := make([]bool, len(pts1))
+	var s1, s2 [8][2]float64
+	for _, set := range sets {
+		for j, idx := range set {
+			s1[j] = pn1[idx]
+			s2[j] = pn2[idx]
+		}
+		hn := computeH21(s1[:], s2[:])
+		h21 := t2inv.Mul(hn).Mul(t1)
+		h12, ok := h21.Inverse()
+		if !ok {
+			continue
+		}
+		score := s.checkHomography(pts1, pts2, h21, h12, inliers)
+		if score > bestScore {
+			best = h21
+			bestScore = score
+			bestInliers = append(bestInliers[:0], inliers...)
+		}
+	}
+	return best, bestInliers, bestScore
+}
+
+func (s *TwoViewSolver) findFundamental(pts1, pts2 [][2]float64, sets [][8]int) (geom.Mat3, []bool, float64) {
+	pn1, t1 := normalisePoints(pts1)
+	pn2, t2 := normalisePoints(pts2)
+
+	var best geom.Mat3
+	var bestInliers []bool
+	var bestScore float64
+	inliers := make([]bool, len(pts1))
+	var s1, s2 [8][2]float64
+	for _, set := range sets {
+		for j, idx := range set {
+			s1[j] = pn1[idx]
+			s2[j] = pn2[idx]
+		}
+		fn := computeF21(s1[:], s2[:])
+		f21 := t2.T().Mul(fn).Mul(t1)
+		score := s.checkFundamental(pts1, pts2, f21, inliers)
+		if score > bestScore {
+			best = f21
+			bestScore = score
+			bestInliers = append(bestInliers[:0], inliers...)
+		}
+	}
+	return best, bestInliers, bestScore
+}
+
+func transferError(h geom.Mat3, from, to [2]float64) float64 {
+	w := 1 / (h[2][0]*from[0] + h[2][1]*from[1] + h[2][2])
+	u := (h[0][0]*from[0] + h[0][1]*from[1] + h[0][2]) * w
+	v := (h[1][0]*from[0] + h[1][1]*from[1] + h[1][2]) * w
+	return (to[0]-u)*(to[0]-u) + (to[1]-v)*(to[1]-v)
+}
+
+// Score the homography by the symmetric transfer error: matches within the threshold in both
+// images are inliers, and each contributes how far inside the threshold it is.
+func (s *TwoViewSolver) checkHomography(pts1, pts2 [][2]float64, h21, h12 geom.Mat3, inliers []bool) float64 {
+	var score float64
+	for i := range pts1 {
+		inliers[i] = true
+		chi2 := transferError(h12, pts2[i], pts1[i]) / s.sigma2
+		if chi2 > chi2TwoDoF {
+			inliers[i] = false
+		} else {
+			score += chi2TwoDoF - chi2
+		}
+		chi2 = transferError(h21, pts1[i], pts2[i]) / s.sigma2
+		if chi2 > chi2TwoDoF {
+			inliers[i] = false
+		} else {
+			score += chi2TwoDoF - chi2
+		}
+	}
+	return score
+}
+
+// Score the fundamental matrix by the distance of each point to the epipolar line of its match.
+// The score uses the 2 DoF threshold so that it is comparable with the homography score.
+func (s *TwoViewSolver) checkFundamental(pts1, pts2 [][2]float64, f21 geom.Mat3, inliers []bool) float64 {
+	var score float64
+	for i := range pts1 {
+		inliers[i] = true
+		x1 := geom.Vec3{pts1[i][0], pts1[i][1], 1}
+		x2 := geom.Vec3{pts2[i][0], pts2[i][1], 1}
+		// the epipolar line of x1 in the second image, l2 = F21 x1
+		l2 := f21.MulVec(x1)
+		num := l2.Dot(x2)
+		chi2 := num * num / (l2[0]*l2[0] + l2[1]*l2[1]) / s.sigma2
+		if chi2 > chi2OneDoF {
+			inliers[i] = false
+		} else {
+			score += chi2TwoDoF - chi2
+		}
+		// the epipolar line of x2 in the first image, l1 = F21^T x2
+		l1 := f21.T().MulVec(x2)
+		num = l1.Dot(x1)
+		chi2 = num * num / (l1[0]*l1[0] + l1[1]*l1[1]) / s.sigma2
+		if chi2 > chi2OneDoF {
+			inliers[i] = false
+		} else {
+			score += chi2TwoDoF - chi2
+		}
+	}
+	return score
+}
+
+func countTrue(b []bool) int {
+	n := 0
+	for _, x := range b {
+		if x {
+			n++
+		}
+	}
+	return n
+}
+
+type motionHypothesis struct {
+	r geom.Mat3
+	t geom.Vec3
+}
+
+type checkedMotion struct {
+	motionHypothesis
+	good         int
+	points       []geom.Vec3
+	triangulated []bool
+	parallax     float64
+}
+
+func (s *TwoViewSolver) result(m *checkedMotion, homography bool) *TwoViewResult {
+	return &TwoViewResult{
+		Pose:            geom.NewSE3(m.r, m.t),
+		Points:          m.points,
+		Triangulated:    m.triangulated,
+		NumTriangulated: countTrue(m.triangulated),
+		Homography:      homography,
+	}
+}
+
+func (s *TwoViewSolver) reconstructF(pts1, pts2 [][2]float64, inliers []bool, f21 geom.Mat3) (*TwoViewResult, bool) {
+	n := countTrue(inliers)
+	k := s.cam.K()
+	e21 := k.T().Mul(f21).Mul(k)
+	r1, r2, t := decomposeE(e21)
+	hypotheses := []motionHypothesis{{r1, t}, {r2, t}, {r1, t.Scale(-1)}, {r2, t.Scale(-1)}}
+
+	var best *checkedMotion
+	checked := make([]*checkedMotion, len(hypotheses))
+	for i, h := range hypotheses {
+		checked[i] = s.checkRT(h, pts1, pts2, inliers)
+		if best == nil || checked[i].good > best.good {
+			best = checked[i]
+		}
+	}
+	minGood := int(0.9 * float64(n))
+	if minGood < s.MinTriangulated {
+		minGood = s.MinTriangulated
+	}
+	similar := 0
+	for _, c := range checked {
+		if float64(c.good) > 0.7*float64(best.good) {
+			similar++
+		}
+	}
+	// reject if there is no clear winner or not enough triangulated points
+	if best.good < minGood || similar > 1 {
+		return nil, false
+	}
+	if best.parallax <= s.MinParallax {
+		return nil, false
+	}
+	return s.result(best, false), true
+}
+
+// Decompose the essential matrix into the two possible rotations and the translation direction.
+// Learning: Hartley & Zisserman, Multiple View Geometry, 9.6.2
+func decomposeE(e geom.Mat3) (r1, r2 geom.Mat3, t geom.Vec3) {
+	u, _, v := geom.SVD(e.Dense())
+	um := geom.Mat3FromDense(u)
+	vt := geom.Mat3FromDense(v).T()
+	t = um.Col(2).Normalised()
+	w := geom.Mat3{{0, -1, 0}, {1, 0, 0}, {0, 0, 1}}
+	r1 = um.Mul(w).Mul(vt)
+	if r1.Det() < 0 {
+		r1 = r1.Scale(-1)
+	}
+	r2 = um.Mul(w.T()).Mul(vt)
+	if r2.Det() < 0 {
+		r2 = r2.Scale(-1)
+	}
+	return r1, r2, t
+}
+
+// Decompose the homography into 8 candidate motions with the method of Faugeras, and pick the one
+// which triangulates the most points.
+// Learning: Faugeras & Lustman, Motion and structure from motion in a piecewise planar environment
+func (s *TwoViewSolver) reconstructH(pts1, pts2 [][2]float64, inliers []bool, h21 geom.Mat3) (*TwoViewResult, bool) {
+	n := countTrue(inliers)
+	k := s.cam.K()
+	invK, _ := k.Inverse()
+	a := invK.Mul(h21).Mul(k)
+	ud, w, vd := geom.SVD(a.Dense())
+	u := geom.Mat3FromDense(ud)
+	v := geom.Mat3FromDense(vd)
+	vt := v.T()
+	sign := u.Det() * vt.Det()
+
+	d1, d2, d3 := w[0], w[1], w[2]
+	if d1/d2 < 1.00001 || d2/d3 < 1.00001 {
+		return nil, false
+	}
+	aux1 := math.Sqrt((d1*d1 - d2*d2) / (d1*d1 - d3*d3))
+	aux3 := math.Sqrt((d2*d2 - d3*d3) / (d1*d1 - d3*d3))
+	x1 := [4]float64{aux1, aux1, -aux1, -aux1}
+	x3 := [4]float64{aux3, -aux3, aux3, -aux3}
+
+	var hypotheses []motionHypothesis
+	// d' = d2
+	auxSTheta := math.Sqrt((d1*d1-d2*d2)*(d2*d2-d3*d3)) / ((d1 + d3) * d2)
+	cTheta := (d2*d2 + d1*d3) / ((d1 + d3) * d2)
+	sTheta := [4]float64{auxSTheta, -auxSTheta, -auxSTheta, auxSTheta}
+	for i := 0; i < 4; i++ {
+		rp := geom.Mat3{{cTheta, 0, -sTheta[i]}, {0, 1, 0}, {sTheta[i], 0, cTheta}}
+		r := u.Mul(rp).Mul(vt).Scale(sign)
+		tp := geom.Vec3{x1[i], 0, -x3[i]}.Scale(d1 - d3)
+		hypotheses = append(hypotheses, motionHypothesis{r, u.MulVec(tp).Normalised()})
+	}
+	// d' = -d2
+	auxSPhi := math.Sqrt((d1*d1-d2*d2)*(d2*d2-d3*d3)) / ((d1 - d3) * d2)
+	cPhi := (d1*d3 - d2*d2) / ((d1 - d3) * d2)
+	sPhi := [4]float64{auxSPhi, -auxSPhi, -auxSPhi, auxSPhi}
+	for i := 0; i < 4; i++ {
+		rp := geom.Mat3{{cPhi, 0, sPhi[i]}, {0, -1, 0}, {sPhi[i], 0, -cPhi}}
+		r := u.Mul(rp).Mul(vt).Scale(sign)
+		tp := geom.Vec3{x1[i], 0, x3[i]}.Scale(d1 + d3)
+		hypotheses = append(hypotheses, motionHypothesis{r, u.MulVec(tp).Normalised()})
+	}
+
+	var best *checkedMotion
+	secondBestGood := 0
+	for _, h := range hypotheses {
+		c := s.checkRT(h, pts1, pts2, inliers)
+		if best == nil || c.good > best.good {
+			if best != nil {
+				secondBestGood = best.good
+			}
+			best = c
+		} else if c.good > secondBestGood {
+			secondBestGood = c.good
+		}
+	}
+	if float64(secondBestGood) < 0.75*float64(best.good) && best.parallax >= s.MinParallax &&
+		best.good > s.MinTriangulated && float64(best.good) > 0.9*float64(n) {
+		return s.result(best, true), true
+	}
+	return nil, false
+}
+
+// Triangulate the inliers with the motion, counting the points which are in front of both
+// cameras with a small reprojection error in both images. The parallax reported is the 50th
+// largest (or the smallest, if there are fewer points) so that a handful of points with a large
+// parallax can't make a poor reconstruction look good.
+func (s *TwoViewSolver) checkRT(h motionHypothesis, pts1, pts2 [][2]float64, inliers []bool) *checkedMotion {
+	c := &checkedMotion{
+		motionHypothesis: h,
+		points:           make([]geom.Vec3, len(pts1)),
+		triangulated:     make([]bool, len(pts1)),
+	}
+	k := s.cam.K()
+	p1 := projectionMatrix(k, geom.Identity3(), geom.Vec3{})
+	p2 := projectionMatrix(k, h.r, h.t)
+	// the second camera center in the first camera's frame
+	o2 := h.r.T().MulVec(h.t).Scale(-1)
+	th2 := 4 * s.sigma2
+
+	var cosParallaxes []float64
+	for i := range pts1 {
+		if !inliers[i] {
+			continue
+		}
+		x, ok := Triangulate(pts1[i][0], pts1[i][1], p1, pts2[i][0], pts2[i][1], p2)
+		if !ok {
+			continue
+		}
+		dist1 := x.Norm()
+		normal2 := x.Sub(o2)
+		cosParallax := x.Dot(normal2) / (dist1 * normal2.Norm())
+		// points with little parallax can be far away, so may not be in front of the camera
+		if x[2] <= 0 && cosParallax < maxCosParallax {
+			continue
+		}
+		x2 := h.r.MulVec(x).Add(h.t)
+		if x2[2] <= 0 && cosParallax < maxCosParallax {
+			continue
+		}
+		u, v := s.cam.Project(x)
+		if (u-pts1[i][0])*(u-pts1[i][0])+(v-pts1[i][1])*(v-pts1[i][1]) > th2 {
+			continue
+		}
+		u, v = s.cam.Project(x2)
+		if (u-pts2[i][0])*(u-pts2[i][0])+(v-pts2[i][1])*(v-pts2[i][1]) > th2 {
+			continue
+		}
+		cosParallaxes = append(cosParallaxes, cosParallax)
+		c.points[i] = x
+		c.good++
+		if cosParallax < maxCosParallax {
+			c.triangulated[i] = true
+		}
+	}
+	if c.good > 0 {
+		sort.Float64s(cosParallaxes)
+		idx := 50
+		if idx > len(cosParallaxes)-1 {
+			idx = len(cosParallaxes) - 1
+		}
+		c.parallax = math.Acos(cosParallaxes[idx]) * 180 / math.Pi
+	}
+	return c
+}
+
+// P = K [R | t]
+func projectionMatrix(k, r geom.Mat3, t geom.Vec3) [3][4]float64 {
+	var p [3][4]float64
+	kr := k.Mul(r)
+	kt := k.MulVec(t)
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			p[i][j] = kr[i][j]
+		}
+		p[i][3] = kt[i]
+	}
+	return p
+}
+
+// Triangulate finds the point which projects to (u1, v1) with the projection matrix p1 and to
+// (u2, v2) with p2 by the linear (DLT) method. The projection matrices can include the intrinsics,
+// or be plain [R | t] poses with normalised image coordinates. Returns false if the point is at
+// infinity.
+func Triangulate(u1, v1 float64, p1 [3][4]float64, u2, v2 float64, p2 [3][4]float64) (geom.Vec3, bool) {
+	a := geom.NewDense(4, 4)
+	for j := 0; j < 4; j++ {
+		a.Set(0, j, u1*p1[2][j]-p1[0][j])
+		a.Set(1, j, v1*p1[2][j]-p1[1][j])
+		a.Set(2, j, u2*p2[2][j]-p2[0][j])
+		a.Set(3, j, v2*p2[2][j]-p2[1][j])
+	}
+	_, _, v := geom.SVD(a)
+	w := v.At(3, 3)
+	if w == 0 {
+		return geom.Vec3{}, false
+	}
+	x := geom.Vec3{v.At(0, 3) / w, v.At(1, 3) / w, v.At(2, 3) / w}
+	for _, c := range x {
+		if math.IsNaN(c) || math.IsInf(c, 0) {
+			return geom.Vec3{}, false
+		}
+	}
+	return x, true
+}
@@ -0,0 +1,126 @@
+package solver
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/kegsay/gorbslam/internal/geom"
+)
+
+// Project points (in the first camera's frame) into both cameras, with gaussian pixel noise.
+// 10% of the matches are replaced by random pixels in the second image.
+func twoViewMatches(rng *rand.Rand, points []geom.Vec3, t21 geom.SE3, noise float64) (pts1, pts2 [][2]float64) {
+	for _, x := range points {
+		u1, v1 := testCam.Project(x)
+		u2, v2 := testCam.Project(t21.Transform(x))
+		if rng.Float64() < 0.1 {
+			u2, v2 = rng.Float64()*640, rng.Float64()*480
+		}
+		pts1 = append(pts1, [2]float64{u1 + rng.NormFloat64()*noise, v1 + rng.NormFloat64()*noise})
+		pts2 = append(pts2, [2]float64{u2 + rng.NormFloat64()*noise, v2 + rng.NormFloat64()*noise})
+	}
+	return pts1, pts2
+}
+
+func checkTwoView(t *testing.T, res *TwoViewResult, want geom.SE3, points []geom.Vec3) {
+	t.Helper()
+	// the motion is only approximate with noisy matches, bundle adjustment refines it afterwards
+	if rotErr := rotationError(res.Pose.R, want.R); rotErr > 0.02 {
+		t.Errorf("rotation error %v", rotErr)
+	}
+	// only the direction of the translation can be recovered
+	if cos := res.Pose.T.Normalised().Dot(want.T.Normalised()); cos < 0.99 {
+		t.Errorf("translation direction error: cos %v", cos)
+	}
+	if res.NumTriangulated < len(points)*3/4 {
+		t.Errorf("triangulated %d of %d points", res.NumTriangulated, len(points))
+	}
+	// the triangulated points have the scale of the unit translation
+	scale := want.T.Norm()
+	var errs []float64
+	for i, ok := range res.Triangulated {
+		if ok {
+			errs = append(errs, res.Points[i].Scale(scale).Sub(points[i]).Norm()/points[i].Norm())
+		}
+	}
+	sort.Float64s(errs)
+	if median := errs[len(errs)/2]; median > 0.1 {
+		t.Errorf("median relative point error %v", median)
+	}
+}
+
+func TestTwoViewGeneralScene(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	var points []geom.Vec3
+	for i := 0; i < 300; i++ {
+		u, v := rng.Float64()*640, rng.Float64()*480
+		points = append(points, testCam.Unproject(u, v).Scale(3+rng.Float64()*5))
+	}
+	want := geom.SE3{R: geom.ExpSO3(geom.Vec3{0.02, -0.05, 0.01}), T: geom.Vec3{-0.6, 0.1, 0.04}}
+	pts1, pts2 := twoViewMatches(rng, points, want, 0.5)
+
+	res, ok := NewTwoViewSolver(testCam, 1, 200).Reconstruct(pts1, pts2)
+	if !ok {
+		t.Fatalf("Reconstruct failed")
+	}
+	if res.Homography {
+		t.Errorf("expected the fundamental matrix to be chosen for a general scene")
+	}
+	checkTwoView(t, res, want, points)
+}
+
+func TestTwoViewPlanarScene(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	// the floor sloping away from the camera. A plane seen almost face on has two decompositions
+	// which explain the matches equally well, so would be rejected as ambiguous.
+	var points []geom.Vec3
+	for i := 0; i < 300; i++ {
+		x, y := rng.Float64()*4-2, rng.Float64()*3-1.5
+		points = append(points, geom.Vec3{x, y, 3 + 1.5*y})
+	}
+	want := geom.SE3{R: geom.ExpSO3(geom.Vec3{0.01, 0.04, -0.02}), T: geom.Vec3{0.3, -0.1, 0.05}}
+	pts1, pts2 := twoViewMatches(rng, points, want, 0.5)
+
+	res, ok := NewTwoViewSolver(testCam, 1, 200).Reconstruct(pts1, pts2)
+	if !ok {
+		t.Fatalf("Reconstruct failed")
+	}
+	if !res.Homography {
+		t.Errorf("expected the homography to be chosen for a planar scene")
+	}
+	checkTwoView(t, res, want, points)
+}
+
+func TestTwoViewLowParallax(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	var points []geom.Vec3
+	for i := 0; i < 300; i++ {
+		u, v := rng.Float64()*640, rng.Float64()*480
+		points = append(points, testCam.Unproject(u, v).Scale(3+rng.Float64()*5))
+	}
+	// a rotation with almost no translation: the structure can't be recovered
+	t21 := geom.SE3{R: geom.ExpSO3(geom.Vec3{0, 0.05, 0}), T: geom.Vec3{0.005, 0, 0}}
+	pts1, pts2 := twoViewMatches(rng, points, t21, 0.5)
+	if _, ok := NewTwoViewSolver(testCam, 1, 200).Reconstruct(pts1, pts2); ok {
+		t.Errorf("Reconstruct succeeded without enough parallax")
+	}
+}
+
+func TestTriangulate(t *testing.T) {
+	x := geom.Vec3{0.3, -0.2, 4}
+	t21 := geom.SE3{R: geom.ExpSO3(geom.Vec3{0, 0.1, 0}), T: geom.Vec3{-0.5, 0, 0}}
+	k := testCam.K()
+	p1 := projectionMatrix(k, geom.Identity3(), geom.Vec3{})
+	p2 := projectionMatrix(k, t21.R.Matrix(), t21.T)
+	u1, v1 := testCam.Project(x)
+	u2, v2 := testCam.Project(t21.Transform(x))
+	got, ok := Triangulate(u1, v1, p1, u2, v2, p2)
+	if !ok {
+		t.Fatalf("Triangulate failed")
+	}
+	if d := got.Sub(x).Norm(); d > 1e-6 || math.IsNaN(d) {
+		t.Errorf("got %v want %v", got, x)
+	}
+}
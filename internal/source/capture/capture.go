@@ -0,0 +1,124 @@
+// Package capture reads frames from capture devices and video files with OpenCV, and opens any
+// source URI for the command line tools.
+package capture
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/kegsay/gorbslam/internal/dataset"
+	"github.com/kegsay/gorbslam/internal/source"
+	"gocv.io/x/gocv"
+)
+
+// Usage describes the URIs Open accepts, for the help of command line flags
+const Usage = `where to read images from:
+  cam:N             video capture device N, e.g a webcam
+  video:FILE        a video file
+  tum:DIR           a sequence of the TUM RGB-D dataset
+  euroc:DIR         a sequence of the EuRoC MAV dataset, its left and right images
+  kitti:DIR         a sequence of the KITTI odometry benchmark, sequences/XX
+` + source.Schemes
+
+// Open opens a source of images given by a URI, as described by Usage
+func Open(uri string) (source.FrameSource, error) {
+	scheme, path, _, err := source.ParseURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	switch scheme {
+	case "cam":
+		id, err := strconv.Atoi(path)
+		if err != nil {
+			return nil, fmt.Errorf("source %s: expected a device number", uri)
+		}
+		return NewDevice(id)
+	case "video":
+		return NewVideoFile(path)
+	case "tum":
+		seq, err := dataset.OpenTUM(path)
+		if err != nil {
+			return nil, err
+		}
+		return seq.Frames(), nil
+	case "euroc":
+		seq, err := dataset.OpenEuRoC(path)
+		if err != nil {
+			return nil, err
+		}
+		return seq.Frames(), nil
+	case "kitti":
+		seq, err := dataset.OpenKITTI(path)
+		if err != nil {
+			return nil, err
+		}
+		return seq.Frames(), nil
+	}
+	return source.Open(uri)
+}
+
+// Video is a FrameSource reading from an OpenCV video capture, either a device or a file
+type Video struct {
+	vc    *gocv.VideoCapture
+	frame gocv.Mat
+	// for files, the time of the first frame; the rest are timestamped from their position in
+	// the video. Frames from devices are timestamped when they are read.
+	start  time.Time
+	isFile bool
+}
+
+// NewDevice opens a video capture device, e.g 0 for the default webcam
+func NewDevice(id int) (*Video, error) {
+	vc, err := gocv.VideoCaptureDevice(id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open video capture device %d: %s", id, err)
+	}
+	return &Video{vc: vc, frame: gocv.NewMat()}, nil
+}
+
+// NewVideoFile opens a video file, whose frames are timestamped from the Unix epoch
+func NewVideoFile(filename string) (*Video, error) {
+	vc, err := gocv.VideoCaptureFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open video %s: %s", filename, err)
+	}
+	return &Video{vc: vc, frame: gocv.NewMat(), start: time.Unix(0, 0), isFile: true}, nil
+}
+
+// Next reads the next frame. A device waits for it to be captured.
+func (v *Video) Next() (source.Frame, error) {
+	if !v.vc.Read(&v.frame) || v.frame.Empty() {
+		if v.isFile {
+			return source.Frame{}, io.EOF
+		}
+		return source.Frame{}, fmt.Errorf("failed to read from the video capture device")
+	}
+	ts := time.Now()
+	if v.isFile {
+		ms := v.vc.Get(gocv.VideoCapturePosMsec)
+		ts = v.start.Add(time.Duration(ms * float64(time.Millisecond)))
+	}
+	img, err := v.frame.ToImage()
+	if err != nil {
+		return source.Frame{}, err
+	}
+	return source.Frame{Image: img, Timestamp: ts}, nil
+}
+
+// Close releases the video capture
+func (v *Video) Close() error {
+	v.frame.Close()
+	return v.vc.Close()
+}
+
+// ToMat converts a frame's image to a Mat for OpenCV, grayscale images staying grayscale. The Mat
+// must be closed.
+func ToMat(img image.Image) (gocv.Mat, error) {
+	if gray, ok := img.(*image.Gray); ok {
+		return gocv.ImageGrayToMatGray(gray)
+	}
+	return gocv.ImageToMatRGB(img)
+}
@@ -0,0 +1,167 @@
+package source
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	// the formats of image sequences
+	_ "image/jpeg"
+	_ "image/png"
+)
+
+// ImageFile is an image in a sequence and the time it was taken
+type ImageFile struct {
+	Path      string
+	Timestamp time.Time
+}
+
+// ImageSequence is a FrameSource reading a list of image files, one at a time
+type ImageSequence struct {
+	files []ImageFile
+	next  int
+}
+
+// NewImageSequence returns a source of the given images, which must be in time order
+func NewImageSequence(files []ImageFile) *ImageSequence {
+	return &ImageSequence{files: files}
+}
+
+// Files returns the images of the sequence
+func (s *ImageSequence) Files() []ImageFile {
+	return s.files
+}
+
+// Next decodes the next image
+func (s *ImageSequence) Next() (Frame, error) {
+	if s.next >= len(s.files) {
+		return Frame{}, io.EOF
+	}
+	file := s.files[s.next]
+	s.next++
+	img, err := ReadImage(file.Path)
+	if err != nil {
+		return Frame{}, err
+	}
+	return Frame{Image: img, Timestamp: file.Timestamp}, nil
+}
+
+// Close does nothing, as each image is closed once read
+func (s *ImageSequence) Close() error {
+	return nil
+}
+
+// ReadImage decodes a PNG or JPEG file
+func ReadImage(filename string) (image.Image, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	return img, nil
+}
+
+// isImage returns true if the file name has the extension of a format ReadImage decodes
+func isImage(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".png", ".jpg", ".jpeg":
+		return true
+	}
+	return false
+}
+
+// NewImageDirectory returns a source of the images in a directory, sorted by name. They are
+// timestamped as if taken fps times a second from the Unix epoch.
+func NewImageDirectory(dir string, fps float64) (*ImageSequence, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && isImage(e.Name()) {
+			names = append(names, e.Name())
+		}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no images in %s", dir)
+	}
+	sort.Strings(names)
+	files := make([]ImageFile, len(names))
+	for i, name := range names {
+		files[i] = ImageFile{
+			Path:      filepath.Join(dir, name),
+			Timestamp: time.Unix(0, 0).Add(time.Duration(float64(i) / fps * float64(time.Second))),
+		}
+	}
+	return NewImageSequence(files), nil
+}
+
+// NewTimestampsFile returns a source of the images listed in a file such as the rgb.txt of the TUM
+// RGB-D dataset:
+//
+//	# timestamp filename
+//	1305031102.175304 rgb/1305031102.175304.png
+//
+// Timestamps are in seconds, and file names relative to the directory of the list.
+func NewTimestampsFile(filename string) (*ImageSequence, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	files, err := ReadTimestamps(f, filepath.Dir(filename))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	return NewImageSequence(files), nil
+}
+
+// ResolvePath returns the path of a file named in a list, relative to dir unless it is absolute.
+// Names in lists use forward slashes.
+func ResolvePath(dir, name string) string {
+	name = filepath.FromSlash(name)
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(dir, name)
+}
+
+// ReadTimestamps reads "timestamp filename" lines as NewTimestampsFile, with file names relative
+// to dir. Lines starting with '#' are comments.
+func ReadTimestamps(r io.Reader, dir string) ([]ImageFile, error) {
+	var files []ImageFile
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected a timestamp and a file name, got '%s'", line, text)
+		}
+		ts, err := ParseSeconds(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+		if len(files) > 0 && ts.Before(files[len(files)-1].Timestamp) {
+			return nil, fmt.Errorf("line %d: timestamps are not in order", line)
+		}
+		files = append(files, ImageFile{Path: ResolvePath(dir, fields[1]), Timestamp: ts})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
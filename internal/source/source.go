@@ -0,0 +1,198 @@
+// Package source reads timestamped images from cameras, video files and image sequences, so that
+// every program can take its images from anywhere. Sources which need OpenCV, capture devices and
+// video files, are in the capture package.
+package source
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kegsay/gorbslam/internal/camera"
+	"github.com/kegsay/gorbslam/internal/imu"
+)
+
+// Frame is an image and the time it was taken
+type Frame struct {
+	Image     image.Image
+	Timestamp time.Time
+	// The depth image registered to Image, nil unless the source is an RGB-D camera
+	Depth *camera.DepthImage
+	// The right image of a stereo pair, taken at the same time as Image, nil unless the source is
+	// a stereo camera
+	Right image.Image
+	// The IMU measurements since the previous frame, oldest first, if the source has an IMU
+	IMU []imu.Measurement
+}
+
+// FrameSource yields frames in the order they were taken
+type FrameSource interface {
+	// Next returns the next frame, or io.EOF once there are no more
+	Next() (Frame, error)
+	// Close releases the source. Next must not be called afterwards.
+	Close() error
+}
+
+// Memory is a FrameSource of frames held in memory
+type Memory struct {
+	frames []Frame
+}
+
+// NewMemory returns a source of the given frames
+func NewMemory(frames ...Frame) *Memory {
+	return &Memory{frames: frames}
+}
+
+// Next returns the next frame
+func (m *Memory) Next() (Frame, error) {
+	if len(m.frames) == 0 {
+		return Frame{}, io.EOF
+	}
+	f := m.frames[0]
+	m.frames = m.frames[1:]
+	return f, nil
+}
+
+// Close does nothing
+func (m *Memory) Close() error {
+	return nil
+}
+
+const (
+	// RetryDelay is how long ForEach waits after failing to read a frame, e.g while a device is
+	// still starting
+	RetryDelay = 100 * time.Millisecond
+	// MaxReadErrors is how many times in a row ForEach fails to read a frame before giving up
+	MaxReadErrors = 50
+)
+
+// ForEach calls fn with each frame of src until the source ends or done is closed, then closes
+// src. Reading is retried after RetryDelay, until it fails MaxReadErrors times in a row. As src is
+// closed by ForEach, Next is never in progress when it is.
+func ForEach(src FrameSource, done <-chan struct{}, fn func(Frame)) error {
+	return forEach(src, done, fn, RetryDelay, MaxReadErrors)
+}
+
+func forEach(src FrameSource, done <-chan struct{}, fn func(Frame), retryDelay time.Duration, maxErrors int) error {
+	defer src.Close()
+	errors := 0
+	for {
+		select {
+		case <-done:
+			return nil
+		default:
+		}
+		f, err := src.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if errors++; errors >= maxErrors {
+				return fmt.Errorf("failed to read %d frames in a row: %s", errors, err)
+			}
+			select {
+			case <-done:
+				return nil
+			case <-time.After(retryDelay):
+			}
+			continue
+		}
+		errors = 0
+		fn(f)
+	}
+}
+
+// Usage describes the URIs Open accepts, for the help of command line flags
+const Usage = "where to read images from:\n" + Schemes
+
+// Schemes describes each kind of URI Open accepts, one per line
+const Schemes = `  dir:PATH[?fps=N]  the images in a directory, sorted by name, taken N times a second (default 30)
+  list:FILE         the images listed in a file of "timestamp filename" lines, as TUM rgb.txt
+  image:FILE        a single image
+  PATH              an image file, or a directory of images`
+
+// defaultFPS is the frame rate of a directory of images when the URI doesn't give one
+const defaultFPS = 30
+
+// Open opens a source of images given by a URI, as described by Usage
+func Open(uri string) (FrameSource, error) {
+	scheme, path, query, err := ParseURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	switch scheme {
+	case "dir":
+		fps := float64(defaultFPS)
+		if v := query.Get("fps"); v != "" {
+			if fps, err = strconv.ParseFloat(v, 64); err != nil || fps <= 0 {
+				return nil, fmt.Errorf("source %s: fps must be a positive number, got '%s'", uri, v)
+			}
+		}
+		return NewImageDirectory(path, fps)
+	case "list":
+		return NewTimestampsFile(path)
+	case "image":
+		return NewImageSequence([]ImageFile{{Path: path}}), nil
+	case "":
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if info.IsDir() {
+			return NewImageDirectory(path, defaultFPS)
+		}
+		return NewImageSequence([]ImageFile{{Path: path}}), nil
+	}
+	return nil, fmt.Errorf("source %s: unknown scheme '%s'", uri, scheme)
+}
+
+// ParseURI splits a source URI into its scheme, path and query. A URI without a scheme is a path.
+func ParseURI(uri string) (scheme, path string, query url.Values, err error) {
+	i := strings.Index(uri, ":")
+	// a single letter is a Windows drive rather than a scheme
+	if i <= 1 || strings.ContainsAny(uri[:i], `/\.`) {
+		return "", uri, url.Values{}, nil
+	}
+	scheme, path = uri[:i], uri[i+1:]
+	if j := strings.LastIndex(path, "?"); j >= 0 {
+		if query, err = url.ParseQuery(path[j+1:]); err != nil {
+			return "", "", nil, fmt.Errorf("source %s: %s", uri, err)
+		}
+		path = path[:j]
+	} else {
+		query = url.Values{}
+	}
+	if path == "" {
+		return "", "", nil, fmt.Errorf("source %s: no path", uri)
+	}
+	return scheme, path, query, nil
+}
+
+// ParseSeconds parses a timestamp in seconds since the Unix epoch, such as "1305031102.175304",
+// without the rounding of a float64
+func ParseSeconds(s string) (time.Time, error) {
+	secs, frac := s, ""
+	if i := strings.Index(s, "."); i >= 0 {
+		secs, frac = s[:i], s[i+1:]
+	}
+	sec, err := strconv.ParseInt(secs, 10, 64)
+	if err != nil || strings.HasPrefix(secs, "-") || strings.HasPrefix(frac, "-") {
+		return time.Time{}, fmt.Errorf("invalid timestamp '%s'", s)
+	}
+	var nsec int64
+	if frac != "" {
+		// only nanoseconds are kept
+		if len(frac) > 9 {
+			frac = frac[:9]
+		}
+		if nsec, err = strconv.ParseInt(frac+strings.Repeat("0", 9-len(frac)), 10, 64); err != nil {
+			return time.Time{}, fmt.Errorf("invalid timestamp '%s'", s)
+		}
+	}
+	return time.Unix(sec, nsec), nil
+}
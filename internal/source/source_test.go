@@ -0,0 +1,245 @@
+package source
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeImage writes a 4x3 grayscale PNG whose pixels are all v
+func writeImage(t *testing.T, filename string, v uint8) {
+	t.Helper()
+	img := image.NewGray(image.Rect(0, 0, 4, 3))
+	for i := range img.Pix {
+		img.Pix[i] = v
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatalf("Create: %s", err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, img); err != nil {
+		t.Fatalf("Encode: %s", err)
+	}
+}
+
+// readAll reads every frame of a source, returning the pixel value of each image
+func readAll(t *testing.T, src FrameSource) ([]uint8, []time.Time) {
+	t.Helper()
+	defer src.Close()
+	var values []uint8
+	var timestamps []time.Time
+	for {
+		f, err := src.Next()
+		if err == io.EOF {
+			return values, timestamps
+		}
+		if err != nil {
+			t.Fatalf("Next: %s", err)
+		}
+		values = append(values, color.GrayModel.Convert(f.Image.At(0, 0)).(color.Gray).Y)
+		timestamps = append(timestamps, f.Timestamp)
+	}
+}
+
+func TestMemory(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 2, 2))
+	img.Pix[0] = 7
+	src := NewMemory(Frame{Image: img, Timestamp: time.Unix(1, 0)}, Frame{Image: img, Timestamp: time.Unix(2, 0)})
+	values, timestamps := readAll(t, src)
+	if len(values) != 2 || values[0] != 7 || !timestamps[1].Equal(time.Unix(2, 0)) {
+		t.Errorf("got values %v at %v", values, timestamps)
+	}
+	if _, err := src.Next(); err != io.EOF {
+		t.Errorf("got %v after the last frame, want io.EOF", err)
+	}
+}
+
+func TestImageDirectory(t *testing.T) {
+	dir := t.TempDir()
+	// sorted by name, not by when they were written
+	writeImage(t, filepath.Join(dir, "0002.png"), 2)
+	writeImage(t, filepath.Join(dir, "0000.png"), 0)
+	writeImage(t, filepath.Join(dir, "0001.png"), 1)
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not an image"), 0644); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	src, err := Open("dir:" + dir + "?fps=20")
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	values, timestamps := readAll(t, src)
+	if len(values) != 3 || values[0] != 0 || values[1] != 1 || values[2] != 2 {
+		t.Fatalf("got images %v", values)
+	}
+	if d := timestamps[2].Sub(timestamps[0]); d != 100*time.Millisecond {
+		t.Errorf("got %v between the first and last images at 20fps", d)
+	}
+
+	// a directory without a scheme is read at the default frame rate
+	src, err = Open(dir)
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	if _, timestamps = readAll(t, src); timestamps[1].Sub(timestamps[0]) != time.Second/defaultFPS {
+		t.Errorf("got %v between images", timestamps[1].Sub(timestamps[0]))
+	}
+	if _, err := NewImageDirectory(t.TempDir(), 30); err == nil {
+		t.Errorf("expected an error for an empty directory")
+	}
+}
+
+func TestTimestampsFile(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "rgb"), 0755); err != nil {
+		t.Fatalf("Mkdir: %s", err)
+	}
+	writeImage(t, filepath.Join(dir, "rgb", "a.png"), 10)
+	writeImage(t, filepath.Join(dir, "rgb", "b.png"), 20)
+	list := filepath.Join(dir, "rgb.txt")
+	contents := `# color images
+# file: 'rgbd_dataset_freiburg1_xyz.bag'
+# timestamp filename
+1305031102.175304 rgb/b.png
+1305031102.211214 rgb/a.png
+`
+	if err := os.WriteFile(list, []byte(contents), 0644); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	src, err := Open("list:" + list)
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	values, timestamps := readAll(t, src)
+	if len(values) != 2 || values[0] != 20 || values[1] != 10 {
+		t.Fatalf("got images %v", values)
+	}
+	if want := time.Unix(1305031102, 175304000); !timestamps[0].Equal(want) {
+		t.Errorf("got timestamp %v want %v", timestamps[0], want)
+	}
+
+	// a missing image is an error when it is read
+	seq := NewImageSequence([]ImageFile{{Path: filepath.Join(dir, "missing.png")}})
+	if _, err := seq.Next(); err == nil || err == io.EOF {
+		t.Errorf("got %v for a missing image", err)
+	}
+}
+
+func TestReadTimestampsErrors(t *testing.T) {
+	testCases := map[string]string{
+		"no file name":  "1305031102.175304\n",
+		"bad timestamp": "13050x1102.17 rgb/a.png\n",
+		"out of order":  "2.0 a.png\n1.0 b.png\n",
+	}
+	for name, contents := range testCases {
+		if _, err := ReadTimestamps(strings.NewReader(contents), ""); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestParseURI(t *testing.T) {
+	testCases := []struct {
+		uri, scheme, path, fps string
+	}{
+		{"cam:1", "cam", "1", ""},
+		{"dir:/data/images?fps=10", "dir", "/data/images", "10"},
+		{"video:clip.mp4", "video", "clip.mp4", ""},
+		{"images/0001.png", "", "images/0001.png", ""},
+		{"./odd:name.png", "", "./odd:name.png", ""},
+		{`C:\images`, "", `C:\images`, ""},
+	}
+	for _, tc := range testCases {
+		scheme, path, query, err := ParseURI(tc.uri)
+		if err != nil {
+			t.Errorf("%s: %s", tc.uri, err)
+			continue
+		}
+		if scheme != tc.scheme || path != tc.path || query.Get("fps") != tc.fps {
+			t.Errorf("%s: got scheme '%s' path '%s' query %v", tc.uri, scheme, path, query)
+		}
+	}
+	for _, uri := range []string{"dir:", "dir:images?fps=%zz", "ftp:images", "dir:images?fps=0"} {
+		if _, err := Open(uri); err == nil {
+			t.Errorf("%s: expected an error", uri)
+		}
+	}
+}
+
+func TestParseSeconds(t *testing.T) {
+	testCases := map[string]time.Time{
+		"1305031102.175304":    time.Unix(1305031102, 175304000),
+		"1305031102":           time.Unix(1305031102, 0),
+		"0.000000001":          time.Unix(0, 1),
+		"1.1234567891":         time.Unix(1, 123456789),
+		"1403636579.763555584": time.Unix(1403636579, 763555584),
+	}
+	for s, want := range testCases {
+		got, err := ParseSeconds(s)
+		if err != nil || !got.Equal(want) {
+			t.Errorf("%s: got %v, %v want %v", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "abc", "1.2.3", "-1.5", "1.-5"} {
+		if _, err := ParseSeconds(s); err == nil {
+			t.Errorf("%s: expected an error", s)
+		}
+	}
+}
+
+// failing is a source which fails to read a number of times before each of its frames
+type failing struct {
+	Memory
+	failures, failed int
+	closed           bool
+}
+
+func (f *failing) Next() (Frame, error) {
+	if f.closed {
+		panic("Next after Close")
+	}
+	if f.failed < f.failures {
+		f.failed++
+		return Frame{}, errors.New("no frame yet")
+	}
+	f.failed = 0
+	return f.Memory.Next()
+}
+
+func (f *failing) Close() error {
+	f.closed = true
+	return nil
+}
+
+func TestForEach(t *testing.T) {
+	frames := []Frame{{Timestamp: time.Unix(1, 0)}, {Timestamp: time.Unix(2, 0)}}
+	src := &failing{Memory: *NewMemory(frames...), failures: 2}
+	var got []Frame
+	if err := forEach(src, nil, func(f Frame) { got = append(got, f) }, time.Millisecond, 3); err != nil {
+		t.Fatalf("forEach: %s", err)
+	}
+	if len(got) != len(frames) || !src.closed {
+		t.Errorf("got %d frames, closed %v", len(got), src.closed)
+	}
+
+	// giving up once reading fails too many times in a row
+	src = &failing{Memory: *NewMemory(frames...), failures: 3}
+	if err := forEach(src, nil, func(Frame) { t.Errorf("got a frame") }, time.Millisecond, 3); err == nil || !src.closed {
+		t.Errorf("got %v, closed %v", err, src.closed)
+	}
+
+	// stopping when done is closed, even while waiting to retry
+	done := make(chan struct{})
+	time.AfterFunc(10*time.Millisecond, func() { close(done) })
+	src = &failing{Memory: *NewMemory(frames...), failures: 1}
+	if err := forEach(src, done, func(Frame) { t.Errorf("got a frame") }, time.Hour, 3); err != nil || !src.closed {
+		t.Errorf("got %v, closed %v", err, src.closed)
+	}
+}
@@ -0,0 +1,172 @@
+package sparse
+
+import (
+	"sort"
+
+	"github.com/kegsay/gorbslam/internal/geom"
+)
+
+// BlockSym is a symmetric matrix made of dense blocks, most of which are zero. This is the shape
+// of the Hessian in bundle adjustment and pose graph problems: each block row is a parameter
+// (e.g a 6 DoF pose) and there is only a non-zero block between two parameters if a measurement
+// links them. Only the upper triangle (including the diagonal) is stored.
+type BlockSym struct {
+	dims    []int
+	offsets []int
+	dim     int
+	// rows[i][j] for j >= i, stored row-major with dims[i] rows and dims[j] columns
+	rows []map[int][]float64
+}
+
+// NewBlockSym creates a matrix whose block rows/columns have the given sizes.
+func NewBlockSym(dims []int) *BlockSym {
+	m := &BlockSym{
+		dims:    dims,
+		offsets: make([]int, len(dims)),
+		rows:    make([]map[int][]float64, len(dims)),
+	}
+	for i, d := range dims {
+		m.offsets[i] = m.dim
+		m.dim += d
+		m.rows[i] = make(map[int][]float64)
+	}
+	return m
+}
+
+// Dim returns the total number of scalar rows
+func (m *BlockSym) Dim() int {
+	return m.dim
+}
+
+// NumBlocks returns the number of block rows
+func (m *BlockSym) NumBlocks() int {
+	return len(m.dims)
+}
+
+// BlockDim returns the size of block row i
+func (m *BlockSym) BlockDim(i int) int {
+	return m.dims[i]
+}
+
+// Offset returns the index of the first scalar row of block row i
+func (m *BlockSym) Offset(i int) int {
+	return m.offsets[i]
+}
+
+// Block returns the block at (i, j), creating it if needed. i must be <= j. Writes to the returned
+// slice modify the matrix.
+func (m *BlockSym) Block(i, j int) []float64 {
+	if i > j {
+		panic("sparse: Block requires i <= j, only the upper triangle is stored")
+	}
+	b, ok := m.rows[i][j]
+	if !ok {
+		b = make([]float64, m.dims[i]*m.dims[j])
+		m.rows[i][j] = b
+	}
+	return b
+}
+
+// Lookup returns the block at (i, j) if it exists. i must be <= j.
+func (m *BlockSym) Lookup(i, j int) ([]float64, bool) {
+	b, ok := m.rows[i][j]
+	return b, ok
+}
+
+// Neighbours returns the block columns j >= i which have a block in row i, in ascending order.
+func (m *BlockSym) Neighbours(i int) []int {
+	cols := make([]int, 0, len(m.rows[i]))
+	for j := range m.rows[i] {
+		cols = append(cols, j)
+	}
+	sort.Ints(cols)
+	return cols
+}
+
+// AddToDiagonal adds lambda to every element on the diagonal, creating diagonal blocks if needed.
+func (m *BlockSym) AddToDiagonal(lambda float64) {
+	for i, d := range m.dims {
+		b := m.Block(i, i)
+		for k := 0; k < d; k++ {
+			b[k*d+k] += lambda
+		}
+	}
+}
+
+// Diagonal returns a copy of the scalar diagonal
+func (m *BlockSym) Diagonal() []float64 {
+	diag := make([]float64, m.dim)
+	for i, d := range m.dims {
+		b, ok := m.rows[i][i]
+		if !ok {
+			continue
+		}
+		for k := 0; k < d; k++ {
+			diag[m.offsets[i]+k] = b[k*d+k]
+		}
+	}
+	return diag
+}
+
+// Clone returns a deep copy of the matrix
+func (m *BlockSym) Clone() *BlockSym {
+	c := NewBlockSym(m.dims)
+	for i, row := range m.rows {
+		for j, b := range row {
+			c.rows[i][j] = append([]float64(nil), b...)
+		}
+	}
+	return c
+}
+
+// MulVec computes y = M * x
+func (m *BlockSym) MulVec(x []float64) []float64 {
+	y := make([]float64, m.dim)
+	for i, row := range m.rows {
+		oi := m.offsets[i]
+		di := m.dims[i]
+		for j, b := range row {
+			oj := m.offsets[j]
+			dj := m.dims[j]
+			for r := 0; r < di; r++ {
+				var sum float64
+				for c := 0; c < dj; c++ {
+					sum += b[r*dj+c] * x[oj+c]
+				}
+				y[oi+r] += sum
+			}
+			if i == j {
+				continue
+			}
+			// the transposed block in the lower triangle
+			for c := 0; c < dj; c++ {
+				var sum float64
+				for r := 0; r < di; r++ {
+					sum += b[r*dj+c] * x[oi+r]
+				}
+				y[oj+c] += sum
+			}
+		}
+	}
+	return y
+}
+
+// Dense expands the matrix into a full dense matrix
+func (m *BlockSym) Dense() *geom.Dense {
+	d := geom.NewDense(m.dim, m.dim)
+	for i, row := range m.rows {
+		oi := m.offsets[i]
+		di := m.dims[i]
+		for j, b := range row {
+			oj := m.offsets[j]
+			dj := m.dims[j]
+			for r := 0; r < di; r++ {
+				for c := 0; c < dj; c++ {
+					d.Set(oi+r, oj+c, b[r*dj+c])
+					d.Set(oj+c, oi+r, b[r*dj+c])
+				}
+			}
+		}
+	}
+	return d
+}
@@ -0,0 +1,125 @@
+package sparse
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// Build a random block-sparse SPD matrix: a chain of blocks plus a few random connections, with a
+// dominant diagonal.
+func randomBlockSym(rng *rand.Rand, dims []int, extraLinks int) *BlockSym {
+	m := NewBlockSym(dims)
+	link := func(i, j int) {
+		if i > j {
+			i, j = j, i
+		}
+		b := m.Block(i, j)
+		for k := range b {
+			b[k] = rng.NormFloat64()
+		}
+	}
+	for i := 0; i+1 < len(dims); i++ {
+		link(i, i+1)
+	}
+	for k := 0; k < extraLinks; k++ {
+		i := rng.Intn(len(dims))
+		j := rng.Intn(len(dims))
+		if i != j {
+			link(i, j)
+		}
+	}
+	// make it diagonally dominant so it's positive definite
+	rowSums := make([]float64, m.Dim())
+	dense := m.Dense()
+	for r := 0; r < m.Dim(); r++ {
+		for c := 0; c < m.Dim(); c++ {
+			if r != c {
+				rowSums[r] += math.Abs(dense.At(r, c))
+			}
+		}
+	}
+	for i, d := range dims {
+		b := m.Block(i, i)
+		for k := 0; k < d; k++ {
+			b[k*d+k] = rowSums[m.Offset(i)+k] + 1
+		}
+	}
+	return m
+}
+
+func TestBlockSymMulVec(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	m := randomBlockSym(rng, []int{6, 6, 3, 7, 3, 6}, 4)
+	dense := m.Dense()
+	x := make([]float64, m.Dim())
+	for i := range x {
+		x[i] = rng.NormFloat64()
+	}
+	got := m.MulVec(x)
+	want := dense.MulVec(x)
+	for i := range want {
+		if math.Abs(got[i]-want[i]) > 1e-12 {
+			t.Fatalf("MulVec mismatch at %d: got %v want %v", i, got[i], want[i])
+		}
+	}
+	// the dense expansion must be symmetric
+	for r := 0; r < dense.Rows; r++ {
+		for c := 0; c < dense.Cols; c++ {
+			if dense.At(r, c) != dense.At(c, r) {
+				t.Fatalf("dense expansion is not symmetric")
+			}
+		}
+	}
+}
+
+func TestSolve(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	for _, numBlocks := range []int{5, 150} { // dense and PCG paths
+		dims := make([]int, numBlocks)
+		for i := range dims {
+			dims[i] = 6
+		}
+		m := randomBlockSym(rng, dims, numBlocks)
+		want := make([]float64, m.Dim())
+		for i := range want {
+			want[i] = rng.NormFloat64()
+		}
+		b := m.MulVec(want)
+		got, ok := Solve(m, b)
+		if !ok {
+			t.Fatalf("%d blocks: Solve failed", numBlocks)
+		}
+		for i := range want {
+			if math.Abs(got[i]-want[i]) > 1e-6 {
+				t.Fatalf("%d blocks: solution mismatch at %d: got %v want %v", numBlocks, i, got[i], want[i])
+			}
+		}
+	}
+}
+
+func TestInvertSPD(t *testing.T) {
+	block := []float64{4, 1, 0, 1, 3, 1, 0, 1, 2}
+	orig := append([]float64(nil), block...)
+	if !InvertSPD(block, 3) {
+		t.Fatalf("InvertSPD failed")
+	}
+	for r := 0; r < 3; r++ {
+		for c := 0; c < 3; c++ {
+			var sum float64
+			for k := 0; k < 3; k++ {
+				sum += orig[r*3+k] * block[k*3+c]
+			}
+			want := 0.0
+			if r == c {
+				want = 1
+			}
+			if math.Abs(sum-want) > 1e-12 {
+				t.Fatalf("A * inv(A) != I")
+			}
+		}
+	}
+	if InvertSPD([]float64{0, 0, 0, 0}, 2) {
+		t.Fatalf("expected failure for a singular matrix")
+	}
+}
@@ -0,0 +1,147 @@
+package sparse
+
+import (
+	"math"
+
+	"github.com/kegsay/gorbslam/internal/geom"
+)
+
+// Systems smaller than this are solved exactly with a dense Cholesky decomposition. Larger
+// systems use preconditioned conjugate gradients, which only needs matrix-vector products and so
+// exploits the sparsity. A dense 600x600 Cholesky is ~70M flops, which is about where PCG wins
+// for the sparsity patterns we see (each keyframe is connected to a few dozen others).
+const denseThreshold = 600
+
+// Solve solves M x = b for a symmetric positive definite M. Returns false if the system could not
+// be solved (e.g M is not positive definite).
+func Solve(m *BlockSym, b []float64) ([]float64, bool) {
+	if m.Dim() == 0 {
+		return nil, true
+	}
+	if m.Dim() <= denseThreshold {
+		return geom.SolveSPD(m.Dense(), b)
+	}
+	x, _ := SolvePCG(m, b, 1e-9, 2*m.Dim())
+	for _, v := range x {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, false
+		}
+	}
+	return x, true
+}
+
+// SolvePCG solves M x = b using the conjugate gradient method with a block-Jacobi preconditioner
+// (the inverse of each diagonal block). Iterates until the residual norm is below tol * |b| or
+// maxIterations is reached. Returns the solution and the number of iterations run.
+// Learning: Shewchuk: "An Introduction to the Conjugate Gradient Method Without the Agonizing Pain" (1994)
+func SolvePCG(m *BlockSym, b []float64, tol float64, maxIterations int) ([]float64, int) {
+	n := m.Dim()
+	precond := blockJacobi(m)
+	x := make([]float64, n)
+	r := append([]float64(nil), b...)
+	z := precond(r)
+	p := append([]float64(nil), z...)
+	rz := dot(r, z)
+	bNorm := math.Sqrt(dot(b, b))
+	if bNorm == 0 {
+		return x, 0
+	}
+	var iter int
+	for iter = 0; iter < maxIterations; iter++ {
+		if math.Sqrt(dot(r, r)) <= tol*bNorm {
+			break
+		}
+		ap := m.MulVec(p)
+		pap := dot(p, ap)
+		if pap <= 0 {
+			// not positive definite along p, we can't make further progress
+			break
+		}
+		alpha := rz / pap
+		for i := range x {
+			x[i] += alpha * p[i]
+			r[i] -= alpha * ap[i]
+		}
+		z = precond(r)
+		rzNew := dot(r, z)
+		beta := rzNew / rz
+		rz = rzNew
+		for i := range p {
+			p[i] = z[i] + beta*p[i]
+		}
+	}
+	return x, iter
+}
+
+// blockJacobi returns a function which applies the inverse of the block diagonal of m
+func blockJacobi(m *BlockSym) func(r []float64) []float64 {
+	inverses := make([][]float64, m.NumBlocks())
+	for i := range inverses {
+		d := m.BlockDim(i)
+		block, ok := m.Lookup(i, i)
+		if ok {
+			inverses[i] = invertSPD(block, d)
+		}
+	}
+	return func(r []float64) []float64 {
+		z := make([]float64, len(r))
+		for i, inv := range inverses {
+			o := m.Offset(i)
+			d := m.BlockDim(i)
+			if inv == nil {
+				copy(z[o:o+d], r[o:o+d])
+				continue
+			}
+			for row := 0; row < d; row++ {
+				var sum float64
+				for col := 0; col < d; col++ {
+					sum += inv[row*d+col] * r[o+col]
+				}
+				z[o+row] = sum
+			}
+		}
+		return z
+	}
+}
+
+// invertSPD inverts a small dense symmetric positive definite matrix. Returns nil if the matrix is
+// not positive definite.
+func invertSPD(block []float64, d int) []float64 {
+	a := geom.NewDenseFrom(d, d, block)
+	inv := make([]float64, d*d)
+	e := make([]float64, d)
+	for col := 0; col < d; col++ {
+		for i := range e {
+			e[i] = 0
+		}
+		e[col] = 1
+		x, ok := geom.SolveSPD(a, e)
+		if !ok {
+			return nil
+		}
+		for row := 0; row < d; row++ {
+			inv[row*d+col] = x[row]
+		}
+	}
+	return inv
+}
+
+// InvertSPD inverts a small dense symmetric positive definite matrix in place, for callers who
+// need the inverse of diagonal blocks (e.g eliminating points in the Schur complement).
+// Returns false if the matrix is not positive definite.
+func InvertSPD(block []float64, d int) bool {
+	inv := invertSPD(block, d)
+	if inv == nil {
+		return false
+	}
+	copy(block, inv)
+	return true
+}
+
+func dot(a, b []float64) float64 {
+	var sum float64
+	for i := range a {
+		sum += a[i] * b[i]
+	}
+	return sum
+}
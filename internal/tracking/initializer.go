@@ -0,0 +1,219 @@
+package tracking
+
+import (
+	"context"
+
+	"github.com/kegsay/gorbslam/internal/geom"
+	"github.com/kegsay/gorbslam/internal/matching"
+	"github.com/kegsay/gorbslam/internal/optim"
+	"github.com/kegsay/gorbslam/internal/solver"
+	"github.com/kegsay/gorbslam/internal/world"
+)
+
+const (
+	// bundle adjustment iterations run on the initial map
+	initBAIterations = 20
+	// the initial map is thrown away unless the second keyframe tracks this many points
+	minInitMapPoints = 100
+)
+
+// initializer holds the reference frame of a monocular initialisation attempt
+type initializer struct {
+	frame  *world.Frame
+	solver *solver.TwoViewSolver
+	// where each keypoint of the reference frame was last matched, to search around in the next
+	prevMatched [][2]float64
+}
+
+// monocularInitialization tries to create the initial map from the first frame with enough
+// keypoints (the reference) and the current frame. The reference is kept until one of the frames
+// after it has enough matches and parallax to reconstruct the scene, or matching fails.
+func (t *Tracker) monocularInitialization() {
+	f := t.current
+	if t.init == nil {
+		if len(f.KeyPoints) <= minInitKeyPoints {
+			return
+		}
+		init := &initializer{
+			frame:       f,
+			solver:      solver.NewTwoViewSolver(f.Camera, 1.0, 200),
+			prevMatched: make([][2]float64, len(f.KeyPoints)),
+		}
+		for i, kp := range f.KeyPoints {
+			init.prevMatched[i] = [2]float64{kp.X, kp.Y}
+		}
+		t.init = init
+		return
+	}
+
+	if len(f.KeyPoints) <= minInitKeyPoints {
+		t.init = nil
+		return
+	}
+	matches, n := matching.NewMatcher(0.9, true).SearchForInitialization(t.init.frame, f, t.init.prevMatched, 100)
+	if n < minInitMatches {
+		t.init = nil
+		return
+	}
+
+	var pts1, pts2 [][2]float64
+	var pairs [][2]int
+	for i1, i2 := range matches {
+		if i2 < 0 {
+			continue
+		}
+		kp1, kp2 := &t.init.frame.KeyPoints[i1], &f.KeyPoints[i2]
+		pts1 = append(pts1, [2]float64{kp1.X, kp1.Y})
+		pts2 = append(pts2, [2]float64{kp2.X, kp2.Y})
+		pairs = append(pairs, [2]int{i1, i2})
+	}
+	res, ok := t.init.solver.Reconstruct(pts1, pts2)
+	if !ok {
+		return
+	}
+	t.init.frame.SetPose(geom.IdentitySE3())
+	f.SetPose(res.Pose)
+	t.createInitialMapMonocular(pairs, res)
+}
+
+// stereoInitialization creates the initial map from the first stereo frame with enough keypoints.
+// Every keypoint with a depth becomes a map point, so unlike a monocular map this one has the true
+// scale.
+func (t *Tracker) stereoInitialization() {
+	f := t.current
+	if len(f.KeyPoints) <= minStereoInitKeyPoints {
+		return
+	}
+	f.SetPose(geom.IdentitySE3())
+	kf := world.NewKeyFrame(f, t.m)
+	t.preintegrateIMU(nil, kf)
+	t.m.AddKeyFrame(kf)
+	for i := range f.KeyPoints {
+		if f.Depth[i] > 0 {
+			t.createStereoMapPoint(kf, i)
+		}
+	}
+	t.mapper.InsertKeyFrame(kf)
+
+	f.ReferenceKeyFrame = kf
+	t.lastKeyFrameID = f.ID
+	t.lastKeyFrame = kf
+	t.referenceKF = kf
+	t.localKeyFrames = []*world.KeyFrame{kf}
+	t.localMapPoints = t.m.MapPoints()
+	t.m.SetReferenceMapPoints(t.localMapPoints)
+	t.matchesInliers = len(t.localMapPoints)
+	t.state = OK
+}
+
+// createStereoMapPoint creates a map point at the depth of keypoint i of the current frame, seen by
+// kf, the keyframe being created from the frame
+func (t *Tracker) createStereoMapPoint(kf *world.KeyFrame, i int) {
+	f := t.current
+	pc, _ := f.UnprojectStereo(i)
+	mp := world.NewMapPoint(f.Pose.Inverse().Transform(pc), kf, t.m)
+	mp.AddObservation(kf, i)
+	kf.AddMapPoint(mp, i)
+	mp.ComputeDistinctiveDescriptors()
+	mp.UpdateNormalAndDepth()
+	t.m.AddMapPoint(mp)
+	f.MapPoints[i] = mp
+	f.Outliers[i] = false
+}
+
+// createInitialMapMonocular creates the first two keyframes and the map points triangulated from
+// them, refines them with bundle adjustment and scales the map to a median scene depth of 1.
+func (t *Tracker) createInitialMapMonocular(pairs [][2]int, res *solver.TwoViewResult) {
+	initial, f := t.init.frame, t.current
+	kfIni := world.NewKeyFrame(initial, t.m)
+	kfCur := world.NewKeyFrame(f, t.m)
+	t.preintegrateIMU(nil, kfIni)
+	t.preintegrateIMU(kfIni, kfCur)
+	kfIni.ComputeBoW(t.voc)
+	kfCur.ComputeBoW(t.voc)
+	t.m.AddKeyFrame(kfIni)
+	t.m.AddKeyFrame(kfCur)
+
+	for k, pair := range pairs {
+		if !res.Triangulated[k] {
+			continue
+		}
+		i1, i2 := pair[0], pair[1]
+		mp := world.NewMapPoint(res.Points[k], kfCur, t.m)
+		kfIni.AddMapPoint(mp, i1)
+		kfCur.AddMapPoint(mp, i2)
+		mp.AddObservation(kfIni, i1)
+		mp.AddObservation(kfCur, i2)
+		mp.ComputeDistinctiveDescriptors()
+		mp.UpdateNormalAndDepth()
+		f.MapPoints[i2] = mp
+		f.Outliers[i2] = false
+		t.m.AddMapPoint(mp)
+	}
+	kfIni.UpdateConnections()
+	kfCur.UpdateConnections()
+
+	t.initialBundleAdjustment(kfIni, kfCur)
+
+	medianDepth := kfIni.ComputeSceneMedianDepth(2)
+	if medianDepth <= 0 || kfCur.TrackedMapPoints(1) < minInitMapPoints {
+		t.resetRequested = true
+		return
+	}
+	// the scale of a monocular map is arbitrary, so pick one where the scene is ~1 unit away
+	invMedianDepth := 1 / medianDepth
+	pose := kfCur.Pose()
+	pose.T = pose.T.Scale(invMedianDepth)
+	kfCur.SetPose(pose)
+	for _, mp := range kfIni.MapPoints() {
+		mp.SetPosition(mp.Position().Scale(invMedianDepth))
+		mp.UpdateNormalAndDepth()
+	}
+
+	t.mapper.InsertKeyFrame(kfIni)
+	t.mapper.InsertKeyFrame(kfCur)
+
+	f.SetPose(kfCur.Pose())
+	f.ReferenceKeyFrame = kfCur
+	t.lastKeyFrameID = f.ID
+	t.lastKeyFrame = kfCur
+	t.referenceKF = kfCur
+	t.localKeyFrames = []*world.KeyFrame{kfCur, kfIni}
+	t.localMapPoints = t.m.MapPoints()
+	t.m.SetReferenceMapPoints(t.localMapPoints)
+	t.matchesInliers = len(t.localMapPoints)
+	t.init = nil
+	t.state = OK
+}
+
+// initialBundleAdjustment jointly refines the two keyframes and their points, holding the first
+// keyframe fixed.
+func (t *Tracker) initialBundleAdjustment(kfIni, kfCur *world.KeyFrame) {
+	p := &optim.BundleProblem{
+		Camera:    kfIni.Camera,
+		InvSigma2: kfIni.Pyramid.InvSigma2,
+		KeyFrames: []optim.BAKeyFrame{
+			{Pose: kfIni.Pose(), Fixed: true},
+			{Pose: kfCur.Pose()},
+		},
+	}
+	points := kfIni.MapPoints()
+	for i, mp := range points {
+		p.Points = append(p.Points, optim.BAPoint{Position: mp.Position()})
+		for k, kf := range []*world.KeyFrame{kfIni, kfCur} {
+			idx, ok := mp.Index(kf)
+			if !ok {
+				continue
+			}
+			kp := &kf.KeyPoints[idx]
+			p.Observations = append(p.Observations, optim.BAObservation{
+				KeyFrame: k, Point: i, U: kp.X, V: kp.Y, Octave: kp.Octave,
+			})
+		}
+	}
+	p.Optimize(context.Background(), initBAIterations, true)
+	kfCur.SetPose(p.KeyFrames[1].Pose)
+	for i, mp := range points {
+		mp.SetPosition(p.Points[i].Position)
+	}
+}
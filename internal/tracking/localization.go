@@ -0,0 +1,128 @@
+package tracking
+
+import (
+	"github.com/kegsay/gorbslam/internal/geom"
+	"github.com/kegsay/gorbslam/internal/matching"
+	"github.com/kegsay/gorbslam/internal/world"
+)
+
+const (
+	// below this many map points matched by the motion model, localisation mode switches to
+	// visual odometry
+	minVOMapMatches = 10
+	// the minimum baseline to triangulate visual odometry points, relative to the scene depth
+	minBaselineRatio = 0.01
+)
+
+// SetOnlyTracking switches localisation mode on or off. In localisation mode the tracker never
+// changes the map: it does not initialise or reset it and creates no keyframes, only localising
+// the camera against the existing map points and relocalising when lost. The caller should stop
+// local mapping and loop closing first. Like Track, it must not be called concurrently with other
+// calls on the tracker.
+func (t *Tracker) SetOnlyTracking(flag bool) {
+	t.onlyTracking = flag
+	if !flag {
+		t.vo = false
+		// the next frame must not match, and then insert into a keyframe, points outside the map
+		if t.lastFrame != nil {
+			discardVisualOdometryPoints(t.lastFrame)
+		}
+	}
+}
+
+// OnlyTracking returns true in localisation mode
+func (t *Tracker) OnlyTracking() bool {
+	return t.onlyTracking
+}
+
+// trackOnly localises the frame in localisation mode. While enough map points are matched this is
+// the same as normal tracking. When too few are, the camera is probably leaving the mapped area,
+// so it is tracked by visual odometry with the temporary points triangulated in the last frame,
+// while relocalisation is tried on every frame to get back onto the map.
+func (t *Tracker) trackOnly() bool {
+	f := t.current
+	if t.state == Lost {
+		if t.db == nil {
+			return false
+		}
+		t.countAttempt()
+		return t.relocalization()
+	}
+	if !t.vo {
+		if t.hasVelocity {
+			return t.trackWithMotionModel()
+		}
+		return t.trackReferenceKeyFrame()
+	}
+
+	okMM := false
+	var pose geom.SE3
+	var points []*world.MapPoint
+	var outliers []bool
+	if t.hasVelocity {
+		okMM = t.trackWithMotionModel()
+		pose = f.Pose
+		points = append(points, f.MapPoints...)
+		outliers = append(outliers, f.Outliers...)
+	}
+	okReloc := t.db != nil && t.relocalization()
+	if okReloc {
+		// back on the map
+		t.vo = false
+		return true
+	}
+	if okMM {
+		f.SetPose(pose)
+		copy(f.MapPoints, points)
+		copy(f.Outliers, outliers)
+		t.matchesInliers = 0
+		for i, mp := range f.MapPoints {
+			if mp == nil || f.Outliers[i] {
+				continue
+			}
+			mp.IncreaseFound(1)
+			if mp.NumObservations() > 0 {
+				t.matchesInliers++
+			}
+		}
+	}
+	return okMM
+}
+
+// discardVisualOdometryPoints removes the matches of a frame to points outside the map
+func discardVisualOdometryPoints(f *world.Frame) {
+	for i, mp := range f.MapPoints {
+		if mp != nil && mp.NumObservations() < 1 {
+			f.MapPoints[i] = nil
+			f.Outliers[i] = false
+		}
+	}
+}
+
+// createVisualOdometryPoints triangulates temporary points from the keypoints of the frame which
+// matched nothing, with the reference keyframe, for the motion model to track in the next frame.
+// They are never added to the map, and are dropped once the next frame has been tracked.
+// ORB-SLAM2 only does this for stereo and RGB-D cameras, whose keypoints have a depth, but a
+// monocular camera can do the same once it has moved far enough from the keyframe.
+func (t *Tracker) createVisualOdometryPoints() {
+	f, kf := t.current, t.referenceKF
+	if kf == nil || kf.IsBad() {
+		return
+	}
+	pose1, pose2 := kf.Pose(), f.Pose
+	medianDepth := kf.ComputeSceneMedianDepth(2)
+	if medianDepth <= 0 || pose2.Center().Sub(pose1.Center()).Norm()/medianDepth < minBaselineRatio {
+		return
+	}
+	f.ComputeBoW(t.voc)
+	pairs := matching.NewMatcher(0.6, false).SearchForTriangulationFrame(kf, f, world.Fundamental12(kf.Features, f.Features, pose1, pose2))
+	for _, pair := range pairs {
+		idx1, idx2 := pair[0], pair[1]
+		x, ok := world.TriangulateMatch(kf.Features, pose1, idx1, f.Features, pose2, idx2)
+		if !ok {
+			continue
+		}
+		f.MapPoints[idx2] = world.NewTemporaryMapPoint(x, f.Descriptors[idx2], kf)
+		f.Outliers[idx2] = false
+	}
+}
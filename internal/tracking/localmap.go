@@ -0,0 +1,282 @@
+package tracking
+
+import (
+	"sort"
+
+	"github.com/kegsay/gorbslam/internal/matching"
+	"github.com/kegsay/gorbslam/internal/world"
+)
+
+// trackLocalMap refines the pose with every map point of the local map which should be visible,
+// not only those matched so far. The local map is the keyframes which share points with the frame,
+// plus their neighbours in the covisibility graph and spanning tree.
+func (t *Tracker) trackLocalMap() bool {
+	t.updateLocalKeyFrames()
+	t.updateLocalPoints()
+	t.m.SetReferenceMapPoints(t.localMapPoints)
+	t.searchLocalPoints()
+	t.optimizePose()
+
+	f := t.current
+	t.matchesInliers = 0
+	for i, mp := range f.MapPoints {
+		if mp == nil || f.Outliers[i] {
+			continue
+		}
+		mp.IncreaseFound(1)
+		if mp.NumObservations() > 0 {
+			t.matchesInliers++
+		}
+	}
+	// be more demanding just after relocalisation
+	if f.ID < t.lastRelocFrameID+t.maxFrames && t.matchesInliers < 50 {
+		return false
+	}
+	return t.matchesInliers >= 30
+}
+
+// updateLocalKeyFrames finds the keyframes observing the map points in the frame. The one sharing
+// the most becomes the reference keyframe.
+func (t *Tracker) updateLocalKeyFrames() {
+	f := t.current
+	counter := make(map[*world.KeyFrame]int)
+	for i, mp := range f.MapPoints {
+		if mp == nil {
+			continue
+		}
+		if mp.IsBad() {
+			f.MapPoints[i] = nil
+			continue
+		}
+		for kf := range mp.Observations() {
+			counter[kf]++
+		}
+	}
+	if len(counter) == 0 {
+		return
+	}
+
+	var best *world.KeyFrame
+	included := make(map[*world.KeyFrame]bool)
+	t.localKeyFrames = t.localKeyFrames[:0]
+	for _, kf := range sortKeyFrames(counter) {
+		if kf.IsBad() {
+			continue
+		}
+		if best == nil || counter[kf] > counter[best] {
+			best = kf
+		}
+		t.localKeyFrames = append(t.localKeyFrames, kf)
+		included[kf] = true
+	}
+
+	// include a neighbour of each keyframe: the best covisible, a child and the parent
+	include := func(kf *world.KeyFrame) bool {
+		if kf == nil || kf.IsBad() || included[kf] {
+			return false
+		}
+		t.localKeyFrames = append(t.localKeyFrames, kf)
+		included[kf] = true
+		return true
+	}
+	for i := 0; i < len(t.localKeyFrames) && len(t.localKeyFrames) < maxLocalKeyFrames; i++ {
+		kf := t.localKeyFrames[i]
+		for _, neighbour := range kf.BestCovisibilityKeyFrames(10) {
+			if include(neighbour) {
+				break
+			}
+		}
+		for _, child := range kf.Children() {
+			if include(child) {
+				break
+			}
+		}
+		include(kf.Parent())
+	}
+
+	if best != nil {
+		t.referenceKF = best
+		f.ReferenceKeyFrame = best
+	}
+}
+
+func sortKeyFrames(counter map[*world.KeyFrame]int) []*world.KeyFrame {
+	keyFrames := make([]*world.KeyFrame, 0, len(counter))
+	for kf := range counter {
+		keyFrames = append(keyFrames, kf)
+	}
+	sort.Slice(keyFrames, func(i, j int) bool { return keyFrames[i].ID < keyFrames[j].ID })
+	return keyFrames
+}
+
+// updateLocalPoints collects the map points of the local keyframes
+func (t *Tracker) updateLocalPoints() {
+	seen := make(map[*world.MapPoint]bool)
+	t.localMapPoints = t.localMapPoints[:0]
+	for _, kf := range t.localKeyFrames {
+		for _, mp := range kf.MapPointMatches() {
+			if mp == nil || seen[mp] || mp.IsBad() {
+				continue
+			}
+			seen[mp] = true
+			t.localMapPoints = append(t.localMapPoints, mp)
+		}
+	}
+}
+
+// searchLocalPoints projects the local map points which aren't matched yet into the frame, and
+// matches those in the frustum.
+func (t *Tracker) searchLocalPoints() {
+	f := t.current
+	matched := make(map[*world.MapPoint]bool)
+	for i, mp := range f.MapPoints {
+		if mp == nil {
+			continue
+		}
+		if mp.IsBad() {
+			f.MapPoints[i] = nil
+			continue
+		}
+		mp.IncreaseVisible(1)
+		matched[mp] = true
+	}
+
+	var points []*world.MapPoint
+	var projections []world.Projection
+	for _, mp := range t.localMapPoints {
+		if matched[mp] || mp.IsBad() {
+			continue
+		}
+		proj, ok := f.IsInFrustum(mp, 0.5)
+		if !ok {
+			continue
+		}
+		mp.IncreaseVisible(1)
+		points = append(points, mp)
+		projections = append(projections, proj)
+	}
+	if len(points) == 0 {
+		return
+	}
+	th := 1.0
+	if f.ID < t.lastRelocFrameID+2 {
+		// the pose is rougher just after relocalisation
+		th = 5
+	}
+	matching.NewMatcher(0.8, true).SearchByProjection(f, points, projections, th)
+}
+
+// needNewKeyFrame decides whether the current frame should become a keyframe. Keyframes are
+// inserted generously (local mapping culls redundant ones later) whenever tracking is weakening
+// and enough frames have passed.
+func (t *Tracker) needNewKeyFrame() bool {
+	if t.onlyTracking || t.mapper.IsStopped() || t.mapper.StopRequested() {
+		return false
+	}
+	f := t.current
+	numKFs := int64(t.m.NumKeyFrames())
+	// not so soon after relocalisation
+	if f.ID < t.lastRelocFrameID+t.maxFrames && numKFs > t.maxFrames {
+		return false
+	}
+
+	if t.imuCalib != nil && !t.m.IsIMUInitialized() && t.lastKeyFrame != nil &&
+		f.Timestamp.Sub(t.lastKeyFrame.Timestamp) >= maxInertialKeyFrameGap {
+		return true
+	}
+
+	minObs := 3
+	if numKFs <= 2 {
+		minObs = 2
+	}
+	refMatches := t.referenceKF.TrackedMapPoints(minObs)
+	idle := t.mapper.AcceptKeyFrames()
+
+	// a stereo camera needs close points to keep the scale, so a keyframe is needed when too few of
+	// them are tracked and enough could be created
+	needClose := false
+	if f.IsStereo() {
+		tracked, nonTracked := 0, 0
+		for i, z := range f.Depth {
+			if z <= 0 || z >= f.ThDepth {
+				continue
+			}
+			if f.MapPoints[i] != nil && !f.Outliers[i] {
+				tracked++
+			} else {
+				nonTracked++
+			}
+		}
+		needClose = tracked < 100 && nonTracked > 70
+	}
+	thRefRatio := 0.9
+	if f.IsStereo() {
+		thRefRatio = 0.75
+		if numKFs < 2 {
+			thRefRatio = 0.4
+		}
+	}
+
+	// max frames have passed since the last keyframe
+	c1a := f.ID >= t.lastKeyFrameID+t.maxFrames
+	// min frames have passed and local mapping is idle
+	c1b := f.ID >= t.lastKeyFrameID+t.minFrames && idle
+	// a stereo camera is tracking much less than the reference keyframe, or needs close points
+	c1c := f.IsStereo() && (float64(t.matchesInliers) < float64(refMatches)*0.25 || needClose)
+	// tracking fewer points than the reference keyframe, but not so few it's about to be lost
+	c2 := (float64(t.matchesInliers) < float64(refMatches)*thRefRatio || needClose) && t.matchesInliers > 15
+	if !(c1a || c1b || c1c) || !c2 {
+		return false
+	}
+	if idle {
+		return true
+	}
+	// let the mapper finish sooner so it can take the next one
+	t.mapper.InterruptBA()
+	// a stereo keyframe is worth queueing, as it brings its own points
+	return f.IsStereo() && t.mapper.KeyFramesInQueue() < 3
+}
+
+// createNewKeyFrame turns the current frame into a keyframe and hands it to local mapping
+func (t *Tracker) createNewKeyFrame() {
+	if !t.mapper.SetNotStop(true) {
+		return
+	}
+	f := t.current
+	kf := world.NewKeyFrame(f, t.m)
+	t.preintegrateIMU(t.lastKeyFrame, kf)
+	t.referenceKF = kf
+	f.ReferenceKeyFrame = kf
+	if f.IsStereo() {
+		t.createCloseMapPoints(kf)
+	}
+	t.mapper.InsertKeyFrame(kf)
+	t.mapper.SetNotStop(false)
+	t.lastKeyFrameID = f.ID
+	t.lastKeyFrame = kf
+}
+
+// createCloseMapPoints creates map points for the keypoints of a new stereo keyframe which have a
+// depth but no map point, nearest first. All the close points are created, and far ones too until
+// there are at least 100 points.
+func (t *Tracker) createCloseMapPoints(kf *world.KeyFrame) {
+	f := t.current
+	var indexes []int
+	for i, z := range f.Depth {
+		if z > 0 {
+			indexes = append(indexes, i)
+		}
+	}
+	sort.Slice(indexes, func(a, b int) bool { return f.Depth[indexes[a]] < f.Depth[indexes[b]] })
+	n := 0
+	for _, i := range indexes {
+		if mp := f.MapPoints[i]; mp == nil || mp.NumObservations() < 1 {
+			// points without observations aren't in the map, so are replaced
+			t.createStereoMapPoint(kf, i)
+		}
+		n++
+		if f.Depth[i] > f.ThDepth && n > 100 {
+			break
+		}
+	}
+}
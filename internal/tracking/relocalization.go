@@ -0,0 +1,193 @@
+package tracking
+
+import (
+	"time"
+
+	"github.com/kegsay/gorbslam/internal/matching"
+	"github.com/kegsay/gorbslam/internal/solver"
+	"github.com/kegsay/gorbslam/internal/world"
+)
+
+// RelocalizationStats counts how the tracker has recovered from being lost.
+type RelocalizationStats struct {
+	// The number of frames relocalisation was tried on, and how many of them succeeded
+	Attempts  int
+	Successes int
+	// The time between tracking being lost and relocalising, according to the frame timestamps:
+	// for the last recovery, and summed over all of them
+	LastTimeToRecover  time.Duration
+	TotalTimeToRecover time.Duration
+}
+
+// MeanTimeToRecover returns the average time taken to relocalise, or 0 if it never has
+func (s RelocalizationStats) MeanTimeToRecover() time.Duration {
+	if s.Successes == 0 {
+		return 0
+	}
+	return s.TotalTimeToRecover / time.Duration(s.Successes)
+}
+
+// relocCandidate is a keyframe which may have seen what the frame sees, with the map points
+// matched to the frame's keypoints by BoW and a PnP solver for them.
+type relocCandidate struct {
+	kf      *world.KeyFrame
+	matches []*world.MapPoint
+	// the keypoint of the frame for each of the solver's correspondences
+	indexes   []int
+	solver    *solver.PnPSolver
+	discarded bool
+}
+
+// relocalization looks for the pose of a frame taken while lost. Keyframes which look like the
+// frame are found in the keyframe database, then each is matched by BoW and PnP RANSAC is run on
+// the matches. A pose with enough inliers is refined with motion-only BA, looking for more matches
+// by projecting the keyframe's points, and accepted if at least 50 map points agree with it. If no
+// candidate is, the frame's pose is restored to what it was before.
+// Learning: Mur-Artal and Tardós: "Fast Relocalisation and Loop Closing in Keyframe-Based SLAM" (2014)
+func (t *Tracker) relocalization() bool {
+	f := t.current
+	f.ComputeBoW(t.voc)
+	kfs := t.db.DetectRelocalizationCandidates(f)
+	if len(kfs) == 0 {
+		return false
+	}
+
+	pose, hasPose := f.Pose, f.HasPose
+	matcher := matching.NewMatcher(0.75, true)
+	var candidates []*relocCandidate
+	numCandidates := 0
+	for _, kf := range kfs {
+		c := &relocCandidate{kf: kf, discarded: true}
+		candidates = append(candidates, c)
+		if kf.IsBad() {
+			continue
+		}
+		matches, n := matcher.SearchByBoW(kf, f)
+		if n < 15 {
+			continue
+		}
+		c.matches = matches
+		var corrs []solver.PnPCorrespondence
+		for i, mp := range matches {
+			if mp == nil {
+				continue
+			}
+			kp := &f.KeyPoints[i]
+			corrs = append(corrs, solver.PnPCorrespondence{Point: mp.Position(), U: kp.X, V: kp.Y, Octave: kp.Octave})
+			c.indexes = append(c.indexes, i)
+		}
+		pnp, err := solver.NewPnPSolver(f.Camera, corrs, f.Pyramid.Sigma2)
+		if err != nil {
+			continue
+		}
+		c.solver = pnp
+		c.solver.SetRansacParameters(0.99, 10, 300, 4, 0.5, 5.991)
+		c.discarded = false
+		numCandidates++
+	}
+
+	// Run a few RANSAC iterations on each candidate in turn, until one gives a pose which enough
+	// map points agree with
+	projMatcher := matching.NewMatcher(0.9, true)
+	for numCandidates > 0 {
+		for _, c := range candidates {
+			if c.discarded {
+				continue
+			}
+			res, noMore := c.solver.Iterate(5)
+			if noMore {
+				c.discarded = true
+				numCandidates--
+			}
+			if res == nil {
+				continue
+			}
+			if t.refineRelocalization(c, res, projMatcher) {
+				t.lastRelocFrameID = f.ID
+				return true
+			}
+		}
+	}
+	// don't leave the last hypothesis behind
+	f.Pose, f.HasPose = pose, hasPose
+	t.clearMatches()
+	return false
+}
+
+// refineRelocalization optimises the pose found by PnP with the inliers, then searches for more
+// matches with the candidate's points, which can rescue a pose with too few inliers. Returns true
+// if the frame is relocalised.
+func (t *Tracker) refineRelocalization(c *relocCandidate, res *solver.PnPResult, matcher *matching.Matcher) bool {
+	f := t.current
+	f.SetPose(res.Pose)
+	t.clearMatches()
+	found := make(map[*world.MapPoint]bool)
+	for j, inlier := range res.Inliers {
+		if inlier {
+			i := c.indexes[j]
+			f.MapPoints[i] = c.matches[i]
+			found[c.matches[i]] = true
+		}
+	}
+	good := t.optimizePose()
+	if good < 10 {
+		return false
+	}
+	dropOutliers := func() {
+		for i := range f.MapPoints {
+			if f.Outliers[i] {
+				f.MapPoints[i] = nil
+				f.Outliers[i] = false
+			}
+		}
+	}
+	dropOutliers()
+
+	if good < 50 {
+		// look wider for the points the candidate sees
+		additional := matcher.SearchByProjectionKeyFrame(f, c.kf, found, 10, 100)
+		if good+additional >= 50 {
+			good = t.optimizePose()
+			// if still not quite enough, search again more narrowly now the pose is better
+			if good > 30 && good < 50 {
+				found = make(map[*world.MapPoint]bool)
+				for _, mp := range f.MapPoints {
+					if mp != nil {
+						found[mp] = true
+					}
+				}
+				additional = matcher.SearchByProjectionKeyFrame(f, c.kf, found, 3, 64)
+				if good+additional >= 50 {
+					good = t.optimizePose()
+				}
+			}
+			dropOutliers()
+		}
+	}
+	return good >= 50
+}
+
+// RelocalizationStats returns how often the tracker has tried to relocalise, and how long it
+// took to recover. Unlike the rest of the tracker, it is safe to call while frames are being
+// tracked.
+func (t *Tracker) RelocalizationStats() RelocalizationStats {
+	t.statsMu.Lock()
+	defer t.statsMu.Unlock()
+	return t.relocStats
+}
+
+// countAttempt records an attempt to relocalise
+func (t *Tracker) countAttempt() {
+	t.statsMu.Lock()
+	defer t.statsMu.Unlock()
+	t.relocStats.Attempts++
+}
+
+// countRecovery records tracking being recovered in a frame with the given timestamp
+func (t *Tracker) countRecovery(timestamp time.Time) {
+	t.statsMu.Lock()
+	defer t.statsMu.Unlock()
+	t.relocStats.Successes++
+	t.relocStats.LastTimeToRecover = timestamp.Sub(t.lostAt)
+	t.relocStats.TotalTimeToRecover += t.relocStats.LastTimeToRecover
+}
@@ -0,0 +1,587 @@
+// Package tracking localises the camera in every frame against the map. This is the first of the
+// three ORB-SLAM2 goroutines: it decides when frames become keyframes, which are then handed to
+// local mapping to grow and refine the map.
+// Learning: https://www.youtube.com/watch?v=0I30M6yTklo&t=191s
+package tracking
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/kegsay/gorbslam/internal/bow"
+	"github.com/kegsay/gorbslam/internal/geom"
+	"github.com/kegsay/gorbslam/internal/imu"
+	"github.com/kegsay/gorbslam/internal/matching"
+	"github.com/kegsay/gorbslam/internal/optim"
+	"github.com/kegsay/gorbslam/internal/world"
+)
+
+// State is the state of the tracker
+type State int
+
+const (
+	// NoImagesYet is the state before the first frame, and after a reset
+	NoImagesYet State = iota
+	// NotInitialized means there is no map yet: the tracker is looking for two frames with enough
+	// parallax to create one.
+	NotInitialized
+	// OK means the camera was localised in the last frame
+	OK
+	// Lost means the camera could not be localised in the last frame
+	Lost
+)
+
+func (s State) String() string {
+	switch s {
+	case NoImagesYet:
+		return "NoImagesYet"
+	case NotInitialized:
+		return "NotInitialized"
+	case OK:
+		return "OK"
+	case Lost:
+		return "Lost"
+	}
+	return "Unknown"
+}
+
+// LocalMapper is the part of local mapping the tracker talks to.
+type LocalMapper interface {
+	// InsertKeyFrame queues a new keyframe to be added to the map
+	InsertKeyFrame(kf *world.KeyFrame)
+	// AcceptKeyFrames returns false while the mapper is busy
+	AcceptKeyFrames() bool
+	// KeyFramesInQueue returns the number of keyframes waiting to be processed
+	KeyFramesInQueue() int
+	// InterruptBA aborts the local bundle adjustment in progress, so the mapper can accept a new
+	// keyframe sooner
+	InterruptBA()
+	// IsStopped and StopRequested return true while loop closing is correcting the map, when no
+	// keyframes should be created
+	IsStopped() bool
+	StopRequested() bool
+	// SetNotStop prevents the mapper from stopping while a keyframe is being created. Returns false
+	// if the mapper has already stopped.
+	SetNotStop(flag bool) bool
+	// RequestReset empties the queue of the mapper, blocking until it has done so
+	RequestReset()
+}
+
+// LoopCloser is the part of loop closing the tracker talks to.
+type LoopCloser interface {
+	// RequestReset discards the loop closer's state, blocking until it has done so
+	RequestReset()
+}
+
+// Result is the outcome of tracking a single frame.
+type Result struct {
+	FrameID   int64
+	Timestamp time.Time
+	State     State
+	// The camera pose Tcw, only valid if State is OK
+	Pose geom.SE3
+	// The number of map points matched in the frame which agree with the pose
+	NumTracked int
+	// The keyframe the pose was tracked against, nil if none
+	ReferenceKeyFrame *world.KeyFrame
+}
+
+const (
+	// an initialisation attempt needs this many keypoints in both frames, and this many matches
+	minInitKeyPoints = 100
+	minInitMatches   = 100
+	// a stereo frame needs this many keypoints to create the initial map on its own
+	minStereoInitKeyPoints = 500
+	// a map with this few keyframes is thrown away when tracking is lost, rather than relocalising
+	minKeyFramesToKeep = 5
+	// with an atlas, relocalisation is given this long before a new map is started
+	maxRecentlyLost = 5 * time.Second
+	// until the IMU is initialised, keyframes are inserted at least this often so there are
+	// enough of them spanning the motion
+	maxInertialKeyFrameGap = 250 * time.Millisecond
+	// the maximum number of keyframes in the local map
+	maxLocalKeyFrames = 80
+)
+
+// Tracker localises the camera in each frame. Other than RelocalizationStats it is not safe for
+// concurrent use: frames should be passed to Track one at a time, in order, or sent to Run.
+type Tracker struct {
+	voc        *bow.Vocabulary
+	m          *world.Map
+	mapper     LocalMapper
+	loopCloser LoopCloser
+	db         *world.KeyFrameDatabase
+	atlas      *world.Atlas
+
+	state State
+	// Keyframes are created at least every maxFrames frames (if tracking is weak) and no more
+	// often than every minFrames
+	maxFrames int64
+	minFrames int64
+
+	current   *world.Frame
+	lastFrame *world.Frame
+	// the pose of the last frame relative to its reference keyframe, which local mapping may move
+	lastTlr geom.SE3
+	// the constant velocity motion model: the motion from the last frame to the current one
+	velocity    geom.SE3
+	hasVelocity bool
+
+	referenceKF      *world.KeyFrame
+	lastKeyFrame     *world.KeyFrame
+	lastKeyFrameID   int64
+	lastRelocFrameID int64
+	// the timestamp of the frame tracking was lost in
+	lostAt time.Time
+	// guards relocStats, which can be read while tracking
+	statsMu    sync.Mutex
+	relocStats RelocalizationStats
+
+	localKeyFrames []*world.KeyFrame
+	localMapPoints []*world.MapPoint
+	// the number of map points in the current frame which agree with the pose
+	matchesInliers int
+
+	init *initializer
+	// set to throw the map away after the current frame
+	resetRequested bool
+	// set along with resetRequested to keep the map in the atlas instead
+	newMapRequested bool
+
+	// set in localisation mode, see SetOnlyTracking
+	onlyTracking bool
+	// set in localisation mode when the motion model matched too few map points, so the camera
+	// is tracked by visual odometry until it relocalises
+	vo bool
+
+	// set for visual-inertial tracking, see SetIMU
+	imuCalib *imu.Calibration
+	// the IMU measurements since the last keyframe, or since the frame initialisation started from
+	imuMeasurements []imu.Measurement
+	// the scale of the map when the last frame was tracked, see world.Map.Scale
+	mapScale float64
+}
+
+// NewTracker creates a tracker which builds the map m, handing keyframes to mapper. fps is the
+// frame rate of the camera, which bounds how often keyframes are inserted.
+func NewTracker(voc *bow.Vocabulary, m *world.Map, mapper LocalMapper, fps int) *Tracker {
+	if fps <= 0 {
+		fps = 30
+	}
+	return &Tracker{
+		voc:       voc,
+		m:         m,
+		mapper:    mapper,
+		maxFrames: int64(fps),
+	}
+}
+
+// SetLoopCloser sets the loop closer to reset along with the map. Must be called before tracking.
+func (t *Tracker) SetLoopCloser(lc LoopCloser) {
+	t.loopCloser = lc
+}
+
+// SetKeyFrameDatabase sets the database to relocalise with when tracking is lost. Keyframes are
+// added to it by loop closing. Must be called before tracking.
+func (t *Tracker) SetKeyFrameDatabase(db *world.KeyFrameDatabase) {
+	t.db = db
+}
+
+// SetAtlas sets the atlas whose active map is being built. When tracking has been lost for a
+// while the map is then stored in the atlas and a new one started, rather than waiting to
+// relocalise. Must be called before tracking.
+func (t *Tracker) SetAtlas(a *world.Atlas) {
+	t.atlas = a
+}
+
+// SetIMU makes the tracker visual-inertial: each keyframe is given the IMU motion since the one
+// before, integrated from the measurements in each frame, for local mapping to estimate gravity,
+// the scale and the IMU biases. Must be called before tracking.
+func (t *Tracker) SetIMU(calib *imu.Calibration) {
+	t.imuCalib = calib
+}
+
+// State returns the state after the last frame
+func (t *Tracker) State() State {
+	return t.state
+}
+
+// Run tracks each frame received on in, publishing the result on out, until in is closed or the
+// context is cancelled. Run closes out when it returns.
+func (t *Tracker) Run(ctx context.Context, in <-chan *world.Frame, out chan<- Result) {
+	defer close(out)
+	for {
+		var f *world.Frame
+		select {
+		case <-ctx.Done():
+			return
+		case frame, ok := <-in:
+			if !ok {
+				return
+			}
+			f = frame
+		}
+		res := t.Track(f)
+		select {
+		case <-ctx.Done():
+			return
+		case out <- res:
+		}
+	}
+}
+
+// Track localises the camera in the frame, initialising the map first if there isn't one.
+func (t *Tracker) Track(f *world.Frame) Result {
+	res := t.track(f)
+	// local mapping may be waiting on the map lock, so only reset once we've released it
+	if t.resetRequested {
+		t.reset()
+	}
+	return res
+}
+
+func (t *Tracker) track(f *world.Frame) Result {
+	t.current = f
+	if t.state == NoImagesYet {
+		t.state = NotInitialized
+	}
+
+	// the map can't change while we track
+	t.m.Update.Lock()
+	defer t.m.Update.Unlock()
+	if t.imuCalib != nil {
+		t.imuMeasurements = append(t.imuMeasurements, f.IMU...)
+	}
+	t.checkMapScale()
+
+	if t.state == NotInitialized && t.m.NumKeyFrames() > 0 {
+		// the map was built before this tracker started, e.g. loaded from a file or before
+		// localisation mode, so the camera must be relocalised in it
+		t.state = Lost
+		t.lostAt = f.Timestamp
+	}
+	if t.onlyTracking && t.state == NotInitialized {
+		// there is nothing to localise against until a map exists
+		return t.result()
+	}
+
+	if t.state == NotInitialized {
+		if f.IsStereo() {
+			t.stereoInitialization()
+		} else {
+			t.monocularInitialization()
+		}
+		if t.state != OK {
+			// only the measurements since the frame initialisation would start from are needed
+			if t.init != nil {
+				t.dropIMUBefore(t.init.frame.Timestamp)
+			} else {
+				t.dropIMUBefore(f.Timestamp)
+			}
+			return t.result()
+		}
+		t.lastFrame = f
+		t.lastTlr = f.Pose.Mul(t.referenceKF.Pose().Inverse())
+		return t.result()
+	}
+
+	var ok bool
+	wasLost := t.state == Lost
+	if t.onlyTracking {
+		ok = t.trackOnly()
+	} else if t.state == OK {
+		t.checkReplacedInLastFrame()
+		if !t.hasVelocity || f.ID < t.lastRelocFrameID+2 {
+			ok = t.trackReferenceKeyFrame()
+		} else {
+			ok = t.trackWithMotionModel()
+			if !ok {
+				ok = t.trackReferenceKeyFrame()
+			}
+		}
+	} else if t.db != nil {
+		// without a keyframe database a lost tracker stays lost
+		t.countAttempt()
+		ok = t.relocalization()
+	}
+	f.ReferenceKeyFrame = t.referenceKF
+
+	// in visual odometry there aren't enough map points to track the local map
+	if ok && !(t.onlyTracking && t.vo) {
+		ok = t.trackLocalMap()
+	}
+	if ok {
+		t.state = OK
+		if wasLost {
+			t.countRecovery(f.Timestamp)
+		}
+	} else {
+		if !wasLost {
+			t.lostAt = f.Timestamp
+		}
+		t.state = Lost
+	}
+
+	if ok {
+		if t.lastFrame != nil && t.lastFrame.HasPose {
+			t.velocity = f.Pose.Mul(t.lastFrame.Pose.Inverse())
+			t.hasVelocity = true
+		} else {
+			t.hasVelocity = false
+		}
+		if t.needNewKeyFrame() {
+			t.createNewKeyFrame()
+		}
+		// outliers were kept so that the keyframe decision could see them, drop them now so they
+		// don't get used to track the next frame
+		for i := range f.MapPoints {
+			if f.MapPoints[i] != nil && f.Outliers[i] {
+				f.MapPoints[i] = nil
+			}
+		}
+	}
+	if t.onlyTracking {
+		discardVisualOdometryPoints(f)
+		if ok {
+			t.createVisualOdometryPoints()
+		}
+		// no keyframes are created, so the measurements are never integrated
+		t.dropIMUBefore(f.Timestamp)
+	}
+
+	res := t.result()
+	if t.state == Lost && !t.onlyTracking && t.m.NumKeyFrames() <= minKeyFramesToKeep {
+		// too little map to be worth relocalising against: start again
+		t.resetRequested = true
+		return res
+	}
+	if t.state == Lost && !t.onlyTracking && t.atlas != nil && f.Timestamp.Sub(t.lostAt) > maxRecentlyLost {
+		// keep the map for loop closing to merge once the camera is back somewhere it knows
+		t.resetRequested = true
+		t.newMapRequested = true
+		return res
+	}
+	if f.ReferenceKeyFrame == nil {
+		f.ReferenceKeyFrame = t.referenceKF
+	}
+	t.lastFrame = f
+	if f.HasPose && t.referenceKF != nil {
+		t.lastTlr = f.Pose.Mul(t.referenceKF.Pose().Inverse())
+	}
+	return res
+}
+
+func (t *Tracker) result() Result {
+	res := Result{
+		FrameID:    t.current.ID,
+		Timestamp:  t.current.Timestamp,
+		State:      t.state,
+		NumTracked: t.matchesInliers,
+	}
+	if t.state == OK {
+		res.Pose = t.current.Pose
+		res.ReferenceKeyFrame = t.referenceKF
+	}
+	return res
+}
+
+// Reset throws away the map and starts initialising again. Like Track, it must not be called
+// concurrently with other calls on the tracker.
+func (t *Tracker) Reset() {
+	t.reset()
+}
+
+func (t *Tracker) reset() {
+	t.mapper.RequestReset()
+	if t.loopCloser != nil {
+		t.loopCloser.RequestReset()
+	}
+	if t.newMapRequested {
+		// now that nothing else uses the map, move it out of the way
+		t.atlas.StoreActiveMap()
+		t.newMapRequested = false
+	}
+	if t.db != nil {
+		t.db.Clear()
+	}
+	t.m.Clear()
+	t.resetRequested = false
+	t.state = NoImagesYet
+	t.init = nil
+	t.vo = false
+	t.lastFrame = nil
+	t.hasVelocity = false
+	t.referenceKF = nil
+	t.lastKeyFrame = nil
+	t.localKeyFrames = nil
+	t.localMapPoints = nil
+	t.matchesInliers = 0
+	t.imuMeasurements = nil
+	t.mapScale = 0
+}
+
+// checkMapScale rescales the motion model when local mapping has scaled the map since the last
+// frame, as it does when it initialises the IMU. The motion is relative to the keyframes, which
+// moved with the map, so only its scale needs correcting.
+func (t *Tracker) checkMapScale() {
+	s := t.m.Scale()
+	if t.mapScale != 0 && s != t.mapScale {
+		ratio := s / t.mapScale
+		t.lastTlr.T = t.lastTlr.T.Scale(ratio)
+		t.velocity.T = t.velocity.T.Scale(ratio)
+		if t.lastFrame != nil && t.lastFrame.HasPose {
+			t.updateLastFrame()
+		}
+	}
+	t.mapScale = s
+}
+
+// preintegrateIMU gives kf, a new keyframe, the IMU motion since prev, the keyframe before it in
+// time. prev is nil for the first keyframe of a map.
+func (t *Tracker) preintegrateIMU(prev, kf *world.KeyFrame) {
+	if t.imuCalib == nil {
+		return
+	}
+	if prev == nil {
+		kf.SetIMU(nil, nil)
+	} else {
+		p := imu.NewPreintegrated(prev.Bias(), t.imuCalib)
+		p.Integrate(imu.Between(t.imuMeasurements, prev.Timestamp, kf.Timestamp), prev.Timestamp, kf.Timestamp)
+		kf.SetIMU(prev, p)
+	}
+	t.dropIMUBefore(kf.Timestamp)
+}
+
+// dropIMUBefore discards the IMU measurements which aren't needed to integrate from ts onwards
+func (t *Tracker) dropIMUBefore(ts time.Time) {
+	ms := t.imuMeasurements
+	i := 0
+	for i+1 < len(ms) && !ms[i+1].Timestamp.After(ts) {
+		i++
+	}
+	t.imuMeasurements = append([]imu.Measurement(nil), ms[i:]...)
+}
+
+// Local mapping may have fused map points seen in the last frame, so use their replacements
+func (t *Tracker) checkReplacedInLastFrame() {
+	for i, mp := range t.lastFrame.MapPoints {
+		if mp == nil {
+			continue
+		}
+		if rep := mp.Replaced(); rep != nil {
+			t.lastFrame.MapPoints[i] = rep
+		}
+	}
+}
+
+// optimizePose runs motion-only bundle adjustment on the current frame using its map point
+// matches, marking the outliers. Returns the number of inliers.
+func (t *Tracker) optimizePose() int {
+	f := t.current
+	var obs []optim.PoseObservation
+	var indexes []int
+	for i, mp := range f.MapPoints {
+		if mp == nil {
+			continue
+		}
+		kp := &f.KeyPoints[i]
+		obs = append(obs, optim.PoseObservation{Point: mp.Position(), U: kp.X, V: kp.Y, URight: f.RightX(i), Octave: kp.Octave})
+		indexes = append(indexes, i)
+	}
+	pose, inliers := optim.PoseOptimization(f.Camera, f.Bf, f.Pose, obs, f.Pyramid.InvSigma2)
+	f.SetPose(pose)
+	for j, i := range indexes {
+		f.Outliers[i] = obs[j].Outlier
+	}
+	return inliers
+}
+
+// discardOutliers removes the outlier matches after pose optimisation, returning the number of
+// remaining matches to points which are in the map.
+func (t *Tracker) discardOutliers() int {
+	f := t.current
+	n := 0
+	for i, mp := range f.MapPoints {
+		if mp == nil {
+			continue
+		}
+		if f.Outliers[i] {
+			f.MapPoints[i] = nil
+			f.Outliers[i] = false
+		} else if mp.NumObservations() > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+func (t *Tracker) clearMatches() {
+	for i := range t.current.MapPoints {
+		t.current.MapPoints[i] = nil
+		t.current.Outliers[i] = false
+	}
+}
+
+// trackReferenceKeyFrame matches the frame to the reference keyframe with the vocabulary, then
+// optimises the pose starting from the last one. This is used when there is no motion model, or
+// the motion model failed.
+func (t *Tracker) trackReferenceKeyFrame() bool {
+	f := t.current
+	f.ComputeBoW(t.voc)
+	matches, n := matching.NewMatcher(0.7, true).SearchByBoW(t.referenceKF, f)
+	if n < 15 {
+		return false
+	}
+	copy(f.MapPoints, matches)
+	for i := range f.Outliers {
+		f.Outliers[i] = false
+	}
+	f.SetPose(t.lastFrame.Pose)
+	t.optimizePose()
+	return t.discardOutliers() >= 10
+}
+
+// updateLastFrame moves the last frame with its reference keyframe, which may have been refined by
+// local mapping since it was tracked.
+func (t *Tracker) updateLastFrame() {
+	if ref := t.lastFrame.ReferenceKeyFrame; ref != nil {
+		t.lastFrame.SetPose(t.lastTlr.Mul(ref.Pose()))
+	}
+}
+
+// trackWithMotionModel predicts the pose assuming the camera keeps moving as it did between the
+// last two frames, then matches the points of the last frame by projection.
+func (t *Tracker) trackWithMotionModel() bool {
+	f := t.current
+	t.updateLastFrame()
+	f.SetPose(t.velocity.Mul(t.lastFrame.Pose))
+	t.clearMatches()
+
+	matcher := matching.NewMatcher(0.9, true)
+	const th = 15
+	n := matcher.SearchByProjectionLastFrame(f, t.lastFrame, th)
+	if n < 20 {
+		// the motion model was probably wrong, search a wider window
+		t.clearMatches()
+		n = matcher.SearchByProjectionLastFrame(f, t.lastFrame, 2*th)
+	}
+	if n < 20 {
+		return false
+	}
+	t.optimizePose()
+	mapMatches := t.discardOutliers()
+	if t.onlyTracking {
+		// visual odometry points are as good as map points to track with, but too few of the
+		// latter means the camera is leaving the map
+		t.vo = mapMatches < minVOMapMatches
+		matches := 0
+		for _, mp := range f.MapPoints {
+			if mp != nil {
+				matches++
+			}
+		}
+		return matches > 20
+	}
+	return mapMatches >= 10
+}
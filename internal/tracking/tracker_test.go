@@ -0,0 +1,539 @@
+package tracking
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/kegsay/gorbslam/internal/bow"
+	"github.com/kegsay/gorbslam/internal/feature"
+	"github.com/kegsay/gorbslam/internal/geom"
+	"github.com/kegsay/gorbslam/internal/world"
+	"github.com/kegsay/gorbslam/internal/worldtest"
+)
+
+// syncMapper adds keyframes to the map as soon as they are inserted, like local mapping would
+// without creating new points or culling anything.
+type syncMapper struct {
+	m   *world.Map
+	voc *bow.Vocabulary
+	// keyframes are added to db if set, as loop closing would
+	db       *world.KeyFrameDatabase
+	inserted int
+	resets   int
+}
+
+func (s *syncMapper) InsertKeyFrame(kf *world.KeyFrame) {
+	s.inserted++
+	kf.ComputeBoW(s.voc)
+	for i, mp := range kf.MapPointMatches() {
+		if mp == nil || mp.IsBad() || mp.IsInKeyFrame(kf) {
+			continue
+		}
+		mp.AddObservation(kf, i)
+		mp.UpdateNormalAndDepth()
+		mp.ComputeDistinctiveDescriptors()
+	}
+	kf.UpdateConnections()
+	s.m.AddKeyFrame(kf)
+	if s.db != nil {
+		s.db.Add(kf)
+	}
+}
+
+func (s *syncMapper) AcceptKeyFrames() bool     { return true }
+func (s *syncMapper) KeyFramesInQueue() int     { return 0 }
+func (s *syncMapper) InterruptBA()              {}
+func (s *syncMapper) IsStopped() bool           { return false }
+func (s *syncMapper) StopRequested() bool       { return false }
+func (s *syncMapper) SetNotStop(flag bool) bool { return true }
+func (s *syncMapper) RequestReset()             { s.resets++ }
+
+// newTestScene creates n points between 3 and 6 units in front of the origin, all in view of it
+func newTestScene(rng *rand.Rand, n int) *worldtest.Scene {
+	s := worldtest.NewScene(rng)
+	for i := 0; i < n; i++ {
+		u, v := rng.Float64()*worldtest.Width, rng.Float64()*worldtest.Height
+		s.Add(worldtest.Camera.Unproject(u, v).Scale(3 + rng.Float64()*3))
+	}
+	return s
+}
+
+// The true camera pose Tcw of frame i: moving sideways and slightly up while turning
+func truePose(i int) geom.SE3 {
+	twc := geom.SE3{
+		R: geom.ExpSO3(geom.Vec3{0, 0.003 * float64(i), 0}),
+		T: geom.Vec3{0.02 * float64(i), -0.005 * float64(i), 0},
+	}
+	return twc.Inverse()
+}
+
+func newTestTracker(rng *rand.Rand) (*Tracker, *syncMapper) {
+	voc := worldtest.FlatVocabulary(rng, 16)
+	m := world.NewMap()
+	mapper := &syncMapper{m: m, voc: voc}
+	return NewTracker(voc, m, mapper, 30), mapper
+}
+
+func TestTrackerSequence(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	scene := newTestScene(rng, 1000)
+	tracker, mapper := newTestTracker(rng)
+
+	// the mapper doesn't refine the initial points, so their error grows as the camera moves away
+	// from where they were triangulated. Keep the sequence short enough that they're still good.
+	var results []Result
+	for i := 0; i < 25; i++ {
+		results = append(results, tracker.Track(scene.Frame(truePose(i), 0.2)))
+	}
+	if results[0].State != NotInitialized {
+		t.Fatalf("first frame: got state %v want NotInitialized", results[0].State)
+	}
+	initialised := -1
+	for i, res := range results {
+		if res.State == OK {
+			initialised = i
+			break
+		}
+		if res.State != NotInitialized {
+			t.Fatalf("frame %d: got state %v before initialising", i, res.State)
+		}
+	}
+	if initialised < 0 {
+		t.Fatalf("never initialised")
+	}
+	for i := initialised; i < len(results); i++ {
+		if results[i].State != OK {
+			t.Fatalf("frame %d: got state %v want OK", i, results[i].State)
+		}
+		if results[i].ReferenceKeyFrame == nil {
+			t.Errorf("frame %d: no reference keyframe", i)
+		}
+	}
+	if mapper.inserted < 2 {
+		t.Errorf("inserted %d keyframes", mapper.inserted)
+	}
+
+	// the map is in the frame of the first camera, with an unknown scale
+	last := len(results) - 1
+	scale := truePose(last).Center().Norm() / results[last].Pose.Center().Norm()
+	for i := initialised; i < len(results); i++ {
+		got := results[i].Pose.Center().Scale(scale)
+		want := truePose(i).Center()
+		if d := got.Sub(want).Norm(); d > 0.02 {
+			t.Errorf("frame %d: camera centre %v want %v", i, got, want)
+		}
+		if d := results[i].Pose.R.Inverse().Mul(truePose(i).R).Angle(); d > 0.01 {
+			t.Errorf("frame %d: rotation error %v", i, d)
+		}
+	}
+}
+
+func TestTrackerLostResets(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	scene := newTestScene(rng, 1000)
+	tracker, mapper := newTestTracker(rng)
+	i := 0
+	for ; i < 20 && tracker.State() != OK; i++ {
+		tracker.Track(scene.Frame(truePose(i), 0.2))
+	}
+	if tracker.State() != OK {
+		t.Fatalf("never initialised")
+	}
+
+	// a completely different view: nothing matches
+	other := newTestScene(rng, 1000)
+	res := tracker.Track(other.Frame(truePose(i), 0.5))
+	if res.State != Lost {
+		t.Fatalf("got state %v want Lost", res.State)
+	}
+	// the map was too small to keep
+	if mapper.resets != 1 || tracker.m.NumKeyFrames() != 0 || tracker.State() != NoImagesYet {
+		t.Errorf("expected a reset: resets=%d keyframes=%d state=%v", mapper.resets, tracker.m.NumKeyFrames(), tracker.State())
+	}
+	// and initialises again
+	for j := 0; j < 20 && tracker.State() != OK; j++ {
+		tracker.Track(scene.Frame(truePose(i+j), 0.5))
+	}
+	if tracker.State() != OK {
+		t.Errorf("did not initialise again after the reset")
+	}
+}
+
+func TestTrackerReset(t *testing.T) {
+	rng := rand.New(rand.NewSource(4))
+	scene := newTestScene(rng, 1000)
+	tracker, mapper := newTestTracker(rng)
+	for i := 0; i < 20 && tracker.State() != OK; i++ {
+		tracker.Track(scene.Frame(truePose(i), 0.2))
+	}
+	if tracker.State() != OK {
+		t.Fatalf("never initialised")
+	}
+	tracker.Reset()
+	if mapper.resets != 1 || tracker.m.NumKeyFrames() != 0 || tracker.State() != NoImagesYet {
+		t.Errorf("expected a reset: resets=%d keyframes=%d state=%v", mapper.resets, tracker.m.NumKeyFrames(), tracker.State())
+	}
+	if res := tracker.Track(scene.Frame(truePose(0), 0.2)); res.State != NotInitialized {
+		t.Errorf("got state %v after reset want NotInitialized", res.State)
+	}
+}
+
+func TestTrackerRun(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	scene := newTestScene(rng, 500)
+	tracker, _ := newTestTracker(rng)
+
+	in := make(chan *world.Frame)
+	out := make(chan Result)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go tracker.Run(ctx, in, out)
+
+	var frames []*world.Frame
+	for i := 0; i < 3; i++ {
+		f := scene.Frame(truePose(i), 0.2)
+		frames = append(frames, f)
+		in <- f
+		res := <-out
+		if res.FrameID != f.ID {
+			t.Errorf("got result for frame %d want %d", res.FrameID, f.ID)
+		}
+	}
+	close(in)
+	if _, ok := <-out; ok {
+		t.Errorf("out was not closed when in was")
+	}
+}
+
+func TestTrackerRelocalization(t *testing.T) {
+	rng := rand.New(rand.NewSource(4))
+	scene := newTestScene(rng, 1000)
+	tracker, mapper := newTestTracker(rng)
+	db := world.NewKeyFrameDatabase()
+	mapper.db = db
+	tracker.SetKeyFrameDatabase(db)
+
+	start := time.Unix(0, 0)
+	frame := func(s *worldtest.Scene, i, n int) *world.Frame {
+		f := s.Frame(truePose(i), 0.2)
+		f.Timestamp = start.Add(time.Duration(n) * time.Second / 30)
+		return f
+	}
+	var poses []geom.SE3
+	n := 0
+	for ; n < 30; n++ {
+		res := tracker.Track(frame(scene, n, n))
+		poses = append(poses, res.Pose)
+	}
+	if tracker.State() != OK {
+		t.Fatalf("not tracking: %v", tracker.State())
+	}
+
+	// the camera is covered: nothing can be seen
+	other := newTestScene(rng, 1000)
+	for j := 0; j < 5; j++ {
+		if res := tracker.Track(frame(other, n, n)); res.State != Lost {
+			t.Fatalf("got state %v want Lost", res.State)
+		}
+		n++
+	}
+	if stats := tracker.RelocalizationStats(); stats.Attempts != 4 || stats.Successes != 0 {
+		t.Errorf("got stats %+v while lost", stats)
+	}
+
+	// partly uncovered: PnP finds the pose, but too few points are seen to accept it
+	const back = 15
+	few := scene.FrameWithout(truePose(back), 0.2, func(i int) bool { return i%25 != 0 })
+	few.Timestamp = start.Add(time.Duration(n) * time.Second / 30)
+	few.HasPose = false
+	if res := tracker.Track(few); res.State != Lost {
+		t.Fatalf("relocalised from too few points: %v", res.State)
+	}
+	if few.HasPose {
+		t.Errorf("failed relocalisation left the pose %v", few.Pose)
+	}
+	n++
+
+	// and uncovered back where it was a while ago
+	res := tracker.Track(frame(scene, back, n))
+	if res.State != OK {
+		t.Fatalf("did not relocalise: %v", res.State)
+	}
+	if d := res.Pose.Center().Sub(poses[back].Center()).Norm(); d > 0.01 {
+		t.Errorf("relocalised %v from the pose tracked before", d)
+	}
+	if d := res.Pose.R.Inverse().Mul(poses[back].R).Angle(); d > 0.01 {
+		t.Errorf("relocalised rotation %v from the pose tracked before", d)
+	}
+	stats := tracker.RelocalizationStats()
+	if stats.Attempts != 6 || stats.Successes != 1 {
+		t.Errorf("got stats %+v", stats)
+	}
+	// lost in frame 30, relocalised in frame 36
+	if want := 6 * time.Second / 30; stats.LastTimeToRecover != want || stats.MeanTimeToRecover() != want {
+		t.Errorf("got time to recover %v, mean %v, want %v", stats.LastTimeToRecover, stats.MeanTimeToRecover(), want)
+	}
+	// and keeps tracking
+	for j := 1; j <= 3; j++ {
+		if res := tracker.Track(frame(scene, back+j, n+j)); res.State != OK {
+			t.Errorf("lost again %d frames after relocalising: %v", j, res.State)
+		}
+	}
+}
+
+func TestTrackerNewMap(t *testing.T) {
+	rng := rand.New(rand.NewSource(8))
+	scene := newTestScene(rng, 1000)
+	voc := worldtest.FlatVocabulary(rng, 16)
+	m, db := world.NewMap(), world.NewKeyFrameDatabase()
+	mapper := &syncMapper{m: m, voc: voc, db: db}
+	// a low frame rate, for frequent keyframes
+	tracker := NewTracker(voc, m, mapper, 5)
+	tracker.SetKeyFrameDatabase(db)
+	atlas := world.NewAtlas(m, db)
+	tracker.SetAtlas(atlas)
+
+	start := time.Unix(0, 0)
+	at := func(f *world.Frame, n int) *world.Frame {
+		f.Timestamp = start.Add(time.Duration(n) * time.Second)
+		return f
+	}
+	n := 0
+	for ; n < 30; n++ {
+		tracker.Track(at(scene.Frame(truePose(n), 0.2), n))
+	}
+	numKFs := tracker.m.NumKeyFrames()
+	if tracker.State() != OK || numKFs <= minKeyFramesToKeep {
+		t.Fatalf("not tracking: %v with %d keyframes", tracker.State(), numKFs)
+	}
+
+	// lost for a while, relocalising all along
+	other := newTestScene(rng, 1000)
+	for ; atlas.NumMaps() == 1 && n < 100; n++ {
+		tracker.Track(at(other.Frame(truePose(n), 0.2), n))
+	}
+	if atlas.NumMaps() != 2 {
+		t.Fatalf("no new map was started")
+	}
+	// lost in frame 30, and given up on more than 5 seconds later
+	if lost := n - 1 - 30; lost != 6 {
+		t.Errorf("new map started after %d lost frames, want 6", lost)
+	}
+	if stored := atlas.InactiveMaps()[0]; stored.NumKeyFrames() != numKFs {
+		t.Errorf("stored map has %d keyframes, want %d", stored.NumKeyFrames(), numKFs)
+	}
+	if mapper.resets != 1 || tracker.m.NumKeyFrames() != 0 {
+		t.Errorf("active map was not emptied")
+	}
+
+	// and a new map is built wherever the camera is now
+	for j := 0; j < 20; j++ {
+		tracker.Track(at(other.Frame(truePose(j), 0.2), n+j))
+	}
+	if tracker.State() != OK || tracker.m.NumKeyFrames() == 0 {
+		t.Errorf("did not initialise a new map: %v", tracker.State())
+	}
+}
+
+func TestTrackerLoadedMap(t *testing.T) {
+	rng := rand.New(rand.NewSource(7))
+	scene := newTestScene(rng, 1000)
+	tracker, mapper := newTestTracker(rng)
+	mapper.db = world.NewKeyFrameDatabase()
+	var poses []geom.SE3
+	for i := 0; i < 20; i++ {
+		poses = append(poses, tracker.Track(scene.Frame(truePose(i), 0.2)).Pose)
+	}
+	if tracker.State() != OK {
+		t.Fatalf("not tracking: %v", tracker.State())
+	}
+	var buf bytes.Buffer
+	if err := world.SaveMap(&buf, tracker.m, tracker.voc, false); err != nil {
+		t.Fatalf("SaveMap: %s", err)
+	}
+
+	// a new tracker with the saved map relocalises in it rather than initialising a new one
+	m, db := world.NewMap(), world.NewKeyFrameDatabase()
+	if err := world.LoadMap(&buf, m, db, tracker.voc); err != nil {
+		t.Fatalf("LoadMap: %s", err)
+	}
+	loaded := NewTracker(tracker.voc, m, &syncMapper{m: m, voc: tracker.voc, db: db}, 30)
+	loaded.SetKeyFrameDatabase(db)
+	numKFs := m.NumKeyFrames()
+	res := loaded.Track(scene.Frame(truePose(10), 0.2))
+	if res.State != OK {
+		t.Fatalf("did not relocalise in the loaded map: %v", res.State)
+	}
+	// the map has its own scale, so compare with the pose tracked before
+	if d := res.Pose.Center().Sub(poses[10].Center()).Norm(); d > 0.01 {
+		t.Errorf("relocalised %v from the pose tracked before", d)
+	}
+	if m.NumKeyFrames() < numKFs {
+		t.Errorf("loaded map was reset")
+	}
+}
+
+// buildUnmappedMap tracks the first 15 frames of the scene. Half of the points are only seen in
+// the first frame, so the first keyframe has plenty of keypoints without map points, from which
+// visual odometry points can be triangulated. Returns the result of the last frame.
+func buildUnmappedMap(tracker *Tracker, scene *worldtest.Scene) Result {
+	res := tracker.Track(scene.Frame(truePose(0), 0.2))
+	for i := 1; i < 15; i++ {
+		res = tracker.Track(scene.FrameWithout(truePose(i), 0.2, func(j int) bool { return j%2 == 0 }))
+	}
+	return res
+}
+
+func TestTrackerOnlyTracking(t *testing.T) {
+	rng := rand.New(rand.NewSource(5))
+	scene := newTestScene(rng, 1000)
+	tracker, mapper := newTestTracker(rng)
+	db := world.NewKeyFrameDatabase()
+	mapper.db = db
+	tracker.SetKeyFrameDatabase(db)
+	buildUnmappedMap(tracker, scene)
+	i := 15
+	if tracker.State() != OK {
+		t.Fatalf("not tracking: %v", tracker.State())
+	}
+
+	tracker.SetOnlyTracking(true)
+	inserted, numKFs, numPoints := mapper.inserted, tracker.m.NumKeyFrames(), tracker.m.NumMapPoints()
+	withVO := 0
+	for end := i + 10; i < end; i++ {
+		if res := tracker.Track(scene.Frame(truePose(i), 0.2)); res.State != OK {
+			t.Fatalf("frame %d: got state %v in localisation mode", i, res.State)
+		}
+		for _, mp := range tracker.lastFrame.MapPoints {
+			if mp != nil && mp.NumObservations() == 0 {
+				withVO++
+				break
+			}
+		}
+	}
+	if mapper.inserted != inserted || tracker.m.NumKeyFrames() != numKFs || tracker.m.NumMapPoints() != numPoints {
+		t.Errorf("map changed in localisation mode: inserted %d keyframes, %d keyframes and %d points, was %d and %d",
+			mapper.inserted-inserted, tracker.m.NumKeyFrames(), tracker.m.NumMapPoints(), numKFs, numPoints)
+	}
+	if withVO == 0 {
+		t.Errorf("no visual odometry points were created")
+	}
+
+	// lost in localisation mode: the map is kept, however small
+	other := newTestScene(rng, 1000)
+	if res := tracker.Track(other.Frame(truePose(i), 0.5)); res.State != Lost {
+		t.Fatalf("got state %v want Lost", res.State)
+	}
+	if mapper.resets != 0 || tracker.m.NumKeyFrames() != numKFs {
+		t.Errorf("map was reset in localisation mode")
+	}
+	if res := tracker.Track(scene.Frame(truePose(i), 0.2)); res.State != OK {
+		t.Fatalf("did not relocalise: %v", res.State)
+	}
+	i++
+
+	// and back to building the map, without any of the temporary points
+	tracker.SetOnlyTracking(false)
+	for end := i + 5; i < end; i++ {
+		if res := tracker.Track(scene.Frame(truePose(i), 0.2)); res.State != OK {
+			t.Fatalf("frame %d: got state %v after localisation mode", i, res.State)
+		}
+	}
+	inMap := make(map[*world.MapPoint]bool)
+	for _, mp := range tracker.m.MapPoints() {
+		inMap[mp] = true
+	}
+	for _, kf := range tracker.m.KeyFrames() {
+		for _, mp := range kf.MapPoints() {
+			if !inMap[mp] {
+				t.Fatalf("keyframe %d has a point which is not in the map", kf.ID)
+			}
+		}
+	}
+}
+
+func TestTrackerVisualOdometry(t *testing.T) {
+	rng := rand.New(rand.NewSource(6))
+	scene := newTestScene(rng, 1000)
+	tracker, mapper := newTestTracker(rng)
+	db := world.NewKeyFrameDatabase()
+	mapper.db = db
+	tracker.SetKeyFrameDatabase(db)
+	res := buildUnmappedMap(tracker, scene)
+	i := 15
+	if res.State != OK {
+		t.Fatalf("not tracking: %v", res.State)
+	}
+	scale := truePose(i-1).Center().Norm() / res.Pose.Center().Norm()
+	tracker.SetOnlyTracking(true)
+	for end := i + 3; i < end; i++ {
+		tracker.Track(scene.Frame(truePose(i), 0.2))
+	}
+
+	// the camera leaves the map: only a handful of the mapped points can still be seen
+	mapped := make(map[feature.Descriptor]bool)
+	for _, mp := range tracker.m.MapPoints() {
+		mapped[mp.Descriptor()] = true
+	}
+	seen := 0
+	hide := func(j int) bool {
+		if !mapped[scene.Descriptors[j]] {
+			return false
+		}
+		seen++
+		return seen > 5
+	}
+	for end := i + 5; i < end; i++ {
+		seen = 0
+		res := tracker.Track(scene.FrameWithout(truePose(i), 0.2, hide))
+		if res.State != OK {
+			t.Fatalf("frame %d: got state %v off the map", i, res.State)
+		}
+		if !tracker.vo {
+			t.Errorf("frame %d: not using visual odometry", i)
+		}
+		got := res.Pose.Center().Scale(scale)
+		if d := got.Sub(truePose(i).Center()).Norm(); d > 0.05 {
+			t.Errorf("frame %d: camera centre %v want %v", i, got, truePose(i).Center())
+		}
+	}
+
+	// and comes back onto it
+	res = tracker.Track(scene.Frame(truePose(i), 0.2))
+	if res.State != OK || tracker.vo {
+		t.Errorf("got state %v, visual odometry %v back on the map", res.State, tracker.vo)
+	}
+}
+
+func TestTrackerStereo(t *testing.T) {
+	rng := rand.New(rand.NewSource(8))
+	scene := newTestScene(rng, 1000)
+	tracker, mapper := newTestTracker(rng)
+	const bf, thDepth = 40, 4
+	var initialPoints int
+	for i := 0; i < 30; i++ {
+		// most of the close points only appear after initialisation, when they need a keyframe
+		hide := func(j int) bool { return i < 5 && scene.Points[j][2] < thDepth && j%4 != 0 }
+		res := tracker.Track(scene.StereoFrame(truePose(i), 0.2, bf, thDepth, hide))
+		// a single stereo frame is enough to initialise
+		if res.State != OK {
+			t.Fatalf("frame %d: got state %v want OK", i, res.State)
+		}
+		if i == 0 {
+			initialPoints = tracker.m.NumMapPoints()
+		}
+		// and the map has the true scale
+		if d := res.Pose.Center().Sub(truePose(i).Center()).Norm(); d > 0.01 {
+			t.Errorf("frame %d: camera centre %v want %v", i, res.Pose.Center(), truePose(i).Center())
+		}
+	}
+	if mapper.inserted < 2 {
+		t.Fatalf("inserted %d keyframes", mapper.inserted)
+	}
+	if n := tracker.m.NumMapPoints(); n < initialPoints+200 {
+		t.Errorf("close points were not added: %d points in the map, %d after initialisation", n, initialPoints)
+	}
+}
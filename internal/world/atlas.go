@@ -0,0 +1,218 @@
+package world
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/kegsay/gorbslam/internal/geom"
+)
+
+// Atlas is the set of maps built so far. Only the active map is tracked and mapped: when tracking
+// is lost for too long its contents are stored as an inactive map and a new one is started in its
+// place, rather than waiting to relocalise. Loop closing then looks for places seen in both the
+// active map and an inactive one, and merges the inactive map into the active one.
+// The active map and keyframe database are the ones shared by tracking, local mapping and loop
+// closing, and stay the same objects for the life of the atlas: their contents are what change.
+// Learning: Campos et al: "ORB-SLAM3: An Accurate Open-Source Library for Visual, Visual-Inertial and Multi-Map SLAM" (2021)
+type Atlas struct {
+	active *Map
+	db     *KeyFrameDatabase
+
+	mu       sync.Mutex
+	inactive []*atlasMap
+}
+
+// an inactive map, with the keyframe database of its keyframes
+type atlasMap struct {
+	m  *Map
+	db *KeyFrameDatabase
+}
+
+// NewAtlas creates an atlas whose active map is m, with the keyframe database db
+func NewAtlas(m *Map, db *KeyFrameDatabase) *Atlas {
+	return &Atlas{active: m, db: db}
+}
+
+// Active returns the active map
+func (a *Atlas) Active() *Map {
+	return a.active
+}
+
+// InactiveMaps returns the maps which are not active, oldest first
+func (a *Atlas) InactiveMaps() []*Map {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	maps := make([]*Map, len(a.inactive))
+	for i, am := range a.inactive {
+		maps[i] = am.m
+	}
+	return maps
+}
+
+// NumMaps returns the number of maps, including the active one
+func (a *Atlas) NumMaps() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.inactive) + 1
+}
+
+// StoreActiveMap moves the contents of the active map into a new inactive map, leaving the active
+// map empty. Returns nil if there was nothing to store. Local mapping and loop closing must not be
+// using the active map, e.g. because they have just been reset.
+func (a *Atlas) StoreActiveMap() *Map {
+	if a.active.NumKeyFrames() == 0 {
+		a.active.Clear()
+		return nil
+	}
+	m := NewMap()
+	a.active.Update.Lock()
+	a.active.moveTo(m)
+	a.active.Update.Unlock()
+	a.add(m)
+	return m
+}
+
+// AddMap adds m as an inactive map, e.g. one loaded with LoadMap. Its keyframes and map points are
+// given new IDs, as they were numbered independently of the maps of this session. m must not be
+// in use.
+func (a *Atlas) AddMap(m *Map) {
+	keyFrameIDs := make(map[int64]int64)
+	for _, kf := range m.KeyFrames() {
+		id := atomic.AddInt64(&nextKeyFrameID, 1) - 1
+		keyFrameIDs[kf.ID] = id
+		kf.ID = id
+	}
+	for _, mp := range m.MapPoints() {
+		mp.ID = atomic.AddInt64(&nextMapPointID, 1) - 1
+		if id, ok := keyFrameIDs[mp.FirstKeyFrameID]; ok {
+			mp.FirstKeyFrameID = id
+		}
+	}
+	m.mu.Lock()
+	m.maxKeyFrameID = 0
+	for kf := range m.keyFrames {
+		if kf.ID > m.maxKeyFrameID {
+			m.maxKeyFrameID = kf.ID
+		}
+	}
+	m.mu.Unlock()
+	a.add(m)
+}
+
+func (a *Atlas) add(m *Map) {
+	db := NewKeyFrameDatabase()
+	for _, kf := range m.KeyFrames() {
+		db.Add(kf)
+	}
+	a.mu.Lock()
+	a.inactive = append(a.inactive, &atlasMap{m: m, db: db})
+	a.mu.Unlock()
+}
+
+// Clear removes every inactive map. The active map is left alone.
+func (a *Atlas) Clear() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.inactive = nil
+}
+
+// DetectMergeCandidates returns keyframes of the inactive maps which look like kf, a keyframe of
+// the active map. minScore is as for KeyFrameDatabase.DetectLoopCandidates.
+func (a *Atlas) DetectMergeCandidates(kf *KeyFrame, minScore float64) []*KeyFrame {
+	a.mu.Lock()
+	inactive := append([]*atlasMap(nil), a.inactive...)
+	a.mu.Unlock()
+	var candidates []*KeyFrame
+	for _, am := range inactive {
+		candidates = append(candidates, am.db.DetectLoopCandidates(kf, minScore)...)
+	}
+	return candidates
+}
+
+// MapOf returns the inactive map containing kf, or nil if it is not in one
+func (a *Atlas) MapOf(kf *KeyFrame) *Map {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, am := range a.inactive {
+		if am.m.hasKeyFrame(kf) {
+			return am.m
+		}
+	}
+	return nil
+}
+
+// Merge moves every keyframe and map point of the inactive map m into the active map, transformed
+// by s from the coordinates of m to those of the active map, and adds the keyframes to the active
+// keyframe database. The spanning tree of m is attached to that of the active map by making kf, a
+// keyframe of m, a child of parent. Must be called with the active map's update lock held, and
+// local mapping stopped. The covisibility graph is left to the caller, which should fuse the map
+// points seen from both maps.
+func (a *Atlas) Merge(m *Map, s geom.Sim3, kf, parent *KeyFrame) {
+	a.mu.Lock()
+	for i, am := range a.inactive {
+		if am.m == m {
+			a.inactive = append(a.inactive[:i:i], a.inactive[i+1:]...)
+			break
+		}
+	}
+	a.mu.Unlock()
+
+	keyFrames := m.KeyFrames()
+	m.Transform(s)
+	m.moveTo(a.active)
+	for _, k := range keyFrames {
+		a.db.Add(k)
+	}
+	kf.reroot()
+	kf.ChangeParent(parent)
+}
+
+// moveTo moves every keyframe and map point into dst, leaving m empty. The origin is only kept if
+// dst is empty.
+func (m *Map) moveTo(dst *Map) {
+	m.mu.Lock()
+	keyFrames, points, origin := m.keyFrames, m.mapPoints, m.origin
+	m.keyFrames = make(map[*KeyFrame]bool)
+	m.mapPoints = make(map[*MapPoint]bool)
+	m.origin = nil
+	m.referencePoints = nil
+	m.maxKeyFrameID = 0
+	m.mu.Unlock()
+
+	if origin != nil {
+		origin.m = dst
+		dst.AddKeyFrame(origin)
+	}
+	for _, kf := range sortedKeyFrames(keyFrames) {
+		kf.m = dst
+		dst.AddKeyFrame(kf)
+	}
+	for mp := range points {
+		mp.m = dst
+		dst.AddMapPoint(mp)
+	}
+}
+
+func (m *Map) hasKeyFrame(kf *KeyFrame) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.keyFrames[kf]
+}
+
+// reroot makes k the root of its spanning tree, by reversing the links between it and the root
+func (k *KeyFrame) reroot() {
+	var child *KeyFrame
+	for kf := k; kf != nil; {
+		parent := kf.Parent()
+		if parent != nil {
+			parent.EraseChild(kf)
+		}
+		kf.mu.Lock()
+		kf.parent = child
+		kf.mu.Unlock()
+		if child != nil {
+			child.AddChild(kf)
+		}
+		child, kf = kf, parent
+	}
+}
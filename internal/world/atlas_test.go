@@ -0,0 +1,116 @@
+package world
+
+import (
+	"testing"
+
+	"github.com/kegsay/gorbslam/internal/geom"
+)
+
+func TestAtlasStoreAndMerge(t *testing.T) {
+	old := newTestScene(60, [][]int{pointRange(0, 40), pointRange(10, 50), pointRange(20, 60)})
+	db := NewKeyFrameDatabase()
+	for i, kf := range old.keyFrames {
+		setWords(kf, pointRange(i*5, i*5+20)...)
+		db.Add(kf)
+	}
+	atlas := NewAtlas(old.m, db)
+
+	stored := atlas.StoreActiveMap()
+	if stored == nil || atlas.NumMaps() != 2 {
+		t.Fatalf("StoreActiveMap: got %v and %d maps", stored, atlas.NumMaps())
+	}
+	if old.m.NumKeyFrames() != 0 || old.m.NumMapPoints() != 0 || old.m.Origin() != nil {
+		t.Errorf("active map was not emptied")
+	}
+	if stored.NumKeyFrames() != 3 || stored.NumMapPoints() != 60 || stored.Origin() != old.keyFrames[0] {
+		t.Errorf("stored map has %d keyframes and %d points", stored.NumKeyFrames(), stored.NumMapPoints())
+	}
+	// removing a point now removes it from the stored map
+	old.points[0].SetBad()
+	if stored.NumMapPoints() != 59 {
+		t.Errorf("bad point was not removed from the stored map")
+	}
+	if atlas.StoreActiveMap() != nil || atlas.NumMaps() != 2 {
+		t.Errorf("stored an empty map")
+	}
+
+	// a new map is started in the active map, which sees the same place as the stored one
+	active := NewKeyFrame(NewFrame(old.keyFrames[1].Features, old.keyFrames[1].Timestamp), old.m)
+	setWords(active, pointRange(5, 25)...)
+	old.m.AddKeyFrame(active)
+	db.Add(active)
+	candidates := atlas.DetectMergeCandidates(active, 0)
+	if len(candidates) == 0 || atlas.MapOf(candidates[0]) != stored {
+		t.Fatalf("got merge candidates %v", candidates)
+	}
+	if atlas.MapOf(active) != nil {
+		t.Errorf("active keyframe is in an inactive map")
+	}
+
+	s := geom.NewSim3(geom.ExpSO3(geom.Vec3{0, 0.2, 0}).Matrix(), geom.Vec3{1, 2, 3}, 2)
+	centres := make(map[*KeyFrame]geom.Vec3)
+	for _, kf := range old.keyFrames {
+		centres[kf] = kf.CameraCenter()
+	}
+	position := old.points[1].Position()
+	old.m.Update.Lock()
+	atlas.Merge(stored, s, old.keyFrames[2], active)
+	old.m.Update.Unlock()
+
+	if atlas.NumMaps() != 1 || stored.NumKeyFrames() != 0 {
+		t.Errorf("inactive map was not removed")
+	}
+	if old.m.NumKeyFrames() != 4 || old.m.NumMapPoints() != 59 || old.m.Origin() != active {
+		t.Errorf("active map has %d keyframes and %d points after merging", old.m.NumKeyFrames(), old.m.NumMapPoints())
+	}
+	for kf, c := range centres {
+		if d := kf.CameraCenter().Sub(s.Transform(c)).Norm(); d > 1e-9 {
+			t.Errorf("keyframe %d moved %v from where it should be", kf.ID, d)
+		}
+	}
+	if d := old.points[1].Position().Sub(s.Transform(position)).Norm(); d > 1e-9 {
+		t.Errorf("point moved %v from where it should be", d)
+	}
+	// the spanning tree of the stored map hangs from the active keyframe
+	kfs := old.keyFrames
+	for child, parent := range map[*KeyFrame]*KeyFrame{kfs[2]: active, kfs[1]: kfs[2], kfs[0]: kfs[1]} {
+		if child.Parent() != parent {
+			t.Errorf("keyframe %d has the wrong parent", child.ID)
+		}
+	}
+	assertKeyFrames(t, "children", active.Children(), kfs[2])
+	assertKeyFrames(t, "children", kfs[1].Children(), kfs[0])
+	// the keyframes are in the active database, and can be removed from the active map
+	if len(db.DetectLoopCandidates(active, 0)) == 0 {
+		t.Errorf("merged keyframes are not in the keyframe database")
+	}
+	kfs[0].SetBad()
+	if old.m.NumKeyFrames() != 3 {
+		t.Errorf("old origin was not removed")
+	}
+}
+
+func TestAtlasAddMap(t *testing.T) {
+	s := newTestScene(20, [][]int{pointRange(0, 20), pointRange(0, 20)})
+	ids := map[int64]bool{}
+	for _, kf := range s.keyFrames {
+		ids[kf.ID] = true
+	}
+	first := s.points[0].FirstKeyFrameID
+	atlas := NewAtlas(NewMap(), NewKeyFrameDatabase())
+	atlas.AddMap(s.m)
+	if atlas.NumMaps() != 2 {
+		t.Fatalf("got %d maps", atlas.NumMaps())
+	}
+	for _, kf := range s.keyFrames {
+		if ids[kf.ID] {
+			t.Errorf("keyframe ID %d was not renumbered", kf.ID)
+		}
+	}
+	if s.points[0].FirstKeyFrameID == first || s.points[0].FirstKeyFrameID != s.keyFrames[0].ID {
+		t.Errorf("first keyframe ID %d not renumbered to %d", s.points[0].FirstKeyFrameID, s.keyFrames[0].ID)
+	}
+	if s.m.MaxKeyFrameID() != s.keyFrames[1].ID {
+		t.Errorf("max keyframe ID is %d", s.m.MaxKeyFrameID())
+	}
+}
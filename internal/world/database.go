@@ -0,0 +1,172 @@
+package world
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/kegsay/gorbslam/internal/bow"
+)
+
+// KeyFrameDatabase is an inverted index from each vocabulary word to the keyframes containing it,
+// used to find keyframes which look like a query keyframe without comparing against all of them.
+// Learning: Gálvez-López and Tardós: "Bags of Binary Words for Fast Place Recognition in Image Sequences" (2012)
+type KeyFrameDatabase struct {
+	mu            sync.RWMutex
+	invertedFiles map[bow.WordID][]*KeyFrame
+	scorer        bow.L1Scorer
+}
+
+// NewKeyFrameDatabase creates an empty database
+func NewKeyFrameDatabase() *KeyFrameDatabase {
+	return &KeyFrameDatabase{
+		invertedFiles: make(map[bow.WordID][]*KeyFrame),
+	}
+}
+
+// Add indexes the keyframe by the words in its bag of words, which must have been computed
+func (db *KeyFrameDatabase) Add(kf *KeyFrame) {
+	bv := kf.BowVector()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for i := 0; i < bv.Len(); i++ {
+		w, _ := bv.Entry(i)
+		db.invertedFiles[w] = append(db.invertedFiles[w], kf)
+	}
+}
+
+// Erase removes the keyframe from the index
+func (db *KeyFrameDatabase) Erase(kf *KeyFrame) {
+	bv := kf.BowVector()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for i := 0; i < bv.Len(); i++ {
+		w, _ := bv.Entry(i)
+		kfs := db.invertedFiles[w]
+		for j := range kfs {
+			if kfs[j] == kf {
+				db.invertedFiles[w] = append(kfs[:j:j], kfs[j+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// Clear empties the database
+func (db *KeyFrameDatabase) Clear() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.invertedFiles = make(map[bow.WordID][]*KeyFrame)
+}
+
+// Count the words each keyframe shares with bv, skipping bad keyframes and those in exclude
+func (db *KeyFrameDatabase) commonWords(bv bow.BowVector, exclude map[*KeyFrame]bool) map[*KeyFrame]int {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	common := make(map[*KeyFrame]int)
+	for i := 0; i < bv.Len(); i++ {
+		w, _ := bv.Entry(i)
+		for _, kf := range db.invertedFiles[w] {
+			if exclude[kf] || kf.IsBad() {
+				continue
+			}
+			common[kf]++
+		}
+	}
+	return common
+}
+
+// Score the keyframes sharing at least 80% as many words as the best one, keeping those scoring at
+// least minScore. Then the score of each keyframe's neighbourhood (its best covisible keyframes
+// which were also scored) is accumulated, as a single similar keyframe may be a coincidence but a
+// similar group is not. The best keyframe of each neighbourhood scoring at least 75% of the best
+// neighbourhood is returned, ordered by ID.
+func (db *KeyFrameDatabase) candidates(bv bow.BowVector, common map[*KeyFrame]int, minScore float64) []*KeyFrame {
+	var maxCommon int
+	for _, n := range common {
+		if n > maxCommon {
+			maxCommon = n
+		}
+	}
+	minCommon := int(float64(maxCommon) * 0.8)
+	scores := make(map[*KeyFrame]float64)
+	for kf, n := range common {
+		if n <= minCommon {
+			continue
+		}
+		if s := db.scorer.Score(bv, kf.BowVector()); s >= minScore {
+			scores[kf] = s
+		}
+	}
+	if len(scores) == 0 {
+		return nil
+	}
+
+	type group struct {
+		acc  float64
+		best *KeyFrame
+	}
+	groups := make([]group, 0, len(scores))
+	var bestAcc float64
+	for _, kf := range sortedKeyFrameScores(scores) {
+		g := group{acc: scores[kf], best: kf}
+		bestScore := scores[kf]
+		for _, n := range kf.BestCovisibilityKeyFrames(10) {
+			s, ok := scores[n]
+			if !ok {
+				continue
+			}
+			g.acc += s
+			if s > bestScore {
+				g.best, bestScore = n, s
+			}
+		}
+		groups = append(groups, g)
+		if g.acc > bestAcc {
+			bestAcc = g.acc
+		}
+	}
+
+	retained := make(map[*KeyFrame]bool)
+	for _, g := range groups {
+		if g.acc > 0.75*bestAcc {
+			retained[g.best] = true
+		}
+	}
+	return sortedKeyFrames(retained)
+}
+
+// DetectLoopCandidates returns keyframes which look like kf but are not connected to it in the
+// covisibility graph. minScore is the lowest similarity accepted, which loop closing sets to the
+// lowest similarity between kf and its covisible keyframes.
+func (db *KeyFrameDatabase) DetectLoopCandidates(kf *KeyFrame, minScore float64) []*KeyFrame {
+	exclude := map[*KeyFrame]bool{kf: true}
+	for _, c := range kf.ConnectedKeyFrames() {
+		exclude[c] = true
+	}
+	bv := kf.BowVector()
+	common := db.commonWords(bv, exclude)
+	if len(common) == 0 {
+		return nil
+	}
+	return db.candidates(bv, common, minScore)
+}
+
+// DetectRelocalizationCandidates returns keyframes which look like the frame, whose bag of words
+// must have been computed. Unlike loop detection every keyframe is considered, with no minimum
+// score, as the tracker has no idea where it is.
+func (db *KeyFrameDatabase) DetectRelocalizationCandidates(f *Frame) []*KeyFrame {
+	common := db.commonWords(f.BowVector, nil)
+	if len(common) == 0 {
+		return nil
+	}
+	return db.candidates(f.BowVector, common, 0)
+}
+
+func sortedKeyFrameScores(scores map[*KeyFrame]float64) []*KeyFrame {
+	kfs := make([]*KeyFrame, 0, len(scores))
+	for kf := range scores {
+		kfs = append(kfs, kf)
+	}
+	sort.Slice(kfs, func(i, j int) bool { return kfs[i].ID < kfs[j].ID })
+	return kfs
+}
@@ -0,0 +1,90 @@
+package world
+
+import (
+	"testing"
+
+	"github.com/kegsay/gorbslam/internal/bow"
+)
+
+// Give the keyframe a normalised bag of words with equal weights for the words
+func setWords(kf *KeyFrame, words ...int) {
+	var bv bow.BowVector
+	for _, w := range words {
+		bv.AddWeight(bow.WordID(w), 1)
+	}
+	bv.Normalise()
+	kf.bowVector = bv
+	kf.hasBoW = true
+}
+
+func TestDetectLoopCandidates(t *testing.T) {
+	// 0 and 1 are connected, as are 3 and 4. 2 and 5 are on their own.
+	s := newTestScene(160, [][]int{
+		pointRange(0, 30),
+		pointRange(0, 30),
+		pointRange(30, 60),
+		pointRange(60, 100),
+		pointRange(60, 100),
+		pointRange(100, 130),
+	})
+	kfs := s.keyFrames
+	setWords(kfs[0], pointRange(1, 21)...)
+	setWords(kfs[1], pointRange(1, 21)...)
+	setWords(kfs[2], pointRange(100, 120)...)
+	// scores 0.9, 0.75 and 0.8 against keyframe 0
+	setWords(kfs[3], append(pointRange(1, 19), 50, 51)...)
+	setWords(kfs[4], append(pointRange(1, 16), pointRange(60, 65)...)...)
+	setWords(kfs[5], append(pointRange(1, 17), pointRange(70, 74)...)...)
+	db := NewKeyFrameDatabase()
+	for _, kf := range kfs {
+		db.Add(kf)
+	}
+
+	// 1 is connected and 2 shares no words. 5 scores better than 4 alone but its neighbourhood is
+	// weaker than the one formed by 3 and 4, whose best keyframe is 3.
+	assertKeyFrames(t, "all", db.DetectLoopCandidates(kfs[0], 0), kfs[3])
+	assertKeyFrames(t, "min score", db.DetectLoopCandidates(kfs[0], 0.85), kfs[3])
+	assertKeyFrames(t, "too high", db.DetectLoopCandidates(kfs[0], 0.95))
+
+	db.Erase(kfs[3])
+	// without 3 neither neighbourhood stands out
+	assertKeyFrames(t, "erased", db.DetectLoopCandidates(kfs[0], 0), kfs[4], kfs[5])
+
+	kfs[5].SetBad()
+	assertKeyFrames(t, "bad", db.DetectLoopCandidates(kfs[0], 0), kfs[4])
+
+	db.Clear()
+	assertKeyFrames(t, "cleared", db.DetectLoopCandidates(kfs[0], 0))
+}
+
+func TestDetectRelocalizationCandidates(t *testing.T) {
+	s := newTestScene(160, [][]int{
+		pointRange(0, 30),
+		pointRange(0, 30),
+		pointRange(30, 60),
+		pointRange(60, 100),
+		pointRange(60, 100),
+	})
+	kfs := s.keyFrames
+	setWords(kfs[0], pointRange(1, 21)...)
+	setWords(kfs[1], pointRange(1, 21)...)
+	setWords(kfs[2], pointRange(100, 120)...)
+	setWords(kfs[3], append(pointRange(1, 19), 50, 51)...)
+	setWords(kfs[4], append(pointRange(1, 16), pointRange(60, 65)...)...)
+	db := NewKeyFrameDatabase()
+	for _, kf := range kfs {
+		db.Add(kf)
+	}
+
+	// a frame seeing what 0 and 1 saw. 4 shares too few words to be scored, so 3 is on its own.
+	var f Frame
+	for _, w := range pointRange(1, 21) {
+		f.BowVector.AddWeight(bow.WordID(w), 1)
+	}
+	f.BowVector.Normalise()
+	assertKeyFrames(t, "relocalisation", db.DetectRelocalizationCandidates(&f), kfs[0], kfs[1])
+
+	var lost Frame
+	lost.BowVector.AddWeight(200, 1)
+	assertKeyFrames(t, "no common words", db.DetectRelocalizationCandidates(&lost))
+}
@@ -0,0 +1,266 @@
+// Package world is the map built by SLAM: keyframes, the map points they observe and the graphs
+// linking them. It is shared by the tracking, local mapping and loop closing goroutines, so every
+// type which can change after creation is safe for concurrent use.
+package world
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/kegsay/gorbslam/internal/bow"
+	"github.com/kegsay/gorbslam/internal/camera"
+	"github.com/kegsay/gorbslam/internal/feature"
+	"github.com/kegsay/gorbslam/internal/geom"
+	"github.com/kegsay/gorbslam/internal/imu"
+)
+
+// Keypoints are bucketed into a grid so we can quickly find those near a predicted position.
+const (
+	gridCols = 64
+	gridRows = 48
+)
+
+// Descriptors are grouped by their vocabulary node this many levels above the words
+const bowLevelsUp = 4
+
+var nextFrameID int64
+
+// Features are the undistorted keypoints and descriptors extracted from an image, along with the
+// camera which took it. They are shared by a frame and any keyframe created from it, and are never
+// modified after creation.
+type Features struct {
+	Camera      camera.Pinhole
+	Pyramid     *feature.ScalePyramid
+	KeyPoints   []feature.KeyPoint
+	Descriptors []feature.Descriptor
+	// The bounds of the undistorted image
+	MinX float64
+	MaxX float64
+	MinY float64
+	MaxY float64
+	// For a stereo (or RGB-D) camera, the x coordinate of each keypoint in the right image and its
+	// depth, both negative if unknown. Nil for a monocular camera. Set with SetStereo.
+	URight []float64
+	Depth  []float64
+	// The stereo baseline times fx, and the depth below which points are close enough for their
+	// depth to be trusted
+	Bf      float64
+	ThDepth float64
+
+	grid       [gridCols][gridRows][]int
+	cellWidth  float64
+	cellHeight float64
+}
+
+// NewFeatures creates the features for a width x height image, assigning keypoints to the grid.
+func NewFeatures(cam camera.Pinhole, pyramid *feature.ScalePyramid, keyPoints []feature.KeyPoint, descriptors []feature.Descriptor, width, height int) *Features {
+	return NewFeaturesInBounds(cam, pyramid, keyPoints, descriptors, 0, float64(width), 0, float64(height))
+}
+
+// NewFeaturesInBounds creates the features for an image whose undistorted keypoints lie within
+// the given bounds, from Pinhole.UndistortedBounds.
+func NewFeaturesInBounds(cam camera.Pinhole, pyramid *feature.ScalePyramid, keyPoints []feature.KeyPoint, descriptors []feature.Descriptor, minX, maxX, minY, maxY float64) *Features {
+	f := &Features{
+		Camera:      cam,
+		Pyramid:     pyramid,
+		KeyPoints:   keyPoints,
+		Descriptors: descriptors,
+		MinX:        minX,
+		MaxX:        maxX,
+		MinY:        minY,
+		MaxY:        maxY,
+	}
+	f.cellWidth = (f.MaxX - f.MinX) / gridCols
+	f.cellHeight = (f.MaxY - f.MinY) / gridRows
+	for i, kp := range keyPoints {
+		if col, row, ok := f.cell(kp.X, kp.Y); ok {
+			f.grid[col][row] = append(f.grid[col][row], i)
+		}
+	}
+	return f
+}
+
+func (f *Features) cell(x, y float64) (int, int, bool) {
+	col := int(math.Floor((x - f.MinX) / f.cellWidth))
+	row := int(math.Floor((y - f.MinY) / f.cellHeight))
+	if col < 0 || col >= gridCols || row < 0 || row >= gridRows {
+		return 0, 0, false
+	}
+	return col, row, true
+}
+
+// SetStereo adds the right image coordinate and depth of each keypoint, for a stereo camera with
+// the baseline bf/fx. Must be called before the features are used.
+func (f *Features) SetStereo(uRight, depth []float64, bf, thDepth float64) {
+	f.URight, f.Depth, f.Bf, f.ThDepth = uRight, depth, bf, thDepth
+}
+
+// SetRGBD adds the depth of each keypoint measured by an RGB-D camera, with unknown depths
+// non-positive. As in ORB-SLAM2 the keypoints are then treated as those of a stereo camera with the
+// baseline bf/fx, whose right image coordinates are computed from the depths. depth is kept, with
+// unknown depths set to -1.
+func (f *Features) SetRGBD(depth []float64, bf, thDepth float64) {
+	uRight := make([]float64, len(depth))
+	for i, z := range depth {
+		if z > 0 {
+			uRight[i] = f.KeyPoints[i].X - bf/z
+		} else {
+			uRight[i], depth[i] = -1, -1
+		}
+	}
+	f.SetStereo(uRight, depth, bf, thDepth)
+}
+
+// IsStereo returns true if the keypoints have a depth
+func (f *Features) IsStereo() bool {
+	return f.Depth != nil
+}
+
+// RightX returns the x coordinate of keypoint i in the right image, negative if it has none or the
+// camera is monocular
+func (f *Features) RightX(i int) float64 {
+	if f.URight == nil {
+		return -1
+	}
+	return f.URight[i]
+}
+
+// UnprojectStereo returns the position of keypoint i in camera coordinates, false if it has no
+// depth
+func (f *Features) UnprojectStereo(i int) (geom.Vec3, bool) {
+	if f.Depth == nil || f.Depth[i] <= 0 {
+		return geom.Vec3{}, false
+	}
+	kp := &f.KeyPoints[i]
+	return f.Camera.Unproject(kp.X, kp.Y).Scale(f.Depth[i]), true
+}
+
+// IsInImage returns true if the pixel lies within the image bounds
+func (f *Features) IsInImage(u, v float64) bool {
+	return u >= f.MinX && u < f.MaxX && v >= f.MinY && v < f.MaxY
+}
+
+// FeaturesInArea returns the indexes of the keypoints within r pixels (in each axis) of (x, y)
+// which were detected on a pyramid level in [minLevel, maxLevel]. A negative level means no limit.
+func (f *Features) FeaturesInArea(x, y, r float64, minLevel, maxLevel int) []int {
+	minCol := int(math.Max(0, math.Floor((x-f.MinX-r)/f.cellWidth)))
+	maxCol := int(math.Min(gridCols-1, math.Ceil((x-f.MinX+r)/f.cellWidth)))
+	minRow := int(math.Max(0, math.Floor((y-f.MinY-r)/f.cellHeight)))
+	maxRow := int(math.Min(gridRows-1, math.Ceil((y-f.MinY+r)/f.cellHeight)))
+	if minCol >= gridCols || maxCol < 0 || minRow >= gridRows || maxRow < 0 {
+		return nil
+	}
+	var indexes []int
+	for col := minCol; col <= maxCol; col++ {
+		for row := minRow; row <= maxRow; row++ {
+			for _, i := range f.grid[col][row] {
+				kp := &f.KeyPoints[i]
+				if minLevel >= 0 && kp.Octave < minLevel {
+					continue
+				}
+				if maxLevel >= 0 && kp.Octave > maxLevel {
+					continue
+				}
+				if math.Abs(kp.X-x) < r && math.Abs(kp.Y-y) < r {
+					indexes = append(indexes, i)
+				}
+			}
+		}
+	}
+	return indexes
+}
+
+// Frame is a single image being tracked. Frames are only used by the tracking goroutine so are not
+// safe for concurrent use.
+type Frame struct {
+	*Features
+	ID        int64
+	Timestamp time.Time
+	// The camera pose Tcw, only valid if HasPose is set
+	Pose    geom.SE3
+	HasPose bool
+	// The map point matched to each keypoint, nil if none
+	MapPoints []*MapPoint
+	// Set by pose optimisation for matches which don't agree with the pose
+	Outliers []bool
+	// The keyframe which shares the most map points with this frame
+	ReferenceKeyFrame *KeyFrame
+	// The IMU measurements since the previous frame, if there is an IMU
+	IMU []imu.Measurement
+	// Set by ComputeBoW
+	BowVector     bow.BowVector
+	FeatureVector bow.FeatureVector
+	hasBoW        bool
+}
+
+// NewFrame creates a frame for the given features
+func NewFrame(features *Features, timestamp time.Time) *Frame {
+	return &Frame{
+		Features:  features,
+		ID:        atomic.AddInt64(&nextFrameID, 1) - 1,
+		Timestamp: timestamp,
+		MapPoints: make([]*MapPoint, len(features.KeyPoints)),
+		Outliers:  make([]bool, len(features.KeyPoints)),
+	}
+}
+
+// ComputeBoW converts the descriptors into a bag of words, if not already done
+func (f *Frame) ComputeBoW(voc *bow.Vocabulary) {
+	if f.hasBoW {
+		return
+	}
+	f.BowVector, f.FeatureVector = voc.Transform(f.Descriptors, bowLevelsUp)
+	f.hasBoW = true
+}
+
+// SetPose sets the camera pose Tcw
+func (f *Frame) SetPose(tcw geom.SE3) {
+	f.Pose = tcw
+	f.HasPose = true
+}
+
+// CameraCenter returns the camera position in world coordinates
+func (f *Frame) CameraCenter() geom.Vec3 {
+	return f.Pose.Center()
+}
+
+// Projection is where a map point is expected to appear in a frame.
+type Projection struct {
+	U float64
+	V float64
+	// The pyramid level the point is expected to be detected on
+	Level int
+	// The cosine of the angle between the viewing ray and the mean viewing direction of the point
+	ViewCos float64
+}
+
+// IsInFrustum returns where the map point projects into the frame, if it is in front of the
+// camera, inside the image, within its scale invariance distances and seen from a direction within
+// acos(viewingCosLimit) of its mean viewing direction.
+func (f *Frame) IsInFrustum(mp *MapPoint, viewingCosLimit float64) (Projection, bool) {
+	pw := mp.Position()
+	pc := f.Pose.Transform(pw)
+	if pc[2] <= 0 {
+		return Projection{}, false
+	}
+	u, v := f.Camera.Project(pc)
+	if !f.IsInImage(u, v) {
+		return Projection{}, false
+	}
+	po := pw.Sub(f.CameraCenter())
+	dist := po.Norm()
+	if dist < mp.MinDistanceInvariance() || dist > mp.MaxDistanceInvariance() {
+		return Projection{}, false
+	}
+	viewCos := po.Dot(mp.Normal()) / dist
+	if viewCos < viewingCosLimit {
+		return Projection{}, false
+	}
+	return Projection{
+		U:       u,
+		V:       v,
+		Level:   mp.PredictScale(dist, f.Pyramid),
+		ViewCos: viewCos,
+	}, true
+}
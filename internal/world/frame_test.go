@@ -0,0 +1,141 @@
+package world
+
+import (
+	"math"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/kegsay/gorbslam/internal/feature"
+	"github.com/kegsay/gorbslam/internal/geom"
+)
+
+func TestFeaturesInArea(t *testing.T) {
+	keyPoints := []feature.KeyPoint{
+		{X: 100, Y: 100, Octave: 0},
+		{X: 104, Y: 97, Octave: 1},
+		{X: 109, Y: 100, Octave: 2},
+		{X: 100, Y: 115, Octave: 0},
+		{X: 639, Y: 479, Octave: 0},
+		// outside the image, so never found
+		{X: -5, Y: 100, Octave: 0},
+	}
+	f := NewFeatures(testCamera, testPyramid, keyPoints, make([]feature.Descriptor, len(keyPoints)), 640, 480)
+	testCases := []struct {
+		x, y, r            float64
+		minLevel, maxLevel int
+		want               []int
+	}{
+		{x: 100, y: 100, r: 10, minLevel: -1, maxLevel: -1, want: []int{0, 1, 2}},
+		{x: 100, y: 100, r: 5, minLevel: -1, maxLevel: -1, want: []int{0, 1}},
+		{x: 100, y: 100, r: 20, minLevel: -1, maxLevel: -1, want: []int{0, 1, 2, 3}},
+		{x: 100, y: 100, r: 10, minLevel: 1, maxLevel: -1, want: []int{1, 2}},
+		{x: 100, y: 100, r: 10, minLevel: -1, maxLevel: 1, want: []int{0, 1}},
+		{x: 100, y: 100, r: 10, minLevel: 1, maxLevel: 1, want: []int{1}},
+		{x: 640, y: 480, r: 3, minLevel: -1, maxLevel: -1, want: []int{4}},
+		{x: 0, y: 100, r: 3, minLevel: -1, maxLevel: -1, want: nil},
+		{x: 300, y: 300, r: 10, minLevel: -1, maxLevel: -1, want: nil},
+	}
+	for _, tc := range testCases {
+		got := f.FeaturesInArea(tc.x, tc.y, tc.r, tc.minLevel, tc.maxLevel)
+		sort.Ints(got)
+		if len(got) != len(tc.want) {
+			t.Errorf("FeaturesInArea(%v, %v, %v, %d, %d): got %v want %v", tc.x, tc.y, tc.r, tc.minLevel, tc.maxLevel, got, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("FeaturesInArea(%v, %v, %v, %d, %d): got %v want %v", tc.x, tc.y, tc.r, tc.minLevel, tc.maxLevel, got, tc.want)
+				break
+			}
+		}
+	}
+}
+
+func TestFeaturesInBounds(t *testing.T) {
+	// undistortion pushed a keypoint off the left of the image
+	keyPoints := []feature.KeyPoint{{X: -5, Y: 100}, {X: 630, Y: 100}}
+	f := NewFeaturesInBounds(testCamera, testPyramid, keyPoints, make([]feature.Descriptor, len(keyPoints)), -20, 660, -15, 495)
+	if got := f.FeaturesInArea(-4, 101, 3, -1, -1); len(got) != 1 || got[0] != 0 {
+		t.Errorf("got %v want the keypoint outside the image", got)
+	}
+	if !f.IsInImage(-10, 490) || f.IsInImage(-21, 100) {
+		t.Errorf("IsInImage does not use the bounds")
+	}
+}
+
+func TestIsInFrustum(t *testing.T) {
+	// a point 5 in front of keyframes at x = 0, 1 and 2
+	s := newTestScene(1, [][]int{{0}, {0}, {0}})
+	mp := s.points[0]
+	mp.SetPosition(geom.Vec3{0.5, 0, 5})
+	mp.UpdateNormalAndDepth()
+	f := NewFrame(s.keyFrames[0].Features, time.Time{})
+
+	testCases := []struct {
+		name   string
+		center geom.Vec3
+		r      geom.Mat3
+		want   bool
+	}{
+		{name: "in view", center: geom.Vec3{0.5, 0, -0.1}, r: geom.Identity3(), want: true},
+		{name: "behind", center: geom.Vec3{0.5, 0, 10}, r: geom.Identity3(), want: false},
+		{name: "outside the image", center: geom.Vec3{5, 0, 0}, r: geom.Identity3(), want: false},
+		{name: "too far", center: geom.Vec3{0.5, 0, -10}, r: geom.Identity3(), want: false},
+		{name: "too close", center: geom.Vec3{0.5, 0, 4.9}, r: geom.Identity3(), want: false},
+		// looking at the point from the side
+		{name: "viewing angle", center: geom.Vec3{5.5, 0, 5}, r: geom.ExpSO3(geom.Vec3{0, math.Pi / 2, 0}).Matrix(), want: false},
+	}
+	for _, tc := range testCases {
+		// Tcw = [R | -R c]
+		f.SetPose(geom.NewSE3(tc.r, tc.r.MulVec(tc.center).Scale(-1)))
+		proj, ok := f.IsInFrustum(mp, 0.5)
+		if ok != tc.want {
+			t.Errorf("%s: got %v want %v", tc.name, ok, tc.want)
+		}
+		if ok && (math.Abs(proj.U-320) > 1e-9 || math.Abs(proj.V-240) > 1e-9 || proj.Level != 0) {
+			t.Errorf("%s: got projection %+v", tc.name, proj)
+		}
+	}
+}
+
+func TestUnprojectStereo(t *testing.T) {
+	s := newTestScene(2, [][]int{{0, 1}, {0, 1}})
+	kf := s.keyFrames[0]
+	if kf.IsStereo() || s.points[0].NumObservations() != 2 {
+		t.Fatalf("monocular keyframe is stereo")
+	}
+	want := kf.Pose().Transform(s.points[0].Position())
+	kf.SetStereo([]float64{kf.KeyPoints[0].X - 40/want[2], -1}, []float64{want[2], -1}, 40, 3)
+	if got, ok := kf.UnprojectStereo(0); !ok || got.Sub(want).Norm() > 1e-9 {
+		t.Errorf("got %v want %v", got, want)
+	}
+	if _, ok := kf.UnprojectStereo(1); ok {
+		t.Errorf("unprojected a keypoint without a depth")
+	}
+	// a stereo observation counts twice
+	if n := s.points[0].NumObservations(); n != 3 {
+		t.Errorf("got %d observations want 3", n)
+	}
+	if n := s.points[1].NumObservations(); n != 2 {
+		t.Errorf("got %d observations of the point without a depth want 2", n)
+	}
+}
+
+func TestSetRGBD(t *testing.T) {
+	keyPoints := []feature.KeyPoint{{X: 100, Y: 50}, {X: 200, Y: 60}}
+	f := NewFeatures(testCamera, testPyramid, keyPoints, make([]feature.Descriptor, len(keyPoints)), 640, 480)
+	if f.RightX(0) >= 0 {
+		t.Errorf("got right x %v for a monocular camera", f.RightX(0))
+	}
+	f.SetRGBD([]float64{2, 0}, 40, 3)
+	if f.RightX(0) != 80 || f.RightX(1) >= 0 {
+		t.Errorf("got right x %v and %v", f.RightX(0), f.RightX(1))
+	}
+	if !f.IsStereo() || f.URight[0] != 80 || f.URight[1] != -1 || f.Depth[1] != -1 {
+		t.Errorf("got right x %v depth %v", f.URight, f.Depth)
+	}
+	if p, ok := f.UnprojectStereo(0); !ok || p[2] != 2 {
+		t.Errorf("got point %v", p)
+	}
+}
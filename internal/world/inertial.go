@@ -0,0 +1,157 @@
+package world
+
+import (
+	"github.com/kegsay/gorbslam/internal/geom"
+	"github.com/kegsay/gorbslam/internal/imu"
+)
+
+// SetIMU links the keyframe to prev, the keyframe before it in time, with the IMU motion p between
+// them. prev and p are nil for the first keyframe of a map.
+func (k *KeyFrame) SetIMU(prev *KeyFrame, p *imu.Preintegrated) {
+	k.mu.Lock()
+	k.prevKF = prev
+	k.preintegrated = p
+	if p != nil {
+		k.bias = p.Bias
+	}
+	k.mu.Unlock()
+	if prev != nil {
+		prev.mu.Lock()
+		prev.nextKF = k
+		prev.mu.Unlock()
+	}
+}
+
+// PrevKeyFrame returns the keyframe before this one in time, nil if there is none or there is no
+// IMU
+func (k *KeyFrame) PrevKeyFrame() *KeyFrame {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.prevKF
+}
+
+// NextKeyFrame returns the keyframe after this one in time, as PrevKeyFrame
+func (k *KeyFrame) NextKeyFrame() *KeyFrame {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.nextKF
+}
+
+// Preintegrated returns the IMU motion from the previous keyframe, nil if there is none. It must
+// not be modified: it is replaced rather than changed when the bias is updated.
+func (k *KeyFrame) Preintegrated() *imu.Preintegrated {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.preintegrated
+}
+
+// Velocity returns the velocity of the IMU in world coordinates
+func (k *KeyFrame) Velocity() geom.Vec3 {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.velocity
+}
+
+// SetVelocity sets the velocity of the IMU in world coordinates
+func (k *KeyFrame) SetVelocity(v geom.Vec3) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.velocity = v
+}
+
+// Bias returns the estimated bias of the IMU at the keyframe
+func (k *KeyFrame) Bias() imu.Bias {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.bias
+}
+
+// SetBias sets the estimated bias of the IMU, integrating the measurements from the previous
+// keyframe again with it.
+func (k *KeyFrame) SetBias(b imu.Bias) {
+	k.mu.Lock()
+	p := k.preintegrated
+	k.bias = b
+	k.mu.Unlock()
+	if p == nil {
+		return
+	}
+	p = p.Clone()
+	p.Reintegrate(b)
+	k.mu.Lock()
+	k.preintegrated = p
+	k.mu.Unlock()
+}
+
+// unlinkIMU removes the keyframe from the chain of keyframes in time. The IMU motion to the
+// keyframe is prepended to that of the next keyframe, so the next keyframe follows on from the
+// previous one.
+func (k *KeyFrame) unlinkIMU() {
+	k.mu.Lock()
+	prev, next, p := k.prevKF, k.nextKF, k.preintegrated
+	k.prevKF, k.nextKF = nil, nil
+	k.mu.Unlock()
+	if next != nil {
+		next.mu.Lock()
+		if p != nil && next.preintegrated != nil {
+			merged := next.preintegrated.Clone()
+			merged.MergePrevious(p)
+			next.preintegrated = merged
+		} else {
+			next.preintegrated = nil
+		}
+		next.prevKF = prev
+		next.mu.Unlock()
+	}
+	if prev != nil {
+		prev.mu.Lock()
+		prev.nextKF = next
+		prev.mu.Unlock()
+	}
+}
+
+// Transform moves every keyframe and map point by the similarity s, so that a point x in the map
+// moves to s * x. Velocities are rotated and scaled with the map. pending are keyframes which will
+// be added to the map but aren't yet, such as those queued for local mapping, and are moved too.
+// Must be called with the update lock held, and local mapping stopped or calling.
+func (m *Map) Transform(s geom.Sim3, pending ...*KeyFrame) {
+	// Siw' = Siw * S^-1, with the scale absorbed into the translation
+	sInv := s.Inverse()
+	for _, kf := range append(m.KeyFrames(), pending...) {
+		kf.mu.Lock()
+		kf.pose = kf.pose.Sim3().Mul(sInv).SE3()
+		kf.velocity = s.R.Rotate(kf.velocity).Scale(s.S)
+		kf.mu.Unlock()
+	}
+	for _, mp := range m.MapPoints() {
+		mp.SetPosition(s.Transform(mp.Position()))
+		// the viewing distances scale with the map
+		mp.UpdateNormalAndDepth()
+	}
+	m.mu.Lock()
+	m.scale *= s.S
+	m.mu.Unlock()
+}
+
+// Scale returns the product of the scales the map has been transformed by. The tracker uses it
+// to rescale its motion model when the map is scaled underneath it.
+func (m *Map) Scale() float64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.scale
+}
+
+// IsIMUInitialized returns true once the map is aligned with gravity, has the true scale and the
+// IMU biases have been estimated
+func (m *Map) IsIMUInitialized() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.imuInitialized
+}
+
+// SetIMUInitialized records that the IMU has been initialised
+func (m *Map) SetIMUInitialized() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.imuInitialized = true
+}
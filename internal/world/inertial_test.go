@@ -0,0 +1,80 @@
+package world
+
+import (
+	"math"
+	"testing"
+
+	"github.com/kegsay/gorbslam/internal/geom"
+	"github.com/kegsay/gorbslam/internal/imu"
+)
+
+func TestKeyFrameIMU(t *testing.T) {
+	s := newTestScene(30, [][]int{pointRange(0, 30), pointRange(0, 30), pointRange(0, 30)})
+	kfs := s.keyFrames
+	calib := imu.NewCalibration(geom.IdentitySE3(), 1.7e-4, 2e-3, 1.9e-5, 3e-3, 200)
+	preintegrated := func(seconds float64) *imu.Preintegrated {
+		p := imu.NewPreintegrated(imu.Bias{}, calib)
+		for i := 0; i < int(seconds*200); i++ {
+			p.IntegrateNewMeasurement(geom.Vec3{0.1, 0, 9.81}, geom.Vec3{0, 0.2, 0}, 0.005)
+		}
+		return p
+	}
+	kfs[0].SetIMU(nil, nil)
+	kfs[1].SetIMU(kfs[0], preintegrated(0.5))
+	kfs[2].SetIMU(kfs[1], preintegrated(0.25))
+	if kfs[0].NextKeyFrame() != kfs[1] || kfs[2].PrevKeyFrame() != kfs[1] {
+		t.Fatalf("keyframes are not linked in time")
+	}
+
+	// a new bias gives a new preintegration, integrated again
+	before := kfs[2].Preintegrated()
+	b := imu.Bias{Gyro: geom.Vec3{0.01, 0, 0}}
+	kfs[2].SetBias(b)
+	if kfs[2].Bias() != b || kfs[2].Preintegrated().Bias != b || before.Bias != (imu.Bias{}) {
+		t.Errorf("bias was not updated")
+	}
+
+	// removing the middle keyframe joins its neighbours
+	kfs[1].SetBad()
+	if kfs[0].NextKeyFrame() != kfs[2] || kfs[2].PrevKeyFrame() != kfs[0] {
+		t.Errorf("neighbours of the removed keyframe are not linked")
+	}
+	if dt := kfs[2].Preintegrated().DeltaT; math.Abs(dt-0.75) > 1e-9 {
+		t.Errorf("merged preintegration covers %vs", dt)
+	}
+	if kfs[2].Preintegrated().Bias != b {
+		t.Errorf("merged preintegration lost its bias")
+	}
+}
+
+func TestMapTransform(t *testing.T) {
+	s := newTestScene(30, [][]int{pointRange(0, 30), pointRange(0, 30)})
+	kf := s.keyFrames[1]
+	kf.SetVelocity(geom.Vec3{1, 0, 0})
+	centre, position := kf.CameraCenter(), s.points[0].Position()
+	sim := geom.NewSim3(geom.ExpSO3(geom.Vec3{0, 0, math.Pi / 2}).Matrix(), geom.Vec3{}, 3)
+	s.m.Transform(sim)
+	s.m.Transform(geom.NewSim3(geom.Identity3(), geom.Vec3{}, 0.5))
+
+	want := sim.Transform(centre).Scale(0.5)
+	if d := kf.CameraCenter().Sub(want).Norm(); d > 1e-9 {
+		t.Errorf("keyframe moved %v from where it should be", d)
+	}
+	if d := s.points[0].Position().Sub(sim.Transform(position).Scale(0.5)).Norm(); d > 1e-9 {
+		t.Errorf("point moved %v from where it should be", d)
+	}
+	if d := kf.Velocity().Sub(geom.Vec3{0, 1.5, 0}).Norm(); d > 1e-9 {
+		t.Errorf("velocity is %v", kf.Velocity())
+	}
+	if s.m.Scale() != 1.5 {
+		t.Errorf("map scale is %v", s.m.Scale())
+	}
+	s.m.SetIMUInitialized()
+	if !s.m.IsIMUInitialized() {
+		t.Errorf("IMU is not initialised")
+	}
+	s.m.Clear()
+	if s.m.Scale() != 1 || s.m.IsIMUInitialized() {
+		t.Errorf("cleared map has scale %v and IMU initialised %v", s.m.Scale(), s.m.IsIMUInitialized())
+	}
+}
@@ -0,0 +1,559 @@
+package world
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kegsay/gorbslam/internal/bow"
+	"github.com/kegsay/gorbslam/internal/geom"
+	"github.com/kegsay/gorbslam/internal/imu"
+)
+
+// The minimum number of shared map points for two keyframes to be connected in the covisibility
+// graph. If no keyframe shares this many, the one sharing the most is connected anyway.
+const covisibilityThreshold = 15
+
+var nextKeyFrameID int64
+
+// KeyFrame is a frame which has been added to the map. Keyframes are the vertices of the
+// covisibility graph, which connects keyframes that observe the same map points weighted by how many
+// they share, and of the spanning tree, a subset of the covisibility graph which connects every
+// keyframe with the fewest, strongest edges.
+// Learning: https://youtu.be/ufvPS5wJAx0?t=1004
+type KeyFrame struct {
+	*Features
+	ID int64
+	// The frame the keyframe was created from
+	FrameID   int64
+	Timestamp time.Time
+
+	m  *Map
+	mu sync.RWMutex
+	// Tcw
+	pose geom.SE3
+	// the map point observed by each keypoint, nil if none
+	mapPoints     []*MapPoint
+	bowVector     bow.BowVector
+	featureVector bow.FeatureVector
+	hasBoW        bool
+
+	// covisibility graph
+	connections     map[*KeyFrame]int
+	ordered         []*KeyFrame
+	orderedWeights  []int
+	firstConnection bool
+
+	// spanning tree
+	parent   *KeyFrame
+	children map[*KeyFrame]bool
+	// the pose relative to the parent, set when the keyframe is removed
+	tcp geom.SE3
+
+	loopEdges map[*KeyFrame]bool
+
+	// visual-inertial state: the keyframes before and after in time, the IMU motion from the one
+	// before, and the velocity and bias estimated by local mapping
+	prevKF, nextKF *KeyFrame
+	preintegrated  *imu.Preintegrated
+	velocity       geom.Vec3
+	bias           imu.Bias
+
+	// keyframes in use by loop closing can't be removed, so removal is deferred until allowed
+	notErase   bool
+	toBeErased bool
+	bad        bool
+}
+
+// NewKeyFrame creates a keyframe from the frame, observing the same map points. The caller is
+// expected to add the keyframe as an observation of the points and to the map.
+func NewKeyFrame(f *Frame, m *Map) *KeyFrame {
+	return &KeyFrame{
+		Features:        f.Features,
+		ID:              atomic.AddInt64(&nextKeyFrameID, 1) - 1,
+		FrameID:         f.ID,
+		Timestamp:       f.Timestamp,
+		m:               m,
+		pose:            f.Pose,
+		mapPoints:       append([]*MapPoint(nil), f.MapPoints...),
+		bowVector:       f.BowVector,
+		featureVector:   f.FeatureVector,
+		hasBoW:          f.hasBoW,
+		connections:     make(map[*KeyFrame]int),
+		firstConnection: true,
+		children:        make(map[*KeyFrame]bool),
+		loopEdges:       make(map[*KeyFrame]bool),
+	}
+}
+
+// Pose returns the camera pose Tcw
+func (k *KeyFrame) Pose() geom.SE3 {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.pose
+}
+
+// SetPose sets the camera pose Tcw
+func (k *KeyFrame) SetPose(tcw geom.SE3) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.pose = tcw
+}
+
+// CameraCenter returns the camera position in world coordinates
+func (k *KeyFrame) CameraCenter() geom.Vec3 {
+	return k.Pose().Center()
+}
+
+// BowVector returns the bag of words representation of the descriptors
+func (k *KeyFrame) BowVector() bow.BowVector {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.bowVector
+}
+
+// FeatureVector returns the descriptor indexes grouped by vocabulary node
+func (k *KeyFrame) FeatureVector() bow.FeatureVector {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.featureVector
+}
+
+// ComputeBoW converts the descriptors into a bag of words, if not already done
+func (k *KeyFrame) ComputeBoW(voc *bow.Vocabulary) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.hasBoW {
+		return
+	}
+	k.bowVector, k.featureVector = voc.Transform(k.Descriptors, bowLevelsUp)
+	k.hasBoW = true
+}
+
+// AddMapPoint records that keypoint idx observes mp
+func (k *KeyFrame) AddMapPoint(mp *MapPoint, idx int) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.mapPoints[idx] = mp
+}
+
+// EraseMapPointMatch removes the map point observed by keypoint idx
+func (k *KeyFrame) EraseMapPointMatch(idx int) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.mapPoints[idx] = nil
+}
+
+// EraseMapPoint removes mp from the keypoint observing it, if any
+func (k *KeyFrame) EraseMapPoint(mp *MapPoint) {
+	if idx, ok := mp.Index(k); ok {
+		k.EraseMapPointMatch(idx)
+	}
+}
+
+// ReplaceMapPointMatch makes keypoint idx observe mp instead
+func (k *KeyFrame) ReplaceMapPointMatch(idx int, mp *MapPoint) {
+	k.AddMapPoint(mp, idx)
+}
+
+// MapPoint returns the map point observed by keypoint idx, or nil
+func (k *KeyFrame) MapPoint(idx int) *MapPoint {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.mapPoints[idx]
+}
+
+// MapPointMatches returns a copy of the map point observed by each keypoint, nil if none
+func (k *KeyFrame) MapPointMatches() []*MapPoint {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return append([]*MapPoint(nil), k.mapPoints...)
+}
+
+// MapPoints returns the good map points observed by the keyframe
+func (k *KeyFrame) MapPoints() []*MapPoint {
+	var points []*MapPoint
+	for _, mp := range k.MapPointMatches() {
+		if mp != nil && !mp.IsBad() {
+			points = append(points, mp)
+		}
+	}
+	return points
+}
+
+// TrackedMapPoints returns the number of good map points observed by the keyframe which are
+// observed by at least minObs keyframes.
+func (k *KeyFrame) TrackedMapPoints(minObs int) int {
+	n := 0
+	for _, mp := range k.MapPoints() {
+		if minObs <= 0 || mp.NumObservations() >= minObs {
+			n++
+		}
+	}
+	return n
+}
+
+// AddConnection connects the keyframe to kf in the covisibility graph, or updates the weight
+func (k *KeyFrame) AddConnection(kf *KeyFrame, weight int) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.connections[kf] = weight
+	k.updateBestCovisibles()
+}
+
+// EraseConnection disconnects kf in the covisibility graph
+func (k *KeyFrame) EraseConnection(kf *KeyFrame) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, ok := k.connections[kf]; !ok {
+		return
+	}
+	delete(k.connections, kf)
+	k.updateBestCovisibles()
+}
+
+// k.mu must be held
+func (k *KeyFrame) updateBestCovisibles() {
+	k.ordered, k.orderedWeights = orderConnections(k.connections)
+}
+
+// orderConnections returns the connections with at least covisibilityThreshold shared points, or
+// failing that the strongest one, by descending weight. Ties are ordered by ID so the order is
+// deterministic.
+func orderConnections(connections map[*KeyFrame]int) ([]*KeyFrame, []int) {
+	ordered := make([]*KeyFrame, 0, len(connections))
+	for kf := range connections {
+		ordered = append(ordered, kf)
+	}
+	sort.Slice(ordered, func(i, j int) bool {
+		wi, wj := connections[ordered[i]], connections[ordered[j]]
+		if wi != wj {
+			return wi > wj
+		}
+		return ordered[i].ID < ordered[j].ID
+	})
+	n := sort.Search(len(ordered), func(i int) bool { return connections[ordered[i]] < covisibilityThreshold })
+	if n == 0 && len(ordered) > 0 {
+		n = 1
+	}
+	ordered = ordered[:n]
+	weights := make([]int, n)
+	for i, kf := range ordered {
+		weights[i] = connections[kf]
+	}
+	return ordered, weights
+}
+
+// UpdateConnections recomputes the covisibility edges of the keyframe from the observations of its
+// map points, updating the keyframes at the other end of each edge too. The first time a keyframe
+// is connected its parent in the spanning tree becomes the keyframe it shares the most points with.
+func (k *KeyFrame) UpdateConnections() {
+	counter := make(map[*KeyFrame]int)
+	for _, mp := range k.MapPoints() {
+		for kf := range mp.Observations() {
+			if kf == k || kf.IsBad() {
+				continue
+			}
+			counter[kf]++
+		}
+	}
+	if len(counter) == 0 {
+		return
+	}
+
+	// only the ordered connections are added to the other keyframes
+	ordered, weights := orderConnections(counter)
+	for i, kf := range ordered {
+		kf.AddConnection(k, weights[i])
+	}
+
+	k.mu.Lock()
+	k.connections = counter
+	k.ordered = ordered
+	k.orderedWeights = weights
+	var parent *KeyFrame
+	if k.firstConnection && !k.isOrigin() {
+		k.parent = ordered[0]
+		k.firstConnection = false
+		parent = k.parent
+	}
+	k.mu.Unlock()
+	if parent != nil {
+		parent.AddChild(k)
+	}
+}
+
+// the first keyframe of the map is the root of the spanning tree
+func (k *KeyFrame) isOrigin() bool {
+	return k.m != nil && k.m.IsOrigin(k)
+}
+
+// ConnectedKeyFrames returns every keyframe connected in the covisibility graph
+func (k *KeyFrame) ConnectedKeyFrames() []*KeyFrame {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	connected := make([]*KeyFrame, 0, len(k.connections))
+	for kf := range k.connections {
+		connected = append(connected, kf)
+	}
+	sort.Slice(connected, func(i, j int) bool { return connected[i].ID < connected[j].ID })
+	return connected
+}
+
+// CovisibleKeyFrames returns the connected keyframes sharing at least 15 points (or the strongest
+// connection if none do), ordered by descending weight
+func (k *KeyFrame) CovisibleKeyFrames() []*KeyFrame {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return append([]*KeyFrame(nil), k.ordered...)
+}
+
+// BestCovisibilityKeyFrames returns up to n connected keyframes with the highest weights
+func (k *KeyFrame) BestCovisibilityKeyFrames(n int) []*KeyFrame {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if n > len(k.ordered) {
+		n = len(k.ordered)
+	}
+	return append([]*KeyFrame(nil), k.ordered[:n]...)
+}
+
+// CovisiblesByWeight returns the connected keyframes with a weight of at least w, ordered by
+// descending weight
+func (k *KeyFrame) CovisiblesByWeight(w int) []*KeyFrame {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	n := sort.Search(len(k.orderedWeights), func(i int) bool { return k.orderedWeights[i] < w })
+	return append([]*KeyFrame(nil), k.ordered[:n]...)
+}
+
+// Weight returns the number of map points shared with kf, 0 if not connected
+func (k *KeyFrame) Weight(kf *KeyFrame) int {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.connections[kf]
+}
+
+// AddChild adds kf as a child in the spanning tree
+func (k *KeyFrame) AddChild(kf *KeyFrame) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.children[kf] = true
+}
+
+// EraseChild removes kf as a child in the spanning tree
+func (k *KeyFrame) EraseChild(kf *KeyFrame) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	delete(k.children, kf)
+}
+
+// ChangeParent makes kf the parent in the spanning tree
+func (k *KeyFrame) ChangeParent(kf *KeyFrame) {
+	k.mu.Lock()
+	k.parent = kf
+	k.mu.Unlock()
+	kf.AddChild(k)
+}
+
+// Children returns the children in the spanning tree, ordered by ID
+func (k *KeyFrame) Children() []*KeyFrame {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	children := make([]*KeyFrame, 0, len(k.children))
+	for kf := range k.children {
+		children = append(children, kf)
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].ID < children[j].ID })
+	return children
+}
+
+// HasChild returns true if kf is a child in the spanning tree
+func (k *KeyFrame) HasChild(kf *KeyFrame) bool {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.children[kf]
+}
+
+// Parent returns the parent in the spanning tree, nil for the root
+func (k *KeyFrame) Parent() *KeyFrame {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.parent
+}
+
+// RelativeToParent returns the pose relative to the parent, Tcp, recorded when the keyframe was
+// removed. It is used to recover the trajectory of frames which referenced a removed keyframe.
+func (k *KeyFrame) RelativeToParent() geom.SE3 {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.tcp
+}
+
+// AddLoopEdge records that a loop was closed between this keyframe and kf. Keyframes with loop
+// edges are never removed.
+func (k *KeyFrame) AddLoopEdge(kf *KeyFrame) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.notErase = true
+	k.loopEdges[kf] = true
+}
+
+// LoopEdges returns the keyframes a loop was closed with, ordered by ID
+func (k *KeyFrame) LoopEdges() []*KeyFrame {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	edges := make([]*KeyFrame, 0, len(k.loopEdges))
+	for kf := range k.loopEdges {
+		edges = append(edges, kf)
+	}
+	sort.Slice(edges, func(i, j int) bool { return edges[i].ID < edges[j].ID })
+	return edges
+}
+
+// SetNotErase stops the keyframe being removed until SetErase is called
+func (k *KeyFrame) SetNotErase() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.notErase = true
+}
+
+// SetErase allows the keyframe to be removed again, removing it now if that was requested while
+// it was protected. Keyframes with loop edges stay protected.
+func (k *KeyFrame) SetErase() {
+	k.mu.Lock()
+	if len(k.loopEdges) == 0 {
+		k.notErase = false
+	}
+	erase := !k.notErase && k.toBeErased
+	k.mu.Unlock()
+	if erase {
+		k.SetBad()
+	}
+}
+
+// SetBad removes the keyframe from the map: it is disconnected from the covisibility graph, stops
+// observing its map points, its children in the spanning tree are given new parents and its IMU
+// motion is merged into the next keyframe's. The first keyframe of the map is never removed.
+func (k *KeyFrame) SetBad() {
+	k.mu.Lock()
+	if k.isOrigin() || k.bad {
+		k.mu.Unlock()
+		return
+	}
+	if k.notErase {
+		k.toBeErased = true
+		k.mu.Unlock()
+		return
+	}
+	// copies, as other threads can add connections and points once the lock is released
+	connections := make([]*KeyFrame, 0, len(k.connections))
+	for kf := range k.connections {
+		connections = append(connections, kf)
+	}
+	mapPoints := append([]*MapPoint(nil), k.mapPoints...)
+	k.mu.Unlock()
+
+	for _, kf := range connections {
+		kf.EraseConnection(k)
+	}
+	for _, mp := range mapPoints {
+		if mp != nil {
+			mp.EraseObservation(k)
+		}
+	}
+
+	k.mu.Lock()
+	k.connections = make(map[*KeyFrame]int)
+	k.ordered = nil
+	k.orderedWeights = nil
+	children := k.children
+	k.children = make(map[*KeyFrame]bool)
+	parent := k.parent
+	k.mu.Unlock()
+
+	// Each child is reassigned to the candidate parent it shares the most points with, starting with
+	// our parent. Reassigned children become candidates for the remaining children.
+	candidates := map[*KeyFrame]bool{parent: true}
+	for len(children) > 0 {
+		var bestChild, bestParent *KeyFrame
+		bestWeight := -1
+		for _, child := range sortedKeyFrames(children) {
+			if child.IsBad() {
+				delete(children, child)
+				continue
+			}
+			covisibles := child.CovisibleKeyFrames()
+			for _, kf := range covisibles {
+				if !candidates[kf] {
+					continue
+				}
+				if w := child.Weight(kf); w > bestWeight {
+					bestChild, bestParent, bestWeight = child, kf, w
+				}
+			}
+		}
+		if bestChild == nil {
+			break
+		}
+		bestChild.ChangeParent(bestParent)
+		candidates[bestChild] = true
+		delete(children, bestChild)
+	}
+	// children which share no points with any candidate are attached to our parent
+	for child := range children {
+		child.ChangeParent(parent)
+	}
+	if parent != nil {
+		parent.EraseChild(k)
+	}
+	k.unlinkIMU()
+
+	k.mu.Lock()
+	if parent != nil {
+		k.tcp = k.pose.Mul(parent.Pose().Inverse())
+	}
+	k.bad = true
+	k.mu.Unlock()
+	if k.m != nil {
+		k.m.EraseKeyFrame(k)
+	}
+}
+
+// IsBad returns true if the keyframe has been removed from the map
+func (k *KeyFrame) IsBad() bool {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.bad
+}
+
+// ComputeSceneMedianDepth returns the depth 1/q of the way through the sorted depths of the map
+// points, so q = 2 is the median.
+func (k *KeyFrame) ComputeSceneMedianDepth(q int) float64 {
+	k.mu.RLock()
+	pose := k.pose
+	mapPoints := append([]*MapPoint(nil), k.mapPoints...)
+	k.mu.RUnlock()
+	var depths []float64
+	for _, mp := range mapPoints {
+		if mp == nil {
+			continue
+		}
+		depths = append(depths, pose.Transform(mp.Position())[2])
+	}
+	if len(depths) == 0 {
+		return 0
+	}
+	sort.Float64s(depths)
+	return depths[(len(depths)-1)/q]
+}
+
+func sortedKeyFrames(set map[*KeyFrame]bool) []*KeyFrame {
+	keyFrames := make([]*KeyFrame, 0, len(set))
+	for kf := range set {
+		keyFrames = append(keyFrames, kf)
+	}
+	sort.Slice(keyFrames, func(i, j int) bool { return keyFrames[i].ID < keyFrames[j].ID })
+	return keyFrames
+}
@@ -0,0 +1,256 @@
+package world
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kegsay/gorbslam/internal/camera"
+	"github.com/kegsay/gorbslam/internal/feature"
+	"github.com/kegsay/gorbslam/internal/geom"
+)
+
+var (
+	testCamera  = camera.Pinhole{Fx: 500, Fy: 500, Cx: 320, Cy: 240}
+	testPyramid = feature.NewScalePyramid(8, 1.2)
+)
+
+type testScene struct {
+	m         *Map
+	keyFrames []*KeyFrame
+	points    []*MapPoint
+}
+
+// A row of keyframes 1 unit apart along the x axis, looking down z. Keyframe i observes the points
+// observed[i], which are spread in front of the cameras. Connections are updated in keyframe order,
+// as local mapping does when inserting them.
+func newTestScene(numPoints int, observed [][]int) *testScene {
+	s := &testScene{m: NewMap()}
+	positions := make([]geom.Vec3, numPoints)
+	for i := range positions {
+		positions[i] = geom.Vec3{float64(i%10)*0.3 - 1.5, float64(i/10%10)*0.2 - 1, 5 + float64(i%7)*0.1}
+	}
+	indexes := make([]map[int]int, len(observed))
+	for k, points := range observed {
+		pose := geom.NewSE3(geom.Identity3(), geom.Vec3{-float64(k), 0, 0})
+		var keyPoints []feature.KeyPoint
+		var descriptors []feature.Descriptor
+		indexes[k] = make(map[int]int)
+		for _, p := range points {
+			u, v := testCamera.Project(pose.Transform(positions[p]))
+			indexes[k][p] = len(keyPoints)
+			keyPoints = append(keyPoints, feature.KeyPoint{X: u, Y: v})
+			var d feature.Descriptor
+			d[0], d[1] = byte(p), byte(p>>8)
+			descriptors = append(descriptors, d)
+		}
+		f := NewFrame(NewFeatures(testCamera, testPyramid, keyPoints, descriptors, 640, 480), time.Time{})
+		f.SetPose(pose)
+		kf := NewKeyFrame(f, s.m)
+		s.m.AddKeyFrame(kf)
+		s.keyFrames = append(s.keyFrames, kf)
+	}
+	for p, pos := range positions {
+		var mp *MapPoint
+		for k := range observed {
+			idx, ok := indexes[k][p]
+			if !ok {
+				continue
+			}
+			if mp == nil {
+				mp = NewMapPoint(pos, s.keyFrames[k], s.m)
+				s.m.AddMapPoint(mp)
+			}
+			s.keyFrames[k].AddMapPoint(mp, idx)
+			mp.AddObservation(s.keyFrames[k], idx)
+		}
+		s.points = append(s.points, mp)
+		if mp != nil {
+			mp.ComputeDistinctiveDescriptors()
+			mp.UpdateNormalAndDepth()
+		}
+	}
+	for _, kf := range s.keyFrames {
+		kf.UpdateConnections()
+	}
+	return s
+}
+
+func pointRange(from, to int) []int {
+	var r []int
+	for i := from; i < to; i++ {
+		r = append(r, i)
+	}
+	return r
+}
+
+func assertKeyFrames(t *testing.T, what string, got []*KeyFrame, want ...*KeyFrame) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Errorf("%s: got %d keyframes want %d", what, len(got), len(want))
+		return
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("%s: element %d is keyframe %d want %d", what, i, got[i].ID, want[i].ID)
+		}
+	}
+}
+
+func TestUpdateConnections(t *testing.T) {
+	// keyframe 0 shares 40 points with 1, 20 with 2 and 5 with 3
+	s := newTestScene(100, [][]int{
+		pointRange(0, 65),
+		pointRange(0, 40),
+		pointRange(40, 60),
+		pointRange(60, 100),
+	})
+	kf0, kf1, kf2, kf3 := s.keyFrames[0], s.keyFrames[1], s.keyFrames[2], s.keyFrames[3]
+	if kf0.Weight(kf1) != 40 || kf0.Weight(kf2) != 20 || kf0.Weight(kf3) != 5 {
+		t.Errorf("weights: got %d %d %d want 40 20 5", kf0.Weight(kf1), kf0.Weight(kf2), kf0.Weight(kf3))
+	}
+	if kf1.Weight(kf0) != 40 {
+		t.Errorf("connections are not symmetric: got %d want 40", kf1.Weight(kf0))
+	}
+	// keyframe 3 shares too few points to be ordered, but is still connected
+	assertKeyFrames(t, "CovisibleKeyFrames", kf0.CovisibleKeyFrames(), kf1, kf2)
+	assertKeyFrames(t, "ConnectedKeyFrames", kf0.ConnectedKeyFrames(), kf1, kf2, kf3)
+	assertKeyFrames(t, "BestCovisibilityKeyFrames", kf0.BestCovisibilityKeyFrames(1), kf1)
+	assertKeyFrames(t, "BestCovisibilityKeyFrames", kf0.BestCovisibilityKeyFrames(10), kf1, kf2)
+	assertKeyFrames(t, "CovisiblesByWeight", kf0.CovisiblesByWeight(30), kf1)
+	assertKeyFrames(t, "CovisiblesByWeight", kf0.CovisiblesByWeight(20), kf1, kf2)
+	// keyframe 3 only shares 5 points with anything, so that connection is kept
+	assertKeyFrames(t, "CovisibleKeyFrames", kf3.CovisibleKeyFrames(), kf0)
+
+	// the spanning tree follows the strongest connection at insertion
+	if kf0.Parent() != nil {
+		t.Errorf("origin has a parent")
+	}
+	for _, kf := range []*KeyFrame{kf1, kf2, kf3} {
+		if kf.Parent() != kf0 {
+			t.Errorf("keyframe %d: wrong parent", kf.ID)
+		}
+	}
+	assertKeyFrames(t, "Children", kf0.Children(), kf1, kf2, kf3)
+
+	// removing points updates the weights once connections are updated
+	for _, mp := range s.points[0:30] {
+		mp.SetBad()
+	}
+	kf0.UpdateConnections()
+	kf1.UpdateConnections()
+	if kf0.Weight(kf1) != 10 || kf1.Weight(kf0) != 10 {
+		t.Errorf("weight after removing points: got %d and %d want 10", kf0.Weight(kf1), kf1.Weight(kf0))
+	}
+	assertKeyFrames(t, "CovisibleKeyFrames", kf0.CovisibleKeyFrames(), kf2)
+	if kf1.Parent() != kf0 {
+		t.Errorf("parent changed after the first connection")
+	}
+}
+
+func TestKeyFrameSetBad(t *testing.T) {
+	// 0 <- 1 <- {2, 3}: keyframe 2 shares points with 0 and keyframe 3 only with 1 and 2
+	s := newTestScene(120, [][]int{
+		pointRange(0, 60),
+		pointRange(0, 100),
+		pointRange(40, 100),
+		pointRange(70, 120),
+	})
+	kf0, kf1, kf2, kf3 := s.keyFrames[0], s.keyFrames[1], s.keyFrames[2], s.keyFrames[3]
+	if kf2.Parent() != kf1 || kf3.Parent() != kf1 {
+		t.Fatalf("unexpected spanning tree")
+	}
+	pose := kf1.Pose()
+
+	kf1.SetBad()
+	if !kf1.IsBad() {
+		t.Fatalf("keyframe was not removed")
+	}
+	if kf2.Parent() != kf0 {
+		t.Errorf("keyframe 2 should be reparented to 0")
+	}
+	if kf3.Parent() != kf2 {
+		t.Errorf("keyframe 3 should be reparented to 2")
+	}
+	assertKeyFrames(t, "Children", kf0.Children(), kf2)
+	assertKeyFrames(t, "Children", kf2.Children(), kf3)
+	if kf0.Weight(kf1) != 0 || kf2.Weight(kf1) != 0 {
+		t.Errorf("removed keyframe is still connected")
+	}
+	if s.m.NumKeyFrames() != 3 {
+		t.Errorf("NumKeyFrames: got %d want 3", s.m.NumKeyFrames())
+	}
+	if s.points[50].IsInKeyFrame(kf1) {
+		t.Errorf("removed keyframe still observes its points")
+	}
+	want := pose.Mul(kf0.Pose().Inverse())
+	if got := kf1.RelativeToParent(); got != want {
+		t.Errorf("RelativeToParent: got %v want %v", got, want)
+	}
+}
+
+func TestKeyFrameSetBadConcurrent(t *testing.T) {
+	s := newTestScene(60, [][]int{
+		pointRange(0, 60),
+		pointRange(0, 60),
+		pointRange(0, 60),
+	})
+	kf1, kf2 := s.keyFrames[1], s.keyFrames[2]
+	// tracking and loop closing can change the keyframe while local mapping removes it
+	started, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		close(started)
+		for i := 0; !kf1.IsBad(); i++ {
+			kf1.AddConnection(kf2, i)
+			kf1.AddMapPoint(s.points[i%60], i%60)
+		}
+	}()
+	<-started
+	kf1.SetBad()
+	<-done
+	if !kf1.IsBad() {
+		t.Errorf("keyframe was not removed")
+	}
+}
+
+func TestKeyFrameSetBadProtected(t *testing.T) {
+	s := newTestScene(60, [][]int{
+		pointRange(0, 60),
+		pointRange(0, 60),
+		pointRange(0, 60),
+	})
+	kf0, kf1, kf2 := s.keyFrames[0], s.keyFrames[1], s.keyFrames[2]
+	kf0.SetBad()
+	if kf0.IsBad() {
+		t.Errorf("origin keyframe was removed")
+	}
+
+	// removal is deferred while loop closing is using the keyframe
+	kf1.SetNotErase()
+	kf1.SetBad()
+	if kf1.IsBad() {
+		t.Fatalf("protected keyframe was removed")
+	}
+	kf1.SetErase()
+	if !kf1.IsBad() {
+		t.Errorf("deferred removal did not happen")
+	}
+
+	// keyframes with loop edges are protected for good
+	kf2.AddLoopEdge(kf0)
+	kf0.AddLoopEdge(kf2)
+	kf2.SetErase()
+	kf2.SetBad()
+	if kf2.IsBad() {
+		t.Errorf("keyframe with a loop edge was removed")
+	}
+	assertKeyFrames(t, "LoopEdges", kf0.LoopEdges(), kf2)
+}
+
+func TestComputeSceneMedianDepth(t *testing.T) {
+	s := newTestScene(10, [][]int{pointRange(0, 10)})
+	// the depths are 5 + (i % 7) / 10: 5.0 5.0 5.1 5.1 5.2 5.2 5.3 5.4 5.5 5.6
+	if got := s.keyFrames[0].ComputeSceneMedianDepth(2); got < 5.2-1e-9 || got > 5.2+1e-9 {
+		t.Errorf("ComputeSceneMedianDepth: got %v want 5.2", got)
+	}
+}
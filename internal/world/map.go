@@ -0,0 +1,174 @@
+package world
+
+import (
+	"sort"
+	"sync"
+)
+
+// Map is the set of keyframes and map points. Keyframes and points have their own locks, and the
+// map never calls into them while holding its own, so the locks can be taken in any order.
+type Map struct {
+	// Update is held while making changes which must appear atomic to the other goroutines, such as
+	// correcting the map after closing a loop. Tracking holds it while using the map so it never
+	// sees a half corrected map.
+	Update sync.Mutex
+
+	mu        sync.RWMutex
+	keyFrames map[*KeyFrame]bool
+	mapPoints map[*MapPoint]bool
+	// the first keyframe of the map, the root of the spanning tree
+	origin *KeyFrame
+	// the local map points, for display
+	referencePoints []*MapPoint
+	maxKeyFrameID   int64
+	// incremented after a loop closure or global bundle adjustment
+	bigChange int
+	// the product of the scales the map has been transformed by, see Transform
+	scale float64
+	// set once the direction of gravity, the scale and the IMU biases have been estimated
+	imuInitialized bool
+}
+
+// NewMap creates an empty map
+func NewMap() *Map {
+	return &Map{
+		keyFrames: make(map[*KeyFrame]bool),
+		mapPoints: make(map[*MapPoint]bool),
+		scale:     1,
+	}
+}
+
+// AddKeyFrame adds a keyframe. The first keyframe added is the origin of the map.
+func (m *Map) AddKeyFrame(kf *KeyFrame) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.origin == nil {
+		m.origin = kf
+	}
+	m.keyFrames[kf] = true
+	if kf.ID > m.maxKeyFrameID {
+		m.maxKeyFrameID = kf.ID
+	}
+}
+
+// AddMapPoint adds a map point
+func (m *Map) AddMapPoint(mp *MapPoint) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.mapPoints[mp] = true
+}
+
+// EraseKeyFrame removes a keyframe. Use KeyFrame.SetBad to remove it from the graphs as well.
+func (m *Map) EraseKeyFrame(kf *KeyFrame) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.keyFrames, kf)
+}
+
+// EraseMapPoint removes a map point. Use MapPoint.SetBad to remove its observations as well.
+func (m *Map) EraseMapPoint(mp *MapPoint) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.mapPoints, mp)
+}
+
+// IsOrigin returns true if kf is the first keyframe of the map
+func (m *Map) IsOrigin(kf *KeyFrame) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.origin == kf
+}
+
+// Origin returns the first keyframe of the map, or nil if the map is empty
+func (m *Map) Origin() *KeyFrame {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.origin
+}
+
+// KeyFrames returns every keyframe, ordered by ID
+func (m *Map) KeyFrames() []*KeyFrame {
+	m.mu.RLock()
+	keyFrames := make([]*KeyFrame, 0, len(m.keyFrames))
+	for kf := range m.keyFrames {
+		keyFrames = append(keyFrames, kf)
+	}
+	m.mu.RUnlock()
+	sort.Slice(keyFrames, func(i, j int) bool { return keyFrames[i].ID < keyFrames[j].ID })
+	return keyFrames
+}
+
+// MapPoints returns every map point, ordered by ID
+func (m *Map) MapPoints() []*MapPoint {
+	m.mu.RLock()
+	points := make([]*MapPoint, 0, len(m.mapPoints))
+	for mp := range m.mapPoints {
+		points = append(points, mp)
+	}
+	m.mu.RUnlock()
+	sort.Slice(points, func(i, j int) bool { return points[i].ID < points[j].ID })
+	return points
+}
+
+// NumKeyFrames returns the number of keyframes
+func (m *Map) NumKeyFrames() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.keyFrames)
+}
+
+// NumMapPoints returns the number of map points
+func (m *Map) NumMapPoints() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.mapPoints)
+}
+
+// MaxKeyFrameID returns the highest keyframe ID added to the map
+func (m *Map) MaxKeyFrameID() int64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.maxKeyFrameID
+}
+
+// SetReferenceMapPoints sets the map points currently being tracked
+func (m *Map) SetReferenceMapPoints(points []*MapPoint) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.referencePoints = append([]*MapPoint(nil), points...)
+}
+
+// ReferenceMapPoints returns the map points currently being tracked
+func (m *Map) ReferenceMapPoints() []*MapPoint {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]*MapPoint(nil), m.referencePoints...)
+}
+
+// InformNewBigChange records that the map has been changed substantially, e.g by closing a loop
+func (m *Map) InformNewBigChange() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bigChange++
+}
+
+// BigChangeIndex returns the number of big changes made to the map, so callers can tell when to
+// refresh anything derived from it
+func (m *Map) BigChangeIndex() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.bigChange
+}
+
+// Clear removes everything from the map
+func (m *Map) Clear() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.keyFrames = make(map[*KeyFrame]bool)
+	m.mapPoints = make(map[*MapPoint]bool)
+	m.origin = nil
+	m.referencePoints = nil
+	m.maxKeyFrameID = 0
+	m.scale = 1
+	m.imuInitialized = false
+}
@@ -0,0 +1,111 @@
+package world
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestMap(t *testing.T) {
+	s := newTestScene(30, [][]int{pointRange(0, 20), pointRange(0, 30), pointRange(10, 30)})
+	if s.m.Origin() != s.keyFrames[0] {
+		t.Errorf("first keyframe is not the origin")
+	}
+	assertKeyFrames(t, "KeyFrames", s.m.KeyFrames(), s.keyFrames...)
+	if s.m.MaxKeyFrameID() != s.keyFrames[2].ID {
+		t.Errorf("MaxKeyFrameID: got %d want %d", s.m.MaxKeyFrameID(), s.keyFrames[2].ID)
+	}
+	points := s.m.MapPoints()
+	if len(points) != 30 || s.m.NumMapPoints() != 30 {
+		t.Fatalf("got %d map points want 30", len(points))
+	}
+	for i := 1; i < len(points); i++ {
+		if points[i].ID <= points[i-1].ID {
+			t.Errorf("map points are not ordered by ID")
+		}
+	}
+
+	s.m.SetReferenceMapPoints(points[:5])
+	if len(s.m.ReferenceMapPoints()) != 5 {
+		t.Errorf("ReferenceMapPoints: got %d want 5", len(s.m.ReferenceMapPoints()))
+	}
+	change := s.m.BigChangeIndex()
+	s.m.InformNewBigChange()
+	if s.m.BigChangeIndex() != change+1 {
+		t.Errorf("BigChangeIndex was not incremented")
+	}
+
+	s.m.Clear()
+	if s.m.NumKeyFrames() != 0 || s.m.NumMapPoints() != 0 || s.m.Origin() != nil {
+		t.Errorf("map was not cleared")
+	}
+}
+
+// The map is changed by local mapping and loop closing while tracking reads it. Run with -race.
+func TestMapConcurrentAccess(t *testing.T) {
+	observed := make([][]int, 8)
+	for i := range observed {
+		observed[i] = pointRange(i*20, i*20+60)
+	}
+	s := newTestScene(200, observed)
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	// tracking
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			for _, kf := range s.m.KeyFrames() {
+				for _, covisible := range kf.BestCovisibilityKeyFrames(10) {
+					for _, mp := range covisible.MapPoints() {
+						mp.Position()
+						mp.IncreaseVisible(1)
+					}
+				}
+			}
+		}
+	}()
+	// local mapping
+	go func() {
+		defer wg.Done()
+		for i, mp := range s.points {
+			if i%3 == 0 {
+				mp.SetBad()
+			} else {
+				mp.ComputeDistinctiveDescriptors()
+				mp.UpdateNormalAndDepth()
+			}
+		}
+		s.keyFrames[3].SetBad()
+		for _, kf := range s.m.KeyFrames() {
+			kf.UpdateConnections()
+		}
+	}()
+	// loop closing
+	go func() {
+		defer wg.Done()
+		s.m.Update.Lock()
+		defer s.m.Update.Unlock()
+		for _, kf := range s.m.KeyFrames() {
+			kf.SetPose(kf.Pose())
+			for _, child := range kf.Children() {
+				child.Parent()
+			}
+		}
+		s.m.InformNewBigChange()
+	}()
+	wg.Wait()
+
+	for _, kf := range s.m.KeyFrames() {
+		if kf.IsBad() {
+			t.Errorf("removed keyframe %d is still in the map", kf.ID)
+		}
+		if kf != s.m.Origin() && kf.Parent() == nil {
+			t.Errorf("keyframe %d has no parent", kf.ID)
+		}
+	}
+	for _, mp := range s.m.MapPoints() {
+		if mp.IsBad() {
+			t.Errorf("removed map point %d is still in the map", mp.ID)
+		}
+	}
+}
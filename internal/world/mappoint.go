@@ -0,0 +1,345 @@
+package world
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+
+	"github.com/kegsay/gorbslam/internal/feature"
+	"github.com/kegsay/gorbslam/internal/geom"
+)
+
+var nextMapPointID int64
+
+// MapPoint is a 3D point in the world which has been observed by one or more keyframes.
+type MapPoint struct {
+	ID int64
+	// The keyframe which created the point
+	FirstKeyFrameID int64
+
+	m  *Map
+	mu sync.RWMutex
+	// world position
+	position geom.Vec3
+	// mean viewing direction
+	normal geom.Vec3
+	// the most representative descriptor of all the observations
+	descriptor feature.Descriptor
+	reference  *KeyFrame
+	// keyframe -> index of the keypoint in that keyframe
+	observations map[*KeyFrame]int
+	// the number of frames the point should have been visible in, and was actually found in
+	visible int
+	found   int
+	bad     bool
+	// the point which replaced this one when they were fused
+	replaced *MapPoint
+	// the scale invariance distances: the range of distances the point can be detected from
+	minDistance float64
+	maxDistance float64
+}
+
+// NewMapPoint creates a map point at position, created by the keyframe reference. The caller is
+// expected to add observations and then add the point to the map.
+func NewMapPoint(position geom.Vec3, reference *KeyFrame, m *Map) *MapPoint {
+	return &MapPoint{
+		ID:              atomic.AddInt64(&nextMapPointID, 1) - 1,
+		FirstKeyFrameID: reference.ID,
+		m:               m,
+		position:        position,
+		reference:       reference,
+		observations:    make(map[*KeyFrame]int),
+		visible:         1,
+		found:           1,
+	}
+}
+
+// NewTemporaryMapPoint creates a point which is never added to the map, with the descriptor of the
+// keypoint it was triangulated from. The tracker uses these for visual odometry in localisation
+// mode: having no observations, they are never mistaken for points of the map.
+func NewTemporaryMapPoint(position geom.Vec3, descriptor feature.Descriptor, reference *KeyFrame) *MapPoint {
+	mp := NewMapPoint(position, reference, nil)
+	mp.descriptor = descriptor
+	return mp
+}
+
+// Position returns the world position
+func (p *MapPoint) Position() geom.Vec3 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.position
+}
+
+// SetPosition sets the world position
+func (p *MapPoint) SetPosition(pos geom.Vec3) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.position = pos
+}
+
+// Normal returns the mean viewing direction, a unit vector
+func (p *MapPoint) Normal() geom.Vec3 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.normal
+}
+
+// Descriptor returns the representative descriptor, see ComputeDistinctiveDescriptors
+func (p *MapPoint) Descriptor() feature.Descriptor {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.descriptor
+}
+
+// ReferenceKeyFrame returns the keyframe used to compute the scale invariance distances
+func (p *MapPoint) ReferenceKeyFrame() *KeyFrame {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.reference
+}
+
+// AddObservation records that keypoint idx in kf observes this point.
+func (p *MapPoint) AddObservation(kf *KeyFrame, idx int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.observations[kf] = idx
+}
+
+// EraseObservation removes the observation by kf. If only 2 observations remain the point is no
+// longer reliable and is marked as bad.
+func (p *MapPoint) EraseObservation(kf *KeyFrame) {
+	p.mu.Lock()
+	if _, ok := p.observations[kf]; !ok {
+		p.mu.Unlock()
+		return
+	}
+	delete(p.observations, kf)
+	if p.reference == kf {
+		p.reference = nil
+		// pick any remaining observer, the lowest ID so it is deterministic
+		for other := range p.observations {
+			if p.reference == nil || other.ID < p.reference.ID {
+				p.reference = other
+			}
+		}
+	}
+	bad := p.numObservations() <= 2
+	p.mu.Unlock()
+	if bad {
+		p.SetBad()
+	}
+}
+
+// Observations returns a copy of the observations: keyframe -> keypoint index
+func (p *MapPoint) Observations() map[*KeyFrame]int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	obs := make(map[*KeyFrame]int, len(p.observations))
+	for kf, idx := range p.observations {
+		obs[kf] = idx
+	}
+	return obs
+}
+
+// NumObservations returns the number of keyframes observing the point. As in ORB-SLAM2 a keyframe
+// which also sees the point in its right image counts twice.
+func (p *MapPoint) NumObservations() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.numObservations()
+}
+
+func (p *MapPoint) numObservations() int {
+	n := 0
+	for kf, idx := range p.observations {
+		if kf.URight != nil && kf.URight[idx] >= 0 {
+			n += 2
+		} else {
+			n++
+		}
+	}
+	return n
+}
+
+// Index returns the index of the keypoint in kf which observes this point
+func (p *MapPoint) Index(kf *KeyFrame) (int, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	idx, ok := p.observations[kf]
+	return idx, ok
+}
+
+// IsInKeyFrame returns true if kf observes this point
+func (p *MapPoint) IsInKeyFrame(kf *KeyFrame) bool {
+	_, ok := p.Index(kf)
+	return ok
+}
+
+// SetBad removes the point from every keyframe observing it and from the map.
+func (p *MapPoint) SetBad() {
+	p.mu.Lock()
+	p.bad = true
+	obs := p.observations
+	p.observations = make(map[*KeyFrame]int)
+	p.mu.Unlock()
+	for kf, idx := range obs {
+		kf.EraseMapPointMatch(idx)
+	}
+	if p.m != nil {
+		p.m.EraseMapPoint(p)
+	}
+}
+
+// IsBad returns true if the point has been removed from the map
+func (p *MapPoint) IsBad() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.bad
+}
+
+// Replace merges this point into other: every observation of this point becomes an observation of
+// other (unless the keyframe already observes other), and this point is removed from the map.
+func (p *MapPoint) Replace(other *MapPoint) {
+	if other == p {
+		return
+	}
+	p.mu.Lock()
+	obs := p.observations
+	p.observations = make(map[*KeyFrame]int)
+	p.bad = true
+	visible, found := p.visible, p.found
+	p.replaced = other
+	p.mu.Unlock()
+
+	for kf, idx := range obs {
+		if !other.IsInKeyFrame(kf) {
+			kf.ReplaceMapPointMatch(idx, other)
+			other.AddObservation(kf, idx)
+		} else {
+			kf.EraseMapPointMatch(idx)
+		}
+	}
+	other.IncreaseFound(found)
+	other.IncreaseVisible(visible)
+	other.ComputeDistinctiveDescriptors()
+	if p.m != nil {
+		p.m.EraseMapPoint(p)
+	}
+}
+
+// Replaced returns the point which replaced this one, if any
+func (p *MapPoint) Replaced() *MapPoint {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.replaced
+}
+
+// IncreaseVisible records that the point was predicted to be visible in n more frames
+func (p *MapPoint) IncreaseVisible(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.visible += n
+}
+
+// IncreaseFound records that the point was matched in n more frames
+func (p *MapPoint) IncreaseFound(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.found += n
+}
+
+// FoundRatio returns the fraction of frames the point was found in when it should have been
+// visible. Points which are rarely found are probably wrong and get culled.
+func (p *MapPoint) FoundRatio() float64 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return float64(p.found) / float64(p.visible)
+}
+
+// ComputeDistinctiveDescriptors picks the observation descriptor with the least median distance
+// to all the others as the descriptor of the point.
+func (p *MapPoint) ComputeDistinctiveDescriptors() {
+	obs := p.Observations()
+	if len(obs) == 0 {
+		return
+	}
+	descriptors := make([]*feature.Descriptor, 0, len(obs))
+	for kf, idx := range obs {
+		if kf.IsBad() {
+			continue
+		}
+		descriptors = append(descriptors, &kf.Descriptors[idx])
+	}
+	best := feature.MedianDescriptor(descriptors)
+	if best < 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.descriptor = *descriptors[best]
+}
+
+// UpdateNormalAndDepth recomputes the mean viewing direction and the scale invariance distances
+// from the observations and the reference keyframe.
+func (p *MapPoint) UpdateNormalAndDepth() {
+	p.mu.RLock()
+	if p.bad || p.reference == nil || len(p.observations) == 0 {
+		p.mu.RUnlock()
+		return
+	}
+	pos := p.position
+	ref := p.reference
+	obs := make(map[*KeyFrame]int, len(p.observations))
+	for kf, idx := range p.observations {
+		obs[kf] = idx
+	}
+	p.mu.RUnlock()
+
+	var normal geom.Vec3
+	for kf := range obs {
+		normal = normal.Add(pos.Sub(kf.CameraCenter()).Normalised())
+	}
+	dist := pos.Sub(ref.CameraCenter()).Norm()
+	idx, ok := obs[ref]
+	if !ok {
+		return
+	}
+	pyramid := ref.Pyramid
+	level := ref.KeyPoints[idx].Octave
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.normal = normal.Normalised()
+	p.maxDistance = dist * pyramid.ScaleFactors[level]
+	p.minDistance = p.maxDistance / pyramid.ScaleFactors[pyramid.Levels-1]
+}
+
+// MinDistanceInvariance returns the minimum distance the point can be detected from, with a margin
+func (p *MapPoint) MinDistanceInvariance() float64 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return 0.8 * p.minDistance
+}
+
+// MaxDistanceInvariance returns the maximum distance the point can be detected from, with a margin
+func (p *MapPoint) MaxDistanceInvariance() float64 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return 1.2 * p.maxDistance
+}
+
+// PredictScale returns the pyramid level the point is expected to be detected on when viewed from
+// dist away.
+func (p *MapPoint) PredictScale(dist float64, pyramid *feature.ScalePyramid) int {
+	p.mu.RLock()
+	ratio := p.maxDistance / dist
+	p.mu.RUnlock()
+	level := int(math.Ceil(math.Log(ratio) / math.Log(pyramid.ScaleFactor)))
+	if level < 0 {
+		return 0
+	}
+	if level >= pyramid.Levels {
+		return pyramid.Levels - 1
+	}
+	return level
+}
@@ -0,0 +1,141 @@
+package world
+
+import (
+	"math"
+	"testing"
+
+	"github.com/kegsay/gorbslam/internal/geom"
+)
+
+func TestMapPointDescriptor(t *testing.T) {
+	s := newTestScene(1, [][]int{{0}, {0}, {0}, {0}, {0}})
+	mp := s.points[0]
+	// four similar descriptors and one far from all of them. The second has the smallest median
+	// distance to the others.
+	for i, kf := range s.keyFrames {
+		d := &kf.Descriptors[0]
+		for b := range d {
+			d[b] = 0
+		}
+		d[0] = []byte{0x00, 0x01, 0x03, 0x0f, 0x00}[i]
+		if i == 4 {
+			for b := range d {
+				d[b] = 0xff
+			}
+		}
+	}
+	mp.ComputeDistinctiveDescriptors()
+	got := mp.Descriptor()
+	if want := s.keyFrames[1].Descriptors[0]; got != want {
+		t.Errorf("Descriptor: got %x want %x", got[:1], want[:1])
+	}
+}
+
+func TestTemporaryMapPoint(t *testing.T) {
+	s := newTestScene(1, [][]int{{0}})
+	d := s.keyFrames[0].Descriptors[0]
+	d[0] ^= 0xff
+	mp := NewTemporaryMapPoint(geom.Vec3{1, 2, 3}, d, s.keyFrames[0])
+	if mp.Descriptor() != d || mp.NumObservations() != 0 {
+		t.Errorf("got descriptor %x with %d observations", mp.Descriptor(), mp.NumObservations())
+	}
+	if s.m.NumMapPoints() != 1 {
+		t.Errorf("temporary point was added to the map")
+	}
+}
+
+func TestUpdateNormalAndDepth(t *testing.T) {
+	s := newTestScene(1, [][]int{{0}, {0}, {0}})
+	mp := s.points[0]
+	pos := geom.Vec3{1, 0, 5}
+	mp.SetPosition(pos)
+	mp.UpdateNormalAndDepth()
+	// the keyframes are at x = 0, 1 and 2 so the mean viewing direction is straight down z
+	if d := mp.Normal().Sub(geom.Vec3{0, 0, 1}).Norm(); d > 1e-9 {
+		t.Errorf("Normal: got %v", mp.Normal())
+	}
+	// the reference keyframe saw the point on level 0, so that's the furthest it can be seen from
+	dist := pos.Sub(s.keyFrames[0].CameraCenter()).Norm()
+	if got := mp.MaxDistanceInvariance(); math.Abs(got-1.2*dist) > 1e-9 {
+		t.Errorf("MaxDistanceInvariance: got %v want %v", got, 1.2*dist)
+	}
+	minDist := dist / testPyramid.ScaleFactors[testPyramid.Levels-1]
+	if got := mp.MinDistanceInvariance(); math.Abs(got-0.8*minDist) > 1e-9 {
+		t.Errorf("MinDistanceInvariance: got %v want %v", got, 0.8*minDist)
+	}
+
+	testCases := []struct {
+		dist  float64
+		level int
+	}{
+		{dist: dist, level: 0},
+		{dist: dist * 2, level: 0},
+		{dist: dist / 1.2 * 1.01, level: 1},
+		{dist: dist / 1.44 * 1.01, level: 2},
+		{dist: dist / 100, level: testPyramid.Levels - 1},
+	}
+	for _, tc := range testCases {
+		if got := mp.PredictScale(tc.dist, testPyramid); got != tc.level {
+			t.Errorf("PredictScale(%v): got %d want %d", tc.dist, got, tc.level)
+		}
+	}
+}
+
+func TestEraseObservation(t *testing.T) {
+	s := newTestScene(1, [][]int{{0}, {0}, {0}, {0}})
+	mp := s.points[0]
+	if mp.ReferenceKeyFrame() != s.keyFrames[0] {
+		t.Fatalf("wrong reference keyframe")
+	}
+	mp.EraseObservation(s.keyFrames[0])
+	if mp.IsBad() {
+		t.Fatalf("point with 3 observations was removed")
+	}
+	if mp.ReferenceKeyFrame() != s.keyFrames[1] {
+		t.Errorf("reference keyframe was not replaced")
+	}
+	// too few observations left to be reliable
+	mp.EraseObservation(s.keyFrames[1])
+	if !mp.IsBad() {
+		t.Fatalf("point with 2 observations was kept")
+	}
+	if s.m.NumMapPoints() != 0 {
+		t.Errorf("point was not removed from the map")
+	}
+	for _, kf := range s.keyFrames {
+		if kf.MapPoint(0) != nil && kf != s.keyFrames[0] && kf != s.keyFrames[1] {
+			t.Errorf("keyframe %d still observes the point", kf.ID)
+		}
+	}
+}
+
+func TestMapPointReplace(t *testing.T) {
+	s := newTestScene(2, [][]int{{0}, {0, 1}, {1}})
+	kf0, kf1, kf2 := s.keyFrames[0], s.keyFrames[1], s.keyFrames[2]
+	p0, p1 := s.points[0], s.points[1]
+	p0.IncreaseVisible(3)
+	p0.IncreaseFound(1)
+
+	p0.Replace(p1)
+	if !p0.IsBad() || p0.Replaced() != p1 {
+		t.Errorf("replaced point was not removed")
+	}
+	if kf0.MapPoint(0) != p1 {
+		t.Errorf("keyframe 0 does not observe the new point")
+	}
+	// keyframe 1 already observed the new point so the old observation is dropped
+	if kf1.MapPoint(0) != nil || kf1.MapPoint(1) != p1 {
+		t.Errorf("keyframe 1 observations are wrong")
+	}
+	obs := p1.Observations()
+	if len(obs) != 3 || obs[kf0] != 0 || obs[kf1] != 1 || obs[kf2] != 0 {
+		t.Errorf("Observations: got %v", obs)
+	}
+	// visible 1 + 1 + 3, found 1 + 1 + 1
+	if got := p1.FoundRatio(); math.Abs(got-0.6) > 1e-9 {
+		t.Errorf("FoundRatio: got %v want 0.6", got)
+	}
+	if s.m.NumMapPoints() != 1 {
+		t.Errorf("NumMapPoints: got %d want 1", s.m.NumMapPoints())
+	}
+}
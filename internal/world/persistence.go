@@ -0,0 +1,678 @@
+package world
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/kegsay/gorbslam/internal/bow"
+	"github.com/kegsay/gorbslam/internal/camera"
+	"github.com/kegsay/gorbslam/internal/feature"
+	"github.com/kegsay/gorbslam/internal/geom"
+	"github.com/kegsay/gorbslam/internal/imu"
+)
+
+// The map file format. Bump mapVersion whenever the format changes.
+const (
+	mapMagic   = "GORBMAP\x00"
+	mapVersion = 3
+	// the oldest version LoadMap reads. Version 1 had no stereo depths, and versions before 3 no
+	// IMU state, so load as visual-only maps.
+	minMapVersion = 1
+	// counts in a map file larger than this are assumed to be corruption, rather than allocated
+	maxMapCount = 1 << 28
+)
+
+// SaveMap writes the keyframes, map points and the graphs linking them, so that the map can be
+// reused with LoadMap. The bags of words are only valid for the vocabulary they were computed
+// with, so its checksum is saved too. The IMU state is saved with them: the velocities, biases and
+// preintegrated motions of the keyframes, their chain in time, and whether the IMU has been
+// initialised. Set compress to gzip the file, which LoadMap detects.
+// The map must not be changed while it is saved: stop local mapping and loop closing first.
+func SaveMap(w io.Writer, m *Map, voc *bow.Vocabulary, compress bool) error {
+	if compress {
+		zw := gzip.NewWriter(w)
+		if err := SaveMap(zw, m, voc, false); err != nil {
+			return err
+		}
+		return zw.Close()
+	}
+	e := &encoder{w: bufio.NewWriter(w)}
+	e.bytes([]byte(mapMagic))
+	e.uint32(mapVersion)
+	e.uint64(voc.Checksum())
+
+	var keyFrames []*KeyFrame
+	for _, kf := range m.KeyFrames() {
+		if !kf.IsBad() {
+			keyFrames = append(keyFrames, kf)
+		}
+	}
+	saved := make(map[*KeyFrame]bool, len(keyFrames))
+	for _, kf := range keyFrames {
+		saved[kf] = true
+	}
+
+	// keyframes share pyramids, so they are saved once
+	pyramidIndexes := make(map[*feature.ScalePyramid]int)
+	var pyramids []*feature.ScalePyramid
+	for _, kf := range keyFrames {
+		if _, ok := pyramidIndexes[kf.Pyramid]; !ok {
+			pyramidIndexes[kf.Pyramid] = len(pyramids)
+			pyramids = append(pyramids, kf.Pyramid)
+		}
+	}
+	e.uint32(uint32(len(pyramids)))
+	for _, p := range pyramids {
+		e.int64(int64(p.Levels))
+		e.float64(p.ScaleFactor)
+	}
+
+	e.uint32(uint32(len(keyFrames)))
+	for _, kf := range keyFrames {
+		e.keyFrame(kf, pyramidIndexes[kf.Pyramid])
+	}
+
+	var points []*MapPoint
+	for _, mp := range m.MapPoints() {
+		if !mp.IsBad() {
+			points = append(points, mp)
+		}
+	}
+	e.uint32(uint32(len(points)))
+	for _, mp := range points {
+		e.mapPoint(mp, saved)
+	}
+
+	// the graphs, once every keyframe they refer to has been saved
+	for _, kf := range keyFrames {
+		kf.mu.RLock()
+		e.keyFrameID(kf.parent, saved)
+		connected := sortedKeyFrames(kf.connectionSet())
+		e.uint32(uint32(countSaved(connected, saved)))
+		for _, o := range connected {
+			if saved[o] {
+				e.int64(o.ID)
+				e.int64(int64(kf.connections[o]))
+			}
+		}
+		loops := sortedKeyFrames(kf.loopEdges)
+		e.uint32(uint32(countSaved(loops, saved)))
+		for _, o := range loops {
+			if saved[o] {
+				e.int64(o.ID)
+			}
+		}
+		// only the previous keyframe in time: LoadMap links the next ones from it
+		e.keyFrameID(kf.prevKF, saved)
+		kf.mu.RUnlock()
+	}
+	e.keyFrameID(m.Origin(), saved)
+	e.bool(m.IsIMUInitialized())
+	e.float64(m.Scale())
+
+	if e.err != nil {
+		return e.err
+	}
+	return e.w.Flush()
+}
+
+// connectionSet returns the connected keyframes as a set. k.mu must be held.
+func (k *KeyFrame) connectionSet() map[*KeyFrame]bool {
+	set := make(map[*KeyFrame]bool, len(k.connections))
+	for kf := range k.connections {
+		set[kf] = true
+	}
+	return set
+}
+
+func countSaved(kfs []*KeyFrame, saved map[*KeyFrame]bool) int {
+	n := 0
+	for _, kf := range kfs {
+		if saved[kf] {
+			n++
+		}
+	}
+	return n
+}
+
+// LoadMap reads a map written by SaveMap into m, which should be empty, and adds its keyframes to
+// db. The covisibility graph, spanning tree and IMU state are restored as they were saved, maps
+// from before version 3 loading without IMU state. Fails if the map was saved with a different
+// vocabulary.
+func LoadMap(r io.Reader, m *Map, db *KeyFrameDatabase, voc *bow.Vocabulary) error {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		br = bufio.NewReader(zr)
+	}
+	d := &decoder{r: br}
+	if magic := d.bytes(len(mapMagic)); d.err == nil && string(magic) != mapMagic {
+		return fmt.Errorf("not a map file")
+	}
+	if d.version = d.uint32(); d.err == nil && (d.version < minMapVersion || d.version > mapVersion) {
+		return fmt.Errorf("unsupported map version %d, want %d to %d", d.version, minMapVersion, mapVersion)
+	}
+	if checksum := d.uint64(); d.err == nil && checksum != voc.Checksum() {
+		return fmt.Errorf("map was saved with a different vocabulary: checksum %x, want %x", checksum, voc.Checksum())
+	}
+
+	pyramids := make([]*feature.ScalePyramid, d.count())
+	for i := range pyramids {
+		levels := d.int64()
+		scaleFactor := d.float64()
+		if d.err == nil && (levels < 1 || levels > 64 || scaleFactor <= 1) {
+			return fmt.Errorf("invalid scale pyramid: %d levels, scale factor %v", levels, scaleFactor)
+		}
+		pyramids[i] = feature.NewScalePyramid(int(levels), scaleFactor)
+	}
+
+	keyFrames := make([]*KeyFrame, d.count())
+	byID := make(map[int64]*KeyFrame, len(keyFrames))
+	for i := range keyFrames {
+		kf := d.keyFrame(m, pyramids)
+		if d.err != nil {
+			return d.err
+		}
+		keyFrames[i] = kf
+		byID[kf.ID] = kf
+	}
+	lookup := func() *KeyFrame {
+		id := d.int64()
+		if id < 0 || d.err != nil {
+			return nil
+		}
+		kf, ok := byID[id]
+		if !ok {
+			d.err = fmt.Errorf("unknown keyframe %d", id)
+		}
+		return kf
+	}
+
+	points := make([]*MapPoint, d.count())
+	for i := range points {
+		mp := &MapPoint{
+			ID:              d.int64(),
+			FirstKeyFrameID: d.int64(),
+			m:               m,
+			position:        d.vec3(),
+			normal:          d.vec3(),
+			observations:    make(map[*KeyFrame]int),
+		}
+		copy(mp.descriptor[:], d.bytes(len(mp.descriptor)))
+		mp.reference = lookup()
+		mp.visible = int(d.int64())
+		mp.found = int(d.int64())
+		mp.minDistance = d.float64()
+		mp.maxDistance = d.float64()
+		numObs := d.count()
+		for j := 0; j < numObs; j++ {
+			kf := lookup()
+			idx := int(d.uint32())
+			if d.err != nil {
+				return d.err
+			}
+			if kf == nil {
+				return fmt.Errorf("map point %d observed by no keyframe", mp.ID)
+			}
+			if idx >= len(kf.mapPoints) {
+				return fmt.Errorf("map point %d observed by keypoint %d of keyframe %d, which has %d", mp.ID, idx, kf.ID, len(kf.mapPoints))
+			}
+			mp.observations[kf] = idx
+			kf.mapPoints[idx] = mp
+		}
+		if d.err != nil {
+			return d.err
+		}
+		points[i] = mp
+	}
+
+	for _, kf := range keyFrames {
+		if parent := lookup(); parent != nil {
+			kf.parent = parent
+			parent.children[kf] = true
+		}
+		numConnections := d.count()
+		for j := 0; j < numConnections; j++ {
+			if o := lookup(); o != nil {
+				kf.connections[o] = int(d.int64())
+			}
+		}
+		numLoops := d.count()
+		for j := 0; j < numLoops; j++ {
+			if o := lookup(); o != nil {
+				kf.loopEdges[o] = true
+			}
+		}
+		if d.version >= 3 {
+			if prev := lookup(); prev != nil {
+				kf.prevKF = prev
+				prev.nextKF = kf
+			}
+		}
+		if d.err != nil {
+			return d.err
+		}
+		kf.updateBestCovisibles()
+		kf.firstConnection = len(kf.connections) == 0
+	}
+	origin := lookup()
+	imuInitialized, scale := false, 1.0
+	if d.version >= 3 {
+		imuInitialized, scale = d.bool(), d.float64()
+		if d.err == nil && !(scale > 0) {
+			return fmt.Errorf("invalid map scale %v", scale)
+		}
+	}
+	if d.err != nil {
+		return d.err
+	}
+
+	// the origin must be added first
+	if origin != nil {
+		m.AddKeyFrame(origin)
+	}
+	var maxFrameID, maxKeyFrameID, maxPointID int64
+	for _, kf := range keyFrames {
+		m.AddKeyFrame(kf)
+		db.Add(kf)
+		if kf.ID > maxKeyFrameID {
+			maxKeyFrameID = kf.ID
+		}
+		if kf.FrameID > maxFrameID {
+			maxFrameID = kf.FrameID
+		}
+	}
+	for _, mp := range points {
+		m.AddMapPoint(mp)
+		if mp.ID > maxPointID {
+			maxPointID = mp.ID
+		}
+	}
+	m.mu.Lock()
+	m.imuInitialized = imuInitialized
+	m.scale = scale
+	m.mu.Unlock()
+	// new frames, keyframes and points must not reuse the loaded IDs
+	advanceID(&nextFrameID, maxFrameID)
+	advanceID(&nextKeyFrameID, maxKeyFrameID)
+	advanceID(&nextMapPointID, maxPointID)
+	return nil
+}
+
+// advanceID makes sure the next ID taken from counter is greater than id
+func advanceID(counter *int64, id int64) {
+	for {
+		next := atomic.LoadInt64(counter)
+		if next > id || atomic.CompareAndSwapInt64(counter, next, id+1) {
+			return
+		}
+	}
+}
+
+// encoder writes little-endian values, remembering the first error
+type encoder struct {
+	w   *bufio.Writer
+	err error
+	buf [8]byte
+}
+
+func (e *encoder) bytes(b []byte) {
+	if e.err == nil {
+		_, e.err = e.w.Write(b)
+	}
+}
+
+func (e *encoder) uint32(v uint32) {
+	binary.LittleEndian.PutUint32(e.buf[:4], v)
+	e.bytes(e.buf[:4])
+}
+
+func (e *encoder) uint64(v uint64) {
+	binary.LittleEndian.PutUint64(e.buf[:], v)
+	e.bytes(e.buf[:])
+}
+
+func (e *encoder) int64(v int64) {
+	e.uint64(uint64(v))
+}
+
+func (e *encoder) float64(v float64) {
+	e.uint64(math.Float64bits(v))
+}
+
+func (e *encoder) vec3(v geom.Vec3) {
+	for _, x := range v {
+		e.float64(x)
+	}
+}
+
+func (e *encoder) bool(v bool) {
+	if v {
+		e.uint32(1)
+	} else {
+		e.uint32(0)
+	}
+}
+
+func (e *encoder) time(t time.Time) {
+	b, err := t.MarshalBinary()
+	if err != nil {
+		e.err = err
+		return
+	}
+	e.uint32(uint32(len(b)))
+	e.bytes(b)
+}
+
+// preintegrated writes the IMU motion to a keyframe, which may be nil
+func (e *encoder) preintegrated(p *imu.Preintegrated) {
+	e.bool(p != nil)
+	if p == nil {
+		return
+	}
+	b, err := p.MarshalBinary()
+	if err != nil {
+		e.err = err
+		return
+	}
+	e.uint32(uint32(len(b)))
+	e.bytes(b)
+}
+
+// keyFrameID writes the ID of a saved keyframe, or -1
+func (e *encoder) keyFrameID(kf *KeyFrame, saved map[*KeyFrame]bool) {
+	if kf == nil || !saved[kf] {
+		e.int64(-1)
+		return
+	}
+	e.int64(kf.ID)
+}
+
+func (e *encoder) keyFrame(kf *KeyFrame, pyramid int) {
+	e.int64(kf.ID)
+	e.int64(kf.FrameID)
+	e.time(kf.Timestamp)
+	cam := kf.Camera
+	for _, v := range []float64{cam.Fx, cam.Fy, cam.Cx, cam.Cy, kf.MinX, kf.MaxX, kf.MinY, kf.MaxY} {
+		e.float64(v)
+	}
+	e.uint32(uint32(pyramid))
+	e.uint32(uint32(len(kf.KeyPoints)))
+	for i := range kf.KeyPoints {
+		kp := &kf.KeyPoints[i]
+		e.float64(kp.X)
+		e.float64(kp.Y)
+		e.int64(int64(kp.Octave))
+		e.float64(kp.Angle)
+		e.float64(kp.Response)
+		e.bytes(kf.Descriptors[i][:])
+	}
+	e.float64(kf.Bf)
+	e.float64(kf.ThDepth)
+	if kf.IsStereo() {
+		e.uint32(1)
+		for i := range kf.KeyPoints {
+			e.float64(kf.URight[i])
+			e.float64(kf.Depth[i])
+		}
+	} else {
+		e.uint32(0)
+	}
+
+	pose := kf.Pose()
+	r := pose.R.Matrix()
+	for _, row := range r {
+		for _, v := range row {
+			e.float64(v)
+		}
+	}
+	e.vec3(pose.T)
+
+	bv := kf.BowVector()
+	e.uint32(uint32(bv.Len()))
+	for i := 0; i < bv.Len(); i++ {
+		id, val := bv.Entry(i)
+		e.uint64(uint64(id))
+		e.float64(float64(val))
+	}
+	fv := kf.FeatureVector()
+	e.uint32(uint32(len(fv.NodeIDs)))
+	for i, node := range fv.NodeIDs {
+		e.int64(int64(node))
+		e.uint32(uint32(len(fv.Features[i])))
+		for _, idx := range fv.Features[i] {
+			e.uint32(uint32(idx))
+		}
+	}
+
+	e.vec3(kf.Velocity())
+	bias := kf.Bias()
+	e.vec3(bias.Acc)
+	e.vec3(bias.Gyro)
+	e.preintegrated(kf.Preintegrated())
+}
+
+func (e *encoder) mapPoint(mp *MapPoint, saved map[*KeyFrame]bool) {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+	e.int64(mp.ID)
+	e.int64(mp.FirstKeyFrameID)
+	e.vec3(mp.position)
+	e.vec3(mp.normal)
+	e.bytes(mp.descriptor[:])
+	e.keyFrameID(mp.reference, saved)
+	e.int64(int64(mp.visible))
+	e.int64(int64(mp.found))
+	e.float64(mp.minDistance)
+	e.float64(mp.maxDistance)
+	observers := make(map[*KeyFrame]bool, len(mp.observations))
+	for kf := range mp.observations {
+		if saved[kf] {
+			observers[kf] = true
+		}
+	}
+	e.uint32(uint32(len(observers)))
+	for _, kf := range sortedKeyFrames(observers) {
+		e.int64(kf.ID)
+		e.uint32(uint32(mp.observations[kf]))
+	}
+}
+
+// decoder reads what encoder writes, remembering the first error
+type decoder struct {
+	r       *bufio.Reader
+	version uint32
+	err     error
+	buf     [8]byte
+}
+
+func (d *decoder) bytes(n int) []byte {
+	b := make([]byte, n)
+	if d.err == nil {
+		if _, err := io.ReadFull(d.r, b); err != nil {
+			d.err = fmt.Errorf("truncated map file: %s", err)
+		}
+	}
+	return b
+}
+
+func (d *decoder) uint32() uint32 {
+	if d.err == nil {
+		if _, err := io.ReadFull(d.r, d.buf[:4]); err != nil {
+			d.err = fmt.Errorf("truncated map file: %s", err)
+			return 0
+		}
+		return binary.LittleEndian.Uint32(d.buf[:4])
+	}
+	return 0
+}
+
+func (d *decoder) uint64() uint64 {
+	if d.err == nil {
+		if _, err := io.ReadFull(d.r, d.buf[:]); err != nil {
+			d.err = fmt.Errorf("truncated map file: %s", err)
+			return 0
+		}
+		return binary.LittleEndian.Uint64(d.buf[:])
+	}
+	return 0
+}
+
+func (d *decoder) int64() int64 {
+	return int64(d.uint64())
+}
+
+func (d *decoder) float64() float64 {
+	return math.Float64frombits(d.uint64())
+}
+
+func (d *decoder) vec3() geom.Vec3 {
+	return geom.Vec3{d.float64(), d.float64(), d.float64()}
+}
+
+func (d *decoder) bool() bool {
+	return d.uint32() != 0
+}
+
+// count reads the length of a list
+func (d *decoder) count() int {
+	n := d.uint32()
+	if n > maxMapCount {
+		d.err = fmt.Errorf("corrupt map file: list of %d entries", n)
+		return 0
+	}
+	return int(n)
+}
+
+func (d *decoder) time() time.Time {
+	b := d.bytes(d.count())
+	var t time.Time
+	if d.err == nil {
+		if err := t.UnmarshalBinary(b); err != nil {
+			d.err = err
+		}
+	}
+	return t
+}
+
+func (d *decoder) preintegrated() *imu.Preintegrated {
+	if !d.bool() {
+		return nil
+	}
+	b := d.bytes(d.count())
+	if d.err != nil {
+		return nil
+	}
+	p := new(imu.Preintegrated)
+	if err := p.UnmarshalBinary(b); err != nil {
+		d.err = err
+		return nil
+	}
+	return p
+}
+
+func (d *decoder) keyFrame(m *Map, pyramids []*feature.ScalePyramid) *KeyFrame {
+	id := d.int64()
+	frameID := d.int64()
+	timestamp := d.time()
+	cam := camera.Pinhole{Fx: d.float64(), Fy: d.float64(), Cx: d.float64(), Cy: d.float64()}
+	minX, maxX, minY, maxY := d.float64(), d.float64(), d.float64(), d.float64()
+	pyramid := int(d.uint32())
+	if d.err == nil && pyramid >= len(pyramids) {
+		d.err = fmt.Errorf("keyframe %d has unknown scale pyramid %d", id, pyramid)
+	}
+	n := d.count()
+	if d.err != nil {
+		return nil
+	}
+	keyPoints := make([]feature.KeyPoint, n)
+	descriptors := make([]feature.Descriptor, n)
+	for i := range keyPoints {
+		keyPoints[i] = feature.KeyPoint{X: d.float64(), Y: d.float64(), Octave: int(d.int64()), Angle: d.float64(), Response: d.float64()}
+		copy(descriptors[i][:], d.bytes(len(descriptors[i])))
+		if d.err == nil && (keyPoints[i].Octave < 0 || keyPoints[i].Octave >= pyramids[pyramid].Levels) {
+			d.err = fmt.Errorf("keyframe %d: keypoint %d has octave %d", id, i, keyPoints[i].Octave)
+		}
+	}
+	var uRight, depth []float64
+	var bf, thDepth float64
+	if d.version >= 2 {
+		bf, thDepth = d.float64(), d.float64()
+		if stereo := d.uint32(); stereo != 0 && d.err == nil {
+			uRight, depth = make([]float64, n), make([]float64, n)
+			for i := range uRight {
+				uRight[i], depth[i] = d.float64(), d.float64()
+			}
+		}
+	}
+
+	var r geom.Mat3
+	for i := range r {
+		for j := range r[i] {
+			r[i][j] = d.float64()
+		}
+	}
+	pose := geom.SE3{R: geom.NewSO3(r), T: d.vec3()}
+
+	var bv bow.BowVector
+	numWords := d.count()
+	for i := 0; i < numWords; i++ {
+		bv.AddWeight(bow.WordID(d.uint64()), bow.WordValue(d.float64()))
+	}
+	var fv bow.FeatureVector
+	numNodes := d.count()
+	for i := 0; i < numNodes && d.err == nil; i++ {
+		fv.NodeIDs = append(fv.NodeIDs, int(d.int64()))
+		indexes := make([]int, d.count())
+		for j := range indexes {
+			indexes[j] = int(d.uint32())
+			if d.err == nil && indexes[j] >= n {
+				d.err = fmt.Errorf("keyframe %d: feature vector has keypoint %d of %d", id, indexes[j], n)
+			}
+		}
+		fv.Features = append(fv.Features, indexes)
+	}
+	var velocity geom.Vec3
+	var bias imu.Bias
+	var preintegrated *imu.Preintegrated
+	if d.version >= 3 {
+		velocity = d.vec3()
+		bias = imu.Bias{Acc: d.vec3(), Gyro: d.vec3()}
+		preintegrated = d.preintegrated()
+	}
+	if d.err != nil {
+		return nil
+	}
+
+	features := NewFeaturesInBounds(cam, pyramids[pyramid], keyPoints, descriptors, minX, maxX, minY, maxY)
+	features.SetStereo(uRight, depth, bf, thDepth)
+	return &KeyFrame{
+		Features:        features,
+		ID:              id,
+		FrameID:         frameID,
+		Timestamp:       timestamp,
+		m:               m,
+		pose:            pose,
+		mapPoints:       make([]*MapPoint, n),
+		bowVector:       bv,
+		featureVector:   fv,
+		hasBoW:          true,
+		connections:     make(map[*KeyFrame]int),
+		firstConnection: true,
+		children:        make(map[*KeyFrame]bool),
+		loopEdges:       make(map[*KeyFrame]bool),
+		preintegrated:   preintegrated,
+		velocity:        velocity,
+		bias:            bias,
+	}
+}
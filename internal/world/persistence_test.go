@@ -0,0 +1,212 @@
+package world
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/kegsay/gorbslam/internal/bow"
+	"github.com/kegsay/gorbslam/internal/geom"
+	"github.com/kegsay/gorbslam/internal/imu"
+)
+
+var testVocabulary = &bow.Vocabulary{
+	BranchingFactor: 2,
+	DepthLevels:     1,
+	Nodes:           []bow.Node{{ID: 0}, {ID: 1, IsWord: true, WordID: 0, Weight: 1}, {ID: 2, IsWord: true, WordID: 1, Weight: 1}},
+}
+
+func saveMap(t *testing.T, m *Map, compress bool) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := SaveMap(&buf, m, testVocabulary, compress); err != nil {
+		t.Fatalf("SaveMap: %s", err)
+	}
+	return buf.Bytes()
+}
+
+func TestSaveLoadMap(t *testing.T) {
+	s := newTestScene(100, [][]int{
+		pointRange(0, 50),
+		pointRange(20, 70),
+		pointRange(40, 90),
+		pointRange(60, 100),
+	})
+	kfs := s.keyFrames
+	for i, kf := range kfs {
+		setWords(kf, pointRange(i*5, i*5+20)...)
+		kf.featureVector = bow.FeatureVector{NodeIDs: []int{1, 2}, Features: [][]int{{0, 1}, {2}}}
+	}
+	depth := make([]float64, len(kfs[1].KeyPoints))
+	uRight := make([]float64, len(depth))
+	for i, kp := range kfs[1].KeyPoints {
+		depth[i], uRight[i] = 5, kp.X-8
+	}
+	depth[0], uRight[0] = -1, -1
+	kfs[1].SetStereo(uRight, depth, 40, 3)
+	kfs[2].SetPose(geom.SE3{R: geom.ExpSO3(geom.Vec3{0.1, 0, 0}), T: geom.Vec3{-2, 0.1, 0.2}})
+	kfs[3].AddLoopEdge(kfs[0])
+	kfs[0].AddLoopEdge(kfs[3])
+	s.points[99].SetBad()
+
+	origDB := NewKeyFrameDatabase()
+	for _, kf := range kfs {
+		origDB.Add(kf)
+	}
+	wantCandidates := origDB.DetectLoopCandidates(kfs[3], 0)
+	if len(wantCandidates) == 0 {
+		t.Fatalf("no loop candidates in the original map")
+	}
+
+	saved := saveMap(t, s.m, false)
+	for _, compress := range []bool{false, true} {
+		m, db := NewMap(), NewKeyFrameDatabase()
+		if err := LoadMap(bytes.NewReader(saveMap(t, s.m, compress)), m, db, testVocabulary); err != nil {
+			t.Fatalf("LoadMap(compressed=%v): %s", compress, err)
+		}
+		// saving the loaded map gives the same file, so nothing was lost
+		if !bytes.Equal(saveMap(t, m, false), saved) {
+			t.Errorf("compressed=%v: saving the loaded map gave a different file", compress)
+		}
+
+		loaded := m.KeyFrames()
+		if len(loaded) != len(kfs) || m.NumMapPoints() != 99 {
+			t.Fatalf("loaded %d keyframes and %d points, want %d and 99", len(loaded), m.NumMapPoints(), len(kfs))
+		}
+		if m.Origin() != loaded[0] {
+			t.Errorf("origin is keyframe %d, want %d", m.Origin().ID, loaded[0].ID)
+		}
+		for i, kf := range loaded {
+			want := kfs[i]
+			if kf.ID != want.ID || kf.Pose() != want.Pose() {
+				t.Errorf("keyframe %d: got ID %d pose %v, want %v", i, kf.ID, kf.Pose(), want.Pose())
+			}
+			if kf.TrackedMapPoints(1) != want.TrackedMapPoints(1) {
+				t.Errorf("keyframe %d: %d points, want %d", i, kf.TrackedMapPoints(1), want.TrackedMapPoints(1))
+			}
+			if kf.IsStereo() != want.IsStereo() || kf.Bf != want.Bf || (kf.IsStereo() && kf.Depth[1] != want.Depth[1]) {
+				t.Errorf("keyframe %d: stereo depths were not restored", i)
+			}
+			kp := want.KeyPoints[0]
+			if got, exp := len(kf.FeaturesInArea(kp.X, kp.Y, 100, -1, -1)), len(want.FeaturesInArea(kp.X, kp.Y, 100, -1, -1)); got != exp {
+				t.Errorf("keyframe %d: %d features in area, want %d", i, got, exp)
+			}
+			var covisibles []*KeyFrame
+			for _, o := range want.CovisibleKeyFrames() {
+				// the scene's keyframe IDs are consecutive
+				covisibles = append(covisibles, loaded[o.ID-kfs[0].ID])
+				if got := kf.Weight(loaded[o.ID-kfs[0].ID]); got != want.Weight(o) {
+					t.Errorf("keyframe %d: weight to %d is %d, want %d", i, o.ID, got, want.Weight(o))
+				}
+			}
+			assertKeyFrames(t, "covisibles", kf.CovisibleKeyFrames(), covisibles...)
+		}
+		assertKeyFrames(t, "children", loaded[0].Children(), loaded[1])
+		assertKeyFrames(t, "loop edges", loaded[3].LoopEdges(), loaded[0])
+		if loaded[2].Parent() != loaded[1] {
+			t.Errorf("parent of keyframe 2 was not restored")
+		}
+		// the inverted index was rebuilt
+		var candidates []*KeyFrame
+		for _, kf := range wantCandidates {
+			candidates = append(candidates, loaded[kf.ID-kfs[0].ID])
+		}
+		assertKeyFrames(t, "loop candidates", db.DetectLoopCandidates(loaded[3], 0), candidates...)
+	}
+}
+
+func TestSaveLoadInertialMap(t *testing.T) {
+	s := newTestScene(30, [][]int{pointRange(0, 30), pointRange(0, 30), pointRange(0, 30)})
+	kfs := s.keyFrames
+	calib := imu.NewCalibration(geom.SE3{R: geom.ExpSO3(geom.Vec3{0, 0.1, 0}), T: geom.Vec3{0.05, 0, 0}}, 1.7e-4, 2e-3, 1.9e-5, 3e-3, 200)
+	for i, kf := range kfs[1:] {
+		p := imu.NewPreintegrated(imu.Bias{}, calib)
+		for j := 0; j < 50; j++ {
+			p.IntegrateNewMeasurement(geom.Vec3{0.1, 0, 9.81}, geom.Vec3{0, 0.2, 0}, 0.005)
+		}
+		kf.SetIMU(kfs[i], p)
+	}
+	for i, kf := range kfs {
+		kf.SetVelocity(geom.Vec3{float64(i), 0.5, 0})
+	}
+	kfs[2].SetBias(imu.Bias{Acc: geom.Vec3{0.02, 0, 0}, Gyro: geom.Vec3{0, 0, 0.01}})
+	s.m.Transform(geom.NewSim3(geom.Identity3(), geom.Vec3{}, 2))
+	s.m.SetIMUInitialized()
+
+	saved := saveMap(t, s.m, false)
+	m := NewMap()
+	if err := LoadMap(bytes.NewReader(saved), m, NewKeyFrameDatabase(), testVocabulary); err != nil {
+		t.Fatalf("LoadMap: %s", err)
+	}
+	if !bytes.Equal(saveMap(t, m, false), saved) {
+		t.Errorf("saving the loaded map gave a different file")
+	}
+	if !m.IsIMUInitialized() || m.Scale() != 2 {
+		t.Errorf("got IMU initialised %v and scale %v", m.IsIMUInitialized(), m.Scale())
+	}
+	loaded := m.KeyFrames()
+	if len(loaded) != len(kfs) {
+		t.Fatalf("loaded %d keyframes, want %d", len(loaded), len(kfs))
+	}
+	for i, kf := range loaded {
+		want := kfs[i]
+		if kf.Velocity() != want.Velocity() || kf.Bias() != want.Bias() {
+			t.Errorf("keyframe %d: got velocity %v and bias %+v, want %v and %+v", i, kf.Velocity(), kf.Bias(), want.Velocity(), want.Bias())
+		}
+		var prev, next *KeyFrame
+		if i > 0 {
+			prev = loaded[i-1]
+		}
+		if i+1 < len(loaded) {
+			next = loaded[i+1]
+		}
+		if kf.PrevKeyFrame() != prev || kf.NextKeyFrame() != next {
+			t.Errorf("keyframe %d is not linked in time", i)
+		}
+		p, wantP := kf.Preintegrated(), want.Preintegrated()
+		if (p == nil) != (wantP == nil) {
+			t.Fatalf("keyframe %d: got preintegration %v", i, p)
+		}
+		if p != nil && (p.DeltaT != wantP.DeltaT || p.Bias != wantP.Bias || p.DeltaVelocity(kf.Bias()) != wantP.DeltaVelocity(want.Bias()) || p.Calibration.Tcb != calib.Tcb) {
+			t.Errorf("keyframe %d: preintegration was not restored", i)
+		}
+	}
+}
+
+func TestLoadMapWrongVocabulary(t *testing.T) {
+	s := newTestScene(20, [][]int{pointRange(0, 20), pointRange(0, 20)})
+	saved := saveMap(t, s.m, true)
+	other := *testVocabulary
+	other.BranchingFactor = 3
+	err := LoadMap(bytes.NewReader(saved), NewMap(), NewKeyFrameDatabase(), &other)
+	if err == nil || !strings.Contains(err.Error(), "different vocabulary") {
+		t.Errorf("LoadMap with the wrong vocabulary: got error %v", err)
+	}
+	err = LoadMap(bytes.NewReader(saved[:len(saved)/2]), NewMap(), NewKeyFrameDatabase(), testVocabulary)
+	if err == nil {
+		t.Errorf("LoadMap of a truncated file: no error")
+	}
+}
+
+func TestLoadMapCorruptObservation(t *testing.T) {
+	s := newTestScene(20, [][]int{pointRange(0, 20)})
+	saved := saveMap(t, s.m, false)
+	// find the first point in the file, whose only observation is its last 12 bytes
+	var buf bytes.Buffer
+	e := &encoder{w: bufio.NewWriter(&buf)}
+	e.mapPoint(s.points[0], map[*KeyFrame]bool{s.keyFrames[0]: true})
+	e.w.Flush()
+	i := bytes.Index(saved, buf.Bytes())
+	if i < 0 {
+		t.Fatalf("point not found in the map file")
+	}
+	obs := i + buf.Len() - 12
+	binary.LittleEndian.PutUint64(saved[obs:], math.MaxUint64) // keyframe -1
+	err := LoadMap(bytes.NewReader(saved), NewMap(), NewKeyFrameDatabase(), testVocabulary)
+	if err == nil || !strings.Contains(err.Error(), "observed by no keyframe") {
+		t.Errorf("got error %v for an observation without a keyframe", err)
+	}
+}
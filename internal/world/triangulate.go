@@ -0,0 +1,80 @@
+package world
+
+import (
+	"github.com/kegsay/gorbslam/internal/geom"
+	"github.com/kegsay/gorbslam/internal/solver"
+)
+
+const (
+	// rays closer to parallel than this don't triangulate accurately
+	maxCosParallaxRays = 0.9998
+	// the chi-squared threshold (2 DoF) at 95% for the reprojection error of a new point
+	chi2Triangulation = 5.991
+)
+
+// Fundamental12 returns the fundamental matrix F12 between two views, such that x1' F12 x2 = 0
+// for matching pixels x1 and x2.
+func Fundamental12(f1, f2 *Features, pose1, pose2 geom.SE3) geom.Mat3 {
+	// T12 = T1w T2w^-1
+	t12 := pose1.Mul(pose2.Inverse())
+	e12 := geom.Skew(t12.T).Mul(t12.R.Matrix())
+	k1inv, _ := f1.Camera.K().Inverse()
+	k2inv, _ := f2.Camera.K().Inverse()
+	return k1inv.T().Mul(e12).Mul(k2inv)
+}
+
+// TriangulateMatch triangulates the point seen by keypoint idx1 of f1 at pose1 (Tcw) and keypoint
+// idx2 of f2 at pose2. As ORB-SLAM2 it returns false unless the viewing rays are far enough from
+// parallel, the point is in front of both cameras and reprojects close to both keypoints, and its
+// distances from the cameras are consistent with the octaves it was detected on.
+func TriangulateMatch(f1 *Features, pose1 geom.SE3, idx1 int, f2 *Features, pose2 geom.SE3, idx2 int) (geom.Vec3, bool) {
+	kp1, kp2 := &f1.KeyPoints[idx1], &f2.KeyPoints[idx2]
+	// the viewing rays must not be close to parallel
+	xn1 := f1.Camera.Unproject(kp1.X, kp1.Y)
+	xn2 := f2.Camera.Unproject(kp2.X, kp2.Y)
+	ray1 := pose1.R.Inverse().Rotate(xn1)
+	ray2 := pose2.R.Inverse().Rotate(xn2)
+	cosParallax := ray1.Dot(ray2) / (ray1.Norm() * ray2.Norm())
+	if cosParallax <= 0 || cosParallax >= maxCosParallaxRays {
+		return geom.Vec3{}, false
+	}
+	x, ok := solver.Triangulate(xn1[0], xn1[1], projectionMatrix(pose1), xn2[0], xn2[1], projectionMatrix(pose2))
+	if !ok {
+		return geom.Vec3{}, false
+	}
+	// in front of both cameras
+	pc1, pc2 := pose1.Transform(x), pose2.Transform(x)
+	if pc1[2] <= 0 || pc2[2] <= 0 {
+		return geom.Vec3{}, false
+	}
+	if !f1.reprojectionOK(pc1, idx1) || !f2.reprojectionOK(pc2, idx2) {
+		return geom.Vec3{}, false
+	}
+	// the distances to the point must be consistent with the octaves it was detected on
+	dist1, dist2 := x.Sub(pose1.Center()).Norm(), x.Sub(pose2.Center()).Norm()
+	if dist1 == 0 || dist2 == 0 {
+		return geom.Vec3{}, false
+	}
+	ratioFactor := 1.5 * f1.Pyramid.ScaleFactor
+	ratioDist := dist2 / dist1
+	ratioOctave := f1.Pyramid.ScaleFactors[kp1.Octave] / f2.Pyramid.ScaleFactors[kp2.Octave]
+	if ratioDist*ratioFactor < ratioOctave || ratioDist > ratioOctave*ratioFactor {
+		return geom.Vec3{}, false
+	}
+	return x, true
+}
+
+// reprojectionOK returns true if the point (in camera coordinates) projects within the 2 DoF
+// chi-squared threshold of keypoint i
+func (f *Features) reprojectionOK(pc geom.Vec3, i int) bool {
+	kp := &f.KeyPoints[i]
+	u, v := f.Camera.Project(pc)
+	eu, ev := u-kp.X, v-kp.Y
+	return eu*eu+ev*ev <= chi2Triangulation*f.Pyramid.Sigma2[kp.Octave]
+}
+
+// projectionMatrix returns the top 3 rows of Tcw, the projection matrix for normalised coordinates
+func projectionMatrix(tcw geom.SE3) [3][4]float64 {
+	m := tcw.Matrix()
+	return [3][4]float64{m[0], m[1], m[2]}
+}
@@ -0,0 +1,47 @@
+package world
+
+import (
+	"testing"
+
+	"github.com/kegsay/gorbslam/internal/feature"
+	"github.com/kegsay/gorbslam/internal/geom"
+)
+
+func TestTriangulateMatch(t *testing.T) {
+	x := geom.Vec3{0.3, -0.2, 4}
+	pose1 := geom.SE3{R: geom.IdentitySO3(), T: geom.Vec3{}}
+	// 50cm to the right, turned slightly towards the point
+	pose2 := geom.SE3{R: geom.ExpSO3(geom.Vec3{0, -0.05, 0}), T: geom.Vec3{}}
+	pose2.T = pose2.R.Rotate(geom.Vec3{-0.5, 0, 0})
+	features := func(pose geom.SE3, octave int) *Features {
+		u, v := testCamera.Project(pose.Transform(x))
+		kps := []feature.KeyPoint{{X: u, Y: v, Octave: octave}}
+		return NewFeatures(testCamera, testPyramid, kps, make([]feature.Descriptor, 1), 640, 480)
+	}
+
+	f1, f2 := features(pose1, 0), features(pose2, 0)
+	got, ok := TriangulateMatch(f1, pose1, 0, f2, pose2, 0)
+	if !ok || got.Sub(x).Norm() > 1e-6 {
+		t.Fatalf("got %v, %v want %v", got, ok, x)
+	}
+	// the fundamental matrix relates the keypoints
+	kp1, kp2 := f1.KeyPoints[0], f2.KeyPoints[0]
+	f12 := Fundamental12(f1, f2, pose1, pose2)
+	if e := (geom.Vec3{kp1.X, kp1.Y, 1}).Dot(f12.MulVec(geom.Vec3{kp2.X, kp2.Y, 1})); e > 1e-9 || e < -1e-9 {
+		t.Errorf("got epipolar error %v", e)
+	}
+
+	// seen from the same place, the rays are parallel
+	if _, ok := TriangulateMatch(f1, pose1, 0, features(pose1, 0), pose1, 0); ok {
+		t.Errorf("triangulated parallel rays")
+	}
+	// detected at very different scales from about the same distance
+	if _, ok := TriangulateMatch(f1, pose1, 0, features(pose2, 7), pose2, 0); ok {
+		t.Errorf("triangulated a point inconsistent with its octaves")
+	}
+	// a keypoint off the epipolar line doesn't reproject
+	f2.KeyPoints[0].Y += 20
+	if _, ok := TriangulateMatch(f1, pose1, 0, f2, pose2, 0); ok {
+		t.Errorf("triangulated a point which doesn't reproject")
+	}
+}
@@ -0,0 +1,121 @@
+// Package worldtest creates synthetic cameras, scenes and vocabularies for the tests of the
+// packages built on world, so that they all test against the same fixtures.
+package worldtest
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/kegsay/gorbslam/internal/bow"
+	"github.com/kegsay/gorbslam/internal/camera"
+	"github.com/kegsay/gorbslam/internal/feature"
+	"github.com/kegsay/gorbslam/internal/geom"
+	"github.com/kegsay/gorbslam/internal/world"
+)
+
+// The size of the images of Camera
+const (
+	Width  = 640
+	Height = 480
+)
+
+var (
+	// Camera is a pinhole camera without distortion, for Width x Height images
+	Camera = camera.Pinhole{Fx: 500, Fy: 500, Cx: 320, Cy: 240}
+	// Pyramid is the scale pyramid of ORB-SLAM2's default settings
+	Pyramid = feature.NewScalePyramid(8, 1.2)
+)
+
+// RandomDescriptor returns a descriptor of random bits
+func RandomDescriptor(rng *rand.Rand) feature.Descriptor {
+	var d feature.Descriptor
+	rng.Read(d[:])
+	return d
+}
+
+// FlatVocabulary returns a vocabulary of n random words, all under the root node. Every descriptor
+// is then under the same node, so BoW searches compare every pair of descriptors, which is slow
+// but fine for a test.
+func FlatVocabulary(rng *rand.Rand, n int) *bow.Vocabulary {
+	v := bow.NewVocabulary(n, 1)
+	for i := 0; i < n; i++ {
+		v.AddWord(0, RandomDescriptor(rng), 1)
+	}
+	return v
+}
+
+// Scene is a cloud of points, each with its own descriptor
+type Scene struct {
+	// The source of pixel noise
+	Rng         *rand.Rand
+	Points      []geom.Vec3
+	Descriptors []feature.Descriptor
+}
+
+// NewScene returns an empty scene, using rng for descriptors and noise
+func NewScene(rng *rand.Rand) *Scene {
+	return &Scene{Rng: rng}
+}
+
+// Add adds a point to the scene with a random descriptor
+func (s *Scene) Add(p geom.Vec3) {
+	s.Points = append(s.Points, p)
+	s.Descriptors = append(s.Descriptors, RandomDescriptor(s.Rng))
+}
+
+// Frame creates a frame of the points visible from the camera pose tcw, with pixel noise. The
+// frame's pose is set to tcw.
+func (s *Scene) Frame(tcw geom.SE3, noise float64) *world.Frame {
+	return s.FrameWithout(tcw, noise, nil)
+}
+
+// FrameWithout is Frame, leaving out the points for which hide returns true
+func (s *Scene) FrameWithout(tcw geom.SE3, noise float64, hide func(i int) bool) *world.Frame {
+	kps, descs, _ := s.keyPoints(tcw, noise, hide)
+	return newFrame(world.NewFeatures(Camera, Pyramid, kps, descs, Width, Height), tcw)
+}
+
+// StereoFrame is FrameWithout for a stereo camera with the baseline bf/fx, which measures the
+// depths exactly
+func (s *Scene) StereoFrame(tcw geom.SE3, noise, bf, thDepth float64, hide func(i int) bool) *world.Frame {
+	kps, descs, depth := s.keyPoints(tcw, noise, hide)
+	features := world.NewFeatures(Camera, Pyramid, kps, descs, Width, Height)
+	uRight := make([]float64, len(kps))
+	for i, kp := range kps {
+		uRight[i] = kp.X - bf/depth[i]
+	}
+	features.SetStereo(uRight, depth, bf, thDepth)
+	return newFrame(features, tcw)
+}
+
+func newFrame(features *world.Features, tcw geom.SE3) *world.Frame {
+	f := world.NewFrame(features, time.Time{})
+	f.SetPose(tcw)
+	return f
+}
+
+// keyPoints projects the points visible from tcw, returning their keypoints, descriptors and depths
+func (s *Scene) keyPoints(tcw geom.SE3, noise float64, hide func(i int) bool) ([]feature.KeyPoint, []feature.Descriptor, []float64) {
+	var kps []feature.KeyPoint
+	var descs []feature.Descriptor
+	var depth []float64
+	for i, p := range s.Points {
+		if hide != nil && hide(i) {
+			continue
+		}
+		pc := tcw.Transform(p)
+		if pc[2] <= 0 {
+			continue
+		}
+		u, v := Camera.Project(pc)
+		u += s.Rng.NormFloat64() * noise
+		v += s.Rng.NormFloat64() * noise
+		if u < 0 || u >= Width || v < 0 || v >= Height {
+			continue
+		}
+		kps = append(kps, feature.KeyPoint{X: u, Y: v})
+		descs = append(descs, s.Descriptors[i])
+		depth = append(depth, pc[2])
+	}
+	return kps, descs, depth
+}
@@ -0,0 +1,64 @@
+package slam
+
+import (
+	"encoding/binary"
+	"image/color"
+	"math"
+
+	"github.com/kegsay/gorbslam/internal/camera"
+	"gocv.io/x/gocv"
+)
+
+// rectifier rectifies the images of a stereo pair with the remap tables of a StereoRectification,
+// which are copied into OpenCV once so that each pair is a pair of cv::remap calls.
+type rectifier struct {
+	// the x and y tables of the left image, then those of the right
+	maps [4]gocv.Mat
+	// reused to hold the rectified images
+	left, right gocv.Mat
+}
+
+func newRectifier(r *camera.StereoRectification) (*rectifier, error) {
+	leftX, leftY := r.LeftMaps()
+	rightX, rightY := r.RightMaps()
+	rect := &rectifier{}
+	for i, table := range [][]float32{leftX, leftY, rightX, rightY} {
+		m, err := float32Mat(table, r.Height, r.Width)
+		if err != nil {
+			for j := 0; j < i; j++ {
+				rect.maps[j].Close()
+			}
+			return nil, err
+		}
+		rect.maps[i] = m
+	}
+	rect.left, rect.right = gocv.NewMat(), gocv.NewMat()
+	return rect, nil
+}
+
+// float32Mat copies a table of rows x cols values, row by row, into a single channel float Mat
+func float32Mat(values []float32, rows, cols int) (gocv.Mat, error) {
+	b := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.LittleEndian.PutUint32(b[4*i:], math.Float32bits(v))
+	}
+	return gocv.NewMatFromBytes(rows, cols, gocv.MatTypeCV32F, b)
+}
+
+// rectify returns the rectified images, which are only valid until the next call
+func (r *rectifier) rectify(left, right gocv.Mat) (gocv.Mat, gocv.Mat) {
+	gocv.Remap(left, &r.left, &r.maps[0], &r.maps[1], gocv.InterpolationLinear, gocv.BorderConstant, color.RGBA{})
+	gocv.Remap(right, &r.right, &r.maps[2], &r.maps[3], gocv.InterpolationLinear, gocv.BorderConstant, color.RGBA{})
+	return r.left, r.right
+}
+
+// Close releases the tables and images
+func (r *rectifier) Close() error {
+	var err error
+	for _, m := range []*gocv.Mat{&r.maps[0], &r.maps[1], &r.maps[2], &r.maps[3], &r.left, &r.right} {
+		if cerr := m.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,639 @@
+// Package slam is the entry point for using gorbslam as a library. A System runs the three
+// ORB-SLAM2 goroutines (tracking, local mapping and loop closing) and is fed one image at a time:
+//
+//	sys, err := slam.NewSystem("ORBvoc.txt", "TUM1.yaml", slam.Monocular)
+//	...
+//	pose, state, err := sys.TrackMonocular(img, timestamp)
+//	...
+//	err = sys.Shutdown(ctx)
+//
+// This mirrors ORB_SLAM2::System.
+package slam
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/draw"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/kegsay/gorbslam/internal/bow"
+	"github.com/kegsay/gorbslam/internal/camera"
+	"github.com/kegsay/gorbslam/internal/geom"
+	"github.com/kegsay/gorbslam/internal/imu"
+	"github.com/kegsay/gorbslam/internal/loopclosing"
+	"github.com/kegsay/gorbslam/internal/mapping"
+	"github.com/kegsay/gorbslam/internal/matching"
+	"github.com/kegsay/gorbslam/internal/orb"
+	"github.com/kegsay/gorbslam/internal/settings"
+	"github.com/kegsay/gorbslam/internal/tracking"
+	"github.com/kegsay/gorbslam/internal/world"
+	"gocv.io/x/gocv"
+)
+
+// Pose is a camera pose Tcw: the transformation from world to camera coordinates.
+type Pose = geom.SE3
+
+// DepthImage is the depth image of an RGB-D camera, registered to its colour image. Load one with
+// System.LoadDepthImage.
+type DepthImage = camera.DepthImage
+
+// IMUMeasurement is a sample of the accelerometer and gyroscope of the IMU rigidly attached to the
+// camera, in the IMU's own frame. Read a EuRoC file of them with LoadIMU.
+type IMUMeasurement = imu.Measurement
+
+// TrackingState is the state of the tracker after a frame
+type TrackingState = tracking.State
+
+// The tracking states, as documented on tracking.State
+const (
+	NoImagesYet    = tracking.NoImagesYet
+	NotInitialized = tracking.NotInitialized
+	OK             = tracking.OK
+	Lost           = tracking.Lost
+)
+
+// Sensor is the kind of camera images come from
+type Sensor int
+
+const (
+	// Monocular is a single camera. The map has an arbitrary scale.
+	Monocular Sensor = iota
+	// Stereo is a pair of cameras whose images are rectified, so that a point lies on the same
+	// row of both. The settings must give the baseline as Camera.bf. The map has the true scale.
+	Stereo
+	// RGBD is a colour camera with a depth sensor, whose depth image is registered to the colour
+	// one. The settings must give Camera.bf, a virtual baseline used to weigh the depths, and
+	// DepthMapFactor to scale the depths to metres. The map has the true scale.
+	RGBD
+	// MonocularInertial is a single camera with an IMU, whose calibration the settings must give.
+	// The map is aligned with gravity and has the true scale once the IMU is initialised.
+	MonocularInertial
+	// StereoInertial is a stereo pair as Stereo, with an IMU as MonocularInertial
+	StereoInertial
+)
+
+func (s Sensor) stereo() bool {
+	return s == Stereo || s == StereoInertial
+}
+
+func (s Sensor) inertial() bool {
+	return s == MonocularInertial || s == StereoInertial
+}
+
+// System runs SLAM on the images from a camera. Its methods are safe for concurrent use, but
+// images are tracked one at a time.
+type System struct {
+	sensor    Sensor
+	settings  *settings.Settings
+	voc       *bow.Vocabulary
+	extractor *orb.Extractor
+	// extracts from the right image of a stereo pair, at the same time as extractor does the left
+	rightExtractor *orb.Extractor
+	// rectifies stereo pairs, nil if they are already rectified
+	rectifier *rectifier
+
+	m       *world.Map
+	db      *world.KeyFrameDatabase
+	atlas   *world.Atlas
+	tracker *tracking.Tracker
+	mapper  *mapping.LocalMapping
+	closer  *loopclosing.LoopClosing
+
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	frames  chan *world.Frame
+	results chan tracking.Result
+
+	// held while tracking an image, so also guards the tracker between images
+	mu sync.Mutex
+	// reused to hold the grayscale images
+	gray      gocv.Mat
+	grayRight gocv.Mat
+	// the size of the last image, and its bounds once undistorted
+	width, height          int
+	minX, maxX, minY, maxY float64
+	state                  TrackingState
+	localizationMode       bool
+	trajectory             []trajectoryFrame
+	isShutdown             bool
+}
+
+// NewSystem loads the ORB vocabulary and the camera settings and starts the SLAM goroutines.
+// Shutdown must be called when done with the system.
+func NewSystem(vocabularyFile, settingsFile string, sensor Sensor) (*System, error) {
+	if sensor < Monocular || sensor > StereoInertial {
+		return nil, fmt.Errorf("unsupported sensor %d", sensor)
+	}
+	s, err := settings.NewSettingsFromFile(settingsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read settings: %s", err)
+	}
+	if sensor.inertial() && s.IMU == nil {
+		return nil, fmt.Errorf("inertial settings must give the IMU calibration")
+	}
+	var rect *rectifier
+	if sensor.stereo() && s.Right != nil {
+		// everything after rectification sees the images of the rectified camera
+		sr := camera.NewStereoRectification(s.Camera, s.Right.Camera, s.Distortion, s.Right.Distortion, s.Right.Tlr, s.Width, s.Height)
+		rectified := *s
+		rectified.Camera, rectified.Distortion, rectified.Bf, rectified.Right = sr.Camera, camera.Distortion{}, sr.Bf(), nil
+		if s.IMU != nil {
+			// the rectified camera is rotated from the left one
+			calib := *s.IMU
+			calib.Tbc = calib.Tbc.Mul(geom.SE3{R: geom.NewSO3(sr.R1).Inverse()})
+			calib.Tcb = calib.Tbc.Inverse()
+			rectified.IMU = &calib
+		}
+		s = &rectified
+		if rect, err = newRectifier(sr); err != nil {
+			return nil, fmt.Errorf("failed to create the rectification maps: %s", err)
+		}
+	}
+	if sensor != Monocular && sensor != MonocularInertial && s.Bf <= 0 {
+		return nil, fmt.Errorf("stereo and RGB-D settings must give Camera.bf, or the right camera of an unrectified pair")
+	}
+	voc, err := bow.NewVocabularyFromFile(vocabularyFile)
+	if err != nil {
+		if rect != nil {
+			rect.Close()
+		}
+		return nil, fmt.Errorf("failed to read vocabulary: %s", err)
+	}
+	sys := newSystem(voc, s, sensor)
+	sys.rectifier = rect
+	return sys, nil
+}
+
+func newSystem(voc *bow.Vocabulary, s *settings.Settings, sensor Sensor) *System {
+	m := world.NewMap()
+	db := world.NewKeyFrameDatabase()
+	atlas := world.NewAtlas(m, db)
+	mapper := mapping.NewLocalMapping(m, voc)
+	// a monocular map has no fixed scale, so loops are closed with a similarity
+	closer := loopclosing.NewLoopClosing(m, db, sensor != Monocular && sensor != MonocularInertial)
+	tracker := tracking.NewTracker(voc, m, mapper, s.FPS)
+	if sensor.inertial() {
+		tracker.SetIMU(s.IMU)
+	}
+	mapper.SetLoopCloser(closer)
+	closer.SetLocalMapper(mapper)
+	tracker.SetLoopCloser(closer)
+	tracker.SetKeyFrameDatabase(db)
+	// maps started when tracking is lost for too long are merged back by loop closing
+	tracker.SetAtlas(atlas)
+	closer.SetAtlas(atlas)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sys := &System{
+		sensor:    sensor,
+		settings:  s,
+		voc:       voc,
+		extractor: orb.NewExtractor(s.ORB.NumFeatures, s.ORB.ScaleFactor, s.ORB.NumLevels, s.ORB.IniThFAST),
+		m:         m,
+		db:        db,
+		atlas:     atlas,
+		tracker:   tracker,
+		mapper:    mapper,
+		closer:    closer,
+		cancel:    cancel,
+		frames:    make(chan *world.Frame),
+		results:   make(chan tracking.Result),
+		gray:      gocv.NewMat(),
+		grayRight: gocv.NewMat(),
+	}
+	if sensor.stereo() {
+		sys.rightExtractor = orb.NewExtractor(s.ORB.NumFeatures, s.ORB.ScaleFactor, s.ORB.NumLevels, s.ORB.IniThFAST)
+	}
+	sys.wg.Add(3)
+	go func() {
+		defer sys.wg.Done()
+		mapper.Run(ctx)
+	}()
+	go func() {
+		defer sys.wg.Done()
+		closer.Run(ctx)
+	}()
+	go func() {
+		defer sys.wg.Done()
+		tracker.Run(ctx, sys.frames, sys.results)
+	}()
+	return sys
+}
+
+// TrackMonocular tracks an image taken at the given time, which may be grayscale or colour. The
+// colour order is given by Camera.RGB in the settings. The pose is only valid if the state is OK.
+// Returns an error after Shutdown, or if the system was not created for a monocular sensor.
+func (s *System) TrackMonocular(img gocv.Mat, timestamp time.Time) (Pose, TrackingState, error) {
+	return s.TrackMonocularInertial(img, timestamp, nil)
+}
+
+// TrackMonocularInertial is TrackMonocular with the IMU measurements taken since the previous
+// image, oldest first. The system must have been created for a MonocularInertial sensor for them
+// to be used.
+func (s *System) TrackMonocularInertial(img gocv.Mat, timestamp time.Time, ms []IMUMeasurement) (Pose, TrackingState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkSensor(Monocular, MonocularInertial); err != nil {
+		return Pose{}, s.state, err
+	}
+	gray := img
+	if code, ok := s.grayConversion(img.Channels()); ok {
+		gocv.CvtColor(img, &s.gray, code)
+		gray = s.gray
+	}
+	pose, state := s.track(gray, timestamp, ms)
+	return pose, state, nil
+}
+
+// TrackMonocularImage is TrackMonocular for a Go image.
+func (s *System) TrackMonocularImage(img image.Image, timestamp time.Time) (Pose, TrackingState, error) {
+	// image.Gray uses the same weights as OpenCV when converting from colour
+	bounds := img.Bounds()
+	gray := image.NewGray(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(gray, gray.Bounds(), img, bounds.Min, draw.Src)
+	mat, err := gocv.NewMatFromBytes(gray.Rect.Dy(), gray.Rect.Dx(), gocv.MatTypeCV8U, gray.Pix)
+	if err != nil {
+		return Pose{}, s.State(), fmt.Errorf("failed to convert image: %s", err)
+	}
+	defer mat.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkSensor(Monocular, MonocularInertial); err != nil {
+		return Pose{}, s.state, err
+	}
+	pose, state := s.track(mat, timestamp, nil)
+	return pose, state, nil
+}
+
+// checkSensor returns an error if the system is shut down or was not created for one of the given
+// sensors. Must be called with the lock held.
+func (s *System) checkSensor(sensors ...Sensor) error {
+	if s.isShutdown {
+		return fmt.Errorf("system is shut down")
+	}
+	for _, sensor := range sensors {
+		if s.sensor == sensor {
+			return nil
+		}
+	}
+	return fmt.Errorf("system was created for sensor %d, not %d", s.sensor, sensors[0])
+}
+
+// grayConversion returns the colour conversion for an image with this many channels, false if
+// it is already grayscale
+func (s *System) grayConversion(channels int) (gocv.ColorConversionCode, bool) {
+	switch channels {
+	case 3:
+		if s.settings.RGB {
+			return gocv.ColorRGBToGray, true
+		}
+		return gocv.ColorBGRToGray, true
+	case 4:
+		if s.settings.RGB {
+			return gocv.ColorRGBAToGray, true
+		}
+		return gocv.ColorBGRAToGray, true
+	}
+	return 0, false
+}
+
+// TrackStereo tracks a stereo pair taken at the given time, as TrackMonocular. The pair is
+// rectified first if the settings describe the right camera, otherwise it must already be. The
+// system must have been created for a Stereo sensor, otherwise an error is returned.
+func (s *System) TrackStereo(left, right gocv.Mat, timestamp time.Time) (Pose, TrackingState, error) {
+	return s.TrackStereoInertial(left, right, timestamp, nil)
+}
+
+// TrackStereoInertial is TrackStereo with the IMU measurements taken since the previous pair, as
+// TrackMonocularInertial. The system must have been created for a StereoInertial sensor.
+func (s *System) TrackStereoInertial(left, right gocv.Mat, timestamp time.Time, ms []IMUMeasurement) (Pose, TrackingState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkSensor(Stereo, StereoInertial); err != nil {
+		return Pose{}, s.state, err
+	}
+	grayLeft, grayRight := left, right
+	if code, ok := s.grayConversion(left.Channels()); ok {
+		gocv.CvtColor(left, &s.gray, code)
+		grayLeft = s.gray
+	}
+	if code, ok := s.grayConversion(right.Channels()); ok {
+		gocv.CvtColor(right, &s.grayRight, code)
+		grayRight = s.grayRight
+	}
+	if s.rectifier != nil {
+		grayLeft, grayRight = s.rectifier.rectify(grayLeft, grayRight)
+	}
+	pose, state := s.trackStereo(grayLeft, grayRight, timestamp, ms)
+	return pose, state, nil
+}
+
+// TrackRGBD tracks a colour image and the depth image registered to it, taken at the given time, as
+// TrackMonocular. The system must have been created for an RGBD sensor, otherwise an error is
+// returned, as it is for a missing or empty depth image.
+func (s *System) TrackRGBD(img gocv.Mat, depth *DepthImage, timestamp time.Time) (Pose, TrackingState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkSensor(RGBD); err != nil {
+		return Pose{}, s.state, err
+	}
+	if depth == nil || depth.Gray16 == nil || depth.Rect.Empty() {
+		return Pose{}, s.state, fmt.Errorf("no depth image")
+	}
+	gray := img
+	if code, ok := s.grayConversion(img.Channels()); ok {
+		gocv.CvtColor(img, &s.gray, code)
+		gray = s.gray
+	}
+	s.updateBounds(gray)
+	features := s.extract(s.extractor, gray)
+	depths := make([]float64, len(features.KeyPoints))
+	cam, dist := s.settings.Camera, s.settings.Distortion
+	for i, kp := range features.KeyPoints {
+		// the depth image is distorted like the colour one
+		u, v := cam.Distort(dist, kp.X, kp.Y)
+		depths[i] = depth.Depth(u, v)
+	}
+	features.SetRGBD(depths, s.settings.Bf, s.settings.DepthThreshold())
+	pose, state := s.trackFeatures(features, timestamp, nil)
+	return pose, state, nil
+}
+
+// LoadDepthImage reads a depth image for TrackRGBD from a 16-bit grayscale PNG file, whose depths
+// are scaled to metres by DepthMapFactor in the settings.
+func (s *System) LoadDepthImage(filename string) (*DepthImage, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return camera.ReadDepthPNG(f, s.settings.DepthMapFactor)
+}
+
+// LoadIMU reads the IMU measurements of a EuRoC imu0/data.csv file, oldest first.
+func LoadIMU(filename string) ([]IMUMeasurement, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return imu.ReadEuRoCCSV(f)
+}
+
+// track extracts features from a grayscale image and hands them to the tracker. Must be called
+// with the lock held.
+func (s *System) track(gray gocv.Mat, timestamp time.Time, ms []IMUMeasurement) (Pose, TrackingState) {
+	s.updateBounds(gray)
+	return s.trackFeatures(s.extract(s.extractor, gray), timestamp, ms)
+}
+
+// trackStereo extracts features from both images of a grayscale stereo pair at once, and finds the
+// depth of the left keypoints by matching them to the right ones. Must be called with the lock held.
+func (s *System) trackStereo(left, right gocv.Mat, timestamp time.Time, ms []IMUMeasurement) (Pose, TrackingState) {
+	s.updateBounds(left)
+	var rightFeatures *world.Features
+	var leftImages, rightImages []*image.Gray
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		rightFeatures = s.extract(s.rightExtractor, right)
+		rightImages, _ = s.rightExtractor.PyramidImages(right)
+	}()
+	leftFeatures := s.extract(s.extractor, left)
+	leftImages, err := s.extractor.PyramidImages(left)
+	wg.Wait()
+	if err != nil || len(rightImages) == 0 {
+		// without the images no keypoint gets a depth, but the frame is still a stereo one
+		leftImages = nil
+	}
+	uRight, depth := matching.ComputeStereoMatches(leftFeatures, rightFeatures, leftImages, rightImages, s.settings.Bf)
+	leftFeatures.SetStereo(uRight, depth, s.settings.Bf, s.settings.DepthThreshold())
+	return s.trackFeatures(leftFeatures, timestamp, ms)
+}
+
+// updateBounds recomputes the undistorted image bounds when the image size changes
+func (s *System) updateBounds(gray gocv.Mat) {
+	if gray.Cols() != s.width || gray.Rows() != s.height {
+		s.width, s.height = gray.Cols(), gray.Rows()
+		s.minX, s.maxX, s.minY, s.maxY = s.settings.Camera.UndistortedBounds(s.settings.Distortion, s.width, s.height)
+	}
+}
+
+// extract detects the features of a grayscale image, with undistorted keypoints. More are
+// extracted while the map is being initialised.
+func (s *System) extract(extractor *orb.Extractor, gray gocv.Mat) *world.Features {
+	initial := s.state == NoImagesYet || s.state == NotInitialized
+	keyPoints, descriptors, err := extractor.Extract(gray, initial)
+	if err != nil {
+		// treat it as an image with no features, which the tracker can't track
+		keyPoints, descriptors = nil, nil
+	}
+	cam, dist := s.settings.Camera, s.settings.Distortion
+	for i := range keyPoints {
+		keyPoints[i].X, keyPoints[i].Y = cam.Undistort(dist, keyPoints[i].X, keyPoints[i].Y)
+	}
+	return world.NewFeaturesInBounds(cam, extractor.Pyramid, keyPoints, descriptors, s.minX, s.maxX, s.minY, s.maxY)
+}
+
+// trackFeatures hands a frame to the tracker and waits for the result, with the IMU measurements
+// since the previous frame if the sensor has an IMU. Must be called with the lock held.
+func (s *System) trackFeatures(features *world.Features, timestamp time.Time, ms []IMUMeasurement) (Pose, TrackingState) {
+	f := world.NewFrame(features, timestamp)
+	if s.sensor.inertial() {
+		f.IMU = ms
+	}
+	s.frames <- f
+	res, ok := <-s.results
+	if !ok {
+		return Pose{}, NoImagesYet
+	}
+	s.state = res.State
+	s.recordTrajectory(res)
+	return res.Pose, res.State
+}
+
+// State returns the tracking state after the last image
+func (s *System) State() TrackingState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+// Reset throws away every map and starts initialising again from the next image.
+func (s *System) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.isShutdown {
+		return
+	}
+	s.tracker.Reset()
+	s.atlas.Clear()
+	s.state = NoImagesYet
+	s.trajectory = nil
+}
+
+// ActivateLocalizationMode tracks the camera against the map without changing it: local mapping
+// and loop closing are paused, and the tracker creates no keyframes. When the camera leaves the
+// map it is tracked by visual odometry until it can be relocalised. Blocks until any map update in
+// progress is done, so the map is not changed once this returns.
+func (s *System) ActivateLocalizationMode() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.isShutdown || s.localizationMode {
+		return
+	}
+	s.stopMapUpdates()
+	s.tracker.SetOnlyTracking(true)
+	s.localizationMode = true
+}
+
+// stopMapUpdates pauses local mapping and loop closing, blocking until any map update in progress
+// is done.
+func (s *System) stopMapUpdates() {
+	// loop closing first, as correcting a loop stops and then releases local mapping
+	s.closer.Pause()
+	s.mapper.RequestStop()
+	for !s.mapper.IsStopped() {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// resumeMapUpdates undoes stopMapUpdates
+func (s *System) resumeMapUpdates() {
+	s.mapper.Release()
+	s.closer.Resume()
+}
+
+// DeactivateLocalizationMode resumes building the map.
+func (s *System) DeactivateLocalizationMode() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.isShutdown || !s.localizationMode {
+		return
+	}
+	s.tracker.SetOnlyTracking(false)
+	s.resumeMapUpdates()
+	s.localizationMode = false
+}
+
+// SaveMap writes the active map to a file, gzipped if compress is set, so that it can be reused with
+// LoadMap. Mapping is paused while the map is saved.
+func (s *System) SaveMap(filename string, compress bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.isShutdown && !s.localizationMode {
+		s.stopMapUpdates()
+		defer s.resumeMapUpdates()
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := world.SaveMap(f, s.m, s.voc, compress); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to save map: %s", err)
+	}
+	return f.Close()
+}
+
+// LoadMap replaces the map with one saved by SaveMap with the same vocabulary. The camera is then
+// relocalised in it from the next image, in localisation mode or to carry on mapping.
+func (s *System) LoadMap(filename string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.isShutdown {
+		return fmt.Errorf("system is shut down")
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if !s.localizationMode {
+		s.stopMapUpdates()
+		defer s.resumeMapUpdates()
+	}
+	s.tracker.Reset()
+	s.state = NoImagesYet
+	s.trajectory = nil
+	if err := world.LoadMap(f, s.m, s.db, s.voc); err != nil {
+		// don't leave half a map behind
+		s.tracker.Reset()
+		return fmt.Errorf("failed to load map: %s", err)
+	}
+	return nil
+}
+
+// AddMap loads a map saved by SaveMap with the same vocabulary, alongside the active map. It is
+// merged into the active map if the camera sees somewhere in both.
+func (s *System) AddMap(filename string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.isShutdown {
+		return fmt.Errorf("system is shut down")
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	m := world.NewMap()
+	if err := world.LoadMap(f, m, world.NewKeyFrameDatabase(), s.voc); err != nil {
+		return fmt.Errorf("failed to load map: %s", err)
+	}
+	s.atlas.AddMap(m)
+	return nil
+}
+
+// NumMaps returns the number of maps, including the active one
+func (s *System) NumMaps() int {
+	return s.atlas.NumMaps()
+}
+
+// Shutdown stops the SLAM goroutines, aborting any global bundle adjustment in progress, and
+// releases the OpenCV resources. Returns the context's error if it is done before every goroutine
+// has returned. The map and trajectories can still be read afterwards.
+func (s *System) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.isShutdown {
+		return nil
+	}
+	s.isShutdown = true
+	close(s.frames)
+	s.cancel()
+	// the extractors and gray images are only used with the lock held, so are free now
+	err := s.extractor.Close()
+	if s.rightExtractor != nil {
+		if rerr := s.rightExtractor.Close(); err == nil {
+			err = rerr
+		}
+	}
+	if s.rectifier != nil {
+		if rerr := s.rectifier.Close(); err == nil {
+			err = rerr
+		}
+	}
+	for _, gray := range []*gocv.Mat{&s.gray, &s.grayRight} {
+		if gerr := gray.Close(); err == nil {
+			err = gerr
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return err
+}
@@ -0,0 +1,87 @@
+package slam
+
+import (
+	"time"
+
+	"github.com/kegsay/gorbslam/internal/geom"
+	"github.com/kegsay/gorbslam/internal/tracking"
+	"github.com/kegsay/gorbslam/internal/world"
+)
+
+// TimedPose is the pose of the camera when an image was taken
+type TimedPose struct {
+	Timestamp time.Time
+	Pose      Pose
+}
+
+// trajectoryFrame records a tracked image relative to its reference keyframe rather than the
+// world, so that its pose follows the keyframe when local mapping or loop closing moves it.
+type trajectoryFrame struct {
+	timestamp time.Time
+	reference *world.KeyFrame
+	// Tcr: the pose relative to the reference keyframe
+	relative geom.SE3
+	lost     bool
+}
+
+// recordTrajectory remembers where the camera was for the result. Must be called with the lock held.
+func (s *System) recordTrajectory(res tracking.Result) {
+	switch res.State {
+	case tracking.OK:
+		s.trajectory = append(s.trajectory, trajectoryFrame{
+			timestamp: res.Timestamp,
+			reference: res.ReferenceKeyFrame,
+			relative:  res.Pose.Mul(res.ReferenceKeyFrame.Pose().Inverse()),
+		})
+	case tracking.Lost:
+		// as ORB-SLAM2, assume the camera stayed where it was last seen
+		if len(s.trajectory) > 0 {
+			last := s.trajectory[len(s.trajectory)-1]
+			last.timestamp = res.Timestamp
+			last.lost = true
+			s.trajectory = append(s.trajectory, last)
+		}
+	default:
+		// the map has been reset, taking the reference keyframes with it
+		s.trajectory = nil
+	}
+}
+
+// Trajectory returns the pose of the camera for every image it was tracked in since the map was
+// created, as currently estimated. Images taken while lost are left out.
+func (s *System) Trajectory() []TimedPose {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var poses []TimedPose
+	for _, tf := range s.trajectory {
+		if tf.lost {
+			continue
+		}
+		// the reference keyframe may have been culled, in which case follow the spanning tree
+		// up to a keyframe which is still in the map
+		kf := tf.reference
+		trw := geom.IdentitySE3()
+		for kf != nil && kf.IsBad() {
+			trw = trw.Mul(kf.RelativeToParent())
+			kf = kf.Parent()
+		}
+		if kf == nil {
+			continue
+		}
+		trw = trw.Mul(kf.Pose())
+		poses = append(poses, TimedPose{Timestamp: tf.timestamp, Pose: tf.relative.Mul(trw)})
+	}
+	return poses
+}
+
+// KeyFrameTrajectory returns the pose of every keyframe in the map, ordered by creation.
+func (s *System) KeyFrameTrajectory() []TimedPose {
+	var poses []TimedPose
+	for _, kf := range s.m.KeyFrames() {
+		if kf.IsBad() {
+			continue
+		}
+		poses = append(poses, TimedPose{Timestamp: kf.Timestamp, Pose: kf.Pose()})
+	}
+	return poses
+}